@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// runCommand executa um comando de administração e retorna o código de saída
+func runCommand(store storage.Storage, args []string) int {
+	switch args[0] {
+	case "deliveries":
+		return listDeliveries(store, args[1:])
+	case "webhooks":
+		return listWebhookDeliveries(store, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "comando desconhecido: %s\n", args[0])
+		fmt.Fprintln(os.Stderr, "uso: simpleEmail [deliveries [-n limite] [consulta] | webhooks [-n limite] [webhook|evento]]")
+		return 2
+	}
+}
+
+// listDeliveries imprime o histórico de entregas externas. A consulta pode
+// ser o identificador na fila, o Message-ID, o remetente ou o destinatário.
+func listDeliveries(store storage.Storage, args []string) int {
+	flags := flag.NewFlagSet("deliveries", flag.ContinueOnError)
+	limit := flags.Int("n", 50, "número máximo de registros exibidos")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	records, err := store.ListDeliveries(strings.Join(flags.Args(), " "), *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Erro ao consultar entregas: %v\n", err)
+		return 1
+	}
+	if len(records) == 0 {
+		fmt.Println("Nenhuma entrega encontrada.")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATA\tFILA\tESTADO\tTENTATIVAS\tREMETENTE\tDESTINATÁRIO\tSERVIDOR\tDETALHE")
+	for _, r := range records {
+		sender := r.Sender
+		if sender == "" {
+			sender = "<>"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n", r.Created.Format("2006-01-02 15:04:05"), r.QueueID,
+			r.Status, r.Attempts, sender, r.Recipient, r.RemoteHost, r.Detail)
+	}
+	w.Flush()
+	return 0
+}
+
+// listWebhookDeliveries imprime o histórico de chamadas de webhooks. A
+// consulta pode ser o nome do webhook ou o identificador do evento.
+func listWebhookDeliveries(store storage.Storage, args []string) int {
+	flags := flag.NewFlagSet("webhooks", flag.ContinueOnError)
+	limit := flags.Int("n", 50, "número máximo de registros exibidos")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	deliveries, err := store.ListWebhookDeliveries(strings.Join(flags.Args(), " "), *limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Erro ao consultar webhooks: %v\n", err)
+		return 1
+	}
+	if len(deliveries) == 0 {
+		fmt.Println("Nenhuma chamada de webhook encontrada.")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DATA\tWEBHOOK\tEVENTO\tESTADO\tTENTATIVA\tHTTP\tURL\tDETALHE")
+	for _, d := range deliveries {
+		code := "-"
+		if d.StatusCode != 0 {
+			code = fmt.Sprint(d.StatusCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", d.Created.Format("2006-01-02 15:04:05"), d.Hook,
+			d.EventID, d.Status, d.Attempt, code, d.URL, d.Detail)
+	}
+	w.Flush()
+	return 0
+}
@@ -10,10 +10,21 @@ import (
 
 // Config representa a configuração global do sistema
 type Config struct {
-	Database DatabaseConfig `mapstructure:"database"`
-	SMTP     SMTPConfig     `mapstructure:"smtp"`
-	IMAP     IMAPConfig     `mapstructure:"imap"`
-	POP3     POP3Config     `mapstructure:"pop3"`
+	Database    DatabaseConfig    `mapstructure:"database"`
+	SMTP        SMTPConfig        `mapstructure:"smtp"`
+	IMAP        IMAPConfig        `mapstructure:"imap"`
+	POP3        POP3Config        `mapstructure:"pop3"`
+	ManageSieve ManageSieveConfig `mapstructure:"managesieve"`
+	JMAP        JMAPConfig        `mapstructure:"jmap"`
+	Webmail     WebmailConfig     `mapstructure:"webmail"`
+	API         APIConfig         `mapstructure:"api"`
+	Outbound    OutboundConfig    `mapstructure:"outbound"`
+	SRS         SRSConfig         `mapstructure:"srs"`
+	Quota       QuotaConfig       `mapstructure:"quota"`
+	Webhooks    WebhooksConfig    `mapstructure:"webhooks"`
+	Spam        SpamConfig        `mapstructure:"spam"`
+	Bayes       BayesConfig       `mapstructure:"bayes"`
+	Antivirus   AntivirusConfig   `mapstructure:"antivirus"`
 }
 
 // DatabaseConfig representa a configuração do banco de dados
@@ -29,11 +40,13 @@ type DatabaseConfig struct {
 
 // SMTPConfig representa a configuração do servidor SMTP
 type SMTPConfig struct {
-	Address      string `mapstructure:"address"`
-	Port         int    `mapstructure:"port"`
-	Domain       string `mapstructure:"domain"`
-	AllowInsecure bool  `mapstructure:"allow_insecure"`
-	MaxMessageBytes int `mapstructure:"max_message_bytes"`
+	Address            string `mapstructure:"address"`
+	Port               int    `mapstructure:"port"`
+	Domain             string `mapstructure:"domain"`
+	AllowInsecure      bool   `mapstructure:"allow_insecure"`
+	MaxMessageBytes    int    `mapstructure:"max_message_bytes"`
+	RecipientDelimiter string `mapstructure:"recipient_delimiter"` // Ex.: "+" para usuario+tag@dominio
+	SubaddressFolders  bool   `mapstructure:"subaddress_folders"`  // Entregar na pasta com o nome da tag
 }
 
 // IMAPConfig representa a configuração do servidor IMAP
@@ -48,6 +61,111 @@ type POP3Config struct {
 	Port    int    `mapstructure:"port"`
 }
 
+// ManageSieveConfig representa a configuração do servidor ManageSieve
+type ManageSieveConfig struct {
+	Address       string `mapstructure:"address"`
+	Port          int    `mapstructure:"port"`
+	MaxScriptSize int    `mapstructure:"max_script_size"` // Tamanho máximo de um script, em bytes
+}
+
+// JMAPConfig representa a configuração do servidor JMAP (RFC 8620 e 8621)
+type JMAPConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Address string `mapstructure:"address"`
+	Port    int    `mapstructure:"port"`
+	URL     string `mapstructure:"url"` // URL pública anunciada aos clientes; vazio usa o Host da requisição
+}
+
+// WebmailConfig representa a configuração do webmail embutido
+type WebmailConfig struct {
+	Enabled       bool   `mapstructure:"enabled"`
+	Address       string `mapstructure:"address"`
+	Port          int    `mapstructure:"port"`
+	SessionHours  int    `mapstructure:"session_hours"`  // Validade da sessão sem atividade; zero usa 8 horas
+	SecureCookies bool   `mapstructure:"secure_cookies"` // Marcar o cookie de sessão como Secure (atrás de HTTPS)
+	PageSize      int    `mapstructure:"page_size"`      // Mensagens por página; zero usa 50
+}
+
+// APIConfig representa a configuração da API HTTP de envio
+type APIConfig struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Address string `mapstructure:"address"`
+	Port    int    `mapstructure:"port"`
+}
+
+// OutboundConfig representa a configuração da entrega para servidores externos
+type OutboundConfig struct {
+	Relay             string   `mapstructure:"relay"`               // Smarthost opcional (host:porta); vazio usa MX
+	Workers           int      `mapstructure:"workers"`             // Número de entregas simultâneas
+	MaxAttempts       int      `mapstructure:"max_attempts"`        // Tentativas antes de desistir
+	RequireTLS        bool     `mapstructure:"require_tls"`         // Exigir TLS com certificado válido em todas as entregas
+	RequireTLSDomains []string `mapstructure:"require_tls_domains"` // Domínios de destino que exigem TLS com certificado válido
+}
+
+// SRSConfig representa a configuração do Sender Rewriting Scheme
+type SRSConfig struct {
+	Secret string `mapstructure:"secret"`
+	Domain string `mapstructure:"domain"` // Domínio dos endereços reescritos; padrão é smtp.domain
+}
+
+// QuotaConfig representa as cotas padrão e os avisos de uso
+type QuotaConfig struct {
+	DefaultBytes      int64 `mapstructure:"default_bytes"`      // Cota padrão por usuário; zero é ilimitado
+	DefaultMessages   int64 `mapstructure:"default_messages"`   // Mensagens por usuário; zero é ilimitado
+	WarningThresholds []int `mapstructure:"warning_thresholds"` // Percentuais de uso que geram aviso
+}
+
+// WebhooksConfig representa os webhooks chamados a cada mensagem entregue
+// localmente
+type WebhooksConfig struct {
+	MaxAttempts    int             `mapstructure:"max_attempts"`    // Tentativas antes de desistir; zero usa 8
+	TimeoutSeconds int             `mapstructure:"timeout_seconds"` // Tempo limite de cada chamada; zero usa 10
+	Hooks          []WebhookConfig `mapstructure:"hooks"`
+}
+
+// WebhookConfig representa um webhook. Os filtros informados (usuário,
+// endereço e domínio) devem todos corresponder ao destinatário; sem filtros,
+// o webhook recebe todas as mensagens.
+type WebhookConfig struct {
+	Name    string `mapstructure:"name"` // Identifica o webhook na fila e no histórico
+	URL     string `mapstructure:"url"`
+	Secret  string `mapstructure:"secret"`  // Chave da assinatura HMAC-SHA256; vazio não assina
+	User    string `mapstructure:"user"`    // Nome de usuário ou endereço principal
+	Address string `mapstructure:"address"` // Endereço de destino (RCPT TO)
+	Domain  string `mapstructure:"domain"`  // Domínio do endereço de destino
+}
+
+// SpamConfig representa a verificação de spam das mensagens recebidas por
+// SMTP sem autenticação, feita por um daemon rspamd ou spamd (SpamAssassin)
+type SpamConfig struct {
+	Enabled        bool    `mapstructure:"enabled"`
+	Protocol       string  `mapstructure:"protocol"`         // "rspamd" ou "spamd"
+	Address        string  `mapstructure:"address"`          // host:porta, URL (rspamd) ou caminho de socket Unix
+	TimeoutSeconds int     `mapstructure:"timeout_seconds"`  // Tempo limite da verificação; zero usa 15
+	MaxSize        int     `mapstructure:"max_size"`         // Mensagens maiores não são verificadas; zero usa 1MB
+	AddHeaderScore float64 `mapstructure:"add_header_score"` // Pontuação a partir da qual a mensagem vai para Junk; zero usa a do daemon
+	RejectScore    float64 `mapstructure:"reject_score"`     // Pontuação a partir da qual a mensagem é recusada; zero não recusa
+}
+
+// BayesConfig representa o classificador bayesiano de spam embutido, treinado
+// quando o usuário move mensagens para a pasta Junk ou para fora dela via IMAP
+type BayesConfig struct {
+	Enabled       bool    `mapstructure:"enabled"`
+	SpamThreshold float64 `mapstructure:"spam_threshold"` // Probabilidade a partir da qual a mensagem é spam; zero usa 0.9
+	MinMessages   int64   `mapstructure:"min_messages"`   // Mensagens treinadas de cada classe para classificar; zero usa 20
+}
+
+// AntivirusConfig representa a verificação de vírus das mensagens recebidas
+// por SMTP, feita pelo clamd com o comando INSTREAM
+type AntivirusConfig struct {
+	Enabled           bool   `mapstructure:"enabled"`
+	Address           string `mapstructure:"address"`            // host:porta ou caminho de socket Unix; vazio usa 127.0.0.1:3310
+	TimeoutSeconds    int    `mapstructure:"timeout_seconds"`    // Tempo limite da verificação; zero usa 30
+	Action            string `mapstructure:"action"`             // "reject", "quarantine" ou "strip"; vazio usa "reject"
+	QuarantineAddress string `mapstructure:"quarantine_address"` // Destino das mensagens em quarentena
+	FailOpen          bool   `mapstructure:"fail_open"`          // Aceitar sem verificação quando o clamd falhar
+}
+
 var cfg *Config
 
 // LoadConfig carrega configurações do arquivo config.yaml
@@ -79,4 +197,4 @@ func LoadConfig(configPath string) (*Config, error) {
 // GetConfig retorna a configuração atual
 func GetConfig() *Config {
 	return cfg
-} 
\ No newline at end of file
+}
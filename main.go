@@ -1,9 +1,12 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/carloslauriano/simpleEmail/config"
@@ -23,13 +26,31 @@ func main() {
 	if err != nil {
 		log.Fatalf("Erro ao inicializar armazenamento: %v", err)
 	}
+	if err := store.Open(); err != nil {
+		log.Fatalf("Erro ao abrir armazenamento: %v", err)
+	}
 	defer store.Close()
 
+	// Comandos de administração, como "deliveries", não iniciam os servidores
+	if len(os.Args) > 1 {
+		code := runCommand(store, os.Args[1:])
+		store.Close()
+		os.Exit(code)
+	}
+
+	if err := initSRSSecret(cfg, store); err != nil {
+		log.Fatalf("Erro ao inicializar o segredo SRS: %v", err)
+	}
+
+	// Iniciar a entrega de mensagens (local, encaminhamento e externa)
+	delivery := server.NewDelivery(cfg, store)
+	delivery.Start()
+
 	// Iniciar servidores em goroutines separadas
-	errors := make(chan error, 3)
+	errors := make(chan error, 7)
 
 	go func() {
-		if err := server.StartSMTPServer(cfg, store); err != nil {
+		if err := server.StartSMTPServer(cfg, store, delivery); err != nil {
 			errors <- err
 		}
 	}()
@@ -46,6 +67,30 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := server.StartManageSieveServer(cfg, store); err != nil {
+			errors <- err
+		}
+	}()
+
+	go func() {
+		if err := server.StartJMAPServer(cfg, store, delivery); err != nil {
+			errors <- err
+		}
+	}()
+
+	go func() {
+		if err := server.StartWebmailServer(cfg, store, delivery); err != nil {
+			errors <- err
+		}
+	}()
+
+	go func() {
+		if err := server.StartAPIServer(cfg, store, delivery); err != nil {
+			errors <- err
+		}
+	}()
+
 	// Aguardar sinais de interrupção
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -56,4 +101,23 @@ func main() {
 	case sig := <-sigChan:
 		log.Printf("Recebido sinal %v, encerrando...", sig)
 	}
-} 
\ No newline at end of file
+} 
+
+// initSRSSecret usa o srs.secret do config.yaml ou, sem ele, um segredo
+// aleatório gerado na primeira execução e guardado no banco de dados, para
+// que os endereços reescritos continuem válidos após reiniciar o servidor
+func initSRSSecret(cfg *config.Config, store storage.Storage) error {
+	if strings.TrimSpace(cfg.SRS.Secret) != "" {
+		return nil
+	}
+	random := make([]byte, 32)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	secret, err := store.InitSetting("srs_secret", hex.EncodeToString(random))
+	if err != nil {
+		return err
+	}
+	cfg.SRS.Secret = secret
+	return nil
+}
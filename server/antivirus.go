@@ -0,0 +1,278 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/emersion/go-smtp"
+)
+
+// Ações para mensagens infectadas
+const (
+	virusReject     = "reject"
+	virusQuarantine = "quarantine"
+	virusStrip      = "strip"
+)
+
+// clamdChunkSize é o tamanho dos blocos enviados no comando INSTREAM
+const clamdChunkSize = 64 * 1024
+
+// Antivirus verifica mensagens no clamd pelo comando INSTREAM, acessado por
+// TCP ou socket Unix
+type Antivirus struct {
+	address    string
+	timeout    time.Duration
+	action     string
+	quarantine string // Destino das mensagens em quarentena
+	failOpen   bool
+}
+
+// NewAntivirus cria o verificador de vírus, ou retorna nil quando a
+// verificação está desabilitada
+func NewAntivirus(cfg *config.Config) *Antivirus {
+	if !cfg.Antivirus.Enabled {
+		return nil
+	}
+
+	a := &Antivirus{
+		address:    cfg.Antivirus.Address,
+		timeout:    time.Duration(cfg.Antivirus.TimeoutSeconds) * time.Second,
+		action:     strings.ToLower(cfg.Antivirus.Action),
+		quarantine: cfg.Antivirus.QuarantineAddress,
+		failOpen:   cfg.Antivirus.FailOpen,
+	}
+	if a.address == "" {
+		a.address = "127.0.0.1:3310"
+	}
+	if a.timeout <= 0 {
+		a.timeout = 30 * time.Second
+	}
+	switch a.action {
+	case virusReject, virusStrip:
+	case virusQuarantine:
+		if a.quarantine == "" {
+			log.Printf("Antivírus: quarantine_address não informado; mensagens infectadas serão recusadas")
+			a.action = virusReject
+		}
+	default:
+		if a.action != "" {
+			log.Printf("Antivírus: ação desconhecida %q; mensagens infectadas serão recusadas", a.action)
+		}
+		a.action = virusReject
+	}
+	return a
+}
+
+// Scan envia o conteúdo ao clamd e retorna o nome do vírus encontrado, ou
+// vazio se o conteúdo estiver limpo
+func (a *Antivirus) Scan(data []byte) (string, error) {
+	network := "tcp"
+	if isUnixSocket(a.address) {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, a.address, a.timeout)
+	if err != nil {
+		return "", fmt.Errorf("falha ao conectar ao clamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(a.timeout))
+
+	// Cada bloco é precedido pelo tamanho em 4 bytes (big-endian); um bloco
+	// vazio encerra o envio
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("falha ao enviar comando ao clamd: %w", err)
+	}
+	size := make([]byte, 4)
+	for rest := data; ; {
+		chunk := rest
+		if len(chunk) > clamdChunkSize {
+			chunk = chunk[:clamdChunkSize]
+		}
+		binary.BigEndian.PutUint32(size, uint32(len(chunk)))
+		if _, err := conn.Write(size); err != nil {
+			return "", fmt.Errorf("falha ao enviar mensagem ao clamd: %w", err)
+		}
+		if len(chunk) == 0 {
+			break
+		}
+		if _, err := conn.Write(chunk); err != nil {
+			return "", fmt.Errorf("falha ao enviar mensagem ao clamd: %w", err)
+		}
+		rest = rest[len(chunk):]
+	}
+
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", fmt.Errorf("falha ao ler resposta do clamd: %w", err)
+	}
+	return parseClamdReply(string(reply))
+}
+
+// parseClamdReply interpreta a resposta do INSTREAM: "stream: OK",
+// "stream: <vírus> FOUND" ou "<mensagem> ERROR"
+func parseClamdReply(reply string) (string, error) {
+	reply = strings.TrimSpace(strings.TrimRight(reply, "\x00"))
+	result := strings.TrimSpace(strings.TrimPrefix(reply, "stream:"))
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	case reply == "":
+		return "", fmt.Errorf("clamd encerrou a conexão sem resposta")
+	}
+	return "", fmt.Errorf("clamd respondeu com erro: %s", reply)
+}
+
+// strip remove da mensagem as partes em que o clamd encontra vírus,
+// substituindo cada uma por um aviso em texto. Retorna nil se nenhuma parte
+// isolada estiver infectada.
+func (a *Antivirus) strip(data []byte) ([]byte, []string, error) {
+	root := parseMIME(data)
+	infected := make(map[*mimePart]string)
+	var viruses []string
+
+	var scan func(p *mimePart) error
+	scan = func(p *mimePart) error {
+		if len(p.parts) > 0 {
+			for _, sub := range p.parts {
+				if err := scan(sub); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		virus, err := a.Scan(p.decoded())
+		if err != nil {
+			return err
+		}
+		if virus != "" {
+			infected[p] = virus
+			viruses = append(viruses, virus)
+		}
+		return nil
+	}
+	if err := scan(root); err != nil {
+		return nil, nil, err
+	}
+	if len(infected) == 0 {
+		return nil, nil, nil
+	}
+
+	var b bytes.Buffer
+	writeStrippedPart(&b, root, infected)
+	return b.Bytes(), viruses, nil
+}
+
+// writeStrippedPart escreve a parte, trocando as infectadas pelo aviso
+func writeStrippedPart(b *bytes.Buffer, p *mimePart, infected map[*mimePart]string) {
+	if virus, ok := infected[p]; ok {
+		// Cabeçalhos que não descrevem o conteúdo, como os da mensagem, são mantidos
+		for _, f := range p.fields {
+			if !strings.HasPrefix(strings.ToLower(f.name), "content-") {
+				b.WriteString(f.name + ":" + f.value + "\r\n")
+			}
+		}
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("Content-Transfer-Encoding: 8bit\r\n")
+		b.WriteString("\r\n")
+		if name := p.filename(); name != "" {
+			fmt.Fprintf(b, "O anexo \"%s\" foi removido porque continha o vírus %s.\r\n", name, virus)
+		} else {
+			fmt.Fprintf(b, "Uma parte desta mensagem foi removida porque continha o vírus %s.\r\n", virus)
+		}
+		return
+	}
+
+	for _, f := range p.fields {
+		b.WriteString(f.name + ":" + f.value + "\r\n")
+	}
+	b.WriteString("\r\n")
+	if len(p.parts) == 0 {
+		b.Write(p.body)
+		return
+	}
+
+	boundary := p.params["boundary"]
+	for _, sub := range p.parts {
+		b.WriteString("--" + boundary + "\r\n")
+		writeStrippedPart(b, sub, infected)
+		b.WriteString("\r\n")
+	}
+	b.WriteString("--" + boundary + "--\r\n")
+}
+
+// stripVirusHeaders remove os cabeçalhos X-Virus-* da mensagem
+func stripVirusHeaders(data []byte) []byte {
+	return stripHeaders(data, "x-virus-")
+}
+
+// checkVirus verifica a mensagem no clamd e aplica a ação configurada para
+// mensagens infectadas. Os cabeçalhos X-Virus-* recebidos, que não são
+// confiáveis, são removidos antes. Retorna a mensagem a entregar, anotada
+// com X-Virus-*, ou deliver false quando ela foi desviada para a quarentena.
+func (s *SMTPSession) checkVirus(body []byte) (data []byte, deliver bool, err error) {
+	av := s.backend.antivirus
+	if av == nil {
+		return body, true, nil
+	}
+	body = stripVirusHeaders(body)
+
+	virus, err := av.Scan(body)
+	if err != nil {
+		log.Printf("Erro na verificação de vírus da mensagem de %s: %v", s.from, err)
+		if av.failOpen {
+			return body, true, nil
+		}
+		return nil, false, &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+			Message:      "Falha temporária na verificação de vírus",
+		}
+	}
+	if virus == "" {
+		return append([]byte("X-Virus-Scanned: clamd\r\n"), body...), true, nil
+	}
+	log.Printf("Vírus %s encontrado na mensagem de %s para %s (ação: %s)", virus, s.from, strings.Join(s.to, ", "), av.action)
+
+	switch av.action {
+	case virusQuarantine:
+		var b bytes.Buffer
+		b.WriteString("X-Virus-Scanned: clamd\r\n")
+		fmt.Fprintf(&b, "X-Virus-Status: Infected (%s)\r\n", virus)
+		fmt.Fprintf(&b, "X-Quarantine-Sender: <%s>\r\n", s.from)
+		fmt.Fprintf(&b, "X-Quarantine-Recipients: %s\r\n", strings.Join(s.to, ", "))
+		b.Write(body)
+		if err := s.backend.delivery.Submit("", []string{av.quarantine}, b.Bytes()); err != nil {
+			log.Printf("Erro ao enviar mensagem para a quarentena: %v", err)
+			return nil, false, &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Falha temporária ao processar mensagem",
+			}
+		}
+		return nil, false, nil
+	case virusStrip:
+		stripped, viruses, err := av.strip(body)
+		if err != nil {
+			log.Printf("Erro ao remover partes infectadas da mensagem de %s: %v", s.from, err)
+		} else if stripped != nil {
+			header := fmt.Sprintf("X-Virus-Scanned: clamd\r\nX-Virus-Status: Infected (%s); removed\r\n", strings.Join(viruses, ", "))
+			return append([]byte(header), stripped...), true, nil
+		}
+		// Sem partes isoladas infectadas, a mensagem é recusada
+	}
+
+	return nil, false, &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Mensagem recusada: vírus encontrado (" + virus + ")",
+	}
+}
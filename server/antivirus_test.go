@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/emersion/go-smtp"
+)
+
+// eicar é o arquivo de teste padrão reconhecido pelos antivírus, montado em
+// partes para que o próprio fonte não seja detectado
+var eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$` + "EICAR-STANDARD-ANTIVIRUS" + `-TEST-FILE!$H+H*`
+
+// clamdRequest é um comando recebido pelo clamd falso
+type clamdRequest struct {
+	command string
+	chunks  []int // Tamanhos dos blocos, incluindo o bloco vazio final
+	data    []byte
+}
+
+// fakeClamd inicia um clamd falso que responde ao INSTREAM: encontra o EICAR
+// em texto ou base64, responde com erro a conteúdos com "CLAMD-ERROR" e
+// considera limpo o restante
+func fakeClamd(t *testing.T, requests chan<- *clamdRequest) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(eicar))
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				command := make([]byte, len("zINSTREAM\x00"))
+				if _, err := io.ReadFull(conn, command); err != nil {
+					return
+				}
+				req := &clamdRequest{command: string(command)}
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(conn, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					req.chunks = append(req.chunks, int(n))
+					if n == 0 {
+						break
+					}
+					chunk := make([]byte, n)
+					if _, err := io.ReadFull(conn, chunk); err != nil {
+						return
+					}
+					req.data = append(req.data, chunk...)
+				}
+				if requests != nil {
+					requests <- req
+				}
+
+				switch {
+				case bytes.Contains(req.data, []byte(eicar)) || bytes.Contains(req.data, []byte(encoded)):
+					conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+				case bytes.Contains(req.data, []byte("CLAMD-ERROR")):
+					conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+				default:
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newTestAntivirus cria uma configuração com o antivírus habilitado e a ação
+// informada, usando o clamd falso
+func newTestAntivirus(t *testing.T, action string) *config.Config {
+	t.Helper()
+	cfg := newTestConfig(t)
+	cfg.Antivirus.Enabled = true
+	cfg.Antivirus.Address = fakeClamd(t, nil)
+	cfg.Antivirus.Action = action
+	cfg.Antivirus.QuarantineAddress = "quarentena@example.com"
+	return cfg
+}
+
+// virusMessage traz o corpo informado e um cabeçalho X-Virus-Status forjado
+// pelo remetente
+const virusMessage = "From: mallory@example.com\r\n" +
+	"To: alice@localhost\r\n" +
+	"Subject: Fatura\r\n" +
+	"X-Virus-Status: Clean\r\n" +
+	"\r\n" +
+	"%s\r\n"
+
+// attachmentMessage traz uma parte de texto e um anexo com o conteúdo
+// informado em base64
+const attachmentMessage = "From: mallory@example.com\r\n" +
+	"To: alice@localhost\r\n" +
+	"Subject: Fatura\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"limite\"\r\n" +
+	"\r\n" +
+	"--limite\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Segue a fatura em anexo.\r\n" +
+	"--limite\r\n" +
+	"Content-Type: application/octet-stream; name=\"fatura.com\"\r\n" +
+	"Content-Disposition: attachment; filename=\"fatura.com\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"%s\r\n" +
+	"--limite--\r\n"
+
+func TestClamdScan(t *testing.T) {
+	requests := make(chan *clamdRequest, 1)
+	cfg := newTestConfig(t)
+	cfg.Antivirus.Enabled = true
+	cfg.Antivirus.Address = fakeClamd(t, requests)
+	av := NewAntivirus(cfg)
+
+	tests := []struct {
+		name  string
+		data  []byte
+		virus string
+		err   bool
+	}{
+		{"limpo", []byte("Olá, tudo bem?\r\n"), "", false},
+		{"eicar", []byte("início " + eicar + " fim"), "Eicar-Test-Signature", false},
+		{"erro", []byte("CLAMD-ERROR"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			virus, err := av.Scan(tt.data)
+			if (err != nil) != tt.err {
+				t.Fatalf("erro = %v, esperado erro: %v", err, tt.err)
+			}
+			if virus != tt.virus {
+				t.Errorf("vírus = %q, esperado %q", virus, tt.virus)
+			}
+			req := <-requests
+			if req.command != "zINSTREAM\x00" {
+				t.Errorf("comando = %q, esperado zINSTREAM", req.command)
+			}
+			if !bytes.Equal(req.data, tt.data) {
+				t.Errorf("conteúdo recebido difere do enviado")
+			}
+		})
+	}
+
+	t.Run("blocos", func(t *testing.T) {
+		data := bytes.Repeat([]byte("0123456789abcdef"), (2*clamdChunkSize+1000)/16)
+		if _, err := av.Scan(data); err != nil {
+			t.Fatal(err)
+		}
+		req := <-requests
+		want := []int{clamdChunkSize, clamdChunkSize, len(data) - 2*clamdChunkSize, 0}
+		if len(req.chunks) != len(want) {
+			t.Fatalf("blocos = %v, esperado %v", req.chunks, want)
+		}
+		for i := range want {
+			if req.chunks[i] != want[i] {
+				t.Fatalf("blocos = %v, esperado %v", req.chunks, want)
+			}
+		}
+		if !bytes.Equal(req.data, data) {
+			t.Errorf("conteúdo remontado difere do enviado")
+		}
+	})
+
+	t.Run("vazio", func(t *testing.T) {
+		if _, err := av.Scan(nil); err != nil {
+			t.Fatal(err)
+		}
+		if req := <-requests; len(req.chunks) != 1 || req.chunks[0] != 0 {
+			t.Errorf("blocos = %v, esperado apenas o bloco vazio final", req.chunks)
+		}
+	})
+}
+
+func TestParseClamdReply(t *testing.T) {
+	tests := []struct {
+		reply string
+		virus string
+		err   bool
+	}{
+		{"stream: OK\x00", "", false},
+		{"stream: OK\n", "", false},
+		{"stream: Win.Test.EICAR_HDB-1 FOUND\x00", "Win.Test.EICAR_HDB-1", false},
+		{"INSTREAM size limit exceeded. ERROR\x00", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		virus, err := parseClamdReply(tt.reply)
+		if (err != nil) != tt.err || virus != tt.virus {
+			t.Errorf("parseClamdReply(%q) = %q, %v; esperado %q, erro: %v", tt.reply, virus, err, tt.virus, tt.err)
+		}
+	}
+}
+
+func TestVirusClean(t *testing.T) {
+	cfg := newTestAntivirus(t, "reject")
+	store, user := newTestStorage(t, cfg)
+	s := newTestSession(t, cfg, store)
+
+	msg := fmt.Sprintf(virusMessage, "Nada de errado aqui.")
+	msg = "X-Virus-Scanned: falso\r\n" + msg
+	if err := sendTestMessage(t, s, "mallory@example.com", "alice@localhost", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := mailboxMessages(t, store, user, "INBOX")
+	if len(messages) != 1 {
+		t.Fatalf("%d mensagens na INBOX, esperado 1", len(messages))
+	}
+	header := messageHeader(messages[0].RawData)
+	if n := strings.Count(header, "X-Virus-Scanned:"); n != 1 || !strings.Contains(header, "X-Virus-Scanned: clamd\r\n") {
+		t.Errorf("esperado apenas X-Virus-Scanned: clamd, cabeçalho:\n%s", header)
+	}
+	if strings.Contains(header, "X-Virus-Status") || strings.Contains(header, "falso") {
+		t.Errorf("cabeçalhos X-Virus-* recebidos não foram removidos:\n%s", header)
+	}
+}
+
+func TestVirusReject(t *testing.T) {
+	cfg := newTestAntivirus(t, "reject")
+	store, user := newTestStorage(t, cfg)
+	s := newTestSession(t, cfg, store)
+
+	msg := fmt.Sprintf(virusMessage, eicar)
+	err := sendTestMessage(t, s, "mallory@example.com", "alice@localhost", msg)
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 554 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Fatalf("erro = %v, esperado 554 5.7.1", err)
+	}
+	if !strings.Contains(smtpErr.Message, "Eicar-Test-Signature") {
+		t.Errorf("mensagem de erro sem o nome do vírus: %q", smtpErr.Message)
+	}
+	if messages := mailboxMessages(t, store, user, "INBOX"); len(messages) != 0 {
+		t.Errorf("%d mensagens na INBOX, esperado 0", len(messages))
+	}
+}
+
+func TestVirusQuarantine(t *testing.T) {
+	cfg := newTestAntivirus(t, "quarantine")
+	store, user := newTestStorage(t, cfg)
+	s := newTestSession(t, cfg, store)
+
+	msg := fmt.Sprintf(virusMessage, eicar)
+	if err := sendTestMessage(t, s, "mallory@example.com", "alice@localhost", msg); err != nil {
+		t.Fatalf("erro = %v, esperado mensagem aceita para a quarentena", err)
+	}
+	if messages := mailboxMessages(t, store, user, "INBOX"); len(messages) != 0 {
+		t.Errorf("%d mensagens na INBOX, esperado 0", len(messages))
+	}
+
+	pending := pendingOutbound(t, store)
+	if len(pending) != 1 {
+		t.Fatalf("%d mensagens na fila externa, esperado 1", len(pending))
+	}
+	if q := pending[0]; q.Sender != "" || len(q.Recipients) != 1 || q.Recipients[0] != "quarentena@example.com" {
+		t.Errorf("envelope da quarentena: remetente %q destinatários %v", q.Sender, q.Recipients)
+	}
+	header := messageHeader(pending[0].Data)
+	for _, want := range []string{
+		"X-Virus-Status: Infected (Eicar-Test-Signature)\r\n",
+		"X-Quarantine-Sender: <mallory@example.com>\r\n",
+		"X-Quarantine-Recipients: alice@localhost\r\n",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("cabeçalho sem %q:\n%s", want, header)
+		}
+	}
+	if strings.Contains(header, "X-Virus-Status: Clean") {
+		t.Errorf("cabeçalho X-Virus-Status recebido não foi removido:\n%s", header)
+	}
+}
+
+func TestVirusStrip(t *testing.T) {
+	cfg := newTestAntivirus(t, "strip")
+	store, user := newTestStorage(t, cfg)
+	s := newTestSession(t, cfg, store)
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(eicar))
+	msg := fmt.Sprintf(attachmentMessage, encoded)
+	if err := sendTestMessage(t, s, "mallory@example.com", "alice@localhost", msg); err != nil {
+		t.Fatal(err)
+	}
+
+	messages := mailboxMessages(t, store, user, "INBOX")
+	if len(messages) != 1 {
+		t.Fatalf("%d mensagens na INBOX, esperado 1", len(messages))
+	}
+	data := string(messages[0].RawData)
+	if !strings.Contains(messageHeader(messages[0].RawData), "X-Virus-Status: Infected (Eicar-Test-Signature); removed\r\n") {
+		t.Errorf("cabeçalho sem X-Virus-Status de remoção:\n%s", messageHeader(messages[0].RawData))
+	}
+	if strings.Contains(data, encoded) {
+		t.Errorf("anexo infectado não foi removido")
+	}
+
+	root := parseMIME(messages[0].RawData)
+	if len(root.parts) != 2 {
+		t.Fatalf("%d partes, esperado 2", len(root.parts))
+	}
+	if text := string(root.parts[0].decoded()); !strings.Contains(text, "Segue a fatura em anexo.") {
+		t.Errorf("parte de texto alterada: %q", text)
+	}
+	notice := root.parts[1]
+	if notice.mediaType != "text/plain" || notice.filename() != "" {
+		t.Errorf("parte substituída: tipo %q, arquivo %q; esperado texto sem anexo", notice.mediaType, notice.filename())
+	}
+	if text := string(notice.decoded()); !strings.Contains(text, "\"fatura.com\" foi removido porque continha o vírus Eicar-Test-Signature") {
+		t.Errorf("aviso de remoção = %q", text)
+	}
+}
+
+func TestVirusStripSinglePart(t *testing.T) {
+	cfg := newTestAntivirus(t, "strip")
+	store, user := newTestStorage(t, cfg)
+	s := newTestSession(t, cfg, store)
+
+	// Em uma mensagem sem partes, o corpo inteiro é trocado pelo aviso e os
+	// cabeçalhos da mensagem são mantidos
+	if err := sendTestMessage(t, s, "mallory@example.com", "alice@localhost", fmt.Sprintf(virusMessage, eicar)); err != nil {
+		t.Fatal(err)
+	}
+	messages := mailboxMessages(t, store, user, "INBOX")
+	if len(messages) != 1 {
+		t.Fatalf("%d mensagens na INBOX, esperado 1", len(messages))
+	}
+	root := parseMIME(messages[0].RawData)
+	if root.header.Get("Subject") != "Fatura" || root.mediaType != "text/plain" {
+		t.Errorf("cabeçalho: Subject %q, tipo %q", root.header.Get("Subject"), root.mediaType)
+	}
+	if body := string(root.decoded()); strings.Contains(body, eicar) ||
+		!strings.Contains(body, "Uma parte desta mensagem foi removida porque continha o vírus Eicar-Test-Signature") {
+		t.Errorf("corpo = %q", body)
+	}
+}
+
+func TestVirusDaemonFailure(t *testing.T) {
+	// Endereço sem clamd escutando
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := l.Addr().String()
+	l.Close()
+
+	msg := fmt.Sprintf(virusMessage, "Nada de errado aqui.")
+	for _, failOpen := range []bool{false, true} {
+		cfg := newTestAntivirus(t, "reject")
+		cfg.Antivirus.Address = address
+		cfg.Antivirus.TimeoutSeconds = 1
+		cfg.Antivirus.FailOpen = failOpen
+		store, user := newTestStorage(t, cfg)
+		s := newTestSession(t, cfg, store)
+
+		err := sendTestMessage(t, s, "mallory@example.com", "alice@localhost", msg)
+		messages := mailboxMessages(t, store, user, "INBOX")
+		if !failOpen {
+			var smtpErr *smtp.SMTPError
+			if !errors.As(err, &smtpErr) || smtpErr.Code != 451 || smtpErr.EnhancedCode != (smtp.EnhancedCode{4, 7, 1}) {
+				t.Errorf("fail_open desligado: erro = %v, esperado 451 4.7.1", err)
+			}
+			if len(messages) != 0 {
+				t.Errorf("fail_open desligado: %d mensagens na INBOX, esperado 0", len(messages))
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("fail_open ligado: erro = %v, esperado mensagem aceita", err)
+		}
+		if len(messages) != 1 {
+			t.Fatalf("fail_open ligado: %d mensagens na INBOX, esperado 1", len(messages))
+		}
+		if header := messageHeader(messages[0].RawData); strings.Contains(header, "X-Virus-") {
+			t.Errorf("fail_open ligado: mensagem não verificada com cabeçalhos X-Virus-*:\n%s", header)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// apiReservedHeaders são os cabeçalhos montados pelo servidor, que não podem
+// ser definidos em "headers"
+var apiReservedHeaders = map[string]bool{
+	"Bcc": true, "Cc": true, "Content-Disposition": true, "Content-Id": true,
+	"Content-Transfer-Encoding": true, "Content-Type": true, "Date": true, "From": true,
+	"In-Reply-To": true, "Message-Id": true, "Mime-Version": true, "References": true,
+	"Reply-To": true, "Sender": true, "Subject": true, "To": true,
+}
+
+// APIServer atende a API HTTP de envio de mensagens transacionais. As
+// requisições são autenticadas com usuário e senha (Basic) e as mensagens
+// seguem o mesmo caminho do envio por SMTP autenticado.
+type APIServer struct {
+	store    storage.Storage
+	delivery *Delivery
+	hostname string
+	maxSize  int
+}
+
+// apiSendRequest é o corpo de POST /api/v1/send
+type apiSendRequest struct {
+	From        string            `json:"from"` // Opcional; o endereço deve ser o do usuário
+	To          []string          `json:"to"`
+	Cc          []string          `json:"cc"`
+	Bcc         []string          `json:"bcc"`
+	ReplyTo     []string          `json:"reply_to"`
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text"`
+	HTML        string            `json:"html"`
+	Headers     map[string]string `json:"headers"`
+	Attachments []struct {
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+		Content     string `json:"content"` // Conteúdo em base64
+		Inline      bool   `json:"inline"`
+		ContentID   string `json:"content_id"`
+	} `json:"attachments"`
+}
+
+// apiSendResponse identifica a mensagem aceita para envio
+type apiSendResponse struct {
+	MessageID  string   `json:"message_id"`
+	Recipients []string `json:"recipients"`
+}
+
+// apiRequestError é um erro de validação do pedido, respondido com 400
+type apiRequestError struct {
+	message string
+}
+
+func (e *apiRequestError) Error() string {
+	return e.message
+}
+
+// invalidRequest cria um erro de validação do pedido
+func invalidRequest(format string, args ...interface{}) error {
+	return &apiRequestError{message: fmt.Sprintf(format, args...)}
+}
+
+// NewAPIServer cria um novo servidor da API de envio
+func NewAPIServer(cfg *config.Config, store storage.Storage, delivery *Delivery) *APIServer {
+	maxSize := cfg.SMTP.MaxMessageBytes
+	if maxSize <= 0 {
+		maxSize = jmapDefaultMaxUpload
+	}
+
+	return &APIServer{
+		store:    store,
+		delivery: delivery,
+		hostname: cfg.SMTP.Domain,
+		maxSize:  maxSize,
+	}
+}
+
+// Handler retorna as rotas da API
+func (s *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/send", s.handleSend)
+	return mux
+}
+
+// writeAPIError envia um erro no formato {"error": "..."}
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func (s *APIServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	username, password, ok := r.BasicAuth()
+	var user *storage.User
+	if ok {
+		user, _ = s.store.AuthenticateUser(username, password)
+	}
+	if user == nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="simpleEmail"`)
+		writeAPIError(w, http.StatusUnauthorized, "autenticação necessária")
+		return
+	}
+
+	// O base64 dos anexos ocupa cerca de 4/3 do tamanho final da mensagem
+	var req apiSendRequest
+	body := http.MaxBytesReader(w, r.Body, int64(s.maxSize)*4/3+65536)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			writeAPIError(w, http.StatusRequestEntityTooLarge, "requisição muito grande")
+			return
+		}
+		writeAPIError(w, http.StatusBadRequest, "JSON inválido: "+err.Error())
+		return
+	}
+
+	msg, err := s.compose(user, &req)
+	var reqErr *apiRequestError
+	if errors.As(err, &reqErr) {
+		writeAPIError(w, http.StatusBadRequest, reqErr.message)
+		return
+	} else if err != nil {
+		writeAPIError(w, http.StatusForbidden, err.Error())
+		return
+	}
+
+	data := msg.bytes(s.hostname)
+	if len(data) > s.maxSize {
+		writeAPIError(w, http.StatusRequestEntityTooLarge, "mensagem excede o tamanho máximo")
+		return
+	}
+
+	var rcpts []string
+	for _, list := range [][]*mail.Address{msg.to, msg.cc, msg.bcc} {
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	if err := s.delivery.Submit(user.Email, rcpts, removeHeader(data, "Bcc")); err != nil {
+		log.Printf("Erro ao enviar mensagem da API de %s: %v", user.Email, err)
+		writeAPIError(w, http.StatusServiceUnavailable, "falha temporária ao enviar a mensagem")
+		return
+	}
+	log.Printf("Mensagem %s aceita pela API de %s para %d destinatários", msg.messageID, user.Email, len(rcpts))
+
+	writeJSON(w, http.StatusAccepted, &apiSendResponse{MessageID: msg.messageID, Recipients: rcpts})
+}
+
+// parseAPIAddresses lê uma lista de endereços no formato RFC 5322
+func parseAPIAddresses(field string, values []string) ([]*mail.Address, error) {
+	var addrs []*mail.Address
+	for _, value := range values {
+		addr, err := mail.ParseAddress(value)
+		if err != nil {
+			return nil, invalidRequest("endereço inválido em %s: %q", field, value)
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// compose valida o pedido e monta a mensagem. Erros de validação são
+// *apiRequestError; os demais indicam remetente não permitido.
+func (s *APIServer) compose(user *storage.User, req *apiSendRequest) (*composedMessage, error) {
+	from := &mail.Address{Name: user.Name, Address: user.Email}
+	if req.From != "" {
+		addr, err := mail.ParseAddress(req.From)
+		if err != nil {
+			return nil, invalidRequest("endereço inválido em from: %q", req.From)
+		}
+		if !strings.EqualFold(addr.Address, user.Email) {
+			return nil, errors.New("o remetente deve ser o endereço do usuário autenticado")
+		}
+		from = addr
+	}
+
+	msg := &composedMessage{
+		from:      []*mail.Address{from},
+		subject:   req.Subject,
+		text:      req.Text,
+		html:      req.HTML,
+		date:      time.Now(),
+		messageID: newMessageID(s.hostname),
+	}
+
+	var err error
+	if msg.to, err = parseAPIAddresses("to", req.To); err != nil {
+		return nil, err
+	}
+	if msg.cc, err = parseAPIAddresses("cc", req.Cc); err != nil {
+		return nil, err
+	}
+	if msg.bcc, err = parseAPIAddresses("bcc", req.Bcc); err != nil {
+		return nil, err
+	}
+	if msg.replyTo, err = parseAPIAddresses("reply_to", req.ReplyTo); err != nil {
+		return nil, err
+	}
+	if len(msg.to)+len(msg.cc)+len(msg.bcc) == 0 {
+		return nil, invalidRequest("informe ao menos um destinatário")
+	}
+	if req.Text == "" && req.HTML == "" {
+		return nil, invalidRequest("informe o conteúdo em text ou html")
+	}
+	if strings.ContainsAny(req.Subject, "\r\n") {
+		return nil, invalidRequest("o assunto não pode conter quebras de linha")
+	}
+
+	names := make([]string, 0, len(req.Headers))
+	for name := range req.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := req.Headers[name]
+		canonical := textproto.CanonicalMIMEHeaderKey(name)
+		if !validHeaderName(name) || apiReservedHeaders[canonical] {
+			return nil, invalidRequest("cabeçalho não permitido: %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, invalidRequest("o cabeçalho %s não pode conter quebras de linha", name)
+		}
+		msg.headers = append(msg.headers, headerField{name: canonical, value: mime.QEncoding.Encode("utf-8", value)})
+	}
+
+	for i, a := range req.Attachments {
+		data, err := base64.StdEncoding.DecodeString(a.Content)
+		if err != nil {
+			return nil, invalidRequest("conteúdo base64 inválido no anexo %d", i+1)
+		}
+		if strings.ContainsAny(a.Filename+a.ContentType+a.ContentID, "\r\n\"") {
+			return nil, invalidRequest("campos inválidos no anexo %d", i+1)
+		}
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = mime.TypeByExtension(extension(a.Filename))
+		}
+		if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+			contentType = mediaType
+		} else {
+			contentType = ""
+		}
+		msg.attachments = append(msg.attachments, &composedAttachment{
+			filename:    a.Filename,
+			contentType: contentType,
+			inline:      a.Inline,
+			contentID:   strings.Trim(a.ContentID, "<>"),
+			data:        data,
+		})
+	}
+	return msg, nil
+}
+
+// validHeaderName verifica a sintaxe de um nome de campo (RFC 5322, seção
+// 3.6.8)
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= 32 || c >= 127 || c == ':' {
+			return false
+		}
+	}
+	return true
+}
+
+// extension retorna a extensão do nome do arquivo, com o ponto
+func extension(filename string) string {
+	if i := strings.LastIndexByte(filename, '.'); i >= 0 {
+		return filename[i:]
+	}
+	return ""
+}
+
+// StartAPIServer inicia a API HTTP de envio, se habilitada na configuração
+func StartAPIServer(cfg *config.Config, store storage.Storage, delivery *Delivery) error {
+	if !cfg.API.Enabled {
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", cfg.API.Address, cfg.API.Port),
+		Handler:           NewAPIServer(cfg, store, delivery).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      60 * time.Second,
+	}
+
+	log.Printf("Iniciando API de envio em %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		return fmt.Errorf("falha ao iniciar API de envio: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/sieve"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// defaultVacationDays é o intervalo entre respostas quando a configuração não o define
+const defaultVacationDays = 7
+
+// userVacation retorna a ação de resposta automática correspondente à
+// resposta de ausência configurada pelo usuário, ou nil se ela não estiver
+// ativa no momento
+func (d *Delivery) userVacation(rcpt *localRecipient) *sieve.VacationAction {
+	vacation, err := d.store.GetVacation(rcpt.user.ID)
+	if errors.Is(err, storage.ErrVacationNotFound) {
+		return nil
+	} else if err != nil {
+		log.Printf("Erro ao obter resposta de ausência de %s: %v", rcpt.user.Email, err)
+		return nil
+	}
+
+	now := time.Now()
+	if !vacation.Enabled || (!vacation.Start.IsZero() && now.Before(vacation.Start)) ||
+		(!vacation.End.IsZero() && now.After(vacation.End)) {
+		return nil
+	}
+
+	days := vacation.Days
+	if days < 1 {
+		days = defaultVacationDays
+	}
+
+	var addresses []string
+	for _, addr := range strings.Split(vacation.Addresses, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addresses = append(addresses, addr)
+		}
+	}
+
+	return &sieve.VacationAction{
+		Reason:    vacation.Body,
+		Subject:   vacation.Subject,
+		Addresses: addresses,
+		Days:      days,
+		Handle:    "vacation",
+	}
+}
+
+// vacation envia a resposta automática da ação vacation (RFC 5230) ou da
+// resposta de ausência do usuário, respeitando as regras de RFC 3834 para
+// evitar respostas indevidas. Mensagens classificadas como spam não são
+// respondidas, pois o remetente costuma ser forjado.
+func (d *Delivery) vacation(env *envelope, rcpt *localRecipient, header mail.Header, action *sieve.VacationAction) {
+	if env.spam {
+		return
+	}
+
+	sender := strings.ToLower(env.from)
+	if !shouldAutoReply(sender, header) {
+		return
+	}
+
+	addresses := append([]string{rcpt.user.Email, rcpt.address}, action.Addresses...)
+	if !addressedTo(header, addresses) {
+		return
+	}
+
+	handle := action.Handle
+	if handle == "" {
+		sum := sha1.Sum([]byte(action.Reason + "\x00" + action.Subject + "\x00" + action.From))
+		handle = hex.EncodeToString(sum[:])
+	}
+
+	last, err := d.store.LastVacationReply(rcpt.user.ID, sender, handle)
+	if err != nil {
+		log.Printf("Erro ao consultar respostas de ausência de %s: %v", rcpt.user.Email, err)
+		return
+	}
+	if !last.IsZero() && time.Since(last) < time.Duration(action.Days)*24*time.Hour {
+		return
+	}
+	if err := d.store.RecordVacationReply(rcpt.user.ID, sender, handle, time.Now()); err != nil {
+		log.Printf("Erro ao registrar resposta de ausência de %s: %v", rcpt.user.Email, err)
+		return
+	}
+
+	from := action.From
+	if from == "" {
+		from = rcpt.user.Email
+	}
+	subject := action.Subject
+	if subject == "" {
+		subject = "Auto: " + header.Get("Subject")
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: <%s>\r\n", env.from)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	if msgID := header.Get("Message-Id"); msgID != "" {
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", msgID)
+		fmt.Fprintf(&b, "References: %s\r\n", strings.TrimSpace(header.Get("References")+" "+msgID))
+	}
+	b.WriteString("Auto-Submitted: auto-replied\r\n")
+	if action.Mime {
+		// Com :mime o motivo já contém os cabeçalhos MIME do corpo
+		b.WriteString("MIME-Version: 1.0\r\n")
+		b.WriteString(action.Reason)
+	} else {
+		b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		b.WriteString("\r\n")
+		b.WriteString(action.Reason)
+	}
+	b.WriteString("\r\n")
+
+	// Respostas automáticas usam remetente de envelope nulo (RFC 3834, seção 3.3)
+	if err := d.Submit("", []string{env.from}, []byte(b.String())); err != nil {
+		log.Printf("Erro ao enviar resposta automática para %s: %v", env.from, err)
+	}
+}
+
+// shouldAutoReply aplica as regras de RFC 3834 sobre o remetente e os
+// cabeçalhos da mensagem recebida
+func shouldAutoReply(sender string, header mail.Header) bool {
+	if sender == "" {
+		return false
+	}
+
+	local := sender
+	if at := strings.LastIndex(sender, "@"); at >= 0 {
+		local = sender[:at]
+	}
+	if local == "mailer-daemon" || local == "postmaster" ||
+		strings.HasPrefix(local, "owner-") || strings.HasSuffix(local, "-request") {
+		return false
+	}
+
+	if auto := strings.ToLower(strings.TrimSpace(header.Get("Auto-Submitted"))); auto != "" && auto != "no" {
+		return false
+	}
+
+	switch strings.ToLower(strings.TrimSpace(header.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return false
+	}
+
+	for key := range header {
+		if strings.HasPrefix(key, "List-") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addressedTo informa se algum dos endereços aparece em To ou Cc
+func addressedTo(header mail.Header, addresses []string) bool {
+	for _, field := range []string{"To", "Cc"} {
+		list, err := header.AddressList(field)
+		if err != nil {
+			continue
+		}
+		for _, addr := range list {
+			for _, candidate := range addresses {
+				if candidate != "" && strings.EqualFold(addr.Address, candidate) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+)
+
+// Parâmetros do classificador
+const (
+	bayesMaxTokens      = 1000 // Tokens considerados por mensagem
+	bayesInteresting    = 150  // Tokens mais significativos usados na combinação
+	bayesMinDeviation   = 0.1  // Tokens com probabilidade próxima de 0,5 são ignorados
+	bayesStrength       = 1.0  // Peso da probabilidade inicial (s de Robinson)
+	bayesAssumedProb    = 0.5  // Probabilidade de tokens pouco vistos (x de Robinson)
+	bayesMinTokenLength = 3
+	bayesMaxTokenLength = 24
+)
+
+// Bayes classifica mensagens como spam por um classificador bayesiano de
+// tokens. Cada usuário tem seu próprio classificador e todos treinam também
+// um global, usado enquanto o do usuário não tem treino suficiente.
+type Bayes struct {
+	store       storage.Storage
+	threshold   float64
+	minMessages int64
+}
+
+// NewBayes cria o classificador, ou retorna nil quando ele está desabilitado
+func NewBayes(cfg *config.Config, store storage.Storage) *Bayes {
+	if !cfg.Bayes.Enabled {
+		return nil
+	}
+
+	threshold := cfg.Bayes.SpamThreshold
+	if threshold <= 0 || threshold >= 1 {
+		threshold = 0.9
+	}
+	minMessages := cfg.Bayes.MinMessages
+	if minMessages <= 0 {
+		minMessages = 20
+	}
+	return &Bayes{
+		store:       store,
+		threshold:   threshold,
+		minMessages: minMessages,
+	}
+}
+
+// Train treina o classificador do usuário e o global com a mensagem
+func (b *Bayes) Train(user *storage.User, data []byte, spam bool) error {
+	tokens := bayesTokens(data)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	digest := bayesDigest(data, tokens)
+	for _, userID := range []int64{user.ID, 0} {
+		if err := b.store.TrainBayes(userID, digest, tokens, spam); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Classify retorna a probabilidade de a mensagem ser spam e qual
+// classificador foi usado ("user" ou "global"). Sem treino suficiente em
+// nenhum deles, retorna classifier vazio.
+func (b *Bayes) Classify(user *storage.User, data []byte) (probability float64, classifier string, err error) {
+	userID := user.ID
+	classifier = "user"
+	stats, err := b.store.GetBayesStats(userID)
+	if err != nil {
+		return 0, "", err
+	}
+	if stats.Spam < b.minMessages || stats.Ham < b.minMessages {
+		userID, classifier = 0, "global"
+		if stats, err = b.store.GetBayesStats(0); err != nil {
+			return 0, "", err
+		}
+		if stats.Spam < b.minMessages || stats.Ham < b.minMessages {
+			return 0, "", nil
+		}
+	}
+
+	tokens := bayesTokens(data)
+	counts, err := b.store.GetBayesTokens(userID, tokens)
+	if err != nil {
+		return 0, "", err
+	}
+	return bayesCombine(counts, stats), classifier, nil
+}
+
+// bayesCombine calcula a probabilidade de spam pelo método de Robinson: a
+// probabilidade de cada token é suavizada conforme o número de mensagens em
+// que apareceu, e as dos tokens mais significativos são combinadas pelo
+// teste qui-quadrado de Fisher
+func bayesCombine(counts map[string]*storage.BayesToken, stats *storage.BayesStats) float64 {
+	var probs []float64
+	for _, token := range counts {
+		spamRatio := float64(token.Spam) / float64(stats.Spam)
+		hamRatio := float64(token.Ham) / float64(stats.Ham)
+		if spamRatio+hamRatio == 0 {
+			continue
+		}
+		p := spamRatio / (spamRatio + hamRatio)
+		n := float64(token.Spam + token.Ham)
+		f := (bayesStrength*bayesAssumedProb + n*p) / (bayesStrength + n)
+		if math.Abs(f-0.5) >= bayesMinDeviation {
+			probs = append(probs, f)
+		}
+	}
+	if len(probs) == 0 {
+		return 0.5
+	}
+
+	sort.Slice(probs, func(i, j int) bool {
+		return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5)
+	})
+	if len(probs) > bayesInteresting {
+		probs = probs[:bayesInteresting]
+	}
+
+	var spamLog, hamLog float64
+	for _, f := range probs {
+		spamLog += math.Log(1 - f)
+		hamLog += math.Log(f)
+	}
+	s := chi2Q(-2*spamLog, 2*len(probs))
+	h := chi2Q(-2*hamLog, 2*len(probs))
+	return (1 + h - s) / 2
+}
+
+// chi2Q retorna a probabilidade de um valor qui-quadrado maior ou igual a x
+// com v graus de liberdade (v par)
+func chi2Q(x float64, v int) float64 {
+	m := x / 2
+	term := math.Exp(-m)
+	sum := term
+	for i := 1; i < v/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+	return math.Min(sum, 1)
+}
+
+// bayesTokens extrai os tokens da mensagem: as palavras do assunto, com o
+// prefixo "subject:", o domínio do remetente e as palavras do corpo de texto,
+// ou do HTML quando não houver texto. Cada token aparece uma única vez.
+func bayesTokens(data []byte) []string {
+	root := parseMIME(data)
+	seen := make(map[string]bool)
+	var tokens []string
+	add := func(token string) {
+		if len(tokens) < bayesMaxTokens && !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+
+	for _, word := range bayesWords(decodeHeader(root.header.Get("Subject"))) {
+		add("subject:" + word)
+	}
+	for _, addr := range parseAddressList(root.header.Get("From")) {
+		if _, domain, ok := splitAddress(strings.ToLower(addr.Address)); ok {
+			add("from:" + domain)
+		}
+	}
+
+	textBody, htmlBody, _ := root.bodyParts()
+	text := joinParts(textBody, "text/plain")
+	if strings.TrimSpace(text) == "" {
+		text = htmlToText(joinParts(htmlBody, "text/html"))
+	}
+	for _, word := range bayesWords(text) {
+		add(word)
+	}
+	return tokens
+}
+
+// bayesWords separa o texto em palavras em minúsculas, descartando as muito
+// curtas ou longas
+func bayesWords(text string) []string {
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\''
+	}) {
+		word = strings.Trim(word, "'")
+		if n := utf8.RuneCountInString(word); n >= bayesMinTokenLength && n <= bayesMaxTokenLength {
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// bayesDigest identifica a mensagem no registro de treino pelos tokens do
+// conteúdo junto com o Message-ID. Cópias entregues a vários usuários, que
+// diferem apenas nos cabeçalhos de entrega, contam uma única vez no
+// classificador global, e mensagens diferentes com o mesmo Message-ID, que é
+// escolhido pelo remetente, são treinadas separadamente.
+func bayesDigest(data []byte, tokens []string) string {
+	h := sha256.New()
+	header, _ := parseMessage(data)
+	if ids := parseMessageIDs(header.Get("Message-Id")); len(ids) > 0 {
+		h.Write([]byte(ids[0]))
+	}
+	for _, token := range tokens {
+		h.Write([]byte{0})
+		h.Write([]byte(token))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// classify classifica a mensagem para o destinatário. Retorna a mensagem
+// com o cabeçalho X-Spam-Bayes e, se ela for spam, uma cópia do envelope
+// marcada como spam, para que o keep implícito vá para a pasta Junk.
+func (d *Delivery) classify(env *envelope, rcpt *localRecipient, body []byte) (*envelope, []byte) {
+	if d.bayes == nil || env.spam {
+		return env, body
+	}
+
+	probability, classifier, err := d.bayes.Classify(rcpt.user, body)
+	if err != nil {
+		log.Printf("Erro ao classificar mensagem para %s: %v", rcpt.user.Email, err)
+		return env, body
+	}
+	if classifier == "" {
+		return env, body
+	}
+
+	header := fmt.Sprintf("X-Spam-Bayes: probability=%.4f; classifier=%s\r\n", probability, classifier)
+	if probability >= d.bayes.threshold {
+		spam := *env
+		spam.spam = true
+		env = &spam
+		if msgHeader, _ := parseMessage(body); msgHeader.Get("X-Spam-Flag") == "" {
+			header = "X-Spam-Flag: YES\r\n" + header
+		}
+	}
+	return env, append([]byte(header), body...)
+}
+
+// trainJunk treina o classificador quando o usuário copia ou move mensagens
+// para a pasta Junk (spam) ou da pasta Junk para outra que não a lixeira
+// (não spam)
+func (m *IMAPMailbox) trainJunk(dest *IMAPMailbox, messages []*storage.Message) {
+	bayes := m.backend.bayes
+	if bayes == nil || m.owner.ID != dest.owner.ID {
+		return
+	}
+
+	fromJunk := m.mailbox.SpecialUse == imap.JunkAttr
+	toJunk := dest.mailbox.SpecialUse == imap.JunkAttr
+	var spam bool
+	switch {
+	case toJunk && !fromJunk:
+		spam = true
+	case fromJunk && !toJunk && dest.mailbox.SpecialUse != imap.TrashAttr:
+		spam = false
+	default:
+		return
+	}
+
+	for _, msg := range messages {
+		if err := bayes.Train(m.owner, msg.RawData, spam); err != nil {
+			log.Printf("Erro ao treinar classificador de %s: %v", m.owner.Email, err)
+		}
+	}
+}
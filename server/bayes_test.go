@@ -0,0 +1,202 @@
+package server
+
+import (
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+const bayesMessage = "From: Loja <ofertas@promo.example>\r\n" +
+	"To: alice@localhost\r\n" +
+	"Subject: Oferta IMPERDIVEL hoje\r\n" +
+	"Message-ID: <oferta-1@promo.example>\r\n" +
+	"\r\n" +
+	"Compre agora, compre JA! Desconto de $100 em produtos.\r\n" +
+	"a ab supercalifragilisticexpialidocious-e-mais\r\n"
+
+func TestBayesTokens(t *testing.T) {
+	want := []string{
+		"subject:oferta", "subject:imperdivel", "subject:hoje",
+		"from:promo.example",
+		"compre", "agora", "desconto", "$100", "produtos", "mais",
+	}
+	if got := bayesTokens([]byte(bayesMessage)); !reflect.DeepEqual(got, want) {
+		t.Errorf("tokens = %q, esperado %q", got, want)
+	}
+
+	html := "From: a@b.example\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"\r\n" +
+		"<html><body><p>Clique <b>aqui</b></p></body></html>\r\n"
+	want = []string{"from:b.example", "clique", "aqui"}
+	if got := bayesTokens([]byte(html)); !reflect.DeepEqual(got, want) {
+		t.Errorf("tokens do HTML = %q, esperado %q", got, want)
+	}
+}
+
+func TestChi2Q(t *testing.T) {
+	tests := []struct {
+		x    float64
+		v    int
+		want float64
+	}{
+		{0, 2, 1},
+		{0, 10, 1},
+		{2, 2, math.Exp(-1)},
+		{4, 4, 3 * math.Exp(-2)},
+		{6, 6, 8.5 * math.Exp(-3)},
+	}
+	for _, tt := range tests {
+		if got := chi2Q(tt.x, tt.v); math.Abs(got-tt.want) > 1e-12 {
+			t.Errorf("chi2Q(%v, %d) = %v, esperado %v", tt.x, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestBayesCombine(t *testing.T) {
+	stats := &storage.BayesStats{Spam: 100, Ham: 100}
+	tokens := func(spam, ham int64) map[string]*storage.BayesToken {
+		counts := make(map[string]*storage.BayesToken)
+		for _, name := range []string{"um", "dois", "tres", "quatro"} {
+			counts[name] = &storage.BayesToken{Token: name, Spam: spam, Ham: ham}
+		}
+		return counts
+	}
+
+	if p := bayesCombine(tokens(40, 1), stats); p < 0.9 {
+		t.Errorf("tokens de spam: probabilidade %v, esperado >= 0.9", p)
+	}
+	if p := bayesCombine(tokens(1, 40), stats); p > 0.1 {
+		t.Errorf("tokens de ham: probabilidade %v, esperado <= 0.1", p)
+	}
+	// Tokens vistos igualmente nas duas classes não são significativos
+	if p := bayesCombine(tokens(10, 10), stats); p != 0.5 {
+		t.Errorf("tokens neutros: probabilidade %v, esperado 0.5", p)
+	}
+	if p := bayesCombine(nil, stats); p != 0.5 {
+		t.Errorf("sem tokens: probabilidade %v, esperado 0.5", p)
+	}
+}
+
+func TestBayesDigest(t *testing.T) {
+	data := []byte(bayesMessage)
+	digest := bayesDigest(data, bayesTokens(data))
+
+	// Cópias de outros destinatários diferem apenas nos cabeçalhos de entrega
+	delivered := []byte("Delivered-To: bob@localhost\r\nReceived: from mx.example\r\n" + bayesMessage)
+	if got := bayesDigest(delivered, bayesTokens(delivered)); got != digest {
+		t.Errorf("cópia com cabeçalhos de entrega tem resumo diferente")
+	}
+
+	// O remetente escolhe o Message-ID, que sozinho não identifica a mensagem
+	other := []byte(strings.Replace(bayesMessage, "Desconto", "Reuniao", 1))
+	if got := bayesDigest(other, bayesTokens(other)); got == digest {
+		t.Errorf("mensagem diferente com o mesmo Message-ID tem o mesmo resumo")
+	}
+}
+
+func TestBayesTrain(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Bayes.Enabled = true
+	store, user := newTestStorage(t, cfg)
+	bayes := NewBayes(cfg, store)
+	data := []byte(bayesMessage)
+
+	check := func(userID, spam, ham int64) {
+		t.Helper()
+		stats, err := store.GetBayesStats(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Spam != spam || stats.Ham != ham {
+			t.Errorf("usuário %d: estatísticas spam=%d ham=%d, esperado spam=%d ham=%d",
+				userID, stats.Spam, stats.Ham, spam, ham)
+		}
+		counts, err := store.GetBayesTokens(userID, []string{"subject:oferta", "desconto", "inexistente"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := counts["inexistente"]; ok {
+			t.Errorf("usuário %d: token nunca visto nas contagens", userID)
+		}
+		for _, name := range []string{"subject:oferta", "desconto"} {
+			token := counts[name]
+			if token == nil || token.Spam != spam || token.Ham != ham {
+				t.Errorf("usuário %d: token %s = %+v, esperado spam=%d ham=%d", userID, name, token, spam, ham)
+			}
+		}
+	}
+
+	if err := bayes.Train(user, data, false); err != nil {
+		t.Fatal(err)
+	}
+	check(user.ID, 0, 1)
+	check(0, 0, 1)
+
+	// Treinar de novo a mesma mensagem na mesma classe não altera as contagens
+	if err := bayes.Train(user, data, false); err != nil {
+		t.Fatal(err)
+	}
+	check(user.ID, 0, 1)
+	check(0, 0, 1)
+
+	// Reclassificar como spam move as contagens de ham para spam
+	if err := bayes.Train(user, data, true); err != nil {
+		t.Fatal(err)
+	}
+	check(user.ID, 1, 0)
+	check(0, 1, 0)
+
+	// Uma mensagem diferente com o mesmo Message-ID é treinada à parte
+	other := []byte(strings.Replace(bayesMessage, "Compre agora", "Veja agora", 1))
+	if err := bayes.Train(user, other, false); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := store.GetBayesStats(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Spam != 1 || stats.Ham != 1 {
+		t.Errorf("global após outra mensagem: spam=%d ham=%d, esperado spam=1 ham=1", stats.Spam, stats.Ham)
+	}
+}
+
+func TestBayesClassify(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Bayes.Enabled = true
+	cfg.Bayes.MinMessages = 2
+	store, user := newTestStorage(t, cfg)
+	bayes := NewBayes(cfg, store)
+
+	message := func(subject, body string) []byte {
+		return []byte("From: x@y.example\r\nSubject: " + subject + "\r\n\r\n" + body + "\r\n")
+	}
+	if _, classifier, err := bayes.Classify(user, message("teste", "nada")); err != nil || classifier != "" {
+		t.Fatalf("sem treino: classifier=%q err=%v, esperado vazio", classifier, err)
+	}
+
+	for i, body := range []string{"viagra barato cassino", "cassino viagra premio", "premio barato viagra"} {
+		if err := bayes.Train(user, message("spam "+string(rune('a'+i)), body), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, body := range []string{"reuniao projeto amanha", "projeto relatorio reuniao", "relatorio amanha projeto"} {
+		if err := bayes.Train(user, message("ham "+string(rune('a'+i)), body), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	p, classifier, err := bayes.Classify(user, message("oi", "viagra cassino premio barato"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if classifier != "user" || p < bayes.threshold {
+		t.Errorf("spam: probabilidade %v classifier %q, esperado >= %v e user", p, classifier, bayes.threshold)
+	}
+	if p, _, _ = bayes.Classify(user, message("oi", "reuniao do projeto amanha")); p > 0.1 {
+		t.Errorf("ham: probabilidade %v, esperado <= 0.1", p)
+	}
+}
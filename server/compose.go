@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// composedMessage descreve uma mensagem montada pelo servidor a partir de
+// campos estruturados, como nas APIs HTTP
+type composedMessage struct {
+	from        []*mail.Address
+	sender      *mail.Address
+	replyTo     []*mail.Address
+	to          []*mail.Address
+	cc          []*mail.Address
+	bcc         []*mail.Address
+	subject     string
+	date        time.Time // Zero usa a data atual
+	messageID   string    // Com os sinais < >; vazio gera um novo identificador
+	inReplyTo   []string
+	references  []string
+	headers     []headerField // Cabeçalhos adicionais, já codificados
+	text        string
+	html        string
+	attachments []*composedAttachment
+}
+
+// composedAttachment é um anexo de uma mensagem composta
+type composedAttachment struct {
+	filename    string
+	contentType string
+	inline      bool
+	contentID   string // Sem os sinais < >
+	data        []byte
+}
+
+// mimeEntity é uma parte MIME já codificada
+type mimeEntity struct {
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+// newMessageID gera um identificador de mensagem único no domínio
+func newMessageID(hostname string) string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return "<" + hex.EncodeToString(buf) + "@" + hostname + ">"
+}
+
+// bytes monta a mensagem em formato RFC 5322, com texto e HTML em
+// multipart/alternative e anexos em multipart/mixed
+func (m *composedMessage) bytes(hostname string) []byte {
+	if m.date.IsZero() {
+		m.date = time.Now()
+	}
+	if m.messageID == "" {
+		m.messageID = newMessageID(hostname)
+	}
+
+	var buf bytes.Buffer
+	writeField := func(name, value string) {
+		if value != "" {
+			buf.WriteString(name + ": " + value + "\r\n")
+		}
+	}
+	writeField("Date", m.date.Format(time.RFC1123Z))
+	writeField("From", formatAddressList(m.from))
+	if m.sender != nil {
+		writeField("Sender", m.sender.String())
+	}
+	writeField("Reply-To", formatAddressList(m.replyTo))
+	writeField("To", formatAddressList(m.to))
+	writeField("Cc", formatAddressList(m.cc))
+	writeField("Bcc", formatAddressList(m.bcc))
+	writeField("Subject", mime.QEncoding.Encode("utf-8", m.subject))
+	writeField("Message-ID", m.messageID)
+	writeField("In-Reply-To", strings.Join(m.inReplyTo, " "))
+	writeField("References", strings.Join(m.references, " "))
+	for _, f := range m.headers {
+		writeField(f.name, strings.TrimSpace(f.value))
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	entity := m.entity()
+	for _, key := range []string{"Content-Type", "Content-Transfer-Encoding", "Content-Disposition", "Content-Id"} {
+		writeField(key, entity.header.Get(key))
+	}
+	buf.WriteString("\r\n")
+	buf.Write(entity.body)
+	return buf.Bytes()
+}
+
+// entity monta o corpo da mensagem
+func (m *composedMessage) entity() *mimeEntity {
+	var body *mimeEntity
+	switch {
+	case m.text != "" && m.html != "":
+		body = multipartEntity("alternative", textEntity("text/plain", m.text), textEntity("text/html", m.html))
+	case m.html != "":
+		body = textEntity("text/html", m.html)
+	default:
+		body = textEntity("text/plain", m.text)
+	}
+
+	if len(m.attachments) == 0 {
+		return body
+	}
+	parts := []*mimeEntity{body}
+	for _, a := range m.attachments {
+		parts = append(parts, a.entity())
+	}
+	return multipartEntity("mixed", parts...)
+}
+
+// textEntity codifica um texto em quoted-printable, com quebras CRLF
+func textEntity(mediaType, content string) *mimeEntity {
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+	content = strings.ReplaceAll(content, "\n", "\r\n")
+
+	var buf bytes.Buffer
+	w := quotedprintable.NewWriter(&buf)
+	w.Write([]byte(content))
+	w.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType(mediaType, map[string]string{"charset": "utf-8"}))
+	header.Set("Content-Transfer-Encoding", "quoted-printable")
+	return &mimeEntity{header: header, body: buf.Bytes()}
+}
+
+// entity codifica o anexo em base64, com linhas de 76 caracteres
+func (a *composedAttachment) entity() *mimeEntity {
+	contentType := a.contentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	disposition := "attachment"
+	if a.inline {
+		disposition = "inline"
+	}
+
+	header := textproto.MIMEHeader{}
+	if a.filename != "" {
+		header.Set("Content-Type", mime.FormatMediaType(contentType, map[string]string{"name": a.filename}))
+		header.Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": a.filename}))
+	} else {
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Disposition", disposition)
+	}
+	if a.contentID != "" {
+		header.Set("Content-Id", "<"+a.contentID+">")
+	}
+	header.Set("Content-Transfer-Encoding", "base64")
+
+	encoded := base64.StdEncoding.EncodeToString(a.data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded + "\r\n")
+	return &mimeEntity{header: header, body: buf.Bytes()}
+}
+
+// multipartEntity agrupa as partes em um multipart do subtipo informado
+func multipartEntity(subtype string, parts ...*mimeEntity) *mimeEntity {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, part := range parts {
+		pw, _ := w.CreatePart(part.header)
+		pw.Write(part.body)
+	}
+	w.Close()
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", mime.FormatMediaType("multipart/"+subtype, map[string]string{"boundary": w.Boundary()}))
+	return &mimeEntity{header: header, body: buf.Bytes()}
+}
+
+// formatAddressList formata endereços para um cabeçalho, codificando nomes
+// não ASCII (RFC 2047)
+func formatAddressList(addrs []*mail.Address) string {
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		formatted[i] = addr.String()
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// removeHeader remove todas as ocorrências de um campo do cabeçalho da
+// mensagem, como Bcc antes do envio
+func removeHeader(data []byte, name string) []byte {
+	fields, body := splitHeader(data)
+	var buf bytes.Buffer
+	for _, f := range fields {
+		if !strings.EqualFold(f.name, name) {
+			buf.WriteString(f.name + ":" + f.value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+	buf.Write(body)
+	return buf.Bytes()
+}
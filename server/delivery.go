@@ -0,0 +1,483 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/sieve"
+	"github.com/carloslauriano/simpleEmail/srs"
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// envelope contém os dados de envelope SMTP de uma mensagem em entrega
+type envelope struct {
+	from string
+	to   []string
+	dsn  *dsnRequest // Parâmetros DSN (RFC 3461); nil quando não informados
+	spam bool        // Classificada como spam; o keep implícito vai para Junk
+}
+
+// Delivery concentra a entrega de mensagens: resolução de destinatários,
+// gravação nas caixas locais, filtros Sieve, encaminhamento e envio para
+// servidores externos
+type Delivery struct {
+	hostname string
+	store    storage.Storage
+	resolver *RecipientResolver
+	outbound *Outbound
+	srs      *srs.SRS
+	quota    *QuotaChecker
+	webhooks *Webhooks
+	bayes    *Bayes // nil quando o classificador está desabilitado
+}
+
+// NewDelivery cria um novo pipeline de entrega
+func NewDelivery(cfg *config.Config, store storage.Storage) *Delivery {
+	srsDomain := cfg.SRS.Domain
+	if srsDomain == "" {
+		srsDomain = cfg.SMTP.Domain
+	}
+
+	d := &Delivery{
+		hostname: cfg.SMTP.Domain,
+		store:    store,
+		resolver: NewRecipientResolver(store, cfg),
+		outbound: NewOutbound(cfg, store),
+		srs:      srs.New(cfg.SRS.Secret, srsDomain),
+		quota:    NewQuotaChecker(store, cfg),
+		webhooks: NewWebhooks(cfg, store),
+		bayes:    NewBayes(cfg, store),
+	}
+	d.outbound.report = d.sendDSN
+	return d
+}
+
+// Start inicia a entrega externa e os webhooks em segundo plano
+func (d *Delivery) Start() {
+	d.outbound.Start()
+	d.webhooks.Start()
+}
+
+// Submit envia uma mensagem, entregando localmente os destinatários
+// hospedados no servidor e enfileirando os demais para entrega externa
+func (d *Delivery) Submit(from string, to []string, data []byte) error {
+	_, err := d.submit(&envelope{from: from, to: to}, data)
+	return err
+}
+
+// submit envia a mensagem aos destinatários do envelope, preservando os
+// parâmetros DSN na entrega externa, e retorna o identificador dos
+// destinatários externos no histórico de entregas. Um erro só é retornado
+// enquanto nenhum destinatário recebeu a mensagem, para que a nova tentativa
+// do cliente não a duplique; depois disso, as falhas são notificadas ao
+// remetente.
+func (d *Delivery) submit(env *envelope, data []byte) (string, error) {
+	var remote []string
+	var local []*localRecipient
+	for _, addr := range env.to {
+		rcpts, err := d.resolver.Resolve(addr)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			remote = append(remote, addr)
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		local = append(local, rcpts...)
+	}
+
+	// A fila externa é persistente: gravada antes das caixas locais, uma
+	// falha ao enfileirar ainda pode ser devolvida ao cliente
+	queueID, err := d.outbound.Enqueue(env, remote, data)
+	if err != nil {
+		return "", err
+	}
+	accepted := len(remote) > 0
+
+	for _, rcpt := range local {
+		err := d.deliverLocal(env, rcpt, data)
+		var reject *rejectError
+		switch {
+		case errors.As(err, &reject):
+			d.sendRejection(env, rcpt, reject, data)
+		case err != nil && !accepted:
+			return "", err
+		case err != nil:
+			d.localFailure(env, rcpt, err, data)
+		}
+		accepted = true
+	}
+	return queueID, nil
+}
+
+// localFailure registra a falha de entrega a um destinatário local depois
+// que a mensagem já foi aceita para outros e a notifica ao remetente
+func (d *Delivery) localFailure(env *envelope, rcpt *localRecipient, err error, data []byte) {
+	log.Printf("Erro ao entregar mensagem de %s para %s: %v", env.from, rcpt.user.Email, err)
+	if env.dsn.notify(rcpt.address, smtp.DSNNotifyFailure) {
+		d.sendDSN(env, dsnFailed, []*dsnRecipient{{address: rcpt.address, status: "5.3.0",
+			reason: "falha ao gravar a mensagem na caixa postal"}}, data, time.Now())
+	}
+}
+
+// reverseSRS retorna o destino original de um endereço SRS do servidor
+func (d *Delivery) reverseSRS(address string) (string, bool) {
+	if !d.srs.IsSRS(address) {
+		return "", false
+	}
+
+	original, err := d.srs.Reverse(address)
+	if err != nil {
+		log.Printf("Endereço SRS %s rejeitado: %v", address, err)
+		return "", false
+	}
+	return original, true
+}
+
+// rejectError indica que a mensagem foi recusada pelo filtro Sieve do
+// destinatário ou por falta de espaço na caixa postal
+type rejectError struct {
+	reason string
+	quota  bool
+}
+
+func (e *rejectError) Error() string {
+	return "mensagem recusada: " + e.reason
+}
+
+// deliverLocal entrega a mensagem a um destinatário local, aplicando o
+// encaminhamento e o filtro Sieve configurados pelo usuário. Retorna
+// *rejectError quando o filtro recusa a mensagem ou a cota foi atingida.
+func (d *Delivery) deliverLocal(env *envelope, rcpt *localRecipient, body []byte) error {
+	env, body = d.classify(env, rcpt, body)
+	header, content := parseMessage(body)
+
+	// Evitar laços de encaminhamento e redirecionamento
+	for _, delivered := range header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(delivered), rcpt.user.Email) {
+			log.Printf("Laço de entrega detectado para %s; mensagem descartada", rcpt.user.Email)
+			return nil
+		}
+	}
+	body = append([]byte("Delivered-To: "+rcpt.user.Email+"\r\n"), body...)
+
+	forwarding, err := d.store.GetForwarding(rcpt.user.ID)
+	if err != nil && !errors.Is(err, storage.ErrForwardingNotFound) {
+		return fmt.Errorf("falha ao obter encaminhamento: %w", err)
+	}
+
+	if forwarding != nil && forwarding.Enabled {
+		if err := d.forward(env, forwarding, body); err != nil {
+			return err
+		}
+		if !forwarding.KeepCopy {
+			return nil
+		}
+	}
+
+	actions := d.runSieve(env, rcpt, header, content, len(body))
+	return d.applyActions(env, rcpt, header, actions, body)
+}
+
+// runSieve executa o script Sieve ativo do usuário. Sem script, ou em caso
+// de erro, retorna apenas o keep implícito.
+func (d *Delivery) runSieve(env *envelope, rcpt *localRecipient, header mail.Header, content []byte, size int) []sieve.Action {
+	keep := []sieve.Action{&sieve.KeepAction{}}
+
+	stored, err := d.store.GetActiveSieveScript(rcpt.user.ID)
+	if errors.Is(err, storage.ErrSieveScriptNotFound) {
+		return keep
+	} else if err != nil {
+		log.Printf("Erro ao obter script sieve de %s: %v", rcpt.user.Email, err)
+		return keep
+	}
+
+	script, err := sieve.Parse(stored.Content)
+	if err != nil {
+		log.Printf("Script sieve %q de %s inválido: %v", stored.Name, rcpt.user.Email, err)
+		return keep
+	}
+
+	actions, err := script.Execute(&sieve.Message{
+		From:   env.from,
+		To:     rcpt.address,
+		Header: header,
+		Body:   content,
+		Size:   size,
+		MailboxExists: func(name string) bool {
+			_, err := d.store.GetMailbox(rcpt.user.ID, name)
+			return err == nil
+		},
+	})
+	if err != nil {
+		log.Printf("Erro ao executar script sieve %q de %s: %v", stored.Name, rcpt.user.Email, err)
+		return keep
+	}
+
+	return actions
+}
+
+// applyActions executa as ações resultantes do filtro Sieve
+func (d *Delivery) applyActions(env *envelope, rcpt *localRecipient, header mail.Header, actions []sieve.Action, body []byte) error {
+	stored := make(map[int64]bool)
+	store := func(mailbox *storage.Mailbox, flags []string) error {
+		if stored[mailbox.ID] {
+			return nil
+		}
+		err := d.quota.Check(rcpt.user, int64(len(body)), 1)
+		var quota *quotaError
+		if errors.As(err, &quota) {
+			return &rejectError{reason: "Caixa postal cheia", quota: true}
+		} else if err != nil {
+			return err
+		}
+		stored[mailbox.ID] = true
+		msg, err := d.storeMessage(env, mailbox, body, flags)
+		if err != nil {
+			return err
+		}
+		d.webhooks.Notify(env, rcpt, mailbox, msg)
+		return nil
+	}
+
+	var reject *rejectError
+	replied := false
+	for _, action := range actions {
+		switch a := action.(type) {
+		case *sieve.KeepAction:
+			mailbox, err := d.mailboxFor(env, rcpt)
+			if err != nil {
+				return err
+			}
+			if err := store(mailbox, a.Flags); err != nil {
+				return err
+			}
+		case *sieve.FileIntoAction:
+			mailbox, err := d.fileIntoMailbox(rcpt, a)
+			if err != nil {
+				return err
+			}
+			if err := store(mailbox, a.Flags); err != nil {
+				return err
+			}
+		case *sieve.RedirectAction:
+			if err := d.redirect(env, a.Address, body); err != nil {
+				return err
+			}
+		case *sieve.RejectAction:
+			reject = &rejectError{reason: a.Reason}
+		case *sieve.VacationAction:
+			d.vacation(env, rcpt, header, a)
+			replied = true
+		case *sieve.DiscardAction:
+			log.Printf("Mensagem de %s para %s descartada pelo filtro sieve", env.from, rcpt.user.Email)
+		}
+	}
+
+	if reject != nil {
+		return reject
+	}
+
+	if len(stored) > 0 {
+		d.quotaWarnings(rcpt, int64(len(body))*int64(len(stored)), int64(len(stored)))
+	}
+
+	// A resposta de ausência do usuário só é usada quando o script Sieve não
+	// responde por conta própria e a mensagem foi entregue
+	if !replied && len(stored) > 0 {
+		if vacation := d.userVacation(rcpt); vacation != nil {
+			d.vacation(env, rcpt, header, vacation)
+		}
+	}
+	return nil
+}
+
+// fileIntoMailbox obtém a caixa de destino de um fileinto, criando-a quando
+// solicitado com :create; caixas inexistentes recaem na INBOX
+func (d *Delivery) fileIntoMailbox(rcpt *localRecipient, action *sieve.FileIntoAction) (*storage.Mailbox, error) {
+	mailbox, err := d.store.GetMailbox(rcpt.user.ID, action.Mailbox)
+	if err == nil && !mailbox.NoSelect {
+		return mailbox, nil
+	}
+
+	if action.Create {
+		if mailbox, err := createMailbox(d.store, rcpt.user.ID, action.Mailbox, ""); err == nil {
+			return mailbox, nil
+		}
+	}
+
+	log.Printf("Caixa %q de %s não existe; usando INBOX", action.Mailbox, rcpt.user.Email)
+	return d.store.GetMailbox(rcpt.user.ID, "INBOX")
+}
+
+// redirect reenvia a mensagem para outro endereço, reescrevendo o remetente com SRS
+func (d *Delivery) redirect(env *envelope, address string, body []byte) error {
+	from := env.from
+	if from != "" {
+		rewritten, err := d.srs.Forward(from)
+		if err != nil {
+			return fmt.Errorf("falha ao reescrever remetente %s: %w", from, err)
+		}
+		from = rewritten
+	}
+	return d.Submit(from, []string{address}, body)
+}
+
+// sendRejection notifica o remetente, com um relatório de entrega, de que a
+// mensagem foi recusada pelo filtro do destinatário (RFC 5429) ou por falta
+// de espaço
+func (d *Delivery) sendRejection(env *envelope, rcpt *localRecipient, reject *rejectError, body []byte) {
+	if !env.dsn.notify(rcpt.address, smtp.DSNNotifyFailure) {
+		return
+	}
+
+	status := "5.7.1"
+	if reject.quota {
+		status = "5.2.2"
+	}
+	d.sendDSN(env, dsnFailed, []*dsnRecipient{{address: rcpt.address, status: status, reason: reject.reason}}, body, time.Now())
+}
+
+// forward reenvia a mensagem aos destinos do encaminhamento, reescrevendo o
+// remetente de envelope com SRS para que o SPF seja aceito no destino
+func (d *Delivery) forward(env *envelope, forwarding *storage.Forwarding, body []byte) error {
+	var targets []string
+	for _, target := range strings.Split(forwarding.Targets, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			targets = append(targets, target)
+		}
+	}
+
+	from := env.from
+	if from != "" {
+		rewritten, err := d.srs.Forward(from)
+		if err != nil {
+			return fmt.Errorf("falha ao reescrever remetente %s: %w", from, err)
+		}
+		from = rewritten
+	}
+
+	_, err := d.outbound.Enqueue(&envelope{from: from, to: targets}, targets, body)
+	return err
+}
+
+// mailboxFor obtém a caixa de destino de um destinatário: a caixa de spam
+// para mensagens classificadas como spam ou a pasta solicitada, usando a
+// INBOX quando ela não existir
+func (d *Delivery) mailboxFor(env *envelope, rcpt *localRecipient) (*storage.Mailbox, error) {
+	if env.spam {
+		junk, err := d.junkMailbox(rcpt)
+		if err != nil {
+			return nil, err
+		}
+		if junk != nil {
+			return junk, nil
+		}
+	}
+
+	if rcpt.folder != "" {
+		if folder, err := d.store.GetMailbox(rcpt.user.ID, rcpt.folder); err == nil && !folder.NoSelect {
+			return folder, nil
+		}
+	}
+
+	inbox, err := d.store.GetMailbox(rcpt.user.ID, "INBOX")
+	if err != nil {
+		return nil, fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+	}
+	return inbox, nil
+}
+
+// storeMessage grava a mensagem na caixa informada, com as flags do filtro
+func (d *Delivery) storeMessage(env *envelope, mailbox *storage.Mailbox, body []byte, flags []string) (*storage.Message, error) {
+	header, _ := parseMessage(body)
+	msg := &storage.Message{
+		MailboxID: mailbox.ID,
+		From:      env.from,
+		To:        strings.Join(env.to, ","),
+		Cc:        header.Get("Cc"),
+		Subject:   header.Get("Subject"),
+		Date:      time.Now(),
+		Body:      string(body),
+		RawData:   body,
+		Size:      len(body),
+	}
+	applyFlags(msg, flags)
+	applyThreadHeaders(msg, header)
+
+	if err := d.store.CreateMessage(msg); err != nil {
+		return nil, fmt.Errorf("falha ao salvar mensagem: %w", err)
+	}
+	return msg, nil
+}
+
+// applyFlags converte flags IMAP nos campos da mensagem
+func applyFlags(msg *storage.Message, flags []string) {
+	var other []string
+	for _, flag := range flags {
+		switch strings.ToLower(flag) {
+		case "\\seen":
+			msg.Seen = true
+		case "\\deleted":
+			msg.Deleted = true
+		case "\\draft":
+			msg.Draft = true
+		default:
+			other = append(other, flag)
+		}
+	}
+	msg.Flags = strings.Join(other, " ")
+}
+
+// applyThreadHeaders copia para a mensagem os identificadores usados no
+// agrupamento em conversas: Message-ID, In-Reply-To e References
+func applyThreadHeaders(msg *storage.Message, header mail.Header) {
+	if ids := parseMessageIDs(header.Get("Message-Id")); len(ids) > 0 {
+		msg.MessageID = ids[0]
+	}
+	if ids := parseMessageIDs(header.Get("In-Reply-To")); len(ids) > 0 {
+		msg.InReplyTo = ids[0]
+	}
+	msg.References = strings.Join(parseMessageIDs(header.Get("References")), " ")
+}
+
+// parseMessageIDs extrai os identificadores <...> de um cabeçalho, ignorando
+// comentários e texto livre
+func parseMessageIDs(value string) []string {
+	var ids []string
+	for {
+		start := strings.IndexByte(value, '<')
+		if start < 0 {
+			return ids
+		}
+		end := strings.IndexByte(value[start:], '>')
+		if end < 0 {
+			return ids
+		}
+		if id := strings.TrimSpace(value[start : start+end+1]); len(id) > 2 {
+			ids = append(ids, id)
+		}
+		value = value[start+end+1:]
+	}
+}
+
+// parseMessage separa cabeçalhos e corpo; mensagens malformadas são tratadas
+// como corpo sem cabeçalhos
+func parseMessage(data []byte) (mail.Header, []byte) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return mail.Header{}, data
+	}
+	content, err := io.ReadAll(msg.Body)
+	if err != nil {
+		return msg.Header, data
+	}
+	return msg.Header, content
+}
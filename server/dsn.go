@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// Ações de um relatório de entrega (RFC 3464, seção 2.3.3)
+const (
+	dsnFailed    = "failed"
+	dsnDelayed   = "delayed"
+	dsnDelivered = "delivered"
+	dsnRelayed   = "relayed"
+)
+
+// dsnRequest reúne os parâmetros DSN (RFC 3461) de uma transação SMTP: RET e
+// ENVID do MAIL FROM e NOTIFY e ORCPT de cada destinatário
+type dsnRequest struct {
+	ret   smtp.DSNReturn
+	envID string
+	rcpts map[string]*smtp.RcptOptions // Indexado pelo endereço em minúsculas
+}
+
+// rcptOptions retorna os parâmetros DSN informados para o destinatário
+func (r *dsnRequest) rcptOptions(rcpt string) *smtp.RcptOptions {
+	if r == nil {
+		return nil
+	}
+	return r.rcpts[strings.ToLower(rcpt)]
+}
+
+// maxEnvIDLength é o tamanho máximo do ENVID (RFC 3461, seção 4.4)
+const maxEnvIDLength = 100
+
+// validEnvID informa se o ENVID, já decodificado do xtext, contém apenas
+// caracteres ASCII imprimíveis e respeita o tamanho máximo
+func validEnvID(envID string) bool {
+	if len(envID) > maxEnvIDLength {
+		return false
+	}
+	for i := 0; i < len(envID); i++ {
+		if envID[i] < ' ' || envID[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// xtext codifica o valor no formato xtext (RFC 3461, seção 4), usado no
+// campo Original-Envelope-Id dos relatórios
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// mailOptions retorna os parâmetros do MAIL FROM repassados ao próximo servidor
+func (r *dsnRequest) mailOptions() *smtp.MailOptions {
+	if r == nil {
+		return nil
+	}
+	envID := r.envID
+	if !validEnvID(envID) {
+		// Gravado na fila por uma versão que não validava o ENVID
+		envID = ""
+	}
+	return &smtp.MailOptions{Return: r.ret, EnvelopeID: envID}
+}
+
+// notify informa se o remetente pediu notificação do evento para o
+// destinatário. Sem NOTIFY, apenas falhas são notificadas (RFC 3461, seção 4.1).
+func (r *dsnRequest) notify(rcpt string, event smtp.DSNNotify) bool {
+	opts := r.rcptOptions(rcpt)
+	if opts == nil || len(opts.Notify) == 0 {
+		return event == smtp.DSNNotifyFailure
+	}
+	for _, n := range opts.Notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dsnRecord é a forma de dsnRequest gravada na fila de entrega externa
+type dsnRecord struct {
+	Ret   smtp.DSNReturn               `json:"ret,omitempty"`
+	EnvID string                       `json:"envid,omitempty"`
+	Rcpts map[string]*smtp.RcptOptions `json:"rcpts,omitempty"`
+}
+
+// marshal codifica os parâmetros para a fila; sem parâmetros, retorna nil
+func (r *dsnRequest) marshal() ([]byte, error) {
+	if r == nil {
+		return nil, nil
+	}
+	return json.Marshal(dsnRecord{Ret: r.ret, EnvID: r.envID, Rcpts: r.rcpts})
+}
+
+// unmarshalDSN decodifica os parâmetros gravados por marshal
+func unmarshalDSN(data []byte) (*dsnRequest, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var record dsnRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	return &dsnRequest{ret: record.Ret, envID: record.EnvID, rcpts: record.Rcpts}, nil
+}
+
+// dsnRecipient descreve o resultado da entrega a um destinatário em um
+// relatório de entrega
+type dsnRecipient struct {
+	address    string
+	status     string    // Código estendido (RFC 3463), como 5.1.1
+	remoteMTA  string    // Servidor que respondeu, quando houve conexão
+	diagnostic string    // Resposta SMTP do servidor remoto
+	reason     string    // Descrição exibida na parte legível
+	retryUntil time.Time // Fim das novas tentativas, para atrasos
+}
+
+// dsnStatus retorna o código de status estendido correspondente ao erro de
+// entrega. Falhas de TLS são falhas criptográficas (4.7.5) e os demais erros
+// sem resposta SMTP indicam falha de conexão (4.4.1).
+func dsnStatus(err error) string {
+	var tlsErr *tlsError
+	if errors.As(err, &tlsErr) {
+		return "4.7.5"
+	}
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return "4.4.1"
+	}
+	if code := smtpErr.EnhancedCode; code[0] == 2 || code[0] == 4 || code[0] == 5 {
+		return fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+	}
+	if smtpErr.Code >= 500 {
+		return "5.0.0"
+	}
+	return "4.0.0"
+}
+
+// dsnFailedStatus retorna o código de status de um destinatário que falhou:
+// uma falha temporária que esgotou as tentativas passa a ser permanente
+func dsnFailedStatus(err error) string {
+	status := dsnStatus(err)
+	if strings.HasPrefix(status, "4.") {
+		status = "5." + status[2:]
+	}
+	return status
+}
+
+// dsnDiagnostic retorna a resposta SMTP do erro, para o campo Diagnostic-Code
+func dsnDiagnostic(err error) string {
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) {
+		return ""
+	}
+	message := strings.Join(strings.Fields(smtpErr.Message), " ")
+	if code := smtpErr.EnhancedCode; code[0] != 0 && code != smtp.NoEnhancedCode {
+		return fmt.Sprintf("%d %d.%d.%d %s", smtpErr.Code, code[0], code[1], code[2], message)
+	}
+	return fmt.Sprintf("%d %s", smtpErr.Code, message)
+}
+
+// buildDSN monta o relatório de entrega (RFC 3464) enviado ao remetente: uma
+// parte legível, o estado de cada destinatário e a mensagem original, ou
+// apenas seus cabeçalhos quando pedido com RET=HDRS. Sem RET, a mensagem
+// completa acompanha apenas as falhas.
+func buildDSN(hostname string, env *envelope, action string, rcpts []*dsnRecipient, data []byte, arrival time.Time) []byte {
+	header, _ := parseMessage(data)
+	subject := decodeHeader(header.Get("Subject"))
+
+	var ret smtp.DSNReturn
+	var envID string
+	if env.dsn != nil {
+		ret, envID = env.dsn.ret, env.dsn.envID
+	}
+	full := ret == smtp.DSNReturnFull || (ret == "" && action == dsnFailed)
+
+	var text strings.Builder
+	var title string
+	switch action {
+	case dsnFailed:
+		title = "Falha na entrega"
+		text.WriteString("Não foi possível entregar sua mensagem aos destinatários abaixo.\r\n\r\n")
+	case dsnDelayed:
+		title = "Entrega atrasada"
+		text.WriteString("A entrega de sua mensagem aos destinatários abaixo está atrasada. Novas\r\n")
+		text.WriteString("tentativas serão feitas e você será avisado se a entrega falhar.\r\n\r\n")
+	case dsnDelivered:
+		title = "Mensagem entregue"
+		text.WriteString("Sua mensagem foi entregue aos destinatários abaixo.\r\n\r\n")
+	case dsnRelayed:
+		title = "Mensagem encaminhada"
+		text.WriteString("Sua mensagem foi encaminhada aos destinatários abaixo, mas o servidor de\r\n")
+		text.WriteString("destino não envia confirmações de entrega.\r\n\r\n")
+	}
+	for _, rcpt := range rcpts {
+		if rcpt.reason != "" {
+			fmt.Fprintf(&text, "<%s>: %s\r\n", rcpt.address, rcpt.reason)
+		} else {
+			fmt.Fprintf(&text, "<%s>\r\n", rcpt.address)
+		}
+	}
+
+	var status strings.Builder
+	fmt.Fprintf(&status, "Reporting-MTA: dns; %s\r\n", hostname)
+	if envID != "" {
+		fmt.Fprintf(&status, "Original-Envelope-Id: %s\r\n", xtext(envID))
+	}
+	fmt.Fprintf(&status, "Arrival-Date: %s\r\n", arrival.Format(time.RFC1123Z))
+	now := time.Now().Format(time.RFC1123Z)
+	for _, rcpt := range rcpts {
+		status.WriteString("\r\n")
+		if opts := env.dsn.rcptOptions(rcpt.address); opts != nil && opts.OriginalRecipient != "" {
+			fmt.Fprintf(&status, "Original-Recipient: %s;%s\r\n", opts.OriginalRecipientType, opts.OriginalRecipient)
+		}
+		fmt.Fprintf(&status, "Final-Recipient: rfc822; %s\r\n", rcpt.address)
+		fmt.Fprintf(&status, "Action: %s\r\n", action)
+		fmt.Fprintf(&status, "Status: %s\r\n", rcpt.status)
+		if rcpt.remoteMTA != "" {
+			fmt.Fprintf(&status, "Remote-MTA: dns; %s\r\n", rcpt.remoteMTA)
+		}
+		if rcpt.diagnostic != "" {
+			fmt.Fprintf(&status, "Diagnostic-Code: smtp; %s\r\n", rcpt.diagnostic)
+		}
+		if action == dsnFailed || action == dsnDelayed {
+			fmt.Fprintf(&status, "Last-Attempt-Date: %s\r\n", now)
+		}
+		if !rcpt.retryUntil.IsZero() {
+			fmt.Fprintf(&status, "Will-Retry-Until: %s\r\n", rcpt.retryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	part, _ := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Transfer-Encoding": {"8bit"}})
+	part.Write([]byte(text.String()))
+	part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	part.Write([]byte(status.String()))
+	if full {
+		part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/rfc822"}})
+		part.Write(data)
+	} else {
+		fields, _ := splitHeader(data)
+		part, _ = w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/rfc822-headers"}})
+		for _, f := range fields {
+			part.Write([]byte(f.name + ":" + f.value + "\r\n"))
+		}
+	}
+	w.Close()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", env.from)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", title+": "+subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-Id: %s\r\n", newMessageID(hostname))
+	b.WriteString("Auto-Submitted: auto-generated\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: %s\r\n", mime.FormatMediaType("multipart/report",
+		map[string]string{"report-type": "delivery-status", "boundary": w.Boundary()}))
+	b.WriteString("\r\n")
+	b.Write(body.Bytes())
+	return b.Bytes()
+}
+
+// sendDSN envia ao remetente um relatório de entrega com o resultado dos
+// destinatários informados. Mensagens sem remetente de envelope, como os
+// próprios relatórios, nunca geram notificações.
+func (d *Delivery) sendDSN(env *envelope, action string, rcpts []*dsnRecipient, data []byte, arrival time.Time) {
+	if env.from == "" || len(rcpts) == 0 {
+		return
+	}
+
+	report := buildDSN(d.hostname, env, action, rcpts, data, arrival)
+	if err := d.Submit("", []string{env.from}, report); err != nil {
+		log.Printf("Erro ao enviar relatório de entrega para %s: %v", env.from, err)
+	}
+}
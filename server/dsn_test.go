@@ -0,0 +1,48 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXtext(t *testing.T) {
+	tests := []struct {
+		value, want string
+	}{
+		{"abc-123", "abc-123"},
+		{"a+b=c", "a+2Bb+3Dc"},
+		{"com espaço", "com+20espa+C3+A7o"},
+		{"a\r\nb", "a+0D+0Ab"},
+	}
+	for _, tt := range tests {
+		if got := xtext(tt.value); got != tt.want {
+			t.Errorf("xtext(%q) = %s, esperado %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDSN(t *testing.T) {
+	env := &envelope{
+		from: "alice@remote.example",
+		to:   []string{"bob@localhost"},
+		// Um ENVID inválido gravado na fila não pode injetar campos no relatório
+		dsn: &dsnRequest{envID: "id 1\r\nX-Injetado: sim"},
+	}
+	report := string(buildDSN("mx.localhost", env, dsnFailed,
+		[]*dsnRecipient{{address: "bob@localhost", status: "5.1.1"}}, []byte(smtpTestMessage), time.Now()))
+
+	header := messageHeader([]byte(report))
+	if !strings.Contains(header, "Auto-Submitted: auto-generated\r\n") {
+		t.Errorf("relatório sem Auto-Submitted: auto-generated:\n%s", header)
+	}
+	if !strings.Contains(report, "Original-Envelope-Id: id+201+0D+0AX-Injetado:+20sim\r\n") {
+		t.Errorf("ENVID não codificado como xtext:\n%s", report)
+	}
+	if strings.Contains(report, "\r\nX-Injetado") {
+		t.Errorf("ENVID injetou um campo no relatório:\n%s", report)
+	}
+	if opts := env.dsn.mailOptions(); opts.EnvelopeID != "" {
+		t.Errorf("ENVID inválido repassado ao próximo servidor: %q", opts.EnvelopeID)
+	}
+}
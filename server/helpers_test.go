@@ -0,0 +1,100 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// newTestConfig cria uma configuração com banco SQLite em um diretório
+// temporário do teste
+func newTestConfig(t *testing.T) *config.Config {
+	t.Helper()
+	cfg := &config.Config{}
+	cfg.Database.Type = "sqlite"
+	cfg.Database.Path = filepath.Join(t.TempDir(), "db.sqlite")
+	cfg.SMTP.Domain = "localhost"
+	cfg.SRS.Secret = "segredo-de-teste"
+	return cfg
+}
+
+// newTestStorage abre o armazenamento da configuração e cria o usuário
+// alice@localhost
+func newTestStorage(t *testing.T, cfg *config.Config) (storage.Storage, *storage.User) {
+	t.Helper()
+	store, err := storage.NewStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	user := &storage.User{Username: "alice", Password: "senha", Email: "alice@localhost"}
+	if err := store.CreateUser(user); err != nil {
+		t.Fatal(err)
+	}
+	return store, user
+}
+
+// newTestSession cria uma sessão SMTP sem autenticação e sem conexão, como a
+// de um servidor remoto entregando para alice@localhost
+func newTestSession(t *testing.T, cfg *config.Config, store storage.Storage) *SMTPSession {
+	t.Helper()
+	be := NewSMTPBackend(store, NewDelivery(cfg, store))
+	be.spam = NewSpamFilter(cfg)
+	be.antivirus = NewAntivirus(cfg)
+	return &SMTPSession{backend: be}
+}
+
+// sendTestMessage executa uma transação SMTP na sessão
+func sendTestMessage(t *testing.T, s *SMTPSession, from, to, msg string) error {
+	t.Helper()
+	s.Reset()
+	if err := s.Mail(from, &smtp.MailOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rcpt(to, &smtp.RcptOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	return s.Data(strings.NewReader(msg))
+}
+
+// mailboxMessages retorna as mensagens de uma caixa do usuário
+func mailboxMessages(t *testing.T, store storage.Storage, user *storage.User, name string) []*storage.Message {
+	t.Helper()
+	mailbox, err := store.GetMailbox(user.ID, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages, err := store.ListMessages(mailbox.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return messages
+}
+
+// pendingOutbound retorna as mensagens da fila de entrega externa
+func pendingOutbound(t *testing.T, store storage.Storage) []*storage.OutboundMessage {
+	t.Helper()
+	pending, err := store.PendingOutbound(time.Now().Add(time.Hour), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pending
+}
+
+// messageHeader retorna o cabeçalho de uma mensagem
+func messageHeader(data []byte) string {
+	header := string(data)
+	if i := strings.Index(header, "\r\n\r\n"); i >= 0 {
+		header = header[:i+2]
+	}
+	return header
+}
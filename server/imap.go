@@ -1,25 +1,34 @@
 package server
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/carloslauriano/simpleEmail/config"
 	"github.com/carloslauriano/simpleEmail/storage"
 	"github.com/emersion/go-imap"
 	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
 )
 
 // IMAPBackend implementa a interface backend.Backend
 type IMAPBackend struct {
 	store storage.Storage
+	quota *QuotaChecker
+	bayes *Bayes // nil quando o classificador está desabilitado
 }
 
 // NewIMAPBackend cria um novo backend IMAP
-func NewIMAPBackend(store storage.Storage) *IMAPBackend {
+func NewIMAPBackend(store storage.Storage, cfg *config.Config) *IMAPBackend {
 	return &IMAPBackend{
 		store: store,
+		quota: NewQuotaChecker(store, cfg),
+		bayes: NewBayes(cfg, store),
 	}
 }
 
@@ -36,79 +45,222 @@ func (b *IMAPBackend) Login(connInfo *imap.ConnInfo, username, password string)
 	}, nil
 }
 
-// IMAPUser implementa a interface backend.User
+// IMAPUser implementa a interface backend.User. Cada sessão autenticada
+// possui seu próprio IMAPUser, que guarda as extensões habilitadas nela.
 type IMAPUser struct {
 	backend *IMAPBackend
 	user    *storage.User
+
+	condstore bool // CONDSTORE habilitado na sessão (RFC 7162)
+	qresync   bool // QRESYNC habilitado na sessão (RFC 7162)
+	compress  bool // COMPRESS=DEFLATE ativo na sessão (RFC 4978)
 }
 
 // Username retorna o nome do usuário
 func (u *IMAPUser) Username() string {
-	return u.user.Username
+	return loginName(u.user)
 }
 
-// ListMailboxes lista as caixas de entrada do usuário
+// loginName retorna o login do usuário; usuários de domínios virtuais são
+// identificados pelo endereço completo
+func loginName(user *storage.User) string {
+	if user.DomainID != 0 {
+		return user.Email
+	}
+	return user.Username
+}
+
+// ListMailboxes lista as caixas de entrada do usuário e as compartilhadas
+// com ele. Com subscribed, lista as caixas assinadas, inclusive as que não
+// existem mais (como \Noselect).
 func (u *IMAPUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
 	mailboxes, err := u.backend.store.ListMailboxes(u.user.ID)
 	if err != nil {
 		return nil, fmt.Errorf("falha ao listar caixas de entrada: %w", err)
 	}
 
-	result := make([]backend.Mailbox, len(mailboxes))
-	for i, m := range mailboxes {
-		result[i] = &IMAPMailbox{
-			backend: u.backend,
-			user:    u.user,
-			mailbox: m,
+	if !subscribed {
+		result := make([]backend.Mailbox, len(mailboxes))
+		for i, m := range mailboxes {
+			result[i] = &IMAPMailbox{
+				backend:    u.backend,
+				user:       u.user,
+				owner:      u.user,
+				mailbox:    m,
+				rights:     allRights,
+				attributes: mailboxAttributes(m, mailboxes),
+			}
+		}
+		shared, err := u.sharedMailboxes()
+		if err != nil {
+			return nil, fmt.Errorf("falha ao listar caixas compartilhadas: %w", err)
+		}
+		return append(result, shared...), nil
+	}
+
+	names, err := u.backend.store.ListSubscriptions(u.user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar assinaturas: %w", err)
+	}
+
+	byName := make(map[string]*storage.Mailbox, len(mailboxes))
+	for _, m := range mailboxes {
+		byName[m.Name] = m
+	}
+
+	result := make([]backend.Mailbox, len(names))
+	for i, name := range names {
+		mailbox := &IMAPMailbox{backend: u.backend, user: u.user, owner: u.user, rights: allRights}
+		if m, ok := byName[name]; ok {
+			mailbox.mailbox = m
+			mailbox.attributes = mailboxAttributes(m, mailboxes)
+		} else if shared := u.sharedSubscription(name); shared != nil {
+			mailbox = shared
+		} else {
+			mailbox.mailbox = &storage.Mailbox{UserID: u.user.ID, Name: name, Path: name, NoSelect: true}
+			mailbox.attributes = []string{imap.NoSelectAttr}
 		}
+		result[i] = mailbox
 	}
 
 	return result, nil
 }
 
-// GetMailbox obtém uma caixa de entrada específica
+// GetMailbox obtém uma caixa de entrada específica, própria ou compartilhada
+// com o usuário
 func (u *IMAPUser) GetMailbox(name string) (backend.Mailbox, error) {
-	mailbox, err := u.backend.store.GetMailbox(u.user.ID, name)
+	mailbox, err := u.backend.lookupMailbox(u.user, name)
 	if err != nil {
-		return nil, fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+		return nil, err
 	}
 
-	return &IMAPMailbox{
-		backend: u.backend,
-		user:    u.user,
-		mailbox: mailbox,
-	}, nil
+	if mailbox.mailbox.NoSelect {
+		return nil, errors.New("caixa de correio não selecionável")
+	}
+
+	return mailbox, nil
 }
 
-// CreateMailbox cria uma nova caixa de entrada
+// CreateMailbox cria uma nova caixa de entrada, incluindo os níveis
+// superiores da hierarquia que ainda não existirem
 func (u *IMAPUser) CreateMailbox(name string) error {
-	mailbox := &storage.Mailbox{
-		UserID: u.user.ID,
-		Name:   name,
+	return u.createMailbox(name, "")
+}
+
+func (u *IMAPUser) createMailbox(name, specialUse string) error {
+	if strings.EqualFold(name, "INBOX") {
+		return errMailboxExists
+	}
+
+	// Em caixas compartilhadas a nova caixa é criada na conta do dono
+	owner, local := u.user, name
+	if isSharedName(name) {
+		var err error
+		if owner, local, err = u.sharedParent(name); err != nil {
+			return err
+		}
 	}
 
-	return u.backend.store.CreateMailbox(mailbox)
+	mailbox, err := createMailbox(u.backend.store, owner.ID, local, specialUse)
+	if err != nil {
+		return err
+	}
+	return u.backend.inheritACL(mailbox)
 }
 
-// DeleteMailbox remove uma caixa de entrada
+// DeleteMailbox remove uma caixa de entrada. Caixas com subcaixas têm as
+// mensagens removidas e permanecem como \Noselect (RFC 3501, seção 6.3.4).
 func (u *IMAPUser) DeleteMailbox(name string) error {
-	mailbox, err := u.backend.store.GetMailbox(u.user.ID, name)
+	target, err := u.backend.lookupMailbox(u.user, name)
+	if err != nil {
+		return err
+	}
+	if target.mailbox.Name == "INBOX" {
+		return errors.New("a INBOX não pode ser removida")
+	}
+	if !target.hasRights("x") {
+		return errNoPermission("sem permissão para remover " + name)
+	}
+
+	mailboxes, err := u.backend.store.ListMailboxes(target.owner.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao listar caixas de entrada: %w", err)
+	}
+
+	mailbox := target.mailbox
+	children := false
+	for _, m := range mailboxes {
+		if isChildMailbox(mailbox.Name, m.Name) {
+			children = true
+		}
+	}
+
+	if !children {
+		return u.backend.store.DeleteMailbox(mailbox.ID)
+	}
+	if mailbox.NoSelect {
+		return errors.New("a caixa possui subcaixas e já não é selecionável")
+	}
+
+	messages, err := u.backend.store.ListMessages(mailbox.ID)
 	if err != nil {
-		return fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+		return fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+	for _, msg := range messages {
+		if err := u.backend.store.DeleteMessage(msg.ID); err != nil {
+			return fmt.Errorf("falha ao excluir mensagem: %w", err)
+		}
 	}
 
-	return u.backend.store.DeleteMailbox(mailbox.ID)
+	mailbox.NoSelect = true
+	mailbox.SpecialUse = ""
+	return u.backend.store.UpdateMailbox(mailbox)
 }
 
-// RenameMailbox renomeia uma caixa de entrada
+// RenameMailbox renomeia uma caixa de entrada e suas subcaixas. Renomear a
+// INBOX move suas mensagens para a nova caixa (RFC 3501, seção 6.3.5). Caixas
+// compartilhadas só podem ser renomeadas dentro da conta do dono.
 func (u *IMAPUser) RenameMailbox(existingName, newName string) error {
-	mailbox, err := u.backend.store.GetMailbox(u.user.ID, existingName)
+	newName = strings.TrimSuffix(newName, storage.MailboxDelimiter)
+	if strings.EqualFold(newName, "INBOX") || isChildMailbox(existingName, newName) {
+		return errors.New("nome de destino inválido")
+	}
+
+	source, err := u.backend.lookupMailbox(u.user, existingName)
 	if err != nil {
-		return fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+		return err
+	}
+	if !source.hasRights("x") {
+		return errNoPermission("sem permissão para renomear " + existingName)
 	}
 
-	mailbox.Name = newName
-	return u.backend.store.UpdateMailbox(mailbox)
+	owner, local := u.user, newName
+	if isSharedName(newName) {
+		if owner, local, err = u.sharedParent(newName); err != nil {
+			return err
+		}
+	}
+	if owner.ID != source.owner.ID {
+		return errNoPermission("caixas não podem ser movidas para a conta de outro usuário")
+	}
+
+	if _, err := u.backend.store.GetMailbox(owner.ID, local); err == nil {
+		return errMailboxExists
+	} else if !errors.Is(err, storage.ErrMailboxNotFound) {
+		return err
+	}
+
+	for _, parent := range parentMailboxes(local) {
+		if _, err := createMailbox(u.backend.store, owner.ID, parent, ""); err != nil && !errors.Is(err, errMailboxExists) {
+			return err
+		}
+	}
+
+	err = u.backend.store.RenameMailbox(owner.ID, source.mailbox.Name, local)
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return backend.ErrNoSuchMailbox
+	}
+	return err
 }
 
 // Logout finaliza a sessão
@@ -116,65 +268,193 @@ func (u *IMAPUser) Logout() error {
 	return nil
 }
 
-// IMAPMailbox implementa a interface backend.Mailbox
+// IMAPMailbox implementa a interface backend.Mailbox. A caixa obtida por
+// SELECT pertence à sessão e guarda o mapa de números de sequência conhecido
+// pelo cliente, que só muda quando as alterações são informadas a ele.
 type IMAPMailbox struct {
-	backend *IMAPBackend
-	user    *storage.User
-	mailbox *storage.Mailbox
+	backend    *IMAPBackend
+	user       *storage.User // Usuário da sessão
+	owner      *storage.User // Dono da caixa; difere de user nas compartilhadas
+	mailbox    *storage.Mailbox
+	prefix     string   // "Shared/<dono>/" nas caixas compartilhadas
+	rights     string   // Direitos do usuário sobre a caixa (RFC 4314)
+	attributes []string // Atributos LIST; calculados sob demanda quando nil
+
+	// Estado da sessão em que a caixa está selecionada
+	uids     []uint32        // UID de cada número de sequência visto pela sessão
+	recent   *imap.SeqSet    // UIDs com \Recent nesta sessão
+	readOnly bool            // Selecionada por EXAMINE, sem reivindicar \Recent
+	conn     imapserver.Conn // Conexão em que a caixa está selecionada
 }
 
-// Name retorna o nome da caixa de entrada
+// Name retorna o nome da caixa de entrada como visto pelo usuário da sessão
 func (m *IMAPMailbox) Name() string {
-	return m.mailbox.Name
+	return m.prefix + m.mailbox.Name
+}
+
+// hasRights informa se o usuário tem todos os direitos informados
+func (m *IMAPMailbox) hasRights(rights string) bool {
+	for _, r := range rights {
+		if !strings.ContainsRune(m.rights, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// canSetFlag informa se o usuário pode alterar a flag: \Seen exige o direito
+// "s", \Deleted o direito "t" e as demais o direito "w"
+func (m *IMAPMailbox) canSetFlag(flag string) bool {
+	switch imap.CanonicalFlag(flag) {
+	case imap.SeenFlag:
+		return m.hasRights("s")
+	case imap.DeletedFlag:
+		return m.hasRights("t")
+	}
+	return m.hasRights("w")
+}
+
+// allowedFlags retira da lista as flags que o usuário não pode alterar
+func (m *IMAPMailbox) allowedFlags(flags []string) []string {
+	allowed := []string{}
+	for _, flag := range flags {
+		if m.canSetFlag(flag) {
+			allowed = append(allowed, flag)
+		}
+	}
+	return allowed
 }
 
 // Info retorna informações sobre a caixa de entrada
 func (m *IMAPMailbox) Info() (*imap.MailboxInfo, error) {
+	if m.attributes == nil {
+		mailboxes, err := m.backend.store.ListMailboxes(m.owner.ID)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao listar caixas de entrada: %w", err)
+		}
+		m.attributes = mailboxAttributes(m.mailbox, mailboxes)
+	}
+
 	return &imap.MailboxInfo{
-		Attributes: []string{},
-		Delimiter:  "/",
-		Name:       m.mailbox.Name,
+		Attributes: m.attributes,
+		Delimiter:  storage.MailboxDelimiter,
+		Name:       m.Name(),
 	}, nil
 }
 
-// Status retorna o status da caixa de entrada
+// Status retorna o status da caixa de entrada a partir dos contadores
+// agregados, sem ler as mensagens
 func (m *IMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
-	status := &imap.MailboxStatus{
-		Name: m.mailbox.Name,
+	if !m.hasRights("r") {
+		return nil, errNoPermission("sem permissão para ler " + m.Name())
 	}
-
-	messages, err := m.backend.store.ListMessages(m.mailbox.ID)
+	counters, err := m.backend.store.GetMailboxCounters(m.mailbox.ID)
 	if err != nil {
-		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+		return nil, fmt.Errorf("falha ao obter contadores da caixa: %w", err)
 	}
+	return m.status(counters, items), nil
+}
+
+func (m *IMAPMailbox) status(counters *storage.MailboxCounters, items []imap.StatusItem) *imap.MailboxStatus {
+	status := imap.NewMailboxStatus(m.Name(), items)
+	status.Flags = []string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag}
+	status.PermanentFlags = m.allowedFlags([]string{imap.SeenFlag, imap.AnsweredFlag, imap.FlaggedFlag, imap.DeletedFlag, imap.DraftFlag, imap.TryCreateFlag})
 
 	for _, item := range items {
 		switch item {
 		case imap.StatusMessages:
-			status.Messages = uint32(len(messages))
+			status.Messages = counters.Messages
 		case imap.StatusRecent:
-			status.Recent = 0
+			status.Recent = counters.Recent
 		case imap.StatusUnseen:
-			unseen := 0
-			for _, msg := range messages {
-				if !msg.Seen {
-					unseen++
-				}
-			}
-			status.Unseen = uint32(unseen)
+			status.Unseen = counters.Unseen
 		case imap.StatusUidNext:
-			status.UidNext = uint32(len(messages) + 1)
+			status.UidNext = counters.UIDNext
 		case imap.StatusUidValidity:
-			status.UidValidity = 1
+			status.UidValidity = m.mailbox.UIDValidity()
+		case statusHighestModSeq:
+			status.Items[item] = imap.RawString(strconv.FormatUint(counters.HighestModSeq, 10))
+		case statusSize:
+			status.Items[item] = imap.RawString(strconv.FormatInt(counters.Size, 10))
+		}
+	}
+
+	return status
+}
+
+// open seleciona a caixa para a sessão: inicia o mapa de sequência e, fora
+// do modo somente leitura, reivindica \Recent para as mensagens ainda não
+// vistas por outra sessão. O status retornado corresponde ao mapa iniciado.
+func (m *IMAPMailbox) open(readOnly bool, items []imap.StatusItem) (*imap.MailboxStatus, *storage.MailboxCounters, error) {
+	if !m.hasRights("r") {
+		return nil, nil, errNoPermission("sem permissão para ler " + m.Name())
+	}
+	counters, err := m.backend.store.GetMailboxCounters(m.mailbox.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("falha ao obter contadores da caixa: %w", err)
+	}
+	uids, err := m.backend.store.ListMessageUIDs(m.mailbox.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+
+	m.uids = uids
+	m.recent = new(imap.SeqSet)
+	m.readOnly = readOnly
+	if err := m.claimRecent(); err != nil {
+		return nil, nil, err
+	}
+
+	status := m.status(counters, items)
+	status.Messages = uint32(len(m.uids))
+	status.Recent = m.recentCount()
+	for i, uid := range m.uids {
+		if uid == counters.FirstUnseen {
+			status.UnseenSeqNum = uint32(i + 1)
 		}
 	}
+	return status, counters, nil
+}
+
+// claimRecent reivindica \Recent para as mensagens do mapa de sequência que
+// nenhuma sessão viu ainda
+func (m *IMAPMailbox) claimRecent() error {
+	if m.readOnly || len(m.uids) == 0 {
+		return nil
+	}
+	last := m.uids[len(m.uids)-1]
+	first, err := m.backend.store.ClaimRecent(m.mailbox.ID, last)
+	if err != nil {
+		return fmt.Errorf("falha ao reivindicar mensagens recentes: %w", err)
+	}
+	if first != 0 {
+		m.recent.AddRange(first, last)
+	}
+	return nil
+}
 
-	return status, nil
+// isRecent informa se a mensagem tem \Recent nesta sessão
+func (m *IMAPMailbox) isRecent(uid uint32) bool {
+	return m.recent != nil && m.recent.Contains(uid)
+}
+
+// recentCount conta as mensagens do mapa de sequência com \Recent
+func (m *IMAPMailbox) recentCount() uint32 {
+	var n uint32
+	for _, uid := range m.uids {
+		if m.isRecent(uid) {
+			n++
+		}
+	}
+	return n
 }
 
 // SetSubscribed marca a caixa de entrada como inscrita
 func (m *IMAPMailbox) SetSubscribed(subscribed bool) error {
-	return nil
+	if subscribed {
+		return m.backend.store.SubscribeMailbox(m.user.ID, m.Name())
+	}
+	return m.backend.store.UnsubscribeMailbox(m.user.ID, m.Name())
 }
 
 // Check verifica a integridade da caixa de entrada
@@ -182,193 +462,483 @@ func (m *IMAPMailbox) Check() error {
 	return nil
 }
 
+// sessionMessages lista as mensagens do mapa de sequência da sessão, junto
+// com seus números de sequência. Mensagens removidas por outras sessões e
+// ainda não informadas são omitidas, e as recém-chegadas só aparecem depois
+// de anunciadas por EXISTS.
+func (m *IMAPMailbox) sessionMessages() ([]*storage.Message, []uint32, error) {
+	messages, err := m.backend.store.ListMessages(m.mailbox.ID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+
+	byUID := make(map[uint32]*storage.Message, len(messages))
+	for _, msg := range messages {
+		byUID[msg.UID] = msg
+	}
+
+	var selected []*storage.Message
+	var seqNums []uint32
+	for i, uid := range m.uids {
+		if msg, ok := byUID[uid]; ok {
+			selected = append(selected, msg)
+			seqNums = append(seqNums, uint32(i+1))
+		}
+	}
+
+	return selected, seqNums, nil
+}
+
+// messagesIn lista as mensagens contidas no conjunto, interpretado como UIDs
+// ou números de sequência, junto com seus números de sequência
+func (m *IMAPMailbox) messagesIn(uid bool, seqSet *imap.SeqSet) ([]*storage.Message, []uint32, error) {
+	messages, seqNums, err := m.sessionMessages()
+	if err != nil || len(m.uids) == 0 {
+		return nil, nil, err
+	}
+
+	// "*" representa a última mensagem conhecida pela sessão
+	last := uint32(len(m.uids))
+	if uid {
+		last = m.uids[len(m.uids)-1]
+	}
+
+	var selected []*storage.Message
+	var selectedNums []uint32
+	for i, msg := range messages {
+		id := seqNums[i]
+		if uid {
+			id = msg.UID
+		}
+		if seqSet.Contains(id) || (id == last && seqSet.Contains(0)) {
+			selected = append(selected, msg)
+			selectedNums = append(selectedNums, seqNums[i])
+		}
+	}
+
+	return selected, selectedNums, nil
+}
+
 // ListMessages lista as mensagens da caixa de entrada
 func (m *IMAPMailbox) ListMessages(uid bool, seqSet *imap.SeqSet, items []imap.FetchItem, ch chan<- *imap.Message) error {
 	defer close(ch)
 
-	messages, err := m.backend.store.ListMessages(m.mailbox.ID)
+	messages, seqNums, err := m.messagesIn(uid, seqSet)
 	if err != nil {
-		return fmt.Errorf("falha ao listar mensagens: %w", err)
+		return err
 	}
 
 	for i, msg := range messages {
-		seqNum := uint32(i + 1)
-		if seqSet.Contains(seqNum) {
-			imapMsg := &imap.Message{
-				SeqNum: seqNum,
-				Uid:    uint32(msg.ID),
-				Items:  make(map[imap.FetchItem]interface{}),
-			}
-
-			for _, item := range items {
-				switch item {
-				case imap.FetchEnvelope:
-					imapMsg.Items[item] = &imap.Envelope{
-						Date:      msg.Date,
-						Subject:   msg.Subject,
-						From:      []*imap.Address{{PersonalName: msg.From}},
-						To:        []*imap.Address{{PersonalName: msg.To}},
-						MessageId: fmt.Sprintf("%d", msg.ID),
-					}
-				case imap.FetchBody, imap.FetchBodyStructure:
-					imapMsg.Items[item] = &imap.BodyStructure{
-						MIMEType:    "text",
-						MIMESubType: "plain",
-						Size:        uint32(len(msg.Body)),
-					}
-				case imap.FetchFlags:
-					flags := []string{}
-					if msg.Seen {
-						flags = append(flags, imap.SeenFlag)
-					}
-					if msg.Deleted {
-						flags = append(flags, imap.DeletedFlag)
-					}
-					if msg.Draft {
-						flags = append(flags, imap.DraftFlag)
-					}
-					imapMsg.Items[item] = flags
-				case imap.FetchInternalDate:
-					imapMsg.Items[item] = msg.Date
-				case imap.FetchRFC822Size:
-					imapMsg.Items[item] = msg.Size
-				case imap.FetchUid:
-					imapMsg.Items[item] = msg.ID
+		imapMsg := imap.NewMessage(seqNums[i], items)
+		imapMsg.Uid = msg.UID
+
+		for _, item := range items {
+			switch item {
+			case imap.FetchEnvelope:
+				imapMsg.Envelope = &imap.Envelope{
+					Date:      msg.Date,
+					Subject:   msg.Subject,
+					From:      []*imap.Address{{PersonalName: msg.From}},
+					To:        []*imap.Address{{PersonalName: msg.To}},
+					MessageId: fmt.Sprintf("%d", msg.ID),
+				}
+			case imap.FetchBody, imap.FetchBodyStructure:
+				imapMsg.BodyStructure = &imap.BodyStructure{
+					MIMEType:    "text",
+					MIMESubType: "plain",
+					Size:        uint32(len(msg.Body)),
 				}
+			case imap.FetchFlags:
+				imapMsg.Flags = messageFlags(msg)
+				if m.isRecent(msg.UID) {
+					imapMsg.Flags = append(imapMsg.Flags, imap.RecentFlag)
+				}
+			case imap.FetchInternalDate:
+				imapMsg.InternalDate = msg.Date
+			case imap.FetchRFC822Size:
+				imapMsg.Size = uint32(msg.Size)
+			case fetchModSeq:
+				imapMsg.Items[item] = []interface{}{imap.RawString(strconv.FormatUint(msg.ModSeq, 10))}
 			}
-
-			ch <- imapMsg
 		}
+
+		ch <- imapMsg
 	}
 
 	return nil
 }
 
+// messageFlags retorna as flags IMAP da mensagem
+func messageFlags(msg *storage.Message) []string {
+	flags := []string{}
+	if msg.Seen {
+		flags = append(flags, imap.SeenFlag)
+	}
+	if msg.Deleted {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	if msg.Draft {
+		flags = append(flags, imap.DraftFlag)
+	}
+	return append(flags, strings.Fields(msg.Flags)...)
+}
+
 // SearchMessages pesquisa mensagens na caixa de entrada
 func (m *IMAPMailbox) SearchMessages(uid bool, criteria *imap.SearchCriteria) ([]uint32, error) {
-	messages, err := m.backend.store.ListMessages(m.mailbox.ID)
+	messages, seqNums, err := m.sessionMessages()
 	if err != nil {
-		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+		return nil, err
 	}
 
 	var results []uint32
 	for i, msg := range messages {
-		seqNum := uint32(i + 1)
-		if criteria.SeqNum != nil && !criteria.SeqNum.Contains(seqNum) {
+		seqNum := seqNums[i]
+		if !m.matches(&searchMessage{msg: msg, seqNum: seqNum}, criteria) {
 			continue
 		}
 
-		if criteria.Uid != nil && !criteria.Uid.Contains(uint32(msg.ID)) {
-			continue
+		if uid {
+			results = append(results, msg.UID)
+		} else {
+			results = append(results, seqNum)
 		}
+	}
 
-		if criteria.Since != (time.Time{}) && msg.Date.Before(criteria.Since) {
-			continue
-		}
+	return results, nil
+}
 
-		if criteria.Before != (time.Time{}) && msg.Date.After(criteria.Before) {
-			continue
-		}
+// CreateMessage cria uma nova mensagem na caixa de entrada (APPEND)
+func (m *IMAPMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
+	_, err := m.createMessages([]*appendMessage{{flags: flags, date: date, body: body}})
+	return err
+}
+
+// appendMessage é uma das mensagens de um APPEND
+type appendMessage struct {
+	flags []string
+	date  time.Time
+	body  imap.Literal
+}
 
-		matches := true
+// createMessages grava as mensagens de um APPEND, com uma ou várias mensagens
+// (MULTIAPPEND, RFC 3502), e as retorna com os UIDs atribuídos. Todas são
+// gravadas ou nenhuma é. Exige o direito "i"; as flags que o usuário não pode
+// alterar são ignoradas.
+func (m *IMAPMailbox) createMessages(appends []*appendMessage) ([]*storage.Message, error) {
+	if !m.hasRights("i") {
+		return nil, errNoPermission("sem permissão para inserir mensagens em " + m.Name())
+	}
 
-		if criteria.Seen && !msg.Seen {
-			matches = false
+	messages := make([]*storage.Message, len(appends))
+	var size int64
+	for i, a := range appends {
+		data, err := io.ReadAll(a.body)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao ler mensagem: %w", err)
 		}
+		size += int64(len(data))
 
-		if criteria.Unseen && msg.Seen {
-			matches = false
+		date := a.date
+		if date.IsZero() {
+			date = time.Now()
 		}
 
-		if criteria.Deleted && !msg.Deleted {
-			matches = false
+		header, content := parseMessage(data)
+		msg := &storage.Message{
+			MailboxID: m.mailbox.ID,
+			From:      header.Get("From"),
+			To:        header.Get("To"),
+			Cc:        header.Get("Cc"),
+			Subject:   header.Get("Subject"),
+			Date:      date,
+			Body:      string(content),
+			RawData:   data,
+			Size:      len(data),
 		}
+		applyFlags(msg, m.allowedFlags(a.flags))
+		applyThreadHeaders(msg, header)
+		messages[i] = msg
+	}
 
-		if criteria.Undeleted && msg.Deleted {
-			matches = false
-		}
+	if err := m.checkQuota(size, int64(len(messages))); err != nil {
+		return nil, err
+	}
 
-		if criteria.Draft && !msg.Draft {
-			matches = false
-		}
+	if err := m.backend.store.CreateMessages(messages); err != nil {
+		return nil, fmt.Errorf("falha ao salvar mensagem: %w", err)
+	}
+	return messages, nil
+}
 
-		if criteria.Undraft && msg.Draft {
-			matches = false
-		}
+// checkQuota verifica a cota do dono da caixa, respondendo NO [OVERQUOTA]
+// quando ela seria excedida (RFC 9208)
+func (m *IMAPMailbox) checkQuota(size, count int64) error {
+	err := m.backend.quota.Check(m.owner, size, count)
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "OVERQUOTA",
+			Info: quota.Error(),
+		}}
+	}
+	return err
+}
 
-		if !matches {
+// UpdateMessagesFlags atualiza as flags das mensagens. Mensagens cujas flags
+// não mudam mantêm sua sequência de modificação, e as flags que o usuário
+// não pode alterar são mantidas (RFC 4314, seção 4).
+func (m *IMAPMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
+	messages, _, err := m.messagesIn(uid, seqSet)
+	if err != nil {
+		return err
+	}
+
+	allowed := m.allowedFlags(flags)
+	for _, msg := range messages {
+		requested := allowed
+		if operation == imap.SetFlags {
+			for _, flag := range messageFlags(msg) {
+				if !m.canSetFlag(flag) {
+					requested = append(requested[:len(requested):len(requested)], flag)
+				}
+			}
+		}
+		if !updateFlags(msg, operation, requested) {
 			continue
 		}
-
-		if criteria.Header != nil {
-			// Implementar pesquisa por cabeçalho
+		if err := m.backend.store.UpdateMessageFlags(msg.ID, msg.Flags, msg.Seen, msg.Deleted, msg.Draft); err != nil {
+			return fmt.Errorf("falha ao atualizar flags: %w", err)
 		}
+	}
 
-		if criteria.Body != nil {
-			// Implementar pesquisa por corpo
+	return nil
+}
+
+// updateFlags aplica a operação STORE às flags da mensagem e informa se
+// alguma flag mudou
+func updateFlags(msg *storage.Message, operation imap.FlagsOp, flags []string) bool {
+	current := messageFlags(msg)
+	var updated []string
+	switch operation {
+	case imap.SetFlags:
+		updated = flags
+	case imap.AddFlags:
+		updated = current
+		for _, flag := range flags {
+			if !containsFlag(updated, flag) {
+				updated = append(updated, flag)
+			}
+		}
+	case imap.RemoveFlags:
+		for _, flag := range current {
+			if !containsFlag(flags, flag) {
+				updated = append(updated, flag)
+			}
 		}
+	}
 
-		if criteria.Text != nil {
-			// Implementar pesquisa por texto
+	changed := len(updated) != len(current)
+	for _, flag := range updated {
+		if !containsFlag(current, flag) {
+			changed = true
 		}
+	}
+	if !changed {
+		return false
+	}
 
-		if uid {
-			results = append(results, uint32(msg.ID))
-		} else {
-			results = append(results, seqNum)
+	msg.Seen, msg.Deleted, msg.Draft = false, false, false
+	var keywords []string
+	for _, flag := range updated {
+		switch imap.CanonicalFlag(flag) {
+		case imap.SeenFlag:
+			msg.Seen = true
+		case imap.DeletedFlag:
+			msg.Deleted = true
+		case imap.DraftFlag:
+			msg.Draft = true
+		case imap.RecentFlag:
+			// \Recent não pode ser alterada pelo cliente
+		default:
+			if !containsFlag(keywords, flag) {
+				keywords = append(keywords, flag)
+			}
 		}
 	}
+	msg.Flags = strings.Join(keywords, " ")
+	return true
+}
 
-	return results, nil
+// containsFlag informa se a lista contém a flag, sem diferenciar maiúsculas
+func containsFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
 }
 
-// CreateMessage cria uma nova mensagem na caixa de entrada
-func (m *IMAPMailbox) CreateMessage(flags []string, date time.Time, body imap.Literal) error {
-	return nil
+// CopyMessages copia mensagens para outra caixa de entrada
+func (m *IMAPMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	_, _, _, err := m.copyMessages(uid, seqSet, destName)
+	return err
 }
 
-// UpdateMessagesFlags atualiza as flags das mensagens
-func (m *IMAPMailbox) UpdateMessagesFlags(uid bool, seqSet *imap.SeqSet, operation imap.FlagsOp, flags []string) error {
-	messages, err := m.backend.store.ListMessages(m.mailbox.ID)
+// copyMessages copia as mensagens e retorna os UIDs de origem e os UIDs
+// atribuídos na caixa de destino, na mesma ordem. O destino exige o direito
+// "i", e as flags que o usuário não pode alterar nele não são copiadas.
+func (m *IMAPMailbox) copyMessages(uid bool, seqSet *imap.SeqSet, destName string) (uidValidity uint32, srcUIDs, destUIDs []uint32, err error) {
+	dest, err := m.backend.lookupMailbox(m.user, destName)
 	if err != nil {
-		return fmt.Errorf("falha ao listar mensagens: %w", err)
+		return 0, nil, nil, err
+	}
+	if !dest.hasRights("i") {
+		return 0, nil, nil, errNoPermission("sem permissão para inserir mensagens em " + dest.Name())
 	}
 
-	for i, msg := range messages {
-		seqNum := uint32(i + 1)
-		if seqSet.Contains(seqNum) {
-			seen := msg.Seen
-			deleted := msg.Deleted
-			draft := msg.Draft
-
-			for _, flag := range flags {
-				switch flag {
-				case imap.SeenFlag:
-					seen = true
-				case imap.DeletedFlag:
-					deleted = true
-				case imap.DraftFlag:
-					draft = true
-				}
-			}
+	selected, _, err := m.messagesIn(uid, seqSet)
+	if err != nil {
+		return 0, nil, nil, err
+	}
 
-			if err := m.backend.store.UpdateMessageFlags(msg.ID, "", seen, deleted, draft); err != nil {
-				return fmt.Errorf("falha ao atualizar flags: %w", err)
-			}
+	var size int64
+	for _, msg := range selected {
+		size += int64(msg.Size)
+	}
+
+	if err := dest.checkQuota(size, int64(len(selected))); err != nil {
+		return 0, nil, nil, err
+	}
+
+	for _, msg := range selected {
+		copied := *msg
+		copied.ID = 0
+		copied.UID = 0
+		copied.MailboxID = dest.mailbox.ID
+		copied.Seen = copied.Seen && dest.canSetFlag(imap.SeenFlag)
+		copied.Deleted = copied.Deleted && dest.canSetFlag(imap.DeletedFlag)
+		if !dest.hasRights("w") {
+			copied.Draft, copied.Flags = false, ""
 		}
+		if err := m.backend.store.CreateMessage(&copied); err != nil {
+			return 0, nil, nil, fmt.Errorf("falha ao copiar mensagem: %w", err)
+		}
+		srcUIDs = append(srcUIDs, msg.UID)
+		destUIDs = append(destUIDs, copied.UID)
 	}
+	m.trainJunk(dest, selected)
 
-	return nil
+	return dest.mailbox.UIDValidity(), srcUIDs, destUIDs, nil
 }
 
-// CopyMessages copia mensagens para outra caixa de entrada
-func (m *IMAPMailbox) CopyMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
-	return nil
+// MoveMessages implementa MOVE e UID MOVE (RFC 6851) pela interface
+// backend.MoveMailbox. O código COPYUID é enviado em uma resposta não marcada,
+// seguido das remoções da caixa de origem pelo mapa de sequência da sessão.
+func (m *IMAPMailbox) MoveMessages(uid bool, seqSet *imap.SeqSet, destName string) error {
+	if m.readOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	uidValidity, srcUIDs, destUIDs, err := m.moveMessages(uid, seqSet, destName)
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		}}
+	} else if err != nil {
+		return err
+	}
+	if m.conn == nil {
+		return nil
+	}
+
+	if len(srcUIDs) > 0 {
+		src, dest := new(imap.SeqSet), new(imap.SeqSet)
+		src.AddNum(srcUIDs...)
+		dest.AddNum(destUIDs...)
+		if err := m.conn.WriteResp(&imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      "COPYUID",
+			Arguments: []interface{}{uidValidity, imap.RawString(src.String()), imap.RawString(dest.String())},
+			Info:      "Moved",
+		}); err != nil {
+			return err
+		}
+	}
+	return writeUpdates(m.conn, true)
+}
+
+// moveMessages move as mensagens para o destino em uma única transação,
+// retornando os UIDs como copyMessages. Exige os direitos "t" e "e" na
+// origem (RFC 6851, seção 4.3) e "i" no destino.
+func (m *IMAPMailbox) moveMessages(uid bool, seqSet *imap.SeqSet, destName string) (uidValidity uint32, srcUIDs, destUIDs []uint32, err error) {
+	if !m.hasRights("te") {
+		return 0, nil, nil, errNoPermission("sem permissão para remover mensagens de " + m.Name())
+	}
+
+	dest, err := m.backend.lookupMailbox(m.user, destName)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if !dest.hasRights("i") {
+		return 0, nil, nil, errNoPermission("sem permissão para inserir mensagens em " + dest.Name())
+	}
+
+	selected, _, err := m.messagesIn(uid, seqSet)
+	if err != nil || len(selected) == 0 {
+		return 0, nil, nil, err
+	}
+
+	// Dentro da mesma conta a movimentação não altera o uso da quota
+	if dest.owner.ID != m.owner.ID {
+		var size int64
+		for _, msg := range selected {
+			size += int64(msg.Size)
+		}
+		if err := dest.checkQuota(size, int64(len(selected))); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	ids := make([]int64, len(selected))
+	for i, msg := range selected {
+		ids[i] = msg.ID
+		srcUIDs = append(srcUIDs, msg.UID)
+	}
+	if destUIDs, err = m.backend.store.MoveMessages(ids, dest.mailbox.ID); err != nil {
+		return 0, nil, nil, fmt.Errorf("falha ao mover mensagens: %w", err)
+	}
+	m.trainJunk(dest, selected)
+
+	return dest.mailbox.UIDValidity(), srcUIDs, destUIDs, nil
 }
 
-// Expunge remove mensagens marcadas como excluídas
+// Expunge remove mensagens marcadas como excluídas. Usado por CLOSE, que sem
+// o direito "e" apenas deixa a caixa (RFC 4314, seção 4).
 func (m *IMAPMailbox) Expunge() error {
-	messages, err := m.backend.store.ListMessages(m.mailbox.ID)
+	if !m.hasRights("e") {
+		return nil
+	}
+	return m.expunge(nil)
+}
+
+// expunge remove as mensagens marcadas como excluídas; com uids, apenas as
+// contidas no conjunto (UID EXPUNGE, RFC 4315)
+func (m *IMAPMailbox) expunge(uids *imap.SeqSet) error {
+	if !m.hasRights("e") {
+		return errNoPermission("sem permissão para remover mensagens de " + m.Name())
+	}
+
+	var messages []*storage.Message
+	var err error
+	if uids != nil {
+		messages, _, err = m.messagesIn(true, uids)
+	} else {
+		messages, err = m.backend.store.ListMessages(m.mailbox.ID)
+	}
 	if err != nil {
 		return fmt.Errorf("falha ao listar mensagens: %w", err)
 	}
@@ -384,10 +954,106 @@ func (m *IMAPMailbox) Expunge() error {
 	return nil
 }
 
+// mailboxChanges são as alterações da caixa ainda não informadas à sessão
+type mailboxChanges struct {
+	expunged []uint32 // Números de sequência removidos, na ordem de envio
+	vanished []uint32 // UIDs removidos
+	exists   uint32   // Novo total de mensagens, ou zero se não mudou
+	recent   uint32   // Mensagens com \Recent, informado junto com exists
+}
+
+// changes compara o mapa de sequência da sessão com a caixa e o atualiza.
+// Sem expunge, as remoções continuam pendentes, pois EXPUNGE não pode ser
+// enviado durante FETCH, STORE e SEARCH (RFC 3501, seção 7.4.1).
+func (m *IMAPMailbox) changes(expunge bool) (*mailboxChanges, error) {
+	messages, err := m.backend.store.ListMessageUIDs(m.mailbox.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+
+	current := make(map[uint32]bool, len(messages))
+	for _, uid := range messages {
+		current[uid] = true
+	}
+
+	changes := &mailboxChanges{}
+	known := make(map[uint32]bool, len(m.uids))
+	uids := m.uids[:0:0]
+	for _, uid := range m.uids {
+		known[uid] = true
+		if expunge && !current[uid] {
+			changes.vanished = append(changes.vanished, uid)
+			continue
+		}
+		uids = append(uids, uid)
+	}
+
+	// Cada EXPUNGE renumera as mensagens seguintes, então as remoções são
+	// informadas da última para a primeira
+	for i := len(m.uids) - 1; i >= 0; i-- {
+		if expunge && !current[m.uids[i]] {
+			changes.expunged = append(changes.expunged, uint32(i+1))
+		}
+	}
+
+	added := false
+	for _, uid := range messages {
+		if !known[uid] {
+			uids = append(uids, uid)
+			added = true
+		}
+	}
+
+	m.uids = uids
+	if added {
+		if err := m.claimRecent(); err != nil {
+			return nil, err
+		}
+		changes.exists = uint32(len(uids))
+		changes.recent = m.recentCount()
+	}
+	return changes, nil
+}
+
+// matchFlags verifica se a mensagem possui (ou não, quando want é falso)
+// todas as flags informadas
+func (m *IMAPMailbox) matchFlags(msg *storage.Message, flags []string, want bool) bool {
+	for _, flag := range flags {
+		has := hasFlag(msg, flag)
+		if imap.CanonicalFlag(flag) == imap.RecentFlag {
+			has = m.isRecent(msg.UID)
+		}
+		if has != want {
+			return false
+		}
+	}
+	return true
+}
+
+// hasFlag informa se a mensagem possui a flag
+func hasFlag(msg *storage.Message, flag string) bool {
+	switch imap.CanonicalFlag(flag) {
+	case imap.SeenFlag:
+		return msg.Seen
+	case imap.DeletedFlag:
+		return msg.Deleted
+	case imap.DraftFlag:
+		return msg.Draft
+	}
+	for _, f := range strings.Fields(msg.Flags) {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
 // StartIMAPServer inicia o servidor IMAP
 func StartIMAPServer(cfg *config.Config, store storage.Storage) error {
-	be := NewIMAPBackend(store)
-	s := imap.NewServer(be)
+	be := NewIMAPBackend(store, cfg)
+	s := imapserver.New(be)
+	s.Enable(newQuotaExtension(be), newListExtension(be), newCondstoreExtension(be), newSortExtension(),
+		newSessionExtension(be), newACLExtension(be), newClientExtension())
 
 	s.Addr = fmt.Sprintf("%s:%d", cfg.IMAP.Address, cfg.IMAP.Port)
 	s.AllowInsecureAuth = true
@@ -0,0 +1,608 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Direitos de acesso às caixas (RFC 4314, seção 2.1)
+const (
+	// allRights são todos os direitos, na ordem em que são informados:
+	// lookup, read, seen, write, insert, post, create, delete (x, t, e) e admin
+	allRights = "lrswipkxtea"
+
+	// anyoneIdentifier concede direitos a todos os usuários autenticados
+	anyoneIdentifier = "anyone"
+
+	// sharedNamespace é a raiz sob a qual as caixas compartilhadas por outros
+	// usuários aparecem, como "Shared/<dono>/<caixa>"
+	sharedNamespace = "Shared"
+)
+
+// errNoPermission recusa uma operação para a qual o usuário não tem direitos
+func errNoPermission(info string) error {
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "NOPERM",
+		Info: info,
+	}}
+}
+
+// parseRights valida uma lista de direitos e a retorna na ordem canônica.
+// Os direitos obsoletos "c" e "d" equivalem a "k" e "xte" (RFC 4314, seção
+// 2.1.1).
+func parseRights(rights string) (string, error) {
+	var expanded strings.Builder
+	for _, r := range rights {
+		switch {
+		case r == 'c':
+			expanded.WriteString("k")
+		case r == 'd':
+			expanded.WriteString("xte")
+		case strings.ContainsRune(allRights, r):
+			expanded.WriteRune(r)
+		default:
+			return "", fmt.Errorf("direito desconhecido: %q", r)
+		}
+	}
+	return unionRights(expanded.String()), nil
+}
+
+// unionRights une listas de direitos, na ordem canônica
+func unionRights(lists ...string) string {
+	var b strings.Builder
+	for _, r := range allRights {
+		for _, list := range lists {
+			if strings.ContainsRune(list, r) {
+				b.WriteRune(r)
+				break
+			}
+		}
+	}
+	return b.String()
+}
+
+// removeRights retira de rights os direitos contidos em removed
+func removeRights(rights, removed string) string {
+	var b strings.Builder
+	for _, r := range rights {
+		if !strings.ContainsRune(removed, r) {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// isSharedName informa se o nome está sob o namespace compartilhado
+func isSharedName(name string) bool {
+	return name == sharedNamespace || strings.HasPrefix(name, sharedNamespace+storage.MailboxDelimiter)
+}
+
+// splitSharedName separa "Shared/<dono>/<caixa>" no login do dono e no nome
+// da caixa na conta dele
+func splitSharedName(name string) (owner, local string, ok bool) {
+	rest := strings.TrimPrefix(name, sharedNamespace+storage.MailboxDelimiter)
+	if rest == name {
+		return "", "", false
+	}
+	i := strings.Index(rest, storage.MailboxDelimiter)
+	if i <= 0 || i == len(rest)-1 {
+		return "", "", false
+	}
+	return rest[:i], rest[i+1:], true
+}
+
+// sharedPrefix é o prefixo dos nomes das caixas compartilhadas pelo dono
+func sharedPrefix(owner *storage.User) string {
+	return sharedNamespace + storage.MailboxDelimiter + loginName(owner) + storage.MailboxDelimiter
+}
+
+// lookupMailbox resolve o nome de uma caixa como visto pelo usuário, inclusive
+// as compartilhadas por outros usuários, junto com os direitos que ele tem
+// sobre ela. Caixas sobre as quais ele não tem nenhum direito não existem.
+func (b *IMAPBackend) lookupMailbox(user *storage.User, name string) (*IMAPMailbox, error) {
+	mailbox := &IMAPMailbox{backend: b, user: user, owner: user, rights: allRights}
+
+	local := name
+	if isSharedName(name) {
+		login, rest, ok := splitSharedName(name)
+		if !ok {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		owner, err := b.store.GetUser(login)
+		if errors.Is(err, storage.ErrUserNotFound) {
+			return nil, backend.ErrNoSuchMailbox
+		} else if err != nil {
+			return nil, fmt.Errorf("falha ao obter dono da caixa: %w", err)
+		}
+		if owner.ID == user.ID {
+			return nil, backend.ErrNoSuchMailbox
+		}
+		mailbox.owner = owner
+		mailbox.prefix = sharedPrefix(owner)
+		local = rest
+	}
+
+	m, err := b.store.GetMailbox(mailbox.owner.ID, local)
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return nil, backend.ErrNoSuchMailbox
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+	}
+	mailbox.mailbox = m
+
+	if mailbox.owner.ID != user.ID {
+		if mailbox.rights, err = b.sharedRights(user, m.ID); err != nil {
+			return nil, err
+		}
+		if mailbox.rights == "" {
+			return nil, backend.ErrNoSuchMailbox
+		}
+	}
+	return mailbox, nil
+}
+
+// sharedRights calcula os direitos do usuário sobre a caixa de outro usuário:
+// os concedidos a ele somados aos concedidos a "anyone"
+func (b *IMAPBackend) sharedRights(user *storage.User, mailboxID int64) (string, error) {
+	acl, err := b.store.ListMailboxACL(mailboxID)
+	if err != nil {
+		return "", err
+	}
+
+	login := strings.ToLower(loginName(user))
+	var rights []string
+	for _, entry := range acl {
+		if entry.Identifier == login || entry.Identifier == anyoneIdentifier {
+			rights = append(rights, entry.Rights)
+		}
+	}
+	return unionRights(rights...), nil
+}
+
+// sharedMailboxes lista as caixas de outros usuários em que o usuário tem o
+// direito "l", com os níveis "Shared", "Shared/<dono>" e os intermediários
+// não visíveis informados como \Noselect
+func (u *IMAPUser) sharedMailboxes() ([]backend.Mailbox, error) {
+	ids := make(map[int64]bool)
+	for _, identifier := range []string{loginName(u.user), anyoneIdentifier} {
+		acl, err := u.backend.store.ListACLByIdentifier(identifier)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range acl {
+			ids[entry.MailboxID] = true
+		}
+	}
+
+	visible := make(map[string]*IMAPMailbox)
+	for id := range ids {
+		m, err := u.backend.store.GetMailboxByID(id)
+		if errors.Is(err, storage.ErrMailboxNotFound) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+		}
+		if m.UserID == u.user.ID {
+			continue
+		}
+
+		owner, err := u.backend.store.GetUserByID(m.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao obter dono da caixa: %w", err)
+		}
+		rights, err := u.backend.sharedRights(u.user, m.ID)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.Contains(rights, "l") {
+			continue
+		}
+
+		mailbox := &IMAPMailbox{
+			backend: u.backend,
+			user:    u.user,
+			owner:   owner,
+			mailbox: m,
+			prefix:  sharedPrefix(owner),
+			rights:  rights,
+		}
+		visible[mailbox.Name()] = mailbox
+	}
+	if len(visible) == 0 {
+		return nil, nil
+	}
+
+	var result []backend.Mailbox
+	placeholder := func(name string) {
+		if _, ok := visible[name]; ok {
+			return
+		}
+		visible[name] = nil
+		result = append(result, &IMAPMailbox{
+			backend:    u.backend,
+			user:       u.user,
+			owner:      u.user,
+			mailbox:    &storage.Mailbox{Name: name, Path: name, NoSelect: true},
+			attributes: []string{imap.NoSelectAttr, imap.HasChildrenAttr},
+		})
+	}
+
+	var names []string
+	for name := range visible {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	placeholder(sharedNamespace)
+	for _, name := range names {
+		placeholder(sharedNamespace + storage.MailboxDelimiter + loginName(visible[name].owner))
+	}
+	for _, name := range names {
+		mailbox := visible[name]
+		children := false
+		for other := range visible {
+			if isChildMailbox(name, other) {
+				children = true
+				break
+			}
+		}
+		mailbox.attributes = mailboxAttributes(mailbox.mailbox, nil)
+		if children {
+			mailbox.attributes = replaceAttr(mailbox.attributes, imap.HasNoChildrenAttr, imap.HasChildrenAttr)
+		}
+		result = append(result, mailbox)
+	}
+	for _, name := range names {
+		for _, parent := range parentMailboxes(name) {
+			placeholder(parent)
+		}
+	}
+
+	return result, nil
+}
+
+// canWrite informa se o usuário pode alterar a caixa de alguma forma, o que
+// permite abri-la para leitura e escrita
+func (m *IMAPMailbox) canWrite() bool {
+	return strings.ContainsAny(m.rights, "stwie")
+}
+
+// inheritACL copia para a nova caixa os direitos concedidos sobre o nível
+// superior, para que as subcaixas de uma caixa compartilhada continuem
+// compartilhadas (RFC 4314, seção 5.1)
+func (b *IMAPBackend) inheritACL(mailbox *storage.Mailbox) error {
+	parents := parentMailboxes(mailbox.Name)
+	if len(parents) == 0 {
+		return nil
+	}
+	parent, err := b.store.GetMailbox(mailbox.UserID, parents[len(parents)-1])
+	if err != nil {
+		return fmt.Errorf("falha ao obter caixa superior: %w", err)
+	}
+
+	acl, err := b.store.ListMailboxACL(parent.ID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range acl {
+		entry.MailboxID = mailbox.ID
+		if err := b.store.SetMailboxACL(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sharedSubscription resolve a assinatura de uma caixa compartilhada que o
+// usuário ainda pode ver, ou retorna nil
+func (u *IMAPUser) sharedSubscription(name string) *IMAPMailbox {
+	if !isSharedName(name) {
+		return nil
+	}
+	mailbox, err := u.backend.lookupMailbox(u.user, name)
+	if err != nil || !mailbox.hasRights("l") {
+		return nil
+	}
+	return mailbox
+}
+
+// replaceAttr substitui um atributo LIST por outro
+func replaceAttr(attrs []string, old, new string) []string {
+	for i, attr := range attrs {
+		if attr == old {
+			attrs[i] = new
+		}
+	}
+	return attrs
+}
+
+// sharedParent resolve o nível superior de uma caixa compartilhada a ser
+// criada ou renomeada, exigindo o direito "k" sobre ele, e retorna o dono e o
+// nome da nova caixa na conta dele
+func (u *IMAPUser) sharedParent(name string) (*storage.User, string, error) {
+	parents := parentMailboxes(strings.TrimSuffix(name, storage.MailboxDelimiter))
+	if _, _, ok := splitSharedName(name); !ok || len(parents) < 3 {
+		return nil, "", errNoPermission("caixas só podem ser criadas dentro de uma caixa compartilhada")
+	}
+
+	parent, err := u.backend.lookupMailbox(u.user, parents[len(parents)-1])
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		return nil, "", errNoPermission("caixas só podem ser criadas dentro de uma caixa compartilhada")
+	} else if err != nil {
+		return nil, "", err
+	}
+	if !parent.hasRights("k") {
+		return nil, "", errNoPermission("sem permissão para criar caixas em " + parent.Name())
+	}
+	return parent.owner, strings.TrimPrefix(name, parent.prefix), nil
+}
+
+// aclExtension implementa ACL (RFC 4314), com os direitos kxte separados
+// (RIGHTS=kxte), e NAMESPACE (RFC 2342), que informa onde ficam as caixas
+// compartilhadas por outros usuários
+type aclExtension struct {
+	backend *IMAPBackend
+}
+
+func newACLExtension(be *IMAPBackend) *aclExtension {
+	return &aclExtension{backend: be}
+}
+
+// Capabilities anuncia as extensões apenas após a autenticação
+func (e *aclExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"ACL", "RIGHTS=kxte", "NAMESPACE"}
+	}
+	return nil
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *aclExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "SETACL":
+		return func() imapserver.Handler { return &setACLHandler{} }
+	case "DELETEACL":
+		return func() imapserver.Handler { return &setACLHandler{delete: true} }
+	case "GETACL":
+		return func() imapserver.Handler { return &getACLHandler{} }
+	case "LISTRIGHTS":
+		return func() imapserver.Handler { return &listRightsHandler{} }
+	case "MYRIGHTS":
+		return func() imapserver.Handler { return &myRightsHandler{} }
+	case "NAMESPACE":
+		return func() imapserver.Handler { return &namespaceHandler{} }
+	}
+	return nil
+}
+
+// parseACLArgs lê o nome da caixa seguido de n argumentos
+func parseACLArgs(fields []interface{}, n int) (string, []string, error) {
+	if len(fields) != n+1 {
+		return "", nil, errors.New("número de argumentos inválido")
+	}
+	mailbox, err := parseMailboxName(fields[0])
+	if err != nil {
+		return "", nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if args[i], err = imap.ParseString(fields[i+1]); err != nil {
+			return "", nil, err
+		}
+	}
+	return mailbox, args, nil
+}
+
+// aclMailbox obtém a caixa de um comando ACL, exigindo os direitos informados
+func aclMailbox(conn imapserver.Conn, name, rights string) (*IMAPMailbox, error) {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return nil, err
+	}
+	mailbox, err := user.backend.lookupMailbox(user.user, name)
+	if err != nil {
+		return nil, err
+	}
+	if !mailbox.hasRights(rights) {
+		return nil, errNoPermission("sem permissão para administrar " + mailbox.Name())
+	}
+	return mailbox, nil
+}
+
+// isOwner informa se o identificador é o dono da caixa, que tem sempre
+// todos os direitos
+func (m *IMAPMailbox) isOwner(identifier string) bool {
+	return strings.EqualFold(identifier, loginName(m.owner))
+}
+
+// setACLHandler implementa SETACL e DELETEACL. Direitos precedidos de "+" ou
+// "-" são somados ou retirados dos já concedidos.
+type setACLHandler struct {
+	delete     bool
+	mailbox    string
+	identifier string
+	rights     string
+}
+
+func (h *setACLHandler) Parse(fields []interface{}) error {
+	n := 2
+	if h.delete {
+		n = 1
+	}
+	mailbox, args, err := parseACLArgs(fields, n)
+	if err != nil {
+		return err
+	}
+	h.mailbox, h.identifier = mailbox, args[0]
+	if !h.delete {
+		h.rights = args[1]
+	}
+	return nil
+}
+
+func (h *setACLHandler) Handle(conn imapserver.Conn) error {
+	mailbox, err := aclMailbox(conn, h.mailbox, "a")
+	if err != nil {
+		return err
+	}
+	if mailbox.isOwner(h.identifier) {
+		return errNoPermission("os direitos do dono da caixa não podem ser alterados")
+	}
+	if strings.HasPrefix(h.identifier, "-") {
+		return errors.New("direitos negativos não são suportados")
+	}
+
+	store := mailbox.backend.store
+	if h.delete {
+		return store.DeleteMailboxACL(mailbox.mailbox.ID, h.identifier)
+	}
+
+	modifier := ""
+	if strings.HasPrefix(h.rights, "+") || strings.HasPrefix(h.rights, "-") {
+		modifier, h.rights = h.rights[:1], h.rights[1:]
+	}
+	rights, err := parseRights(h.rights)
+	if err != nil {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{Type: imap.StatusRespBad, Info: err.Error()}}
+	}
+
+	if modifier != "" {
+		acl, err := store.ListMailboxACL(mailbox.mailbox.ID)
+		if err != nil {
+			return err
+		}
+		current := ""
+		for _, entry := range acl {
+			if strings.EqualFold(entry.Identifier, h.identifier) {
+				current = entry.Rights
+			}
+		}
+		if modifier == "+" {
+			rights = unionRights(current, rights)
+		} else {
+			rights = removeRights(current, rights)
+		}
+	}
+
+	return store.SetMailboxACL(&storage.MailboxACL{
+		MailboxID:  mailbox.mailbox.ID,
+		Identifier: h.identifier,
+		Rights:     rights,
+	})
+}
+
+// getACLHandler implementa GETACL, informando o dono com todos os direitos
+type getACLHandler struct {
+	mailbox string
+}
+
+func (h *getACLHandler) Parse(fields []interface{}) error {
+	mailbox, _, err := parseACLArgs(fields, 0)
+	h.mailbox = mailbox
+	return err
+}
+
+func (h *getACLHandler) Handle(conn imapserver.Conn) error {
+	mailbox, err := aclMailbox(conn, h.mailbox, "a")
+	if err != nil {
+		return err
+	}
+	acl, err := mailbox.backend.store.ListMailboxACL(mailbox.mailbox.ID)
+	if err != nil {
+		return err
+	}
+
+	fields := []interface{}{
+		imap.RawString("ACL"), imap.FormatMailboxName(mailbox.Name()),
+		loginName(mailbox.owner), allRights,
+	}
+	for _, entry := range acl {
+		fields = append(fields, entry.Identifier, entry.Rights)
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// listRightsHandler implementa LISTRIGHTS. Exceto para o dono, nenhum
+// direito é obrigatório e todos podem ser concedidos separadamente.
+type listRightsHandler struct {
+	mailbox    string
+	identifier string
+}
+
+func (h *listRightsHandler) Parse(fields []interface{}) error {
+	mailbox, args, err := parseACLArgs(fields, 1)
+	if err != nil {
+		return err
+	}
+	h.mailbox, h.identifier = mailbox, args[0]
+	return nil
+}
+
+func (h *listRightsHandler) Handle(conn imapserver.Conn) error {
+	mailbox, err := aclMailbox(conn, h.mailbox, "a")
+	if err != nil {
+		return err
+	}
+
+	fields := []interface{}{imap.RawString("LISTRIGHTS"), imap.FormatMailboxName(mailbox.Name()), h.identifier}
+	if mailbox.isOwner(h.identifier) {
+		fields = append(fields, allRights)
+	} else {
+		fields = append(fields, "")
+		for _, r := range allRights {
+			fields = append(fields, imap.RawString(string(r)))
+		}
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// myRightsHandler implementa MYRIGHTS, permitido com qualquer direito
+type myRightsHandler struct {
+	mailbox string
+}
+
+func (h *myRightsHandler) Parse(fields []interface{}) error {
+	mailbox, _, err := parseACLArgs(fields, 0)
+	h.mailbox = mailbox
+	return err
+}
+
+func (h *myRightsHandler) Handle(conn imapserver.Conn) error {
+	mailbox, err := aclMailbox(conn, h.mailbox, "")
+	if err != nil {
+		return err
+	}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("MYRIGHTS"), imap.FormatMailboxName(mailbox.Name()), mailbox.rights,
+	}))
+}
+
+// namespaceHandler implementa NAMESPACE: as caixas do usuário ficam na raiz
+// e as compartilhadas sob "Shared/"
+type namespaceHandler struct{}
+
+func (h *namespaceHandler) Parse(fields []interface{}) error {
+	if len(fields) != 0 {
+		return errors.New("NAMESPACE não aceita argumentos")
+	}
+	return nil
+}
+
+func (h *namespaceHandler) Handle(conn imapserver.Conn) error {
+	if _, err := sessionUser(conn); err != nil {
+		return err
+	}
+	personal := []interface{}{[]interface{}{"", storage.MailboxDelimiter}}
+	shared := []interface{}{[]interface{}{sharedNamespace + storage.MailboxDelimiter, storage.MailboxDelimiter}}
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{
+		imap.RawString("NAMESPACE"), personal, nil, shared,
+	}))
+}
@@ -0,0 +1,186 @@
+package server
+
+import (
+	"compress/flate"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// clientExtension implementa ID (RFC 2971), que registra o cliente de cada
+// sessão, e COMPRESS=DEFLATE (RFC 4978), que reduz o tráfego em conexões
+// lentas
+type clientExtension struct{}
+
+func newClientExtension() *clientExtension {
+	return &clientExtension{}
+}
+
+// Capabilities anuncia ID em qualquer estado e COMPRESS após a autenticação
+func (e *clientExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"ID", "COMPRESS=DEFLATE"}
+	}
+	return []string{"ID"}
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *clientExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "ID":
+		return func() imapserver.Handler { return &idHandler{} }
+	case "COMPRESS":
+		return func() imapserver.Handler { return &compressHandler{} }
+	}
+	return nil
+}
+
+// serverID identifica o servidor na resposta ao comando ID
+var serverID = []interface{}{"name", "simpleEmail"}
+
+// idHandler implementa ID, registrando o nome e a versão do cliente
+type idHandler struct {
+	params map[string]string
+}
+
+func (h *idHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("ID exige uma lista de parâmetros ou NIL")
+	}
+	if fields[0] == nil {
+		return nil
+	}
+
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list)%2 != 0 {
+		return errors.New("parâmetros de ID inválidos")
+	}
+	h.params = make(map[string]string, len(list)/2)
+	for i := 0; i < len(list); i += 2 {
+		key, err := imap.ParseString(list[i])
+		if err != nil {
+			return err
+		}
+		// Valores NIL são aceitos e ignorados
+		if list[i+1] == nil {
+			continue
+		}
+		value, err := imap.ParseString(list[i+1])
+		if err != nil {
+			return err
+		}
+		h.params[strings.ToLower(key)] = value
+	}
+	return nil
+}
+
+func (h *idHandler) Handle(conn imapserver.Conn) error {
+	if h.params != nil {
+		login := "-"
+		if user, ok := conn.Context().User.(*IMAPUser); ok {
+			login = user.Username()
+		}
+		log.Printf("Cliente IMAP de %s (%s): %s %s", conn.Info().RemoteAddr, login,
+			clientParam(h.params, "name"), clientParam(h.params, "version"))
+	}
+
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{imap.RawString("ID"), serverID}))
+}
+
+// clientParam retorna um parâmetro de ID, ou "?" quando ausente
+func clientParam(params map[string]string, key string) string {
+	if value, ok := params[key]; ok && value != "" {
+		return value
+	}
+	return "?"
+}
+
+// compressHandler implementa COMPRESS DEFLATE. Após a resposta OK, todo o
+// tráfego da conexão passa a ser comprimido nos dois sentidos.
+type compressHandler struct {
+	mechanism string
+}
+
+func (h *compressHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("COMPRESS exige o mecanismo de compressão")
+	}
+	mechanism, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.mechanism = strings.ToUpper(mechanism)
+	return nil
+}
+
+func (h *compressHandler) Handle(conn imapserver.Conn) error {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+	if h.mechanism != "DEFLATE" {
+		return badRequest("mecanismo de compressão não suportado")
+	}
+	if user.compress {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: "COMPRESSIONACTIVE",
+			Info: "a compressão já está ativa",
+		}}
+	}
+
+	user.compress = true
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Info: "DEFLATE active",
+	}}
+}
+
+// Upgrade substitui a conexão por uma comprimida depois que a resposta OK
+// foi enviada
+func (h *compressHandler) Upgrade(conn imapserver.Conn) error {
+	return conn.Upgrade(func(sock net.Conn) (net.Conn, error) {
+		conn.WaitReady()
+		return newDeflateConn(sock)
+	})
+}
+
+// deflateConn comprime a conexão com DEFLATE puro, sem os cabeçalhos do
+// zlib (RFC 4978, seção 4)
+type deflateConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+func newDeflateConn(sock net.Conn) (*deflateConn, error) {
+	w, err := flate.NewWriter(sock, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return &deflateConn{Conn: sock, r: flate.NewReader(sock), w: w}, nil
+}
+
+func (c *deflateConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Write comprime os dados e os envia imediatamente, para que o cliente não
+// espere por respostas retidas no compressor
+func (c *deflateConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *deflateConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
@@ -0,0 +1,613 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Itens de FETCH e STATUS de CONDSTORE (RFC 7162)
+const (
+	fetchModSeq         imap.FetchItem  = "MODSEQ"
+	statusHighestModSeq imap.StatusItem = "HIGHESTMODSEQ"
+)
+
+// condstoreExtension implementa CONDSTORE e QRESYNC (RFC 7162), além do
+// comando ENABLE (RFC 5161) usado para habilitá-las. SELECT, EXAMINE, FETCH
+// e STORE são substituídos para aceitar os novos modificadores; as remoções
+// são enviadas como VANISHED por writeUpdates.
+type condstoreExtension struct {
+	backend *IMAPBackend
+}
+
+func newCondstoreExtension(be *IMAPBackend) *condstoreExtension {
+	return &condstoreExtension{backend: be}
+}
+
+// Capabilities anuncia as extensões apenas após a autenticação
+func (e *condstoreExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"ENABLE", "CONDSTORE", "QRESYNC"}
+	}
+	return nil
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *condstoreExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "ENABLE":
+		return func() imapserver.Handler { return &enableHandler{} }
+	case "SELECT":
+		return func() imapserver.Handler { return &selectHandler{} }
+	case "EXAMINE":
+		return func() imapserver.Handler {
+			h := &selectHandler{}
+			h.ReadOnly = true
+			return h
+		}
+	case "FETCH":
+		return func() imapserver.Handler { return &fetchHandler{} }
+	case "STORE":
+		return func() imapserver.Handler { return &storeHandler{} }
+	}
+	return nil
+}
+
+// sessionUser retorna o usuário autenticado na conexão
+func sessionUser(conn imapserver.Conn) (*IMAPUser, error) {
+	user, ok := conn.Context().User.(*IMAPUser)
+	if !ok {
+		return nil, imapserver.ErrNotAuthenticated
+	}
+	return user, nil
+}
+
+// selectedMailbox retorna a caixa selecionada na conexão
+func selectedMailbox(conn imapserver.Conn) (*IMAPMailbox, error) {
+	mailbox, ok := conn.Context().Mailbox.(*IMAPMailbox)
+	if !ok {
+		return nil, imapserver.ErrNoMailboxSelected
+	}
+	return mailbox, nil
+}
+
+// badRequest responde BAD a um comando sintaticamente válido, mas não
+// permitido no estado atual da sessão
+func badRequest(info string) error {
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespBad,
+		Info: info,
+	}}
+}
+
+// parseModSeq lê um valor de sequência de modificação (63 bits)
+func parseModSeq(f interface{}) (uint64, error) {
+	if n, ok := f.(uint32); ok {
+		return uint64(n), nil
+	}
+	s, err := imap.ParseString(f)
+	if err != nil {
+		return 0, err
+	}
+	modseq, err := strconv.ParseUint(s, 10, 63)
+	if err != nil {
+		return 0, fmt.Errorf("sequência de modificação inválida: %s", s)
+	}
+	return modseq, nil
+}
+
+// writeFetch envia uma resposta FETCH não solicitada
+func writeFetch(conn imapserver.Conn, msg *imap.Message) error {
+	return conn.WriteResp(imap.NewUntaggedResp([]interface{}{msg.SeqNum, imap.RawString("FETCH"), msg.Format()}))
+}
+
+// writeMessages envia respostas FETCH com os itens pedidos para as mensagens
+// cujos UIDs estão em uids
+func writeMessages(conn imapserver.Conn, mailbox *IMAPMailbox, uids *imap.SeqSet, items []imap.FetchItem) error {
+	if uids.Empty() {
+		return nil
+	}
+
+	ch := make(chan *imap.Message)
+	done := make(chan error, 1)
+	go func() {
+		done <- mailbox.ListMessages(true, uids, items, ch)
+	}()
+
+	for msg := range ch {
+		if err := writeFetch(conn, msg); err != nil {
+			// Esvaziar o canal para liberar ListMessages
+			for range ch {
+			}
+			return err
+		}
+	}
+	return <-done
+}
+
+// writeVanished envia a resposta VANISHED de QRESYNC; earlier indica
+// remoções anteriores ao comando atual
+func writeVanished(conn imapserver.Conn, earlier bool, uids []uint32) error {
+	if len(uids) == 0 {
+		return nil
+	}
+
+	set := new(imap.SeqSet)
+	set.AddNum(uids...)
+	fields := []interface{}{imap.RawString("VANISHED")}
+	if earlier {
+		fields = append(fields, []interface{}{imap.RawString("EARLIER")})
+	}
+	fields = append(fields, imap.RawString(set.String()))
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// enableHandler implementa ENABLE (RFC 5161)
+type enableHandler struct {
+	capabilities []string
+}
+
+func (h *enableHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return errors.New("ENABLE exige ao menos uma extensão")
+	}
+	for _, f := range fields {
+		capability, err := imap.ParseString(f)
+		if err != nil {
+			return err
+		}
+		h.capabilities = append(h.capabilities, strings.ToUpper(capability))
+	}
+	return nil
+}
+
+func (h *enableHandler) Handle(conn imapserver.Conn) error {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+	if conn.Context().Mailbox != nil {
+		return badRequest("ENABLE não é permitido com uma caixa selecionada")
+	}
+
+	fields := []interface{}{imap.RawString("ENABLED")}
+	for _, capability := range h.capabilities {
+		switch capability {
+		case "CONDSTORE":
+			if !user.condstore {
+				user.condstore = true
+				fields = append(fields, imap.RawString(capability))
+			}
+		case "QRESYNC":
+			if !user.qresync {
+				// QRESYNC implica CONDSTORE
+				user.condstore, user.qresync = true, true
+				fields = append(fields, imap.RawString(capability))
+			}
+		}
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// qresyncParams são os parâmetros QRESYNC de SELECT/EXAMINE
+type qresyncParams struct {
+	uidValidity uint32
+	modSeq      uint64
+	knownUids   *imap.SeqSet
+}
+
+// selectHandler implementa SELECT e EXAMINE com os parâmetros CONDSTORE e
+// QRESYNC
+type selectHandler struct {
+	imapserver.Select
+	condstore bool
+	qresync   *qresyncParams
+}
+
+func (h *selectHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("é necessário informar uma caixa de correio")
+	}
+	if err := h.Select.Parse(fields[:1]); err != nil {
+		return err
+	}
+	if len(fields) == 1 {
+		return nil
+	}
+
+	params, ok := fields[1].([]interface{})
+	if !ok || len(fields) > 2 {
+		return errors.New("parâmetros de SELECT inválidos")
+	}
+	for i := 0; i < len(params); i++ {
+		name, err := imap.ParseString(params[i])
+		if err != nil {
+			return err
+		}
+		switch strings.ToUpper(name) {
+		case "CONDSTORE":
+			h.condstore = true
+		case "QRESYNC":
+			i++
+			if i >= len(params) {
+				return errors.New("QRESYNC exige parâmetros")
+			}
+			list, ok := params[i].([]interface{})
+			if !ok || len(list) < 2 {
+				return errors.New("parâmetros de QRESYNC inválidos")
+			}
+			q := &qresyncParams{}
+			if q.uidValidity, err = imap.ParseNumber(list[0]); err != nil {
+				return err
+			}
+			if q.modSeq, err = parseModSeq(list[1]); err != nil {
+				return err
+			}
+			if len(list) > 2 {
+				set, err := imap.ParseString(list[2])
+				if err != nil {
+					return err
+				}
+				if q.knownUids, err = imap.ParseSeqSet(set); err != nil {
+					return err
+				}
+			}
+			h.qresync = q
+		default:
+			return fmt.Errorf("parâmetro de SELECT desconhecido: %s", name)
+		}
+	}
+	return nil
+}
+
+func (h *selectHandler) Handle(conn imapserver.Conn) error {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+	if h.qresync != nil && !user.qresync {
+		return badRequest("QRESYNC não foi habilitado")
+	}
+	if h.condstore {
+		user.condstore = true
+	}
+
+	// Um SELECT que falha deixa a sessão sem caixa selecionada (RFC 3501,
+	// seção 6.3.1)
+	ctx := conn.Context()
+	ctx.Mailbox = nil
+	ctx.MailboxReadOnly = false
+
+	mbox, err := user.GetMailbox(h.Mailbox)
+	if err != nil {
+		return err
+	}
+	mailbox := mbox.(*IMAPMailbox)
+
+	items := []imap.StatusItem{
+		imap.StatusMessages, imap.StatusRecent, imap.StatusUnseen,
+		imap.StatusUidNext, imap.StatusUidValidity,
+	}
+	// Sem direitos de alteração a caixa é aberta somente para leitura
+	// (RFC 4314, seção 4)
+	readOnly := h.ReadOnly || !mailbox.canWrite()
+	status, counters, err := mailbox.open(readOnly, items)
+	if err != nil {
+		return err
+	}
+
+	mailbox.conn = conn
+	ctx.Mailbox = mailbox
+	ctx.MailboxReadOnly = readOnly
+	if err := conn.WriteResp(&responses.Select{Mailbox: status}); err != nil {
+		return err
+	}
+
+	if err := conn.WriteResp(&imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      imap.StatusRespCode(statusHighestModSeq),
+		Arguments: []interface{}{imap.RawString(strconv.FormatUint(counters.HighestModSeq, 10))},
+		Info:      "Highest",
+	}); err != nil {
+		return err
+	}
+
+	// Com UIDVALIDITY diferente o cliente precisa descartar o cache inteiro
+	if h.qresync != nil && h.qresync.uidValidity == mailbox.mailbox.UIDValidity() {
+		if err := h.resync(conn, mailbox); err != nil {
+			return err
+		}
+	}
+
+	code := imap.CodeReadWrite
+	if readOnly {
+		code = imap.CodeReadOnly
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespOk,
+		Code: code,
+	}}
+}
+
+// resync envia as remoções e alterações ocorridas desde a sequência de
+// modificação conhecida pelo cliente
+func (h *selectHandler) resync(conn imapserver.Conn, mailbox *IMAPMailbox) error {
+	expunged, err := mailbox.backend.store.ListExpunged(mailbox.mailbox.ID, h.qresync.modSeq)
+	if err != nil {
+		return err
+	}
+	var vanished []uint32
+	for _, uid := range expunged {
+		if h.qresync.knownUids == nil || h.qresync.knownUids.Contains(uid) {
+			vanished = append(vanished, uid)
+		}
+	}
+	if err := writeVanished(conn, true, vanished); err != nil {
+		return err
+	}
+
+	messages, err := mailbox.backend.store.ListMessages(mailbox.mailbox.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+	changed := new(imap.SeqSet)
+	for _, msg := range messages {
+		if msg.ModSeq > h.qresync.modSeq {
+			changed.AddNum(msg.UID)
+		}
+	}
+	return writeMessages(conn, mailbox, changed, []imap.FetchItem{imap.FetchUid, imap.FetchFlags, fetchModSeq})
+}
+
+// fetchHandler implementa FETCH com o item MODSEQ e os modificadores
+// CHANGEDSINCE e VANISHED
+type fetchHandler struct {
+	imapserver.Fetch
+	changedSince uint64
+	vanished     bool
+}
+
+func (h *fetchHandler) Parse(fields []interface{}) error {
+	if len(fields) > 2 {
+		modifiers, ok := fields[2].([]interface{})
+		if !ok || len(fields) > 3 {
+			return errors.New("modificadores de FETCH inválidos")
+		}
+		for i := 0; i < len(modifiers); i++ {
+			name, err := imap.ParseString(modifiers[i])
+			if err != nil {
+				return err
+			}
+			switch strings.ToUpper(name) {
+			case "CHANGEDSINCE":
+				i++
+				if i >= len(modifiers) {
+					return errors.New("CHANGEDSINCE exige uma sequência de modificação")
+				}
+				if h.changedSince, err = parseModSeq(modifiers[i]); err != nil {
+					return err
+				}
+			case "VANISHED":
+				h.vanished = true
+			default:
+				return fmt.Errorf("modificador de FETCH desconhecido: %s", name)
+			}
+		}
+		fields = fields[:2]
+	}
+	return h.Fetch.Parse(fields)
+}
+
+func (h *fetchHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *fetchHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+func (h *fetchHandler) handle(uid bool, conn imapserver.Conn) error {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+	mailbox, err := selectedMailbox(conn)
+	if err != nil {
+		return err
+	}
+	if h.vanished && (!uid || !user.qresync || h.changedSince == 0) {
+		return badRequest("VANISHED exige UID FETCH, QRESYNC e CHANGEDSINCE")
+	}
+
+	items := h.Items
+	if uid && !hasFetchItem(items, imap.FetchUid) {
+		items = append(items, imap.FetchUid)
+	}
+	if h.changedSince > 0 || hasFetchItem(items, fetchModSeq) {
+		user.condstore = true
+		if !hasFetchItem(items, fetchModSeq) {
+			items = append(items, fetchModSeq)
+		}
+	}
+
+	messages, _, err := mailbox.messagesIn(uid, h.SeqSet)
+	if err != nil {
+		return err
+	}
+
+	if h.vanished {
+		expunged, err := mailbox.backend.store.ListExpunged(mailbox.mailbox.ID, h.changedSince)
+		if err != nil {
+			return err
+		}
+		var vanished []uint32
+		for _, id := range expunged {
+			if h.SeqSet.Contains(id) {
+				vanished = append(vanished, id)
+			}
+		}
+		if err := writeVanished(conn, true, vanished); err != nil {
+			return err
+		}
+	}
+
+	selected := new(imap.SeqSet)
+	for _, msg := range messages {
+		if msg.ModSeq > h.changedSince {
+			selected.AddNum(msg.UID)
+		}
+	}
+	if err := writeMessages(conn, mailbox, selected, items); err != nil {
+		return err
+	}
+	return writeUpdates(conn, uid)
+}
+
+// hasFetchItem informa se o item foi pedido
+func hasFetchItem(items []imap.FetchItem, item imap.FetchItem) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
+
+// storeHandler implementa STORE com o modificador UNCHANGEDSINCE
+type storeHandler struct {
+	imapserver.Store
+	unchangedSince    uint64
+	hasUnchangedSince bool
+}
+
+func (h *storeHandler) Parse(fields []interface{}) error {
+	if len(fields) > 1 {
+		if modifiers, ok := fields[1].([]interface{}); ok {
+			if len(modifiers) != 2 {
+				return errors.New("modificadores de STORE inválidos")
+			}
+			name, err := imap.ParseString(modifiers[0])
+			if err != nil {
+				return err
+			}
+			if !strings.EqualFold(name, "UNCHANGEDSINCE") {
+				return fmt.Errorf("modificador de STORE desconhecido: %s", name)
+			}
+			if h.unchangedSince, err = parseModSeq(modifiers[1]); err != nil {
+				return err
+			}
+			h.hasUnchangedSince = true
+			fields = append([]interface{}{fields[0]}, fields[2:]...)
+		}
+	}
+	return h.Store.Parse(fields)
+}
+
+func (h *storeHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *storeHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+func (h *storeHandler) handle(uid bool, conn imapserver.Conn) error {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+	mailbox, err := selectedMailbox(conn)
+	if err != nil {
+		return err
+	}
+	if conn.Context().MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	op, silent, err := imap.ParseFlagsOp(h.Item)
+	if err != nil {
+		return err
+	}
+	var flags []string
+	if list, ok := h.Value.([]interface{}); ok {
+		if flags, err = imap.ParseStringList(list); err != nil {
+			return err
+		}
+	} else {
+		flag, err := imap.ParseString(h.Value)
+		if err != nil {
+			return err
+		}
+		flags = []string{flag}
+	}
+	for i, flag := range flags {
+		flags[i] = imap.CanonicalFlag(flag)
+	}
+
+	if h.hasUnchangedSince {
+		user.condstore = true
+	}
+
+	messages, seqNums, err := mailbox.messagesIn(uid, h.SeqSet)
+	if err != nil {
+		return err
+	}
+
+	// Mensagens alteradas após UNCHANGEDSINCE não são atualizadas e são
+	// informadas no código MODIFIED
+	modified := new(imap.SeqSet)
+	updated := new(imap.SeqSet)
+	for i, msg := range messages {
+		if h.hasUnchangedSince && msg.ModSeq > h.unchangedSince {
+			if uid {
+				modified.AddNum(msg.UID)
+			} else {
+				modified.AddNum(seqNums[i])
+			}
+			continue
+		}
+		updated.AddNum(msg.UID)
+	}
+
+	if !updated.Empty() {
+		if err := mailbox.UpdateMessagesFlags(true, updated, op, flags); err != nil {
+			return err
+		}
+	}
+
+	// Com CONDSTORE a nova sequência de modificação é informada mesmo em
+	// .SILENT (RFC 7162, seção 3.2)
+	var items []imap.FetchItem
+	if !silent {
+		items = append(items, imap.FetchFlags)
+	}
+	if user.condstore {
+		items = append(items, fetchModSeq)
+	}
+	if len(items) > 0 {
+		if uid {
+			items = append(items, imap.FetchUid)
+		}
+		if err := writeMessages(conn, mailbox, updated, items); err != nil {
+			return err
+		}
+	}
+	if err := writeUpdates(conn, uid); err != nil {
+		return err
+	}
+
+	if !modified.Empty() {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type:      imap.StatusRespOk,
+			Code:      "MODIFIED",
+			Arguments: []interface{}{imap.RawString(modified.String())},
+			Info:      "STORE condicional falhou",
+		}}
+	}
+	return nil
+}
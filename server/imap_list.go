@@ -0,0 +1,427 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/responses"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// statusSize é o item SIZE de STATUS=SIZE (RFC 8438)
+const statusSize imap.StatusItem = "SIZE"
+
+// listExtension substitui LIST e CREATE para oferecer LIST-EXTENDED
+// (RFC 5258), LIST-STATUS (RFC 5819) e SPECIAL-USE/CREATE-SPECIAL-USE
+// (RFC 6154), e SUBSCRIBE/UNSUBSCRIBE para aceitar caixas inexistentes.
+// Também anuncia STATUS=SIZE, respondido por IMAPMailbox.Status.
+type listExtension struct {
+	backend *IMAPBackend
+}
+
+func newListExtension(be *IMAPBackend) *listExtension {
+	return &listExtension{backend: be}
+}
+
+// Capabilities anuncia as extensões apenas após a autenticação
+func (e *listExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"LIST-EXTENDED", "LIST-STATUS", "SPECIAL-USE", "CREATE-SPECIAL-USE", "STATUS=SIZE"}
+	}
+	return nil
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *listExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "LIST":
+		return func() imapserver.Handler { return &listHandler{} }
+	case "CREATE":
+		return func() imapserver.Handler { return &createHandler{} }
+	case "SUBSCRIBE":
+		return func() imapserver.Handler { return &subscribeHandler{subscribe: true} }
+	case "UNSUBSCRIBE":
+		return func() imapserver.Handler { return &subscribeHandler{} }
+	}
+	return nil
+}
+
+// parseMailboxName decodifica um nome de caixa recebido do cliente
+func parseMailboxName(f interface{}) (string, error) {
+	name, err := imap.ParseString(f)
+	if err != nil {
+		return "", err
+	}
+	if name, err = utf7.Encoding.NewDecoder().String(name); err != nil {
+		return "", err
+	}
+	return imap.CanonicalMailboxName(name), nil
+}
+
+// listHandler implementa LIST com as opções de seleção e de retorno de
+// LIST-EXTENDED
+type listHandler struct {
+	reference string
+	patterns  []string
+
+	selectSubscribed bool
+	recursiveMatch   bool
+	selectSpecialUse bool
+
+	returnSubscribed bool
+	returnStatus     []imap.StatusItem
+}
+
+func (h *listHandler) Parse(fields []interface{}) error {
+	// Opções de seleção opcionais antes da referência
+	if len(fields) > 0 {
+		if opts, ok := fields[0].([]interface{}); ok {
+			fields = fields[1:]
+			for _, f := range opts {
+				opt, err := imap.ParseString(f)
+				if err != nil {
+					return err
+				}
+				switch strings.ToUpper(opt) {
+				case "SUBSCRIBED":
+					h.selectSubscribed = true
+					h.returnSubscribed = true
+				case "RECURSIVEMATCH":
+					h.recursiveMatch = true
+				case "SPECIAL-USE":
+					h.selectSpecialUse = true
+				case "REMOTE":
+					// Não há caixas remotas
+				default:
+					return fmt.Errorf("opção de seleção desconhecida: %s", opt)
+				}
+			}
+			if h.recursiveMatch && !h.selectSubscribed {
+				return errors.New("RECURSIVEMATCH exige outra opção de seleção")
+			}
+		}
+	}
+
+	if len(fields) < 2 {
+		return errors.New("LIST exige referência e padrão")
+	}
+
+	reference, err := parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	h.reference = reference
+
+	if list, ok := fields[1].([]interface{}); ok {
+		for _, f := range list {
+			pattern, err := parseMailboxName(f)
+			if err != nil {
+				return err
+			}
+			h.patterns = append(h.patterns, pattern)
+		}
+	} else {
+		pattern, err := parseMailboxName(fields[1])
+		if err != nil {
+			return err
+		}
+		h.patterns = []string{pattern}
+	}
+	fields = fields[2:]
+
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) != 2 {
+		return errors.New("argumentos de LIST inválidos")
+	}
+	if keyword, err := imap.ParseString(fields[0]); err != nil || !strings.EqualFold(keyword, "RETURN") {
+		return errors.New("esperado RETURN")
+	}
+	opts, ok := fields[1].([]interface{})
+	if !ok {
+		return errors.New("opções de retorno devem ser uma lista")
+	}
+	for i := 0; i < len(opts); i++ {
+		opt, err := imap.ParseString(opts[i])
+		if err != nil {
+			return err
+		}
+		switch strings.ToUpper(opt) {
+		case "SUBSCRIBED":
+			h.returnSubscribed = true
+		case "SPECIAL-USE", "CHILDREN":
+			// Os atributos de uso especial e de subcaixas são sempre informados
+		case "STATUS":
+			i++
+			if i >= len(opts) {
+				return errors.New("STATUS exige uma lista de itens")
+			}
+			items, ok := opts[i].([]interface{})
+			if !ok {
+				return errors.New("STATUS exige uma lista de itens")
+			}
+			for _, f := range items {
+				item, err := imap.ParseString(f)
+				if err != nil {
+					return err
+				}
+				h.returnStatus = append(h.returnStatus, imap.StatusItem(strings.ToUpper(item)))
+			}
+		default:
+			return fmt.Errorf("opção de retorno desconhecida: %s", opt)
+		}
+	}
+	return nil
+}
+
+func (h *listHandler) Handle(conn imapserver.Conn) error {
+	user := conn.Context().User
+	if user == nil {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	// Um padrão vazio solicita apenas o delimitador da hierarquia
+	if len(h.patterns) == 1 && h.patterns[0] == "" {
+		info := &imap.MailboxInfo{
+			Attributes: []string{imap.NoSelectAttr},
+			Delimiter:  storage.MailboxDelimiter,
+		}
+		fields := append([]interface{}{imap.RawString("LIST")}, info.Format()...)
+		return conn.WriteResp(imap.NewUntaggedResp(fields))
+	}
+
+	mailboxes, err := user.ListMailboxes(false)
+	if err != nil {
+		return err
+	}
+
+	subscribed := make(map[string]bool)
+	if h.returnSubscribed {
+		list, err := user.ListMailboxes(true)
+		if err != nil {
+			return err
+		}
+		for _, mbox := range list {
+			info, err := mbox.Info()
+			if err != nil {
+				return err
+			}
+			subscribed[info.Name] = true
+		}
+	}
+
+	infos := make(map[string]*imap.MailboxInfo)
+	var names []string
+	for _, mbox := range mailboxes {
+		info, err := mbox.Info()
+		if err != nil {
+			return err
+		}
+		infos[info.Name] = info
+		names = append(names, info.Name)
+	}
+	if h.selectSubscribed {
+		// Caixas assinadas podem não existir mais (RFC 5258, seção 3.1)
+		for name := range subscribed {
+			if _, ok := infos[name]; !ok {
+				infos[name] = &imap.MailboxInfo{
+					Attributes: []string{nonExistentAttr},
+					Delimiter:  storage.MailboxDelimiter,
+					Name:       name,
+				}
+				names = append(names, name)
+			}
+		}
+	}
+
+	for _, name := range names {
+		info := infos[name]
+		if !h.match(info) {
+			continue
+		}
+
+		childInfo := false
+		if h.selectSubscribed && !subscribed[name] {
+			if !h.recursiveMatch || !hasSubscribedChild(name, subscribed) {
+				continue
+			}
+			childInfo = true
+		}
+
+		special := false
+		attrs := make([]string, 0, len(info.Attributes)+1)
+		for _, attr := range info.Attributes {
+			if specialUseAttrs[attr] {
+				special = true
+			}
+			attrs = append(attrs, attr)
+		}
+		if h.selectSpecialUse && !special {
+			continue
+		}
+		if h.returnSubscribed && subscribed[name] {
+			attrs = append(attrs, subscribedAttr)
+		}
+
+		out := &imap.MailboxInfo{Attributes: attrs, Delimiter: info.Delimiter, Name: info.Name}
+		fields := append([]interface{}{imap.RawString("LIST")}, out.Format()...)
+		if childInfo {
+			fields = append(fields, []interface{}{"CHILDINFO", []interface{}{"SUBSCRIBED"}})
+		}
+		if err := conn.WriteResp(imap.NewUntaggedResp(fields)); err != nil {
+			return err
+		}
+
+		if len(h.returnStatus) > 0 && !hasAttr(attrs, imap.NoSelectAttr) && !hasAttr(attrs, nonExistentAttr) {
+			mbox, err := user.GetMailbox(name)
+			if err != nil {
+				return err
+			}
+			// Sem o direito "r" a caixa é listada sem STATUS (RFC 5819, seção 2)
+			if !mbox.(*IMAPMailbox).hasRights("r") {
+				continue
+			}
+			status, err := mbox.Status(h.returnStatus)
+			if err != nil {
+				return err
+			}
+			if err := conn.WriteResp(&responses.Status{Mailbox: status}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// match informa se a caixa corresponde a algum dos padrões
+func (h *listHandler) match(info *imap.MailboxInfo) bool {
+	for _, pattern := range h.patterns {
+		if info.Match(h.reference, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasSubscribedChild informa se alguma caixa abaixo de name está assinada
+func hasSubscribedChild(name string, subscribed map[string]bool) bool {
+	for child := range subscribed {
+		if isChildMailbox(name, child) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasAttr(attrs []string, attr string) bool {
+	for _, a := range attrs {
+		if a == attr {
+			return true
+		}
+	}
+	return false
+}
+
+// createHandler implementa CREATE com o parâmetro USE de CREATE-SPECIAL-USE
+type createHandler struct {
+	mailbox string
+	uses    []string
+}
+
+func (h *createHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("CREATE exige o nome da caixa")
+	}
+
+	mailbox, err := parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	h.mailbox = mailbox
+
+	if len(fields) == 1 {
+		return nil
+	}
+	params, ok := fields[1].([]interface{})
+	if !ok || len(params) != 2 {
+		return errors.New("parâmetros de CREATE inválidos")
+	}
+	if name, err := imap.ParseString(params[0]); err != nil || !strings.EqualFold(name, "USE") {
+		return errors.New("parâmetro de CREATE desconhecido")
+	}
+	h.uses, err = imap.ParseStringList(params[1])
+	return err
+}
+
+func (h *createHandler) Handle(conn imapserver.Conn) error {
+	user, ok := conn.Context().User.(*IMAPUser)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	if len(h.uses) > 1 {
+		return useAttrError("apenas um atributo de uso especial por caixa")
+	}
+
+	specialUse := ""
+	if len(h.uses) == 1 {
+		for attr := range specialUseAttrs {
+			if strings.EqualFold(attr, h.uses[0]) {
+				specialUse = attr
+			}
+		}
+		if specialUse == "" {
+			return useAttrError("atributo de uso especial não suportado")
+		}
+	}
+
+	return user.createMailbox(h.mailbox, specialUse)
+}
+
+// useAttrError recusa um atributo de uso especial (RFC 6154, seção 3)
+func useAttrError(info string) error {
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Code: "USEATTR",
+		Info: info,
+	}}
+}
+
+// subscribeHandler implementa SUBSCRIBE e UNSUBSCRIBE gravando apenas o nome,
+// sem exigir que a caixa exista (RFC 3501, seção 6.3.6)
+type subscribeHandler struct {
+	subscribe bool
+	mailbox   string
+}
+
+func (h *subscribeHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("é necessário informar uma caixa de correio")
+	}
+
+	mailbox, err := parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	h.mailbox = strings.TrimSuffix(mailbox, storage.MailboxDelimiter)
+	return nil
+}
+
+func (h *subscribeHandler) Handle(conn imapserver.Conn) error {
+	user, ok := conn.Context().User.(*IMAPUser)
+	if !ok {
+		return imapserver.ErrNotAuthenticated
+	}
+
+	store := user.backend.store
+	if h.subscribe {
+		return store.SubscribeMailbox(user.user.ID, h.mailbox)
+	}
+	return store.UnsubscribeMailbox(user.user.ID, h.mailbox)
+}
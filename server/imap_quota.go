@@ -0,0 +1,158 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/emersion/go-imap"
+	imapserver "github.com/emersion/go-imap/server"
+	"github.com/emersion/go-imap/utf7"
+)
+
+// quotaExtension implementa a extensão IMAP QUOTA (RFC 9208). As cotas são
+// definidas pelo administrador, portanto SETQUOTA é sempre recusado.
+type quotaExtension struct {
+	backend *IMAPBackend
+}
+
+func newQuotaExtension(be *IMAPBackend) *quotaExtension {
+	return &quotaExtension{backend: be}
+}
+
+// Capabilities anuncia QUOTA apenas após a autenticação
+func (e *quotaExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"QUOTA", "QUOTA=RES-" + quotaStorage, "QUOTA=RES-" + quotaMessage}
+	}
+	return nil
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *quotaExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "GETQUOTA":
+		return func() imapserver.Handler { return &getQuotaHandler{ext: e} }
+	case "GETQUOTAROOT":
+		return func() imapserver.Handler { return &getQuotaRootHandler{ext: e} }
+	case "SETQUOTA":
+		return func() imapserver.Handler { return &setQuotaHandler{} }
+	}
+	return nil
+}
+
+// roots obtém as raízes de cota do usuário autenticado na conexão
+func (e *quotaExtension) roots(conn imapserver.Conn) ([]*quotaRoot, error) {
+	user, ok := conn.Context().User.(*IMAPUser)
+	if !ok {
+		return nil, imapserver.ErrNotAuthenticated
+	}
+	return e.backend.quota.Roots(user.user)
+}
+
+// quotaResponse monta a resposta QUOTA de uma raiz; STORAGE é informado em
+// unidades de 1024 octetos
+func quotaResponse(root *quotaRoot) *imap.DataResp {
+	var list []interface{}
+	for _, res := range root.resources {
+		usage, limit := res.usage, res.limit
+		if res.name == quotaStorage {
+			usage, limit = (usage+1023)/1024, limit/1024
+		}
+		list = append(list, imap.RawString(res.name), uint32(usage), uint32(limit))
+	}
+	return imap.NewUntaggedResp([]interface{}{imap.RawString("QUOTA"), root.name, list})
+}
+
+// getQuotaHandler implementa GETQUOTA raiz
+type getQuotaHandler struct {
+	ext  *quotaExtension
+	root string
+}
+
+func (h *getQuotaHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTA exige uma raiz de cota")
+	}
+	root, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.root = root
+	return nil
+}
+
+func (h *getQuotaHandler) Handle(conn imapserver.Conn) error {
+	roots, err := h.ext.roots(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, root := range roots {
+		if root.name == h.root {
+			return conn.WriteResp(quotaResponse(root))
+		}
+	}
+	return errors.New("raiz de cota inexistente")
+}
+
+// getQuotaRootHandler implementa GETQUOTAROOT caixa
+type getQuotaRootHandler struct {
+	ext     *quotaExtension
+	mailbox string
+}
+
+func (h *getQuotaRootHandler) Parse(fields []interface{}) error {
+	if len(fields) != 1 {
+		return errors.New("GETQUOTAROOT exige uma caixa de correio")
+	}
+	mailbox, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	if mailbox, err = utf7.Encoding.NewDecoder().String(mailbox); err != nil {
+		return err
+	}
+	h.mailbox = imap.CanonicalMailboxName(mailbox)
+	return nil
+}
+
+func (h *getQuotaRootHandler) Handle(conn imapserver.Conn) error {
+	if _, err := conn.Context().User.GetMailbox(h.mailbox); err != nil {
+		return err
+	}
+
+	roots, err := h.ext.roots(conn)
+	if err != nil {
+		return err
+	}
+
+	// Todas as caixas do usuário compartilham as mesmas raízes de cota
+	mailbox, _ := utf7.Encoding.NewEncoder().String(h.mailbox)
+	fields := []interface{}{imap.RawString("QUOTAROOT"), imap.FormatMailboxName(mailbox)}
+	for _, root := range roots {
+		fields = append(fields, root.name)
+	}
+	if err := conn.WriteResp(imap.NewUntaggedResp(fields)); err != nil {
+		return err
+	}
+
+	for _, root := range roots {
+		if err := conn.WriteResp(quotaResponse(root)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setQuotaHandler recusa SETQUOTA: as cotas são gerenciadas pelo administrador
+type setQuotaHandler struct{}
+
+func (h *setQuotaHandler) Parse(fields []interface{}) error {
+	return nil
+}
+
+func (h *setQuotaHandler) Handle(conn imapserver.Conn) error {
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type: imap.StatusRespNo,
+		Info: "cotas são definidas pelo administrador",
+	}}
+}
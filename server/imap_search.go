@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+)
+
+// maxSearchDepth limita a recursão em mensagens multipart aninhadas
+const maxSearchDepth = 10
+
+// searchMessage é uma mensagem avaliada por SEARCH; o cabeçalho e o texto
+// do corpo só são extraídos quando algum critério precisa deles
+type searchMessage struct {
+	msg    *storage.Message
+	seqNum uint32
+	parsed bool
+	header mail.Header
+	body   string
+}
+
+// matches informa se a mensagem atende a todos os critérios (RFC 3501,
+// seção 6.4.4)
+func (m *IMAPMailbox) matches(sm *searchMessage, c *imap.SearchCriteria) bool {
+	msg := sm.msg
+	if c.SeqNum != nil && !c.SeqNum.Contains(sm.seqNum) {
+		return false
+	}
+	if c.Uid != nil && !c.Uid.Contains(msg.UID) {
+		return false
+	}
+
+	// As datas comparam apenas o dia, sem a hora
+	if !c.Since.IsZero() && searchDay(msg.Date).Before(searchDay(c.Since)) {
+		return false
+	}
+	if !c.Before.IsZero() && !searchDay(msg.Date).Before(searchDay(c.Before)) {
+		return false
+	}
+	if !c.SentSince.IsZero() || !c.SentBefore.IsZero() {
+		sent, err := sm.parsedHeader().Date()
+		if err != nil {
+			return false
+		}
+		if !c.SentSince.IsZero() && searchDay(sent).Before(searchDay(c.SentSince)) {
+			return false
+		}
+		if !c.SentBefore.IsZero() && !searchDay(sent).Before(searchDay(c.SentBefore)) {
+			return false
+		}
+	}
+
+	if c.Larger > 0 && uint32(msg.Size) <= c.Larger {
+		return false
+	}
+	if c.Smaller > 0 && uint32(msg.Size) >= c.Smaller {
+		return false
+	}
+
+	if !m.matchFlags(msg, c.WithFlags, true) || !m.matchFlags(msg, c.WithoutFlags, false) {
+		return false
+	}
+
+	for key, values := range c.Header {
+		fields := sm.parsedHeader()[textproto.CanonicalMIMEHeaderKey(key)]
+		for _, value := range values {
+			if !searchFields(fields, value) {
+				return false
+			}
+		}
+	}
+	for _, value := range c.Body {
+		if !searchContains(sm.bodyText(), value) {
+			return false
+		}
+	}
+	for _, value := range c.Text {
+		if !searchContains(sm.bodyText(), value) && !searchHeader(sm.parsedHeader(), value) {
+			return false
+		}
+	}
+
+	for _, not := range c.Not {
+		if m.matches(sm, not) {
+			return false
+		}
+	}
+	for _, or := range c.Or {
+		if !m.matches(sm, or[0]) && !m.matches(sm, or[1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// parse extrai o cabeçalho e o texto do corpo da mensagem
+func (sm *searchMessage) parse() {
+	if sm.parsed {
+		return
+	}
+	sm.parsed = true
+	sm.header = mail.Header{}
+	parsed, err := mail.ReadMessage(bytes.NewReader(sm.msg.RawData))
+	if err != nil {
+		return
+	}
+	sm.header = parsed.Header
+	body, err := io.ReadAll(parsed.Body)
+	if err != nil {
+		return
+	}
+	var parts []string
+	searchParts(textproto.MIMEHeader(parsed.Header), body, 0, &parts)
+	sm.body = strings.Join(parts, "\n")
+}
+
+func (sm *searchMessage) parsedHeader() mail.Header {
+	sm.parse()
+	return sm.header
+}
+
+func (sm *searchMessage) bodyText() string {
+	sm.parse()
+	return sm.body
+}
+
+// searchParts reúne as partes de texto do corpo, decodificadas; partes que
+// não são texto, como anexos, não entram na pesquisa
+func searchParts(header textproto.MIMEHeader, body []byte, depth int, parts *[]string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/") && depth < maxSearchDepth:
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				return
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return
+			}
+			searchParts(part.Header, data, depth+1, parts)
+		}
+	case mediaType == "message/rfc822" && depth < maxSearchDepth:
+		if inner, err := mail.ReadMessage(bytes.NewReader(body)); err == nil {
+			if data, err := io.ReadAll(inner.Body); err == nil {
+				*parts = append(*parts, searchHeaderText(inner.Header))
+				searchParts(textproto.MIMEHeader(inner.Header), data, depth+1, parts)
+			}
+		}
+	case strings.HasPrefix(mediaType, "text/"):
+		*parts = append(*parts, searchDecode(header.Get("Content-Transfer-Encoding"), body))
+	}
+}
+
+// searchDecode decodifica quoted-printable e base64
+func searchDecode(encoding string, body []byte) string {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		if data, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body))); err == nil {
+			return string(data)
+		}
+	case "base64":
+		clean := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+				return -1
+			}
+			return r
+		}, string(body))
+		if data, err := base64.StdEncoding.DecodeString(clean); err == nil {
+			return string(data)
+		}
+	}
+	return string(body)
+}
+
+// searchHeader informa se algum campo do cabeçalho contém o texto
+func searchHeader(header mail.Header, value string) bool {
+	for _, fields := range header {
+		if searchFields(fields, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchHeaderText retorna os campos do cabeçalho como texto pesquisável
+func searchHeaderText(header mail.Header) string {
+	var b strings.Builder
+	for key, fields := range header {
+		for _, field := range fields {
+			b.WriteString(key + ": " + searchDecodeHeader(field) + "\n")
+		}
+	}
+	return b.String()
+}
+
+// searchFields informa se algum dos valores do campo contém o texto; texto
+// vazio exige apenas que o campo exista
+func searchFields(fields []string, value string) bool {
+	for _, field := range fields {
+		if searchContains(searchDecodeHeader(field), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchDecodeHeader decodifica as palavras codificadas (RFC 2047)
+func searchDecodeHeader(value string) string {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(value); err == nil {
+		return decoded
+	}
+	return value
+}
+
+// searchContains compara sem diferenciar maiúsculas de minúsculas
+func searchContains(text, value string) bool {
+	return strings.Contains(strings.ToLower(text), strings.ToLower(value))
+}
+
+// searchDay retorna o dia da data, no fuso da própria data
+func searchDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
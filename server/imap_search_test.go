@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+)
+
+const searchTestMessage = "From: =?UTF-8?Q?Jos=C3=A9?= <jose@example.com>\r\n" +
+	"To: bob@localhost\r\n" +
+	"Subject: Relatorio mensal\r\n" +
+	"Date: Mon, 05 Oct 2026 10:00:00 +0000\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=limite\r\n" +
+	"\r\n" +
+	"--limite\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Segue o relat=C3=B3rio de vendas.\r\n" +
+	"--limite\r\n" +
+	"Content-Type: application/octet-stream\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"c2VncmVkbyBvY3VsdG8=\r\n" +
+	"--limite--\r\n"
+
+func TestSearchCriteria(t *testing.T) {
+	msg := &storage.Message{
+		UID:     7,
+		Date:    time.Date(2026, 10, 6, 15, 0, 0, 0, time.UTC),
+		Size:    len(searchTestMessage),
+		Seen:    true,
+		RawData: []byte(searchTestMessage),
+	}
+	header := func(key, value string) *imap.SearchCriteria {
+		return &imap.SearchCriteria{Header: textproto.MIMEHeader{key: {value}}}
+	}
+	day := func(d int) time.Time { return time.Date(2026, 10, d, 0, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		name     string
+		criteria *imap.SearchCriteria
+		want     bool
+	}{
+		{"from decodificado", header("From", "josé"), true},
+		{"from endereço", header("From", "JOSE@example"), true},
+		{"subject", header("Subject", "mensal"), true},
+		{"subject ausente", header("Subject", "semanal"), false},
+		{"campo existente", header("To", ""), true},
+		{"campo inexistente", header("X-Nada", ""), false},
+		{"body quoted-printable", &imap.SearchCriteria{Body: []string{"relatório"}}, true},
+		{"body ignora anexos", &imap.SearchCriteria{Body: []string{"segredo"}}, false},
+		{"body não inclui cabeçalho", &imap.SearchCriteria{Body: []string{"mensal"}}, false},
+		{"text no cabeçalho", &imap.SearchCriteria{Text: []string{"bob@localhost"}}, true},
+		{"text no corpo", &imap.SearchCriteria{Text: []string{"VENDAS"}}, true},
+		{"not", &imap.SearchCriteria{Not: []*imap.SearchCriteria{header("Subject", "mensal")}}, false},
+		{"or", &imap.SearchCriteria{Or: [][2]*imap.SearchCriteria{{header("From", "ana"), header("Subject", "relatorio")}}}, true},
+		{"since", &imap.SearchCriteria{Since: day(6)}, true},
+		{"before mesmo dia", &imap.SearchCriteria{Before: day(6)}, false},
+		{"sentbefore", &imap.SearchCriteria{SentBefore: day(6)}, true},
+		{"sentsince", &imap.SearchCriteria{SentSince: day(6)}, false},
+		{"larger", &imap.SearchCriteria{Larger: uint32(len(searchTestMessage))}, false},
+		{"smaller", &imap.SearchCriteria{Smaller: uint32(len(searchTestMessage)) + 1}, true},
+		{"flag", &imap.SearchCriteria{WithFlags: []string{imap.SeenFlag}, WithoutFlags: []string{imap.DeletedFlag}}, true},
+		{"uid", &imap.SearchCriteria{Uid: new(imap.SeqSet)}, false},
+	}
+	m := &IMAPMailbox{}
+	for _, tt := range tests {
+		if got := m.matches(&searchMessage{msg: msg, seqNum: 1}, tt.criteria); got != tt.want {
+			t.Errorf("%s: %v, esperado %v", tt.name, got, tt.want)
+		}
+	}
+}
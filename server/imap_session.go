@@ -0,0 +1,306 @@
+package server
+
+import (
+	"errors"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// sessionExtension mantém o mapa de números de sequência de cada sessão em
+// dia com a caixa selecionada, enviando EXPUNGE e EXISTS quando outras
+// sessões ou a entrega de mensagens alteram a caixa, e implementa UIDPLUS
+// (RFC 4315): UID EXPUNGE e os códigos APPENDUID e COPYUID. APPEND aceita
+// várias mensagens (MULTIAPPEND, RFC 3502).
+type sessionExtension struct {
+	backend *IMAPBackend
+}
+
+func newSessionExtension(be *IMAPBackend) *sessionExtension {
+	return &sessionExtension{backend: be}
+}
+
+// Capabilities anuncia as extensões apenas após a autenticação
+func (e *sessionExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"UIDPLUS", "MULTIAPPEND"}
+	}
+	return nil
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *sessionExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "NOOP":
+		return func() imapserver.Handler { return &noopHandler{} }
+	case "CHECK":
+		return func() imapserver.Handler { return &checkHandler{} }
+	case "EXPUNGE":
+		return func() imapserver.Handler { return &expungeHandler{} }
+	case "APPEND":
+		return func() imapserver.Handler { return &appendHandler{} }
+	case "COPY":
+		return func() imapserver.Handler { return &copyHandler{} }
+	}
+	return nil
+}
+
+// writeUpdates informa à sessão as alterações da caixa selecionada ainda não
+// vistas por ela. Com expunge falso, apenas novas mensagens são informadas.
+// Com QRESYNC habilitado, as remoções são enviadas como VANISHED.
+func writeUpdates(conn imapserver.Conn, expunge bool) error {
+	mailbox, ok := conn.Context().Mailbox.(*IMAPMailbox)
+	if !ok {
+		return nil
+	}
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+
+	changes, err := mailbox.changes(expunge)
+	if err != nil {
+		return err
+	}
+
+	if user.qresync {
+		if err := writeVanished(conn, false, changes.vanished); err != nil {
+			return err
+		}
+	} else {
+		for _, seqNum := range changes.expunged {
+			if err := conn.WriteResp(imap.NewUntaggedResp([]interface{}{seqNum, imap.RawString("EXPUNGE")})); err != nil {
+				return err
+			}
+		}
+	}
+
+	if changes.exists > 0 {
+		if err := conn.WriteResp(imap.NewUntaggedResp([]interface{}{changes.exists, imap.RawString("EXISTS")})); err != nil {
+			return err
+		}
+		return conn.WriteResp(imap.NewUntaggedResp([]interface{}{changes.recent, imap.RawString("RECENT")}))
+	}
+	return nil
+}
+
+// noopHandler implementa NOOP, usado pelos clientes para receber as
+// alterações da caixa selecionada
+type noopHandler struct {
+	imapserver.Noop
+}
+
+func (h *noopHandler) Handle(conn imapserver.Conn) error {
+	return writeUpdates(conn, true)
+}
+
+// checkHandler implementa CHECK, que também informa as alterações da caixa
+type checkHandler struct {
+	imapserver.Check
+}
+
+func (h *checkHandler) Handle(conn imapserver.Conn) error {
+	mailbox, err := selectedMailbox(conn)
+	if err != nil {
+		return err
+	}
+	if err := mailbox.Check(); err != nil {
+		return err
+	}
+	return writeUpdates(conn, true)
+}
+
+// expungeHandler implementa EXPUNGE e UID EXPUNGE, informando as remoções
+// pelo mapa de sequência da sessão
+type expungeHandler struct {
+	uids *imap.SeqSet
+}
+
+func (h *expungeHandler) Parse(fields []interface{}) error {
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) > 1 {
+		return errors.New("argumentos de EXPUNGE inválidos")
+	}
+	set, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.uids, err = imap.ParseSeqSet(set)
+	return err
+}
+
+func (h *expungeHandler) Handle(conn imapserver.Conn) error {
+	if h.uids != nil {
+		return badRequest("EXPUNGE não aceita argumentos")
+	}
+	return h.handle(conn)
+}
+
+func (h *expungeHandler) UidHandle(conn imapserver.Conn) error {
+	if h.uids == nil {
+		return badRequest("UID EXPUNGE exige um conjunto de UIDs")
+	}
+	return h.handle(conn)
+}
+
+func (h *expungeHandler) handle(conn imapserver.Conn) error {
+	mailbox, err := selectedMailbox(conn)
+	if err != nil {
+		return err
+	}
+	if conn.Context().MailboxReadOnly {
+		return imapserver.ErrMailboxReadOnly
+	}
+
+	if err := mailbox.expunge(h.uids); err != nil {
+		return err
+	}
+	return writeUpdates(conn, true)
+}
+
+// appendHandler implementa APPEND com MULTIAPPEND (RFC 3502), gravando todas
+// as mensagens ou nenhuma, e o código APPENDUID
+type appendHandler struct {
+	mailbox  string
+	messages []*appendMessage
+}
+
+func (h *appendHandler) Parse(fields []interface{}) error {
+	if len(fields) < 2 {
+		return errors.New("APPEND exige a caixa e ao menos uma mensagem")
+	}
+
+	mailbox, err := parseMailboxName(fields[0])
+	if err != nil {
+		return err
+	}
+	h.mailbox = mailbox
+
+	// Cada mensagem é um literal precedido das flags e da data opcionais
+	msg := &appendMessage{}
+	for _, f := range fields[1:] {
+		switch f := f.(type) {
+		case imap.Literal:
+			msg.body = f
+			h.messages = append(h.messages, msg)
+			msg = &appendMessage{}
+		case []interface{}:
+			if msg.flags != nil || !msg.date.IsZero() {
+				return errors.New("flags fora de posição em APPEND")
+			}
+			flags, err := imap.ParseStringList(f)
+			if err != nil {
+				return err
+			}
+			msg.flags = make([]string, len(flags))
+			for i, flag := range flags {
+				msg.flags[i] = imap.CanonicalFlag(flag)
+			}
+		case string:
+			if !msg.date.IsZero() {
+				return errors.New("data fora de posição em APPEND")
+			}
+			if msg.date, err = time.Parse(imap.DateTimeLayout, f); err != nil {
+				return err
+			}
+		default:
+			return errors.New("argumento de APPEND inválido")
+		}
+	}
+	if msg.flags != nil || !msg.date.IsZero() {
+		return errors.New("a mensagem deve ser um literal")
+	}
+	return nil
+}
+
+func (h *appendHandler) Handle(conn imapserver.Conn) error {
+	user, err := sessionUser(conn)
+	if err != nil {
+		return err
+	}
+
+	mbox, err := user.GetMailbox(h.mailbox)
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		}}
+	} else if err != nil {
+		return err
+	}
+
+	mailbox := mbox.(*IMAPMailbox)
+	messages, err := mailbox.createMessages(h.messages)
+	if err != nil {
+		return err
+	}
+
+	// As novas mensagens são anunciadas se a caixa de destino estiver selecionada
+	if err := writeUpdates(conn, true); err != nil {
+		return err
+	}
+
+	uids := new(imap.SeqSet)
+	for _, msg := range messages {
+		uids.AddNum(msg.UID)
+	}
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "APPENDUID",
+		Arguments: []interface{}{mailbox.mailbox.UIDValidity(), imap.RawString(uids.String())},
+		Info:      "APPEND completed",
+	}}
+}
+
+// copyHandler implementa COPY e UID COPY com o código COPYUID
+type copyHandler struct {
+	imapserver.Copy
+}
+
+func (h *copyHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *copyHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+func (h *copyHandler) handle(uid bool, conn imapserver.Conn) error {
+	mailbox, err := selectedMailbox(conn)
+	if err != nil {
+		return err
+	}
+
+	uidValidity, srcUIDs, destUIDs, err := mailbox.copyMessages(uid, h.SeqSet, h.Mailbox)
+	if errors.Is(err, backend.ErrNoSuchMailbox) {
+		return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+			Type: imap.StatusRespNo,
+			Code: imap.CodeTryCreate,
+			Info: err.Error(),
+		}}
+	} else if err != nil {
+		return err
+	}
+
+	if err := writeUpdates(conn, uid); err != nil {
+		return err
+	}
+	if len(srcUIDs) == 0 {
+		return nil
+	}
+
+	src, dest := new(imap.SeqSet), new(imap.SeqSet)
+	src.AddNum(srcUIDs...)
+	dest.AddNum(destUIDs...)
+	return &imap.ErrStatusResp{Resp: &imap.StatusResp{
+		Type:      imap.StatusRespOk,
+		Code:      "COPYUID",
+		Arguments: []interface{}{uidValidity, imap.RawString(src.String()), imap.RawString(dest.String())},
+		Info:      "COPY completed",
+	}}
+}
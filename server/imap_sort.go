@@ -0,0 +1,746 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/commands"
+	imapserver "github.com/emersion/go-imap/server"
+)
+
+// Algoritmos de THREAD suportados (RFC 5256)
+const (
+	threadOrderedSubject = "ORDEREDSUBJECT"
+	threadReferences     = "REFERENCES"
+)
+
+// sortExtension implementa SORT e THREAD (RFC 5256), com as chaves
+// DISPLAYFROM e DISPLAYTO de SORT=DISPLAY (RFC 5957)
+type sortExtension struct{}
+
+func newSortExtension() *sortExtension {
+	return &sortExtension{}
+}
+
+// Capabilities anuncia as extensões apenas após a autenticação
+func (e *sortExtension) Capabilities(c imapserver.Conn) []string {
+	if c.Context().State&imap.AuthenticatedState != 0 {
+		return []string{"SORT", "SORT=DISPLAY", "THREAD=" + threadOrderedSubject, "THREAD=" + threadReferences}
+	}
+	return nil
+}
+
+// Command retorna o tratador dos comandos da extensão
+func (e *sortExtension) Command(name string) imapserver.HandlerFactory {
+	switch name {
+	case "SORT":
+		return func() imapserver.Handler { return &sortHandler{} }
+	case "THREAD":
+		return func() imapserver.Handler { return &threadHandler{} }
+	}
+	return nil
+}
+
+// parseSearchArgs lê o charset obrigatório de SORT e THREAD seguido dos
+// critérios de pesquisa
+func parseSearchArgs(fields []interface{}) (*imap.SearchCriteria, error) {
+	if len(fields) < 2 {
+		return nil, errors.New("é necessário informar charset e critérios de pesquisa")
+	}
+	charset, err := imap.ParseString(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	search := &commands.Search{}
+	if err := search.Parse(append([]interface{}{"CHARSET", charset}, fields[1:]...)); err != nil {
+		return nil, err
+	}
+	return search.Criteria, nil
+}
+
+// sortItem é uma mensagem a ordenar ou agrupar, com os cabeçalhos lidos sob
+// demanda
+type sortItem struct {
+	seqNum uint32
+	msg    *storage.Message
+	header mail.Header
+}
+
+// searchItems retorna as mensagens da caixa selecionada que atendem aos
+// critérios, na ordem dos números de sequência
+func searchItems(conn imapserver.Conn, criteria *imap.SearchCriteria) ([]*sortItem, error) {
+	mailbox, err := selectedMailbox(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	seqNums, err := mailbox.SearchMessages(false, criteria)
+	if err != nil || len(seqNums) == 0 {
+		return nil, err
+	}
+	set := new(imap.SeqSet)
+	set.AddNum(seqNums...)
+	messages, seqNums, err := mailbox.messagesIn(false, set)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]*sortItem, len(messages))
+	for i, msg := range messages {
+		items[i] = &sortItem{seqNum: seqNums[i], msg: msg}
+	}
+	return items, nil
+}
+
+// id retorna o número de sequência ou o UID da mensagem
+func (item *sortItem) id(uid bool) uint32 {
+	if uid {
+		return item.msg.UID
+	}
+	return item.seqNum
+}
+
+func (item *sortItem) headers() mail.Header {
+	if item.header == nil {
+		item.header = mail.Header{}
+		if msg, err := mail.ReadMessage(bytes.NewReader(item.msg.RawData)); err == nil {
+			item.header = msg.Header
+		}
+	}
+	return item.header
+}
+
+// sentDate retorna a data do cabeçalho Date ou, se inválida, a data interna
+func (item *sortItem) sentDate() time.Time {
+	if date, err := item.headers().Date(); err == nil {
+		return date
+	}
+	return item.msg.Date
+}
+
+// subject retorna o assunto base e se a mensagem é resposta ou encaminhamento
+func (item *sortItem) subject() (string, bool) {
+	subject := item.headers().Get("Subject")
+	if subject == "" {
+		subject = item.msg.Subject
+	}
+	return baseSubject(subject)
+}
+
+// address retorna a chave de ordenação do primeiro endereço do cabeçalho:
+// a parte local (RFC 5256) ou, com display, o nome de exibição (RFC 5957)
+func (item *sortItem) address(field string, display bool) string {
+	list, err := item.headers().AddressList(field)
+	if err != nil || len(list) == 0 {
+		return ""
+	}
+	addr := list[0]
+	if display {
+		if addr.Name != "" {
+			return strings.ToLower(addr.Name)
+		}
+		return strings.ToLower(addr.Address)
+	}
+	local := addr.Address
+	if at := strings.LastIndex(local, "@"); at >= 0 {
+		local = local[:at]
+	}
+	return strings.ToLower(local)
+}
+
+// sortCriterion é uma chave de SORT, possivelmente invertida com REVERSE
+type sortCriterion struct {
+	key     string
+	reverse bool
+}
+
+// compare compara duas mensagens pela chave, retornando -1, 0 ou 1
+func (c sortCriterion) compare(a, b *sortItem) int {
+	var result int
+	switch c.key {
+	case "ARRIVAL":
+		result = compareTimes(a.msg.Date, b.msg.Date)
+	case "DATE":
+		result = compareTimes(a.sentDate(), b.sentDate())
+	case "SIZE":
+		result = compareInts(a.msg.Size, b.msg.Size)
+	case "SUBJECT":
+		sa, _ := a.subject()
+		sb, _ := b.subject()
+		result = strings.Compare(sa, sb)
+	case "FROM", "TO", "CC":
+		result = strings.Compare(a.address(c.key, false), b.address(c.key, false))
+	case "DISPLAYFROM":
+		result = strings.Compare(a.address("From", true), b.address("From", true))
+	case "DISPLAYTO":
+		result = strings.Compare(a.address("To", true), b.address("To", true))
+	}
+	if c.reverse {
+		return -result
+	}
+	return result
+}
+
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// sortHandler implementa SORT e UID SORT
+type sortHandler struct {
+	criteria []sortCriterion
+	search   *imap.SearchCriteria
+}
+
+func (h *sortHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("SORT exige critérios de ordenação")
+	}
+	list, ok := fields[0].([]interface{})
+	if !ok || len(list) == 0 {
+		return errors.New("critérios de ordenação devem ser uma lista")
+	}
+
+	reverse := false
+	for _, f := range list {
+		key, err := imap.ParseString(f)
+		if err != nil {
+			return err
+		}
+		key = strings.ToUpper(key)
+		switch key {
+		case "REVERSE":
+			reverse = true
+			continue
+		case "ARRIVAL", "CC", "DATE", "FROM", "SIZE", "SUBJECT", "TO", "DISPLAYFROM", "DISPLAYTO":
+			h.criteria = append(h.criteria, sortCriterion{key: key, reverse: reverse})
+			reverse = false
+		default:
+			return fmt.Errorf("critério de ordenação desconhecido: %s", key)
+		}
+	}
+	if reverse {
+		return errors.New("REVERSE deve preceder um critério")
+	}
+
+	search, err := parseSearchArgs(fields[1:])
+	if err != nil {
+		return err
+	}
+	h.search = search
+	return nil
+}
+
+func (h *sortHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *sortHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+func (h *sortHandler) handle(uid bool, conn imapserver.Conn) error {
+	items, err := searchItems(conn, h.search)
+	if err != nil {
+		return err
+	}
+
+	// Empates são resolvidos pelo número de sequência, já em ordem crescente
+	sort.SliceStable(items, func(i, j int) bool {
+		for _, c := range h.criteria {
+			if result := c.compare(items[i], items[j]); result != 0 {
+				return result < 0
+			}
+		}
+		return false
+	})
+
+	fields := []interface{}{imap.RawString("SORT")}
+	for _, item := range items {
+		fields = append(fields, item.id(uid))
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// threadHandler implementa THREAD e UID THREAD
+type threadHandler struct {
+	algorithm string
+	search    *imap.SearchCriteria
+}
+
+func (h *threadHandler) Parse(fields []interface{}) error {
+	if len(fields) < 1 {
+		return errors.New("THREAD exige um algoritmo")
+	}
+	algorithm, err := imap.ParseString(fields[0])
+	if err != nil {
+		return err
+	}
+	h.algorithm = strings.ToUpper(algorithm)
+	if h.algorithm != threadOrderedSubject && h.algorithm != threadReferences {
+		return fmt.Errorf("algoritmo de THREAD desconhecido: %s", algorithm)
+	}
+
+	search, err := parseSearchArgs(fields[1:])
+	if err != nil {
+		return err
+	}
+	h.search = search
+	return nil
+}
+
+func (h *threadHandler) Handle(conn imapserver.Conn) error {
+	return h.handle(false, conn)
+}
+
+func (h *threadHandler) UidHandle(conn imapserver.Conn) error {
+	return h.handle(true, conn)
+}
+
+func (h *threadHandler) handle(uid bool, conn imapserver.Conn) error {
+	items, err := searchItems(conn, h.search)
+	if err != nil {
+		return err
+	}
+
+	var roots []*threadNode
+	if h.algorithm == threadOrderedSubject {
+		roots = threadByOrderedSubject(items)
+	} else {
+		roots = threadByReferences(items)
+	}
+
+	fields := []interface{}{imap.RawString("THREAD")}
+	if len(roots) > 0 {
+		var b strings.Builder
+		for _, root := range roots {
+			b.WriteByte('(')
+			root.format(&b, uid)
+			b.WriteByte(')')
+		}
+		fields = append(fields, imap.RawString(b.String()))
+	}
+	return conn.WriteResp(imap.NewUntaggedResp(fields))
+}
+
+// threadNode é um nó da árvore de conversas; nós sem mensagem são fictícios
+type threadNode struct {
+	item     *sortItem
+	parent   *threadNode
+	children []*threadNode
+}
+
+// format escreve o nó no formato da resposta THREAD: filhos únicos seguem o
+// pai separados por espaço; vários filhos aparecem entre parênteses
+func (n *threadNode) format(b *strings.Builder, uid bool) {
+	if n.item != nil {
+		b.WriteString(strconv.FormatUint(uint64(n.item.id(uid)), 10))
+		if len(n.children) == 0 {
+			return
+		}
+		b.WriteByte(' ')
+		if len(n.children) == 1 {
+			n.children[0].format(b, uid)
+			return
+		}
+	}
+	for _, child := range n.children {
+		b.WriteByte('(')
+		child.format(b, uid)
+		b.WriteByte(')')
+	}
+}
+
+// date retorna a data usada na ordenação: a da mensagem ou, para nós
+// fictícios, a do primeiro filho
+func (n *threadNode) date() time.Time {
+	if n.item != nil {
+		return n.item.sentDate()
+	}
+	if len(n.children) > 0 {
+		return n.children[0].date()
+	}
+	return time.Time{}
+}
+
+func (n *threadNode) seqNum() uint32 {
+	if n.item != nil {
+		return n.item.seqNum
+	}
+	if len(n.children) > 0 {
+		return n.children[0].seqNum()
+	}
+	return 0
+}
+
+// subjectItem retorna a mensagem que representa o assunto do nó
+func (n *threadNode) subjectItem() *sortItem {
+	if n.item != nil {
+		return n.item
+	}
+	if len(n.children) > 0 {
+		return n.children[0].item
+	}
+	return nil
+}
+
+// isAncestorOf informa se n está acima de other na árvore
+func (n *threadNode) isAncestorOf(other *threadNode) bool {
+	for p := other; p != nil; p = p.parent {
+		if p == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *threadNode) addChild(child *threadNode) {
+	child.parent = n
+	n.children = append(n.children, child)
+}
+
+func (n *threadNode) removeChild(child *threadNode) {
+	for i, c := range n.children {
+		if c == child {
+			n.children = append(n.children[:i], n.children[i+1:]...)
+			break
+		}
+	}
+	child.parent = nil
+}
+
+// sortNodes ordena nós irmãos pela data de envio e, no empate, pelo número
+// de sequência
+func sortNodes(nodes []*threadNode) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		if c := compareTimes(nodes[i].date(), nodes[j].date()); c != 0 {
+			return c < 0
+		}
+		return nodes[i].seqNum() < nodes[j].seqNum()
+	})
+}
+
+// sortTree ordena recursivamente os filhos de cada nó
+func sortTree(nodes []*threadNode) {
+	for _, n := range nodes {
+		sortTree(n.children)
+		sortNodes(n.children)
+	}
+}
+
+// threadByOrderedSubject agrupa as mensagens pelo assunto base; a primeira
+// mensagem de cada grupo é pai das demais (RFC 5256, seção 3)
+func threadByOrderedSubject(items []*sortItem) []*threadNode {
+	sorted := append([]*sortItem(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		si, _ := sorted[i].subject()
+		sj, _ := sorted[j].subject()
+		if si != sj {
+			return si < sj
+		}
+		if c := compareTimes(sorted[i].sentDate(), sorted[j].sentDate()); c != 0 {
+			return c < 0
+		}
+		return sorted[i].seqNum < sorted[j].seqNum
+	})
+
+	var roots []*threadNode
+	var current *threadNode
+	currentSubject := ""
+	for _, item := range sorted {
+		subject, _ := item.subject()
+		if current == nil || subject != currentSubject {
+			current = &threadNode{item: item}
+			currentSubject = subject
+			roots = append(roots, current)
+			continue
+		}
+		current.addChild(&threadNode{item: item})
+	}
+
+	sortNodes(roots)
+	return roots
+}
+
+// threadByReferences monta as conversas a partir de Message-ID, References e
+// In-Reply-To, agrupando em seguida as raízes de mesmo assunto (RFC 5256,
+// seção 3)
+func threadByReferences(items []*sortItem) []*threadNode {
+	nodes := make(map[string]*threadNode)
+	get := func(id string) *threadNode {
+		n, ok := nodes[id]
+		if !ok {
+			n = &threadNode{}
+			nodes[id] = n
+		}
+		return n
+	}
+
+	// 1. Ligar as mensagens às referências, sem criar ciclos
+	var all []*threadNode
+	for i, item := range items {
+		id := item.msg.MessageID
+		if id == "" || (nodes[id] != nil && nodes[id].item != nil) {
+			id = fmt.Sprintf("<%d@sem-identificador>", i)
+		}
+		n := get(id)
+		n.item = item
+		all = append(all, n)
+
+		refs := strings.Fields(item.msg.References)
+		if len(refs) == 0 && item.msg.InReplyTo != "" {
+			refs = []string{item.msg.InReplyTo}
+		}
+		for j := 0; j+1 < len(refs); j++ {
+			parent, child := get(refs[j]), get(refs[j+1])
+			if child.parent == nil && parent != child && !child.isAncestorOf(parent) {
+				parent.addChild(child)
+			}
+		}
+
+		if n.parent != nil {
+			n.parent.removeChild(n)
+		}
+		if len(refs) > 0 {
+			parent := get(refs[len(refs)-1])
+			if parent != n && !n.isAncestorOf(parent) {
+				parent.addChild(n)
+			}
+		}
+	}
+
+	// 2. Conjunto raiz
+	var roots []*threadNode
+	seen := make(map[*threadNode]bool)
+	for _, n := range nodes {
+		if n.parent == nil && !seen[n] {
+			seen[n] = true
+			roots = append(roots, n)
+		}
+	}
+
+	// 3. Remover nós fictícios desnecessários
+	roots = pruneThreads(roots, true)
+
+	// 4. Ordenar o conjunto raiz pela data de envio
+	sortTree(roots)
+	sortNodes(roots)
+
+	// 5. Agrupar raízes com o mesmo assunto base
+	roots = groupBySubject(roots)
+
+	// 6. Ordenar os irmãos pela data de envio
+	sortTree(roots)
+	return roots
+}
+
+// pruneThreads remove nós fictícios sem filhos e promove os filhos de nós
+// fictícios, exceto na raiz quando há mais de um filho
+func pruneThreads(nodes []*threadNode, root bool) []*threadNode {
+	var result []*threadNode
+	for _, n := range nodes {
+		n.children = pruneThreads(n.children, false)
+		if n.item == nil {
+			if len(n.children) == 0 {
+				continue
+			}
+			if !root || len(n.children) == 1 {
+				for _, child := range n.children {
+					child.parent = n.parent
+				}
+				result = append(result, n.children...)
+				continue
+			}
+		}
+		result = append(result, n)
+	}
+	return result
+}
+
+// groupBySubject junta raízes que compartilham o assunto base
+func groupBySubject(roots []*threadNode) []*threadNode {
+	table := make(map[string]*threadNode)
+	for _, root := range roots {
+		item := root.subjectItem()
+		if item == nil {
+			continue
+		}
+		subject, reply := item.subject()
+		if subject == "" {
+			continue
+		}
+		existing, ok := table[subject]
+		if !ok {
+			table[subject] = root
+			continue
+		}
+		_, existingReply := existing.subjectItem().subject()
+		if existing.item != nil && (root.item == nil || (existingReply && !reply)) {
+			table[subject] = root
+		}
+	}
+
+	var result []*threadNode
+	merged := make(map[*threadNode]bool)
+	for _, root := range roots {
+		if merged[root] {
+			continue
+		}
+		item := root.subjectItem()
+		subject := ""
+		reply := false
+		if item != nil {
+			subject, reply = item.subject()
+		}
+		other, ok := table[subject]
+		if subject == "" || !ok || other == root {
+			result = append(result, root)
+			continue
+		}
+
+		_, otherReply := other.subjectItem().subject()
+		switch {
+		case other.item == nil && root.item == nil:
+			for _, child := range root.children {
+				other.addChild(child)
+			}
+		case other.item == nil:
+			other.addChild(root)
+		case root.item != nil && reply && !otherReply:
+			other.addChild(root)
+		default:
+			// Um novo nó fictício passa a conter as duas conversas, na
+			// posição da que aparece primeiro
+			dummy := &threadNode{}
+			placed := false
+			for i, r := range result {
+				if r == other {
+					result[i] = dummy
+					placed = true
+				}
+			}
+			if !placed {
+				result = append(result, dummy)
+				merged[other] = true
+			}
+			dummy.addChild(other)
+			dummy.addChild(root)
+			table[subject] = dummy
+		}
+	}
+	return result
+}
+
+// baseSubject extrai o assunto base (RFC 5256, seção 2.1), informando se o
+// assunto indicava resposta ou encaminhamento
+func baseSubject(subject string) (string, bool) {
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+	s := strings.Join(strings.Fields(subject), " ")
+
+	reply := false
+	for {
+		// Remover "(fwd)" e espaços no final
+		for {
+			s = strings.TrimSpace(s)
+			if !strings.HasSuffix(strings.ToLower(s), "(fwd)") {
+				break
+			}
+			s = s[:len(s)-len("(fwd)")]
+			reply = true
+		}
+
+		// Remover prefixos "Re:", "Fwd:" e blocos "[...]"
+		for {
+			rest, isReply, ok := trimSubjectLeader(s)
+			if !ok {
+				break
+			}
+			s = rest
+			reply = reply || isReply
+		}
+
+		// Remover o invólucro "[fwd: ...]"
+		lower := strings.ToLower(s)
+		if strings.HasPrefix(lower, "[fwd:") && strings.HasSuffix(s, "]") {
+			s = s[len("[fwd:") : len(s)-1]
+			reply = true
+			continue
+		}
+		break
+	}
+
+	return strings.ToLower(strings.TrimSpace(s)), reply
+}
+
+// trimSubjectLeader remove um prefixo de resposta ("Re:", "Fw:", "Fwd:",
+// possivelmente com blocos "[...]") ou um bloco "[...]" inicial que não seja
+// o assunto inteiro
+func trimSubjectLeader(s string) (string, bool, bool) {
+	s = strings.TrimLeft(s, " ")
+	rest := s
+	for {
+		after, ok := subjectBlob(rest)
+		if !ok {
+			break
+		}
+		rest = strings.TrimLeft(after, " ")
+	}
+
+	lower := strings.ToLower(rest)
+	for _, prefix := range []string{"re", "fwd", "fw"} {
+		if !strings.HasPrefix(lower, prefix) {
+			continue
+		}
+		after := strings.TrimLeft(rest[len(prefix):], " ")
+		if afterBlob, ok := subjectBlob(after); ok {
+			after = strings.TrimLeft(afterBlob, " ")
+		}
+		if strings.HasPrefix(after, ":") {
+			return after[1:], true, true
+		}
+	}
+
+	if after, ok := subjectBlob(s); ok && strings.TrimSpace(after) != "" {
+		return after, false, true
+	}
+	return s, false, false
+}
+
+// subjectBlob remove um bloco "[...]" do início do assunto
+func subjectBlob(s string) (string, bool) {
+	if !strings.HasPrefix(s, "[") {
+		return s, false
+	}
+	end := strings.IndexByte(s, ']')
+	if end < 0 || strings.ContainsAny(s[1:end], "[") {
+		return s, false
+	}
+	return s[end+1:], true
+}
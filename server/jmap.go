@@ -0,0 +1,1078 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// Capacidades JMAP suportadas
+const (
+	jmapCore       = "urn:ietf:params:jmap:core"
+	jmapMail       = "urn:ietf:params:jmap:mail"
+	jmapSubmission = "urn:ietf:params:jmap:submission"
+)
+
+// Limites anunciados na capacidade core (RFC 8620, seção 2)
+const (
+	jmapMaxSizeRequest      = 10 << 20
+	jmapMaxConcurrent       = 4
+	jmapMaxCallsInRequest   = 32
+	jmapMaxObjectsInGet     = 500
+	jmapMaxObjectsInSet     = 500
+	jmapDefaultMaxUpload    = 50 << 20
+	jmapMaxConcurrentUpload = 4
+)
+
+// jmapMaxDeliveryRecords limita os registros do histórico de entregas lidos
+// para montar o estado de entrega de um envio ou calcular suas mudanças
+const jmapMaxDeliveryRecords = 1000
+
+// jmapPushInterval é o intervalo entre as verificações de mudanças enviadas
+// aos clientes conectados por EventSource
+const jmapPushInterval = 5 * time.Second
+
+// jmapBlobTTL é o tempo pelo qual um blob enviado fica disponível
+const jmapBlobTTL = 24 * time.Hour
+
+// Prefixos dos identificadores JMAP. A RFC 8620 recomenda que IDs não
+// comecem com dígitos.
+const (
+	jmapAccountPrefix    = 'A'
+	jmapMailboxPrefix    = 'M'
+	jmapEmailPrefix      = 'E'
+	jmapThreadPrefix     = 'T'
+	jmapBlobPrefix       = 'B'
+	jmapIdentityPrefix   = 'I'
+	jmapSubmissionPrefix = 'S'
+	jmapUploadPrefix     = 'U'
+)
+
+// jmapError é um erro de método ou de objeto em /set (RFC 8620, seções
+// 3.6.2 e 5.3)
+type jmapError struct {
+	Type        string   `json:"type"`
+	Description string   `json:"description,omitempty"`
+	Properties  []string `json:"properties,omitempty"`
+}
+
+func (e *jmapError) Error() string {
+	if e.Description != "" {
+		return e.Type + ": " + e.Description
+	}
+	return e.Type
+}
+
+func newJMAPError(errType, description string) *jmapError {
+	return &jmapError{Type: errType, Description: description}
+}
+
+// errInvalidProperties indica propriedades inválidas em uma criação ou
+// atualização
+func errInvalidProperties(description string, properties ...string) *jmapError {
+	return &jmapError{Type: "invalidProperties", Description: description, Properties: properties}
+}
+
+// jmapInvocation é uma chamada de método ou sua resposta: nome, argumentos e
+// identificador da chamada
+type jmapInvocation struct {
+	name   string
+	args   interface{}
+	callID string
+}
+
+func (i *jmapInvocation) MarshalJSON() ([]byte, error) {
+	return json.Marshal([]interface{}{i.name, i.args, i.callID})
+}
+
+func (i *jmapInvocation) UnmarshalJSON(data []byte) error {
+	var fields []json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) != 3 {
+		return errors.New("chamada deve ter nome, argumentos e identificador")
+	}
+	var name, callID string
+	if err := json.Unmarshal(fields[0], &name); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(fields[2], &callID); err != nil {
+		return err
+	}
+	i.name, i.args, i.callID = name, fields[1], callID
+	return nil
+}
+
+// jmapRequest é o corpo de uma requisição à API (RFC 8620, seção 3.3)
+type jmapRequest struct {
+	Using       []string          `json:"using"`
+	MethodCalls []*jmapInvocation `json:"methodCalls"`
+	CreatedIDs  map[string]string `json:"createdIds"`
+}
+
+// jmapResponse é o corpo da resposta à API (RFC 8620, seção 3.4)
+type jmapResponse struct {
+	MethodResponses []*jmapInvocation `json:"methodResponses"`
+	CreatedIDs      map[string]string `json:"createdIds,omitempty"`
+	SessionState    string            `json:"sessionState"`
+}
+
+// jmapMethod implementa um método da API. A capacidade precisa ter sido
+// declarada em "using" para que o método exista.
+type jmapMethod struct {
+	capability string
+	handle     func(c *jmapContext, args json.RawMessage) (interface{}, error)
+}
+
+// jmapMethods lista os métodos suportados
+var jmapMethods = map[string]jmapMethod{
+	"Core/echo": {jmapCore, func(c *jmapContext, args json.RawMessage) (interface{}, error) {
+		return args, nil
+	}},
+	"Mailbox/get":             {jmapMail, (*jmapContext).mailboxGet},
+	"Mailbox/changes":         {jmapMail, (*jmapContext).mailboxChanges},
+	"Mailbox/query":           {jmapMail, (*jmapContext).mailboxQuery},
+	"Mailbox/queryChanges":    {jmapMail, (*jmapContext).queryChanges},
+	"Mailbox/set":             {jmapMail, (*jmapContext).mailboxSet},
+	"Thread/get":              {jmapMail, (*jmapContext).threadGet},
+	"Thread/changes":          {jmapMail, (*jmapContext).threadChanges},
+	"Email/get":               {jmapMail, (*jmapContext).emailGet},
+	"Email/changes":           {jmapMail, (*jmapContext).emailChanges},
+	"Email/query":             {jmapMail, (*jmapContext).emailQuery},
+	"Email/queryChanges":      {jmapMail, (*jmapContext).queryChanges},
+	"Email/set":               {jmapMail, (*jmapContext).emailSet},
+	"Email/import":            {jmapMail, (*jmapContext).emailImport},
+	"Identity/get":            {jmapSubmission, (*jmapContext).identityGet},
+	"Identity/changes":        {jmapSubmission, (*jmapContext).identityChanges},
+	"EmailSubmission/get":     {jmapSubmission, (*jmapContext).submissionGet},
+	"EmailSubmission/changes": {jmapSubmission, (*jmapContext).submissionChanges},
+	"EmailSubmission/query":   {jmapSubmission, (*jmapContext).submissionQuery},
+	"EmailSubmission/set":     {jmapSubmission, (*jmapContext).submissionSet},
+}
+
+// JMAPServer atende a API JMAP sobre HTTP, com autenticação Basic validada
+// por AuthenticateUser
+type JMAPServer struct {
+	store     storage.Storage
+	delivery  *Delivery
+	hostname  string
+	url       string // URL pública; vazia usa o Host da requisição
+	maxUpload int
+	blobs     *jmapBlobStore
+}
+
+// NewJMAPServer cria um novo servidor JMAP
+func NewJMAPServer(cfg *config.Config, store storage.Storage, delivery *Delivery) *JMAPServer {
+	maxUpload := cfg.SMTP.MaxMessageBytes
+	if maxUpload <= 0 {
+		maxUpload = jmapDefaultMaxUpload
+	}
+
+	return &JMAPServer{
+		store:     store,
+		delivery:  delivery,
+		hostname:  cfg.SMTP.Domain,
+		url:       strings.TrimSuffix(cfg.JMAP.URL, "/"),
+		maxUpload: maxUpload,
+		blobs:     newJMAPBlobStore(),
+	}
+}
+
+// Handler retorna as rotas do servidor
+func (s *JMAPServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/jmap", s.handleSession)
+	mux.HandleFunc("/jmap/api", s.handleAPI)
+	mux.HandleFunc("/jmap/upload/", s.handleUpload)
+	mux.HandleFunc("/jmap/download/", s.handleDownload)
+	mux.HandleFunc("/jmap/eventsource", s.handleEventSource)
+	return mux
+}
+
+// authenticate valida as credenciais Basic da requisição, respondendo 401
+// quando ausentes ou inválidas
+func (s *JMAPServer) authenticate(w http.ResponseWriter, r *http.Request) *storage.User {
+	username, password, ok := r.BasicAuth()
+	if ok {
+		if user, err := s.store.AuthenticateUser(username, password); err == nil {
+			return user
+		}
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="simpleEmail"`)
+	http.Error(w, "autenticação necessária", http.StatusUnauthorized)
+	return nil
+}
+
+// baseURL retorna a URL pública do servidor
+func (s *JMAPServer) baseURL(r *http.Request) string {
+	if s.url != "" {
+		return s.url
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// handleSession responde o recurso de sessão (RFC 8620, seção 2)
+func (s *JMAPServer) handleSession(w http.ResponseWriter, r *http.Request) {
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	accountID := jmapID(jmapAccountPrefix, user.ID)
+	base := s.baseURL(r)
+	session := map[string]interface{}{
+		"capabilities": map[string]interface{}{
+			jmapCore: map[string]interface{}{
+				"maxSizeUpload":         s.maxUpload,
+				"maxConcurrentUpload":   jmapMaxConcurrentUpload,
+				"maxSizeRequest":        jmapMaxSizeRequest,
+				"maxConcurrentRequests": jmapMaxConcurrent,
+				"maxCallsInRequest":     jmapMaxCallsInRequest,
+				"maxObjectsInGet":       jmapMaxObjectsInGet,
+				"maxObjectsInSet":       jmapMaxObjectsInSet,
+				"collationAlgorithms":   []string{"i;ascii-casemap"},
+			},
+			jmapMail:       map[string]interface{}{},
+			jmapSubmission: map[string]interface{}{},
+		},
+		"accounts": map[string]interface{}{
+			accountID: map[string]interface{}{
+				"name":       user.Email,
+				"isPersonal": true,
+				"isReadOnly": false,
+				"accountCapabilities": map[string]interface{}{
+					jmapMail: map[string]interface{}{
+						"maxMailboxesPerEmail":       1,
+						"maxMailboxDepth":            nil,
+						"maxSizeMailboxName":         255,
+						"maxSizeAttachmentsPerEmail": s.maxUpload,
+						"emailQuerySortOptions":      jmapEmailSortOptions,
+						"mayCreateTopLevelMailbox":   true,
+					},
+					jmapSubmission: map[string]interface{}{
+						"maxDelayedSend":       0,
+						"submissionExtensions": map[string]interface{}{},
+					},
+				},
+			},
+		},
+		"primaryAccounts": map[string]string{
+			jmapMail:       accountID,
+			jmapSubmission: accountID,
+		},
+		"username":       loginName(user),
+		"apiUrl":         base + "/jmap/api",
+		"downloadUrl":    base + "/jmap/download/{accountId}/{blobId}/{name}?accept={type}",
+		"uploadUrl":      base + "/jmap/upload/{accountId}/",
+		"eventSourceUrl": base + "/jmap/eventsource?types={types}&closeafter={closeafter}&ping={ping}",
+		"state":          sessionState(user),
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+// sessionState identifica o estado do objeto de sessão, que só muda com os
+// dados da conta
+func sessionState(user *storage.User) string {
+	return hashState(loginName(user), user.Email)
+}
+
+// writeJSON envia uma resposta JSON
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Erro ao enviar resposta JMAP: %v", err)
+	}
+}
+
+// writeProblem envia um erro de requisição (RFC 8620, seção 3.6.1) no
+// formato da RFC 7807
+func writeProblem(w http.ResponseWriter, status int, errType, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":   "urn:ietf:params:jmap:error:" + errType,
+		"status": status,
+		"detail": detail,
+	})
+}
+
+// handleAPI processa uma requisição com chamadas de métodos (RFC 8620,
+// seção 3)
+func (s *JMAPServer) handleAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, jmapMaxSizeRequest+1))
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "notJSON", "falha ao ler a requisição")
+		return
+	}
+	if len(data) > jmapMaxSizeRequest {
+		writeProblem(w, http.StatusBadRequest, "limit", "maxSizeRequest excedido")
+		return
+	}
+	if !json.Valid(data) {
+		writeProblem(w, http.StatusBadRequest, "notJSON", "a requisição não é um JSON válido")
+		return
+	}
+
+	var req jmapRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Using == nil || req.MethodCalls == nil {
+		writeProblem(w, http.StatusBadRequest, "notRequest", "a requisição não segue o formato JMAP")
+		return
+	}
+	if len(req.MethodCalls) > jmapMaxCallsInRequest {
+		writeProblem(w, http.StatusBadRequest, "limit", "maxCallsInRequest excedido")
+		return
+	}
+
+	c := s.newContext(user)
+	for _, capability := range req.Using {
+		if capability != jmapCore && capability != jmapMail && capability != jmapSubmission {
+			writeProblem(w, http.StatusBadRequest, "unknownCapability", "capacidade desconhecida: "+capability)
+			return
+		}
+		c.using[capability] = true
+	}
+	for id, created := range req.CreatedIDs {
+		c.createdIDs[id] = created
+	}
+
+	for _, call := range req.MethodCalls {
+		c.call(call)
+	}
+
+	resp := &jmapResponse{
+		MethodResponses: c.responses,
+		SessionState:    sessionState(user),
+	}
+	if req.CreatedIDs != nil {
+		resp.CreatedIDs = c.createdIDs
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// jmapContext guarda o estado de uma requisição à API: o usuário, os IDs
+// criados e as respostas já produzidas, usadas por referências a resultados
+type jmapContext struct {
+	server     *JMAPServer
+	user       *storage.User
+	accountID  string
+	using      map[string]bool
+	createdIDs map[string]string
+	responses  []*jmapInvocation
+	implicit   []*jmapInvocation
+
+	// Caches válidos durante a requisição
+	mailboxList []*storage.Mailbox
+	messages    []*storage.Message
+	parsed      map[int64]*mimePart
+}
+
+func (s *JMAPServer) newContext(user *storage.User) *jmapContext {
+	return &jmapContext{
+		server:     s,
+		user:       user,
+		accountID:  jmapID(jmapAccountPrefix, user.ID),
+		using:      map[string]bool{},
+		createdIDs: map[string]string{},
+		parsed:     map[int64]*mimePart{},
+	}
+}
+
+// call executa uma chamada e acrescenta sua resposta, ou o erro do método
+func (c *jmapContext) call(call *jmapInvocation) {
+	method, ok := jmapMethods[call.name]
+	if !ok || !c.using[method.capability] {
+		c.respond("error", newJMAPError("unknownMethod", call.name), call.callID)
+		return
+	}
+
+	args, err := c.resolveReferences(call.args.(json.RawMessage))
+	if err != nil {
+		c.respond("error", err, call.callID)
+		return
+	}
+
+	result, err := method.handle(c, args)
+	var jerr *jmapError
+	if errors.As(err, &jerr) {
+		c.respond("error", jerr, call.callID)
+		return
+	} else if err != nil {
+		log.Printf("Erro no método JMAP %s de %s: %v", call.name, c.user.Email, err)
+		c.respond("error", newJMAPError("serverFail", err.Error()), call.callID)
+		return
+	}
+
+	c.respond(call.name, result, call.callID)
+
+	// Respostas implícitas, como o Email/set de EmailSubmission/set, seguem a
+	// resposta principal com o mesmo identificador de chamada
+	for _, resp := range c.implicit {
+		resp.callID = call.callID
+		c.responses = append(c.responses, resp)
+	}
+	c.implicit = nil
+}
+
+// respond acrescenta uma resposta à requisição
+func (c *jmapContext) respond(name string, args interface{}, callID string) {
+	c.responses = append(c.responses, &jmapInvocation{name: name, args: args, callID: callID})
+}
+
+// jmapResultReference aponta para parte do resultado de uma chamada anterior
+// (RFC 8620, seção 3.7)
+type jmapResultReference struct {
+	ResultOf string `json:"resultOf"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+}
+
+// resolveReferences substitui os argumentos "#nome" pelo valor apontado no
+// resultado de uma chamada anterior
+func (c *jmapContext) resolveReferences(raw json.RawMessage) (json.RawMessage, error) {
+	var args map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, newJMAPError("invalidArguments", "os argumentos devem ser um objeto")
+	}
+
+	resolved := false
+	for key, value := range args {
+		if !strings.HasPrefix(key, "#") {
+			continue
+		}
+		name := key[1:]
+		if _, ok := args[name]; ok {
+			return nil, newJMAPError("invalidArguments", "argumento informado também como referência: "+name)
+		}
+
+		var ref jmapResultReference
+		if err := json.Unmarshal(value, &ref); err != nil {
+			return nil, newJMAPError("invalidResultReference", "referência inválida em "+key)
+		}
+		result, err := c.referencedValue(&ref)
+		if err != nil {
+			return nil, err
+		}
+		if args[name], err = json.Marshal(result); err != nil {
+			return nil, err
+		}
+		delete(args, key)
+		resolved = true
+	}
+
+	if !resolved {
+		return raw, nil
+	}
+	return json.Marshal(args)
+}
+
+// referencedValue avalia o caminho da referência no resultado apontado
+func (c *jmapContext) referencedValue(ref *jmapResultReference) (interface{}, error) {
+	for _, resp := range c.responses {
+		if resp.callID != ref.ResultOf || resp.name != ref.Name {
+			continue
+		}
+
+		data, err := json.Marshal(resp.args)
+		if err != nil {
+			return nil, err
+		}
+		var value interface{}
+		if err := json.Unmarshal(data, &value); err != nil {
+			return nil, err
+		}
+
+		tokens := strings.Split(ref.Path, "/")
+		if ref.Path == "" || tokens[0] != "" {
+			return nil, newJMAPError("invalidResultReference", "caminho inválido: "+ref.Path)
+		}
+		if result, ok := evalPointer(value, tokens[1:]); ok {
+			return result, nil
+		}
+		return nil, newJMAPError("invalidResultReference", "caminho não encontrado: "+ref.Path)
+	}
+	return nil, newJMAPError("invalidResultReference", "resposta não encontrada: "+ref.ResultOf)
+}
+
+// evalPointer avalia um JSON Pointer (RFC 6901) com a extensão "*" da RFC
+// 8620, que aplica o restante do caminho a cada item de um array
+func evalPointer(value interface{}, tokens []string) (interface{}, bool) {
+	if len(tokens) == 0 {
+		return value, true
+	}
+	token := strings.ReplaceAll(strings.ReplaceAll(tokens[0], "~1", "/"), "~0", "~")
+
+	switch v := value.(type) {
+	case []interface{}:
+		if token == "*" {
+			result := []interface{}{}
+			for _, item := range v {
+				r, ok := evalPointer(item, tokens[1:])
+				if !ok {
+					return nil, false
+				}
+				if list, isList := r.([]interface{}); isList {
+					result = append(result, list...)
+				} else {
+					result = append(result, r)
+				}
+			}
+			return result, true
+		}
+		i, err := strconv.Atoi(token)
+		if err != nil || i < 0 || i >= len(v) {
+			return nil, false
+		}
+		return evalPointer(v[i], tokens[1:])
+	case map[string]interface{}:
+		item, ok := v[token]
+		if !ok {
+			return nil, false
+		}
+		return evalPointer(item, tokens[1:])
+	}
+	return nil, false
+}
+
+// checkAccount valida o accountId de uma chamada
+func (c *jmapContext) checkAccount(accountID string) error {
+	if accountID != c.accountID {
+		return newJMAPError("accountNotFound", accountID)
+	}
+	return nil
+}
+
+// resolveID converte uma referência "#criação" no ID criado nesta
+// requisição; outros IDs são mantidos
+func (c *jmapContext) resolveID(id string) string {
+	if strings.HasPrefix(id, "#") {
+		if created, ok := c.createdIDs[id[1:]]; ok {
+			return created
+		}
+	}
+	return id
+}
+
+// jmapID monta um identificador JMAP a partir do ID interno
+func jmapID(prefix byte, id int64) string {
+	return string(prefix) + strconv.FormatInt(id, 10)
+}
+
+// parseJMAPID extrai o ID interno de um identificador JMAP
+func parseJMAPID(prefix byte, id string) (int64, bool) {
+	if len(id) < 2 || id[0] != prefix {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(id[1:], 10, 64)
+	return n, err == nil && n > 0
+}
+
+// hashState resume valores em uma string de estado opaca
+func hashState(values ...string) string {
+	h := fnv.New64a()
+	for _, v := range values {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// jmapStates contém os estados dos tipos de dados de uma conta. Os estados
+// de Mailbox e Email guardam a posição de cada caixa, de modo que os métodos
+// /changes calculam as mudanças a partir da sequência de modificação das
+// mensagens e das remoções registradas (RFC 7162). O de EmailSubmission
+// guarda o último envio e o último registro de entrega do usuário.
+type jmapStates struct {
+	mailbox    string
+	email      string // Também usado por Thread
+	submission string
+}
+
+// states calcula os estados da conta a partir das caixas: qualquer mudança
+// em mensagens altera a sequência de modificação da caixa. Cada caixa é
+// registrada como "id.modseq.propriedades" no estado de Mailbox e como
+// "id.uidnext.modseq" no de Email, em base 36.
+func (s *JMAPServer) states(user *storage.User) (*jmapStates, error) {
+	mailboxes, err := s.store.ListMailboxes(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar caixas de correio: %w", err)
+	}
+	subscriptions, err := s.store.ListSubscriptions(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar assinaturas: %w", err)
+	}
+	subscribed := make(map[string]bool, len(subscriptions))
+	for _, name := range subscriptions {
+		subscribed[name] = true
+	}
+
+	sorted := append([]*storage.Mailbox(nil), mailboxes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	var mailboxEntries, emailEntries []string
+	for _, mb := range sorted {
+		id := strconv.FormatInt(mb.ID, 36)
+		modseq := strconv.FormatUint(mb.HighestModSeq, 36)
+		props := hashState(mb.Name, mb.SpecialUse, strconv.FormatBool(mb.NoSelect), strconv.FormatBool(subscribed[mb.Name]))
+		mailboxEntries = append(mailboxEntries, id+"."+modseq+"."+props)
+		emailEntries = append(emailEntries, id+"."+strconv.FormatUint(uint64(mb.UIDNext), 36)+"."+modseq)
+	}
+
+	submissions, err := s.store.ListEmailSubmissions(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar envios: %w", err)
+	}
+	records, err := s.store.ListDeliveries(strings.ToLower(user.Email), 1)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar entregas: %w", err)
+	}
+
+	return &jmapStates{
+		mailbox:    strings.Join(mailboxEntries, "_"),
+		email:      strings.Join(emailEntries, "_"),
+		submission: submissionState(submissions, records),
+	}, nil
+}
+
+// statePosition é a posição de uma caixa guardada em um estado
+type statePosition struct {
+	uidNext uint32 // Apenas no estado de Email
+	modSeq  uint64
+	props   string // Apenas no estado de Mailbox
+}
+
+// parseState decodifica as posições das caixas de um estado de Mailbox ou,
+// com email verdadeiro, de Email. Estados em outro formato não são aceitos.
+func parseState(state string, email bool) (map[int64]statePosition, bool) {
+	positions := make(map[int64]statePosition)
+	if state == "" {
+		return positions, true
+	}
+	for _, entry := range strings.Split(state, "_") {
+		fields := strings.Split(entry, ".")
+		if len(fields) != 3 {
+			return nil, false
+		}
+		id, err := strconv.ParseInt(fields[0], 36, 64)
+		if err != nil {
+			return nil, false
+		}
+
+		var pos statePosition
+		modseq := fields[1]
+		if email {
+			uidNext, err := strconv.ParseUint(fields[1], 36, 32)
+			if err != nil {
+				return nil, false
+			}
+			pos.uidNext = uint32(uidNext)
+			modseq = fields[2]
+		} else {
+			pos.props = fields[2]
+		}
+		if pos.modSeq, err = strconv.ParseUint(modseq, 36, 64); err != nil {
+			return nil, false
+		}
+		positions[id] = pos
+	}
+	return positions, true
+}
+
+// changesArgs são os argumentos dos métodos /changes
+type changesArgs struct {
+	AccountID  string `json:"accountId"`
+	SinceState string `json:"sinceState"`
+	MaxChanges *int   `json:"maxChanges"`
+}
+
+// decodeChangesArgs lê e valida os argumentos de um /changes
+func (c *jmapContext) decodeChangesArgs(raw json.RawMessage) (*changesArgs, error) {
+	var args changesArgs
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, newJMAPError("invalidArguments", err.Error())
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.MaxChanges != nil && *args.MaxChanges <= 0 {
+		return nil, newJMAPError("invalidArguments", "maxChanges deve ser positivo")
+	}
+	return &args, nil
+}
+
+// changesResult monta a resposta de um /changes. As mudanças são
+// calculadas de uma vez, sem estados intermediários: além de maxChanges, o
+// cliente recebe cannotCalculateChanges e deve recarregar os objetos (RFC
+// 8620, seção 5.2).
+func (c *jmapContext) changesResult(args *changesArgs, newState string, created, updated, destroyed []string) (map[string]interface{}, error) {
+	if args.MaxChanges != nil && len(created)+len(updated)+len(destroyed) > *args.MaxChanges {
+		return nil, newJMAPError("cannotCalculateChanges", "as mudanças excedem maxChanges")
+	}
+	return map[string]interface{}{
+		"accountId":      c.accountID,
+		"oldState":       args.SinceState,
+		"newState":       newState,
+		"hasMoreChanges": false,
+		"created":        created,
+		"updated":        updated,
+		"destroyed":      destroyed,
+	}, nil
+}
+
+// changesResponse responde um /changes dos tipos sem histórico de mudanças
+// quando o estado não mudou; com outro estado, o cliente recebe
+// cannotCalculateChanges e deve recarregar os objetos
+func (c *jmapContext) changesResponse(raw json.RawMessage, current string) (interface{}, error) {
+	args, err := c.decodeChangesArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+	if args.SinceState != current {
+		return nil, newJMAPError("cannotCalculateChanges", "o histórico de mudanças não é mantido")
+	}
+	return c.changesResult(args, current, []string{}, []string{}, []string{})
+}
+
+// queryChanges implementa os métodos /queryChanges, que nunca são
+// calculáveis: as consultas não guardam histórico
+func (c *jmapContext) queryChanges(raw json.RawMessage) (interface{}, error) {
+	var args struct {
+		AccountID string `json:"accountId"`
+	}
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, newJMAPError("invalidArguments", err.Error())
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	return nil, newJMAPError("cannotCalculateChanges", "o histórico de consultas não é mantido")
+}
+
+// filterProperties mantém no objeto apenas as propriedades pedidas; o id é
+// sempre incluído
+func filterProperties(object map[string]interface{}, properties []string) map[string]interface{} {
+	if properties == nil {
+		return object
+	}
+	filtered := map[string]interface{}{"id": object["id"]}
+	for _, prop := range properties {
+		if value, ok := object[prop]; ok {
+			filtered[prop] = value
+		}
+	}
+	return filtered
+}
+
+// checkProperties valida a lista de propriedades de um /get
+func checkProperties(properties []string, known []string) error {
+	for _, prop := range properties {
+		found := false
+		for _, k := range known {
+			if prop == k {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return newJMAPError("invalidArguments", "propriedade desconhecida: "+prop)
+		}
+	}
+	return nil
+}
+
+// Métodos de implementação para blobs
+
+// jmapBlob é um blob enviado pelo cliente e ainda não usado em uma mensagem
+type jmapBlob struct {
+	userID   int64
+	mimeType string
+	data     []byte
+	created  time.Time
+}
+
+// jmapBlobStore guarda em memória os blobs enviados, descartados após
+// jmapBlobTTL
+type jmapBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string]*jmapBlob
+	next  int64
+}
+
+func newJMAPBlobStore() *jmapBlobStore {
+	return &jmapBlobStore{blobs: map[string]*jmapBlob{}}
+}
+
+// put guarda o blob e retorna seu identificador
+func (b *jmapBlobStore) put(blob *jmapBlob) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, old := range b.blobs {
+		if time.Since(old.created) > jmapBlobTTL {
+			delete(b.blobs, id)
+		}
+	}
+
+	b.next++
+	id := string(jmapUploadPrefix) + strconv.FormatInt(time.Now().UnixNano(), 36) + strconv.FormatInt(b.next, 36)
+	b.blobs[id] = blob
+	return id
+}
+
+// get retorna um blob do usuário
+func (b *jmapBlobStore) get(userID int64, id string) (*jmapBlob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	blob, ok := b.blobs[id]
+	if !ok || blob.userID != userID {
+		return nil, false
+	}
+	return blob, true
+}
+
+// blob retorna o conteúdo e o tipo de um blob: um blob enviado, uma mensagem
+// ("B<id>") ou uma parte de mensagem ("B<id>.<parte>")
+func (c *jmapContext) blob(blobID string) ([]byte, string, error) {
+	if blob, ok := c.server.blobs.get(c.user.ID, blobID); ok {
+		return blob.data, blob.mimeType, nil
+	}
+
+	id, partID, _ := strings.Cut(blobID, ".")
+	messageID, ok := parseJMAPID(jmapBlobPrefix, id)
+	if !ok {
+		return nil, "", storage.ErrMessageNotFound
+	}
+	msg, err := c.message(messageID)
+	if err != nil {
+		return nil, "", err
+	}
+	if partID == "" {
+		return msg.RawData, "message/rfc822", nil
+	}
+
+	part := c.parse(msg).findPart(partID)
+	if part == nil || part.isMultipart() {
+		return nil, "", storage.ErrMessageNotFound
+	}
+	return part.decoded(), part.mediaType, nil
+}
+
+// handleUpload recebe um blob (RFC 8620, seção 6.1)
+func (s *JMAPServer) handleUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	accountID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/jmap/upload/"), "/")
+	if accountID != jmapID(jmapAccountPrefix, user.ID) {
+		http.Error(w, "conta não encontrada", http.StatusNotFound)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, int64(s.maxUpload)+1))
+	if err != nil {
+		http.Error(w, "falha ao ler o blob", http.StatusBadRequest)
+		return
+	}
+	if len(data) > s.maxUpload {
+		writeProblem(w, http.StatusRequestEntityTooLarge, "limit", "maxSizeUpload excedido")
+		return
+	}
+
+	mimeType := r.Header.Get("Content-Type")
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	blobID := s.blobs.put(&jmapBlob{userID: user.ID, mimeType: mimeType, data: data, created: time.Now()})
+
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"accountId": accountID,
+		"blobId":    blobID,
+		"type":      mimeType,
+		"size":      len(data),
+	})
+}
+
+// handleDownload envia um blob (RFC 8620, seção 6.2). O caminho tem a forma
+// /jmap/download/{accountId}/{blobId}/{name}.
+func (s *JMAPServer) handleDownload(w http.ResponseWriter, r *http.Request) {
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+
+	segments := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/jmap/download/"), "/", 3)
+	if len(segments) != 3 || segments[0] != jmapID(jmapAccountPrefix, user.ID) {
+		http.Error(w, "blob não encontrado", http.StatusNotFound)
+		return
+	}
+
+	c := s.newContext(user)
+	data, mimeType, err := c.blob(segments[1])
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		http.Error(w, "blob não encontrado", http.StatusNotFound)
+		return
+	} else if err != nil {
+		log.Printf("Erro ao obter blob %s de %s: %v", segments[1], user.Email, err)
+		http.Error(w, "falha ao obter o blob", http.StatusInternalServerError)
+		return
+	}
+
+	if accept := r.URL.Query().Get("accept"); accept != "" {
+		mimeType = accept
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": segments[2]}))
+	w.Header().Set("Cache-Control", "private, immutable, max-age=31536000")
+	w.Write(data)
+}
+
+// Métodos de implementação para push
+
+// handleEventSource envia mudanças de estado por Server-Sent Events (RFC
+// 8620, seção 7.3). O estado é verificado a cada jmapPushInterval.
+func (s *JMAPServer) handleEventSource(w http.ResponseWriter, r *http.Request) {
+	user := s.authenticate(w, r)
+	if user == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming não suportado", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	types := map[string]bool{}
+	for _, t := range strings.Split(query.Get("types"), ",") {
+		types[strings.TrimSpace(t)] = true
+	}
+	all := len(types) == 0 || types["*"] || types[""]
+	closeAfterState := query.Get("closeafter") == "state"
+
+	var ping time.Duration
+	if seconds, err := strconv.Atoi(query.Get("ping")); err == nil && seconds > 0 {
+		ping = time.Duration(seconds) * time.Second
+		if ping < jmapPushInterval {
+			ping = jmapPushInterval
+		}
+	}
+
+	last, err := s.states(user)
+	if err != nil {
+		log.Printf("Erro ao obter estado JMAP de %s: %v", user.Email, err)
+		http.Error(w, "falha ao obter o estado", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	accountID := jmapID(jmapAccountPrefix, user.ID)
+	ticker := time.NewTicker(jmapPushInterval)
+	defer ticker.Stop()
+	lastPing := time.Now()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := s.states(user)
+		if err != nil {
+			log.Printf("Erro ao obter estado JMAP de %s: %v", user.Email, err)
+			return
+		}
+
+		changed := map[string]string{}
+		if current.mailbox != last.mailbox && (all || types["Mailbox"]) {
+			changed["Mailbox"] = current.mailbox
+		}
+		if current.email != last.email {
+			for _, t := range []string{"Email", "Thread"} {
+				if all || types[t] {
+					changed[t] = current.email
+				}
+			}
+		}
+		if current.submission != last.submission && (all || types["EmailSubmission"]) {
+			changed["EmailSubmission"] = current.submission
+		}
+		last = current
+
+		if len(changed) > 0 {
+			event, _ := json.Marshal(map[string]interface{}{
+				"@type":   "StateChange",
+				"changed": map[string]interface{}{accountID: changed},
+			})
+			fmt.Fprintf(w, "event: state\ndata: %s\n\n", event)
+			flusher.Flush()
+			if closeAfterState {
+				return
+			}
+			lastPing = time.Now()
+		} else if ping > 0 && time.Since(lastPing) >= ping {
+			fmt.Fprintf(w, "event: ping\ndata: {\"interval\":%d}\n\n", int(ping/time.Second))
+			flusher.Flush()
+			lastPing = time.Now()
+		}
+	}
+}
+
+// StartJMAPServer inicia o servidor JMAP, quando habilitado
+func StartJMAPServer(cfg *config.Config, store storage.Storage, delivery *Delivery) error {
+	if !cfg.JMAP.Enabled {
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", cfg.JMAP.Address, cfg.JMAP.Port),
+		Handler:           NewJMAPServer(cfg, store, delivery).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("Iniciando servidor JMAP em %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		return fmt.Errorf("falha ao iniciar servidor JMAP: %w", err)
+	}
+	return nil
+}
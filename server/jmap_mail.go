@@ -0,0 +1,2426 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+)
+
+// Propriedades dos objetos JMAP de email (RFC 8621)
+var (
+	jmapMailboxProperties = []string{"id", "name", "parentId", "role", "sortOrder", "totalEmails",
+		"unreadEmails", "totalThreads", "unreadThreads", "myRights", "isSubscribed"}
+
+	jmapEmailProperties = []string{"id", "blobId", "threadId", "mailboxIds", "keywords", "size",
+		"receivedAt", "messageId", "inReplyTo", "references", "sender", "from", "to", "cc", "bcc",
+		"replyTo", "subject", "sentAt", "hasAttachment", "preview", "bodyValues", "textBody",
+		"htmlBody", "attachments"}
+
+	// Propriedades além das padrão que podem ser pedidas em Email/get
+	jmapEmailExtraProperties = []string{"headers", "bodyStructure"}
+
+	jmapBodyProperties = []string{"partId", "blobId", "size", "name", "type", "charset",
+		"disposition", "cid", "language", "location"}
+
+	jmapEmailSortOptions = []string{"receivedAt", "sentAt", "size", "from", "to", "subject", "hasKeyword"}
+)
+
+// jmapPreviewSize é o tamanho máximo, em caracteres, da prévia de um email
+const jmapPreviewSize = 256
+
+// jmapFlagKeywords associa as flags IMAP do sistema às palavras-chave JMAP
+// (RFC 8621, seção 4.1.1)
+var jmapFlagKeywords = map[string]string{
+	imap.SeenFlag:     "$seen",
+	imap.DraftFlag:    "$draft",
+	imap.FlaggedFlag:  "$flagged",
+	imap.AnsweredFlag: "$answered",
+}
+
+// getArgs são os argumentos comuns dos métodos /get
+type getArgs struct {
+	AccountID  string    `json:"accountId"`
+	IDs        *[]string `json:"ids"`
+	Properties []string  `json:"properties"`
+}
+
+// setArgs são os argumentos comuns dos métodos /set. Os objetos são mantidos
+// em JSON para que cada propriedade seja lida com o tipo esperado.
+type setArgs struct {
+	AccountID string                                `json:"accountId"`
+	IfInState *string                               `json:"ifInState"`
+	Create    map[string]map[string]json.RawMessage `json:"create"`
+	Update    map[string]map[string]json.RawMessage `json:"update"`
+	Destroy   []string                              `json:"destroy"`
+}
+
+// setResult acumula a resposta de um /set; mapas vazios são enviados como
+// null (RFC 8620, seção 5.3)
+type setResult struct {
+	AccountID    string                 `json:"accountId"`
+	OldState     string                 `json:"oldState"`
+	NewState     string                 `json:"newState"`
+	Created      map[string]interface{} `json:"created"`
+	Updated      map[string]interface{} `json:"updated"`
+	Destroyed    []string               `json:"destroyed"`
+	NotCreated   map[string]*jmapError  `json:"notCreated"`
+	NotUpdated   map[string]*jmapError  `json:"notUpdated"`
+	NotDestroyed map[string]*jmapError  `json:"notDestroyed"`
+}
+
+func (r *setResult) created(id string, object interface{}) {
+	if r.Created == nil {
+		r.Created = map[string]interface{}{}
+	}
+	r.Created[id] = object
+}
+
+func (r *setResult) updated(id string) {
+	if r.Updated == nil {
+		r.Updated = map[string]interface{}{}
+	}
+	r.Updated[id] = nil
+}
+
+func (r *setResult) notCreated(id string, err *jmapError) {
+	if r.NotCreated == nil {
+		r.NotCreated = map[string]*jmapError{}
+	}
+	r.NotCreated[id] = err
+}
+
+func (r *setResult) notUpdated(id string, err *jmapError) {
+	if r.NotUpdated == nil {
+		r.NotUpdated = map[string]*jmapError{}
+	}
+	r.NotUpdated[id] = err
+}
+
+func (r *setResult) notDestroyed(id string, err *jmapError) {
+	if r.NotDestroyed == nil {
+		r.NotDestroyed = map[string]*jmapError{}
+	}
+	r.NotDestroyed[id] = err
+}
+
+// decodeArgs lê os argumentos de um método, respondendo invalidArguments
+// quando eles não têm os tipos esperados
+func decodeArgs(raw json.RawMessage, args interface{}) error {
+	if err := json.Unmarshal(raw, args); err != nil {
+		return newJMAPError("invalidArguments", err.Error())
+	}
+	return nil
+}
+
+// setError converte o erro de uma operação de /set: erros JMAP são
+// reportados no objeto e os demais interrompem o método
+func setError(err error) (*jmapError, error) {
+	var jerr *jmapError
+	if errors.As(err, &jerr) {
+		return jerr, nil
+	}
+	return nil, err
+}
+
+// Métodos de implementação para o acesso aos dados da conta
+
+// mailboxes retorna as caixas do usuário, guardadas durante a requisição
+func (c *jmapContext) mailboxes() ([]*storage.Mailbox, error) {
+	if c.mailboxList == nil {
+		list, err := c.server.store.ListMailboxes(c.user.ID)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao listar caixas de correio: %w", err)
+		}
+		c.mailboxList = list
+	}
+	return c.mailboxList, nil
+}
+
+// mailbox obtém uma caixa do usuário pelo ID JMAP, aceitando referências a
+// caixas criadas na mesma requisição
+func (c *jmapContext) mailbox(id string) (*storage.Mailbox, error) {
+	mailboxID, ok := parseJMAPID(jmapMailboxPrefix, c.resolveID(id))
+	if !ok {
+		return nil, storage.ErrMailboxNotFound
+	}
+	mailboxes, err := c.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	for _, mb := range mailboxes {
+		if mb.ID == mailboxID {
+			return mb, nil
+		}
+	}
+	return nil, storage.ErrMailboxNotFound
+}
+
+// allMessages retorna todas as mensagens do usuário
+func (c *jmapContext) allMessages() ([]*storage.Message, error) {
+	if c.messages != nil {
+		return c.messages, nil
+	}
+	mailboxes, err := c.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+
+	all := []*storage.Message{}
+	for _, mb := range mailboxes {
+		messages, err := c.server.store.ListMessages(mb.ID)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+		}
+		all = append(all, messages...)
+	}
+	c.messages = all
+	return all, nil
+}
+
+// message obtém uma mensagem do usuário pelo ID interno
+func (c *jmapContext) message(id int64) (*storage.Message, error) {
+	msg, err := c.server.store.GetMessageByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.mailbox(jmapID(jmapMailboxPrefix, msg.MailboxID)); errors.Is(err, storage.ErrMailboxNotFound) {
+		return nil, storage.ErrMessageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// email obtém uma mensagem do usuário pelo ID JMAP
+func (c *jmapContext) email(id string) (*storage.Message, error) {
+	messageID, ok := parseJMAPID(jmapEmailPrefix, c.resolveID(id))
+	if !ok {
+		return nil, storage.ErrMessageNotFound
+	}
+	return c.message(messageID)
+}
+
+// parse retorna a estrutura MIME da mensagem, guardada durante a requisição
+func (c *jmapContext) parse(msg *storage.Message) *mimePart {
+	part, ok := c.parsed[msg.ID]
+	if !ok {
+		part = parseMIME(msg.RawData)
+		c.parsed[msg.ID] = part
+	}
+	return part
+}
+
+// invalidate descarta os dados guardados após uma alteração
+func (c *jmapContext) invalidate() {
+	c.mailboxList = nil
+	c.messages = nil
+}
+
+// states retorna os estados atuais da conta
+func (c *jmapContext) states() (*jmapStates, error) {
+	return c.server.states(c.user)
+}
+
+// checkState verifica ifInState antes de um /set
+func checkState(ifInState *string, current string) error {
+	if ifInState != nil && *ifInState != current {
+		return newJMAPError("stateMismatch", "o estado da conta mudou")
+	}
+	return nil
+}
+
+// Métodos de implementação para Mailbox
+
+// mailboxRole retorna o papel JMAP da caixa, derivado do atributo de uso
+// especial (RFC 6154)
+func mailboxRole(mb *storage.Mailbox) interface{} {
+	if strings.EqualFold(mb.Name, "INBOX") {
+		return "inbox"
+	}
+	if mb.SpecialUse != "" {
+		return strings.ToLower(strings.TrimPrefix(mb.SpecialUse, "\\"))
+	}
+	return nil
+}
+
+// roleSpecialUse converte um papel JMAP no atributo de uso especial
+func roleSpecialUse(role string) (string, bool) {
+	if role == "" {
+		return "", false
+	}
+	attr := "\\" + strings.ToUpper(role[:1]) + strings.ToLower(role[1:])
+	return attr, specialUseAttrs[attr]
+}
+
+// mailboxParent retorna a caixa no nível superior, ou nil
+func mailboxParent(mb *storage.Mailbox, all []*storage.Mailbox) *storage.Mailbox {
+	i := strings.LastIndex(mb.Name, storage.MailboxDelimiter)
+	if i < 0 {
+		return nil
+	}
+	for _, other := range all {
+		if other.Name == mb.Name[:i] {
+			return other
+		}
+	}
+	return nil
+}
+
+// mailboxCounts resume as mensagens de uma caixa para o objeto Mailbox
+type mailboxCounts struct {
+	total, unread          int
+	threads, unreadThreads map[int64]bool
+}
+
+// countMailboxes calcula os contadores de todas as caixas do usuário. As
+// conversas não lidas consideram apenas as mensagens da própria caixa.
+func (c *jmapContext) countMailboxes() (map[int64]*mailboxCounts, error) {
+	messages, err := c.allMessages()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := map[int64]*mailboxCounts{}
+	for _, msg := range messages {
+		count, ok := counts[msg.MailboxID]
+		if !ok {
+			count = &mailboxCounts{threads: map[int64]bool{}, unreadThreads: map[int64]bool{}}
+			counts[msg.MailboxID] = count
+		}
+		count.total++
+		count.threads[msg.ThreadID] = true
+		if !msg.Seen {
+			count.unread++
+			count.unreadThreads[msg.ThreadID] = true
+		}
+	}
+	return counts, nil
+}
+
+// mailboxObject monta o objeto Mailbox (RFC 8621, seção 2)
+func mailboxObject(mb *storage.Mailbox, all []*storage.Mailbox, count *mailboxCounts, subscribed map[string]bool) map[string]interface{} {
+	var parentID interface{}
+	if parent := mailboxParent(mb, all); parent != nil {
+		parentID = jmapID(jmapMailboxPrefix, parent.ID)
+	}
+	if count == nil {
+		count = &mailboxCounts{}
+	}
+
+	name := mb.Name
+	if i := strings.LastIndex(name, storage.MailboxDelimiter); i >= 0 {
+		name = name[i+1:]
+	}
+	inbox := strings.EqualFold(mb.Name, "INBOX")
+
+	return map[string]interface{}{
+		"id":            jmapID(jmapMailboxPrefix, mb.ID),
+		"name":          name,
+		"parentId":      parentID,
+		"role":          mailboxRole(mb),
+		"sortOrder":     0,
+		"totalEmails":   count.total,
+		"unreadEmails":  count.unread,
+		"totalThreads":  len(count.threads),
+		"unreadThreads": len(count.unreadThreads),
+		"myRights": map[string]bool{
+			"mayReadItems":   !mb.NoSelect,
+			"mayAddItems":    !mb.NoSelect,
+			"mayRemoveItems": !mb.NoSelect,
+			"maySetSeen":     !mb.NoSelect,
+			"maySetKeywords": !mb.NoSelect,
+			"mayCreateChild": true,
+			"mayRename":      !inbox,
+			"mayDelete":      !inbox,
+			"maySubmit":      true,
+		},
+		"isSubscribed": subscribed[mb.Name],
+	}
+}
+
+// subscriptions retorna os nomes das caixas assinadas
+func (c *jmapContext) subscriptions() (map[string]bool, error) {
+	names, err := c.server.store.ListSubscriptions(c.user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar assinaturas: %w", err)
+	}
+	subscribed := make(map[string]bool, len(names))
+	for _, name := range names {
+		subscribed[name] = true
+	}
+	return subscribed, nil
+}
+
+// mailboxObjects monta os objetos de todas as caixas do usuário
+func (c *jmapContext) mailboxObjects() ([]map[string]interface{}, error) {
+	mailboxes, err := c.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	counts, err := c.countMailboxes()
+	if err != nil {
+		return nil, err
+	}
+	subscribed, err := c.subscriptions()
+	if err != nil {
+		return nil, err
+	}
+
+	objects := make([]map[string]interface{}, len(mailboxes))
+	for i, mb := range mailboxes {
+		objects[i] = mailboxObject(mb, mailboxes, counts[mb.ID], subscribed)
+	}
+	return objects, nil
+}
+
+func (c *jmapContext) mailboxGet(raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(args.Properties, jmapMailboxProperties); err != nil {
+		return nil, err
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := c.mailboxObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	if args.IDs == nil {
+		for _, object := range objects {
+			list = append(list, filterProperties(object, args.Properties))
+		}
+	} else {
+		if len(*args.IDs) > jmapMaxObjectsInGet {
+			return nil, newJMAPError("requestTooLarge", "maxObjectsInGet excedido")
+		}
+		for _, id := range *args.IDs {
+			found := false
+			for _, object := range objects {
+				if object["id"] == c.resolveID(id) {
+					list = append(list, filterProperties(object, args.Properties))
+					found = true
+					break
+				}
+			}
+			if !found {
+				notFound = append(notFound, id)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"accountId": c.accountID,
+		"state":     states.mailbox,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// mailboxChanges implementa Mailbox/changes comparando as posições das
+// caixas: caixas novas são criadas, ausentes são removidas e as demais são
+// atualizadas quando mudam suas propriedades ou mensagens
+func (c *jmapContext) mailboxChanges(raw json.RawMessage) (interface{}, error) {
+	args, err := c.decodeChangesArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	old, ok := parseState(args.SinceState, false)
+	if !ok {
+		return nil, newJMAPError("cannotCalculateChanges", "estado desconhecido")
+	}
+	current, _ := parseState(states.mailbox, false)
+
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, id := range sortedStateIDs(current) {
+		pos, known := old[id]
+		switch {
+		case !known:
+			created = append(created, jmapID(jmapMailboxPrefix, id))
+		case pos != current[id]:
+			updated = append(updated, jmapID(jmapMailboxPrefix, id))
+		}
+	}
+	for _, id := range sortedStateIDs(old) {
+		if _, ok := current[id]; !ok {
+			destroyed = append(destroyed, jmapID(jmapMailboxPrefix, id))
+		}
+	}
+
+	result, err := c.changesResult(args, states.mailbox, created, updated, destroyed)
+	if err != nil {
+		return nil, err
+	}
+	result["updatedProperties"] = nil
+	return result, nil
+}
+
+// sortedStateIDs retorna os IDs das caixas de um estado em ordem
+func sortedStateIDs(positions map[int64]statePosition) []int64 {
+	ids := make([]int64, 0, len(positions))
+	for id := range positions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// mailboxQueryArgs são os argumentos de Mailbox/query. O filtro aceita
+// apenas condições simples, sem operadores.
+type mailboxQueryArgs struct {
+	AccountID      string                     `json:"accountId"`
+	Filter         map[string]json.RawMessage `json:"filter"`
+	Sort           []jmapComparator           `json:"sort"`
+	Position       int                        `json:"position"`
+	Limit          *int                       `json:"limit"`
+	CalculateTotal bool                       `json:"calculateTotal"`
+}
+
+// jmapComparator é um critério de ordenação de /query
+type jmapComparator struct {
+	Property    string `json:"property"`
+	IsAscending *bool  `json:"isAscending"`
+	Keyword     string `json:"keyword"`
+}
+
+// ascending informa a direção da ordenação; o padrão é crescente
+func (cmp *jmapComparator) ascending() bool {
+	return cmp.IsAscending == nil || *cmp.IsAscending
+}
+
+func (c *jmapContext) mailboxQuery(raw json.RawMessage) (interface{}, error) {
+	var args mailboxQueryArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := c.mailboxObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []map[string]interface{}
+	for _, object := range objects {
+		ok, err := matchMailbox(object, args.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, object)
+		}
+	}
+
+	for _, cmp := range args.Sort {
+		if cmp.Property != "name" && cmp.Property != "sortOrder" {
+			return nil, newJMAPError("unsupportedSort", cmp.Property)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, cmp := range args.Sort {
+			if cmp.Property != "name" {
+				continue
+			}
+			a, b := matched[i]["name"].(string), matched[j]["name"].(string)
+			if !strings.EqualFold(a, b) {
+				return (strings.ToLower(a) < strings.ToLower(b)) == cmp.ascending()
+			}
+		}
+		return false
+	})
+
+	ids := make([]string, len(matched))
+	for i, object := range matched {
+		ids[i] = object["id"].(string)
+	}
+	return queryResult(c.accountID, states.mailbox, ids, args.Position, nil, 0, args.Limit, args.CalculateTotal)
+}
+
+// matchMailbox aplica uma condição de Mailbox/query ao objeto da caixa
+func matchMailbox(object map[string]interface{}, filter map[string]json.RawMessage) (bool, error) {
+	for key, raw := range filter {
+		switch key {
+		case "parentId", "role":
+			var value *string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return false, newJMAPError("invalidArguments", err.Error())
+			}
+			current, _ := object[key].(string)
+			if (value == nil) != (object[key] == nil) || (value != nil && *value != current) {
+				return false, nil
+			}
+		case "name":
+			var value string
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return false, newJMAPError("invalidArguments", err.Error())
+			}
+			if !strings.Contains(strings.ToLower(object["name"].(string)), strings.ToLower(value)) {
+				return false, nil
+			}
+		case "hasAnyRole", "isSubscribed":
+			var value bool
+			if err := json.Unmarshal(raw, &value); err != nil {
+				return false, newJMAPError("invalidArguments", err.Error())
+			}
+			current := object["isSubscribed"] == true
+			if key == "hasAnyRole" {
+				current = object["role"] != nil
+			}
+			if current != value {
+				return false, nil
+			}
+		default:
+			return false, newJMAPError("unsupportedFilter", key)
+		}
+	}
+	return true, nil
+}
+
+// queryResult pagina os IDs de um /query (RFC 8620, seção 5.5). Com âncora,
+// a posição é relativa a ela.
+func queryResult(accountID, state string, ids []string, position int, anchor *string, anchorOffset int, limit *int, calculateTotal bool) (interface{}, error) {
+	total := len(ids)
+	if anchor != nil {
+		position = -1
+		for i, id := range ids {
+			if id == *anchor {
+				position = i + anchorOffset
+				break
+			}
+		}
+		if position == -1 && anchorOffset >= 0 {
+			return nil, newJMAPError("anchorNotFound", *anchor)
+		}
+	} else if position < 0 {
+		position += total
+	}
+	if position < 0 {
+		position = 0
+	}
+	if position > total {
+		position = total
+	}
+
+	end := total
+	if limit != nil {
+		if *limit < 0 {
+			return nil, newJMAPError("invalidArguments", "limit não pode ser negativo")
+		}
+		if position+*limit < end {
+			end = position + *limit
+		}
+	}
+
+	result := map[string]interface{}{
+		"accountId":           accountID,
+		"queryState":          state,
+		"canCalculateChanges": false,
+		"position":            position,
+		"ids":                 append([]string{}, ids[position:end]...),
+	}
+	if calculateTotal {
+		result["total"] = total
+	}
+	return result, nil
+}
+
+// mailboxSetArgs acrescenta a Mailbox/set a remoção das mensagens das
+// caixas removidas
+type mailboxSetArgs struct {
+	setArgs
+	OnDestroyRemoveEmails bool `json:"onDestroyRemoveEmails"`
+}
+
+func (c *jmapContext) mailboxSet(raw json.RawMessage) (interface{}, error) {
+	var args mailboxSetArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjectsInSet {
+		return nil, newJMAPError("requestTooLarge", "maxObjectsInSet excedido")
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkState(args.IfInState, states.mailbox); err != nil {
+		return nil, err
+	}
+
+	result := &setResult{AccountID: c.accountID, OldState: states.mailbox}
+	for _, creationID := range mailboxCreationOrder(args.Create) {
+		props := args.Create[creationID]
+		id, err := c.createMailbox(props)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notCreated(creationID, jerr)
+			continue
+		}
+		c.createdIDs[creationID] = id
+		result.created(creationID, map[string]interface{}{"id": id})
+	}
+
+	for id, patch := range args.Update {
+		err := c.updateMailbox(id, patch)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notUpdated(id, jerr)
+			continue
+		}
+		result.updated(id)
+	}
+
+	for _, id := range args.Destroy {
+		err := c.destroyMailbox(id, args.OnDestroyRemoveEmails)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notDestroyed(id, jerr)
+			continue
+		}
+		result.Destroyed = append(result.Destroyed, id)
+	}
+
+	if states, err = c.states(); err != nil {
+		return nil, err
+	}
+	result.NewState = states.mailbox
+	return result, nil
+}
+
+// mailboxCreationOrder ordena as criações para que as caixas referenciadas
+// como "#creationId" em parentId sejam criadas antes de suas subcaixas
+func mailboxCreationOrder(create map[string]map[string]json.RawMessage) []string {
+	pending := make([]string, 0, len(create))
+	for creationID := range create {
+		pending = append(pending, creationID)
+	}
+	sort.Strings(pending)
+
+	var order []string
+	done := map[string]bool{}
+	for len(pending) > 0 {
+		var next []string
+		for _, creationID := range pending {
+			var parentID string
+			json.Unmarshal(create[creationID]["parentId"], &parentID)
+			ref := strings.TrimPrefix(parentID, "#")
+			if _, ok := create[ref]; ok && ref != parentID && !done[ref] {
+				next = append(next, creationID)
+				continue
+			}
+			order = append(order, creationID)
+			done[creationID] = true
+		}
+		// Referências circulares são criadas na ordem e falham em parentId
+		if len(next) == len(pending) {
+			return append(order, next...)
+		}
+		pending = next
+	}
+	return order
+}
+
+// mailboxFields são as propriedades graváveis de Mailbox
+type mailboxFields struct {
+	name         *string
+	parentID     *string // Ponteiro para "" indica o nível superior
+	role         *string // Ponteiro para "" remove o papel
+	isSubscribed *bool
+}
+
+// parseMailboxFields lê as propriedades de uma criação ou atualização
+func parseMailboxFields(props map[string]json.RawMessage) (*mailboxFields, error) {
+	fields := &mailboxFields{}
+	for key, raw := range props {
+		var err error
+		switch key {
+		case "name":
+			err = json.Unmarshal(raw, &fields.name)
+			if err == nil && (fields.name == nil || *fields.name == "" || len(*fields.name) > 255 ||
+				strings.Contains(*fields.name, storage.MailboxDelimiter)) {
+				err = errors.New("nome inválido")
+			}
+		case "parentId", "role":
+			var value *string
+			if err = json.Unmarshal(raw, &value); err == nil {
+				if value == nil {
+					value = new(string)
+				}
+				if key == "parentId" {
+					fields.parentID = value
+				} else {
+					fields.role = value
+				}
+			}
+		case "isSubscribed":
+			err = json.Unmarshal(raw, &fields.isSubscribed)
+		case "sortOrder":
+			// A ordem é definida pelo cliente e não é armazenada
+		default:
+			return nil, errInvalidProperties("propriedade não pode ser alterada", key)
+		}
+		if err != nil {
+			return nil, errInvalidProperties(err.Error(), key)
+		}
+	}
+	return fields, nil
+}
+
+// mailboxName monta o nome completo de uma caixa a partir do pai
+func (c *jmapContext) mailboxName(parentID, name string) (string, error) {
+	if parentID == "" {
+		return name, nil
+	}
+	parent, err := c.mailbox(parentID)
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return "", errInvalidProperties("caixa superior não encontrada", "parentId")
+	} else if err != nil {
+		return "", err
+	}
+	return parent.Name + storage.MailboxDelimiter + name, nil
+}
+
+func (c *jmapContext) createMailbox(props map[string]json.RawMessage) (string, error) {
+	fields, err := parseMailboxFields(props)
+	if err != nil {
+		return "", err
+	}
+	if fields.name == nil {
+		return "", errInvalidProperties("o nome é obrigatório", "name")
+	}
+
+	var specialUse string
+	if fields.role != nil && *fields.role != "" {
+		var ok bool
+		if specialUse, ok = roleSpecialUse(*fields.role); !ok {
+			return "", errInvalidProperties("papel não suportado", "role")
+		}
+	}
+
+	parentID := ""
+	if fields.parentID != nil {
+		parentID = *fields.parentID
+	}
+	name, err := c.mailboxName(parentID, *fields.name)
+	if err != nil {
+		return "", err
+	}
+
+	mailbox, err := createMailbox(c.server.store, c.user.ID, name, specialUse)
+	if errors.Is(err, errMailboxExists) {
+		return "", errInvalidProperties("já existe uma caixa com este nome", "name")
+	} else if err != nil {
+		return "", err
+	}
+	c.invalidate()
+
+	if fields.isSubscribed != nil && *fields.isSubscribed {
+		if err := c.server.store.SubscribeMailbox(c.user.ID, name); err != nil {
+			return "", fmt.Errorf("falha ao assinar caixa: %w", err)
+		}
+	}
+	return jmapID(jmapMailboxPrefix, mailbox.ID), nil
+}
+
+func (c *jmapContext) updateMailbox(id string, props map[string]json.RawMessage) error {
+	mailbox, err := c.mailbox(id)
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return newJMAPError("notFound", id)
+	} else if err != nil {
+		return err
+	}
+	fields, err := parseMailboxFields(props)
+	if err != nil {
+		return err
+	}
+
+	name := mailbox.Name
+	if fields.name != nil || fields.parentID != nil {
+		all, err := c.mailboxes()
+		if err != nil {
+			return err
+		}
+
+		local := name[strings.LastIndex(name, storage.MailboxDelimiter)+1:]
+		if fields.name != nil {
+			local = *fields.name
+		}
+		parentID := ""
+		if parent := mailboxParent(mailbox, all); parent != nil {
+			parentID = jmapID(jmapMailboxPrefix, parent.ID)
+		}
+		if fields.parentID != nil {
+			parentID = *fields.parentID
+		}
+		if name, err = c.mailboxName(parentID, local); err != nil {
+			return err
+		}
+	}
+
+	if name != mailbox.Name {
+		if strings.EqualFold(mailbox.Name, "INBOX") {
+			return newJMAPError("forbidden", "a INBOX não pode ser renomeada")
+		}
+		if isChildMailbox(mailbox.Name, name) {
+			return errInvalidProperties("a caixa não pode ficar abaixo de si mesma", "parentId")
+		}
+		if _, err := c.server.store.GetMailbox(c.user.ID, name); err == nil {
+			return errInvalidProperties("já existe uma caixa com este nome", "name")
+		}
+		if err := c.server.store.RenameMailbox(c.user.ID, mailbox.Name, name); err != nil {
+			return fmt.Errorf("falha ao renomear caixa: %w", err)
+		}
+		c.invalidate()
+	}
+
+	if fields.role != nil {
+		specialUse, ok := roleSpecialUse(*fields.role)
+		if *fields.role != "" && !ok {
+			return errInvalidProperties("papel não suportado", "role")
+		}
+		updated, err := c.server.store.GetMailbox(c.user.ID, name)
+		if err != nil {
+			return err
+		}
+		updated.SpecialUse = specialUse
+		if err := c.server.store.UpdateMailbox(updated); err != nil {
+			return err
+		}
+		c.invalidate()
+	}
+
+	if fields.isSubscribed != nil {
+		if *fields.isSubscribed {
+			err = c.server.store.SubscribeMailbox(c.user.ID, name)
+		} else {
+			err = c.server.store.UnsubscribeMailbox(c.user.ID, name)
+		}
+		if err != nil {
+			return fmt.Errorf("falha ao alterar assinatura: %w", err)
+		}
+	}
+	return nil
+}
+
+// destroyMailbox remove uma caixa sem subcaixas. Caixas com mensagens só são
+// removidas com onDestroyRemoveEmails (RFC 8621, seção 2.5).
+func (c *jmapContext) destroyMailbox(id string, removeEmails bool) error {
+	mailbox, err := c.mailbox(id)
+	if errors.Is(err, storage.ErrMailboxNotFound) {
+		return newJMAPError("notFound", id)
+	} else if err != nil {
+		return err
+	}
+	if strings.EqualFold(mailbox.Name, "INBOX") {
+		return newJMAPError("forbidden", "a INBOX não pode ser removida")
+	}
+
+	all, err := c.mailboxes()
+	if err != nil {
+		return err
+	}
+	for _, other := range all {
+		if isChildMailbox(mailbox.Name, other.Name) {
+			return newJMAPError("mailboxHasChild", "a caixa possui subcaixas")
+		}
+	}
+
+	messages, err := c.server.store.ListMessages(mailbox.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+	if len(messages) > 0 && !removeEmails {
+		return newJMAPError("mailboxHasEmail", "a caixa possui mensagens")
+	}
+	for _, msg := range messages {
+		if err := c.server.store.DeleteMessage(msg.ID); err != nil {
+			return fmt.Errorf("falha ao excluir mensagem: %w", err)
+		}
+	}
+
+	if err := c.server.store.DeleteMailbox(mailbox.ID); err != nil {
+		return err
+	}
+	if err := c.server.store.UnsubscribeMailbox(c.user.ID, mailbox.Name); err != nil {
+		return fmt.Errorf("falha ao remover assinatura: %w", err)
+	}
+	c.invalidate()
+	return nil
+}
+
+// Métodos de implementação para Thread
+
+func (c *jmapContext) threadGet(raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(args.Properties, []string{"id", "emailIds"}); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if args.IDs == nil {
+		threads, err := c.server.store.ListThreads(c.user.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, thread := range threads {
+			ids = append(ids, jmapID(jmapThreadPrefix, thread.ID))
+		}
+	} else {
+		ids = *args.IDs
+	}
+	if len(ids) > jmapMaxObjectsInGet {
+		return nil, newJMAPError("requestTooLarge", "maxObjectsInGet excedido")
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	for _, id := range ids {
+		threadID, ok := parseJMAPID(jmapThreadPrefix, id)
+		var messages []*storage.Message
+		if ok {
+			messages, err = c.server.store.GetThread(c.user.ID, threadID)
+		}
+		if !ok || errors.Is(err, storage.ErrThreadNotFound) {
+			notFound = append(notFound, id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		emailIDs := make([]string, len(messages))
+		for i, msg := range messages {
+			emailIDs[i] = jmapID(jmapEmailPrefix, msg.ID)
+		}
+		list = append(list, filterProperties(map[string]interface{}{"id": id, "emailIds": emailIDs}, args.Properties))
+	}
+
+	return map[string]interface{}{
+		"accountId": c.accountID,
+		"state":     states.email,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// Métodos de implementação para Email
+
+// messageKeywords retorna as palavras-chave JMAP da mensagem. \Deleted não
+// tem equivalente e é omitida.
+func messageKeywords(msg *storage.Message) map[string]bool {
+	keywords := map[string]bool{}
+	for _, flag := range messageFlags(msg) {
+		if keyword, ok := jmapFlagKeywords[imap.CanonicalFlag(flag)]; ok {
+			keywords[keyword] = true
+		} else if !strings.HasPrefix(flag, "\\") {
+			keywords[strings.ToLower(flag)] = true
+		}
+	}
+	return keywords
+}
+
+// applyKeywords substitui as flags da mensagem pelas palavras-chave,
+// mantendo \Deleted
+func applyKeywords(msg *storage.Message, keywords map[string]bool) {
+	var flags []string
+	if msg.Deleted {
+		flags = append(flags, imap.DeletedFlag)
+	}
+	for keyword := range keywords {
+		flag := keyword
+		for f, k := range jmapFlagKeywords {
+			if k == keyword {
+				flag = f
+			}
+		}
+		flags = append(flags, flag)
+	}
+	sort.Strings(flags)
+	msg.Seen, msg.Draft = false, false
+	applyFlags(msg, flags)
+}
+
+// validKeyword verifica a sintaxe de uma palavra-chave (RFC 8621, seção
+// 4.1.1)
+func validKeyword(keyword string) bool {
+	if keyword == "" || len(keyword) > 255 {
+		return false
+	}
+	for _, c := range keyword {
+		if c <= 0x20 || c >= 0x7f || strings.ContainsRune(`()]{%*"\`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// emailAddresses converte endereços para objetos EmailAddress
+func emailAddresses(addrs []*mail.Address) []map[string]interface{} {
+	list := []map[string]interface{}{}
+	for _, addr := range addrs {
+		var name interface{}
+		if addr.Name != "" {
+			name = addr.Name
+		}
+		list = append(list, map[string]interface{}{"name": name, "email": addr.Address})
+	}
+	return list
+}
+
+// headerForm converte o valor bruto de um cabeçalho na forma pedida (RFC
+// 8621, seção 4.1.2)
+func headerForm(raw, form string) interface{} {
+	value := unfoldHeader(raw)
+	switch form {
+	case "asText":
+		return decodeHeader(value)
+	case "asAddresses":
+		return emailAddresses(parseAddressList(value))
+	case "asGroupedAddresses":
+		return []map[string]interface{}{{"name": nil, "addresses": emailAddresses(parseAddressList(value))}}
+	case "asMessageIds":
+		ids := parseMessageIDs(value)
+		if len(ids) == 0 {
+			return nil
+		}
+		for i, id := range ids {
+			ids[i] = strings.Trim(id, "<>")
+		}
+		return ids
+	case "asDate":
+		date, err := mail.ParseDate(value)
+		if err != nil {
+			return nil
+		}
+		return date.Format(time.RFC3339)
+	case "asURLs":
+		ids := parseMessageIDs(value)
+		if len(ids) == 0 {
+			return nil
+		}
+		for i, id := range ids {
+			ids[i] = strings.Trim(id, "<>")
+		}
+		return ids
+	}
+	return raw
+}
+
+// parseHeaderProperty interpreta uma propriedade "header:Nome[:forma][:all]"
+func parseHeaderProperty(prop string) (name, form string, all bool, ok bool) {
+	parts := strings.Split(prop, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] != "header" || parts[1] == "" {
+		return "", "", false, false
+	}
+	name, form = parts[1], "asRaw"
+	for _, p := range parts[2:] {
+		switch {
+		case p == "all" && !all:
+			all = true
+		case strings.HasPrefix(p, "as") && form == "asRaw" && !all:
+			form = p
+		default:
+			return "", "", false, false
+		}
+	}
+	switch form {
+	case "asRaw", "asText", "asAddresses", "asGroupedAddresses", "asMessageIds", "asDate", "asURLs":
+		return name, form, all, true
+	}
+	return "", "", false, false
+}
+
+// headerValue retorna um cabeçalho na forma pedida: a última ocorrência, ou
+// todas com :all. Um cabeçalho ausente resulta em null.
+func headerValue(fields []headerField, name, form string, all bool) interface{} {
+	var values []interface{}
+	for _, f := range fields {
+		if strings.EqualFold(f.name, name) {
+			values = append(values, headerForm(f.value, form))
+		}
+	}
+	if all {
+		if values == nil {
+			return []interface{}{}
+		}
+		return values
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values[len(values)-1]
+}
+
+// headerList retorna os cabeçalhos no formato EmailHeader
+func headerList(fields []headerField) []map[string]string {
+	list := []map[string]string{}
+	for _, f := range fields {
+		list = append(list, map[string]string{"name": f.name, "value": f.value})
+	}
+	return list
+}
+
+// checkEmailProperties valida as propriedades pedidas em Email/get
+func checkEmailProperties(properties, known []string) error {
+	for _, prop := range properties {
+		if strings.HasPrefix(prop, "header:") {
+			if _, _, _, ok := parseHeaderProperty(prop); !ok {
+				return newJMAPError("invalidArguments", "propriedade inválida: "+prop)
+			}
+			continue
+		}
+		if err := checkProperties([]string{prop}, known); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bodyPartObject monta o objeto EmailBodyPart com as propriedades pedidas
+func bodyPartObject(msg *storage.Message, part *mimePart, props []string, subParts bool) map[string]interface{} {
+	object := map[string]interface{}{}
+	for _, prop := range props {
+		if name, form, all, ok := parseHeaderProperty(prop); ok {
+			object[prop] = headerValue(part.fields, name, form, all)
+			continue
+		}
+
+		var value interface{}
+		switch prop {
+		case "partId":
+			if !part.isMultipart() {
+				value = part.id
+			}
+		case "blobId":
+			if !part.isMultipart() {
+				value = jmapID(jmapBlobPrefix, msg.ID) + "." + part.id
+			}
+		case "size":
+			size := 0
+			if !part.isMultipart() {
+				size = len(part.decoded())
+			}
+			value = size
+		case "headers":
+			value = headerList(part.fields)
+		case "name":
+			if name := part.filename(); name != "" {
+				value = name
+			}
+		case "type":
+			value = part.mediaType
+		case "charset":
+			if charset := part.params["charset"]; charset != "" {
+				value = charset
+			} else if strings.HasPrefix(part.mediaType, "text/") {
+				value = "us-ascii"
+			}
+		case "disposition":
+			if disposition := part.disposition(); disposition != "" {
+				value = disposition
+			}
+		case "cid":
+			if cid := part.header.Get("Content-Id"); cid != "" {
+				value = strings.Trim(cid, "<> ")
+			}
+		case "language":
+			if language := part.header.Get("Content-Language"); language != "" {
+				var tags []string
+				for _, tag := range strings.Split(language, ",") {
+					tags = append(tags, strings.TrimSpace(tag))
+				}
+				value = tags
+			}
+		case "location":
+			if location := part.header.Get("Content-Location"); location != "" {
+				value = location
+			}
+		}
+		object[prop] = value
+	}
+
+	if subParts {
+		if part.isMultipart() {
+			list := []map[string]interface{}{}
+			for _, sub := range part.parts {
+				list = append(list, bodyPartObject(msg, sub, props, true))
+			}
+			object["subParts"] = list
+		} else {
+			object["subParts"] = nil
+		}
+	}
+	return object
+}
+
+// emailGetArgs são os argumentos de Email/get
+type emailGetArgs struct {
+	getArgs
+	BodyProperties      []string `json:"bodyProperties"`
+	FetchTextBodyValues bool     `json:"fetchTextBodyValues"`
+	FetchHTMLBodyValues bool     `json:"fetchHTMLBodyValues"`
+	FetchAllBodyValues  bool     `json:"fetchAllBodyValues"`
+	MaxBodyValueBytes   int      `json:"maxBodyValueBytes"`
+}
+
+// bodyValue monta o objeto EmailBodyValue, truncado em maxBytes sem quebrar
+// caracteres
+func bodyValue(part *mimePart, maxBytes int) map[string]interface{} {
+	text, problem := part.text()
+	truncated := false
+	if maxBytes > 0 && len(text) > maxBytes {
+		cut := maxBytes
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text, truncated = text[:cut], true
+	}
+	return map[string]interface{}{
+		"value":             text,
+		"isEncodingProblem": problem,
+		"isTruncated":       truncated,
+	}
+}
+
+// emailPreview resume o primeiro corpo de texto da mensagem
+func emailPreview(textBody []*mimePart) string {
+	for _, part := range textBody {
+		text, _ := part.text()
+		switch part.mediaType {
+		case "text/plain":
+			return preview(text, jmapPreviewSize)
+		case "text/html":
+			return preview(htmlToText(text), jmapPreviewSize)
+		}
+	}
+	return ""
+}
+
+// emailObject monta o objeto Email (RFC 8621, seção 4.1) com as propriedades
+// pedidas
+func (c *jmapContext) emailObject(msg *storage.Message, args *emailGetArgs) map[string]interface{} {
+	root := c.parse(msg)
+	textBody, htmlBody, attachments := root.bodyParts()
+
+	object := map[string]interface{}{"id": jmapID(jmapEmailPrefix, msg.ID)}
+	for _, prop := range args.Properties {
+		if name, form, all, ok := parseHeaderProperty(prop); ok {
+			object[prop] = headerValue(root.fields, name, form, all)
+			continue
+		}
+
+		switch prop {
+		case "blobId":
+			object[prop] = jmapID(jmapBlobPrefix, msg.ID)
+		case "threadId":
+			object[prop] = jmapID(jmapThreadPrefix, msg.ThreadID)
+		case "mailboxIds":
+			object[prop] = map[string]bool{jmapID(jmapMailboxPrefix, msg.MailboxID): true}
+		case "keywords":
+			object[prop] = messageKeywords(msg)
+		case "size":
+			object[prop] = msg.Size
+		case "receivedAt":
+			object[prop] = msg.Date.UTC().Format(time.RFC3339)
+		case "headers":
+			object[prop] = headerList(root.fields)
+		case "messageId":
+			object[prop] = headerValue(root.fields, "Message-ID", "asMessageIds", false)
+		case "inReplyTo":
+			object[prop] = headerValue(root.fields, "In-Reply-To", "asMessageIds", false)
+		case "references":
+			object[prop] = headerValue(root.fields, "References", "asMessageIds", false)
+		case "sender", "from", "to", "cc", "bcc":
+			object[prop] = headerValue(root.fields, prop, "asAddresses", false)
+		case "replyTo":
+			object[prop] = headerValue(root.fields, "Reply-To", "asAddresses", false)
+		case "subject":
+			object[prop] = headerValue(root.fields, "Subject", "asText", false)
+		case "sentAt":
+			object[prop] = headerValue(root.fields, "Date", "asDate", false)
+		case "hasAttachment":
+			object[prop] = len(attachments) > 0
+		case "preview":
+			object[prop] = emailPreview(textBody)
+		case "bodyStructure":
+			object[prop] = bodyPartObject(msg, root, args.BodyProperties, true)
+		case "textBody", "htmlBody", "attachments":
+			parts := map[string][]*mimePart{"textBody": textBody, "htmlBody": htmlBody, "attachments": attachments}[prop]
+			list := []map[string]interface{}{}
+			for _, part := range parts {
+				list = append(list, bodyPartObject(msg, part, args.BodyProperties, false))
+			}
+			object[prop] = list
+		case "bodyValues":
+			values := map[string]interface{}{}
+			add := func(parts []*mimePart) {
+				for _, part := range parts {
+					if strings.HasPrefix(part.mediaType, "text/") {
+						values[part.id] = bodyValue(part, args.MaxBodyValueBytes)
+					}
+				}
+			}
+			if args.FetchTextBodyValues || args.FetchAllBodyValues {
+				add(textBody)
+			}
+			if args.FetchHTMLBodyValues || args.FetchAllBodyValues {
+				add(htmlBody)
+			}
+			object[prop] = values
+		}
+	}
+	return object
+}
+
+func (c *jmapContext) emailGet(raw json.RawMessage) (interface{}, error) {
+	args := emailGetArgs{}
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if args.Properties == nil {
+		args.Properties = jmapEmailProperties
+	}
+	if args.BodyProperties == nil {
+		args.BodyProperties = jmapBodyProperties
+	}
+	if err := checkEmailProperties(args.Properties, append(append([]string{}, jmapEmailProperties...), jmapEmailExtraProperties...)); err != nil {
+		return nil, err
+	}
+	if err := checkEmailProperties(args.BodyProperties, append(append([]string{}, jmapBodyProperties...), "headers")); err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	if args.IDs == nil {
+		messages, err := c.allMessages()
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range messages {
+			ids = append(ids, jmapID(jmapEmailPrefix, msg.ID))
+		}
+	} else {
+		ids = *args.IDs
+	}
+	if len(ids) > jmapMaxObjectsInGet {
+		return nil, newJMAPError("requestTooLarge", "maxObjectsInGet excedido")
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	for _, id := range ids {
+		msg, err := c.email(id)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			notFound = append(notFound, id)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, c.emailObject(msg, &args))
+	}
+
+	return map[string]interface{}{
+		"accountId": c.accountID,
+		"state":     states.email,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// emailChanges implementa Email/changes. As mensagens com sequência de
+// modificação maior que a da caixa no estado mudaram; as com UID abaixo do
+// UIDNEXT guardado já existiam e foram atualizadas. As remoções registradas
+// desde o estado indicam as mensagens excluídas ou movidas: uma mensagem
+// movida continua existindo e é apenas atualizada.
+func (c *jmapContext) emailChanges(raw json.RawMessage) (interface{}, error) {
+	args, err := c.decodeChangesArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	if args.SinceState == states.email {
+		return c.changesResult(args, states.email, []string{}, []string{}, []string{})
+	}
+	old, ok := parseState(args.SinceState, true)
+	if !ok {
+		return nil, newJMAPError("cannotCalculateChanges", "estado desconhecido")
+	}
+
+	mailboxes, err := c.mailboxes()
+	if err != nil {
+		return nil, err
+	}
+	exists := make(map[int64]bool, len(mailboxes))
+	for _, mb := range mailboxes {
+		exists[mb.ID] = true
+	}
+	// As remoções de uma caixa excluída não ficam registradas
+	for id := range old {
+		if !exists[id] {
+			return nil, newJMAPError("cannotCalculateChanges", "uma caixa do estado foi excluída")
+		}
+	}
+
+	existed := make(map[int64]bool) // Mensagens que já existiam no estado
+	var removed []int64
+	for _, mb := range mailboxes {
+		pos := old[mb.ID]
+		expunged, err := c.server.store.ListExpungedMessages(mb.ID, pos.modSeq)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range expunged {
+			if e.MessageID == 0 {
+				return nil, newJMAPError("cannotCalculateChanges", "remoções anteriores ao registro das mensagens")
+			}
+			if e.UID < pos.uidNext {
+				existed[e.MessageID] = true
+			}
+			removed = append(removed, e.MessageID)
+		}
+	}
+
+	messages, err := c.allMessages()
+	if err != nil {
+		return nil, err
+	}
+	present := make(map[int64]bool, len(messages))
+	var changed []*storage.Message
+	for _, msg := range messages {
+		present[msg.ID] = true
+		pos := old[msg.MailboxID]
+		if msg.ModSeq <= pos.modSeq {
+			continue
+		}
+		if msg.UID < pos.uidNext {
+			existed[msg.ID] = true
+		}
+		changed = append(changed, msg)
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].ID < changed[j].ID })
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+
+	created, updated, destroyed := []string{}, []string{}, []string{}
+	for _, msg := range changed {
+		if existed[msg.ID] {
+			updated = append(updated, jmapID(jmapEmailPrefix, msg.ID))
+		} else {
+			created = append(created, jmapID(jmapEmailPrefix, msg.ID))
+		}
+	}
+	// Mensagens criadas e removidas depois do estado não são informadas
+	seen := make(map[int64]bool)
+	for _, id := range removed {
+		if !present[id] && existed[id] && !seen[id] {
+			destroyed = append(destroyed, jmapID(jmapEmailPrefix, id))
+			seen[id] = true
+		}
+	}
+
+	return c.changesResult(args, states.email, created, updated, destroyed)
+}
+
+// threadChanges implementa Thread/changes, que não guarda histórico
+func (c *jmapContext) threadChanges(raw json.RawMessage) (interface{}, error) {
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	return c.changesResponse(raw, states.email)
+}
+
+// emailQueryArgs são os argumentos de Email/query
+type emailQueryArgs struct {
+	AccountID       string           `json:"accountId"`
+	Filter          json.RawMessage  `json:"filter"`
+	Sort            []jmapComparator `json:"sort"`
+	Position        int              `json:"position"`
+	Anchor          *string          `json:"anchor"`
+	AnchorOffset    int              `json:"anchorOffset"`
+	Limit           *int             `json:"limit"`
+	CalculateTotal  bool             `json:"calculateTotal"`
+	CollapseThreads bool             `json:"collapseThreads"`
+}
+
+// emailFilter é um FilterOperator ou, sem operador, um FilterCondition
+type emailFilter struct {
+	operator   string
+	conditions []*emailFilter
+	condition  map[string]json.RawMessage
+}
+
+// parseEmailFilter lê o filtro de Email/query, validando as condições
+func parseEmailFilter(raw json.RawMessage) (*emailFilter, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &fields); err != nil {
+		return nil, newJMAPError("invalidArguments", "filtro inválido")
+	}
+
+	if op, ok := fields["operator"]; ok {
+		filter := &emailFilter{}
+		var conditions []json.RawMessage
+		if err := json.Unmarshal(op, &filter.operator); err != nil {
+			return nil, newJMAPError("invalidArguments", "operador inválido")
+		}
+		if filter.operator != "AND" && filter.operator != "OR" && filter.operator != "NOT" {
+			return nil, newJMAPError("unsupportedFilter", filter.operator)
+		}
+		if err := json.Unmarshal(fields["conditions"], &conditions); err != nil {
+			return nil, newJMAPError("invalidArguments", "condições inválidas")
+		}
+		for _, cond := range conditions {
+			sub, err := parseEmailFilter(cond)
+			if err != nil {
+				return nil, err
+			}
+			filter.conditions = append(filter.conditions, sub)
+		}
+		return filter, nil
+	}
+
+	for key := range fields {
+		switch key {
+		case "inMailbox", "inMailboxOtherThan", "before", "after", "minSize", "maxSize",
+			"allInThreadHaveKeyword", "someInThreadHaveKeyword", "noneInThreadHaveKeyword",
+			"hasKeyword", "notKeyword", "hasAttachment", "text", "from", "to", "cc", "bcc",
+			"subject", "body", "header":
+		default:
+			return nil, newJMAPError("unsupportedFilter", key)
+		}
+	}
+	return &emailFilter{condition: fields}, nil
+}
+
+// matchEmail aplica o filtro à mensagem
+func (c *jmapContext) matchEmail(msg *storage.Message, filter *emailFilter, threads map[int64][]*storage.Message) (bool, error) {
+	if filter.condition == nil {
+		for _, sub := range filter.conditions {
+			ok, err := c.matchEmail(msg, sub, threads)
+			if err != nil {
+				return false, err
+			}
+			switch {
+			case filter.operator == "AND" && !ok:
+				return false, nil
+			case filter.operator == "OR" && ok:
+				return true, nil
+			case filter.operator == "NOT" && ok:
+				return false, nil
+			}
+		}
+		return filter.operator != "OR", nil
+	}
+
+	for key, raw := range filter.condition {
+		ok, err := c.matchCondition(msg, key, raw, threads)
+		if err != nil {
+			return false, newJMAPError("invalidArguments", key+": "+err.Error())
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// matchCondition avalia uma propriedade de FilterCondition (RFC 8621, seção
+// 4.4.1)
+func (c *jmapContext) matchCondition(msg *storage.Message, key string, raw json.RawMessage, threads map[int64][]*storage.Message) (bool, error) {
+	switch key {
+	case "inMailbox":
+		var id string
+		if err := json.Unmarshal(raw, &id); err != nil {
+			return false, err
+		}
+		return jmapID(jmapMailboxPrefix, msg.MailboxID) == c.resolveID(id), nil
+	case "inMailboxOtherThan":
+		var ids []string
+		if err := json.Unmarshal(raw, &ids); err != nil {
+			return false, err
+		}
+		for _, id := range ids {
+			if jmapID(jmapMailboxPrefix, msg.MailboxID) == c.resolveID(id) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "before", "after":
+		var date time.Time
+		if err := json.Unmarshal(raw, &date); err != nil {
+			return false, err
+		}
+		return msg.Date.Before(date) == (key == "before"), nil
+	case "minSize", "maxSize":
+		var size int
+		if err := json.Unmarshal(raw, &size); err != nil {
+			return false, err
+		}
+		return (msg.Size >= size) == (key == "minSize"), nil
+	case "hasKeyword", "notKeyword":
+		var keyword string
+		if err := json.Unmarshal(raw, &keyword); err != nil {
+			return false, err
+		}
+		return messageKeywords(msg)[strings.ToLower(keyword)] == (key == "hasKeyword"), nil
+	case "allInThreadHaveKeyword", "someInThreadHaveKeyword", "noneInThreadHaveKeyword":
+		var keyword string
+		if err := json.Unmarshal(raw, &keyword); err != nil {
+			return false, err
+		}
+		count := 0
+		thread := threads[msg.ThreadID]
+		for _, other := range thread {
+			if messageKeywords(other)[strings.ToLower(keyword)] {
+				count++
+			}
+		}
+		switch key {
+		case "allInThreadHaveKeyword":
+			return count == len(thread), nil
+		case "someInThreadHaveKeyword":
+			return count > 0, nil
+		}
+		return count == 0, nil
+	case "hasAttachment":
+		var want bool
+		if err := json.Unmarshal(raw, &want); err != nil {
+			return false, err
+		}
+		_, _, attachments := c.parse(msg).bodyParts()
+		return (len(attachments) > 0) == want, nil
+	case "header":
+		var header []string
+		if err := json.Unmarshal(raw, &header); err != nil || len(header) == 0 || len(header) > 2 {
+			return false, errors.New("header exige o nome e, opcionalmente, o valor")
+		}
+		for _, f := range c.parse(msg).fields {
+			if strings.EqualFold(f.name, header[0]) &&
+				(len(header) == 1 || containsFold(decodeHeader(unfoldHeader(f.value)), header[1])) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err != nil {
+		return false, err
+	}
+	root := c.parse(msg)
+	fieldText := func(name string) string {
+		var values []string
+		for _, f := range root.fields {
+			if strings.EqualFold(f.name, name) {
+				values = append(values, decodeHeader(unfoldHeader(f.value)))
+			}
+		}
+		return strings.Join(values, " ")
+	}
+
+	switch key {
+	case "from", "to", "cc", "bcc", "subject":
+		return containsFold(fieldText(key), text), nil
+	case "body":
+		return containsFold(emailBodyText(root), text), nil
+	}
+
+	// text: cabeçalhos de endereço, assunto e corpo
+	for _, name := range []string{"from", "to", "cc", "bcc", "subject"} {
+		if containsFold(fieldText(name), text) {
+			return true, nil
+		}
+	}
+	return containsFold(emailBodyText(root), text), nil
+}
+
+// emailBodyText retorna o texto dos corpos da mensagem, com HTML convertido
+func emailBodyText(root *mimePart) string {
+	textBody, htmlBody, _ := root.bodyParts()
+	var texts []string
+	for _, part := range append(textBody, htmlBody...) {
+		text, _ := part.text()
+		if part.mediaType == "text/html" {
+			text = htmlToText(text)
+		}
+		texts = append(texts, text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// containsFold informa se s contém substr, sem diferenciar maiúsculas
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// compareEmails compara duas mensagens pelo critério de ordenação
+func (c *jmapContext) compareEmails(a, b *storage.Message, cmp *jmapComparator) int {
+	text := func(msg *storage.Message, name string) string {
+		return strings.ToLower(decodeHeader(c.parse(msg).header.Get(name)))
+	}
+	sentAt := func(msg *storage.Message) time.Time {
+		date, _ := mail.ParseDate(c.parse(msg).header.Get("Date"))
+		return date
+	}
+
+	switch cmp.Property {
+	case "receivedAt":
+		return compareTime(a.Date, b.Date)
+	case "sentAt":
+		return compareTime(sentAt(a), sentAt(b))
+	case "size":
+		return a.Size - b.Size
+	case "from", "to", "subject":
+		return strings.Compare(text(a, cmp.Property), text(b, cmp.Property))
+	case "hasKeyword":
+		keyword := strings.ToLower(cmp.Keyword)
+		ka, kb := messageKeywords(a)[keyword], messageKeywords(b)[keyword]
+		switch {
+		case ka == kb:
+			return 0
+		case ka:
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+func compareTime(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	}
+	return 0
+}
+
+func (c *jmapContext) emailQuery(raw json.RawMessage) (interface{}, error) {
+	var args emailQueryArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+
+	var filter *emailFilter
+	if len(args.Filter) > 0 && string(args.Filter) != "null" {
+		var err error
+		if filter, err = parseEmailFilter(args.Filter); err != nil {
+			return nil, err
+		}
+	}
+	for _, cmp := range args.Sort {
+		if !containsFlag(jmapEmailSortOptions, cmp.Property) {
+			return nil, newJMAPError("unsupportedSort", cmp.Property)
+		}
+	}
+	// Sem ordenação, as mensagens mais recentes vêm primeiro
+	if len(args.Sort) == 0 {
+		descending := false
+		args.Sort = []jmapComparator{{Property: "receivedAt", IsAscending: &descending}}
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	messages, err := c.allMessages()
+	if err != nil {
+		return nil, err
+	}
+	threads := map[int64][]*storage.Message{}
+	for _, msg := range messages {
+		threads[msg.ThreadID] = append(threads[msg.ThreadID], msg)
+	}
+
+	var matched []*storage.Message
+	for _, msg := range messages {
+		if filter != nil {
+			ok, err := c.matchEmail(msg, filter, threads)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				continue
+			}
+		}
+		matched = append(matched, msg)
+	}
+
+	sort.SliceStable(matched, func(i, j int) bool {
+		for k := range args.Sort {
+			cmp := &args.Sort[k]
+			if r := c.compareEmails(matched[i], matched[j], cmp); r != 0 {
+				return (r < 0) == cmp.ascending()
+			}
+		}
+		return matched[i].ID > matched[j].ID
+	})
+
+	ids := []string{}
+	seenThreads := map[int64]bool{}
+	for _, msg := range matched {
+		if args.CollapseThreads {
+			if seenThreads[msg.ThreadID] {
+				continue
+			}
+			seenThreads[msg.ThreadID] = true
+		}
+		ids = append(ids, jmapID(jmapEmailPrefix, msg.ID))
+	}
+
+	result, err := queryResult(c.accountID, states.email, ids, args.Position, args.Anchor, args.AnchorOffset, args.Limit, args.CalculateTotal)
+	if err != nil {
+		return nil, err
+	}
+	result.(map[string]interface{})["collapseThreads"] = args.CollapseThreads
+	return result, nil
+}
+
+// storeEmail grava uma mensagem criada ou importada pelo cliente, com as
+// mesmas regras de APPEND: uma única caixa selecionável e a cota do usuário
+func (c *jmapContext) storeEmail(data []byte, mailboxIDs map[string]bool, keywords map[string]bool, receivedAt time.Time) (*storage.Message, error) {
+	if len(mailboxIDs) != 1 {
+		return nil, errInvalidProperties("a mensagem deve estar em exatamente uma caixa", "mailboxIds")
+	}
+	var mailbox *storage.Mailbox
+	for id := range mailboxIDs {
+		var err error
+		if mailbox, err = c.mailbox(id); errors.Is(err, storage.ErrMailboxNotFound) || (err == nil && mailbox.NoSelect) {
+			return nil, errInvalidProperties("caixa não encontrada", "mailboxIds")
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	for keyword := range keywords {
+		if !validKeyword(keyword) {
+			return nil, errInvalidProperties("palavra-chave inválida: "+keyword, "keywords")
+		}
+	}
+
+	err := c.server.delivery.quota.Check(c.user, int64(len(data)), 1)
+	var quota *quotaError
+	if errors.As(err, &quota) {
+		return nil, newJMAPError("overQuota", quota.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	if receivedAt.IsZero() {
+		receivedAt = time.Now()
+	}
+	header, content := parseMessage(data)
+	msg := &storage.Message{
+		MailboxID: mailbox.ID,
+		From:      header.Get("From"),
+		To:        header.Get("To"),
+		Cc:        header.Get("Cc"),
+		Subject:   header.Get("Subject"),
+		Date:      receivedAt,
+		Body:      string(content),
+		RawData:   data,
+		Size:      len(data),
+	}
+	lower := map[string]bool{}
+	for keyword, set := range keywords {
+		if set {
+			lower[strings.ToLower(keyword)] = true
+		}
+	}
+	applyKeywords(msg, lower)
+	applyThreadHeaders(msg, header)
+
+	if err := c.server.store.CreateMessage(msg); err != nil {
+		return nil, fmt.Errorf("falha ao salvar mensagem: %w", err)
+	}
+	c.invalidate()
+	return msg, nil
+}
+
+// createdEmail monta as propriedades definidas pelo servidor de uma mensagem
+// criada
+func createdEmail(msg *storage.Message) map[string]interface{} {
+	return map[string]interface{}{
+		"id":       jmapID(jmapEmailPrefix, msg.ID),
+		"blobId":   jmapID(jmapBlobPrefix, msg.ID),
+		"threadId": jmapID(jmapThreadPrefix, msg.ThreadID),
+		"size":     msg.Size,
+	}
+}
+
+func (c *jmapContext) emailSet(raw json.RawMessage) (interface{}, error) {
+	var args setArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	return c.applyEmailSet(&args)
+}
+
+// applyEmailSet executa Email/set; também usado pelas ações de sucesso de
+// EmailSubmission/set
+func (c *jmapContext) applyEmailSet(args *setArgs) (*setResult, error) {
+	if len(args.Create)+len(args.Update)+len(args.Destroy) > jmapMaxObjectsInSet {
+		return nil, newJMAPError("requestTooLarge", "maxObjectsInSet excedido")
+	}
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkState(args.IfInState, states.email); err != nil {
+		return nil, err
+	}
+
+	result := &setResult{AccountID: c.accountID, OldState: states.email}
+	for creationID, props := range args.Create {
+		msg, err := c.createEmail(props)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notCreated(creationID, jerr)
+			continue
+		}
+		c.createdIDs[creationID] = jmapID(jmapEmailPrefix, msg.ID)
+		result.created(creationID, createdEmail(msg))
+	}
+
+	for id, patch := range args.Update {
+		err := c.updateEmail(id, patch)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notUpdated(id, jerr)
+			continue
+		}
+		result.updated(id)
+	}
+
+	for _, id := range args.Destroy {
+		msg, err := c.email(id)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			result.notDestroyed(id, newJMAPError("notFound", id))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if err := c.server.store.DeleteMessage(msg.ID); err != nil {
+			return nil, fmt.Errorf("falha ao excluir mensagem: %w", err)
+		}
+		c.invalidate()
+		result.Destroyed = append(result.Destroyed, id)
+	}
+
+	if states, err = c.states(); err != nil {
+		return nil, err
+	}
+	result.NewState = states.email
+	return result, nil
+}
+
+// jmapEmailAddress é um EmailAddress em uma criação
+type jmapEmailAddress struct {
+	Name  *string `json:"name"`
+	Email string  `json:"email"`
+}
+
+// jmapBodyPartInput é um EmailBodyPart em uma criação: o conteúdo vem de
+// bodyValues (corpos de texto) ou de um blob (anexos)
+type jmapBodyPartInput struct {
+	PartID      string  `json:"partId"`
+	BlobID      string  `json:"blobId"`
+	Type        string  `json:"type"`
+	Name        *string `json:"name"`
+	Disposition *string `json:"disposition"`
+	CID         *string `json:"cid"`
+}
+
+// createEmail monta e grava uma mensagem a partir das propriedades do
+// objeto Email (RFC 8621, seção 4.6). bodyStructure não é suportado: o corpo
+// é descrito por textBody, htmlBody e attachments.
+func (c *jmapContext) createEmail(props map[string]json.RawMessage) (*storage.Message, error) {
+	var (
+		mailboxIDs  map[string]bool
+		keywords    map[string]bool
+		receivedAt  time.Time
+		bodyValues  map[string]struct{ Value string }
+		textBody    []jmapBodyPartInput
+		htmlBody    []jmapBodyPartInput
+		attachments []jmapBodyPartInput
+	)
+	msg := &composedMessage{}
+
+	addresses := func(raw json.RawMessage) ([]*mail.Address, error) {
+		var list []jmapEmailAddress
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return nil, err
+		}
+		var addrs []*mail.Address
+		for _, a := range list {
+			if !strings.Contains(a.Email, "@") {
+				return nil, errors.New("endereço inválido: " + a.Email)
+			}
+			addr := &mail.Address{Address: a.Email}
+			if a.Name != nil {
+				addr.Name = *a.Name
+			}
+			addrs = append(addrs, addr)
+		}
+		return addrs, nil
+	}
+	messageIDs := func(raw json.RawMessage) ([]string, error) {
+		var ids []string
+		if err := json.Unmarshal(raw, &ids); err != nil {
+			return nil, err
+		}
+		for i, id := range ids {
+			ids[i] = "<" + strings.Trim(id, "<>") + ">"
+		}
+		return ids, nil
+	}
+
+	for key, raw := range props {
+		var err error
+		switch key {
+		case "mailboxIds":
+			err = json.Unmarshal(raw, &mailboxIDs)
+		case "keywords":
+			err = json.Unmarshal(raw, &keywords)
+		case "receivedAt":
+			err = json.Unmarshal(raw, &receivedAt)
+		case "from":
+			msg.from, err = addresses(raw)
+		case "to":
+			msg.to, err = addresses(raw)
+		case "cc":
+			msg.cc, err = addresses(raw)
+		case "bcc":
+			msg.bcc, err = addresses(raw)
+		case "replyTo":
+			msg.replyTo, err = addresses(raw)
+		case "sender":
+			var sender []*mail.Address
+			if sender, err = addresses(raw); err == nil && len(sender) > 0 {
+				msg.sender = sender[0]
+			}
+		case "subject":
+			err = json.Unmarshal(raw, &msg.subject)
+		case "sentAt":
+			err = json.Unmarshal(raw, &msg.date)
+		case "messageId":
+			var ids []string
+			if ids, err = messageIDs(raw); err == nil && len(ids) > 0 {
+				msg.messageID = ids[0]
+			}
+		case "inReplyTo":
+			msg.inReplyTo, err = messageIDs(raw)
+		case "references":
+			msg.references, err = messageIDs(raw)
+		case "bodyValues":
+			err = json.Unmarshal(raw, &bodyValues)
+		case "textBody":
+			err = json.Unmarshal(raw, &textBody)
+		case "htmlBody":
+			err = json.Unmarshal(raw, &htmlBody)
+		case "attachments":
+			err = json.Unmarshal(raw, &attachments)
+		default:
+			name, form, all, ok := parseHeaderProperty(key)
+			if !ok || all || (form != "asRaw" && form != "asText") {
+				return nil, errInvalidProperties("propriedade não suportada na criação", key)
+			}
+			var value string
+			if err = json.Unmarshal(raw, &value); err == nil {
+				if form == "asText" {
+					value = mimeEncodeWord(value)
+				}
+				msg.headers = append(msg.headers, headerField{name: name, value: value})
+			}
+		}
+		if err != nil {
+			return nil, errInvalidProperties(err.Error(), key)
+		}
+	}
+
+	bodyText := func(parts []jmapBodyPartInput, mediaType, key string) (string, error) {
+		if len(parts) == 0 {
+			return "", nil
+		}
+		if len(parts) > 1 || (parts[0].Type != "" && parts[0].Type != mediaType) {
+			return "", errInvalidProperties("apenas uma parte "+mediaType+" é suportada", key)
+		}
+		value, ok := bodyValues[parts[0].PartID]
+		if !ok {
+			return "", errInvalidProperties("parte sem valor em bodyValues", key)
+		}
+		return value.Value, nil
+	}
+	var err error
+	if msg.text, err = bodyText(textBody, "text/plain", "textBody"); err != nil {
+		return nil, err
+	}
+	if msg.html, err = bodyText(htmlBody, "text/html", "htmlBody"); err != nil {
+		return nil, err
+	}
+
+	for _, a := range attachments {
+		data, mimeType, err := c.blob(a.BlobID)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			return nil, newJMAPError("blobNotFound", a.BlobID)
+		} else if err != nil {
+			return nil, err
+		}
+		attachment := &composedAttachment{contentType: mimeType, data: data}
+		if a.Type != "" {
+			attachment.contentType = a.Type
+		}
+		if a.Name != nil {
+			attachment.filename = *a.Name
+		}
+		if a.Disposition != nil && *a.Disposition == "inline" {
+			attachment.inline = true
+		}
+		if a.CID != nil {
+			attachment.contentID = *a.CID
+		}
+		msg.attachments = append(msg.attachments, attachment)
+	}
+
+	return c.storeEmail(msg.bytes(c.server.hostname), mailboxIDs, keywords, receivedAt)
+}
+
+// mimeEncodeWord codifica um texto livre de cabeçalho (RFC 2047)
+func mimeEncodeWord(value string) string {
+	return " " + mime.QEncoding.Encode("utf-8", value)
+}
+
+// updateEmail aplica um PatchObject às palavras-chave e à caixa da mensagem.
+// As demais propriedades de Email são imutáveis.
+func (c *jmapContext) updateEmail(id string, patch map[string]json.RawMessage) error {
+	msg, err := c.email(id)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		return newJMAPError("notFound", id)
+	} else if err != nil {
+		return err
+	}
+
+	keywords := messageKeywords(msg)
+	mailboxIDs := map[string]bool{jmapID(jmapMailboxPrefix, msg.MailboxID): true}
+	keywordsChanged := false
+
+	for key, raw := range patch {
+		var err error
+		switch {
+		case key == "keywords":
+			var value map[string]bool
+			if err = json.Unmarshal(raw, &value); err == nil {
+				keywords = map[string]bool{}
+				for k, set := range value {
+					if set {
+						keywords[strings.ToLower(k)] = true
+					}
+				}
+				keywordsChanged = true
+			}
+		case strings.HasPrefix(key, "keywords/"):
+			var set *bool
+			if err = json.Unmarshal(raw, &set); err == nil {
+				keyword := strings.ToLower(strings.TrimPrefix(key, "keywords/"))
+				if set != nil && *set {
+					keywords[keyword] = true
+				} else {
+					delete(keywords, keyword)
+				}
+				keywordsChanged = true
+			}
+		case key == "mailboxIds":
+			var value map[string]bool
+			if err = json.Unmarshal(raw, &value); err == nil {
+				mailboxIDs = map[string]bool{}
+				for k, set := range value {
+					if set {
+						mailboxIDs[c.resolveID(k)] = true
+					}
+				}
+			}
+		case strings.HasPrefix(key, "mailboxIds/"):
+			var set *bool
+			if err = json.Unmarshal(raw, &set); err == nil {
+				mailboxID := c.resolveID(strings.TrimPrefix(key, "mailboxIds/"))
+				if set != nil && *set {
+					mailboxIDs[mailboxID] = true
+				} else {
+					delete(mailboxIDs, mailboxID)
+				}
+			}
+		default:
+			return errInvalidProperties("propriedade não pode ser alterada", key)
+		}
+		if err != nil {
+			return errInvalidProperties(err.Error(), key)
+		}
+	}
+
+	for keyword := range keywords {
+		if !validKeyword(keyword) {
+			return errInvalidProperties("palavra-chave inválida: "+keyword, "keywords")
+		}
+	}
+	if len(mailboxIDs) > 1 {
+		return newJMAPError("tooManyMailboxes", "a mensagem deve estar em exatamente uma caixa")
+	}
+	if len(mailboxIDs) == 0 {
+		return errInvalidProperties("a mensagem deve estar em exatamente uma caixa", "mailboxIds")
+	}
+
+	for mailboxID := range mailboxIDs {
+		if mailboxID == jmapID(jmapMailboxPrefix, msg.MailboxID) {
+			continue
+		}
+		dest, err := c.mailbox(mailboxID)
+		if errors.Is(err, storage.ErrMailboxNotFound) || (err == nil && dest.NoSelect) {
+			return errInvalidProperties("caixa não encontrada", "mailboxIds")
+		} else if err != nil {
+			return err
+		}
+		if err := c.server.store.MoveMessage(msg.ID, dest.ID); err != nil {
+			return fmt.Errorf("falha ao mover mensagem: %w", err)
+		}
+		c.invalidate()
+	}
+
+	if keywordsChanged {
+		applyKeywords(msg, keywords)
+		if err := c.server.store.UpdateMessageFlags(msg.ID, msg.Flags, msg.Seen, msg.Deleted, msg.Draft); err != nil {
+			return fmt.Errorf("falha ao atualizar flags: %w", err)
+		}
+		c.invalidate()
+	}
+	return nil
+}
+
+// emailImportArgs são os argumentos de Email/import
+type emailImportArgs struct {
+	AccountID string  `json:"accountId"`
+	IfInState *string `json:"ifInState"`
+	Emails    map[string]struct {
+		BlobID     string          `json:"blobId"`
+		MailboxIDs map[string]bool `json:"mailboxIds"`
+		Keywords   map[string]bool `json:"keywords"`
+		ReceivedAt time.Time       `json:"receivedAt"`
+	} `json:"emails"`
+}
+
+// emailImport grava mensagens RFC 5322 enviadas como blobs (RFC 8621,
+// seção 4.8)
+func (c *jmapContext) emailImport(raw json.RawMessage) (interface{}, error) {
+	var args emailImportArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if len(args.Emails) > jmapMaxObjectsInSet {
+		return nil, newJMAPError("requestTooLarge", "maxObjectsInSet excedido")
+	}
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkState(args.IfInState, states.email); err != nil {
+		return nil, err
+	}
+
+	result := &setResult{AccountID: c.accountID, OldState: states.email}
+	for creationID, email := range args.Emails {
+		data, _, err := c.blob(email.BlobID)
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			result.notCreated(creationID, newJMAPError("blobNotFound", email.BlobID))
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		msg, err := c.storeEmail(data, email.MailboxIDs, email.Keywords, email.ReceivedAt)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notCreated(creationID, jerr)
+			continue
+		}
+		c.createdIDs[creationID] = jmapID(jmapEmailPrefix, msg.ID)
+		result.created(creationID, createdEmail(msg))
+	}
+
+	if states, err = c.states(); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"accountId":  c.accountID,
+		"oldState":   result.OldState,
+		"newState":   states.email,
+		"created":    result.Created,
+		"notCreated": result.NotCreated,
+	}, nil
+}
@@ -0,0 +1,595 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// Métodos de implementação para Identity
+
+// identity monta a única identidade do usuário, com seu nome e endereço
+func (c *jmapContext) identity() map[string]interface{} {
+	return map[string]interface{}{
+		"id":            jmapID(jmapIdentityPrefix, c.user.ID),
+		"name":          c.user.Name,
+		"email":         c.user.Email,
+		"replyTo":       nil,
+		"bcc":           nil,
+		"textSignature": "",
+		"htmlSignature": "",
+		"mayDelete":     false,
+	}
+}
+
+func (c *jmapContext) identityGet(raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	identity := c.identity()
+
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	if args.IDs == nil {
+		list = append(list, filterProperties(identity, args.Properties))
+	} else {
+		for _, id := range *args.IDs {
+			if id == identity["id"] {
+				list = append(list, filterProperties(identity, args.Properties))
+			} else {
+				notFound = append(notFound, id)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"accountId": c.accountID,
+		"state":     sessionState(c.user),
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+func (c *jmapContext) identityChanges(raw json.RawMessage) (interface{}, error) {
+	return c.changesResponse(raw, sessionState(c.user))
+}
+
+// Métodos de implementação para EmailSubmission
+
+// jmapSubmissionProperties são as propriedades de EmailSubmission
+var jmapSubmissionProperties = []string{"id", "identityId", "emailId", "threadId", "envelope", "sendAt",
+	"undoStatus", "deliveryStatus", "dsnBlobIds", "mdnBlobIds"}
+
+// submissionState é o estado de EmailSubmission, "envio.registro" em base
+// 36: o ID do último envio e o do último registro de entrega do usuário,
+// que muda o deliveryStatus dos envios
+func submissionState(submissions []*storage.EmailSubmission, records []*storage.DeliveryRecord) string {
+	var submission, record int64
+	if len(submissions) > 0 {
+		submission = submissions[len(submissions)-1].ID
+	}
+	if len(records) > 0 {
+		record = records[len(records)-1].ID
+	}
+	return strconv.FormatInt(submission, 36) + "." + strconv.FormatInt(record, 36)
+}
+
+// parseSubmissionState decodifica um estado de EmailSubmission
+func parseSubmissionState(state string) (submission, record int64, ok bool) {
+	fields := strings.Split(state, ".")
+	if len(fields) != 2 {
+		return 0, 0, false
+	}
+	submission, err := strconv.ParseInt(fields[0], 36, 64)
+	if err != nil || submission < 0 {
+		return 0, 0, false
+	}
+	record, err = strconv.ParseInt(fields[1], 36, 64)
+	if err != nil || record < 0 {
+		return 0, 0, false
+	}
+	return submission, record, true
+}
+
+// submissionObjects monta os objetos EmailSubmission da conta, em ordem de
+// criação
+func (c *jmapContext) submissionObjects() ([]map[string]interface{}, error) {
+	submissions, err := c.server.store.ListEmailSubmissions(c.user.ID)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]map[string]interface{}, 0, len(submissions))
+	for _, submission := range submissions {
+		object, err := c.submissionObject(submission)
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, object)
+	}
+	return objects, nil
+}
+
+// submissionObject monta o objeto EmailSubmission de um envio. Os envios
+// são feitos imediatamente e não podem ser cancelados; os destinatários
+// locais já receberam a mensagem, e o estado dos externos vem do histórico
+// de entregas.
+func (c *jmapContext) submissionObject(submission *storage.EmailSubmission) (map[string]interface{}, error) {
+	var records []*storage.DeliveryRecord
+	if submission.QueueID != "" {
+		var err error
+		if records, err = c.server.store.ListDeliveries(submission.QueueID, jmapMaxDeliveryRecords); err != nil {
+			return nil, err
+		}
+	}
+	// Os registros estão em ordem cronológica: vale o último de cada destinatário
+	latest := map[string]*storage.DeliveryRecord{}
+	for _, record := range records {
+		if record.QueueID == submission.QueueID {
+			latest[record.Recipient] = record
+		}
+	}
+
+	rcpts := make([]map[string]interface{}, len(submission.Recipients))
+	status := map[string]interface{}{}
+	for i, rcpt := range submission.Recipients {
+		rcpts[i] = map[string]interface{}{"email": rcpt, "parameters": nil}
+
+		smtpReply, delivered := "250 2.0.0 OK", "yes"
+		if record, ok := latest[strings.ToLower(rcpt)]; ok {
+			delivered = submissionDelivered(record.Status)
+			if isSMTPReply(record.Detail) {
+				smtpReply = record.Detail
+			}
+		} else if _, err := c.server.delivery.resolver.Resolve(rcpt); errors.Is(err, storage.ErrUserNotFound) {
+			// Envio registrado antes do histórico de entregas
+			delivered = "unknown"
+		} else if err != nil {
+			return nil, fmt.Errorf("falha ao resolver destinatário %s: %w", rcpt, err)
+		}
+		status[rcpt] = map[string]interface{}{"smtpReply": smtpReply, "delivered": delivered, "displayed": "unknown"}
+	}
+	return map[string]interface{}{
+		"id":         jmapID(jmapSubmissionPrefix, submission.ID),
+		"identityId": jmapID(jmapIdentityPrefix, submission.UserID),
+		"emailId":    jmapID(jmapEmailPrefix, submission.MessageID),
+		"threadId":   jmapID(jmapThreadPrefix, submission.ThreadID),
+		"sendAt":     submission.SendAt.UTC().Format(time.RFC3339),
+		"undoStatus": "final",
+		"envelope": map[string]interface{}{
+			"mailFrom": map[string]interface{}{"email": submission.MailFrom, "parameters": nil},
+			"rcptTo":   rcpts,
+		},
+		"deliveryStatus": status,
+		"dsnBlobIds":     []string{},
+		"mdnBlobIds":     []string{},
+	}, nil
+}
+
+// submissionDelivered converte o estado do histórico de entregas no valor
+// de delivered do deliveryStatus. A aceitação pelo servidor remoto não
+// confirma a entrega na caixa do destinatário, que continua desconhecida.
+func submissionDelivered(status string) string {
+	switch status {
+	case storage.DeliveryDelivered:
+		return "unknown"
+	case storage.DeliveryBounced:
+		return "no"
+	default:
+		return "queued"
+	}
+}
+
+// isSMTPReply informa se o detalhe de um registro de entrega é uma resposta
+// SMTP, e não a descrição de uma falha de conexão
+func isSMTPReply(detail string) bool {
+	if len(detail) < 4 || detail[3] != ' ' {
+		return false
+	}
+	for _, c := range detail[:3] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *jmapContext) submissionGet(raw json.RawMessage) (interface{}, error) {
+	var args getArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	if err := checkProperties(args.Properties, jmapSubmissionProperties); err != nil {
+		return nil, err
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := c.submissionObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	list := []map[string]interface{}{}
+	notFound := []string{}
+	if args.IDs == nil {
+		for _, object := range objects {
+			list = append(list, filterProperties(object, args.Properties))
+		}
+	} else {
+		if len(*args.IDs) > jmapMaxObjectsInGet {
+			return nil, newJMAPError("requestTooLarge", "maxObjectsInGet excedido")
+		}
+		for _, id := range *args.IDs {
+			found := false
+			for _, object := range objects {
+				if object["id"] == c.resolveID(id) {
+					list = append(list, filterProperties(object, args.Properties))
+					found = true
+					break
+				}
+			}
+			if !found {
+				notFound = append(notFound, id)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"accountId": c.accountID,
+		"state":     states.submission,
+		"list":      list,
+		"notFound":  notFound,
+	}, nil
+}
+
+// submissionChanges lista os envios criados desde o estado informado e os
+// alterados por novos registros de entrega; envios não são removidos
+func (c *jmapContext) submissionChanges(raw json.RawMessage) (interface{}, error) {
+	args, err := c.decodeChangesArgs(raw)
+	if err != nil {
+		return nil, err
+	}
+	since, sinceRecord, ok := parseSubmissionState(args.SinceState)
+	if !ok {
+		return nil, newJMAPError("cannotCalculateChanges", "estado desconhecido")
+	}
+	submissions, err := c.server.store.ListEmailSubmissions(c.user.ID)
+	if err != nil {
+		return nil, err
+	}
+	records, err := c.server.store.ListDeliveries(strings.ToLower(c.user.Email), jmapMaxDeliveryRecords)
+	if err != nil {
+		return nil, err
+	}
+	state := submissionState(submissions, records)
+	last, lastRecord, _ := parseSubmissionState(state)
+	if since > last || sinceRecord > lastRecord {
+		return nil, newJMAPError("cannotCalculateChanges", "estado desconhecido")
+	}
+	// Registros além do limite lido podem ter alterado outros envios
+	if len(records) == jmapMaxDeliveryRecords && records[0].ID > sinceRecord {
+		return nil, newJMAPError("cannotCalculateChanges", "histórico de entregas muito extenso")
+	}
+
+	changedQueues := map[string]bool{}
+	for _, record := range records {
+		if record.ID > sinceRecord {
+			changedQueues[record.QueueID] = true
+		}
+	}
+	created, updated := []string{}, []string{}
+	for _, submission := range submissions {
+		switch {
+		case submission.ID > since:
+			created = append(created, jmapID(jmapSubmissionPrefix, submission.ID))
+		case submission.QueueID != "" && changedQueues[submission.QueueID]:
+			updated = append(updated, jmapID(jmapSubmissionPrefix, submission.ID))
+		}
+	}
+	return c.changesResult(args, state, created, updated, []string{})
+}
+
+func (c *jmapContext) submissionQuery(raw json.RawMessage) (interface{}, error) {
+	var args mailboxQueryArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	objects, err := c.submissionObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []map[string]interface{}
+	for _, object := range objects {
+		ok, err := matchSubmission(object, args.Filter)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, object)
+		}
+	}
+
+	for _, cmp := range args.Sort {
+		if cmp.Property != "emailId" && cmp.Property != "threadId" && cmp.Property != "sentAt" {
+			return nil, newJMAPError("unsupportedSort", cmp.Property)
+		}
+	}
+	// Os IDs de um tipo têm o mesmo prefixo e as datas o mesmo formato, então
+	// comparar o tamanho e depois o texto segue a ordem numérica e cronológica
+	sort.SliceStable(matched, func(i, j int) bool {
+		for _, cmp := range args.Sort {
+			property := cmp.Property
+			if property == "sentAt" {
+				property = "sendAt"
+			}
+			a, b := matched[i][property].(string), matched[j][property].(string)
+			if len(a) != len(b) {
+				return (len(a) < len(b)) == cmp.ascending()
+			}
+			if a != b {
+				return (a < b) == cmp.ascending()
+			}
+		}
+		return false
+	})
+
+	ids := make([]string, len(matched))
+	for i, object := range matched {
+		ids[i] = object["id"].(string)
+	}
+	return queryResult(c.accountID, states.submission, ids, args.Position, nil, 0, args.Limit, args.CalculateTotal)
+}
+
+// matchSubmission aplica uma condição de EmailSubmission/query ao objeto do
+// envio (RFC 8621, seção 7.3)
+func matchSubmission(object map[string]interface{}, filter map[string]json.RawMessage) (bool, error) {
+	for key, raw := range filter {
+		switch key {
+		case "identityIds", "emailIds", "threadIds":
+			var ids []string
+			if err := json.Unmarshal(raw, &ids); err != nil {
+				return false, newJMAPError("invalidArguments", err.Error())
+			}
+			value := object[strings.TrimSuffix(key, "s")].(string)
+			found := false
+			for _, id := range ids {
+				if id == value {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false, nil
+			}
+		case "undoStatus":
+			var status string
+			if err := json.Unmarshal(raw, &status); err != nil {
+				return false, newJMAPError("invalidArguments", err.Error())
+			}
+			if status != object["undoStatus"] {
+				return false, nil
+			}
+		case "before", "after":
+			var date time.Time
+			if err := json.Unmarshal(raw, &date); err != nil {
+				return false, newJMAPError("invalidArguments", err.Error())
+			}
+			sendAt, _ := time.Parse(time.RFC3339, object["sendAt"].(string))
+			if key == "before" && !sendAt.Before(date) || key == "after" && sendAt.Before(date) {
+				return false, nil
+			}
+		default:
+			return false, newJMAPError("unsupportedFilter", key)
+		}
+	}
+	return true, nil
+}
+
+// submissionSetArgs acrescenta a EmailSubmission/set as alterações feitas
+// nas mensagens enviadas com sucesso (RFC 8621, seção 7.5)
+type submissionSetArgs struct {
+	setArgs
+	OnSuccessUpdateEmail  map[string]map[string]json.RawMessage `json:"onSuccessUpdateEmail"`
+	OnSuccessDestroyEmail []string                              `json:"onSuccessDestroyEmail"`
+}
+
+// jmapEnvelope é o envelope SMTP de um envio
+type jmapEnvelope struct {
+	MailFrom struct {
+		Email string `json:"email"`
+	} `json:"mailFrom"`
+	RcptTo []struct {
+		Email string `json:"email"`
+	} `json:"rcptTo"`
+}
+
+func (c *jmapContext) submissionSet(raw json.RawMessage) (interface{}, error) {
+	var args submissionSetArgs
+	if err := decodeArgs(raw, &args); err != nil {
+		return nil, err
+	}
+	if err := c.checkAccount(args.AccountID); err != nil {
+		return nil, err
+	}
+	states, err := c.states()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkState(args.IfInState, states.submission); err != nil {
+		return nil, err
+	}
+
+	result := &setResult{AccountID: c.accountID, OldState: states.submission, NewState: states.submission}
+	emailIDs := map[string]string{} // Envio criado -> mensagem enviada
+	for creationID, props := range args.Create {
+		object, emailID, err := c.submit(props)
+		if jerr, err := setError(err); err != nil {
+			return nil, err
+		} else if jerr != nil {
+			result.notCreated(creationID, jerr)
+			continue
+		}
+		c.createdIDs[creationID] = object["id"].(string)
+		emailIDs["#"+creationID] = emailID
+		result.created(creationID, object)
+	}
+
+	if len(result.Created) > 0 {
+		if states, err = c.states(); err != nil {
+			return nil, err
+		}
+		result.NewState = states.submission
+	}
+
+	// Envios já feitos não podem ser alterados nem cancelados
+	for id := range args.Update {
+		result.notUpdated(id, newJMAPError("notFound", id))
+	}
+	for _, id := range args.Destroy {
+		result.notDestroyed(id, newJMAPError("notFound", id))
+	}
+
+	// As ações de sucesso referenciam os envios como "#creationId" e geram
+	// uma resposta implícita de Email/set
+	if len(args.OnSuccessUpdateEmail) == 0 && len(args.OnSuccessDestroyEmail) == 0 {
+		return result, nil
+	}
+	emailSet := &setArgs{AccountID: c.accountID, Update: map[string]map[string]json.RawMessage{}}
+	for ref, patch := range args.OnSuccessUpdateEmail {
+		if emailID, ok := emailIDs[ref]; ok {
+			emailSet.Update[emailID] = patch
+		}
+	}
+	for _, ref := range args.OnSuccessDestroyEmail {
+		if emailID, ok := emailIDs[ref]; ok {
+			emailSet.Destroy = append(emailSet.Destroy, emailID)
+		}
+	}
+	if len(emailSet.Update) == 0 && len(emailSet.Destroy) == 0 {
+		return result, nil
+	}
+
+	emailResult, err := c.applyEmailSet(emailSet)
+	var jerr *jmapError
+	if errors.As(err, &jerr) {
+		c.implicit = append(c.implicit, &jmapInvocation{name: "error", args: jerr})
+	} else if err != nil {
+		return nil, err
+	} else {
+		c.implicit = append(c.implicit, &jmapInvocation{name: "Email/set", args: emailResult})
+	}
+	return result, nil
+}
+
+// submit envia uma mensagem da conta, retornando o objeto EmailSubmission
+// criado e o ID da mensagem enviada
+func (c *jmapContext) submit(props map[string]json.RawMessage) (map[string]interface{}, string, error) {
+	var (
+		identityID, emailID string
+		env                 *jmapEnvelope
+	)
+	for key, raw := range props {
+		var err error
+		switch key {
+		case "identityId":
+			err = json.Unmarshal(raw, &identityID)
+		case "emailId":
+			err = json.Unmarshal(raw, &emailID)
+		case "envelope":
+			err = json.Unmarshal(raw, &env)
+		default:
+			return nil, "", errInvalidProperties("propriedade não suportada na criação", key)
+		}
+		if err != nil {
+			return nil, "", errInvalidProperties(err.Error(), key)
+		}
+	}
+
+	if identityID != jmapID(jmapIdentityPrefix, c.user.ID) {
+		return nil, "", errInvalidProperties("identidade não encontrada", "identityId")
+	}
+	emailID = c.resolveID(emailID)
+	msg, err := c.email(emailID)
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		return nil, "", errInvalidProperties("mensagem não encontrada", "emailId")
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	// Sem envelope, o remetente é o endereço da identidade e os destinatários
+	// vêm dos campos To, Cc e Bcc
+	mailFrom := c.user.Email
+	var rcptTo []string
+	if env != nil {
+		mailFrom = env.MailFrom.Email
+		for _, rcpt := range env.RcptTo {
+			rcptTo = append(rcptTo, rcpt.Email)
+		}
+	} else {
+		root := c.parse(msg)
+		for _, name := range []string{"To", "Cc", "Bcc"} {
+			for _, f := range root.fields {
+				if strings.EqualFold(f.name, name) {
+					for _, addr := range parseAddressList(unfoldHeader(f.value)) {
+						rcptTo = append(rcptTo, addr.Address)
+					}
+				}
+			}
+		}
+	}
+
+	if !strings.EqualFold(mailFrom, c.user.Email) {
+		return nil, "", newJMAPError("forbiddenMailFrom", "o remetente deve ser o endereço da identidade")
+	}
+	if len(rcptTo) == 0 {
+		return nil, "", newJMAPError("noRecipients", "a mensagem não tem destinatários")
+	}
+
+	queueID, err := c.server.delivery.submit(&envelope{from: mailFrom, to: rcptTo}, removeHeader(msg.RawData, "Bcc"))
+	if err != nil {
+		return nil, "", fmt.Errorf("falha ao enviar mensagem: %w", err)
+	}
+	log.Printf("Mensagem %d enviada via JMAP por %s para %d destinatários", msg.ID, c.user.Email, len(rcptTo))
+
+	submission := &storage.EmailSubmission{
+		UserID:     c.user.ID,
+		MessageID:  msg.ID,
+		ThreadID:   msg.ThreadID,
+		MailFrom:   mailFrom,
+		Recipients: rcptTo,
+		QueueID:    queueID,
+	}
+	if err := c.server.store.CreateEmailSubmission(submission); err != nil {
+		return nil, "", err
+	}
+	object, err := c.submissionObject(submission)
+	if err != nil {
+		return nil, "", err
+	}
+	return object, emailID, nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// jmapCall executa um método JMAP no contexto e devolve a resposta em JSON
+func jmapCall(t *testing.T, method func(json.RawMessage) (interface{}, error), args string) map[string]interface{} {
+	t.Helper()
+	result, err := method(json.RawMessage(args))
+	if err != nil {
+		t.Fatalf("%s: %v", args, err)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	if err := json.Unmarshal(data, &response); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestEmailSubmission(t *testing.T) {
+	cfg := newTestConfig(t)
+	store, alice := newTestStorage(t, cfg)
+	bob := &storage.User{Username: "bob", Password: "senha", Email: "bob@localhost"}
+	if err := store.CreateUser(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestSession(t, cfg, store)
+	msg := "From: alice@localhost\r\n" +
+		"To: bob@localhost, carol@remote.example\r\n" +
+		"Subject: Envio\r\n" +
+		"\r\n" +
+		"Corpo\r\n"
+	if err := sendTestMessage(t, s, "alice@localhost", "alice@localhost", msg); err != nil {
+		t.Fatal(err)
+	}
+	sent := mailboxMessages(t, store, alice, "INBOX")[0]
+	emailID := jmapID(jmapEmailPrefix, sent.ID)
+
+	c := NewJMAPServer(cfg, store, s.backend.delivery).newContext(alice)
+	accountID := `"accountId":"` + c.accountID + `"`
+
+	get := jmapCall(t, c.submissionGet, `{`+accountID+`}`)
+	if list := get["list"].([]interface{}); len(list) != 0 {
+		t.Fatalf("EmailSubmission/get antes do envio = %v", list)
+	}
+	oldState := get["state"].(string)
+
+	set := jmapCall(t, c.submissionSet, `{`+accountID+`,"create":{"k1":{"identityId":"`+
+		jmapID(jmapIdentityPrefix, alice.ID)+`","emailId":"`+emailID+`"}}}`)
+	created := set["created"].(map[string]interface{})["k1"].(map[string]interface{})
+	id := created["id"].(string)
+	if set["newState"] == oldState {
+		t.Errorf("estado não mudou depois do envio: %v", set["newState"])
+	}
+
+	get = jmapCall(t, c.submissionGet, `{`+accountID+`,"ids":["`+id+`","S999"]}`)
+	list := get["list"].([]interface{})
+	if len(list) != 1 || !reflect.DeepEqual(get["notFound"], []interface{}{"S999"}) {
+		t.Fatalf("EmailSubmission/get = %v, esperado o envio %s", get, id)
+	}
+	object := list[0].(map[string]interface{})
+	if object["emailId"] != emailID || object["undoStatus"] != "final" {
+		t.Errorf("envio = %v", object)
+	}
+	status := object["deliveryStatus"].(map[string]interface{})
+	for rcpt, want := range map[string]string{"bob@localhost": "yes", "carol@remote.example": "queued"} {
+		if got := status[rcpt].(map[string]interface{})["delivered"]; got != want {
+			t.Errorf("delivered de %s = %v, esperado %s", rcpt, got, want)
+		}
+	}
+
+	tests := []struct {
+		filter string
+		want   []interface{}
+	}{
+		{`{}`, []interface{}{id}},
+		{`{"emailIds":["` + emailID + `"]}`, []interface{}{id}},
+		{`{"emailIds":["E999"]}`, []interface{}{}},
+		{`{"undoStatus":"final"}`, []interface{}{id}},
+		{`{"undoStatus":"pending"}`, []interface{}{}},
+		{`{"before":"2000-01-01T00:00:00Z"}`, []interface{}{}},
+		{`{"after":"2000-01-01T00:00:00Z"}`, []interface{}{id}},
+	}
+	for _, tt := range tests {
+		query := jmapCall(t, c.submissionQuery, `{`+accountID+`,"filter":`+tt.filter+`,"sort":[{"property":"sentAt"}]}`)
+		if !reflect.DeepEqual(query["ids"], tt.want) {
+			t.Errorf("EmailSubmission/query %s = %v, esperado %v", tt.filter, query["ids"], tt.want)
+		}
+	}
+
+	changes := jmapCall(t, c.submissionChanges, `{`+accountID+`,"sinceState":"`+oldState+`"}`)
+	if !reflect.DeepEqual(changes["created"], []interface{}{id}) || changes["newState"] != set["newState"] {
+		t.Errorf("EmailSubmission/changes = %v", changes)
+	}
+	for _, state := range []string{"zz.0", "0.zz", "1"} {
+		if _, err := c.submissionChanges(json.RawMessage(`{` + accountID + `,"sinceState":"` + state + `"}`)); err == nil {
+			t.Errorf("EmailSubmission/changes aceitou o estado %s", state)
+		}
+	}
+
+	// A resposta do servidor remoto atualiza o envio
+	pending := pendingOutbound(t, store)
+	if len(pending) != 1 {
+		t.Fatalf("%d mensagens na fila, esperado uma", len(pending))
+	}
+	records := []struct {
+		status, detail, delivered, smtpReply string
+	}{
+		{storage.DeliveryDeferred, "connection refused", "queued", "250 2.0.0 OK"},
+		{storage.DeliveryDeferred, "451 4.3.0 Tente mais tarde", "queued", "451 4.3.0 Tente mais tarde"},
+		{storage.DeliveryDelivered, "250 2.0.0 Ok: queued as 1234", "unknown", "250 2.0.0 Ok: queued as 1234"},
+		{storage.DeliveryBounced, "550 5.1.1 Usuário desconhecido", "no", "550 5.1.1 Usuário desconhecido"},
+	}
+	state := set["newState"].(string)
+	for _, tt := range records {
+		if err := store.RecordDelivery(&storage.DeliveryRecord{QueueID: pending[0].QueueID, Sender: "alice@localhost",
+			Recipient: "Carol@remote.example", Status: tt.status, Detail: tt.detail}); err != nil {
+			t.Fatal(err)
+		}
+
+		get = jmapCall(t, c.submissionGet, `{`+accountID+`,"ids":["`+id+`"]}`)
+		object := get["list"].([]interface{})[0].(map[string]interface{})
+		status := object["deliveryStatus"].(map[string]interface{})["carol@remote.example"].(map[string]interface{})
+		if status["delivered"] != tt.delivered || status["smtpReply"] != tt.smtpReply {
+			t.Errorf("%s %q: deliveryStatus = %v, esperado %s e %q", tt.status, tt.detail, status, tt.delivered, tt.smtpReply)
+		}
+
+		changes := jmapCall(t, c.submissionChanges, `{`+accountID+`,"sinceState":"`+state+`"}`)
+		if !reflect.DeepEqual(changes["updated"], []interface{}{id}) || changes["newState"] != get["state"] {
+			t.Errorf("EmailSubmission/changes depois de %s = %v", tt.status, changes)
+		}
+		state = get["state"].(string)
+	}
+}
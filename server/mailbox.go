@@ -0,0 +1,117 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+)
+
+// specialUseAttrs lista os atributos de uso especial que podem ser
+// atribuídos a uma caixa (RFC 6154). \All e \Flagged exigem caixas virtuais
+// e não são suportados.
+var specialUseAttrs = map[string]bool{
+	imap.ArchiveAttr: true,
+	imap.DraftsAttr:  true,
+	imap.JunkAttr:    true,
+	imap.SentAttr:    true,
+	imap.TrashAttr:   true,
+}
+
+// Atributos LIST de LIST-EXTENDED (RFC 5258) ausentes em go-imap
+const (
+	nonExistentAttr = "\\NonExistent"
+	subscribedAttr  = "\\Subscribed"
+)
+
+// errMailboxExists indica que já existe uma caixa com o nome informado
+var errMailboxExists = errors.New("caixa de correio já existe")
+
+// parentMailboxes retorna os níveis superiores de um nome hierárquico, do
+// mais externo para o mais interno ("a/b/c" resulta em "a" e "a/b")
+func parentMailboxes(name string) []string {
+	var parents []string
+	for i, c := range name {
+		if string(c) == storage.MailboxDelimiter && i > 0 {
+			parents = append(parents, name[:i])
+		}
+	}
+	return parents
+}
+
+// isChildMailbox informa se child está abaixo de parent na hierarquia
+func isChildMailbox(parent, child string) bool {
+	return strings.HasPrefix(child, parent+storage.MailboxDelimiter)
+}
+
+// createMailbox cria uma caixa de correio e os níveis superiores que ainda
+// não existirem (RFC 3501, seção 6.3.3)
+func createMailbox(store storage.Storage, userID int64, name, specialUse string) (*storage.Mailbox, error) {
+	name = strings.TrimSuffix(name, storage.MailboxDelimiter)
+	if name == "" || strings.Contains(name, storage.MailboxDelimiter+storage.MailboxDelimiter) {
+		return nil, fmt.Errorf("nome de caixa de correio inválido: %q", name)
+	}
+
+	if existing, err := store.GetMailbox(userID, name); err == nil {
+		// Um nível mantido apenas pela hierarquia volta a ser selecionável
+		if existing.NoSelect {
+			existing.NoSelect = false
+			existing.SpecialUse = specialUse
+			return existing, store.UpdateMailbox(existing)
+		}
+		return nil, errMailboxExists
+	} else if !errors.Is(err, storage.ErrMailboxNotFound) {
+		return nil, err
+	}
+
+	for _, parent := range parentMailboxes(name) {
+		if _, err := store.GetMailbox(userID, parent); errors.Is(err, storage.ErrMailboxNotFound) {
+			mailbox := &storage.Mailbox{UserID: userID, Name: parent, Path: parent}
+			if err := store.CreateMailbox(mailbox); err != nil {
+				return nil, err
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	mailbox := &storage.Mailbox{
+		UserID:     userID,
+		Name:       name,
+		Path:       name,
+		SpecialUse: specialUse,
+	}
+	if err := store.CreateMailbox(mailbox); err != nil {
+		return nil, err
+	}
+	return mailbox, nil
+}
+
+// mailboxAttributes calcula os atributos LIST de uma caixa a partir da lista
+// completa de caixas do usuário
+func mailboxAttributes(mailbox *storage.Mailbox, all []*storage.Mailbox) []string {
+	var attrs []string
+	if mailbox.NoSelect {
+		attrs = append(attrs, imap.NoSelectAttr)
+	}
+
+	children := false
+	for _, other := range all {
+		if isChildMailbox(mailbox.Name, other.Name) {
+			children = true
+			break
+		}
+	}
+	if children {
+		attrs = append(attrs, imap.HasChildrenAttr)
+	} else {
+		attrs = append(attrs, imap.HasNoChildrenAttr)
+	}
+
+	if mailbox.SpecialUse != "" {
+		attrs = append(attrs, mailbox.SpecialUse)
+	}
+	return attrs
+}
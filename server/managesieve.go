@@ -0,0 +1,559 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/sieve"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// manageSieveTimeout é o tempo máximo de inatividade de uma sessão ManageSieve
+const manageSieveTimeout = 10 * time.Minute
+
+// defaultMaxScriptSize é usado quando managesieve.max_script_size não é configurado
+const defaultMaxScriptSize = 64 * 1024
+
+// maxScriptNameLength limita o tamanho do nome de um script
+const maxScriptNameLength = 128
+
+// errLineTooLong indica um comando ou literal acima do limite aceito
+var errLineTooLong = errors.New("comando muito longo")
+
+// ManageSieveServer implementa o protocolo ManageSieve (RFC 5804)
+type ManageSieveServer struct {
+	store         storage.Storage
+	cfg           *config.Config
+	maxScriptSize int
+}
+
+// NewManageSieveServer cria um novo servidor ManageSieve
+func NewManageSieveServer(store storage.Storage, cfg *config.Config) *ManageSieveServer {
+	maxScriptSize := cfg.ManageSieve.MaxScriptSize
+	if maxScriptSize <= 0 {
+		maxScriptSize = defaultMaxScriptSize
+	}
+
+	return &ManageSieveServer{
+		store:         store,
+		cfg:           cfg,
+		maxScriptSize: maxScriptSize,
+	}
+}
+
+// manageSieveSession guarda o estado de uma conexão ManageSieve
+type manageSieveSession struct {
+	server *ManageSieveServer
+	conn   net.Conn
+	reader *bufio.Reader
+	user   *storage.User
+}
+
+// handleConnection gerencia uma conexão ManageSieve
+func (s *ManageSieveServer) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	session := &manageSieveSession{
+		server: s,
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	// A saudação é a própria lista de capacidades
+	session.capabilities()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(manageSieveTimeout))
+		args, err := session.readCommand()
+		if errors.Is(err, errLineTooLong) {
+			session.bye("", "comando muito longo")
+			return
+		} else if err != nil {
+			return
+		}
+
+		if len(args) == 0 {
+			session.no("", "comando vazio")
+			continue
+		}
+
+		cmd := strings.ToUpper(args[0])
+		if quit := session.handle(cmd, args[1:]); quit {
+			return
+		}
+	}
+}
+
+// handle processa um comando e retorna true quando a sessão deve ser encerrada
+func (m *manageSieveSession) handle(cmd string, args []string) bool {
+	switch cmd {
+	case "LOGOUT":
+		m.ok("", "Logout")
+		return true
+	case "CAPABILITY":
+		m.capabilities()
+		return false
+	case "NOOP":
+		if len(args) > 0 {
+			m.ok("TAG "+quoteSieveString(args[0]), "Done")
+		} else {
+			m.ok("", "Done")
+		}
+		return false
+	case "STARTTLS":
+		m.no("", "STARTTLS não suportado")
+		return false
+	}
+
+	// Estado não autenticado
+	if m.user == nil {
+		if cmd != "AUTHENTICATE" {
+			m.no("", "autentique-se primeiro")
+			return false
+		}
+		return m.authenticate(args)
+	}
+
+	switch cmd {
+	case "AUTHENTICATE":
+		m.no("", "já autenticado")
+	case "UNAUTHENTICATE":
+		m.user = nil
+		m.ok("", "")
+	case "HAVESPACE":
+		if !m.argCount(args, 2) {
+			return false
+		}
+		size, err := strconv.Atoi(args[1])
+		if err != nil || size < 0 {
+			m.no("", "tamanho inválido")
+		} else if size > m.server.maxScriptSize {
+			m.no("QUOTA/MAXSIZE", fmt.Sprintf("tamanho máximo de script é %d bytes", m.server.maxScriptSize))
+		} else {
+			m.ok("", "")
+		}
+	case "PUTSCRIPT":
+		if m.argCount(args, 2) && m.validName(args[0]) && m.validScript(args[1]) {
+			m.putScript(args[0], args[1])
+		}
+	case "CHECKSCRIPT":
+		if m.argCount(args, 1) && m.validScript(args[0]) {
+			m.ok("", "")
+		}
+	case "LISTSCRIPTS":
+		m.listScripts()
+	case "GETSCRIPT":
+		if m.argCount(args, 1) {
+			m.getScript(args[0])
+		}
+	case "SETACTIVE":
+		if m.argCount(args, 1) {
+			m.setActive(args[0])
+		}
+	case "DELETESCRIPT":
+		if m.argCount(args, 1) {
+			m.deleteScript(args[0])
+		}
+	case "RENAMESCRIPT":
+		if m.argCount(args, 2) && m.validName(args[1]) {
+			m.renameScript(args[0], args[1])
+		}
+	default:
+		m.no("", "comando desconhecido")
+	}
+
+	return false
+}
+
+// capabilities envia a lista de capacidades seguida de OK
+func (m *manageSieveSession) capabilities() {
+	var buf bytes.Buffer
+	buf.WriteString(`"IMPLEMENTATION" "SimpleEmail ManageSieve"` + "\r\n")
+	buf.WriteString(`"SASL" "PLAIN"` + "\r\n")
+	buf.WriteString(`"SIEVE" ` + quoteSieveString(strings.Join(sieve.Extensions(), " ")) + "\r\n")
+	buf.WriteString(`"VERSION" "1.0"` + "\r\n")
+	if m.user != nil {
+		buf.WriteString(`"OWNER" ` + quoteSieveString(m.login()) + "\r\n")
+	}
+	m.conn.Write(buf.Bytes())
+	m.ok("", "SimpleEmail ManageSieve server ready")
+}
+
+// authenticate executa AUTHENTICATE "PLAIN", com ou sem resposta inicial
+func (m *manageSieveSession) authenticate(args []string) bool {
+	if len(args) == 0 || len(args) > 2 {
+		m.no("", "uso: AUTHENTICATE mecanismo [resposta-inicial]")
+		return false
+	}
+	if !strings.EqualFold(args[0], "PLAIN") {
+		m.no("", "mecanismo SASL não suportado")
+		return false
+	}
+
+	response := ""
+	if len(args) == 2 {
+		response = args[1]
+	} else {
+		// Solicitar as credenciais ao cliente com um desafio vazio
+		m.conn.Write([]byte("\"\"\r\n"))
+		reply, err := m.readCommand()
+		if err != nil {
+			return true
+		}
+		if len(reply) != 1 {
+			m.no("", "resposta SASL inválida")
+			return false
+		}
+		response = reply[0]
+	}
+
+	if response == "*" {
+		m.no("", "autenticação cancelada")
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		m.no("", "resposta SASL inválida")
+		return false
+	}
+
+	// authzid \0 authcid \0 senha (RFC 4616)
+	parts := strings.SplitN(string(decoded), "\x00", 3)
+	if len(parts) != 3 || (parts[0] != "" && parts[0] != parts[1]) {
+		m.no("", "autenticação falhou")
+		return false
+	}
+
+	user, err := m.server.store.AuthenticateUser(parts[1], parts[2])
+	if err != nil {
+		m.no("", "autenticação falhou")
+		return false
+	}
+
+	m.user = user
+	m.ok("", "autenticado")
+	return false
+}
+
+// login retorna o nome usado para identificar o usuário autenticado
+func (m *manageSieveSession) login() string {
+	if m.user.DomainID != 0 {
+		return m.user.Email
+	}
+	return m.user.Username
+}
+
+// argCount verifica o número de argumentos do comando
+func (m *manageSieveSession) argCount(args []string, n int) bool {
+	if len(args) != n {
+		m.no("", "número incorreto de argumentos")
+		return false
+	}
+	return true
+}
+
+// validName verifica se o nome do script é aceitável (RFC 5804, seção 1.6)
+func (m *manageSieveSession) validName(name string) bool {
+	if name == "" || len(name) > maxScriptNameLength {
+		m.no("", "nome de script inválido")
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			m.no("", "nome de script inválido")
+			return false
+		}
+	}
+	return true
+}
+
+// validScript verifica tamanho e sintaxe do script, respondendo NO com o
+// erro encontrado
+func (m *manageSieveSession) validScript(content string) bool {
+	if len(content) > m.server.maxScriptSize {
+		m.no("QUOTA/MAXSIZE", fmt.Sprintf("tamanho máximo de script é %d bytes", m.server.maxScriptSize))
+		return false
+	}
+	if _, err := sieve.Parse(content); err != nil {
+		m.no("", err.Error())
+		return false
+	}
+	return true
+}
+
+func (m *manageSieveSession) putScript(name, content string) {
+	script := &storage.SieveScript{
+		UserID:  m.user.ID,
+		Name:    name,
+		Content: content,
+	}
+	if err := m.server.store.PutSieveScript(script); err != nil {
+		m.fail("salvar", name, err)
+		return
+	}
+	m.ok("", "")
+}
+
+func (m *manageSieveSession) listScripts() {
+	scripts, err := m.server.store.ListSieveScripts(m.user.ID)
+	if err != nil {
+		m.fail("listar", "", err)
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, script := range scripts {
+		buf.WriteString(quoteSieveString(script.Name))
+		if script.Active {
+			buf.WriteString(" ACTIVE")
+		}
+		buf.WriteString("\r\n")
+	}
+	m.conn.Write(buf.Bytes())
+	m.ok("", "")
+}
+
+func (m *manageSieveSession) getScript(name string) {
+	script, err := m.server.store.GetSieveScript(m.user.ID, name)
+	if err != nil {
+		m.fail("obter", name, err)
+		return
+	}
+
+	m.conn.Write([]byte(fmt.Sprintf("{%d}\r\n%s\r\n", len(script.Content), script.Content)))
+	m.ok("", "")
+}
+
+func (m *manageSieveSession) setActive(name string) {
+	if err := m.server.store.SetActiveSieveScript(m.user.ID, name); err != nil {
+		m.fail("ativar", name, err)
+		return
+	}
+	m.ok("", "")
+}
+
+func (m *manageSieveSession) deleteScript(name string) {
+	script, err := m.server.store.GetSieveScript(m.user.ID, name)
+	if err != nil {
+		m.fail("excluir", name, err)
+		return
+	}
+	if script.Active {
+		m.no("ACTIVE", "não é possível excluir o script ativo")
+		return
+	}
+
+	if err := m.server.store.DeleteSieveScript(m.user.ID, name); err != nil {
+		m.fail("excluir", name, err)
+		return
+	}
+	m.ok("", "")
+}
+
+func (m *manageSieveSession) renameScript(oldName, newName string) {
+	if err := m.server.store.RenameSieveScript(m.user.ID, oldName, newName); err != nil {
+		m.fail("renomear", oldName, err)
+		return
+	}
+	m.ok("", "")
+}
+
+// fail responde NO com o código de resposta correspondente ao erro de armazenamento
+func (m *manageSieveSession) fail(action, name string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrSieveScriptNotFound):
+		m.no("NONEXISTENT", "script não encontrado")
+	case errors.Is(err, storage.ErrSieveScriptExists):
+		m.no("ALREADYEXISTS", "já existe um script com esse nome")
+	default:
+		log.Printf("Erro ao %s script sieve %q de %s: %v", action, name, m.user.Email, err)
+		m.no("TRYLATER", "falha temporária")
+	}
+}
+
+// readCommand lê um comando completo, separando átomos, strings entre aspas
+// e literais ({n} ou {n+}) em argumentos
+func (m *manageSieveSession) readCommand() ([]string, error) {
+	var args []string
+	total := 0
+	for {
+		c, err := m.reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case c == ' ' || c == '\t':
+			continue
+		case c == '\r':
+			continue
+		case c == '\n':
+			return args, nil
+		case c == '"':
+			s, err := m.readQuoted()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+			total += len(s)
+		case c == '{':
+			s, err := m.readLiteral()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+			total += len(s)
+		default:
+			m.reader.UnreadByte()
+			s, err := m.readAtom()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, s)
+			total += len(s)
+		}
+
+		// Margem para o literal em base64 e para os demais argumentos
+		if total > 2*m.server.maxScriptSize+1024 {
+			return nil, errLineTooLong
+		}
+	}
+}
+
+func (m *manageSieveSession) readAtom() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := m.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == ' ' || c == '\t' || c == '\r' || c == '\n' {
+			m.reader.UnreadByte()
+			return b.String(), nil
+		}
+		if b.Len() >= 1024 {
+			return "", errLineTooLong
+		}
+		b.WriteByte(c)
+	}
+}
+
+func (m *manageSieveSession) readQuoted() (string, error) {
+	var b strings.Builder
+	for {
+		c, err := m.reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '"':
+			return b.String(), nil
+		case '\\':
+			if c, err = m.reader.ReadByte(); err != nil {
+				return "", err
+			}
+		case '\r', '\n':
+			return "", errors.New("quebra de linha em string entre aspas")
+		}
+		if b.Len() >= 1024 {
+			return "", errLineTooLong
+		}
+		b.WriteByte(c)
+	}
+}
+
+// readLiteral lê um literal após o "{" inicial
+func (m *manageSieveSession) readLiteral() (string, error) {
+	spec, err := m.reader.ReadString('}')
+	if err != nil {
+		return "", err
+	}
+	size, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(spec, "}"), "+"))
+	if err != nil || size < 0 {
+		return "", errors.New("literal inválido")
+	}
+	if size > 2*m.server.maxScriptSize {
+		return "", errLineTooLong
+	}
+
+	// O literal começa após o CRLF que segue o tamanho
+	if line, err := m.reader.ReadString('\n'); err != nil {
+		return "", err
+	} else if strings.TrimRight(line, "\r\n") != "" {
+		return "", errors.New("literal inválido")
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(m.reader, data); err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// quoteSieveString codifica uma string para resposta, usando literal quando
+// ela contém quebras de linha ou caracteres não representáveis entre aspas
+func quoteSieveString(s string) string {
+	if strings.ContainsAny(s, "\r\n\x00") || len(s) > 1024 {
+		return fmt.Sprintf("{%d}\r\n%s", len(s), s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+func (m *manageSieveSession) ok(code, msg string) {
+	m.respond("OK", code, msg)
+}
+
+func (m *manageSieveSession) no(code, msg string) {
+	m.respond("NO", code, msg)
+}
+
+func (m *manageSieveSession) bye(code, msg string) {
+	m.respond("BYE", code, msg)
+}
+
+// respond envia uma resposta final com código e texto opcionais
+func (m *manageSieveSession) respond(status, code, msg string) {
+	line := status
+	if code != "" {
+		line += " (" + code + ")"
+	}
+	if msg != "" {
+		line += " " + quoteSieveString(msg)
+	}
+	m.conn.Write([]byte(line + "\r\n"))
+}
+
+// StartManageSieveServer inicia o servidor ManageSieve
+func StartManageSieveServer(cfg *config.Config, store storage.Storage) error {
+	server := NewManageSieveServer(store, cfg)
+	addr := fmt.Sprintf("%s:%d", cfg.ManageSieve.Address, cfg.ManageSieve.Port)
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar servidor ManageSieve: %w", err)
+	}
+
+	log.Printf("Iniciando servidor ManageSieve em %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Erro ao aceitar conexão: %v", err)
+			continue
+		}
+
+		go server.handleConnection(conn)
+	}
+}
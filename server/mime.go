@@ -0,0 +1,400 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxPartDepth limita a recursão em mensagens multipart aninhadas
+const maxPartDepth = 10
+
+// headerField é um campo de cabeçalho na ordem e na forma em que aparece na
+// mensagem
+type headerField struct {
+	name  string // Nome como escrito na mensagem
+	value string // Valor bruto após os dois-pontos, com as quebras de linha
+}
+
+// mimePart é uma parte de uma mensagem MIME. O conteúdo é mantido com a
+// codificação de transferência original.
+type mimePart struct {
+	id        string // Posição da parte na árvore: "1", "1.2", ...
+	fields    []headerField
+	header    textproto.MIMEHeader
+	mediaType string
+	params    map[string]string
+	body      []byte
+	parts     []*mimePart // Subpartes de multipart/*
+}
+
+// parseMIME monta a árvore de partes de uma mensagem. Mensagens malformadas
+// resultam em uma única parte text/plain.
+func parseMIME(data []byte) *mimePart {
+	return parseMIMEPart("1", data, 0)
+}
+
+func parseMIMEPart(id string, data []byte, depth int) *mimePart {
+	fields, body := splitHeader(data)
+	part := &mimePart{
+		id:     id,
+		fields: fields,
+		header: textproto.MIMEHeader{},
+		body:   body,
+	}
+	for _, f := range fields {
+		part.header.Add(textproto.CanonicalMIMEHeaderKey(f.name), unfoldHeader(f.value))
+	}
+
+	mediaType, params, err := mime.ParseMediaType(part.header.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	part.mediaType, part.params = mediaType, params
+
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" && depth < maxPartDepth {
+		for i, sub := range splitMultipart(body, params["boundary"]) {
+			part.parts = append(part.parts, parseMIMEPart(id+"."+strconv.Itoa(i+1), sub, depth+1))
+		}
+	}
+	return part
+}
+
+// splitHeader separa os campos de cabeçalho do corpo, preservando a ordem e
+// as dobras de linha dos valores
+func splitHeader(data []byte) ([]headerField, []byte) {
+	var fields []headerField
+	rest := data
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n')
+		line := rest
+		if end >= 0 {
+			line = rest[:end+1]
+		}
+		trimmed := strings.TrimRight(string(line), "\r\n")
+		if trimmed == "" {
+			return fields, rest[len(line):]
+		}
+
+		if (trimmed[0] == ' ' || trimmed[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].value += "\r\n" + trimmed
+		} else if colon := strings.IndexByte(trimmed, ':'); colon > 0 {
+			fields = append(fields, headerField{name: strings.TrimSpace(trimmed[:colon]), value: trimmed[colon+1:]})
+		} else {
+			// Linha inválida: o restante é tratado como corpo
+			return fields, rest
+		}
+		rest = rest[len(line):]
+	}
+	return fields, nil
+}
+
+// stripHeaders remove da mensagem os campos de cabeçalho cujo nome começa
+// com o prefixo (em minúsculas), mantendo os demais como estão
+func stripHeaders(data []byte, prefix string) []byte {
+	fields, body := splitHeader(data)
+	found := false
+	for _, f := range fields {
+		if strings.HasPrefix(strings.ToLower(f.name), prefix) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return data
+	}
+
+	var b bytes.Buffer
+	for _, f := range fields {
+		if !strings.HasPrefix(strings.ToLower(f.name), prefix) {
+			b.WriteString(f.name + ":" + f.value + "\r\n")
+		}
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// splitMultipart retorna o conteúdo bruto de cada parte de um corpo
+// multipart, ignorando o preâmbulo e o epílogo
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delimiter := "--" + boundary
+	var parts [][]byte
+	var current []byte
+	inPart := false
+
+	for _, line := range bytes.SplitAfter(body, []byte("\n")) {
+		trimmed := strings.TrimRight(string(line), " \t\r\n")
+		if trimmed == delimiter || trimmed == delimiter+"--" {
+			if inPart {
+				parts = append(parts, trimLineEnding(current))
+			}
+			if trimmed != delimiter {
+				return parts
+			}
+			current, inPart = nil, true
+			continue
+		}
+		if inPart {
+			current = append(current, line...)
+		}
+	}
+
+	// Mensagem truncada, sem o delimitador final
+	if inPart {
+		parts = append(parts, trimLineEnding(current))
+	}
+	return parts
+}
+
+// trimLineEnding remove a quebra de linha que antecede um delimitador, que
+// pertence ao delimitador e não à parte (RFC 2046, seção 5.1.1)
+func trimLineEnding(data []byte) []byte {
+	data = bytes.TrimSuffix(data, []byte("\n"))
+	return bytes.TrimSuffix(data, []byte("\r"))
+}
+
+// isMultipart informa se a parte contém subpartes
+func (p *mimePart) isMultipart() bool {
+	return strings.HasPrefix(p.mediaType, "multipart/")
+}
+
+// decoded retorna o conteúdo da parte sem a codificação de transferência.
+// Trechos inválidos são descartados.
+func (p *mimePart) decoded() []byte {
+	switch strings.ToLower(strings.TrimSpace(p.header.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		// Quebras de linha, preenchimento e caracteres inválidos são ignorados
+		clean := make([]byte, 0, len(p.body))
+		for _, c := range p.body {
+			if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '+' || c == '/' {
+				clean = append(clean, c)
+			}
+		}
+		if len(clean)%4 == 1 {
+			clean = clean[:len(clean)-1]
+		}
+		data, _ := base64.RawStdEncoding.DecodeString(string(clean))
+		return data
+	case "quoted-printable":
+		data, _ := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(p.body)))
+		return data
+	}
+	return p.body
+}
+
+// text retorna o conteúdo decodificado da parte como UTF-8 e informa se houve
+// problema de codificação (charset desconhecido ou bytes inválidos)
+func (p *mimePart) text() (string, bool) {
+	return decodeCharset(p.decoded(), p.params["charset"])
+}
+
+// decodeCharset converte o texto para UTF-8. Além de UTF-8 e ASCII, apenas
+// ISO-8859-1 e Windows-1252 são convertidos; os demais são mantidos e
+// sinalizados como problema de codificação.
+func decodeCharset(data []byte, charset string) (string, bool) {
+	switch strings.ToLower(strings.TrimSpace(charset)) {
+	case "", "utf-8", "utf8", "us-ascii", "ascii":
+		if utf8.Valid(data) {
+			return string(data), false
+		}
+		return strings.ToValidUTF8(string(data), "�"), true
+	case "iso-8859-1", "latin1", "iso_8859-1", "windows-1252", "cp1252":
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		return string(runes), false
+	}
+	if utf8.Valid(data) {
+		return string(data), true
+	}
+	return strings.ToValidUTF8(string(data), "�"), true
+}
+
+// filename retorna o nome do arquivo da parte, de Content-Disposition ou do
+// parâmetro name de Content-Type
+func (p *mimePart) filename() string {
+	if _, params, err := mime.ParseMediaType(p.header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return decodeHeader(params["filename"])
+	}
+	return decodeHeader(p.params["name"])
+}
+
+// disposition retorna o valor de Content-Disposition em minúsculas, sem
+// parâmetros
+func (p *mimePart) disposition() string {
+	disposition, _, err := mime.ParseMediaType(p.header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	return disposition
+}
+
+// bodyParts classifica as partes folha da mensagem em corpo de texto, corpo
+// HTML e anexos, seguindo o algoritmo da RFC 8621, seção 4.1.4
+func (p *mimePart) bodyParts() (textBody, htmlBody, attachments []*mimePart) {
+	textBody, htmlBody = []*mimePart{}, []*mimePart{}
+	parseBodyStructure([]*mimePart{p}, "mixed", false, &textBody, &htmlBody, &attachments)
+	return textBody, htmlBody, attachments
+}
+
+func parseBodyStructure(parts []*mimePart, multipartType string, inAlternative bool, textBody, htmlBody, attachments *[]*mimePart) {
+	textLength, htmlLength := -1, -1
+	if textBody != nil {
+		textLength = len(*textBody)
+	}
+	if htmlBody != nil {
+		htmlLength = len(*htmlBody)
+	}
+
+	for i, part := range parts {
+		// Uma parte de texto com nome de arquivo fora da primeira posição é
+		// tratada como anexo; em multipart/related, só a primeira é corpo
+		inline := part.disposition() != "attachment" &&
+			(part.mediaType == "text/plain" || part.mediaType == "text/html" || isInlineMediaType(part.mediaType)) &&
+			(i == 0 || (multipartType != "related" && (isInlineMediaType(part.mediaType) || part.filename() == "")))
+
+		switch {
+		case part.isMultipart():
+			subtype := strings.TrimPrefix(part.mediaType, "multipart/")
+			parseBodyStructure(part.parts, subtype, inAlternative || subtype == "alternative", textBody, htmlBody, attachments)
+		case inline:
+			if multipartType == "alternative" {
+				switch part.mediaType {
+				case "text/plain":
+					*textBody = append(*textBody, part)
+				case "text/html":
+					*htmlBody = append(*htmlBody, part)
+				default:
+					*attachments = append(*attachments, part)
+				}
+				continue
+			} else if inAlternative {
+				if part.mediaType == "text/plain" {
+					htmlBody = nil
+				}
+				if part.mediaType == "text/html" {
+					textBody = nil
+				}
+			}
+			if textBody != nil {
+				*textBody = append(*textBody, part)
+			}
+			if htmlBody != nil {
+				*htmlBody = append(*htmlBody, part)
+			}
+			if (textBody == nil || htmlBody == nil) && isInlineMediaType(part.mediaType) {
+				*attachments = append(*attachments, part)
+			}
+		default:
+			*attachments = append(*attachments, part)
+		}
+	}
+
+	if multipartType == "alternative" && textBody != nil && htmlBody != nil {
+		// Apenas HTML encontrado: usar também como texto, e vice-versa
+		if textLength == len(*textBody) && htmlLength != len(*htmlBody) {
+			*textBody = append(*textBody, (*htmlBody)[htmlLength:]...)
+		}
+		if htmlLength == len(*htmlBody) && textLength != len(*textBody) {
+			*htmlBody = append(*htmlBody, (*textBody)[textLength:]...)
+		}
+	}
+}
+
+// isInlineMediaType informa se o tipo pode ser exibido junto ao corpo
+func isInlineMediaType(mediaType string) bool {
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "audio/") ||
+		strings.HasPrefix(mediaType, "video/")
+}
+
+// findPart procura uma parte pelo identificador
+func (p *mimePart) findPart(id string) *mimePart {
+	if p.id == id {
+		return p
+	}
+	for _, sub := range p.parts {
+		if found := sub.findPart(id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// unfoldHeader junta as linhas de um valor de cabeçalho dobrado
+func unfoldHeader(value string) string {
+	value = strings.ReplaceAll(value, "\r\n", "")
+	return strings.TrimSpace(strings.ReplaceAll(value, "\n", ""))
+}
+
+// headerDecoder decodifica palavras codificadas (RFC 2047) nos charsets
+// aceitos por decodeCharset
+var headerDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		data, err := io.ReadAll(input)
+		if err != nil {
+			return nil, err
+		}
+		text, _ := decodeCharset(data, charset)
+		return strings.NewReader(text), nil
+	},
+}
+
+// decodeHeader decodifica um valor de cabeçalho, mantendo o texto original
+// quando ele for inválido
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+// parseAddressList lê uma lista de endereços. Endereços inválidos são
+// ignorados em vez de invalidar a lista inteira.
+func parseAddressList(value string) []*mail.Address {
+	parser := &mail.AddressParser{WordDecoder: headerDecoder}
+	if addrs, err := parser.ParseList(value); err == nil {
+		return addrs
+	}
+
+	var addrs []*mail.Address
+	for _, item := range strings.Split(value, ",") {
+		if addr, err := parser.Parse(item); err == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+var (
+	htmlHiddenPattern = regexp.MustCompile(`(?is)<(script|style|head)\b.*?</(script|style|head)\s*>`)
+	htmlTagPattern    = regexp.MustCompile(`(?s)<[^>]*>`)
+	whitespacePattern = regexp.MustCompile(`\s+`)
+)
+
+// htmlToText extrai o texto visível de um HTML, sem formatação
+func htmlToText(content string) string {
+	content = htmlHiddenPattern.ReplaceAllString(content, " ")
+	content = htmlTagPattern.ReplaceAllString(content, " ")
+	return html.UnescapeString(content)
+}
+
+// preview resume o texto em até size caracteres, em uma única linha
+func preview(text string, size int) string {
+	text = strings.TrimSpace(whitespacePattern.ReplaceAllString(text, " "))
+	if utf8.RuneCountInString(text) <= size {
+		return text
+	}
+	return string([]rune(text)[:size])
+}
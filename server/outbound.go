@@ -0,0 +1,654 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// outboundBackoff define o intervalo entre novas tentativas de entrega
+var outboundBackoff = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	6 * time.Hour,
+}
+
+// outboundPollInterval é o intervalo entre as verificações da fila de entrega
+const outboundPollInterval = 30 * time.Second
+
+// outboundBatchSize limita as mensagens lidas em cada verificação da fila
+const outboundBatchSize = 50
+
+// outboundMessage representa uma mensagem aguardando entrega externa
+type outboundMessage struct {
+	queueRow  int64     // ID na fila persistente
+	id        string    // Identificador na fila e no histórico de entregas
+	env       *envelope // Remetente e parâmetros DSN
+	to        []string  // Destinatários ainda pendentes
+	data      []byte
+	messageID string
+	arrival   time.Time
+	delayed   map[string]bool // Destinatários cujo atraso já foi notificado
+	attempts  int
+}
+
+// Outbound entrega mensagens para servidores externos, diretamente via MX
+// ou através de um smarthost, com novas tentativas em caso de falha temporária.
+// As mensagens aguardam em uma fila persistente no banco de dados, retomada
+// quando o servidor reinicia. Cada mudança de estado é registrada no
+// histórico de entregas e falhas, atrasos e confirmações são notificados ao
+// remetente conforme o DSN.
+type Outbound struct {
+	hostname    string
+	relay       string
+	tlsRequired bool     // Exigir TLS com certificado válido em todas as entregas
+	tlsDomains  []string // Domínios que exigem TLS com certificado válido
+	workers     int
+	maxAttempts int
+	store       storage.Storage
+	report      func(env *envelope, action string, rcpts []*dsnRecipient, data []byte, arrival time.Time)
+	work        chan *outboundMessage
+	wake        chan struct{}
+
+	mu       sync.Mutex     // Garante que o registro "queued" preceda o das tentativas
+	inflight map[int64]bool // Mensagens em processamento, pelo ID na fila
+}
+
+// NewOutbound cria uma nova fila de entrega externa
+func NewOutbound(cfg *config.Config, store storage.Storage) *Outbound {
+	workers := cfg.Outbound.Workers
+	if workers <= 0 {
+		workers = 2
+	}
+	maxAttempts := cfg.Outbound.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = len(outboundBackoff)
+	}
+
+	return &Outbound{
+		hostname:    cfg.SMTP.Domain,
+		relay:       cfg.Outbound.Relay,
+		tlsRequired: cfg.Outbound.RequireTLS,
+		tlsDomains:  cfg.Outbound.RequireTLSDomains,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		store:       store,
+		work:        make(chan *outboundMessage),
+		wake:        make(chan struct{}, 1),
+		inflight:    make(map[int64]bool),
+	}
+}
+
+// Start inicia os workers de entrega e o processamento da fila, incluindo
+// as mensagens deixadas pendentes antes de o servidor reiniciar
+func (o *Outbound) Start() {
+	for i := 0; i < o.workers; i++ {
+		go func() {
+			for msg := range o.work {
+				o.process(msg)
+				o.done(msg)
+			}
+		}()
+	}
+	go o.run()
+}
+
+func (o *Outbound) run() {
+	ticker := time.NewTicker(outboundPollInterval)
+	defer ticker.Stop()
+	for {
+		o.dispatch()
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+// dispatch entrega aos workers as mensagens cuja próxima tentativa já venceu
+// e que ainda não estão em processamento
+func (o *Outbound) dispatch() {
+	o.mu.Lock()
+	rows, err := o.store.PendingOutbound(time.Now(), outboundBatchSize)
+	if err != nil {
+		o.mu.Unlock()
+		log.Printf("Erro ao ler fila de entrega externa: %v", err)
+		return
+	}
+	var batch []*outboundMessage
+	for _, row := range rows {
+		if o.inflight[row.ID] {
+			continue
+		}
+		msg, err := newOutboundMessage(row)
+		if err != nil {
+			log.Printf("Mensagem %s descartada da fila de entrega externa: %v", row.QueueID, err)
+			o.remove(row.ID, row.QueueID)
+			continue
+		}
+		o.inflight[row.ID] = true
+		batch = append(batch, msg)
+	}
+	o.mu.Unlock()
+
+	for _, msg := range batch {
+		o.work <- msg
+	}
+}
+
+// done libera a mensagem processada e verifica a fila novamente, pois um
+// lote cheio pode ter deixado mensagens vencidas para trás
+func (o *Outbound) done(msg *outboundMessage) {
+	o.mu.Lock()
+	delete(o.inflight, msg.queueRow)
+	o.mu.Unlock()
+	o.notify()
+}
+
+func (o *Outbound) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue grava a mensagem na fila de entrega externa e retorna seu
+// identificador no histórico de entregas, vazio sem destinatários. Ao
+// retornar sem erro, a mensagem está persistida e será entregue mesmo que o
+// servidor reinicie.
+func (o *Outbound) Enqueue(env *envelope, to []string, data []byte) (string, error) {
+	if len(to) == 0 {
+		return "", nil
+	}
+
+	msg := &outboundMessage{
+		id:      newQueueID(),
+		env:     env,
+		to:      to,
+		data:    data,
+		arrival: time.Now(),
+		delayed: make(map[string]bool),
+	}
+	header, _ := parseMessage(data)
+	if ids := parseMessageIDs(header.Get("Message-Id")); len(ids) > 0 {
+		msg.messageID = ids[0]
+	}
+
+	row, err := msg.row()
+	if err != nil {
+		return "", fmt.Errorf("falha ao codificar parâmetros DSN: %w", err)
+	}
+	row.NextAttempt = msg.arrival
+
+	o.mu.Lock()
+	if err := o.store.EnqueueOutbound(row); err != nil {
+		o.mu.Unlock()
+		return "", err
+	}
+	for _, rcpt := range to {
+		o.record(msg, rcpt, storage.DeliveryQueued, "", "")
+	}
+	o.mu.Unlock()
+
+	o.notify()
+	return msg.id, nil
+}
+
+// newOutboundMessage reconstrói a mensagem a partir da fila persistente
+func newOutboundMessage(row *storage.OutboundMessage) (*outboundMessage, error) {
+	dsn, err := unmarshalDSN(row.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("parâmetros DSN inválidos: %w", err)
+	}
+
+	msg := &outboundMessage{
+		queueRow:  row.ID,
+		id:        row.QueueID,
+		env:       &envelope{from: row.Sender, to: row.Recipients, dsn: dsn},
+		to:        row.Recipients,
+		data:      row.Data,
+		messageID: row.MessageID,
+		arrival:   row.Created,
+		delayed:   make(map[string]bool),
+		attempts:  row.Attempts,
+	}
+	for _, rcpt := range row.Delayed {
+		msg.delayed[rcpt] = true
+	}
+	return msg, nil
+}
+
+// row retorna a forma da mensagem gravada na fila persistente
+func (msg *outboundMessage) row() (*storage.OutboundMessage, error) {
+	dsn, err := msg.env.dsn.marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	row := &storage.OutboundMessage{
+		ID:         msg.queueRow,
+		QueueID:    msg.id,
+		Sender:     msg.env.from,
+		Recipients: msg.to,
+		DSN:        dsn,
+		MessageID:  msg.messageID,
+		Data:       msg.data,
+		Attempts:   msg.attempts,
+		Created:    msg.arrival,
+	}
+	for rcpt := range msg.delayed {
+		row.Delayed = append(row.Delayed, rcpt)
+	}
+	sort.Strings(row.Delayed)
+	return row, nil
+}
+
+// process entrega a mensagem agrupando os destinatários por domínio
+func (o *Outbound) process(msg *outboundMessage) {
+	msg.attempts++
+
+	var retry []string
+	var failed, delayed, relayed []*dsnRecipient
+	groups, invalid := groupByDomain(msg.to)
+	for _, rcpt := range invalid {
+		log.Printf("Endereço inválido %s na mensagem %s de %s; entrega abandonada", rcpt, msg.id, msg.env.from)
+		o.record(msg, rcpt, storage.DeliveryBounced, "", "endereço de destinatário inválido")
+		if msg.env.dsn.notify(rcpt, smtp.DSNNotifyFailure) {
+			failed = append(failed, &dsnRecipient{address: rcpt, status: "5.1.3", reason: "endereço de destinatário inválido"})
+		}
+	}
+	for domain, rcpts := range groups {
+		t, err := o.send(domain, msg, rcpts)
+		for _, rcpt := range rcpts {
+			rcptErr := err
+			if err == nil {
+				rcptErr = t.rejected[rcpt]
+			}
+
+			switch {
+			case rcptErr == nil:
+				log.Printf("Mensagem %s de %s entregue para %s em %s: %s", msg.id, msg.env.from, rcpt, t.host, t.response)
+				o.record(msg, rcpt, storage.DeliveryDelivered, t.host, t.response)
+				// Servidores sem DSN não confirmam a entrega final; a
+				// confirmação pedida é dada aqui (RFC 3461, seção 5.2.2)
+				if !t.dsn && msg.env.dsn.notify(rcpt, smtp.DSNNotifySuccess) {
+					relayed = append(relayed, &dsnRecipient{address: rcpt, status: "2.0.0", remoteMTA: t.host, diagnostic: t.response})
+				}
+			case isPermanent(rcptErr) || msg.attempts >= o.maxAttempts:
+				if isPermanent(rcptErr) {
+					log.Printf("Falha permanente ao entregar mensagem %s de %s para %s: %v", msg.id, msg.env.from, rcpt, rcptErr)
+				} else {
+					log.Printf("Desistindo da entrega de %s de %s para %s após %d tentativas: %v", msg.id, msg.env.from, rcpt, msg.attempts, rcptErr)
+				}
+				o.record(msg, rcpt, storage.DeliveryBounced, t.host, deliveryDetail(rcptErr))
+				if msg.env.dsn.notify(rcpt, smtp.DSNNotifyFailure) {
+					failed = append(failed, &dsnRecipient{address: rcpt, status: dsnFailedStatus(rcptErr), remoteMTA: t.host,
+						diagnostic: dsnDiagnostic(rcptErr), reason: deliveryDetail(rcptErr)})
+				}
+			default:
+				log.Printf("Falha temporária ao entregar mensagem %s de %s para %s (tentativa %d): %v",
+					msg.id, msg.env.from, rcpt, msg.attempts, rcptErr)
+				o.record(msg, rcpt, storage.DeliveryDeferred, t.host, deliveryDetail(rcptErr))
+				retry = append(retry, rcpt)
+				if !msg.delayed[rcpt] && msg.env.dsn.notify(rcpt, smtp.DSNNotifyDelayed) {
+					msg.delayed[rcpt] = true
+					delayed = append(delayed, &dsnRecipient{address: rcpt, status: dsnStatus(rcptErr), remoteMTA: t.host,
+						diagnostic: dsnDiagnostic(rcptErr), reason: deliveryDetail(rcptErr), retryUntil: o.retryUntil(msg.attempts)})
+				}
+			}
+		}
+	}
+
+	if o.report != nil {
+		o.report(msg.env, dsnFailed, failed, msg.data, msg.arrival)
+		o.report(msg.env, dsnDelayed, delayed, msg.data, msg.arrival)
+		o.report(msg.env, dsnRelayed, relayed, msg.data, msg.arrival)
+	}
+
+	msg.to = retry
+	if len(retry) == 0 {
+		o.remove(msg.queueRow, msg.id)
+		return
+	}
+	row, err := msg.row()
+	if err == nil {
+		row.NextAttempt = time.Now().Add(backoff(msg.attempts))
+		err = o.store.UpdateOutbound(row)
+	}
+	if err != nil {
+		log.Printf("Erro ao reagendar mensagem %s: %v", msg.id, err)
+	}
+}
+
+// remove retira da fila uma mensagem sem destinatários pendentes
+func (o *Outbound) remove(queueRow int64, id string) {
+	if err := o.store.DeleteOutbound(queueRow); err != nil {
+		log.Printf("Erro ao remover mensagem %s da fila de entrega externa: %v", id, err)
+	}
+}
+
+// record acrescenta o estado da entrega a um destinatário ao histórico
+func (o *Outbound) record(msg *outboundMessage, rcpt, status, host, detail string) {
+	err := o.store.RecordDelivery(&storage.DeliveryRecord{
+		QueueID:    msg.id,
+		MessageID:  msg.messageID,
+		Sender:     msg.env.from,
+		Recipient:  rcpt,
+		Status:     status,
+		RemoteHost: host,
+		Detail:     detail,
+		Attempts:   msg.attempts,
+	})
+	if err != nil {
+		log.Printf("Erro ao registrar entrega de %s para %s: %v", msg.id, rcpt, err)
+	}
+}
+
+// retryUntil estima quando será feita a última tentativa de entrega
+func (o *Outbound) retryUntil(attempts int) time.Time {
+	until := time.Now()
+	for attempt := attempts; attempt < o.maxAttempts; attempt++ {
+		until = until.Add(backoff(attempt))
+	}
+	return until
+}
+
+// backoff retorna o intervalo até a tentativa seguinte à informada
+func backoff(attempt int) time.Duration {
+	if attempt-1 < len(outboundBackoff) {
+		return outboundBackoff[attempt-1]
+	}
+	return outboundBackoff[len(outboundBackoff)-1]
+}
+
+// deliveryDetail descreve a falha no histórico de entregas, usando a
+// resposta SMTP quando houver
+func deliveryDetail(err error) string {
+	if diagnostic := dsnDiagnostic(err); diagnostic != "" {
+		return diagnostic
+	}
+	return err.Error()
+}
+
+// newQueueID gera o identificador de uma mensagem na fila de entrega
+func newQueueID() string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
+
+// transaction é o resultado de uma transação SMTP com um servidor remoto
+type transaction struct {
+	host     string           // Servidor que respondeu
+	response string           // Resposta ao fim do DATA
+	dsn      bool             // O servidor anunciou a extensão DSN
+	rejected map[string]error // Destinatários recusados no RCPT TO
+}
+
+// send entrega a mensagem para os destinatários de um mesmo domínio
+func (o *Outbound) send(domain string, msg *outboundMessage, to []string) (*transaction, error) {
+	hosts := []string{o.relay}
+	if o.relay == "" {
+		var err error
+		hosts, err = lookupMX(domain)
+		if err != nil {
+			return &transaction{}, err
+		}
+	}
+
+	var t *transaction
+	var err error
+	for _, host := range hosts {
+		t, err = o.sendTo(host, msg, to, o.requireTLS(domain))
+		if err == nil || isPermanent(err) {
+			return t, err
+		}
+	}
+	return t, err
+}
+
+// sendTo realiza uma transação SMTP com um servidor específico, repassando
+// os parâmetros DSN quando o servidor os aceita. Destinatários recusados não
+// impedem a entrega aos demais.
+func (o *Outbound) sendTo(addr string, msg *outboundMessage, to []string, requireTLS bool) (*transaction, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+		addr = net.JoinHostPort(addr, "25")
+	}
+	t := &transaction{host: host, rejected: make(map[string]error)}
+
+	c, err := o.dial(addr, host, requireTLS)
+	if err != nil {
+		return t, err
+	}
+	defer c.Close()
+
+	var recorder responseRecorder
+	c.DebugWriter = &recorder
+	t.dsn, _ = c.Extension("DSN")
+
+	if err := c.Mail(msg.env.from, msg.env.dsn.mailOptions()); err != nil {
+		return t, err
+	}
+	accepted := 0
+	for _, rcpt := range to {
+		err := c.Rcpt(rcpt, msg.env.dsn.rcptOptions(rcpt))
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			t.rejected[rcpt] = err
+			continue
+		} else if err != nil {
+			return t, err
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		c.Quit()
+		return t, nil
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return t, err
+	}
+	if _, err := w.Write(msg.data); err != nil {
+		return t, err
+	}
+	if err := w.Close(); err != nil {
+		return t, err
+	}
+	t.response = recorder.last
+
+	// A mensagem já foi aceita; uma falha no QUIT não deve causar reenvio
+	c.Quit()
+	return t, nil
+}
+
+// tlsError indica que a conexão com o servidor remoto não pôde ser
+// protegida por TLS em um domínio que exige TLS: o servidor não anuncia
+// STARTTLS, a negociação falhou ou o certificado não foi validado. É uma
+// falha temporária, pois o servidor ou seu certificado podem ser corrigidos.
+type tlsError struct {
+	addr string
+	err  error
+}
+
+func (e *tlsError) Error() string {
+	return fmt.Sprintf("falha no STARTTLS com %s: %v", e.addr, e.err)
+}
+
+func (e *tlsError) Unwrap() error {
+	return e.err
+}
+
+// dial conecta ao servidor e se apresenta com o nome do servidor, usando
+// STARTTLS quando anunciado. O TLS é oportunista (RFC 3207): muitos
+// servidores de email usam certificados autoassinados ou de outro nome, então
+// um certificado que não é validado ainda é usado para cifrar a conexão, e
+// uma negociação que falha é refeita sem TLS. Para os domínios que exigem
+// TLS, essas situações resultam em tlsError.
+func (o *Outbound) dial(addr, host string, requireTLS bool) (*smtp.Client, error) {
+	c, err := o.hello(smtp.Dial(addr))
+	if err != nil {
+		return nil, fmt.Errorf("falha ao conectar em %s: %w", addr, err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		if requireTLS {
+			c.Quit()
+			return nil, &tlsError{addr: addr, err: errors.New("o servidor não anuncia STARTTLS")}
+		}
+		return c, nil
+	}
+
+	// O cliente só negocia STARTTLS no início da conexão, então uma nova é aberta
+	c.Quit()
+	c, err = o.hello(smtp.DialStartTLS(addr, &tls.Config{ServerName: host}))
+	if err == nil || !isTLSFailure(err) {
+		if err != nil {
+			return nil, fmt.Errorf("falha no STARTTLS com %s: %w", addr, err)
+		}
+		return c, nil
+	}
+	if requireTLS {
+		return nil, &tlsError{addr: addr, err: err}
+	}
+
+	var certErr *tls.CertificateVerificationError
+	if errors.As(err, &certErr) {
+		log.Printf("Certificado de %s não validado (%v); usando TLS sem validação", addr, err)
+		if c, err := o.hello(smtp.DialStartTLS(addr, &tls.Config{ServerName: host, InsecureSkipVerify: true})); err == nil {
+			return c, nil
+		}
+	}
+
+	log.Printf("Falha no STARTTLS com %s (%v); entregando sem TLS", addr, err)
+	if c, err = o.hello(smtp.Dial(addr)); err != nil {
+		return nil, fmt.Errorf("falha ao conectar em %s: %w", addr, err)
+	}
+	return c, nil
+}
+
+// hello se apresenta na conexão recém-aberta. Com STARTTLS, o handshake TLS
+// acontece neste primeiro comando.
+func (o *Outbound) hello(c *smtp.Client, err error) (*smtp.Client, error) {
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Hello(o.hostname); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// requireTLS informa se as entregas para o domínio exigem TLS com
+// certificado válido
+func (o *Outbound) requireTLS(domain string) bool {
+	if o.tlsRequired {
+		return true
+	}
+	for _, d := range o.tlsDomains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// isTLSFailure informa se o erro veio da negociação TLS, como um
+// certificado inválido ou um alerta do servidor, e não da rede ou de uma
+// resposta SMTP
+func isTLSFailure(err error) bool {
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		// Alerta TLS enviado pelo servidor
+		return true
+	}
+	return errors.As(err, &certErr) || errors.As(err, &alertErr) || errors.As(err, &recordErr) ||
+		strings.HasPrefix(err.Error(), "tls: ")
+}
+
+// responseRecorder guarda a última linha trocada com o servidor remoto, que
+// ao fim do DATA é a resposta de aceitação da mensagem
+type responseRecorder struct {
+	line []byte
+	last string
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	for _, c := range b {
+		switch c {
+		case '\n':
+			r.last = string(r.line)
+			r.line = r.line[:0]
+		case '\r':
+		default:
+			if len(r.line) < 512 {
+				r.line = append(r.line, c)
+			}
+		}
+	}
+	return len(b), nil
+}
+
+// lookupMX retorna os servidores de email de um domínio em ordem de preferência
+func lookupMX(domain string) ([]string, error) {
+	records, err := net.LookupMX(domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, fmt.Errorf("falha ao consultar MX de %s: %w", domain, err)
+	}
+	if len(records) == 0 {
+		// Sem registros MX, usar o próprio domínio (RFC 5321, seção 5.1)
+		return []string{domain}, nil
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Pref < records[j].Pref
+	})
+
+	hosts := make([]string, len(records))
+	for i, mx := range records {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// groupByDomain agrupa os destinatários pelo domínio do endereço e retorna
+// à parte os endereços sem domínio válido
+func groupByDomain(rcpts []string) (groups map[string][]string, invalid []string) {
+	groups = make(map[string][]string)
+	for _, rcpt := range rcpts {
+		_, domain, ok := splitAddress(normalizeAddress(rcpt))
+		if !ok {
+			invalid = append(invalid, rcpt)
+			continue
+		}
+		groups[domain] = append(groups[domain], rcpt)
+	}
+	return groups, invalid
+}
+
+// isPermanent informa se o erro é uma falha permanente: uma resposta SMTP 5xx
+func isPermanent(err error) bool {
+	var smtpErr *smtp.SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code >= 500
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// mxDelivery é uma mensagem recebida pelo servidor remoto falso
+type mxDelivery struct {
+	tls  bool
+	data []byte
+}
+
+type mxBackend struct {
+	deliveries chan<- *mxDelivery
+}
+
+func (b *mxBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	_, secure := c.TLSConnectionState()
+	return &mxSession{backend: b, tls: secure}, nil
+}
+
+type mxSession struct {
+	backend *mxBackend
+	tls     bool
+}
+
+func (s *mxSession) Reset()                                         {}
+func (s *mxSession) Logout() error                                  { return nil }
+func (s *mxSession) Mail(from string, opts *smtp.MailOptions) error { return nil }
+func (s *mxSession) Rcpt(to string, opts *smtp.RcptOptions) error   { return nil }
+
+func (s *mxSession) Data(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.backend.deliveries <- &mxDelivery{tls: s.tls, data: data}
+	return nil
+}
+
+// fakeMX inicia um servidor SMTP remoto falso. Com tlsConfig, o servidor
+// anuncia STARTTLS.
+func fakeMX(t *testing.T, tlsConfig *tls.Config) (string, <-chan *mxDelivery) {
+	t.Helper()
+	deliveries := make(chan *mxDelivery, 1)
+	s := smtp.NewServer(&mxBackend{deliveries: deliveries})
+	s.Domain = "mx.example"
+	s.AllowInsecureAuth = true
+	s.TLSConfig = tlsConfig
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return l.Addr().String(), deliveries
+}
+
+// selfSignedTLS cria uma configuração TLS com um certificado autoassinado
+// para mx.example, como os de muitos servidores de email
+func selfSignedTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example"},
+		DNSNames:     []string{"mx.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func TestOutboundTLS(t *testing.T) {
+	selfSigned := selfSignedTLS(t)
+	// Servidor que anuncia STARTTLS mas não conclui a negociação com o cliente
+	broken := selfSignedTLS(t)
+	broken.MaxVersion = tls.VersionTLS10
+
+	tests := []struct {
+		name       string
+		tls        *tls.Config
+		requireTLS bool
+		wantTLS    bool // Entregue com TLS; falso entrega sem TLS
+		wantErr    bool // Entrega adiada com tlsError
+	}{
+		{"certificado autoassinado", selfSigned, false, true, false},
+		{"negociação falha", broken, false, false, false},
+		{"sem STARTTLS", nil, false, false, false},
+		{"certificado autoassinado com TLS exigido", selfSigned, true, false, true},
+		{"negociação falha com TLS exigido", broken, true, false, true},
+		{"sem STARTTLS com TLS exigido", nil, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, deliveries := fakeMX(t, tt.tls)
+			o := NewOutbound(newTestConfig(t), nil)
+			msg := &outboundMessage{
+				env:  &envelope{from: "alice@localhost"},
+				data: []byte("Subject: teste\r\n\r\ncorpo\r\n"),
+			}
+
+			_, err := o.sendTo(addr, msg, []string{"bob@remote.example"}, tt.requireTLS)
+			if tt.wantErr {
+				var tlsErr *tlsError
+				if !errors.As(err, &tlsErr) {
+					t.Fatalf("erro = %v, esperado tlsError", err)
+				}
+				if isPermanent(err) {
+					t.Errorf("falha de TLS tratada como permanente")
+				}
+				if status := dsnStatus(err); status != "4.7.5" {
+					t.Errorf("status DSN = %s, esperado 4.7.5", status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case d := <-deliveries:
+				if d.tls != tt.wantTLS {
+					t.Errorf("entregue com TLS: %v, esperado %v", d.tls, tt.wantTLS)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("mensagem não entregue")
+			}
+		})
+	}
+}
+
+func TestOutboundRequireTLSDomains(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Outbound.RequireTLSDomains = []string{"Banco.example"}
+	o := NewOutbound(cfg, nil)
+	if !o.requireTLS("banco.example") || o.requireTLS("outro.example") {
+		t.Errorf("require_tls_domains não aplicado por domínio")
+	}
+
+	cfg.Outbound.RequireTLS = true
+	if o := NewOutbound(cfg, nil); !o.requireTLS("outro.example") {
+		t.Errorf("require_tls não aplicado a todos os domínios")
+	}
+}
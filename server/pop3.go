@@ -1,15 +1,22 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/carloslauriano/simpleEmail/config"
 	"github.com/carloslauriano/simpleEmail/storage"
 )
 
+// pop3Timeout é o tempo máximo de inatividade de uma sessão POP3 (RFC 1939)
+const pop3Timeout = 10 * time.Minute
+
 // POP3Server implementa o servidor POP3
 type POP3Server struct {
 	store storage.Storage
@@ -24,25 +31,287 @@ func NewPOP3Server(store storage.Storage, cfg *config.Config) *POP3Server {
 	}
 }
 
+// pop3Session guarda o estado de uma conexão POP3
+type pop3Session struct {
+	server   *POP3Server
+	conn     net.Conn
+	reader   *bufio.Reader
+	username string
+	user     *storage.User
+	messages []*storage.Message
+	deleted  map[int]bool
+}
+
 // handleConnection gerencia uma conexão POP3
 func (s *POP3Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
+	session := &pop3Session{
+		server:  s,
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		deleted: make(map[int]bool),
+	}
+
 	// Enviar saudação
-	conn.Write([]byte("+OK SimpleEmail POP3 server ready\r\n"))
+	session.ok("SimpleEmail POP3 server ready")
 
 	// Ler comandos do cliente
-	buf := make([]byte, 1024)
 	for {
-		n, err := conn.Read(buf)
+		conn.SetReadDeadline(time.Now().Add(pop3Timeout))
+		line, err := session.reader.ReadString('\n')
 		if err != nil {
 			return
 		}
 
-		cmd := string(buf[:n])
-		// Processar comando...
-		// Implementar comandos POP3 básicos: USER, PASS, LIST, RETR, DELE, QUIT
+		fields := strings.Fields(strings.TrimSpace(line))
+		if len(fields) == 0 {
+			session.err("comando vazio")
+			continue
+		}
+
+		cmd := strings.ToUpper(fields[0])
+		if quit := session.handle(cmd, fields[1:]); quit {
+			return
+		}
+	}
+}
+
+// handle processa um comando e retorna true quando a sessão deve ser encerrada
+func (p *pop3Session) handle(cmd string, args []string) bool {
+	if cmd == "QUIT" {
+		if p.user != nil {
+			if err := p.commit(); err != nil {
+				log.Printf("Erro ao remover mensagens POP3 de %s: %v", p.user.Username, err)
+				p.err("falha ao remover mensagens")
+				return true
+			}
+		}
+		p.ok("SimpleEmail POP3 server signing off")
+		return true
+	}
+
+	if cmd == "CAPA" {
+		p.ok("Capability list follows")
+		p.multiline([]string{"USER", "UIDL", "TOP"})
+		return false
+	}
+
+	// Estado AUTHORIZATION
+	if p.user == nil {
+		switch cmd {
+		case "USER":
+			if len(args) != 1 {
+				p.err("uso: USER nome")
+				return false
+			}
+			p.username = args[0]
+			p.ok("envie a senha")
+		case "PASS":
+			if p.username == "" {
+				p.err("envie USER primeiro")
+				return false
+			}
+			p.login(strings.Join(args, " "))
+		default:
+			p.err("comando inválido antes da autenticação")
+		}
+		return false
+	}
+
+	// Estado TRANSACTION
+	switch cmd {
+	case "STAT":
+		count, size := 0, 0
+		for i, msg := range p.messages {
+			if !p.deleted[i] {
+				count++
+				size += msg.Size
+			}
+		}
+		p.ok(fmt.Sprintf("%d %d", count, size))
+	case "LIST":
+		p.list(args, func(i int, msg *storage.Message) string {
+			return fmt.Sprintf("%d %d", i+1, msg.Size)
+		})
+	case "UIDL":
+		p.list(args, func(i int, msg *storage.Message) string {
+			return fmt.Sprintf("%d %d", i+1, msg.ID)
+		})
+	case "RETR":
+		i, msg := p.message(args)
+		if msg == nil {
+			return false
+		}
+		p.ok(fmt.Sprintf("%d octets", msg.Size))
+		p.writeMessage(msg.RawData, -1)
+		p.markSeen(i, msg)
+	case "TOP":
+		if len(args) != 2 {
+			p.err("uso: TOP mensagem linhas")
+			return false
+		}
+		lines, err := strconv.Atoi(args[1])
+		if err != nil || lines < 0 {
+			p.err("número de linhas inválido")
+			return false
+		}
+		_, msg := p.message(args[:1])
+		if msg == nil {
+			return false
+		}
+		p.ok("top of message follows")
+		p.writeMessage(msg.RawData, lines)
+	case "DELE":
+		i, msg := p.message(args)
+		if msg == nil {
+			return false
+		}
+		p.deleted[i] = true
+		p.ok(fmt.Sprintf("message %d deleted", i+1))
+	case "RSET":
+		p.deleted = make(map[int]bool)
+		p.ok("")
+	case "NOOP":
+		p.ok("")
+	default:
+		p.err("comando desconhecido")
 	}
+
+	return false
+}
+
+// login autentica o usuário e carrega a caixa de entrada
+func (p *pop3Session) login(password string) {
+	user, err := p.server.store.AuthenticateUser(p.username, password)
+	if err != nil {
+		p.username = ""
+		p.err("autenticação falhou")
+		return
+	}
+
+	mailbox, err := p.server.store.GetMailbox(user.ID, "INBOX")
+	if err != nil {
+		p.err("falha ao obter caixa de entrada")
+		return
+	}
+
+	messages, err := p.server.store.ListMessages(mailbox.ID)
+	if err != nil {
+		p.err("falha ao listar mensagens")
+		return
+	}
+
+	p.user = user
+	for _, msg := range messages {
+		if !msg.Deleted {
+			p.messages = append(p.messages, msg)
+		}
+	}
+	p.ok(fmt.Sprintf("maildrop has %d messages", len(p.messages)))
+}
+
+// message obtém a mensagem indicada pelo argumento numérico do comando
+func (p *pop3Session) message(args []string) (int, *storage.Message) {
+	if len(args) != 1 {
+		p.err("número da mensagem obrigatório")
+		return 0, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(p.messages) || p.deleted[n-1] {
+		p.err("mensagem inexistente")
+		return 0, nil
+	}
+	return n - 1, p.messages[n-1]
+}
+
+// list responde a LIST e UIDL, com ou sem argumento
+func (p *pop3Session) list(args []string, format func(int, *storage.Message) string) {
+	if len(args) > 0 {
+		i, msg := p.message(args)
+		if msg != nil {
+			p.ok(format(i, msg))
+		}
+		return
+	}
+
+	var lines []string
+	for i, msg := range p.messages {
+		if !p.deleted[i] {
+			lines = append(lines, format(i, msg))
+		}
+	}
+	p.ok("")
+	p.multiline(lines)
+}
+
+// markSeen marca uma mensagem recuperada como lida
+func (p *pop3Session) markSeen(i int, msg *storage.Message) {
+	if msg.Seen {
+		return
+	}
+	if err := p.server.store.UpdateMessageFlags(msg.ID, msg.Flags, true, msg.Deleted, msg.Draft); err != nil {
+		log.Printf("Erro ao marcar mensagem %d como lida: %v", msg.ID, err)
+		return
+	}
+	msg.Seen = true
+}
+
+// commit remove as mensagens marcadas com DELE (estado UPDATE)
+func (p *pop3Session) commit() error {
+	for i, msg := range p.messages {
+		if p.deleted[i] {
+			if err := p.server.store.DeleteMessage(msg.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeMessage envia o conteúdo da mensagem com byte-stuffing; lines limita
+// as linhas do corpo enviadas (negativo envia tudo)
+func (p *pop3Session) writeMessage(data []byte, lines int) {
+	var buf bytes.Buffer
+	inBody := false
+	for _, line := range strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n") {
+		if inBody && lines >= 0 {
+			if lines == 0 {
+				break
+			}
+			lines--
+		}
+		if !inBody && line == "" {
+			inBody = true
+		}
+		if strings.HasPrefix(line, ".") {
+			line = "." + line
+		}
+		buf.WriteString(line + "\r\n")
+	}
+	buf.WriteString(".\r\n")
+	p.conn.Write(buf.Bytes())
+}
+
+func (p *pop3Session) multiline(lines []string) {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line + "\r\n")
+	}
+	buf.WriteString(".\r\n")
+	p.conn.Write(buf.Bytes())
+}
+
+func (p *pop3Session) ok(msg string) {
+	if msg == "" {
+		p.conn.Write([]byte("+OK\r\n"))
+		return
+	}
+	p.conn.Write([]byte("+OK " + msg + "\r\n"))
+}
+
+func (p *pop3Session) err(msg string) {
+	p.conn.Write([]byte("-ERR " + msg + "\r\n"))
 }
 
 // StartPOP3Server inicia o servidor POP3
@@ -66,4 +335,4 @@ func StartPOP3Server(cfg *config.Config, store storage.Storage) error {
 
 		go server.handleConnection(conn)
 	}
-} 
\ No newline at end of file
+}
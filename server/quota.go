@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// Recursos de cota, com os nomes usados pela extensão IMAP QUOTA (RFC 9208)
+const (
+	quotaStorage = "STORAGE"
+	quotaMessage = "MESSAGE"
+)
+
+// quotaError indica que a operação excederia uma cota
+type quotaError struct {
+	root     string // Vazio para a cota do usuário; nome do domínio para a cota do domínio
+	resource string
+}
+
+func (e *quotaError) Error() string {
+	if e.root != "" {
+		return fmt.Sprintf("cota do domínio %s excedida (%s)", e.root, e.resource)
+	}
+	return fmt.Sprintf("cota excedida (%s)", e.resource)
+}
+
+// quotaResource representa o uso e o limite de um recurso
+type quotaResource struct {
+	name  string
+	usage int64
+	limit int64
+}
+
+// quotaRoot agrupa os recursos limitados de uma raiz de cota
+type quotaRoot struct {
+	name      string
+	resources []quotaResource
+}
+
+// QuotaChecker calcula o uso e aplica as cotas de usuários e domínios
+type QuotaChecker struct {
+	store storage.Storage
+	cfg   *config.Config
+}
+
+// NewQuotaChecker cria um novo verificador de cotas
+func NewQuotaChecker(store storage.Storage, cfg *config.Config) *QuotaChecker {
+	return &QuotaChecker{
+		store: store,
+		cfg:   cfg,
+	}
+}
+
+// Roots retorna as raízes de cota com limites aplicáveis ao usuário: a do
+// próprio usuário (nome vazio) e a do domínio virtual, quando houver
+func (q *QuotaChecker) Roots(user *storage.User) ([]*quotaRoot, error) {
+	var roots []*quotaRoot
+
+	bytesLimit, messagesLimit := user.QuotaBytes, user.QuotaMessages
+	if bytesLimit == 0 {
+		bytesLimit = q.cfg.Quota.DefaultBytes
+	}
+	if messagesLimit == 0 {
+		messagesLimit = q.cfg.Quota.DefaultMessages
+	}
+	if bytesLimit > 0 || messagesLimit > 0 {
+		usage, err := q.store.GetUserUsage(user.ID)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, newQuotaRoot("", usage, bytesLimit, messagesLimit))
+	}
+
+	if user.DomainID != 0 {
+		domain, err := q.store.GetDomainByID(user.DomainID)
+		if err != nil {
+			return nil, err
+		}
+		if domain.QuotaBytes > 0 || domain.QuotaMessages > 0 {
+			usage, err := q.store.GetDomainUsage(domain.ID)
+			if err != nil {
+				return nil, err
+			}
+			roots = append(roots, newQuotaRoot(domain.Name, usage, domain.QuotaBytes, domain.QuotaMessages))
+		}
+	}
+
+	return roots, nil
+}
+
+func newQuotaRoot(name string, usage *storage.Usage, bytesLimit, messagesLimit int64) *quotaRoot {
+	root := &quotaRoot{name: name}
+	if bytesLimit > 0 {
+		root.resources = append(root.resources, quotaResource{name: quotaStorage, usage: usage.Bytes, limit: bytesLimit})
+	}
+	if messagesLimit > 0 {
+		root.resources = append(root.resources, quotaResource{name: quotaMessage, usage: usage.Messages, limit: messagesLimit})
+	}
+	return root
+}
+
+// Check verifica se o usuário pode receber mais count mensagens somando size
+// bytes. Retorna *quotaError quando alguma cota seria excedida.
+func (q *QuotaChecker) Check(user *storage.User, size, count int64) error {
+	roots, err := q.Roots(user)
+	if err != nil {
+		return fmt.Errorf("falha ao verificar cota: %w", err)
+	}
+
+	for _, root := range roots {
+		for _, res := range root.resources {
+			added := size
+			if res.name == quotaMessage {
+				added = count
+			}
+			if res.usage+added > res.limit {
+				return &quotaError{root: root.name, resource: res.name}
+			}
+		}
+	}
+	return nil
+}
+
+// quotaWarnings avisa o usuário quando a entrega de count mensagens somando
+// size bytes fez o uso ultrapassar um dos percentuais configurados. O aviso é
+// gravado diretamente na INBOX, sem passar pela verificação de cota.
+func (d *Delivery) quotaWarnings(rcpt *localRecipient, size, count int64) {
+	if len(d.quota.cfg.Quota.WarningThresholds) == 0 {
+		return
+	}
+
+	roots, err := d.quota.Roots(rcpt.user)
+	if err != nil {
+		log.Printf("Erro ao calcular cota de %s: %v", rcpt.user.Email, err)
+		return
+	}
+
+	for _, root := range roots {
+		for _, res := range root.resources {
+			added := size
+			if res.name == quotaMessage {
+				added = count
+			}
+			threshold := crossedThreshold(d.quota.cfg.Quota.WarningThresholds, res.usage-added, res.usage, res.limit)
+			if threshold > 0 {
+				d.sendQuotaWarning(rcpt, root, res, threshold)
+			}
+		}
+	}
+}
+
+// crossedThreshold retorna o maior percentual ultrapassado ao passar o uso de
+// before para after, ou zero se nenhum foi ultrapassado
+func crossedThreshold(thresholds []int, before, after, limit int64) int {
+	crossed := 0
+	for _, t := range thresholds {
+		level := limit * int64(t)
+		if before*100 < level && after*100 >= level && t > crossed {
+			crossed = t
+		}
+	}
+	return crossed
+}
+
+func (d *Delivery) sendQuotaWarning(rcpt *localRecipient, root *quotaRoot, res quotaResource, threshold int) {
+	scope := "Sua caixa postal"
+	if root.name != "" {
+		scope = "O domínio " + root.name
+	}
+	usage := fmt.Sprintf("%d de %d mensagens", res.usage, res.limit)
+	if res.name == quotaStorage {
+		usage = fmt.Sprintf("%.1f de %.1f MB", float64(res.usage)/(1<<20), float64(res.limit)/(1<<20))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", d.hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", rcpt.user.Email)
+	fmt.Fprintf(&b, "Subject: Aviso de cota: %d%% utilizado\r\n", threshold)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("Auto-Submitted: auto-generated\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "%s atingiu %d%% da cota (%s).\r\n", scope, threshold, usage)
+	b.WriteString("Exclua mensagens antigas para continuar recebendo emails.\r\n")
+	data := []byte(b.String())
+
+	inbox, err := d.store.GetMailbox(rcpt.user.ID, "INBOX")
+	if err != nil {
+		log.Printf("Erro ao obter caixa de entrada de %s: %v", rcpt.user.Email, err)
+		return
+	}
+	env := &envelope{to: []string{rcpt.user.Email}}
+	if _, err := d.storeMessage(env, inbox, data, nil); err != nil {
+		log.Printf("Erro ao gravar aviso de cota para %s: %v", rcpt.user.Email, err)
+	}
+}
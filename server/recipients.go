@@ -0,0 +1,193 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// maxAliasDepth limita a expansão recursiva de aliases para evitar ciclos
+const maxAliasDepth = 10
+
+// localRecipient representa um destino local resolvido a partir de um endereço
+type localRecipient struct {
+	user    *storage.User
+	folder  string // Caixa de destino; vazio significa INBOX
+	address string // Endereço de destino original (RCPT TO)
+}
+
+// RecipientResolver resolve endereços de destino em usuários locais,
+// considerando domínios virtuais, aliases, catch-all por domínio e
+// subendereçamento (usuario+tag)
+type RecipientResolver struct {
+	store     storage.Storage
+	delimiter string
+	folders   bool
+}
+
+// NewRecipientResolver cria um novo resolvedor de destinatários
+func NewRecipientResolver(store storage.Storage, cfg *config.Config) *RecipientResolver {
+	return &RecipientResolver{
+		store:     store,
+		delimiter: cfg.SMTP.RecipientDelimiter,
+		folders:   cfg.SMTP.SubaddressFolders,
+	}
+}
+
+// Resolve retorna os destinos locais de um endereço
+func (r *RecipientResolver) Resolve(address string) ([]*localRecipient, error) {
+	seen := make(map[string]bool)
+	recipients, err := r.resolve(normalizeAddress(address), 0, seen)
+	if err != nil {
+		return nil, err
+	}
+	if len(recipients) == 0 {
+		return nil, storage.ErrUserNotFound
+	}
+
+	recipients = dedupRecipients(recipients)
+	for _, rcpt := range recipients {
+		rcpt.address = normalizeAddress(address)
+	}
+	return recipients, nil
+}
+
+func (r *RecipientResolver) resolve(address string, depth int, seen map[string]bool) ([]*localRecipient, error) {
+	if depth > maxAliasDepth {
+		return nil, fmt.Errorf("expansão de alias muito profunda para %s", address)
+	}
+	if seen[address] {
+		return nil, nil
+	}
+	seen[address] = true
+
+	local, domain, ok := splitAddress(address)
+	if !ok {
+		return nil, fmt.Errorf("endereço inválido: %s", address)
+	}
+
+	// Domínios virtuais desativados não recebem mensagens
+	hosted, err := r.store.GetDomain(domain)
+	if err != nil && !errors.Is(err, storage.ErrDomainNotFound) {
+		return nil, err
+	}
+	if hosted != nil && !hosted.Enabled {
+		return nil, nil
+	}
+
+	// Endereço exato de um usuário
+	user, err := r.store.GetUserByEmail(address)
+	if err == nil {
+		return []*localRecipient{{user: user}}, nil
+	} else if !errors.Is(err, storage.ErrUserNotFound) {
+		return nil, err
+	}
+
+	// Alias exato
+	alias, err := r.store.GetAlias(address)
+	if err == nil {
+		return r.expandAlias(alias, depth, seen)
+	} else if !errors.Is(err, storage.ErrAliasNotFound) {
+		return nil, err
+	}
+
+	// Subendereçamento: usuario+tag@dominio
+	if r.delimiter != "" {
+		if i := strings.Index(local, r.delimiter); i > 0 {
+			tag := local[i+len(r.delimiter):]
+			recipients, err := r.resolve(local[:i]+"@"+domain, depth+1, seen)
+			if err != nil {
+				return nil, err
+			}
+			if r.folders && tag != "" {
+				for _, rcpt := range recipients {
+					if rcpt.folder == "" {
+						rcpt.folder = tag
+					}
+				}
+			}
+			if len(recipients) > 0 {
+				return recipients, nil
+			}
+		}
+	}
+
+	// Catch-all do domínio
+	alias, err = r.store.GetAlias("@" + domain)
+	if err == nil {
+		return r.expandAlias(alias, depth, seen)
+	} else if !errors.Is(err, storage.ErrAliasNotFound) {
+		return nil, err
+	}
+	if hosted != nil && hosted.CatchAll != "" {
+		return r.resolve(normalizeAddress(hosted.CatchAll), depth+1, seen)
+	}
+
+	return nil, nil
+}
+
+// expandAlias resolve os destinos de um alias
+func (r *RecipientResolver) expandAlias(alias *storage.Alias, depth int, seen map[string]bool) ([]*localRecipient, error) {
+	var recipients []*localRecipient
+
+	if alias.UserID != 0 {
+		user, err := r.store.GetUserByID(alias.UserID)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao obter usuário do alias %s: %w", alias.Address, err)
+		}
+		recipients = append(recipients, &localRecipient{user: user})
+	}
+
+	for _, target := range strings.Split(alias.Targets, ",") {
+		target = normalizeAddress(target)
+		if target == "" {
+			continue
+		}
+		expanded, err := r.resolve(target, depth+1, seen)
+		if err != nil {
+			return nil, err
+		}
+		if len(expanded) == 0 {
+			log.Printf("Destino %s do alias %s não é local e foi ignorado", target, alias.Address)
+		}
+		recipients = append(recipients, expanded...)
+	}
+
+	return recipients, nil
+}
+
+// dedupRecipients remove destinos repetidos (mesmo usuário e pasta)
+func dedupRecipients(recipients []*localRecipient) []*localRecipient {
+	seen := make(map[string]bool)
+	var result []*localRecipient
+	for _, rcpt := range recipients {
+		key := fmt.Sprintf("%d/%s", rcpt.user.ID, rcpt.folder)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, rcpt)
+	}
+	return result
+}
+
+// normalizeAddress remove espaços e colchetes angulares e converte para minúsculas
+func normalizeAddress(address string) string {
+	address = strings.TrimSpace(address)
+	address = strings.TrimPrefix(address, "<")
+	address = strings.TrimSuffix(address, ">")
+	return strings.ToLower(address)
+}
+
+// splitAddress separa um endereço em parte local e domínio
+func splitAddress(address string) (local, domain string, ok bool) {
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,59 +10,151 @@ import (
 
 	"github.com/carloslauriano/simpleEmail/config"
 	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
 // SMTPBackend implementa a interface smtp.Backend
 type SMTPBackend struct {
-	store storage.Storage
+	store     storage.Storage
+	delivery  *Delivery
+	spam      *SpamFilter // nil quando a verificação de spam está desabilitada
+	antivirus *Antivirus  // nil quando a verificação de vírus está desabilitada
 }
 
 // NewSMTPBackend cria um novo backend SMTP
-func NewSMTPBackend(store storage.Storage) *SMTPBackend {
+func NewSMTPBackend(store storage.Storage, delivery *Delivery) *SMTPBackend {
 	return &SMTPBackend{
-		store: store,
+		store:    store,
+		delivery: delivery,
 	}
 }
 
-// Login implementa a autenticação SMTP
-func (b *SMTPBackend) Login(state smtp.Session, username, password string) (smtp.Session, error) {
-	user, err := b.store.AuthenticateUser(username, password)
-	if err != nil {
-		return nil, fmt.Errorf("autenticação falhou: %w", err)
-	}
-
+// NewSession cria uma nova sessão para uma conexão SMTP. Sessões sem
+// autenticação podem apenas entregar mensagens para destinatários locais.
+func (b *SMTPBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	return &SMTPSession{
 		backend: b,
-		user:    user,
+		conn:    c,
 	}, nil
 }
 
-// AnonymousLogin não é permitido
-func (b *SMTPBackend) AnonymousLogin(state smtp.Session) (smtp.Session, error) {
-	return nil, fmt.Errorf("login anônimo não permitido")
-}
-
 // SMTPSession implementa a interface smtp.Session
 type SMTPSession struct {
 	backend *SMTPBackend
+	conn    *smtp.Conn
 	user    *storage.User
 	from    string
+	size    int64 // Tamanho anunciado em MAIL FROM SIZE=, quando informado
 	to      []string
+	rcpts   []*localRecipient
+	remote  []string // Destinatários externos (apenas sessões autenticadas)
+	bounces []string // Remetentes originais de bounces recebidos em endereços SRS
+	dsn     *dsnRequest
+}
+
+// AuthMechanisms lista os mecanismos de autenticação SMTP aceitos
+func (s *SMTPSession) AuthMechanisms() []string {
+	return []string{sasl.Plain}
+}
+
+// Auth implementa a autenticação SMTP
+func (s *SMTPSession) Auth(mech string) (sasl.Server, error) {
+	return sasl.NewPlainServer(func(identity, username, password string) error {
+		if identity != "" && identity != username {
+			return smtp.ErrAuthFailed
+		}
+		user, err := s.backend.store.AuthenticateUser(username, password)
+		if err != nil {
+			return smtp.ErrAuthFailed
+		}
+
+		s.user = user
+		return nil
+	}), nil
 }
 
 // Mail inicia uma nova transação de email
-func (s *SMTPSession) Mail(from string, opts smtp.MailOptions) error {
+func (s *SMTPSession) Mail(from string, opts *smtp.MailOptions) error {
 	s.from = from
+	s.dsn = &dsnRequest{rcpts: make(map[string]*smtp.RcptOptions)}
+	if opts != nil {
+		if !validEnvID(opts.EnvelopeID) {
+			return &smtp.SMTPError{
+				Code:         501,
+				EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+				Message:      "Parâmetro ENVID inválido",
+			}
+		}
+		s.size = opts.Size
+		s.dsn.ret = opts.Return
+		s.dsn.envID = opts.EnvelopeID
+	}
 	return nil
 }
 
 // Rcpt adiciona um destinatário
-func (s *SMTPSession) Rcpt(to string) error {
+func (s *SMTPSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	if original, ok := s.backend.delivery.reverseSRS(to); ok {
+		s.to = append(s.to, to)
+		s.bounces = append(s.bounces, original)
+		return nil
+	}
+
+	rcpts, err := s.backend.delivery.resolver.Resolve(to)
+	if errors.Is(err, storage.ErrUserNotFound) {
+		if s.user != nil {
+			s.to = append(s.to, to)
+			s.remote = append(s.remote, to)
+			s.addDSN(to, opts)
+			return nil
+		}
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Destinatário desconhecido",
+		}
+	} else if err != nil {
+		log.Printf("Erro ao resolver destinatário %s: %v", to, err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Falha temporária ao resolver destinatário",
+		}
+	}
+
+	for _, rcpt := range rcpts {
+		err := s.backend.delivery.quota.Check(rcpt.user, s.size, 1)
+		var quota *quotaError
+		if errors.As(err, &quota) {
+			return &smtp.SMTPError{
+				Code:         452,
+				EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+				Message:      "Caixa postal cheia",
+			}
+		} else if err != nil {
+			log.Printf("Erro ao verificar cota de %s: %v", rcpt.user.Email, err)
+			return &smtp.SMTPError{
+				Code:         451,
+				EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+				Message:      "Falha temporária ao verificar cota",
+			}
+		}
+	}
+
 	s.to = append(s.to, to)
+	s.rcpts = append(s.rcpts, rcpts...)
+	s.addDSN(to, opts)
 	return nil
 }
 
+// addDSN guarda os parâmetros NOTIFY e ORCPT do destinatário
+func (s *SMTPSession) addDSN(to string, opts *smtp.RcptOptions) {
+	if opts != nil && s.dsn != nil && (len(opts.Notify) > 0 || opts.OriginalRecipient != "") {
+		s.dsn.rcpts[strings.ToLower(to)] = opts
+	}
+}
+
 // Data processa o conteúdo do email
 func (s *SMTPSession) Data(r io.Reader) error {
 	// Ler o conteúdo do email
@@ -70,35 +163,100 @@ func (s *SMTPSession) Data(r io.Reader) error {
 		return fmt.Errorf("falha ao ler email: %w", err)
 	}
 
-	// Obter a caixa de entrada do usuário
-	mailbox, err := s.backend.store.GetMailbox(s.user.ID, "INBOX")
+	env := &envelope{
+		from: s.from,
+		to:   s.to,
+		dsn:  s.dsn,
+	}
+
+	body, deliver, err := s.checkVirus(body)
+	if err != nil {
+		return err
+	}
+	if !deliver {
+		return nil
+	}
+
+	body, err = s.checkSpam(env, body)
 	if err != nil {
-		return fmt.Errorf("falha ao obter caixa de entrada: %w", err)
+		return err
+	}
+
+	// Os destinatários externos e os bounces são enfileirados antes da
+	// entrega local. Um erro só é devolvido ao cliente enquanto nenhum
+	// destinatário recebeu a mensagem, para que a nova tentativa não a
+	// duplique; depois disso, as falhas são notificadas ao remetente.
+	remote := &envelope{from: s.from, to: s.remote, dsn: s.dsn}
+	if _, err := s.backend.delivery.outbound.Enqueue(remote, s.remote, body); err != nil {
+		return fmt.Errorf("falha ao enfileirar mensagem: %w", err)
 	}
+	accepted := len(s.remote) > 0
 
-	// Criar a mensagem
-	msg := &storage.Message{
-		MailboxID: mailbox.ID,
-		From:      s.from,
-		To:        strings.Join(s.to, ","),
-		Date:      time.Now(),
-		Body:      string(body),
-		RawData:   body,
-		Size:      len(body),
+	// Bounces para endereços SRS voltam ao remetente original sem remetente de envelope
+	if err := s.backend.delivery.Submit("", s.bounces, body); err != nil {
+		if !accepted {
+			return fmt.Errorf("falha ao enfileirar bounce: %w", err)
+		}
+		log.Printf("Erro ao enfileirar bounce para %s: %v", strings.Join(s.bounces, ", "), err)
 	}
+	accepted = accepted || len(s.bounces) > 0
 
-	// Salvar a mensagem
-	if err := s.backend.store.CreateMessage(msg); err != nil {
-		return fmt.Errorf("falha ao salvar mensagem: %w", err)
+	arrival := time.Now()
+	rcpts := dedupRecipients(s.rcpts)
+	var rejects []*rejectError
+	var delivered []*dsnRecipient
+	notified := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		err := s.backend.delivery.deliverLocal(env, rcpt, body)
+		var reject *rejectError
+		if errors.As(err, &reject) {
+			rejects = append(rejects, reject)
+
+			// Com outros destinatários a mensagem já foi aceita; a recusa
+			// segue como notificação ao remetente
+			if len(rcpts) > 1 || len(s.remote) > 0 || len(s.bounces) > 0 {
+				s.backend.delivery.sendRejection(env, rcpt, reject, body)
+			}
+		} else if err != nil && !accepted {
+			return err
+		} else if err != nil {
+			s.backend.delivery.localFailure(env, rcpt, err, body)
+		} else if !notified[rcpt.address] && s.dsn.notify(rcpt.address, smtp.DSNNotifySuccess) {
+			notified[rcpt.address] = true
+			delivered = append(delivered, &dsnRecipient{address: rcpt.address, status: "2.0.0"})
+		}
+		accepted = true
+	}
+
+	// Recusa com um único destinatário é informada na própria transação
+	if len(rejects) == 1 && len(rcpts) == 1 && len(s.remote) == 0 && len(s.bounces) == 0 {
+		if rejects[0].quota {
+			return &smtp.SMTPError{
+				Code:         552,
+				EnhancedCode: smtp.EnhancedCode{5, 2, 2},
+				Message:      rejects[0].reason,
+			}
+		}
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      rejects[0].reason,
+		}
 	}
 
+	s.backend.delivery.sendDSN(env, dsnDelivered, delivered, body, arrival)
 	return nil
 }
 
 // Reset limpa o estado da sessão
 func (s *SMTPSession) Reset() {
 	s.from = ""
+	s.size = 0
 	s.to = nil
+	s.rcpts = nil
+	s.remote = nil
+	s.bounces = nil
+	s.dsn = nil
 }
 
 // Logout finaliza a sessão
@@ -107,8 +265,10 @@ func (s *SMTPSession) Logout() error {
 }
 
 // StartSMTPServer inicia o servidor SMTP
-func StartSMTPServer(cfg *config.Config, store storage.Storage) error {
-	be := NewSMTPBackend(store)
+func StartSMTPServer(cfg *config.Config, store storage.Storage, delivery *Delivery) error {
+	be := NewSMTPBackend(store, delivery)
+	be.spam = NewSpamFilter(cfg)
+	be.antivirus = NewAntivirus(cfg)
 	s := smtp.NewServer(be)
 
 	s.Addr = fmt.Sprintf("%s:%d", cfg.SMTP.Address, cfg.SMTP.Port)
@@ -118,7 +278,8 @@ func StartSMTPServer(cfg *config.Config, store storage.Storage) error {
 	s.MaxMessageBytes = 1024 * 1024 // 1MB
 	s.MaxRecipients = 50
 	s.AllowInsecureAuth = true
+	s.EnableDSN = true
 
 	log.Printf("Iniciando servidor SMTP em %s", s.Addr)
 	return s.ListenAndServe()
-} 
\ No newline at end of file
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-smtp"
+)
+
+const smtpTestMessage = "From: alice@localhost\r\n" +
+	"Subject: Teste\r\n" +
+	"Message-ID: <teste@localhost>\r\n" +
+	"\r\n" +
+	"Corpo\r\n"
+
+// smtpTransaction executa MAIL, RCPT e DATA, sem interromper o teste em erros
+func smtpTransaction(s *SMTPSession, from string, to ...string) error {
+	s.Reset()
+	if err := s.Mail(from, &smtp.MailOptions{}); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := s.Rcpt(rcpt, &smtp.RcptOptions{}); err != nil {
+			return err
+		}
+	}
+	return s.Data(strings.NewReader(smtpTestMessage))
+}
+
+func TestDataQueuesBeforeLocalDelivery(t *testing.T) {
+	cfg := newTestConfig(t)
+	store, alice := newTestStorage(t, cfg)
+	bob := &storage.User{Username: "bob", Password: "senha", Email: "bob@localhost"}
+	if err := store.CreateUser(bob); err != nil {
+		t.Fatal(err)
+	}
+	// Sem a INBOX, a entrega local para bob falha
+	inbox, err := store.GetMailbox(bob.ID, "INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteMailbox(inbox.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	s := newTestSession(t, cfg, store)
+	s.user = alice
+
+	// Só com bob, nenhum destinatário recebeu a mensagem e o cliente pode tentar de novo
+	if err := smtpTransaction(s, "alice@localhost", "bob@localhost"); err == nil {
+		t.Fatal("falha na entrega local sem outros destinatários não devolvida ao cliente")
+	}
+	if pending := pendingOutbound(t, store); len(pending) != 0 {
+		t.Fatalf("%d mensagens na fila, esperado nenhuma", len(pending))
+	}
+
+	// Com um destinatário externo já enfileirado, a falha vira uma notificação
+	if err := smtpTransaction(s, "alice@localhost", "carol@remote.example", "bob@localhost"); err != nil {
+		t.Fatalf("transação devolveu %v depois de enfileirar o destinatário externo", err)
+	}
+	pending := pendingOutbound(t, store)
+	if len(pending) != 1 || !reflect.DeepEqual(pending[0].Recipients, []string{"carol@remote.example"}) {
+		t.Fatalf("fila = %+v, esperado uma mensagem para carol@remote.example", pending)
+	}
+
+	messages := mailboxMessages(t, store, alice, "INBOX")
+	if len(messages) != 1 {
+		t.Fatalf("%d mensagens para alice, esperado um relatório de falha", len(messages))
+	}
+	report := string(messages[0].RawData)
+	for _, want := range []string{"Final-Recipient: rfc822; bob@localhost", "Action: failed", "Status: 5.3.0"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("relatório sem %q:\n%s", want, report)
+		}
+	}
+}
+
+func TestMailEnvelopeID(t *testing.T) {
+	cfg := newTestConfig(t)
+	store, _ := newTestStorage(t, cfg)
+	s := newTestSession(t, cfg, store)
+
+	tests := []struct {
+		envID string
+		ok    bool
+	}{
+		{"", true},
+		{"abc+=123 xyz", true},
+		{strings.Repeat("a", maxEnvIDLength), true},
+		{strings.Repeat("a", maxEnvIDLength+1), false},
+		{"abc\r\nBcc: mallory@example.com", false},
+		{"relatório", false},
+	}
+	for _, tt := range tests {
+		s.Reset()
+		err := s.Mail("bob@remote.example", &smtp.MailOptions{EnvelopeID: tt.envID})
+		var smtpErr *smtp.SMTPError
+		if tt.ok && err != nil {
+			t.Errorf("ENVID %q recusado: %v", tt.envID, err)
+		} else if !tt.ok && (!errors.As(err, &smtpErr) || smtpErr.Code != 501) {
+			t.Errorf("ENVID %q: erro %v, esperado 501", tt.envID, err)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// Protocolos aceitos para a verificação de spam
+const (
+	spamRspamd = "rspamd"
+	spamSpamd  = "spamd"
+)
+
+// spamResult é o resultado da verificação de uma mensagem
+type spamResult struct {
+	score    float64
+	required float64  // Pontuação a partir da qual a mensagem é spam
+	symbols  []string // Regras que pontuaram a mensagem
+	spam     bool
+	reject   bool
+}
+
+// spamRequest reúne os dados da transação SMTP enviados ao daemon junto
+// com a mensagem
+type spamRequest struct {
+	from  string
+	rcpts []string
+	ip    string // Endereço IP do cliente SMTP
+	helo  string
+}
+
+// SpamFilter verifica mensagens em um daemon rspamd (protocolo HTTP) ou
+// spamd (protocolo SPAMC do SpamAssassin), acessado por TCP ou socket Unix
+type SpamFilter struct {
+	protocol  string
+	address   string
+	timeout   time.Duration
+	maxSize   int
+	addHeader float64
+	reject    float64
+	client    *http.Client
+}
+
+// NewSpamFilter cria o filtro de spam, ou retorna nil quando a verificação
+// está desabilitada
+func NewSpamFilter(cfg *config.Config) *SpamFilter {
+	if !cfg.Spam.Enabled {
+		return nil
+	}
+
+	protocol := strings.ToLower(cfg.Spam.Protocol)
+	if protocol == "" {
+		protocol = spamRspamd
+	}
+	timeout := cfg.Spam.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = 15
+	}
+	maxSize := cfg.Spam.MaxSize
+	if maxSize <= 0 {
+		maxSize = 1024 * 1024
+	}
+
+	f := &SpamFilter{
+		protocol:  protocol,
+		address:   cfg.Spam.Address,
+		timeout:   time.Duration(timeout) * time.Second,
+		maxSize:   maxSize,
+		addHeader: cfg.Spam.AddHeaderScore,
+		reject:    cfg.Spam.RejectScore,
+	}
+	if f.address == "" {
+		f.address = "127.0.0.1:11333"
+		if protocol == spamSpamd {
+			f.address = "127.0.0.1:783"
+		}
+	}
+
+	transport := &http.Transport{}
+	if isUnixSocket(f.address) {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", f.address)
+		}
+	}
+	f.client = &http.Client{Timeout: f.timeout, Transport: transport}
+	return f
+}
+
+// isUnixSocket informa se o endereço é o caminho de um socket Unix
+func isUnixSocket(address string) bool {
+	return strings.HasPrefix(address, "/")
+}
+
+// Check verifica a mensagem no daemon configurado. Mensagens acima do
+// tamanho máximo não são verificadas e resultam em nil.
+func (f *SpamFilter) Check(req *spamRequest, data []byte) (*spamResult, error) {
+	if len(data) > f.maxSize {
+		return nil, nil
+	}
+
+	var result *spamResult
+	var err error
+	switch f.protocol {
+	case spamRspamd:
+		result, err = f.checkRspamd(req, data)
+	case spamSpamd:
+		result, err = f.checkSpamd(data)
+	default:
+		return nil, fmt.Errorf("protocolo de verificação de spam desconhecido: %s", f.protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.addHeader > 0 {
+		result.required = f.addHeader
+	}
+	result.spam = result.required > 0 && result.score >= result.required
+	result.reject = f.reject > 0 && result.score >= f.reject
+	return result, nil
+}
+
+// rspamdResponse é a resposta do endpoint /checkv2 do rspamd
+type rspamdResponse struct {
+	Score         float64            `json:"score"`
+	RequiredScore float64            `json:"required_score"`
+	Thresholds    map[string]float64 `json:"thresholds"`
+	Symbols       map[string]struct {
+		Score float64 `json:"score"`
+	} `json:"symbols"`
+}
+
+func (f *SpamFilter) checkRspamd(req *spamRequest, data []byte) (*spamResult, error) {
+	url := f.address
+	if isUnixSocket(url) {
+		url = "http://localhost"
+	} else if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+
+	httpReq, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(url, "/")+"/checkv2", bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("falha ao criar requisição ao rspamd: %w", err)
+	}
+	if req.from != "" {
+		httpReq.Header.Set("From", req.from)
+	}
+	for _, rcpt := range req.rcpts {
+		httpReq.Header.Add("Rcpt", rcpt)
+	}
+	if req.ip != "" {
+		httpReq.Header.Set("IP", req.ip)
+	}
+	if req.helo != "" {
+		httpReq.Header.Set("Helo", req.helo)
+	}
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao consultar rspamd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd respondeu HTTP %d", resp.StatusCode)
+	}
+
+	var r rspamdResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("resposta inválida do rspamd: %w", err)
+	}
+
+	result := &spamResult{score: r.Score, required: r.RequiredScore}
+	if threshold, ok := r.Thresholds["add header"]; ok {
+		result.required = threshold
+	}
+	for name, symbol := range r.Symbols {
+		if symbol.Score != 0 {
+			result.symbols = append(result.symbols, name)
+		}
+	}
+	sort.Strings(result.symbols)
+	return result, nil
+}
+
+func (f *SpamFilter) checkSpamd(data []byte) (*spamResult, error) {
+	network := "tcp"
+	if isUnixSocket(f.address) {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, f.address, f.timeout)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao conectar ao spamd: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(f.timeout))
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "SYMBOLS SPAMC/1.5\r\nContent-length: %d\r\n\r\n", len(data))
+	w.Write(data)
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("falha ao enviar mensagem ao spamd: %w", err)
+	}
+	if tcp, ok := conn.(interface{ CloseWrite() error }); ok {
+		tcp.CloseWrite()
+	}
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler resposta do spamd: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "SPAMD/") || fields[1] != "0" {
+		return nil, fmt.Errorf("spamd respondeu com erro: %s", strings.TrimSpace(line))
+	}
+
+	result := &spamResult{}
+	found := false
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("falha ao ler resposta do spamd: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || !strings.EqualFold(name, "Spam") {
+			continue
+		}
+		// Spam: True ; 15.3 / 5.0
+		_, scores, _ := strings.Cut(value, ";")
+		score, required, _ := strings.Cut(scores, "/")
+		result.score, err = strconv.ParseFloat(strings.TrimSpace(score), 64)
+		if err != nil {
+			return nil, fmt.Errorf("pontuação inválida do spamd: %s", line)
+		}
+		result.required, _ = strconv.ParseFloat(strings.TrimSpace(required), 64)
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("resposta do spamd sem cabeçalho Spam")
+	}
+
+	symbols, _ := io.ReadAll(io.LimitReader(r, 64*1024))
+	for _, symbol := range strings.Split(string(symbols), ",") {
+		if symbol = strings.TrimSpace(symbol); symbol != "" {
+			result.symbols = append(result.symbols, symbol)
+		}
+	}
+	return result, nil
+}
+
+// annotateSpam remove da mensagem os cabeçalhos X-Spam-* recebidos, que não
+// são confiáveis, e acrescenta os cabeçalhos com o resultado da verificação
+func annotateSpam(data []byte, result *spamResult) []byte {
+	data = stripSpamHeaders(data)
+
+	var b bytes.Buffer
+	verdict := "No"
+	if result.spam {
+		verdict = "Yes"
+		b.WriteString("X-Spam-Flag: YES\r\n")
+	}
+	fmt.Fprintf(&b, "X-Spam-Score: %.2f\r\n", result.score)
+	status := fmt.Sprintf("X-Spam-Status: %s, score=%.2f required=%.2f", verdict, result.score, result.required)
+	if len(result.symbols) > 0 {
+		status += " tests="
+		line := len(status)
+		for i, symbol := range result.symbols {
+			if i > 0 {
+				status += ","
+				line++
+			}
+			if line+len(symbol) > 76 {
+				status += "\r\n\t"
+				line = 1
+			}
+			status += symbol
+			line += len(symbol)
+		}
+	}
+	b.WriteString(status + "\r\n")
+	b.Write(data)
+	return b.Bytes()
+}
+
+// stripSpamHeaders remove os cabeçalhos X-Spam-* da mensagem
+func stripSpamHeaders(data []byte) []byte {
+	return stripHeaders(data, "x-spam-")
+}
+
+// checkSpam verifica a mensagem recebida sem autenticação. Retorna a
+// mensagem com os cabeçalhos X-Spam-* e marca o envelope quando ela é spam.
+// Falhas do daemon não impedem a entrega, mas os cabeçalhos X-Spam-*
+// recebidos são removidos mesmo assim.
+func (s *SMTPSession) checkSpam(env *envelope, body []byte) ([]byte, error) {
+	filter := s.backend.spam
+	if filter == nil || s.user != nil || len(s.rcpts) == 0 {
+		return body, nil
+	}
+
+	req := &spamRequest{from: s.from, rcpts: s.to}
+	if s.conn != nil {
+		req.helo = s.conn.Hostname()
+		if addr, ok := s.conn.Conn().RemoteAddr().(*net.TCPAddr); ok {
+			req.ip = addr.IP.String()
+		}
+	}
+
+	result, err := filter.Check(req, body)
+	if err != nil {
+		log.Printf("Erro na verificação de spam da mensagem de %s: %v", s.from, err)
+		return stripSpamHeaders(body), nil
+	}
+	if result == nil {
+		return stripSpamHeaders(body), nil
+	}
+
+	if result.reject {
+		log.Printf("Mensagem de %s recusada como spam (pontuação %.2f)", s.from, result.score)
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Mensagem recusada como spam",
+		}
+	}
+	env.spam = result.spam
+	return annotateSpam(body, result), nil
+}
+
+// junkMailbox obtém a caixa de spam do usuário (uso especial \Junk), ou nil
+// se ela não existir
+func (d *Delivery) junkMailbox(rcpt *localRecipient) (*storage.Mailbox, error) {
+	mailboxes, err := d.store.ListMailboxes(rcpt.user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar caixas de correio: %w", err)
+	}
+	for _, mb := range mailboxes {
+		if mb.SpecialUse == `\Junk` && !mb.NoSelect {
+			return mb, nil
+		}
+	}
+	return nil, nil
+}
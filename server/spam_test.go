@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-smtp"
+)
+
+// spoofedMessage traz cabeçalhos X-Spam-* forjados pelo remetente, um deles
+// dobrado em duas linhas
+const spoofedMessage = "From: x@remote.test\r\n" +
+	"To: alice@localhost\r\n" +
+	"X-Spam-Flag: NO\r\n" +
+	"X-Spam-Status: No, score=-100.00\r\n" +
+	"\trequired=5.00\r\n" +
+	"Subject: %s\r\n" +
+	"\r\n" +
+	"corpo\r\n"
+
+// testScore é a pontuação dos daemons falsos, escolhida pelo assunto
+func testScore(body []byte) float64 {
+	switch {
+	case strings.Contains(string(body), "Subject: reject"):
+		return 20
+	case strings.Contains(string(body), "Subject: spam"):
+		return 8
+	}
+	return 1
+}
+
+// fakeRspamd inicia um rspamd falso que responde /checkv2 com os limiares
+// "add header" 6 e "reject" 15
+func fakeRspamd(t *testing.T, requests chan<- *http.Request) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/checkv2" || r.Method != http.MethodPost {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if requests != nil {
+			requests <- r
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"score":          testScore(body),
+			"required_score": 15,
+			"thresholds":     map[string]float64{"add header": 6, "reject": 15},
+			"symbols": map[string]interface{}{
+				"R_SPF_FAIL": map[string]float64{"score": 1},
+				"ZERO_SCORE": map[string]float64{"score": 0},
+			},
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// spamdRequest é um pedido recebido pelo spamd falso
+type spamdRequest struct {
+	command string
+	length  int
+	body    []byte
+}
+
+// fakeSpamd inicia um spamd falso que responde SYMBOLS pelo protocolo SPAMC
+func fakeSpamd(t *testing.T, requests chan<- *spamdRequest) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req := &spamdRequest{}
+				line, _ := r.ReadString('\n')
+				req.command = strings.TrimSpace(line)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSpace(line)
+					if line == "" {
+						break
+					}
+					if name, value, ok := strings.Cut(line, ":"); ok && strings.EqualFold(name, "Content-length") {
+						req.length, _ = strconv.Atoi(strings.TrimSpace(value))
+					}
+				}
+				req.body = make([]byte, req.length)
+				if _, err := io.ReadFull(r, req.body); err != nil {
+					return
+				}
+				if requests != nil {
+					requests <- req
+				}
+
+				score := testScore(req.body)
+				symbols := "BAYES_99,URIBL_BLACK"
+				fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %v ; %.1f / 5.0\r\n\r\n%s",
+					len(symbols), score >= 5, score, symbols)
+			}(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// checkSpamHeaders verifica que os cabeçalhos forjados foram removidos e
+// que restou apenas o resultado da verificação
+func checkSpamHeaders(t *testing.T, msg *storage.Message, status string) {
+	t.Helper()
+	header := messageHeader(msg.RawData)
+	if strings.Contains(header, "score=-100.00") || strings.Contains(header, "\trequired=5.00") ||
+		strings.Contains(header, "X-Spam-Flag: NO") {
+		t.Errorf("cabeçalhos X-Spam-* forjados mantidos:\n%s", header)
+	}
+	if strings.Count(header, "X-Spam-Status:") != 1 || !strings.Contains(header, status) {
+		t.Errorf("X-Spam-Status esperado %q:\n%s", status, header)
+	}
+}
+
+func TestSpamRspamdFiling(t *testing.T) {
+	requests := make(chan *http.Request, 10)
+	cfg := newTestConfig(t)
+	cfg.Spam.Enabled = true
+	cfg.Spam.Protocol = spamRspamd
+	cfg.Spam.Address = fakeRspamd(t, requests)
+	cfg.Spam.RejectScore = 15
+	store, user := newTestStorage(t, cfg)
+	session := newTestSession(t, cfg, store)
+
+	if err := sendTestMessage(t, session, "x@remote.test", "alice@localhost", fmt.Sprintf(spoofedMessage, "ham")); err != nil {
+		t.Fatalf("mensagem legítima recusada: %v", err)
+	}
+	req := <-requests
+	if req.Header.Get("From") != "x@remote.test" || req.Header.Get("Rcpt") != "alice@localhost" {
+		t.Errorf("envelope não enviado ao rspamd: From=%q Rcpt=%q", req.Header.Get("From"), req.Header.Get("Rcpt"))
+	}
+
+	if err := sendTestMessage(t, session, "x@remote.test", "alice@localhost", fmt.Sprintf(spoofedMessage, "spam")); err != nil {
+		t.Fatalf("spam abaixo do limiar de recusa recusado: %v", err)
+	}
+
+	inbox := mailboxMessages(t, store, user, "INBOX")
+	if len(inbox) != 1 {
+		t.Fatalf("INBOX com %d mensagens, esperada 1", len(inbox))
+	}
+	checkSpamHeaders(t, inbox[0], "X-Spam-Status: No, score=1.00 required=6.00 tests=R_SPF_FAIL")
+	if strings.Contains(string(inbox[0].RawData), "X-Spam-Flag") {
+		t.Error("X-Spam-Flag em mensagem legítima")
+	}
+
+	junk := mailboxMessages(t, store, user, "Junk")
+	if len(junk) != 1 {
+		t.Fatalf("Junk com %d mensagens, esperada 1", len(junk))
+	}
+	checkSpamHeaders(t, junk[0], "X-Spam-Status: Yes, score=8.00 required=6.00 tests=R_SPF_FAIL")
+	if !strings.Contains(messageHeader(junk[0].RawData), "\nX-Spam-Flag: YES\r\n") {
+		t.Errorf("X-Spam-Flag ausente no spam:\n%s", messageHeader(junk[0].RawData))
+	}
+}
+
+func TestSpamRspamdReject(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Spam.Enabled = true
+	cfg.Spam.Protocol = spamRspamd
+	cfg.Spam.Address = fakeRspamd(t, nil)
+	cfg.Spam.RejectScore = 15
+	store, user := newTestStorage(t, cfg)
+	session := newTestSession(t, cfg, store)
+
+	err := sendTestMessage(t, session, "x@remote.test", "alice@localhost", fmt.Sprintf(spoofedMessage, "reject"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Fatalf("esperado 550 5.7.1, obtido %v", err)
+	}
+	if n := len(mailboxMessages(t, store, user, "INBOX")) + len(mailboxMessages(t, store, user, "Junk")); n != 0 {
+		t.Errorf("mensagem recusada foi entregue (%d mensagens)", n)
+	}
+}
+
+func TestSpamSpamd(t *testing.T) {
+	requests := make(chan *spamdRequest, 10)
+	cfg := newTestConfig(t)
+	cfg.Spam.Enabled = true
+	cfg.Spam.Protocol = spamSpamd
+	cfg.Spam.Address = fakeSpamd(t, requests)
+	cfg.Spam.RejectScore = 15
+	store, user := newTestStorage(t, cfg)
+	session := newTestSession(t, cfg, store)
+
+	for _, tc := range []struct {
+		subject string
+		code    int
+		mailbox string
+		status  string
+	}{
+		{"ham", 0, "INBOX", "X-Spam-Status: No, score=1.00 required=5.00 tests=BAYES_99,URIBL_BLACK"},
+		{"spam", 0, "Junk", "X-Spam-Status: Yes, score=8.00 required=5.00 tests=BAYES_99,URIBL_BLACK"},
+		{"reject", 550, "", ""},
+	} {
+		msg := fmt.Sprintf(spoofedMessage, tc.subject)
+		err := sendTestMessage(t, session, "x@remote.test", "alice@localhost", msg)
+
+		req := <-requests
+		if req.command != "SYMBOLS SPAMC/1.5" || req.length != len(msg) || string(req.body) != msg {
+			t.Errorf("%s: pedido SPAMC inesperado: %q, %d bytes", tc.subject, req.command, req.length)
+		}
+
+		var smtpErr *smtp.SMTPError
+		if tc.code != 0 {
+			if !errors.As(err, &smtpErr) || smtpErr.Code != tc.code {
+				t.Errorf("%s: esperado %d, obtido %v", tc.subject, tc.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.subject, err)
+		}
+		messages := mailboxMessages(t, store, user, tc.mailbox)
+		if len(messages) != 1 {
+			t.Fatalf("%s: %s com %d mensagens, esperada 1", tc.subject, tc.mailbox, len(messages))
+		}
+		checkSpamHeaders(t, messages[0], tc.status)
+	}
+}
+
+func TestSpamDaemonTimeout(t *testing.T) {
+	// O rspamd falso só responde depois do fim do teste
+	release := make(chan struct{})
+	var once sync.Once
+	rspamd := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(func() {
+		once.Do(func() { close(release) })
+		rspamd.Close()
+	})
+
+	// O spamd falso aceita a conexão e nunca responde
+	spamd, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { spamd.Close() })
+	go func() {
+		for {
+			conn, err := spamd.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(io.Discard, conn)
+		}
+	}()
+
+	for _, tc := range []struct{ protocol, address string }{
+		{spamRspamd, rspamd.URL},
+		{spamSpamd, spamd.Addr().String()},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			cfg := newTestConfig(t)
+			cfg.Spam.Enabled = true
+			cfg.Spam.Protocol = tc.protocol
+			cfg.Spam.Address = tc.address
+			store, user := newTestStorage(t, cfg)
+			session := newTestSession(t, cfg, store)
+			filter := session.backend.spam
+			filter.timeout = 200 * time.Millisecond
+			filter.client.Timeout = filter.timeout
+
+			start := time.Now()
+			if _, err := filter.Check(&spamRequest{}, []byte("Subject: spam\r\n\r\n")); err == nil {
+				t.Error("verificação sem resposta do daemon não falhou")
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("tempo limite não respeitado: %v", elapsed)
+			}
+
+			// Sem resposta do daemon a mensagem é entregue sem os cabeçalhos forjados
+			if err := sendTestMessage(t, session, "x@remote.test", "alice@localhost", fmt.Sprintf(spoofedMessage, "spam")); err != nil {
+				t.Fatalf("falha do daemon recusou a mensagem: %v", err)
+			}
+			inbox := mailboxMessages(t, store, user, "INBOX")
+			if len(inbox) != 1 {
+				t.Fatalf("INBOX com %d mensagens, esperada 1", len(inbox))
+			}
+			if header := messageHeader(inbox[0].RawData); strings.Contains(header, "X-Spam-") {
+				t.Errorf("cabeçalhos X-Spam-* forjados mantidos:\n%s", header)
+			}
+		})
+	}
+}
+
+func TestSpamSkipsVacation(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.Spam.Enabled = true
+	cfg.Spam.Protocol = spamRspamd
+	cfg.Spam.Address = fakeRspamd(t, nil)
+	store, user := newTestStorage(t, cfg)
+	session := newTestSession(t, cfg, store)
+
+	err := store.SetVacation(&storage.Vacation{UserID: user.ID, Enabled: true, Subject: "Ausente", Body: "Volto logo", Days: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sendTestMessage(t, session, "x@remote.test", "alice@localhost", fmt.Sprintf(spoofedMessage, "spam")); err != nil {
+		t.Fatal(err)
+	}
+	if pending := pendingOutbound(t, store); len(pending) != 0 {
+		t.Fatalf("resposta de ausência enviada para spam: %d mensagens na fila", len(pending))
+	}
+
+	if err := sendTestMessage(t, session, "y@remote.test", "alice@localhost", fmt.Sprintf(spoofedMessage, "ham")); err != nil {
+		t.Fatal(err)
+	}
+	pending := pendingOutbound(t, store)
+	if len(pending) != 1 || len(pending[0].Recipients) != 1 || pending[0].Recipients[0] != "y@remote.test" {
+		t.Fatalf("resposta de ausência não enviada para mensagem legítima: %+v", pending)
+	}
+}
@@ -0,0 +1,397 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+)
+
+// webhookBackoff define o intervalo entre novas tentativas de chamada
+var webhookBackoff = []time.Duration{
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+	6 * time.Hour,
+}
+
+// webhookPollInterval é o intervalo entre as verificações da fila de webhooks
+const webhookPollInterval = 15 * time.Second
+
+// webhookBatchSize limita os eventos processados em cada verificação da fila
+const webhookBatchSize = 50
+
+// webhookPayload é o corpo JSON enviado aos webhooks a cada mensagem entregue
+type webhookPayload struct {
+	Event       string              `json:"event"`
+	ID          string              `json:"id"`
+	Timestamp   time.Time           `json:"timestamp"`
+	User        string              `json:"user"`
+	Recipient   string              `json:"recipient"`
+	Sender      string              `json:"sender"`
+	Mailbox     string              `json:"mailbox"`
+	UID         uint32              `json:"uid"`
+	MessageID   string              `json:"message_id"`
+	Subject     string              `json:"subject"`
+	From        []webhookAddress    `json:"from"`
+	To          []webhookAddress    `json:"to"`
+	Cc          []webhookAddress    `json:"cc"`
+	Date        string              `json:"date"`
+	Headers     map[string][]string `json:"headers"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []webhookAttachment `json:"attachments"`
+	Size        int                 `json:"size"`
+}
+
+type webhookAddress struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// webhookAttachment descreve um anexo; o conteúdo não é enviado
+type webhookAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	ContentID   string `json:"content_id,omitempty"`
+}
+
+// Webhooks notifica URLs externas a cada mensagem gravada em uma caixa local.
+// As chamadas passam por uma fila persistente no banco de dados, com novas
+// tentativas em caso de falha, e cada tentativa é registrada no histórico.
+type Webhooks struct {
+	hooks       map[string]config.WebhookConfig // Indexado pelo nome
+	order       []string                        // Nomes na ordem da configuração
+	maxAttempts int
+	client      *http.Client
+	store       storage.Storage
+	wake        chan struct{}
+}
+
+// NewWebhooks cria o despachante de webhooks
+func NewWebhooks(cfg *config.Config, store storage.Storage) *Webhooks {
+	maxAttempts := cfg.Webhooks.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 8
+	}
+	timeout := cfg.Webhooks.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = 10
+	}
+
+	w := &Webhooks{
+		hooks:       make(map[string]config.WebhookConfig),
+		maxAttempts: maxAttempts,
+		client:      &http.Client{Timeout: time.Duration(timeout) * time.Second},
+		store:       store,
+		wake:        make(chan struct{}, 1),
+	}
+	for i, hook := range cfg.Webhooks.Hooks {
+		if hook.Name == "" {
+			hook.Name = "webhook" + strconv.Itoa(i+1)
+		}
+		if hook.URL == "" {
+			log.Printf("Webhook %s ignorado: URL não informada", hook.Name)
+			continue
+		}
+		if _, exists := w.hooks[hook.Name]; exists {
+			log.Printf("Webhook %s ignorado: nome duplicado", hook.Name)
+			continue
+		}
+		w.hooks[hook.Name] = hook
+		w.order = append(w.order, hook.Name)
+	}
+	return w
+}
+
+// Start inicia o processamento da fila de webhooks. A fila é processada
+// mesmo sem webhooks configurados, para descartar eventos antigos.
+func (w *Webhooks) Start() {
+	go w.run()
+}
+
+func (w *Webhooks) run() {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+	for {
+		w.dispatch()
+		select {
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+// dispatch chama os webhooks cuja próxima tentativa já venceu
+func (w *Webhooks) dispatch() {
+	for {
+		events, err := w.store.PendingWebhooks(time.Now(), webhookBatchSize)
+		if err != nil {
+			log.Printf("Erro ao ler fila de webhooks: %v", err)
+			return
+		}
+		for _, event := range events {
+			w.deliver(event)
+		}
+		if len(events) < webhookBatchSize {
+			return
+		}
+	}
+}
+
+// Notify enfileira a notificação dos webhooks que correspondem ao
+// destinatário da mensagem gravada
+func (w *Webhooks) Notify(env *envelope, rcpt *localRecipient, mailbox *storage.Mailbox, msg *storage.Message) {
+	var payload *webhookPayload
+	queued := false
+	for _, name := range w.order {
+		hook := w.hooks[name]
+		if !webhookMatches(hook, rcpt) {
+			continue
+		}
+		if payload == nil {
+			payload = buildWebhookPayload(env, rcpt, mailbox, msg)
+		}
+
+		payload.ID = newWebhookID()
+		data, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Erro ao gerar corpo do webhook %s: %v", name, err)
+			continue
+		}
+		event := &storage.WebhookEvent{EventID: payload.ID, Hook: name, Payload: data}
+		if err := w.store.EnqueueWebhook(event); err != nil {
+			log.Printf("Erro ao enfileirar webhook %s: %v", name, err)
+			continue
+		}
+		queued = true
+	}
+
+	if queued {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// webhookMatches informa se o webhook se aplica ao destinatário
+func webhookMatches(hook config.WebhookConfig, rcpt *localRecipient) bool {
+	address := normalizeAddress(rcpt.address)
+	if address == "" {
+		address = normalizeAddress(rcpt.user.Email)
+	}
+
+	if hook.User != "" {
+		user := normalizeAddress(hook.User)
+		if user != strings.ToLower(rcpt.user.Username) && user != normalizeAddress(rcpt.user.Email) {
+			return false
+		}
+	}
+	if hook.Address != "" && normalizeAddress(hook.Address) != address {
+		return false
+	}
+	if hook.Domain != "" {
+		_, domain, ok := splitAddress(address)
+		if !ok || domain != strings.ToLower(strings.TrimPrefix(strings.TrimSpace(hook.Domain), "@")) {
+			return false
+		}
+	}
+	return true
+}
+
+// buildWebhookPayload descreve a mensagem gravada: cabeçalhos decodificados,
+// corpos de texto e HTML e os metadados dos anexos
+func buildWebhookPayload(env *envelope, rcpt *localRecipient, mailbox *storage.Mailbox, msg *storage.Message) *webhookPayload {
+	root := parseMIME(msg.RawData)
+	payload := &webhookPayload{
+		Event:       "message.received",
+		Timestamp:   msg.Created,
+		User:        rcpt.user.Username,
+		Recipient:   rcpt.address,
+		Sender:      env.from,
+		Mailbox:     mailbox.Name,
+		UID:         msg.UID,
+		MessageID:   msg.MessageID,
+		Subject:     decodeHeader(root.header.Get("Subject")),
+		From:        webhookAddresses(root.header.Get("From")),
+		To:          webhookAddresses(root.header.Get("To")),
+		Cc:          webhookAddresses(root.header.Get("Cc")),
+		Date:        root.header.Get("Date"),
+		Headers:     make(map[string][]string),
+		Attachments: []webhookAttachment{},
+		Size:        msg.Size,
+	}
+	if payload.Timestamp.IsZero() {
+		payload.Timestamp = time.Now()
+	}
+	if payload.Recipient == "" {
+		payload.Recipient = rcpt.user.Email
+	}
+	if date, err := mail.ParseDate(payload.Date); err == nil {
+		payload.Date = date.Format(time.RFC3339)
+	}
+	for _, f := range root.fields {
+		name := strings.ToLower(f.name)
+		payload.Headers[name] = append(payload.Headers[name], decodeHeader(unfoldHeader(f.value)))
+	}
+
+	textBody, htmlBody, attachments := root.bodyParts()
+	payload.Text = joinParts(textBody, "text/plain")
+	payload.HTML = joinParts(htmlBody, "text/html")
+	for _, part := range attachments {
+		payload.Attachments = append(payload.Attachments, webhookAttachment{
+			Filename:    part.filename(),
+			ContentType: part.mediaType,
+			Size:        len(part.decoded()),
+			ContentID:   strings.Trim(part.header.Get("Content-Id"), " <>"),
+		})
+	}
+	return payload
+}
+
+// joinParts concatena o texto das partes do tipo informado
+func joinParts(parts []*mimePart, mediaType string) string {
+	var texts []string
+	for _, part := range parts {
+		if part.mediaType == mediaType {
+			text, _ := part.text()
+			texts = append(texts, text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func webhookAddresses(value string) []webhookAddress {
+	addresses := []webhookAddress{}
+	for _, addr := range parseAddressList(value) {
+		addresses = append(addresses, webhookAddress{Name: addr.Name, Email: addr.Address})
+	}
+	return addresses
+}
+
+// deliver faz uma tentativa de chamada do evento e atualiza a fila e o
+// histórico conforme o resultado
+func (w *Webhooks) deliver(event *storage.WebhookEvent) {
+	attempt := event.Attempts + 1
+	hook, ok := w.hooks[event.Hook]
+	if !ok {
+		w.record(event, "", storage.WebhookFailed, 0, "webhook removido da configuração", attempt)
+		w.remove(event)
+		return
+	}
+
+	statusCode, err := w.post(hook, event)
+	if err == nil {
+		log.Printf("Webhook %s chamado para o evento %s (HTTP %d)", hook.Name, event.EventID, statusCode)
+		w.record(event, hook.URL, storage.WebhookDelivered, statusCode, "", attempt)
+		w.remove(event)
+		return
+	}
+
+	if attempt >= w.maxAttempts {
+		log.Printf("Desistindo do webhook %s para o evento %s após %d tentativas: %v", hook.Name, event.EventID, attempt, err)
+		w.record(event, hook.URL, storage.WebhookFailed, statusCode, err.Error(), attempt)
+		w.remove(event)
+		return
+	}
+
+	log.Printf("Falha no webhook %s para o evento %s (tentativa %d): %v", hook.Name, event.EventID, attempt, err)
+	w.record(event, hook.URL, storage.WebhookRetrying, statusCode, err.Error(), attempt)
+	if err := w.store.RescheduleWebhook(event.ID, attempt, time.Now().Add(webhookDelay(attempt))); err != nil {
+		log.Printf("Erro ao reagendar webhook %s: %v", hook.Name, err)
+	}
+}
+
+// post envia o evento ao webhook, assinando o corpo quando há segredo. Apenas
+// respostas 2xx são consideradas entregues.
+func (w *Webhooks) post(hook config.WebhookConfig, event *storage.WebhookEvent) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(event.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("falha ao criar requisição: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "simpleEmail-webhook")
+	req.Header.Set("X-Webhook-Id", event.EventID)
+	req.Header.Set("X-Webhook-Event", "message.received")
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	if hook.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+webhookSignature(hook.Secret, timestamp, event.Payload))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		detail := strings.Join(strings.Fields(string(body)), " ")
+		if detail == "" {
+			return resp.StatusCode, fmt.Errorf("HTTP %d", resp.StatusCode)
+		}
+		return resp.StatusCode, fmt.Errorf("HTTP %d: %s", resp.StatusCode, detail)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookSignature calcula o HMAC-SHA256 de "timestamp.corpo" com o segredo do
+// webhook. Incluir o horário permite ao destino recusar chamadas repetidas.
+func webhookSignature(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhooks) record(event *storage.WebhookEvent, url, status string, statusCode int, detail string, attempt int) {
+	err := w.store.RecordWebhookDelivery(&storage.WebhookDelivery{
+		EventID:    event.EventID,
+		Hook:       event.Hook,
+		URL:        url,
+		Status:     status,
+		StatusCode: statusCode,
+		Detail:     detail,
+		Attempt:    attempt,
+	})
+	if err != nil {
+		log.Printf("Erro ao registrar chamada do webhook %s: %v", event.Hook, err)
+	}
+}
+
+func (w *Webhooks) remove(event *storage.WebhookEvent) {
+	if err := w.store.DeleteWebhook(event.ID); err != nil {
+		log.Printf("Erro ao remover webhook %s da fila: %v", event.Hook, err)
+	}
+}
+
+// webhookDelay retorna o intervalo até a próxima tentativa de chamada
+func webhookDelay(attempt int) time.Duration {
+	if attempt-1 < len(webhookBackoff) {
+		return webhookBackoff[attempt-1]
+	}
+	return webhookBackoff[len(webhookBackoff)-1]
+}
+
+// newWebhookID gera o identificador de um evento de webhook
+func newWebhookID() string {
+	return "evt_" + strings.ToLower(newQueueID()) + strings.ToLower(newQueueID())
+}
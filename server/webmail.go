@@ -0,0 +1,1060 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/carloslauriano/simpleEmail/config"
+	"github.com/carloslauriano/simpleEmail/storage"
+	"github.com/emersion/go-imap"
+)
+
+const (
+	webmailCookie          = "webmail_session"
+	webmailDefaultTTL      = 8 * time.Hour
+	webmailDefaultPageSize = 50
+)
+
+// webmailContentPolicy impede scripts, conteúdo externo e o uso da página em
+// frames. Imagens só vêm do próprio servidor, o que inclui as partes cid:.
+const webmailContentPolicy = "default-src 'none'; img-src 'self' data:; style-src 'unsafe-inline'; " +
+	"form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// webmailNotices são os avisos exibidos após um redirecionamento
+var webmailNotices = map[string]string{
+	"sent":      "Mensagem enviada.",
+	"sent-copy": "Mensagem enviada, mas a cópia em Enviados não pôde ser salva.",
+	"deleted":   "Mensagem excluída.",
+	"moved":     "Mensagem movida.",
+	"unseen":    "Mensagem marcada como não lida.",
+}
+
+// WebmailServer serve o webmail embutido. As sessões ficam em memória e são
+// perdidas quando o servidor reinicia.
+type WebmailServer struct {
+	store     storage.Storage
+	delivery  *Delivery
+	hostname  string
+	ttl       time.Duration
+	secure    bool
+	pageSize  int
+	maxUpload int
+	templates *template.Template
+
+	mu       sync.Mutex
+	sessions map[string]*webmailSession
+}
+
+// webmailSession é uma sessão autenticada. O token CSRF acompanha todos os
+// formulários que alteram dados.
+type webmailSession struct {
+	userID  int64
+	csrf    string
+	expires time.Time
+}
+
+// NewWebmailServer cria um novo servidor de webmail
+func NewWebmailServer(cfg *config.Config, store storage.Storage, delivery *Delivery) *WebmailServer {
+	ttl := time.Duration(cfg.Webmail.SessionHours) * time.Hour
+	if ttl <= 0 {
+		ttl = webmailDefaultTTL
+	}
+	pageSize := cfg.Webmail.PageSize
+	if pageSize <= 0 {
+		pageSize = webmailDefaultPageSize
+	}
+	maxUpload := cfg.SMTP.MaxMessageBytes
+	if maxUpload <= 0 {
+		maxUpload = jmapDefaultMaxUpload
+	}
+
+	return &WebmailServer{
+		store:     store,
+		delivery:  delivery,
+		hostname:  cfg.SMTP.Domain,
+		ttl:       ttl,
+		secure:    cfg.Webmail.SecureCookies,
+		pageSize:  pageSize,
+		maxUpload: maxUpload,
+		templates: template.Must(template.New("webmail").Parse(webmailTemplates)),
+		sessions:  make(map[string]*webmailSession),
+	}
+}
+
+// Handler retorna as rotas do webmail
+func (s *WebmailServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handleIndex)
+	mux.HandleFunc("/login", s.handleLogin)
+	mux.HandleFunc("/logout", s.authenticated(s.handleLogout))
+	mux.HandleFunc("/mailbox", s.authenticated(s.handleMailbox))
+	mux.HandleFunc("/message", s.authenticated(s.handleMessage))
+	mux.HandleFunc("/message/action", s.authenticated(s.handleAction))
+	mux.HandleFunc("/compose", s.authenticated(s.handleCompose))
+	mux.HandleFunc("/send", s.authenticated(s.handleSend))
+	mux.HandleFunc("/part", s.authenticated(s.handlePart))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", webmailContentPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Métodos de implementação para sessões
+
+// newSession cria uma sessão para o usuário e envia o cookie
+func (s *WebmailServer) newSession(w http.ResponseWriter, user *storage.User) {
+	session := &webmailSession{
+		userID:  user.ID,
+		csrf:    randomToken(),
+		expires: time.Now().Add(s.ttl),
+	}
+	token := randomToken()
+
+	s.mu.Lock()
+	s.sessions[token] = session
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     webmailCookie,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   s.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// session obtém a sessão da requisição, renovando sua validade. Sessões
+// expiradas são descartadas.
+func (s *WebmailServer) session(r *http.Request) (string, *webmailSession) {
+	cookie, err := r.Cookie(webmailCookie)
+	if err != nil {
+		return "", nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for token, session := range s.sessions {
+		if now.After(session.expires) {
+			delete(s.sessions, token)
+		}
+	}
+	session, ok := s.sessions[cookie.Value]
+	if !ok {
+		return "", nil
+	}
+	session.expires = now.Add(s.ttl)
+	return cookie.Value, session
+}
+
+// webmailHandler é um handler de página autenticada
+type webmailHandler func(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession)
+
+// authenticated exige uma sessão válida, redirecionando para o login, e
+// verifica o token CSRF dos envios de formulário
+func (s *WebmailServer) authenticated(handler webmailHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, session := s.session(r)
+		if session == nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		user, err := s.store.GetUserByID(session.userID)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			// O formulário de envio é multipart e é lido pelo próprio handler
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+				r.ParseForm()
+			} else if err := r.ParseMultipartForm(int64(s.maxUpload)); err != nil {
+				http.Error(w, "formulário inválido", http.StatusBadRequest)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(session.csrf)) != 1 {
+				http.Error(w, "token de formulário inválido", http.StatusForbidden)
+				return
+			}
+		}
+		handler(w, r, user, session)
+	}
+}
+
+// randomToken gera um identificador aleatório para sessões e CSRF
+func randomToken() string {
+	buf := make([]byte, 32)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func (s *WebmailServer) handleLogin(w http.ResponseWriter, r *http.Request) {
+	data := map[string]string{}
+	if r.Method == http.MethodPost {
+		username := strings.TrimSpace(r.FormValue("username"))
+		user, err := s.store.AuthenticateUser(username, r.FormValue("password"))
+		if err == nil {
+			s.newSession(w, user)
+			log.Printf("Login no webmail de %s a partir de %s", user.Email, r.RemoteAddr)
+			http.Redirect(w, r, "/mailbox", http.StatusSeeOther)
+			return
+		}
+		data["Username"] = username
+		data["Error"] = "Usuário ou senha inválidos."
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	s.render(w, "login", data)
+}
+
+func (s *WebmailServer) handleLogout(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	token, _ := s.session(r)
+	s.mu.Lock()
+	delete(s.sessions, token)
+	s.mu.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: webmailCookie, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func (s *WebmailServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, "/mailbox", http.StatusSeeOther)
+}
+
+// Métodos de implementação para as páginas
+
+// webmailFolder é uma pasta na lista lateral
+type webmailFolder struct {
+	Name     string
+	Label    string // Último nível do nome
+	Depth    int
+	Unseen   uint32
+	NoSelect bool
+	Current  bool
+}
+
+// webmailListItem é uma linha da lista de mensagens
+type webmailListItem struct {
+	ID            int64
+	From          string
+	Subject       string
+	Date          string
+	Seen          bool
+	Flagged       bool
+	HasAttachment bool
+}
+
+// webmailMessage é uma mensagem aberta para leitura
+type webmailMessage struct {
+	ID          int64
+	From        string
+	To          string
+	Cc          string
+	Subject     string
+	Date        string
+	Text        string
+	HTML        template.HTML // Já sanitizado
+	Attachments []webmailAttachment
+}
+
+// webmailAttachment é um anexo listado na leitura ou no encaminhamento
+type webmailAttachment struct {
+	Part string
+	Name string
+	Size string
+}
+
+// webmailCompose são os campos iniciais do formulário de envio
+type webmailCompose struct {
+	To                 string
+	Cc                 string
+	Bcc                string
+	Subject            string
+	Body               string
+	InReplyTo          string
+	References         string
+	Answered           int64 // Mensagem marcada como respondida após o envio
+	Forward            int64 // Mensagem cujos anexos são encaminhados
+	ForwardAttachments []webmailAttachment
+}
+
+// webmailPage reúne os dados de uma página autenticada
+type webmailPage struct {
+	Title   string
+	User    *storage.User
+	CSRF    string
+	Folders []webmailFolder
+	Mailbox string
+	Query   string
+	Notice  string
+	Error   string
+
+	Messages []webmailListItem
+	Page     int
+	Pages    int
+	PrevPage int
+	NextPage int
+
+	Message *webmailMessage
+	Compose *webmailCompose
+}
+
+// newPage prepara os dados comuns das páginas, com a lista de pastas
+func (s *WebmailServer) newPage(r *http.Request, user *storage.User, session *webmailSession, title, current string) (*webmailPage, error) {
+	mailboxes, err := s.store.ListMailboxes(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar caixas de correio: %w", err)
+	}
+	sort.Slice(mailboxes, func(i, j int) bool {
+		// A INBOX vem sempre primeiro
+		if strings.EqualFold(mailboxes[i].Name, "INBOX") != strings.EqualFold(mailboxes[j].Name, "INBOX") {
+			return strings.EqualFold(mailboxes[i].Name, "INBOX")
+		}
+		return mailboxes[i].Name < mailboxes[j].Name
+	})
+
+	page := &webmailPage{
+		Title:   title,
+		User:    user,
+		CSRF:    session.csrf,
+		Mailbox: current,
+		Notice:  webmailNotices[r.FormValue("notice")],
+	}
+	for _, mb := range mailboxes {
+		folder := webmailFolder{
+			Name:     mb.Name,
+			Label:    mb.Name[strings.LastIndex(mb.Name, storage.MailboxDelimiter)+1:],
+			Depth:    strings.Count(mb.Name, storage.MailboxDelimiter),
+			NoSelect: mb.NoSelect,
+			Current:  mb.Name == current,
+		}
+		if !mb.NoSelect {
+			counters, err := s.store.GetMailboxCounters(mb.ID)
+			if err != nil {
+				return nil, fmt.Errorf("falha ao obter contadores da caixa: %w", err)
+			}
+			folder.Unseen = counters.Unseen
+		}
+		page.Folders = append(page.Folders, folder)
+	}
+	return page, nil
+}
+
+// render executa um template, registrando falhas
+func (s *WebmailServer) render(w http.ResponseWriter, name string, data interface{}) {
+	if err := s.templates.ExecuteTemplate(w, name, data); err != nil {
+		log.Printf("Erro ao exibir página %s do webmail: %v", name, err)
+	}
+}
+
+// serverError registra um erro interno e responde sem expor detalhes
+func (s *WebmailServer) serverError(w http.ResponseWriter, user *storage.User, err error) {
+	log.Printf("Erro no webmail de %s: %v", user.Email, err)
+	http.Error(w, "erro interno do servidor", http.StatusInternalServerError)
+}
+
+func (s *WebmailServer) handleMailbox(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	name := r.FormValue("name")
+	if name == "" {
+		name = "INBOX"
+	}
+	mailbox, err := s.store.GetMailbox(user.ID, name)
+	if errors.Is(err, storage.ErrMailboxNotFound) || (err == nil && mailbox.NoSelect) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+
+	page, err := s.newPage(r, user, session, mailbox.Name, mailbox.Name)
+	if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+	page.Query = strings.TrimSpace(r.FormValue("q"))
+
+	messages, err := s.store.ListMessages(mailbox.ID)
+	if err != nil {
+		s.serverError(w, user, fmt.Errorf("falha ao listar mensagens: %w", err))
+		return
+	}
+	if page.Query != "" {
+		var matched []*storage.Message
+		for _, msg := range messages {
+			if webmailMatches(msg, page.Query) {
+				matched = append(matched, msg)
+			}
+		}
+		messages = matched
+	}
+	sort.SliceStable(messages, func(i, j int) bool {
+		return messages[i].Date.After(messages[j].Date)
+	})
+
+	// Paginação, com a página fora do intervalo ajustada aos limites
+	page.Pages = (len(messages) + s.pageSize - 1) / s.pageSize
+	if page.Pages == 0 {
+		page.Pages = 1
+	}
+	page.Page, _ = strconv.Atoi(r.FormValue("page"))
+	if page.Page < 1 {
+		page.Page = 1
+	}
+	if page.Page > page.Pages {
+		page.Page = page.Pages
+	}
+	if page.Page > 1 {
+		page.PrevPage = page.Page - 1
+	}
+	if page.Page < page.Pages {
+		page.NextPage = page.Page + 1
+	}
+	start := (page.Page - 1) * s.pageSize
+	end := start + s.pageSize
+	if end > len(messages) {
+		end = len(messages)
+	}
+
+	for _, msg := range messages[start:end] {
+		_, _, attachments := parseMIME(msg.RawData).bodyParts()
+		page.Messages = append(page.Messages, webmailListItem{
+			ID:            msg.ID,
+			From:          displayAddresses(msg.From, true),
+			Subject:       decodeHeader(msg.Subject),
+			Date:          msg.Date.Local().Format("02/01/2006 15:04"),
+			Seen:          msg.Seen,
+			Flagged:       containsFlag(strings.Fields(msg.Flags), imap.FlaggedFlag),
+			HasAttachment: len(attachments) > 0,
+		})
+	}
+	s.render(w, "mailbox", page)
+}
+
+// webmailMatches pesquisa o texto nos remetentes, destinatários, assunto e
+// corpo da mensagem
+func webmailMatches(msg *storage.Message, query string) bool {
+	for _, value := range []string{msg.From, msg.To, msg.Cc, msg.Subject} {
+		if containsFold(decodeHeader(value), query) {
+			return true
+		}
+	}
+	return containsFold(emailBodyText(parseMIME(msg.RawData)), query)
+}
+
+// displayAddresses formata uma lista de endereços para exibição; com
+// namesOnly, mostra apenas o nome quando houver
+func displayAddresses(value string, namesOnly bool) string {
+	addrs := parseAddressList(value)
+	if len(addrs) == 0 {
+		return decodeHeader(value)
+	}
+	formatted := make([]string, len(addrs))
+	for i, addr := range addrs {
+		switch {
+		case addr.Name == "":
+			formatted[i] = addr.Address
+		case namesOnly:
+			formatted[i] = addr.Name
+		default:
+			formatted[i] = addr.Name + " <" + addr.Address + ">"
+		}
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// userMessage obtém uma mensagem que pertence a uma caixa do usuário
+func (s *WebmailServer) userMessage(user *storage.User, value string) (*storage.Message, *storage.Mailbox, error) {
+	id, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, nil, storage.ErrMessageNotFound
+	}
+	msg, err := s.store.GetMessageByID(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	mailbox, err := s.store.GetMailboxByID(msg.MailboxID)
+	if errors.Is(err, storage.ErrMailboxNotFound) || (err == nil && mailbox.UserID != user.ID) {
+		return nil, nil, storage.ErrMessageNotFound
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return msg, mailbox, nil
+}
+
+// allParts lista a parte e todas as suas subpartes
+func allParts(part *mimePart) []*mimePart {
+	parts := []*mimePart{part}
+	for _, sub := range part.parts {
+		parts = append(parts, allParts(sub)...)
+	}
+	return parts
+}
+
+// formatSize formata um tamanho em bytes para exibição
+func formatSize(size int) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// attachmentList descreve os anexos para exibição
+func attachmentList(attachments []*mimePart) []webmailAttachment {
+	var list []webmailAttachment
+	for _, part := range attachments {
+		name := part.filename()
+		if name == "" {
+			name = "anexo-" + part.id
+		}
+		list = append(list, webmailAttachment{Part: part.id, Name: name, Size: formatSize(len(part.decoded()))})
+	}
+	return list
+}
+
+func (s *WebmailServer) handleMessage(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	msg, mailbox, err := s.userMessage(user, r.FormValue("id"))
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+
+	// Abrir a mensagem a marca como lida
+	if !msg.Seen {
+		msg.Seen = true
+		if err := s.store.UpdateMessageFlags(msg.ID, msg.Flags, msg.Seen, msg.Deleted, msg.Draft); err != nil {
+			s.serverError(w, user, fmt.Errorf("falha ao atualizar flags: %w", err))
+			return
+		}
+	}
+
+	page, err := s.newPage(r, user, session, decodeHeader(msg.Subject), mailbox.Name)
+	if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+
+	root := parseMIME(msg.RawData)
+	textBody, htmlBody, attachments := root.bodyParts()
+	view := &webmailMessage{
+		ID:      msg.ID,
+		From:    displayAddresses(root.header.Get("From"), false),
+		To:      displayAddresses(root.header.Get("To"), false),
+		Cc:      displayAddresses(root.header.Get("Cc"), false),
+		Subject: decodeHeader(root.header.Get("Subject")),
+		Date:    msg.Date.Local().Format("02/01/2006 15:04"),
+	}
+
+	// Imagens embutidas são servidas a partir das partes da própria mensagem
+	cids := map[string]string{}
+	for _, part := range allParts(root) {
+		if cid := strings.Trim(part.header.Get("Content-Id"), "<> "); cid != "" {
+			cids[cid] = fmt.Sprintf("/part?id=%d&part=%s", msg.ID, url.QueryEscape(part.id))
+		}
+	}
+	used := map[string]bool{}
+	cidURL := func(cid string) string {
+		cid, _ = url.PathUnescape(cid)
+		used[cid] = true
+		return cids[cid]
+	}
+
+	for _, part := range htmlBody {
+		if part.mediaType == "text/html" {
+			text, _ := part.text()
+			view.HTML += template.HTML(sanitizeHTML(text, cidURL))
+		}
+	}
+	if view.HTML == "" {
+		var texts []string
+		for _, part := range textBody {
+			if part.mediaType == "text/plain" {
+				text, _ := part.text()
+				texts = append(texts, text)
+			}
+		}
+		view.Text = strings.Join(texts, "\n")
+	}
+
+	// Imagens exibidas no corpo não são listadas como anexos
+	var listed []*mimePart
+	for _, part := range attachments {
+		if !used[strings.Trim(part.header.Get("Content-Id"), "<> ")] {
+			listed = append(listed, part)
+		}
+	}
+	view.Attachments = attachmentList(listed)
+
+	page.Message = view
+	s.render(w, "message", page)
+}
+
+// specialMailbox obtém a caixa de uso especial do usuário (RFC 6154), ou
+// nil se ela não existir
+func (s *WebmailServer) specialMailbox(user *storage.User, attr string) (*storage.Mailbox, error) {
+	mailboxes, err := s.store.ListMailboxes(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar caixas de correio: %w", err)
+	}
+	for _, mb := range mailboxes {
+		if mb.SpecialUse == attr && !mb.NoSelect {
+			return mb, nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *WebmailServer) handleAction(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	msg, mailbox, err := s.userMessage(user, r.FormValue("id"))
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+
+	var notice string
+	switch r.FormValue("action") {
+	case "unseen":
+		msg.Seen = false
+		err = s.store.UpdateMessageFlags(msg.ID, msg.Flags, msg.Seen, msg.Deleted, msg.Draft)
+		notice = "unseen"
+	case "delete":
+		// A exclusão move para a Lixeira; na própria Lixeira, remove
+		var trash *storage.Mailbox
+		if trash, err = s.specialMailbox(user, imap.TrashAttr); err != nil {
+			break
+		}
+		if trash == nil || trash.ID == mailbox.ID {
+			err = s.store.DeleteMessage(msg.ID)
+		} else {
+			err = s.store.MoveMessage(msg.ID, trash.ID)
+		}
+		notice = "deleted"
+	case "move":
+		target, err := s.store.GetMailbox(user.ID, r.FormValue("target"))
+		if errors.Is(err, storage.ErrMailboxNotFound) || (err == nil && target.NoSelect) {
+			http.Error(w, "caixa de destino não encontrada", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			s.serverError(w, user, err)
+			return
+		}
+		if target.ID != mailbox.ID {
+			if err := s.store.MoveMessage(msg.ID, target.ID); err != nil {
+				s.serverError(w, user, fmt.Errorf("falha ao mover mensagem: %w", err))
+				return
+			}
+		}
+		notice = "moved"
+	default:
+		http.Error(w, "ação inválida", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+
+	http.Redirect(w, r, "/mailbox?name="+url.QueryEscape(mailbox.Name)+"&notice="+notice, http.StatusSeeOther)
+}
+
+// Métodos de implementação para o envio
+
+func (s *WebmailServer) handleCompose(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	page, err := s.newPage(r, user, session, "Escrever", "")
+	if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+	compose := &webmailCompose{To: r.FormValue("to")}
+
+	for _, mode := range []string{"reply", "replyall", "forward"} {
+		if r.FormValue(mode) == "" {
+			continue
+		}
+		msg, _, err := s.userMessage(user, r.FormValue(mode))
+		if errors.Is(err, storage.ErrMessageNotFound) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			s.serverError(w, user, err)
+			return
+		}
+		compose = composeFrom(user, msg, mode)
+		break
+	}
+
+	page.Compose = compose
+	s.render(w, "compose", page)
+}
+
+// composeFrom preenche o formulário para responder ou encaminhar uma
+// mensagem
+func composeFrom(user *storage.User, msg *storage.Message, mode string) *webmailCompose {
+	root := parseMIME(msg.RawData)
+	subject := decodeHeader(root.header.Get("Subject"))
+	from := displayAddresses(root.header.Get("From"), false)
+	date := msg.Date.Local().Format("02/01/2006 15:04")
+	textBody, _, attachments := root.bodyParts()
+
+	var texts []string
+	for _, part := range textBody {
+		text, _ := part.text()
+		if part.mediaType == "text/html" {
+			text = htmlToText(text)
+		}
+		texts = append(texts, text)
+	}
+	original := strings.ReplaceAll(strings.Join(texts, "\n"), "\r\n", "\n")
+
+	compose := &webmailCompose{}
+	if mode == "forward" {
+		if !hasSubjectPrefix(subject, "fwd:", "enc:") {
+			subject = "Fwd: " + subject
+		}
+		compose.Subject = subject
+		compose.Body = "\n\n---------- Mensagem encaminhada ----------\n" +
+			"De: " + from + "\nData: " + date + "\nAssunto: " + decodeHeader(root.header.Get("Subject")) +
+			"\nPara: " + displayAddresses(root.header.Get("To"), false) + "\n\n" + original
+		compose.Forward = msg.ID
+		compose.ForwardAttachments = attachmentList(attachments)
+		return compose
+	}
+
+	if !hasSubjectPrefix(subject, "re:") {
+		subject = "Re: " + subject
+	}
+	compose.Subject = subject
+	compose.Answered = msg.ID
+
+	replyTo := root.header.Get("Reply-To")
+	if replyTo == "" {
+		replyTo = root.header.Get("From")
+	}
+	compose.To = formatAddressList(parseAddressList(replyTo))
+	if mode == "replyall" {
+		// Os demais destinatários vão em cópia, sem o próprio usuário
+		seen := map[string]bool{strings.ToLower(user.Email): true}
+		for _, addr := range parseAddressList(replyTo) {
+			seen[strings.ToLower(addr.Address)] = true
+		}
+		var cc []*mail.Address
+		for _, name := range []string{"To", "Cc"} {
+			for _, addr := range parseAddressList(root.header.Get(name)) {
+				if !seen[strings.ToLower(addr.Address)] {
+					seen[strings.ToLower(addr.Address)] = true
+					cc = append(cc, addr)
+				}
+			}
+		}
+		compose.Cc = formatAddressList(cc)
+	}
+
+	messageID := strings.TrimSpace(root.header.Get("Message-Id"))
+	if messageID != "" {
+		compose.InReplyTo = messageID
+		compose.References = strings.TrimSpace(strings.Join(append(parseMessageIDs(root.header.Get("References")), messageID), " "))
+	}
+
+	var quoted []string
+	for _, line := range strings.Split(original, "\n") {
+		quoted = append(quoted, "> "+line)
+	}
+	compose.Body = "\n\nEm " + date + ", " + from + " escreveu:\n" + strings.Join(quoted, "\n")
+	return compose
+}
+
+// hasSubjectPrefix informa se o assunto já começa com um dos prefixos
+func hasSubjectPrefix(subject string, prefixes ...string) bool {
+	lower := strings.ToLower(strings.TrimSpace(subject))
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseFormAddresses lê uma lista de endereços digitada no formulário
+func parseFormAddresses(value string) ([]*mail.Address, error) {
+	value = strings.TrimSpace(strings.ReplaceAll(value, ";", ","))
+	if value == "" {
+		return nil, nil
+	}
+	addrs, err := mail.ParseAddressList(value)
+	if err != nil {
+		return nil, fmt.Errorf("endereço inválido em %q", value)
+	}
+	return addrs, nil
+}
+
+func (s *WebmailServer) handleSend(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	form := &webmailCompose{
+		To:         r.FormValue("to"),
+		Cc:         r.FormValue("cc"),
+		Bcc:        r.FormValue("bcc"),
+		Subject:    r.FormValue("subject"),
+		Body:       r.FormValue("body"),
+		InReplyTo:  r.FormValue("in_reply_to"),
+		References: r.FormValue("references"),
+	}
+	form.Answered, _ = strconv.ParseInt(r.FormValue("answered"), 10, 64)
+	form.Forward, _ = strconv.ParseInt(r.FormValue("forward"), 10, 64)
+
+	msg, err := s.composeMessage(r, user, form)
+	if err != nil {
+		// Erros de preenchimento voltam ao formulário com os dados digitados
+		page, perr := s.newPage(r, user, session, "Escrever", "")
+		if perr != nil {
+			s.serverError(w, user, perr)
+			return
+		}
+		page.Error = err.Error()
+		page.Compose = form
+		w.WriteHeader(http.StatusBadRequest)
+		s.render(w, "compose", page)
+		return
+	}
+
+	var rcpts []string
+	for _, list := range [][]*mail.Address{msg.to, msg.cc, msg.bcc} {
+		for _, addr := range list {
+			rcpts = append(rcpts, addr.Address)
+		}
+	}
+	data := msg.bytes(s.hostname)
+	if err := s.delivery.Submit(user.Email, rcpts, removeHeader(data, "Bcc")); err != nil {
+		s.serverError(w, user, fmt.Errorf("falha ao enviar mensagem: %w", err))
+		return
+	}
+	log.Printf("Mensagem enviada via webmail por %s para %d destinatários", user.Email, len(rcpts))
+
+	if form.Answered != 0 {
+		s.markAnswered(user, form.Answered)
+	}
+	notice := "sent"
+	if err := s.saveSent(user, data); err != nil {
+		log.Printf("Erro ao salvar cópia enviada de %s: %v", user.Email, err)
+		notice = "sent-copy"
+	}
+	http.Redirect(w, r, "/mailbox?notice="+notice, http.StatusSeeOther)
+}
+
+// composeMessage monta a mensagem a partir do formulário, com os anexos
+// enviados e os da mensagem encaminhada
+func (s *WebmailServer) composeMessage(r *http.Request, user *storage.User, form *webmailCompose) (*composedMessage, error) {
+	msg := &composedMessage{
+		from:    []*mail.Address{{Name: user.Name, Address: user.Email}},
+		subject: form.Subject,
+		text:    form.Body,
+	}
+
+	var err error
+	if msg.to, err = parseFormAddresses(form.To); err != nil {
+		return nil, err
+	}
+	if msg.cc, err = parseFormAddresses(form.Cc); err != nil {
+		return nil, err
+	}
+	if msg.bcc, err = parseFormAddresses(form.Bcc); err != nil {
+		return nil, err
+	}
+	if len(msg.to)+len(msg.cc)+len(msg.bcc) == 0 {
+		return nil, errors.New("informe ao menos um destinatário")
+	}
+	if ids := parseMessageIDs(form.InReplyTo); len(ids) > 0 {
+		msg.inReplyTo = ids[:1]
+		msg.references = parseMessageIDs(form.References)
+	}
+
+	if form.Forward != 0 {
+		original, _, err := s.userMessage(user, strconv.FormatInt(form.Forward, 10))
+		if err != nil {
+			return nil, errors.New("mensagem encaminhada não encontrada")
+		}
+		_, _, attachments := parseMIME(original.RawData).bodyParts()
+		for _, part := range attachments {
+			msg.attachments = append(msg.attachments, &composedAttachment{
+				filename:    part.filename(),
+				contentType: part.mediaType,
+				data:        part.decoded(),
+			})
+		}
+	}
+
+	if r.MultipartForm != nil {
+		for _, header := range r.MultipartForm.File["attachments"] {
+			if header.Filename == "" {
+				continue
+			}
+			f, err := header.Open()
+			if err != nil {
+				return nil, fmt.Errorf("falha ao ler anexo %s", header.Filename)
+			}
+			data, err := io.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("falha ao ler anexo %s", header.Filename)
+			}
+			contentType := header.Header.Get("Content-Type")
+			if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+				contentType = mediaType
+			}
+			msg.attachments = append(msg.attachments, &composedAttachment{
+				filename:    header.Filename,
+				contentType: contentType,
+				data:        data,
+			})
+		}
+	}
+	return msg, nil
+}
+
+// markAnswered marca a mensagem respondida com \Answered
+func (s *WebmailServer) markAnswered(user *storage.User, id int64) {
+	msg, _, err := s.userMessage(user, strconv.FormatInt(id, 10))
+	if err != nil {
+		return
+	}
+	flags := strings.Fields(msg.Flags)
+	if containsFlag(flags, imap.AnsweredFlag) {
+		return
+	}
+	flags = append(flags, imap.AnsweredFlag)
+	if err := s.store.UpdateMessageFlags(msg.ID, strings.Join(flags, " "), msg.Seen, msg.Deleted, msg.Draft); err != nil {
+		log.Printf("Erro ao marcar mensagem %d como respondida: %v", msg.ID, err)
+	}
+}
+
+// saveSent grava a cópia enviada na pasta Enviados, respeitando a cota
+func (s *WebmailServer) saveSent(user *storage.User, data []byte) error {
+	sent, err := s.specialMailbox(user, imap.SentAttr)
+	if err != nil {
+		return err
+	}
+	if sent == nil {
+		return nil
+	}
+	if err := s.delivery.quota.Check(user, int64(len(data)), 1); err != nil {
+		return err
+	}
+
+	header, content := parseMessage(data)
+	msg := &storage.Message{
+		MailboxID: sent.ID,
+		From:      header.Get("From"),
+		To:        header.Get("To"),
+		Cc:        header.Get("Cc"),
+		Subject:   header.Get("Subject"),
+		Date:      time.Now(),
+		Body:      string(content),
+		RawData:   data,
+		Size:      len(data),
+	}
+	applyFlags(msg, []string{imap.SeenFlag})
+	applyThreadHeaders(msg, header)
+
+	if err := s.store.CreateMessage(msg); err != nil {
+		return fmt.Errorf("falha ao salvar mensagem: %w", err)
+	}
+	return nil
+}
+
+// handlePart envia uma parte da mensagem: anexos como download e imagens
+// embutidas para exibição
+func (s *WebmailServer) handlePart(w http.ResponseWriter, r *http.Request, user *storage.User, session *webmailSession) {
+	msg, _, err := s.userMessage(user, r.FormValue("id"))
+	if errors.Is(err, storage.ErrMessageNotFound) {
+		http.NotFound(w, r)
+		return
+	} else if err != nil {
+		s.serverError(w, user, err)
+		return
+	}
+	part := parseMIME(msg.RawData).findPart(r.FormValue("part"))
+	if part == nil || part.isMultipart() {
+		http.NotFound(w, r)
+		return
+	}
+
+	disposition := "attachment"
+	switch part.mediaType {
+	case "image/png", "image/gif", "image/jpeg", "image/webp":
+		disposition = "inline"
+	}
+	name := part.filename()
+	if name == "" {
+		name = "anexo-" + part.id
+	}
+	w.Header().Set("Content-Type", part.mediaType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": name}))
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	w.Write(part.decoded())
+}
+
+// StartWebmailServer inicia o webmail, se habilitado na configuração
+func StartWebmailServer(cfg *config.Config, store storage.Storage, delivery *Delivery) error {
+	if !cfg.Webmail.Enabled {
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", cfg.Webmail.Address, cfg.Webmail.Port),
+		Handler:           NewWebmailServer(cfg, store, delivery).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      60 * time.Second,
+	}
+
+	log.Printf("Iniciando servidor de webmail em %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil {
+		return fmt.Errorf("falha ao iniciar servidor de webmail: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Elementos HTML mantidos na exibição de mensagens. Os demais são removidos,
+// mas seu texto é preservado.
+var sanitizeAllowedTags = map[string]bool{
+	"a": true, "abbr": true, "address": true, "b": true, "big": true, "blockquote": true,
+	"br": true, "caption": true, "center": true, "cite": true, "code": true, "col": true,
+	"colgroup": true, "dd": true, "del": true, "div": true, "dl": true, "dt": true,
+	"em": true, "font": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "hr": true, "i": true, "img": true, "ins": true, "li": true, "mark": true,
+	"ol": true, "p": true, "pre": true, "q": true, "s": true, "small": true, "span": true,
+	"strike": true, "strong": true, "sub": true, "sup": true, "table": true, "tbody": true,
+	"td": true, "tfoot": true, "th": true, "thead": true, "tr": true, "tt": true, "u": true,
+	"ul": true,
+}
+
+// Elementos removidos junto com todo o seu conteúdo
+var sanitizeDroppedTags = map[string]bool{
+	"applet": true, "embed": true, "frame": true, "frameset": true, "head": true,
+	"iframe": true, "math": true, "noscript": true, "object": true, "script": true,
+	"select": true, "style": true, "svg": true, "template": true, "textarea": true,
+	"title": true,
+}
+
+// Elementos sem conteúdo, que não são fechados
+var sanitizeVoidTags = map[string]bool{"br": true, "col": true, "hr": true, "img": true}
+
+// Atributos mantidos em qualquer elemento permitido. Atributos de evento e
+// style nunca são mantidos.
+var sanitizeAllowedAttrs = map[string]bool{
+	"align": true, "alt": true, "bgcolor": true, "border": true, "cellpadding": true,
+	"cellspacing": true, "color": true, "colspan": true, "dir": true, "face": true,
+	"height": true, "lang": true, "rowspan": true, "size": true, "start": true,
+	"title": true, "valign": true, "width": true,
+}
+
+var (
+	tagNamePattern   = regexp.MustCompile(`^</?([a-zA-Z][a-zA-Z0-9]*)`)
+	attributePattern = regexp.MustCompile(`^\s*([^\s"'<>/=]+)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+	dataImagePattern = regexp.MustCompile(`(?i)^data:image/(png|gif|jpeg|webp);base64,[a-z0-9+/=\s]*$`)
+)
+
+// sanitizeHTML reduz o HTML de uma mensagem a um conjunto seguro de
+// elementos e atributos para exibição no navegador. Links externos abrem em
+// nova janela; imagens só são exibidas quando embutidas na mensagem (cid:,
+// resolvido por cidURL, ou data:), o que também bloqueia rastreadores.
+func sanitizeHTML(content string, cidURL func(cid string) string) string {
+	var b strings.Builder
+	var open []string
+
+	for len(content) > 0 {
+		i := strings.IndexByte(content, '<')
+		if i < 0 {
+			b.WriteString(escapeText(content))
+			break
+		}
+		b.WriteString(escapeText(content[:i]))
+		content = content[i:]
+
+		// Comentários, declarações e instruções de processamento
+		if strings.HasPrefix(content, "<!--") {
+			end := strings.Index(content[4:], "-->")
+			if end < 0 {
+				break
+			}
+			content = content[4+end+3:]
+			continue
+		}
+		if strings.HasPrefix(content, "<!") || strings.HasPrefix(content, "<?") {
+			end := strings.IndexByte(content, '>')
+			if end < 0 {
+				break
+			}
+			content = content[end+1:]
+			continue
+		}
+
+		m := tagNamePattern.FindStringSubmatch(content)
+		if m == nil {
+			b.WriteString("&lt;")
+			content = content[1:]
+			continue
+		}
+		name := strings.ToLower(m[1])
+		closing := content[1] == '/'
+		attrs, rest, ok := parseTagAttributes(content[len(m[0]):])
+		if !ok {
+			break
+		}
+		content = rest
+
+		switch {
+		case sanitizeDroppedTags[name]:
+			if !closing {
+				content = skipElement(content, name)
+			}
+		case !sanitizeAllowedTags[name]:
+			// Elemento removido, conteúdo mantido
+		case closing:
+			for j := len(open) - 1; j >= 0; j-- {
+				if open[j] == name {
+					for _, tag := range reverse(open[j:]) {
+						b.WriteString("</" + tag + ">")
+					}
+					open = open[:j]
+					break
+				}
+			}
+		default:
+			if tag, ok := sanitizeTag(name, attrs, cidURL); ok {
+				b.WriteString(tag)
+				if !sanitizeVoidTags[name] {
+					open = append(open, name)
+				}
+			}
+		}
+	}
+
+	// Fecha os elementos deixados abertos para não afetar o restante da página
+	for _, tag := range reverse(open) {
+		b.WriteString("</" + tag + ">")
+	}
+	return b.String()
+}
+
+// parseTagAttributes lê os atributos de uma tag até o ">" final, retornando
+// o restante do conteúdo
+func parseTagAttributes(content string) (map[string]string, string, bool) {
+	attrs := map[string]string{}
+	for {
+		content = strings.TrimLeft(content, " \t\r\n/")
+		if content == "" {
+			return nil, "", false
+		}
+		if content[0] == '>' {
+			return attrs, content[1:], true
+		}
+
+		m := attributePattern.FindStringSubmatch(content)
+		if m == nil {
+			// Caractere inválido no meio da tag
+			content = content[1:]
+			continue
+		}
+		name := strings.ToLower(m[1])
+		if _, ok := attrs[name]; !ok {
+			attrs[name] = html.UnescapeString(m[2] + m[3] + m[4])
+		}
+		content = content[len(m[0]):]
+	}
+}
+
+// skipElement descarta o conteúdo até o fechamento do elemento
+func skipElement(content, name string) string {
+	lower := strings.ToLower(content)
+	i := strings.Index(lower, "</"+name)
+	if i < 0 {
+		return ""
+	}
+	end := strings.IndexByte(content[i:], '>')
+	if end < 0 {
+		return ""
+	}
+	return content[i+end+1:]
+}
+
+// sanitizeTag monta a tag de abertura com os atributos permitidos
+func sanitizeTag(name string, attrs map[string]string, cidURL func(string) string) (string, bool) {
+	var b strings.Builder
+	b.WriteString("<" + name)
+	for attr, value := range attrs {
+		if sanitizeAllowedAttrs[attr] {
+			b.WriteString(" " + attr + `="` + html.EscapeString(value) + `"`)
+		}
+	}
+
+	switch name {
+	case "a":
+		href := strings.TrimSpace(attrs["href"])
+		lower := strings.ToLower(href)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:") {
+			b.WriteString(` href="` + html.EscapeString(href) + `" target="_blank" rel="noopener noreferrer nofollow"`)
+		}
+	case "img":
+		src := strings.TrimSpace(attrs["src"])
+		switch {
+		case strings.HasPrefix(strings.ToLower(src), "cid:") && cidURL != nil:
+			url := cidURL(src[4:])
+			if url == "" {
+				return "", false
+			}
+			b.WriteString(` src="` + html.EscapeString(url) + `"`)
+		case dataImagePattern.MatchString(src):
+			b.WriteString(` src="` + html.EscapeString(src) + `"`)
+		default:
+			// Imagens externas não são carregadas
+			return "", false
+		}
+	}
+
+	b.WriteString(">")
+	return b.String(), true
+}
+
+// escapeText normaliza o texto entre tags, reescapando as entidades
+func escapeText(text string) string {
+	return html.EscapeString(html.UnescapeString(text))
+}
+
+func reverse(list []string) []string {
+	reversed := make([]string, len(list))
+	for i, s := range list {
+		reversed[len(list)-1-i] = s
+	}
+	return reversed
+}
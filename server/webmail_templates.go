@@ -0,0 +1,182 @@
+package server
+
+// webmailTemplates contém as páginas do webmail. Todas as páginas
+// autenticadas usam "header" e "footer", que exibem as pastas do usuário.
+const webmailTemplates = `
+{{define "style"}}
+<style>
+body { font-family: sans-serif; margin: 0; color: #222; }
+a { color: #1a56a0; text-decoration: none; }
+a:hover { text-decoration: underline; }
+header { background: #1a56a0; color: #fff; padding: .6em 1em; display: flex; justify-content: space-between; align-items: center; }
+header a, header button { color: #fff; }
+header form { display: inline; }
+button, input[type=submit] { cursor: pointer; }
+.link { background: none; border: none; padding: 0; font: inherit; text-decoration: underline; }
+.layout { display: flex; }
+nav { width: 14em; padding: 1em; border-right: 1px solid #ddd; min-height: 90vh; }
+nav ul { list-style: none; padding: 0; margin: 0; }
+nav li { padding: .2em 0; }
+nav .current { font-weight: bold; }
+main { flex: 1; padding: 1em; min-width: 0; }
+table.list { width: 100%; border-collapse: collapse; }
+table.list td, table.list th { padding: .35em .5em; border-bottom: 1px solid #eee; text-align: left; }
+table.list tr.unseen { font-weight: bold; }
+.notice { background: #e7f4e4; padding: .5em; margin-bottom: 1em; }
+.error { background: #fbe3e3; padding: .5em; margin-bottom: 1em; }
+.meta { color: #555; margin-bottom: 1em; }
+.meta div { margin: .15em 0; }
+.actions { margin: 1em 0; }
+.actions form { display: inline; }
+.body-text { white-space: pre-wrap; font-family: monospace; }
+.body-html { border-top: 1px solid #ddd; padding-top: 1em; overflow-x: auto; }
+.pager { margin-top: 1em; }
+form.compose label { display: block; margin-top: .6em; }
+form.compose input[type=text], form.compose textarea { width: 100%; box-sizing: border-box; }
+form.compose textarea { height: 20em; font-family: monospace; }
+.login { max-width: 20em; margin: 5em auto; }
+.login input { width: 100%; box-sizing: border-box; margin-bottom: .6em; }
+</style>
+{{end}}
+
+{{define "header"}}<!DOCTYPE html>
+<html lang="pt-BR">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}} - Webmail</title>
+{{template "style"}}
+</head>
+<body>
+<header>
+  <span><a href="/compose">Escrever</a></span>
+  <span>{{.User.Email}}
+    <form method="post" action="/logout"><input type="hidden" name="csrf" value="{{.CSRF}}"><button class="link">Sair</button></form>
+  </span>
+</header>
+<div class="layout">
+<nav>
+  <form method="get" action="/mailbox">
+    <input type="hidden" name="name" value="{{.Mailbox}}">
+    <input type="search" name="q" value="{{.Query}}" placeholder="Pesquisar">
+  </form>
+  <ul>
+  {{range .Folders}}
+    <li{{if .Current}} class="current"{{end}} style="padding-left: {{.Depth}}em">
+      {{if .NoSelect}}{{.Label}}{{else}}<a href="/mailbox?name={{.Name}}">{{.Label}}</a>{{if .Unseen}} ({{.Unseen}}){{end}}{{end}}
+    </li>
+  {{end}}
+  </ul>
+</nav>
+<main>
+{{if .Notice}}<div class="notice">{{.Notice}}</div>{{end}}
+{{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+{{end}}
+
+{{define "footer"}}
+</main>
+</div>
+</body>
+</html>
+{{end}}
+
+{{define "login"}}<!DOCTYPE html>
+<html lang="pt-BR">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Entrar - Webmail</title>
+{{template "style"}}
+</head>
+<body>
+<form class="login" method="post" action="/login">
+  <h2>Webmail</h2>
+  {{if .Error}}<div class="error">{{.Error}}</div>{{end}}
+  <input type="text" name="username" placeholder="Usuário ou endereço" value="{{.Username}}" autofocus required>
+  <input type="password" name="password" placeholder="Senha" required>
+  <input type="submit" value="Entrar">
+</form>
+</body>
+</html>
+{{end}}
+
+{{define "mailbox"}}{{template "header" .}}
+<h2>{{.Mailbox}}{{if .Query}}: resultados para "{{.Query}}"{{end}}</h2>
+{{if .Messages}}
+<table class="list">
+  <tr><th>De</th><th>Assunto</th><th>Data</th><th></th></tr>
+  {{range .Messages}}
+  <tr{{if not .Seen}} class="unseen"{{end}}>
+    <td>{{.From}}</td>
+    <td><a href="/message?id={{.ID}}">{{if .Subject}}{{.Subject}}{{else}}(sem assunto){{end}}</a></td>
+    <td>{{.Date}}</td>
+    <td>{{if .Flagged}}&#9733;{{end}}{{if .HasAttachment}} &#128206;{{end}}</td>
+  </tr>
+  {{end}}
+</table>
+<div class="pager">
+  {{if .PrevPage}}<a href="/mailbox?name={{.Mailbox}}&amp;q={{.Query}}&amp;page={{.PrevPage}}">&laquo; Anterior</a>{{end}}
+  Página {{.Page}} de {{.Pages}}
+  {{if .NextPage}}<a href="/mailbox?name={{.Mailbox}}&amp;q={{.Query}}&amp;page={{.NextPage}}">Próxima &raquo;</a>{{end}}
+</div>
+{{else}}
+<p>Nenhuma mensagem.</p>
+{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "message"}}{{template "header" .}}
+{{with .Message}}
+<h2>{{if .Subject}}{{.Subject}}{{else}}(sem assunto){{end}}</h2>
+<div class="meta">
+  <div><b>De:</b> {{.From}}</div>
+  {{if .To}}<div><b>Para:</b> {{.To}}</div>{{end}}
+  {{if .Cc}}<div><b>Cc:</b> {{.Cc}}</div>{{end}}
+  <div><b>Data:</b> {{.Date}}</div>
+</div>
+<div class="actions">
+  <a href="/compose?reply={{.ID}}">Responder</a> |
+  <a href="/compose?replyall={{.ID}}">Responder a todos</a> |
+  <a href="/compose?forward={{.ID}}">Encaminhar</a> |
+  <form method="post" action="/message/action">
+    <input type="hidden" name="csrf" value="{{$.CSRF}}">
+    <input type="hidden" name="id" value="{{.ID}}">
+    <button name="action" value="unseen">Marcar como não lida</button>
+    <button name="action" value="delete">Excluir</button>
+    <select name="target">
+      {{range $.Folders}}{{if not .NoSelect}}<option value="{{.Name}}">{{.Name}}</option>{{end}}{{end}}
+    </select>
+    <button name="action" value="move">Mover</button>
+  </form>
+</div>
+{{if .Attachments}}
+<div class="meta"><b>Anexos:</b>
+  {{range .Attachments}}<a href="/part?id={{$.Message.ID}}&amp;part={{.Part}}">{{.Name}}</a> ({{.Size}}) {{end}}
+</div>
+{{end}}
+{{if .HTML}}<div class="body-html">{{.HTML}}</div>{{else}}<div class="body-text">{{.Text}}</div>{{end}}
+{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "compose"}}{{template "header" .}}
+{{with .Compose}}
+<h2>Nova mensagem</h2>
+<form class="compose" method="post" action="/send" enctype="multipart/form-data">
+  <input type="hidden" name="csrf" value="{{$.CSRF}}">
+  <input type="hidden" name="in_reply_to" value="{{.InReplyTo}}">
+  <input type="hidden" name="references" value="{{.References}}">
+  <input type="hidden" name="answered" value="{{.Answered}}">
+  <input type="hidden" name="forward" value="{{.Forward}}">
+  <label>Para <input type="text" name="to" value="{{.To}}"></label>
+  <label>Cc <input type="text" name="cc" value="{{.Cc}}"></label>
+  <label>Cco <input type="text" name="bcc" value="{{.Bcc}}"></label>
+  <label>Assunto <input type="text" name="subject" value="{{.Subject}}"></label>
+  <label>Mensagem <textarea name="body">{{.Body}}</textarea></label>
+  {{if .ForwardAttachments}}
+  <p>Anexos encaminhados: {{range .ForwardAttachments}}{{.Name}} ({{.Size}}) {{end}}</p>
+  {{end}}
+  <label>Anexos <input type="file" name="attachments" multiple></label>
+  <p><input type="submit" value="Enviar"></p>
+</form>
+{{end}}
+{{template "footer" .}}{{end}}
+`
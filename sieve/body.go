@@ -0,0 +1,103 @@
+package sieve
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// maxMIMEDepth limita a recursão em mensagens multipart aninhadas
+const maxMIMEDepth = 10
+
+// bodyParts retorna o conteúdo usado pelo teste body (RFC 5173). Com
+// :raw, o corpo sem decodificação; com :content, as partes cujo tipo MIME
+// corresponde a um dos tipos informados; caso contrário (:text), as partes
+// text/* decodificadas.
+func bodyParts(msg *Message, transform string, contentTypes []string) []string {
+	if transform == "raw" {
+		return []string{string(msg.Body)}
+	}
+	if transform != "content" {
+		contentTypes = []string{"text"}
+	}
+
+	header := textproto.MIMEHeader(msg.Header)
+	var parts []string
+	collectParts(header, msg.Body, contentTypes, 0, &parts)
+	return parts
+}
+
+func collectParts(header textproto.MIMEHeader, body []byte, contentTypes []string, depth int, parts *[]string) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") && depth < maxMIMEDepth {
+		if typeMatches(mediaType, contentTypes) {
+			*parts = append(*parts, multipartPreamble(body, params["boundary"]))
+		}
+		reader := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := reader.NextRawPart()
+			if err != nil {
+				return
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return
+			}
+			collectParts(part.Header, data, contentTypes, depth+1, parts)
+		}
+	}
+
+	if typeMatches(mediaType, contentTypes) {
+		*parts = append(*parts, decodeBody(header.Get("Content-Transfer-Encoding"), body))
+	}
+}
+
+// typeMatches compara o tipo MIME com a lista de :content; "" casa com
+// todos, "tipo" casa com "tipo/*" e "tipo/subtipo" exige igualdade
+func typeMatches(mediaType string, contentTypes []string) bool {
+	for _, ct := range contentTypes {
+		ct = strings.ToLower(ct)
+		if ct == "" || ct == mediaType || (!strings.Contains(ct, "/") && strings.HasPrefix(mediaType, ct+"/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// multipartPreamble retorna o texto anterior ao primeiro delimitador
+func multipartPreamble(body []byte, boundary string) string {
+	if i := bytes.Index(body, []byte("--"+boundary)); i >= 0 {
+		return string(body[:i])
+	}
+	return string(body)
+}
+
+// decodeBody decodifica quoted-printable e base64
+func decodeBody(encoding string, body []byte) string {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		if data, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body))); err == nil {
+			return string(data)
+		}
+	case "base64":
+		clean := strings.Map(func(r rune) rune {
+			if r == '\r' || r == '\n' || r == ' ' {
+				return -1
+			}
+			return r
+		}, string(body))
+		if data, err := base64.StdEncoding.DecodeString(clean); err == nil {
+			return string(data)
+		}
+	}
+	return string(body)
+}
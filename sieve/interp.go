@@ -0,0 +1,586 @@
+package sieve
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxRedirects limita a quantidade de redirect por execução
+const maxRedirects = 5
+
+// Script é um script Sieve analisado e validado
+type Script struct {
+	commands []*node
+	requires map[string]bool
+}
+
+// Parse analisa e valida um script Sieve (RFC 5228)
+func Parse(src string) (*Script, error) {
+	commands, err := parse(src)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{requires: make(map[string]bool)}
+	if err := v.commands(commands, true); err != nil {
+		return nil, err
+	}
+
+	return &Script{
+		commands: commands,
+		requires: v.requires,
+	}, nil
+}
+
+// Message contém os dados da mensagem avaliados pelo script
+type Message struct {
+	From   string      // Remetente de envelope (MAIL FROM)
+	To     string      // Destinatário de envelope (RCPT TO)
+	Header mail.Header // Cabeçalhos da mensagem
+	Body   []byte      // Corpo da mensagem, sem os cabeçalhos
+	Size   int
+
+	// MailboxExists é usado pelo teste mailboxexists; pode ser nil
+	MailboxExists func(name string) bool
+}
+
+// Action é uma ação resultante da execução do script
+type Action interface {
+	isAction()
+}
+
+// KeepAction grava a mensagem na caixa padrão
+type KeepAction struct {
+	Flags []string
+}
+
+// FileIntoAction grava a mensagem em uma caixa específica
+type FileIntoAction struct {
+	Mailbox string
+	Flags   []string
+	Create  bool
+}
+
+// RedirectAction reenvia a mensagem para outro endereço
+type RedirectAction struct {
+	Address string
+}
+
+// DiscardAction descarta a mensagem silenciosamente
+type DiscardAction struct{}
+
+// RejectAction recusa a mensagem informando o motivo ao remetente
+type RejectAction struct {
+	Reason   string
+	Extended bool // ereject: recusar durante a transação SMTP quando possível
+}
+
+// VacationAction envia uma resposta automática (RFC 5230)
+type VacationAction struct {
+	Reason    string
+	Subject   string
+	From      string
+	Addresses []string
+	Days      int
+	Mime      bool
+	Handle    string
+}
+
+func (*KeepAction) isAction()     {}
+func (*FileIntoAction) isAction() {}
+func (*RedirectAction) isAction() {}
+func (*DiscardAction) isAction()  {}
+func (*RejectAction) isAction()   {}
+func (*VacationAction) isAction() {}
+
+// errStop interrompe a execução (comando stop)
+var errStop = errors.New("stop")
+
+// runtime guarda o estado de uma execução
+type runtime struct {
+	script       *Script
+	msg          *Message
+	vars         map[string]string
+	matchVars    []string
+	flags        []string
+	implicitKeep bool
+	actions      []Action
+	redirects    int
+}
+
+// Execute executa o script sobre a mensagem e retorna as ações resultantes.
+// Se nenhuma ação cancelar o keep implícito, uma KeepAction é incluída.
+// Em caso de erro de execução, o chamador deve aplicar o keep implícito.
+func (s *Script) Execute(msg *Message) ([]Action, error) {
+	rt := &runtime{
+		script:       s,
+		msg:          msg,
+		vars:         make(map[string]string),
+		implicitKeep: true,
+	}
+
+	if err := rt.run(s.commands); err != nil && err != errStop {
+		return nil, err
+	}
+
+	if rt.implicitKeep {
+		rt.actions = append(rt.actions, &KeepAction{Flags: rt.flags})
+	}
+	return rt.actions, nil
+}
+
+func (rt *runtime) run(commands []*node) error {
+	// Rastreia se o último if/elsif da cadeia já executou um bloco
+	handled := false
+	for _, cmd := range commands {
+		switch cmd.name {
+		case "require":
+			continue
+		case "if":
+			handled = false
+			fallthrough
+		case "elsif":
+			if handled {
+				continue
+			}
+			ok, err := rt.test(cmd.tests[0])
+			if err != nil {
+				return err
+			}
+			if ok {
+				handled = true
+				if err := rt.run(cmd.block); err != nil {
+					return err
+				}
+			}
+			continue
+		case "else":
+			if !handled {
+				handled = true
+				if err := rt.run(cmd.block); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if err := rt.action(cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// action executa um comando que não é de controle de fluxo
+func (rt *runtime) action(cmd *node) error {
+	switch cmd.name {
+	case "stop":
+		return errStop
+	case "keep":
+		rt.implicitKeep = false
+		rt.actions = append(rt.actions, &KeepAction{Flags: rt.actionFlags(cmd)})
+	case "discard":
+		rt.implicitKeep = false
+		rt.actions = append(rt.actions, &DiscardAction{})
+	case "fileinto":
+		if !cmd.hasTag("copy") {
+			rt.implicitKeep = false
+		}
+		rt.actions = append(rt.actions, &FileIntoAction{
+			Mailbox: rt.expand(cmd.positional[0].strings[0]),
+			Flags:   rt.actionFlags(cmd),
+			Create:  cmd.hasTag("create"),
+		})
+	case "redirect":
+		rt.redirects++
+		if rt.redirects > maxRedirects {
+			return fmt.Errorf("limite de %d redirecionamentos excedido", maxRedirects)
+		}
+		address := rt.expand(cmd.positional[0].strings[0])
+		if _, err := mail.ParseAddress(address); err != nil {
+			return fmt.Errorf("endereço de redirecionamento inválido: %s", address)
+		}
+		if !cmd.hasTag("copy") {
+			rt.implicitKeep = false
+		}
+		rt.actions = append(rt.actions, &RedirectAction{Address: address})
+	case "reject", "ereject":
+		rt.implicitKeep = false
+		rt.actions = append(rt.actions, &RejectAction{
+			Reason:   rt.expand(cmd.positional[0].strings[0]),
+			Extended: cmd.name == "ereject",
+		})
+	case "vacation":
+		rt.actions = append(rt.actions, rt.vacation(cmd))
+	case "set":
+		rt.set(cmd)
+	case "setflag", "addflag", "removeflag":
+		rt.updateFlags(cmd)
+	}
+	return nil
+}
+
+func (rt *runtime) vacation(cmd *node) *VacationAction {
+	v := &VacationAction{
+		Reason: rt.expand(cmd.positional[0].strings[0]),
+		Days:   7,
+		Mime:   cmd.hasTag("mime"),
+	}
+	if days := cmd.tags["days"]; days != nil {
+		v.Days = int(days.number)
+		if v.Days < 1 {
+			v.Days = 1
+		}
+	}
+	if subject := cmd.tags["subject"]; subject != nil {
+		v.Subject = rt.expand(subject.strings[0])
+	}
+	if from := cmd.tags["from"]; from != nil {
+		v.From = rt.expand(from.strings[0])
+	}
+	if addresses := cmd.tags["addresses"]; addresses != nil {
+		v.Addresses = rt.expandList(addresses.strings)
+	}
+	if handle := cmd.tags["handle"]; handle != nil {
+		v.Handle = rt.expand(handle.strings[0])
+	}
+	return v
+}
+
+// set atribui uma variável aplicando os modificadores (RFC 5229, seção 4)
+func (rt *runtime) set(cmd *node) {
+	name := strings.ToLower(rt.expand(cmd.positional[0].strings[0]))
+	value := rt.expand(cmd.positional[1].strings[0])
+
+	switch {
+	case cmd.hasTag("lower"):
+		value = strings.ToLower(value)
+	case cmd.hasTag("upper"):
+		value = strings.ToUpper(value)
+	}
+	switch {
+	case cmd.hasTag("lowerfirst"):
+		value = mapFirst(value, unicode.ToLower)
+	case cmd.hasTag("upperfirst"):
+		value = mapFirst(value, unicode.ToUpper)
+	}
+	if cmd.hasTag("quotewildcard") {
+		value = quoteWildcard(value)
+	}
+	if cmd.hasTag("length") {
+		value = strconv.Itoa(utf8.RuneCountInString(value))
+	}
+
+	rt.vars[name] = value
+}
+
+// updateFlags executa setflag, addflag e removeflag (RFC 5232)
+func (rt *runtime) updateFlags(cmd *node) {
+	list := parseFlags(rt.expandList(cmd.positional[1].strings))
+
+	current := rt.flags
+	varName := ""
+	if cmd.positional[0] != nil {
+		varName = strings.ToLower(rt.expand(cmd.positional[0].strings[0]))
+		current = parseFlags([]string{rt.vars[varName]})
+	}
+
+	switch cmd.name {
+	case "setflag":
+		current = list
+	case "addflag":
+		current = parseFlags(append(current, list...))
+	case "removeflag":
+		var kept []string
+		for _, flag := range current {
+			if !containsFold(list, flag) {
+				kept = append(kept, flag)
+			}
+		}
+		current = kept
+	}
+
+	if varName != "" {
+		rt.vars[varName] = strings.Join(current, " ")
+	} else {
+		rt.flags = current
+	}
+}
+
+// actionFlags retorna as flags de :flags ou, sem a tag, as flags internas
+func (rt *runtime) actionFlags(cmd *node) []string {
+	if flags := cmd.tags["flags"]; flags != nil {
+		return parseFlags(rt.expandList(flags.strings))
+	}
+	return rt.flags
+}
+
+// test avalia um teste
+func (rt *runtime) test(t *node) (bool, error) {
+	switch t.name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "not":
+		ok, err := rt.test(t.tests[0])
+		return !ok, err
+	case "allof":
+		for _, sub := range t.tests {
+			ok, err := rt.test(sub)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case "anyof":
+		for _, sub := range t.tests {
+			ok, err := rt.test(sub)
+			if err != nil || ok {
+				return ok, err
+			}
+		}
+		return false, nil
+	case "exists":
+		for _, name := range rt.expandList(t.positional[0].strings) {
+			if len(rt.msg.Header[canonicalHeader(name)]) == 0 {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "size":
+		limit := t.positional[0].number
+		if t.hasTag("over") {
+			return int64(rt.msg.Size) > limit, nil
+		}
+		return int64(rt.msg.Size) < limit, nil
+	case "header":
+		return rt.matchAny(t, rt.headerValues(t.positional[0].strings), t.positional[1].strings), nil
+	case "address":
+		var values []string
+		for _, name := range rt.expandList(t.positional[0].strings) {
+			for _, raw := range rt.msg.Header[canonicalHeader(name)] {
+				values = append(values, addressParts(t, parseAddresses(raw))...)
+			}
+		}
+		return rt.matchAny(t, values, t.positional[1].strings), nil
+	case "envelope":
+		var values []string
+		for _, part := range rt.expandList(t.positional[0].strings) {
+			switch strings.ToLower(part) {
+			case "from":
+				values = append(values, addressParts(t, []string{rt.msg.From})...)
+			case "to":
+				values = append(values, addressParts(t, []string{rt.msg.To})...)
+			}
+		}
+		return rt.matchAny(t, values, t.positional[1].strings), nil
+	case "body":
+		transform := "text"
+		var contentTypes []string
+		switch {
+		case t.hasTag("raw"):
+			transform = "raw"
+		case t.hasTag("content"):
+			transform = "content"
+			contentTypes = rt.expandList(t.tags["content"].strings)
+		}
+		keys := rt.expandList(t.positional[0].strings)
+		m := newMatcher(t)
+		for _, part := range bodyParts(rt.msg, transform, contentTypes) {
+			for _, key := range keys {
+				if ok, _ := m.match(part, key); ok {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+	case "string":
+		return rt.matchAny(t, rt.expandList(t.positional[0].strings), t.positional[1].strings), nil
+	case "hasflag":
+		flags := rt.flags
+		if t.positional[0] != nil {
+			flags = nil
+			for _, name := range rt.expandList(t.positional[0].strings) {
+				flags = append(flags, parseFlags([]string{rt.vars[strings.ToLower(name)]})...)
+			}
+		}
+		return rt.matchAny(t, flags, t.positional[1].strings), nil
+	case "mailboxexists":
+		if rt.msg.MailboxExists == nil {
+			return false, nil
+		}
+		for _, name := range rt.expandList(t.positional[0].strings) {
+			if !rt.msg.MailboxExists(name) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("teste desconhecido: %s", t.name)
+}
+
+// matchAny compara cada valor com cada chave, guardando as capturas de :matches
+func (rt *runtime) matchAny(t *node, values, keys []string) bool {
+	m := newMatcher(t)
+	keys = rt.expandList(keys)
+	for _, value := range values {
+		for _, key := range keys {
+			if ok, captures := m.match(value, key); ok {
+				if m.matchType == "matches" {
+					rt.matchVars = captures
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerValues retorna os valores decodificados dos cabeçalhos informados
+func (rt *runtime) headerValues(names []string) []string {
+	dec := new(mime.WordDecoder)
+	var values []string
+	for _, name := range rt.expandList(names) {
+		for _, raw := range rt.msg.Header[canonicalHeader(name)] {
+			if decoded, err := dec.DecodeHeader(raw); err == nil {
+				raw = decoded
+			}
+			values = append(values, strings.TrimSpace(raw))
+		}
+	}
+	return values
+}
+
+// expand substitui referências a variáveis quando a extensão variables está ativa
+func (rt *runtime) expand(s string) string {
+	if !rt.script.requires["variables"] || !strings.Contains(s, "${") {
+		return s
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			b.WriteString(s)
+			return b.String()
+		}
+
+		name := s[start+2 : start+end]
+		if value, ok := rt.variable(name); ok {
+			b.WriteString(s[:start])
+			b.WriteString(value)
+		} else {
+			// Referências inválidas são mantidas literalmente
+			b.WriteString(s[:start+end+1])
+		}
+		s = s[start+end+1:]
+	}
+}
+
+// variable retorna o valor de uma variável ou de uma variável de captura
+func (rt *runtime) variable(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n < len(rt.matchVars) {
+			return rt.matchVars[n], true
+		}
+		return "", true
+	}
+	for i, r := range name {
+		if !(r == '_' || r == '.' || unicode.IsLetter(r) || (i > 0 && unicode.IsDigit(r))) {
+			return "", false
+		}
+	}
+	return rt.vars[strings.ToLower(name)], true
+}
+
+func (rt *runtime) expandList(list []string) []string {
+	result := make([]string, len(list))
+	for i, s := range list {
+		result[i] = rt.expand(s)
+	}
+	return result
+}
+
+// addressParts extrai a parte pedida (:all, :localpart, :domain) dos endereços
+func addressParts(t *node, addresses []string) []string {
+	var parts []string
+	for _, addr := range addresses {
+		local, domain := addr, ""
+		if i := strings.LastIndex(addr, "@"); i >= 0 {
+			local, domain = addr[:i], addr[i+1:]
+		}
+		switch {
+		case t.hasTag("localpart"):
+			parts = append(parts, local)
+		case t.hasTag("domain"):
+			parts = append(parts, domain)
+		default:
+			parts = append(parts, addr)
+		}
+	}
+	return parts
+}
+
+// parseAddresses extrai os endereços de um cabeçalho como From ou To
+func parseAddresses(raw string) []string {
+	list, err := mail.ParseAddressList(raw)
+	if err != nil {
+		return []string{strings.TrimSpace(raw)}
+	}
+	addresses := make([]string, len(list))
+	for i, addr := range list {
+		addresses[i] = addr.Address
+	}
+	return addresses
+}
+
+// parseFlags separa e normaliza uma lista de flags, removendo duplicadas
+func parseFlags(list []string) []string {
+	var flags []string
+	for _, item := range list {
+		for _, flag := range strings.Fields(item) {
+			if !containsFold(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+	return flags
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func canonicalHeader(name string) string {
+	return textproto.CanonicalMIMEHeaderKey(name)
+}
+
+func mapFirst(s string, f func(rune) rune) string {
+	r, n := utf8.DecodeRuneInString(s)
+	if n == 0 {
+		return s
+	}
+	return string(f(r)) + s[n:]
+}
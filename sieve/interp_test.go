@@ -0,0 +1,214 @@
+package sieve
+
+import (
+	"bytes"
+	"fmt"
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testMessage = "From: \"Ana\" <ana@origem.example>\r\n" +
+	"To: bob@example.com, carol@example.com\r\n" +
+	"Subject: =?UTF-8?Q?Relat=C3=B3rio?= Mensal\r\n" +
+	"X-Lista: vendas\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/alternative; boundary=limite\r\n" +
+	"\r\n" +
+	"--limite\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Promo=C3=A7=C3=A3o de ver=C3=A3o\r\n" +
+	"--limite\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>OFERTA</p>\r\n" +
+	"--limite--\r\n"
+
+// newTestMessage monta a mensagem avaliada pelos scripts dos testes
+func newTestMessage(t *testing.T) *Message {
+	t.Helper()
+	parsed, err := mail.ReadMessage(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body bytes.Buffer
+	if _, err := body.ReadFrom(parsed.Body); err != nil {
+		t.Fatal(err)
+	}
+	return &Message{
+		From:   "ana@origem.example",
+		To:     "bob@example.com",
+		Header: parsed.Header,
+		Body:   body.Bytes(),
+		Size:   len(testMessage),
+		MailboxExists: func(name string) bool {
+			return name == "INBOX" || name == "Vendas"
+		},
+	}
+}
+
+func TestExecute(t *testing.T) {
+	keep := &KeepAction{}
+	fileinto := func(mailbox string) *FileIntoAction { return &FileIntoAction{Mailbox: mailbox} }
+
+	tests := []struct {
+		name string
+		src  string
+		want []Action
+	}{
+		{"keep implícito", "", []Action{keep}},
+		{"discard", "discard;", []Action{&DiscardAction{}}},
+		{"stop", "keep; stop; discard;", []Action{keep}},
+
+		// Comparadores e tipos de comparação
+		{"header decodificado", `require "fileinto";
+if header :contains "subject" "RELATóRIO" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{"i;ascii-casemap não altera letras acentuadas", `require "fileinto";
+if header :contains "subject" "RELATÓRIO" { fileinto "A"; }`, []Action{keep}},
+		{"i;octet diferencia maiúsculas", `require "fileinto";
+if header :contains :comparator "i;octet" "subject" "relatório" { fileinto "A"; }`, []Action{keep}},
+		{"i;octet com o mesmo texto", `require "fileinto";
+if header :is :comparator "i;octet" "subject" "Relatório Mensal" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{":is compara o valor inteiro", `require "fileinto";
+if header :is "subject" "relatório" { fileinto "A"; }`, []Action{keep}},
+		{"lista de chaves", `require "fileinto";
+if header :is "x-lista" ["compras", "VENDAS"] { fileinto "A"; }`, []Action{fileinto("A")}},
+		{":matches com curingas", `require "fileinto";
+if header :matches "subject" "rel?t*o mensal" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{":matches com curinga escapado", `require "fileinto";
+if header :matches "subject" "*\\?" { fileinto "A"; }`, []Action{keep}},
+		{":matches com i;octet", `require "fileinto";
+if header :matches :comparator "i;octet" "subject" "relat*" { fileinto "A"; }`, []Action{keep}},
+		{"capturas de :matches", `require ["fileinto", "variables"];
+if address :matches "from" "*@*.example" { fileinto "${2}/${1}"; }`, []Action{fileinto("origem/ana")}},
+
+		// Testes de endereço, envelope, existência e tamanho
+		{"address com vários endereços", `require "fileinto";
+if address :all :is "to" "CAROL@example.com" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{"address :localpart", `require "fileinto";
+if address :localpart :is "from" "ana" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{"envelope :domain", `require ["envelope", "fileinto"];
+if envelope :domain :is "to" "example.com" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{"exists", `require "fileinto";
+if exists ["subject", "x-lista"] { fileinto "A"; } if exists ["subject", "x-nada"] { fileinto "B"; }`, []Action{fileinto("A")}},
+		{"size", `require "fileinto";
+if size :over 100 { fileinto "A"; } if size :under 1K { fileinto "B"; }`, []Action{fileinto("A"), fileinto("B")}},
+		{"mailboxexists", `require ["fileinto", "mailbox"];
+if mailboxexists "Vendas" { fileinto "Vendas"; } if mailboxexists ["INBOX", "Outra"] { fileinto "B"; }`, []Action{fileinto("Vendas")}},
+
+		// Controle de fluxo e testes compostos
+		{"elsif", `require "fileinto";
+if false { fileinto "A"; } elsif true { fileinto "B"; } else { fileinto "C"; }`, []Action{fileinto("B")}},
+		{"else", `require "fileinto";
+if false { fileinto "A"; } elsif false { fileinto "B"; } else { fileinto "C"; }`, []Action{fileinto("C")}},
+		{"allof anyof not", `require "fileinto";
+if allof (not exists "x-nada", anyof (false, header :contains "x-lista" "vend")) { fileinto "A"; }`, []Action{fileinto("A")}},
+
+		// body (RFC 5173)
+		{"body decodificado", `require "body";
+if body :contains "promoção" { discard; }`, []Action{&DiscardAction{}}},
+		{"body :text inclui HTML", `require "body";
+if body :text :contains "oferta" { discard; }`, []Action{&DiscardAction{}}},
+		{"body :content", `require "body";
+if body :content "text/plain" :contains "oferta" { discard; }`, []Action{keep}},
+		{"body :raw não decodifica", `require "body";
+if body :raw :contains "Promo=C3=A7" { discard; }`, []Action{&DiscardAction{}}},
+		{"body não inclui cabeçalhos", `require "body";
+if body :contains "Mensal" { discard; }`, []Action{keep}},
+
+		// fileinto, redirect e reject
+		{"fileinto :copy mantém o keep", `require ["fileinto", "copy"]; fileinto :copy "A";`,
+			[]Action{fileinto("A"), keep}},
+		{"fileinto :create", `require ["fileinto", "mailbox"]; fileinto :create "Nova";`,
+			[]Action{&FileIntoAction{Mailbox: "Nova", Create: true}}},
+		{"fileinto sem variables", `require "fileinto"; fileinto "${pasta}";`, []Action{fileinto("${pasta}")}},
+		{"redirect", `redirect "carol@destino.example";`, []Action{&RedirectAction{Address: "carol@destino.example"}}},
+		{"redirect :copy", `require "copy"; redirect :copy "carol@destino.example";`,
+			[]Action{&RedirectAction{Address: "carol@destino.example"}, keep}},
+		{"reject", `require "reject"; reject "não aceito";`, []Action{&RejectAction{Reason: "não aceito"}}},
+		{"ereject", `require "ereject"; ereject "não aceito";`, []Action{&RejectAction{Reason: "não aceito", Extended: true}}},
+
+		// vacation (RFC 5230)
+		{"vacation", `require "vacation";
+vacation :days 3 :subject "Ausente" :from "bob@example.com" :addresses ["bob@example.com", "b@example.com"] :mime :handle "ferias" "Volto logo";`,
+			[]Action{&VacationAction{
+				Reason: "Volto logo", Subject: "Ausente", From: "bob@example.com",
+				Addresses: []string{"bob@example.com", "b@example.com"}, Days: 3, Mime: true, Handle: "ferias",
+			}, keep}},
+		{"vacation padrão", `require "vacation"; vacation text:
+Volto
+..logo
+.
+;`, []Action{&VacationAction{Reason: "Volto\r\n.logo\r\n", Days: 7}, keep}},
+		{"vacation com :days 0", `require "vacation"; vacation :days 0 "Volto";`,
+			[]Action{&VacationAction{Reason: "Volto", Days: 1}, keep}},
+		{"vacation com variáveis", `require ["vacation", "variables"];
+if header :matches "subject" "*" { vacation :subject "Re: ${1}" "Volto"; }`,
+			[]Action{&VacationAction{Reason: "Volto", Subject: "Re: Relatório Mensal", Days: 7}, keep}},
+
+		// variables (RFC 5229) e imap4flags (RFC 5232)
+		{"set com modificadores", `require ["fileinto", "variables"];
+set :lower :upperfirst "pasta" "NOTICIAS"; set :length "n" "${pasta}"; fileinto "${PASTA}-${n}";`,
+			[]Action{fileinto("Noticias-8")}},
+		{"set :quotewildcard", `require ["fileinto", "variables"];
+set :quotewildcard "p" "a*b"; if string :matches "a*b" "${p}" { fileinto "A"; }`, []Action{fileinto("A")}},
+		{"flags internas", `require "imap4flags";
+addflag "\\Seen"; addflag ["\\Flagged \\seen"]; removeflag "\\flagged";`,
+			[]Action{&KeepAction{Flags: []string{"\\Seen"}}}},
+		{"fileinto :flags", `require ["fileinto", "imap4flags"];
+setflag "\\Seen"; fileinto :flags "\\Flagged" "A"; fileinto "B";`,
+			[]Action{
+				&FileIntoAction{Mailbox: "A", Flags: []string{"\\Flagged"}},
+				&FileIntoAction{Mailbox: "B", Flags: []string{"\\Seen"}},
+			}},
+		{"hasflag em variável", `require ["fileinto", "imap4flags", "variables"];
+addflag "f" "$Importante"; if hasflag :is "f" "$importante" { fileinto "A"; }`, []Action{fileinto("A")}},
+	}
+	for _, tt := range tests {
+		script, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		got, err := script.Execute(newTestMessage(t))
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: ações = %s, esperado %s", tt.name, formatActions(got), formatActions(tt.want))
+		}
+	}
+}
+
+func TestExecuteErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		msg  string
+	}{
+		{"redirect inválido", `redirect "não é endereço";`, "endereço de redirecionamento inválido"},
+		{"redirects demais", strings.Repeat(`redirect "a@b.example";`, maxRedirects+1), "limite de 5 redirecionamentos"},
+	}
+	for _, tt := range tests {
+		script, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if _, err := script.Execute(newTestMessage(t)); err == nil || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: erro = %v, esperado %s", tt.name, err, tt.msg)
+		}
+	}
+}
+
+func formatActions(actions []Action) string {
+	var parts []string
+	for _, action := range actions {
+		parts = append(parts, fmt.Sprintf("%T%+v", action, action))
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
@@ -0,0 +1,256 @@
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tokenKind identifica o tipo de um token Sieve
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdentifier
+	tokTag
+	tokNumber
+	tokString
+	tokLBracket
+	tokRBracket
+	tokLParen
+	tokRParen
+	tokLBrace
+	tokRBrace
+	tokComma
+	tokSemicolon
+)
+
+// token representa um elemento léxico do script
+type token struct {
+	kind   tokenKind
+	text   string
+	number int64
+	line   int
+}
+
+// lexer divide o código-fonte Sieve em tokens (RFC 5228, seção 8.1)
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func newLexer(src string) *lexer {
+	return &lexer{src: src, line: 1}
+}
+
+// tokenize retorna todos os tokens do script
+func (l *lexer) tokenize() ([]token, error) {
+	var tokens []token
+	for {
+		tok, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, tok)
+		if tok.kind == tokEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Line: l.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipWhitespace(); err != nil {
+		return token{}, err
+	}
+	if l.pos >= len(l.src) {
+		return token{kind: tokEOF, line: l.line}, nil
+	}
+
+	c := l.src[l.pos]
+	line := l.line
+	switch {
+	case c == '[':
+		l.pos++
+		return token{kind: tokLBracket, line: line}, nil
+	case c == ']':
+		l.pos++
+		return token{kind: tokRBracket, line: line}, nil
+	case c == '(':
+		l.pos++
+		return token{kind: tokLParen, line: line}, nil
+	case c == ')':
+		l.pos++
+		return token{kind: tokRParen, line: line}, nil
+	case c == '{':
+		l.pos++
+		return token{kind: tokLBrace, line: line}, nil
+	case c == '}':
+		l.pos++
+		return token{kind: tokRBrace, line: line}, nil
+	case c == ',':
+		l.pos++
+		return token{kind: tokComma, line: line}, nil
+	case c == ';':
+		l.pos++
+		return token{kind: tokSemicolon, line: line}, nil
+	case c == '"':
+		text, err := l.quotedString()
+		return token{kind: tokString, text: text, line: line}, err
+	case c == ':':
+		l.pos++
+		name := l.identifier()
+		if name == "" {
+			return token{}, l.errorf("tag inválida")
+		}
+		return token{kind: tokTag, text: strings.ToLower(name), line: line}, nil
+	case isDigit(c):
+		return l.number()
+	case isIdentStart(c):
+		name := l.identifier()
+		if strings.EqualFold(name, "text") && l.pos < len(l.src) && l.src[l.pos] == ':' {
+			l.pos++
+			text, err := l.multiLine()
+			return token{kind: tokString, text: text, line: line}, err
+		}
+		return token{kind: tokIdentifier, text: strings.ToLower(name), line: line}, nil
+	}
+
+	return token{}, l.errorf("caractere inesperado %q", c)
+}
+
+// skipWhitespace ignora espaços e comentários
+func (l *lexer) skipWhitespace() error {
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			l.line++
+			l.pos++
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+		case c == '/' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '*':
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("comentário não terminado")
+			}
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+	for l.pos < len(l.src) && (isIdentStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+	return l.src[start:l.pos]
+}
+
+// number lê um número com sufixo opcional K, M ou G
+func (l *lexer) number() (token, error) {
+	start := l.pos
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+	n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return token{}, l.errorf("número inválido")
+	}
+	if l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case 'K', 'k':
+			n <<= 10
+			l.pos++
+		case 'M', 'm':
+			n <<= 20
+			l.pos++
+		case 'G', 'g':
+			n <<= 30
+			l.pos++
+		}
+	}
+	return token{kind: tokNumber, number: n, line: l.line}, nil
+}
+
+// quotedString lê uma string entre aspas, tratando \" e \\
+func (l *lexer) quotedString() (string, error) {
+	l.pos++
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return b.String(), nil
+		case '\\':
+			if l.pos+1 < len(l.src) {
+				l.pos++
+				c = l.src[l.pos]
+			}
+		case '\n':
+			l.line++
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return "", l.errorf("string não terminada")
+}
+
+// multiLine lê uma string no formato text: ... terminada por uma linha com "."
+func (l *lexer) multiLine() (string, error) {
+	// Ignorar o restante da linha após "text:" (espaços ou comentário)
+	for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+		l.pos++
+	}
+	if l.pos >= len(l.src) {
+		return "", l.errorf("string multilinha não terminada")
+	}
+	l.pos++
+	l.line++
+
+	var b strings.Builder
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		var line string
+		if end < 0 {
+			line = l.src[l.pos:]
+			l.pos = len(l.src)
+		} else {
+			line = l.src[l.pos : l.pos+end]
+			l.pos += end + 1
+		}
+		l.line++
+
+		line = strings.TrimSuffix(line, "\r")
+		if line == "." {
+			return b.String(), nil
+		}
+		if strings.HasPrefix(line, "..") {
+			line = line[1:]
+		}
+		b.WriteString(line)
+		b.WriteString("\r\n")
+	}
+	return "", l.errorf("string multilinha não terminada")
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
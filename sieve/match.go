@@ -0,0 +1,131 @@
+package sieve
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// matcher aplica o tipo de comparação (:is, :contains, :matches) com o
+// comparador escolhido (i;ascii-casemap ou i;octet)
+type matcher struct {
+	matchType string
+	fold      bool
+}
+
+// newMatcher cria o matcher a partir das tags do teste
+func newMatcher(n *node) matcher {
+	m := matcher{matchType: "is", fold: true}
+	for _, t := range []string{"is", "contains", "matches"} {
+		if n.hasTag(t) {
+			m.matchType = t
+		}
+	}
+	if c, ok := n.tags["comparator"]; ok && strings.EqualFold(c.strings[0], "i;octet") {
+		m.fold = false
+	}
+	return m
+}
+
+// match compara o valor com a chave. Para :matches, retorna também os
+// trechos capturados pelos curingas (o primeiro elemento é o valor inteiro).
+func (m matcher) match(value, key string) (bool, []string) {
+	switch m.matchType {
+	case "contains":
+		if m.fold {
+			return strings.Contains(asciiLower(value), asciiLower(key)), nil
+		}
+		return strings.Contains(value, key), nil
+	case "matches":
+		captures, ok := glob(key, value, m.fold)
+		if !ok {
+			return false, nil
+		}
+		return true, append([]string{value}, captures...)
+	default:
+		if m.fold {
+			return asciiLower(value) == asciiLower(key), nil
+		}
+		return value == key, nil
+	}
+}
+
+// glob compara o valor com um padrão contendo "*" e "?", onde "\" escapa o
+// caractere seguinte. Cada curinga gera uma captura; curingas à esquerda
+// capturam o mínimo possível.
+func glob(pattern, value string, fold bool) ([]string, bool) {
+	if pattern == "" {
+		return nil, value == ""
+	}
+
+	c, size := utf8.DecodeRuneInString(pattern)
+	switch c {
+	case '*':
+		for i := 0; i <= len(value); {
+			if rest, ok := glob(pattern[size:], value[i:], fold); ok {
+				return append([]string{value[:i]}, rest...), true
+			}
+			if i == len(value) {
+				break
+			}
+			_, n := utf8.DecodeRuneInString(value[i:])
+			i += n
+		}
+		return nil, false
+	case '?':
+		if value == "" {
+			return nil, false
+		}
+		_, n := utf8.DecodeRuneInString(value)
+		rest, ok := glob(pattern[size:], value[n:], fold)
+		if !ok {
+			return nil, false
+		}
+		return append([]string{value[:n]}, rest...), true
+	case '\\':
+		if len(pattern) > size {
+			c, n := utf8.DecodeRuneInString(pattern[size:])
+			size += n
+			return globLiteral(c, pattern[size:], value, fold)
+		}
+	}
+	return globLiteral(c, pattern[size:], value, fold)
+}
+
+func globLiteral(c rune, pattern, value string, fold bool) ([]string, bool) {
+	v, n := utf8.DecodeRuneInString(value)
+	if value == "" || !runeEqual(c, v, fold) {
+		return nil, false
+	}
+	return glob(pattern, value[n:], fold)
+}
+
+func runeEqual(a, b rune, fold bool) bool {
+	if fold {
+		return asciiLowerRune(a) == asciiLowerRune(b)
+	}
+	return a == b
+}
+
+// asciiLower converte apenas letras ASCII, como exige i;ascii-casemap
+func asciiLower(s string) string {
+	return strings.Map(asciiLowerRune, s)
+}
+
+func asciiLowerRune(r rune) rune {
+	if r >= 'A' && r <= 'Z' {
+		return r + ('a' - 'A')
+	}
+	return r
+}
+
+// quoteWildcard escapa os caracteres especiais de :matches
+func quoteWildcard(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r == '*' || r == '?' || r == '\\' {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
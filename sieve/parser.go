@@ -0,0 +1,240 @@
+package sieve
+
+import (
+	"fmt"
+)
+
+// Error descreve um erro de sintaxe ou validação em um script
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("linha %d: %s", e.Line, e.Msg)
+}
+
+// argKind identifica o tipo de um argumento
+type argKind int
+
+const (
+	argString argKind = iota // String ou lista de strings
+	argNumber
+	argTag
+)
+
+// argument representa um argumento de comando ou teste
+type argument struct {
+	kind    argKind
+	strings []string
+	number  int64
+	tag     string
+	list    bool // Indica que o argumento foi escrito como lista [ ... ]
+	line    int
+}
+
+// node representa um comando ou teste. Após a validação, os argumentos
+// marcados (tags) e posicionais ficam separados em tags e positional.
+type node struct {
+	name  string
+	args  []*argument
+	tests []*node
+	block []*node
+	line  int
+
+	tags       map[string]*argument // Valor do parâmetro da tag, ou nil
+	positional []*argument
+}
+
+// hasTag informa se a tag foi usada no nó
+func (n *node) hasTag(tag string) bool {
+	_, ok := n.tags[tag]
+	return ok
+}
+
+// parser constrói a árvore de comandos a partir dos tokens
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+// parse analisa o código-fonte e retorna a lista de comandos de nível superior
+func parse(src string) ([]*node, error) {
+	tokens, err := newLexer(src).tokenize()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, p.errorf(tok, "token inesperado")
+	}
+	return commands, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &Error{Line: tok.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// commands lê comandos até o fim do bloco ou do script
+func (p *parser) commands() ([]*node, error) {
+	var commands []*node
+	for {
+		tok := p.peek()
+		if tok.kind == tokEOF || tok.kind == tokRBrace {
+			return commands, nil
+		}
+		cmd, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, cmd)
+	}
+}
+
+// command = identifier arguments (";" / block)
+func (p *parser) command() (*node, error) {
+	tok := p.advance()
+	if tok.kind != tokIdentifier {
+		return nil, p.errorf(tok, "esperado nome de comando")
+	}
+
+	cmd := &node{name: tok.text, line: tok.line}
+	if err := p.arguments(cmd); err != nil {
+		return nil, err
+	}
+
+	switch next := p.advance(); next.kind {
+	case tokSemicolon:
+		return cmd, nil
+	case tokLBrace:
+		block, err := p.commands()
+		if err != nil {
+			return nil, err
+		}
+		if end := p.advance(); end.kind != tokRBrace {
+			return nil, p.errorf(end, "esperado '}'")
+		}
+		cmd.block = block
+		if cmd.block == nil {
+			cmd.block = []*node{}
+		}
+		return cmd, nil
+	default:
+		return nil, p.errorf(next, "esperado ';' ou '{' após %s", cmd.name)
+	}
+}
+
+// arguments = *argument [ test / test-list ]
+func (p *parser) arguments(n *node) error {
+	for {
+		tok := p.peek()
+		switch tok.kind {
+		case tokString, tokLBracket:
+			arg, err := p.stringList()
+			if err != nil {
+				return err
+			}
+			n.args = append(n.args, arg)
+		case tokNumber:
+			p.advance()
+			n.args = append(n.args, &argument{kind: argNumber, number: tok.number, line: tok.line})
+		case tokTag:
+			p.advance()
+			n.args = append(n.args, &argument{kind: argTag, tag: tok.text, line: tok.line})
+		case tokIdentifier:
+			test, err := p.test()
+			if err != nil {
+				return err
+			}
+			n.tests = []*node{test}
+			return nil
+		case tokLParen:
+			tests, err := p.testList()
+			if err != nil {
+				return err
+			}
+			n.tests = tests
+			return nil
+		default:
+			return nil
+		}
+	}
+}
+
+// test = identifier arguments
+func (p *parser) test() (*node, error) {
+	tok := p.advance()
+	if tok.kind != tokIdentifier {
+		return nil, p.errorf(tok, "esperado nome de teste")
+	}
+	test := &node{name: tok.text, line: tok.line}
+	if err := p.arguments(test); err != nil {
+		return nil, err
+	}
+	return test, nil
+}
+
+// testList = "(" test *("," test) ")"
+func (p *parser) testList() ([]*node, error) {
+	p.advance()
+	var tests []*node
+	for {
+		test, err := p.test()
+		if err != nil {
+			return nil, err
+		}
+		tests = append(tests, test)
+
+		switch tok := p.advance(); tok.kind {
+		case tokComma:
+			continue
+		case tokRParen:
+			return tests, nil
+		default:
+			return nil, p.errorf(tok, "esperado ',' ou ')' na lista de testes")
+		}
+	}
+}
+
+// stringList = string / "[" string *("," string) "]"
+func (p *parser) stringList() (*argument, error) {
+	tok := p.advance()
+	if tok.kind == tokString {
+		return &argument{kind: argString, strings: []string{tok.text}, line: tok.line}, nil
+	}
+
+	arg := &argument{kind: argString, list: true, line: tok.line}
+	for {
+		s := p.advance()
+		if s.kind != tokString {
+			return nil, p.errorf(s, "esperado string na lista")
+		}
+		arg.strings = append(arg.strings, s.text)
+
+		switch next := p.advance(); next.kind {
+		case tokComma:
+			continue
+		case tokRBracket:
+			return arg, nil
+		default:
+			return nil, p.errorf(next, "esperado ',' ou ']' na lista de strings")
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package sieve
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseValid(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"vazio", ""},
+		{"keep", "keep;"},
+		{"comentários", "# comentário\n/* bloco\nde várias linhas */ keep; # fim"},
+		{"require com lista", `require ["fileinto", "Reject"]; fileinto "Lixo"; reject "não";`},
+		{"if elsif else", `require "fileinto";
+if header :contains "subject" "a" { fileinto "A"; }
+elsif header :is "subject" "b" { discard; }
+else { keep; }`},
+		{"bloco vazio", `if true {}`},
+		{"allof anyof not", `if allof (not exists "x-spam", anyof (true, false)) { stop; }`},
+		{"size com sufixo", `if size :over 1M { discard; }`},
+		{"comparador", `if header :is :comparator "i;octet" "subject" "A" { keep; }`},
+		{"address", `if address :domain :matches ["from", "sender"] "*.example" { keep; }`},
+		{"envelope", `require "envelope"; if envelope :localpart "to" "bob" { keep; }`},
+		{"body", `require "body"; if body :content "text/html" :contains "oferta" { discard; }`},
+		{"vacation", `require "vacation";
+vacation :days 3 :subject "Ausente" :from "bob@example.com" :addresses ["bob@example.com"] :mime :handle "h" "Volto logo";`},
+		{"texto multilinha", "require \"vacation\";\nvacation text:\nlinha\n..ponto\n.\n;"},
+		{"variables e imap4flags", `require ["variables", "imap4flags", "fileinto"];
+set :lower :upperfirst "pasta" "NOTICIAS";
+addflag "\\Seen";
+fileinto :flags "\\Flagged" "${pasta}";`},
+		{"copy e mailbox", `require ["copy", "fileinto", "mailbox"]; fileinto :copy :create "Nova"; redirect :copy "a@b.example";`},
+		{"string e hasflag", `require ["variables", "imap4flags"]; if anyof (string :is "${a}" "", hasflag :contains "seen") { keep; }`},
+	}
+	for _, tt := range tests {
+		if _, err := Parse(tt.src); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		line int
+		msg  string
+	}{
+		{"sem ponto e vírgula", "keep", 1, "esperado ';' ou '{'"},
+		{"string não terminada", "\nreject \"oi;", 2, "string não terminada"},
+		{"comentário não terminado", "/* oi", 1, "comentário não terminado"},
+		{"multilinha não terminada", "require \"reject\";\nreject text:\noi\n", 4, "multilinha não terminada"},
+		{"comando desconhecido", "keep;\nfoo;", 2, "comando desconhecido: foo"},
+		{"teste desconhecido", "if foo { keep; }", 1, "teste desconhecido: foo"},
+		{"extensão não declarada", `fileinto "A";`, 1, `fileinto exige require "fileinto"`},
+		{"tag de extensão não declarada", `require "fileinto"; fileinto :copy "A";`, 1, `:copy exige require "copy"`},
+		{"extensão não suportada", `require "regex";`, 1, "extensão não suportada: regex"},
+		// Sem a extensão regex, :regex é uma tag desconhecida
+		{"regex", `if header :regex "subject" "a.*" { keep; }`, 1, "tag desconhecida para header: :regex"},
+		{"comparador não suportado", `if header :comparator "i;unicode-casemap" "subject" "a" { keep; }`, 1, "comparador não suportado"},
+		{"tipos de comparação combinados", `if header :is :contains "subject" "a" { keep; }`, 1, "não pode ser usada com"},
+		{"tag repetida", `if header :comparator "i;octet" :comparator "i;octet" "subject" "a" { keep; }`, 1, "repetida"},
+		{"require fora do início", "keep;\nrequire \"fileinto\";", 2, "require deve aparecer no início"},
+		{"else sem if", "else { keep; }", 1, "else sem if correspondente"},
+		{"if sem bloco", "if true;", 1, "if exige um bloco"},
+		{"keep com bloco", "keep { stop; }", 1, "keep não aceita bloco"},
+		{"argumentos faltando", `if header "subject" { keep; }`, 1, "número incorreto de argumentos"},
+		{"tipo de argumento", `if size :over "10" { keep; }`, 1, "tipo de argumento inválido"},
+		{"size sem over ou under", `if size 10 { keep; }`, 1, "size exige :over ou :under"},
+		{"tag após posicional", `if header "subject" :is "a" { keep; }`, 1, "após argumentos posicionais"},
+		{"parâmetro ausente", `require "vacation"; vacation :days "oi";`, 1, "parâmetro ausente ou inválido para :days"},
+		{"lista de testes vazia", `if allof () { keep; }`, 1, "esperado nome de teste"},
+		{"chave extra", "keep; }", 1, "token inesperado"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.src)
+		var serr *Error
+		if !errors.As(err, &serr) {
+			t.Errorf("%s: erro = %v, esperado *Error", tt.name, err)
+			continue
+		}
+		if serr.Line != tt.line || !strings.Contains(serr.Msg, tt.msg) {
+			t.Errorf("%s: erro = %v, esperado linha %d: %s", tt.name, err, tt.line, tt.msg)
+		}
+	}
+}
+
+func TestExtensions(t *testing.T) {
+	got := strings.Join(Extensions(), " ")
+	want := "body copy envelope ereject fileinto imap4flags mailbox reject vacation variables"
+	if got != want {
+		t.Errorf("Extensions() = %s, esperado %s", got, want)
+	}
+}
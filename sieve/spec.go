@@ -0,0 +1,312 @@
+package sieve
+
+import (
+	"sort"
+	"strings"
+)
+
+// tagSpec descreve uma tag aceita por um comando ou teste
+type tagSpec struct {
+	ext      string // Extensão necessária para usar a tag
+	group    string // Tags do mesmo grupo são mutuamente exclusivas
+	hasParam bool
+	param    argKind
+}
+
+// spec descreve a sintaxe de um comando ou teste
+type spec struct {
+	ext         string // Extensão necessária; vazio para o núcleo da linguagem
+	tags        map[string]tagSpec
+	positional  []argKind
+	optionalPos int // Quantidade de argumentos posicionais iniciais opcionais
+	tests       int // 0: nenhum; 1: um teste; -1: lista de testes
+	block       bool
+}
+
+// supportedExtensions lista as extensões implementadas pelo interpretador
+var supportedExtensions = map[string]bool{
+	"fileinto":                   true,
+	"reject":                     true,
+	"ereject":                    true,
+	"envelope":                   true,
+	"body":                       true,
+	"variables":                  true,
+	"imap4flags":                 true,
+	"vacation":                   true,
+	"copy":                       true,
+	"mailbox":                    true,
+	"comparator-i;octet":         true,
+	"comparator-i;ascii-casemap": true,
+}
+
+// Extensions retorna as extensões suportadas, em ordem alfabética
+func Extensions() []string {
+	var exts []string
+	for ext := range supportedExtensions {
+		if !strings.HasPrefix(ext, "comparator-") {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+var matchTags = map[string]tagSpec{
+	"is":         {group: "match"},
+	"contains":   {group: "match"},
+	"matches":    {group: "match"},
+	"comparator": {hasParam: true, param: argString},
+}
+
+var addressTags = merge(matchTags, map[string]tagSpec{
+	"all":       {group: "address-part"},
+	"localpart": {group: "address-part"},
+	"domain":    {group: "address-part"},
+})
+
+var commandSpecs = map[string]spec{
+	"require": {positional: []argKind{argString}},
+	"if":      {tests: 1, block: true},
+	"elsif":   {tests: 1, block: true},
+	"else":    {block: true},
+	"stop":    {},
+	"keep": {tags: map[string]tagSpec{
+		"flags": {ext: "imap4flags", hasParam: true, param: argString},
+	}},
+	"discard": {},
+	"redirect": {
+		tags:       map[string]tagSpec{"copy": {ext: "copy"}},
+		positional: []argKind{argString},
+	},
+	"fileinto": {
+		ext: "fileinto",
+		tags: map[string]tagSpec{
+			"copy":   {ext: "copy"},
+			"flags":  {ext: "imap4flags", hasParam: true, param: argString},
+			"create": {ext: "mailbox"},
+		},
+		positional: []argKind{argString},
+	},
+	"reject":  {ext: "reject", positional: []argKind{argString}},
+	"ereject": {ext: "ereject", positional: []argKind{argString}},
+	"vacation": {
+		ext: "vacation",
+		tags: map[string]tagSpec{
+			"days":      {hasParam: true, param: argNumber},
+			"subject":   {hasParam: true, param: argString},
+			"from":      {hasParam: true, param: argString},
+			"addresses": {hasParam: true, param: argString},
+			"mime":      {},
+			"handle":    {hasParam: true, param: argString},
+		},
+		positional: []argKind{argString},
+	},
+	"set": {
+		ext: "variables",
+		tags: map[string]tagSpec{
+			"lower":         {group: "case"},
+			"upper":         {group: "case"},
+			"lowerfirst":    {group: "first"},
+			"upperfirst":    {group: "first"},
+			"quotewildcard": {},
+			"length":        {},
+		},
+		positional: []argKind{argString, argString},
+	},
+	"setflag":    {ext: "imap4flags", positional: []argKind{argString, argString}, optionalPos: 1},
+	"addflag":    {ext: "imap4flags", positional: []argKind{argString, argString}, optionalPos: 1},
+	"removeflag": {ext: "imap4flags", positional: []argKind{argString, argString}, optionalPos: 1},
+}
+
+var testSpecs = map[string]spec{
+	"address":  {tags: addressTags, positional: []argKind{argString, argString}},
+	"envelope": {ext: "envelope", tags: addressTags, positional: []argKind{argString, argString}},
+	"header":   {tags: matchTags, positional: []argKind{argString, argString}},
+	"exists":   {positional: []argKind{argString}},
+	"size": {
+		tags: map[string]tagSpec{
+			"over":  {group: "size"},
+			"under": {group: "size"},
+		},
+		positional: []argKind{argNumber},
+	},
+	"true":  {},
+	"false": {},
+	"not":   {tests: 1},
+	"allof": {tests: -1},
+	"anyof": {tests: -1},
+	"body": {
+		ext: "body",
+		tags: merge(matchTags, map[string]tagSpec{
+			"raw":     {group: "transform"},
+			"content": {group: "transform", hasParam: true, param: argString},
+			"text":    {group: "transform"},
+		}),
+		positional: []argKind{argString},
+	},
+	"string":        {ext: "variables", tags: matchTags, positional: []argKind{argString, argString}},
+	"hasflag":       {ext: "imap4flags", tags: matchTags, positional: []argKind{argString, argString}, optionalPos: 1},
+	"mailboxexists": {ext: "mailbox", positional: []argKind{argString}},
+}
+
+func merge(a, b map[string]tagSpec) map[string]tagSpec {
+	m := make(map[string]tagSpec, len(a)+len(b))
+	for k, v := range a {
+		m[k] = v
+	}
+	for k, v := range b {
+		m[k] = v
+	}
+	return m
+}
+
+// validator verifica os comandos contra as especificações e as extensões
+// declaradas com require
+type validator struct {
+	requires map[string]bool
+}
+
+func (v *validator) commands(commands []*node, topLevel bool) error {
+	requireAllowed := topLevel
+	prev := ""
+	for _, cmd := range commands {
+		sp, ok := commandSpecs[cmd.name]
+		if !ok {
+			return &Error{Line: cmd.line, Msg: "comando desconhecido: " + cmd.name}
+		}
+
+		switch cmd.name {
+		case "require":
+			if !requireAllowed {
+				return &Error{Line: cmd.line, Msg: "require deve aparecer no início do script"}
+			}
+		case "elsif", "else":
+			if prev != "if" && prev != "elsif" {
+				return &Error{Line: cmd.line, Msg: cmd.name + " sem if correspondente"}
+			}
+		}
+		if cmd.name != "require" {
+			requireAllowed = false
+		}
+		prev = cmd.name
+
+		if err := v.node(cmd, sp); err != nil {
+			return err
+		}
+
+		if cmd.name == "require" {
+			for _, ext := range cmd.positional[0].strings {
+				ext = strings.ToLower(ext)
+				if !supportedExtensions[ext] {
+					return &Error{Line: cmd.line, Msg: "extensão não suportada: " + ext}
+				}
+				v.requires[ext] = true
+			}
+		}
+
+		if sp.block {
+			if cmd.block == nil {
+				return &Error{Line: cmd.line, Msg: cmd.name + " exige um bloco"}
+			}
+			if err := v.commands(cmd.block, false); err != nil {
+				return err
+			}
+		} else if cmd.block != nil {
+			return &Error{Line: cmd.line, Msg: cmd.name + " não aceita bloco"}
+		}
+	}
+	return nil
+}
+
+func (v *validator) tests(tests []*node) error {
+	for _, test := range tests {
+		sp, ok := testSpecs[test.name]
+		if !ok {
+			return &Error{Line: test.line, Msg: "teste desconhecido: " + test.name}
+		}
+		if err := v.node(test, sp); err != nil {
+			return err
+		}
+		if test.name == "size" && len(test.tags) != 1 {
+			return &Error{Line: test.line, Msg: "size exige :over ou :under"}
+		}
+	}
+	return nil
+}
+
+// node valida argumentos e testes de um nó, preenchendo tags e positional
+func (v *validator) node(n *node, sp spec) error {
+	if sp.ext != "" && !v.requires[sp.ext] {
+		return &Error{Line: n.line, Msg: n.name + " exige require \"" + sp.ext + "\""}
+	}
+
+	n.tags = make(map[string]*argument)
+	groups := make(map[string]string)
+	for i := 0; i < len(n.args); i++ {
+		arg := n.args[i]
+		if arg.kind != argTag {
+			n.positional = append(n.positional, arg)
+			continue
+		}
+		if len(n.positional) > 0 {
+			return &Error{Line: arg.line, Msg: "tag :" + arg.tag + " após argumentos posicionais"}
+		}
+
+		ts, ok := sp.tags[arg.tag]
+		if !ok {
+			return &Error{Line: arg.line, Msg: "tag desconhecida para " + n.name + ": :" + arg.tag}
+		}
+		if ts.ext != "" && !v.requires[ts.ext] {
+			return &Error{Line: arg.line, Msg: ":" + arg.tag + " exige require \"" + ts.ext + "\""}
+		}
+		if ts.group != "" {
+			if other, dup := groups[ts.group]; dup {
+				return &Error{Line: arg.line, Msg: ":" + arg.tag + " não pode ser usada com :" + other}
+			}
+			groups[ts.group] = arg.tag
+		}
+		if _, dup := n.tags[arg.tag]; dup {
+			return &Error{Line: arg.line, Msg: "tag :" + arg.tag + " repetida"}
+		}
+
+		var param *argument
+		if ts.hasParam {
+			if i+1 >= len(n.args) || n.args[i+1].kind != ts.param {
+				return &Error{Line: arg.line, Msg: "parâmetro ausente ou inválido para :" + arg.tag}
+			}
+			i++
+			param = n.args[i]
+		}
+		n.tags[arg.tag] = param
+	}
+
+	if c, ok := n.tags["comparator"]; ok {
+		name := strings.ToLower(c.strings[0])
+		if name != "i;octet" && name != "i;ascii-casemap" {
+			return &Error{Line: n.line, Msg: "comparador não suportado: " + name}
+		}
+	}
+
+	// Preencher argumentos posicionais opcionais ausentes com nil
+	if missing := len(sp.positional) - len(n.positional); missing > 0 && missing <= sp.optionalPos {
+		n.positional = append(make([]*argument, missing), n.positional...)
+	}
+	if len(n.positional) != len(sp.positional) {
+		return &Error{Line: n.line, Msg: "número incorreto de argumentos para " + n.name}
+	}
+	for i, arg := range n.positional {
+		if arg != nil && arg.kind != sp.positional[i] {
+			return &Error{Line: arg.line, Msg: "tipo de argumento inválido para " + n.name}
+		}
+	}
+
+	switch {
+	case sp.tests == 0 && len(n.tests) > 0:
+		return &Error{Line: n.line, Msg: n.name + " não aceita testes"}
+	case sp.tests == 1 && len(n.tests) != 1:
+		return &Error{Line: n.line, Msg: n.name + " exige um teste"}
+	case sp.tests == -1 && len(n.tests) == 0:
+		return &Error{Line: n.line, Msg: n.name + " exige uma lista de testes"}
+	}
+	return v.tests(n.tests)
+}
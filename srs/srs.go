@@ -0,0 +1,196 @@
+// Package srs implementa o Sender Rewriting Scheme, usado para reescrever o
+// remetente de envelope de mensagens encaminhadas para que o SPF continue
+// válido no destino, e para desfazer a reescrita quando um bounce retorna.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// base32Alphabet é o alfabeto usado para codificar o timestamp
+const base32Alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+
+const (
+	hashLength     = 4
+	timestampSlots = 1024 // O timestamp usa 10 bits (dois caracteres base32)
+	separator      = "="
+)
+
+// ErrNotSRS é retornado quando o endereço não foi reescrito com SRS
+var ErrNotSRS = errors.New("endereço não está no formato SRS")
+
+// ErrInvalidHash é retornado quando o hash de um endereço SRS não confere
+var ErrInvalidHash = errors.New("hash SRS inválido")
+
+// ErrExpired é retornado quando um endereço SRS é mais antigo que o permitido
+var ErrExpired = errors.New("endereço SRS expirado")
+
+// SRS reescreve e desfaz a reescrita de endereços de envelope
+type SRS struct {
+	secret []byte
+	domain string
+	maxAge int // Em dias
+	now    func() time.Time
+}
+
+// New cria um novo SRS que reescreve endereços para o domínio informado
+func New(secret, domain string) *SRS {
+	return &SRS{
+		secret: []byte(secret),
+		domain: strings.ToLower(domain),
+		maxAge: 21,
+		now:    time.Now,
+	}
+}
+
+// Domain retorna o domínio usado nos endereços reescritos
+func (s *SRS) Domain() string {
+	return s.domain
+}
+
+// Forward reescreve o endereço de remetente. Endereços SRS0 de outros
+// encaminhadores são convertidos em SRS1, e endereços do próprio domínio
+// não são alterados.
+func (s *SRS) Forward(address string) (string, error) {
+	local, domain, ok := split(address)
+	if !ok {
+		return "", fmt.Errorf("endereço inválido: %s", address)
+	}
+	if strings.EqualFold(domain, s.domain) {
+		return address, nil
+	}
+
+	prefix := strings.ToUpper(local)
+	switch {
+	case strings.HasPrefix(prefix, "SRS0") && len(local) > 4 && isSeparator(local[4]):
+		// Guardar o domínio do encaminhador anterior e a parte SRS0 original
+		rest := local[5:]
+		hash := s.hash(domain, rest)
+		return "SRS1" + separator + hash + separator + domain + separator + separator + rest + "@" + s.domain, nil
+	case strings.HasPrefix(prefix, "SRS1") && len(local) > 4 && isSeparator(local[4]):
+		// Manter o primeiro encaminhador e recalcular o hash
+		parts := strings.SplitN(local[5:], separator, 3)
+		if len(parts) != 3 {
+			return "", ErrNotSRS
+		}
+		first, rest := parts[1], strings.TrimPrefix(parts[2], separator)
+		hash := s.hash(first, rest)
+		return "SRS1" + separator + hash + separator + first + separator + separator + rest + "@" + s.domain, nil
+	}
+
+	timestamp := s.timestamp()
+	hash := s.hash(timestamp, domain, local)
+	return "SRS0" + separator + hash + separator + timestamp + separator + domain + separator + local + "@" + s.domain, nil
+}
+
+// Reverse desfaz a reescrita de um endereço SRS, retornando o destino do
+// bounce (o remetente original para SRS0 ou o encaminhador anterior para SRS1)
+func (s *SRS) Reverse(address string) (string, error) {
+	local, _, ok := split(address)
+	if !ok || len(local) < 5 || !isSeparator(local[4]) {
+		return "", ErrNotSRS
+	}
+
+	switch strings.ToUpper(local[:4]) {
+	case "SRS0":
+		parts := strings.SplitN(local[5:], separator, 4)
+		if len(parts) != 4 {
+			return "", ErrNotSRS
+		}
+		hash, timestamp, domain, user := parts[0], parts[1], parts[2], parts[3]
+		if !s.validHash(hash, timestamp, domain, user) {
+			return "", ErrInvalidHash
+		}
+		if err := s.checkTimestamp(timestamp); err != nil {
+			return "", err
+		}
+		return user + "@" + domain, nil
+	case "SRS1":
+		parts := strings.SplitN(local[5:], separator, 3)
+		if len(parts) != 3 {
+			return "", ErrNotSRS
+		}
+		hash, domain, rest := parts[0], parts[1], strings.TrimPrefix(parts[2], separator)
+		if !s.validHash(hash, domain, rest) {
+			return "", ErrInvalidHash
+		}
+		return "SRS0" + separator + rest + "@" + domain, nil
+	}
+
+	return "", ErrNotSRS
+}
+
+// IsSRS informa se o endereço foi reescrito para o domínio deste SRS
+func (s *SRS) IsSRS(address string) bool {
+	local, domain, ok := split(address)
+	if !ok || !strings.EqualFold(domain, s.domain) || len(local) < 5 || !isSeparator(local[4]) {
+		return false
+	}
+	prefix := strings.ToUpper(local[:4])
+	return prefix == "SRS0" || prefix == "SRS1"
+}
+
+// hash calcula o HMAC-SHA1 truncado dos campos, sem diferenciar maiúsculas
+func (s *SRS) hash(fields ...string) string {
+	mac := hmac.New(sha1.New, s.secret)
+	for _, field := range fields {
+		mac.Write([]byte(strings.ToLower(field)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+func (s *SRS) validHash(hash string, fields ...string) bool {
+	return len(hash) == hashLength && strings.EqualFold(hash, s.hash(fields...))
+}
+
+// timestamp codifica o dia atual em dois caracteres base32
+func (s *SRS) timestamp() string {
+	day := int(s.now().Unix()/86400) % timestampSlots
+	return string([]byte{base32Alphabet[day>>5], base32Alphabet[day&31]})
+}
+
+// checkTimestamp verifica se o timestamp está dentro da validade
+func (s *SRS) checkTimestamp(timestamp string) error {
+	if len(timestamp) != 2 {
+		return ErrNotSRS
+	}
+	hi := strings.IndexByte(base32Alphabet, upper(timestamp[0]))
+	lo := strings.IndexByte(base32Alphabet, upper(timestamp[1]))
+	if hi < 0 || lo < 0 {
+		return ErrNotSRS
+	}
+
+	then := hi<<5 | lo
+	today := int(s.now().Unix()/86400) % timestampSlots
+	age := (today - then + timestampSlots) % timestampSlots
+	if age > s.maxAge {
+		return ErrExpired
+	}
+	return nil
+}
+
+func split(address string) (local, domain string, ok bool) {
+	address = strings.Trim(strings.TrimSpace(address), "<>")
+	i := strings.LastIndex(address, "@")
+	if i <= 0 || i == len(address)-1 {
+		return "", "", false
+	}
+	return address[:i], address[i+1:], true
+}
+
+func isSeparator(c byte) bool {
+	return c == separator[0]
+}
+
+func upper(c byte) byte {
+	if c >= 'a' && c <= 'z' {
+		return c - 'a' + 'A'
+	}
+	return c
+}
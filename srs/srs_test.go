@@ -0,0 +1,182 @@
+package srs
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestSRS cria um SRS com o relógio controlado pelo teste
+func newTestSRS(secret, domain string, now *time.Time) *SRS {
+	s := New(secret, domain)
+	s.now = func() time.Time { return *now }
+	return s
+}
+
+func TestForwardReverse(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	s := newTestSRS("segredo", "Forward.example", &now)
+
+	rewritten, err := s.Forward("Alice@Origem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(rewritten, "SRS0=") || !strings.HasSuffix(rewritten, "@forward.example") {
+		t.Fatalf("Forward = %s, esperado SRS0=...@forward.example", rewritten)
+	}
+	local := rewritten[:strings.LastIndex(rewritten, "@")]
+	parts := strings.Split(local, "=")
+	if len(parts) != 5 || len(parts[1]) != hashLength || len(parts[2]) != 2 {
+		t.Fatalf("Forward = %s, esperado SRS0=hash=tt=domínio=usuário", rewritten)
+	}
+	if !s.IsSRS(rewritten) {
+		t.Errorf("IsSRS(%s) = false", rewritten)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+	}{
+		{"original", rewritten},
+		// Servidores intermediários podem alterar maiúsculas no endereço
+		{"minúsculas", strings.ToLower(rewritten)},
+		{"maiúsculas", strings.ToUpper(rewritten)},
+		{"entre sinais de menor e maior", "<" + rewritten + ">"},
+	}
+	for _, tt := range tests {
+		original, err := s.Reverse(tt.address)
+		if err != nil {
+			t.Errorf("%s: Reverse(%s): %v", tt.name, tt.address, err)
+			continue
+		}
+		if !strings.EqualFold(original, "Alice@Origem.example") {
+			t.Errorf("%s: Reverse = %s, esperado Alice@Origem.example", tt.name, original)
+		}
+	}
+
+	// Endereços do próprio domínio não são reescritos
+	if got, err := s.Forward("bob@forward.example"); err != nil || got != "bob@forward.example" {
+		t.Errorf("Forward do próprio domínio = %s, %v", got, err)
+	}
+}
+
+func TestReverseInvalid(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	s := newTestSRS("segredo", "forward.example", &now)
+	rewritten, err := s.Forward("alice@origem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := rewritten[5 : 5+hashLength]
+
+	// Um hash diferente em um caractere, que não muda só maiúsculas
+	forgedHash := []byte(hash)
+	if forgedHash[0] == '0' {
+		forgedHash[0] = '1'
+	} else {
+		forgedHash[0] = '0'
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		want    error
+	}{
+		{"hash forjado", strings.Replace(rewritten, hash, string(forgedHash), 1), ErrInvalidHash},
+		{"destinatário alterado", strings.Replace(rewritten, "=alice@", "=mallory@", 1), ErrInvalidHash},
+		{"hash truncado", strings.Replace(rewritten, hash, hash[:hashLength-1], 1), ErrInvalidHash},
+		{"outro segredo", mustForward(t, newTestSRS("outro", "forward.example", &now), "alice@origem.example"), ErrInvalidHash},
+		{"sem SRS", "alice@forward.example", ErrNotSRS},
+		{"campos faltando", "SRS0=abcd=AA@forward.example", ErrNotSRS},
+		{"sem domínio", "SRS0=abcd", ErrNotSRS},
+	}
+	for _, tt := range tests {
+		if _, err := s.Reverse(tt.address); !errors.Is(err, tt.want) {
+			t.Errorf("%s: Reverse(%s) = %v, esperado %v", tt.name, tt.address, err, tt.want)
+		}
+	}
+}
+
+func TestReverseExpired(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	s := newTestSRS("segredo", "forward.example", &now)
+	rewritten, err := s.Forward("alice@origem.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		days int
+		want error
+	}{
+		{0, nil},
+		{21, nil},
+		{22, ErrExpired},
+		{300, ErrExpired},
+	}
+	for _, tt := range tests {
+		now = time.Date(2026, 10, 18+tt.days, 12, 0, 0, 0, time.UTC)
+		if _, err := s.Reverse(rewritten); !errors.Is(err, tt.want) {
+			t.Errorf("após %d dias: Reverse = %v, esperado %v", tt.days, err, tt.want)
+		}
+	}
+}
+
+func TestSRS1(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	first := newTestSRS("primeiro", "first.example", &now)
+	second := newTestSRS("segundo", "second.example", &now)
+	third := newTestSRS("terceiro", "third.example", &now)
+
+	srs0 := mustForward(t, first, "alice@origem.example")
+
+	// O segundo encaminhador converte o SRS0 em SRS1 apontando para o primeiro
+	srs1 := mustForward(t, second, srs0)
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.HasSuffix(srs1, "@second.example") {
+		t.Fatalf("Forward(%s) = %s, esperado SRS1=...@second.example", srs0, srs1)
+	}
+	if !strings.Contains(srs1, "=first.example==") {
+		t.Errorf("SRS1 %s não guarda o primeiro encaminhador", srs1)
+	}
+
+	// Um terceiro encaminhador mantém o primeiro e recalcula o hash
+	again := mustForward(t, third, srs1)
+	if !strings.HasPrefix(again, "SRS1=") || !strings.HasSuffix(again, "@third.example") ||
+		!strings.Contains(again, "=first.example==") {
+		t.Errorf("Forward(%s) = %s, esperado SRS1 para first.example em third.example", srs1, again)
+	}
+
+	// O bounce volta para o endereço SRS0 do primeiro encaminhador, que o desfaz
+	for _, tt := range []struct {
+		s       *SRS
+		address string
+	}{{second, srs1}, {third, again}} {
+		back, err := tt.s.Reverse(tt.address)
+		if err != nil {
+			t.Fatalf("Reverse(%s): %v", tt.address, err)
+		}
+		if !strings.EqualFold(back, srs0) {
+			t.Errorf("Reverse(%s) = %s, esperado %s", tt.address, back, srs0)
+		}
+		original, err := first.Reverse(back)
+		if err != nil || original != "alice@origem.example" {
+			t.Errorf("Reverse(%s) = %s, %v, esperado alice@origem.example", back, original, err)
+		}
+	}
+
+	// O hash do SRS1 também é verificado
+	forged := strings.Replace(srs1, "=first.example==", "=outro.example==", 1)
+	if _, err := second.Reverse(forged); !errors.Is(err, ErrInvalidHash) {
+		t.Errorf("Reverse(%s) = %v, esperado %v", forged, err, ErrInvalidHash)
+	}
+}
+
+func mustForward(t *testing.T, s *SRS, address string) string {
+	t.Helper()
+	rewritten, err := s.Forward(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rewritten
+}
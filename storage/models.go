@@ -7,40 +7,124 @@ import (
 // User representa um usuário do sistema de email
 type User struct {
 	ID       int64
+	DomainID int64 // Zero para usuários sem domínio (login apenas pelo nome)
 	Username string
 	Password string // Deve ser armazenado com hash
 	Name     string
 	Email    string
-	Created  time.Time
-	Updated  time.Time
+	// Cotas do usuário; zero usa o padrão da configuração
+	QuotaBytes    int64
+	QuotaMessages int64
+	Created       time.Time
+	Updated       time.Time
+}
+
+// Usage representa o espaço ocupado pelas mensagens de um usuário ou domínio
+type Usage struct {
+	Bytes    int64
+	Messages int64
 }
 
-// Mailbox representa uma caixa de email
+// Domain representa um domínio virtual hospedado pelo servidor
+type Domain struct {
+	ID             int64
+	Name           string
+	Enabled        bool
+	CatchAll       string // Endereço que recebe mensagens para destinatários desconhecidos
+	QuotaBytes     int64  // Zero significa ilimitado
+	QuotaMessages  int64  // Zero significa ilimitado
+	DKIMSelector   string
+	DKIMPrivateKey string // Chave privada em formato PEM
+	Created        time.Time
+	Updated        time.Time
+}
+
+// Mailbox representa uma caixa de email. Caixas hierárquicas usam "/" como
+// separador no nome.
 type Mailbox struct {
-	ID     int64
-	UserID int64
-	Name   string
-	Path   string
+	ID         int64
+	UserID     int64
+	Name       string
+	Path       string
+	SpecialUse string // Atributo de uso especial (RFC 6154), ex.: \Sent
+	NoSelect   bool   // Caixa mantida apenas como nível da hierarquia
+
+	UIDNext       uint32 // Próximo UID a ser atribuído
+	HighestModSeq uint64 // Maior sequência de modificação da caixa (RFC 7162)
+}
+
+// UIDValidity retorna o UIDVALIDITY da caixa: o próprio ID, que nunca é
+// reutilizado, de modo que uma caixa excluída e criada de novo com o mesmo
+// nome invalida os UIDs guardados pelos clientes
+func (m *Mailbox) UIDValidity() uint32 {
+	return uint32(m.ID)
+}
+
+// ExpungedMessage registra a remoção de um UID de uma caixa. MessageID é o
+// ID da mensagem excluída ou movida para outra caixa; remoções anteriores
+// ao registro do ID têm MessageID zero.
+type ExpungedMessage struct {
+	UID       uint32
+	MessageID int64
+	ModSeq    uint64
+}
+
+// MailboxACL é uma entrada da lista de controle de acesso de uma caixa
+// (RFC 4314). O dono da caixa não aparece na lista: ele tem sempre todos os
+// direitos.
+type MailboxACL struct {
+	MailboxID  int64
+	Identifier string // Login do usuário, ou "anyone" para todos
+	Rights     string // Direitos da RFC 4314, ex.: "lrs"
+}
+
+// MailboxCounters resume uma caixa de correio para STATUS e SELECT, calculado
+// por agregação sem ler as mensagens
+type MailboxCounters struct {
+	Messages      uint32
+	Unseen        uint32
+	Recent        uint32 // Mensagens ainda não vistas por nenhuma sessão IMAP
+	Size          int64  // Soma dos tamanhos das mensagens
+	FirstUnseen   uint32 // UID da primeira mensagem não lida, ou zero
+	UIDNext       uint32
+	HighestModSeq uint64
 }
 
 // Message representa uma mensagem de email
 type Message struct {
-	ID        int64
-	MailboxID int64
-	UID       uint32
-	From      string
-	To        string
-	Cc        string
-	Subject   string
-	Date      time.Time
-	Body      string
-	RawData   []byte
-	Flags     string // Armazena flags como \\Seen, \\Answered, etc.
-	Size      int
-	Seen      bool
-	Deleted   bool
-	Draft     bool
-	Created   time.Time
+	ID         int64
+	MailboxID  int64
+	UID        uint32
+	From       string
+	To         string
+	Cc         string
+	Subject    string
+	MessageID  string // Cabeçalho Message-ID
+	InReplyTo  string // Cabeçalho In-Reply-To
+	References string // Identificadores do cabeçalho References, separados por espaço
+	ThreadID   int64  // Conversa à qual a mensagem pertence, atribuída em CreateMessage
+	Date       time.Time
+	Body       string
+	RawData    []byte
+	Flags      string // Armazena flags como \\Seen, \\Answered, etc.
+	Size       int
+	Seen       bool
+	Deleted    bool
+	Draft      bool
+	ModSeq     uint64 // Sequência de modificação, atualizada a cada alteração de flags
+	Created    time.Time
+}
+
+// Thread representa uma conversa: mensagens de um usuário ligadas pelos
+// cabeçalhos Message-ID, In-Reply-To e References ou, na falta deles, por
+// respostas com o mesmo assunto
+type Thread struct {
+	ID       int64
+	UserID   int64
+	Subject  string // Assunto base, sem prefixos como "Re:" e "Fwd:"
+	Messages int    // Número de mensagens da conversa
+	Created  time.Time
+	Updated  time.Time // Data da última mensagem adicionada
 }
 
 // Attachment representa um anexo de email
@@ -52,4 +136,147 @@ type Attachment struct {
 	Data      []byte
 	Size      int
 	Created   time.Time
-} 
\ No newline at end of file
+}
+
+// Alias representa um endereço alternativo de entrega. Um alias aponta para
+// um usuário local (UserID) ou para uma lista de endereços (Targets, separados
+// por vírgula). Um alias cujo endereço é "@dominio" funciona como catch-all
+// para o domínio.
+type Alias struct {
+	ID      int64
+	Address string
+	UserID  int64
+	Targets string
+	Created time.Time
+}
+
+// Forwarding representa o encaminhamento das mensagens de um usuário para
+// endereços externos
+type Forwarding struct {
+	UserID   int64
+	Targets  string // Endereços de destino separados por vírgula
+	KeepCopy bool   // Manter uma cópia local das mensagens encaminhadas
+	Enabled  bool
+	Updated  time.Time
+}
+
+// OutboundMessage é uma mensagem pendente na fila persistente de entrega
+// externa
+type OutboundMessage struct {
+	ID          int64
+	QueueID     string   // Identificador no histórico de entregas
+	Sender      string   // Remetente de envelope; vazio para notificações
+	Recipients  []string // Destinatários ainda pendentes
+	DSN         []byte   // Parâmetros DSN em JSON; vazio quando não informados
+	MessageID   string   // Cabeçalho Message-ID, com os sinais <>
+	Data        []byte
+	Delayed     []string // Destinatários cujo atraso já foi notificado
+	Attempts    int
+	NextAttempt time.Time
+	Created     time.Time // Chegada da mensagem na fila
+}
+
+// Vacation representa a resposta automática de ausência de um usuário
+type Vacation struct {
+	UserID    int64
+	Enabled   bool
+	Subject   string
+	Body      string
+	Start     time.Time // Início do período de ausência; zero para imediato
+	End       time.Time // Fim do período de ausência; zero para indeterminado
+	Addresses string    // Outros endereços do usuário aceitos em To/Cc, separados por vírgula
+	Days      int       // Intervalo mínimo, em dias, entre respostas ao mesmo remetente
+	Updated   time.Time
+}
+
+// SieveScript representa um script de filtragem Sieve de um usuário.
+// Apenas um script por usuário pode estar ativo.
+type SieveScript struct {
+	ID      int64
+	UserID  int64
+	Name    string
+	Content string
+	Active  bool
+	Created time.Time
+	Updated time.Time
+}
+
+// EmailSubmission registra um envio feito por um cliente JMAP (RFC 8621,
+// seção 7)
+type EmailSubmission struct {
+	ID         int64
+	UserID     int64
+	MessageID  int64 // Mensagem enviada; pode já ter sido excluída
+	ThreadID   int64
+	MailFrom   string
+	Recipients []string
+	QueueID    string // Identificador dos destinatários externos no histórico de entregas
+	SendAt     time.Time
+}
+
+// Estados registrados no histórico de entregas
+const (
+	DeliveryQueued    = "queued"    // Aceita na fila de entrega externa
+	DeliveryDeferred  = "deferred"  // Falha temporária; nova tentativa agendada
+	DeliveryDelivered = "delivered" // Aceita pelo servidor remoto
+	DeliveryBounced   = "bounced"   // Falha permanente ou tentativas esgotadas
+)
+
+// DeliveryRecord registra uma mudança no estado da entrega de uma mensagem a
+// um destinatário externo
+type DeliveryRecord struct {
+	ID         int64
+	QueueID    string // Identificador da mensagem na fila de entrega
+	MessageID  string // Cabeçalho Message-ID, com os sinais <>
+	Sender     string // Remetente de envelope; vazio para notificações
+	Recipient  string
+	Status     string
+	RemoteHost string // Servidor que respondeu à tentativa, quando houve conexão
+	Detail     string // Motivo da falha ou resposta do servidor remoto
+	Attempts   int
+	Created    time.Time
+}
+
+// Estados registrados no histórico de webhooks
+const (
+	WebhookDelivered = "delivered" // Resposta 2xx do destino
+	WebhookRetrying  = "retrying"  // Falha; nova tentativa agendada
+	WebhookFailed    = "failed"    // Tentativas esgotadas
+)
+
+// WebhookEvent é uma chamada de webhook pendente na fila persistente
+type WebhookEvent struct {
+	ID          int64
+	EventID     string // Identificador do evento, enviado em X-Webhook-Id
+	Hook        string // Nome do webhook na configuração
+	Payload     []byte // Corpo JSON da chamada
+	Attempts    int
+	NextAttempt time.Time
+	Created     time.Time
+}
+
+// WebhookDelivery registra uma tentativa de chamada de webhook
+type WebhookDelivery struct {
+	ID         int64
+	EventID    string
+	Hook       string
+	URL        string
+	Status     string
+	StatusCode int    // Código HTTP da resposta; zero quando não houve resposta
+	Detail     string // Erro ou início da resposta
+	Attempt    int
+	Created    time.Time
+}
+
+// BayesStats conta as mensagens treinadas em um classificador bayesiano
+type BayesStats struct {
+	Spam int64
+	Ham  int64
+}
+
+// BayesToken conta as mensagens treinadas que contêm um token
+type BayesToken struct {
+	Token string
+	Spam  int64
+	Ham   int64
+}
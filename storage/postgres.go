@@ -1,12 +1,16 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/carloslauriano/simpleEmail/config"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // PostgresStorage implementa a interface Storage para PostgreSQL
@@ -36,6 +40,9 @@ func (s *PostgresStorage) Open() error {
 	if err := s.createSchema(); err != nil {
 		return fmt.Errorf("falha ao criar esquema PostgreSQL: %w", err)
 	}
+	if err := s.migrate(); err != nil {
+		return fmt.Errorf("falha ao migrar esquema PostgreSQL: %w", err)
+	}
 	return nil
 }
 
@@ -50,14 +57,36 @@ func (s *PostgresStorage) Close() error {
 // createSchema cria o esquema do banco de dados
 func (s *PostgresStorage) createSchema() error {
 	schema := `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		applied TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS domains (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL UNIQUE,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		catch_all VARCHAR(255),
+		quota_bytes BIGINT NOT NULL DEFAULT 0,
+		quota_messages BIGINT NOT NULL DEFAULT 0,
+		dkim_selector VARCHAR(255),
+		dkim_private_key TEXT,
+		created TIMESTAMP NOT NULL,
+		updated TIMESTAMP NOT NULL
+	);
+
 	CREATE TABLE IF NOT EXISTS users (
 		id SERIAL PRIMARY KEY,
-		username VARCHAR(255) NOT NULL UNIQUE,
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		username VARCHAR(255) NOT NULL,
 		password VARCHAR(255) NOT NULL,
 		name VARCHAR(255),
 		email VARCHAR(255) NOT NULL UNIQUE,
+		quota_bytes BIGINT NOT NULL DEFAULT 0,
+		quota_messages BIGINT NOT NULL DEFAULT 0,
 		created TIMESTAMP NOT NULL,
-		updated TIMESTAMP NOT NULL
+		updated TIMESTAMP NOT NULL,
+		UNIQUE(domain_id, username)
 	);
 
 	CREATE TABLE IF NOT EXISTS mailboxes (
@@ -65,9 +94,42 @@ func (s *PostgresStorage) createSchema() error {
 		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
 		name VARCHAR(255) NOT NULL,
 		path VARCHAR(255) NOT NULL,
+		special_use VARCHAR(32) NOT NULL DEFAULT '',
+		noselect BOOLEAN NOT NULL DEFAULT FALSE,
+		uid_next BIGINT NOT NULL DEFAULT 1,
+		highest_modseq BIGINT NOT NULL DEFAULT 1,
+		recent_uid BIGINT NOT NULL DEFAULT 1,
 		UNIQUE(user_id, name)
 	);
 
+	CREATE TABLE IF NOT EXISTS subscriptions (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		PRIMARY KEY (user_id, name)
+	);
+
+	CREATE TABLE IF NOT EXISTS mailbox_acl (
+		mailbox_id INTEGER NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+		identifier VARCHAR(255) NOT NULL,
+		rights VARCHAR(32) NOT NULL,
+		PRIMARY KEY (mailbox_id, identifier)
+	);
+
+	CREATE TABLE IF NOT EXISTS threads (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		subject TEXT NOT NULL,
+		created TIMESTAMP NOT NULL,
+		updated TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS thread_refs (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		message_id TEXT NOT NULL,
+		thread_id INTEGER NOT NULL REFERENCES threads(id) ON DELETE CASCADE,
+		PRIMARY KEY (user_id, message_id)
+	);
+
 	CREATE TABLE IF NOT EXISTS messages (
 		id SERIAL PRIMARY KEY,
 		mailbox_id INTEGER NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
@@ -76,6 +138,10 @@ func (s *PostgresStorage) createSchema() error {
 		to_addr VARCHAR(255) NOT NULL,
 		cc TEXT,
 		subject TEXT,
+		message_id TEXT NOT NULL DEFAULT '',
+		in_reply_to TEXT NOT NULL DEFAULT '',
+		refs TEXT NOT NULL DEFAULT '',
+		thread_id INTEGER NOT NULL DEFAULT 0,
 		date TIMESTAMP NOT NULL,
 		body TEXT,
 		raw_data BYTEA,
@@ -84,10 +150,19 @@ func (s *PostgresStorage) createSchema() error {
 		seen BOOLEAN NOT NULL DEFAULT FALSE,
 		deleted BOOLEAN NOT NULL DEFAULT FALSE,
 		draft BOOLEAN NOT NULL DEFAULT FALSE,
+		modseq BIGINT NOT NULL DEFAULT 1,
 		created TIMESTAMP NOT NULL,
 		UNIQUE(mailbox_id, uid)
 	);
 
+	CREATE TABLE IF NOT EXISTS expunged_messages (
+		mailbox_id INTEGER NOT NULL REFERENCES mailboxes(id) ON DELETE CASCADE,
+		uid BIGINT NOT NULL,
+		message_id INTEGER NOT NULL DEFAULT 0,
+		modseq BIGINT NOT NULL,
+		PRIMARY KEY (mailbox_id, uid)
+	);
+
 	CREATE TABLE IF NOT EXISTS attachments (
 		id SERIAL PRIMARY KEY,
 		message_id INTEGER NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
@@ -97,22 +172,349 @@ func (s *PostgresStorage) createSchema() error {
 		size INTEGER NOT NULL,
 		created TIMESTAMP NOT NULL
 	);
+
+	CREATE TABLE IF NOT EXISTS aliases (
+		id SERIAL PRIMARY KEY,
+		address VARCHAR(255) NOT NULL UNIQUE,
+		user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+		targets TEXT,
+		created TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS forwardings (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		targets TEXT NOT NULL,
+		keep_copy BOOLEAN NOT NULL DEFAULT FALSE,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		updated TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS outbound_queue (
+		id SERIAL PRIMARY KEY,
+		queue_id VARCHAR(64) NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		recipients TEXT NOT NULL,
+		dsn BYTEA,
+		message_id TEXT NOT NULL DEFAULT '',
+		data BYTEA NOT NULL,
+		delayed TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt TIMESTAMP NOT NULL,
+		created TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS outbound_queue_next_attempt ON outbound_queue(next_attempt);
+
+	CREATE TABLE IF NOT EXISTS vacations (
+		user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		enabled BOOLEAN NOT NULL DEFAULT TRUE,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		start_date TIMESTAMP,
+		end_date TIMESTAMP,
+		addresses TEXT NOT NULL DEFAULT '',
+		days INTEGER NOT NULL DEFAULT 7,
+		updated TIMESTAMP NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS vacation_replies (
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		sender VARCHAR(255) NOT NULL,
+		handle VARCHAR(255) NOT NULL,
+		sent TIMESTAMP NOT NULL,
+		PRIMARY KEY (user_id, sender, handle)
+	);
+
+	CREATE TABLE IF NOT EXISTS sieve_scripts (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		name VARCHAR(255) NOT NULL,
+		content TEXT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT FALSE,
+		created TIMESTAMP NOT NULL,
+		updated TIMESTAMP NOT NULL,
+		UNIQUE(user_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS email_submissions (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		message_id INTEGER NOT NULL,
+		thread_id INTEGER NOT NULL DEFAULT 0,
+		mail_from TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		queue_id TEXT NOT NULL DEFAULT '',
+		send_at TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS email_submissions_user_id ON email_submissions(user_id);
+
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id SERIAL PRIMARY KEY,
+		queue_id VARCHAR(64) NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		sender TEXT NOT NULL DEFAULT '',
+		recipient TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		remote_host TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS deliveries_queue_id ON deliveries(queue_id);
+	CREATE INDEX IF NOT EXISTS deliveries_message_id ON deliveries(message_id);
+	CREATE INDEX IF NOT EXISTS deliveries_recipient ON deliveries(recipient);
+
+	CREATE TABLE IF NOT EXISTS webhook_outbox (
+		id SERIAL PRIMARY KEY,
+		event_id VARCHAR(64) NOT NULL,
+		hook VARCHAR(255) NOT NULL,
+		payload BYTEA NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt TIMESTAMP NOT NULL,
+		created TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_outbox_next_attempt ON webhook_outbox(next_attempt);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id SERIAL PRIMARY KEY,
+		event_id VARCHAR(64) NOT NULL,
+		hook VARCHAR(255) NOT NULL,
+		url TEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT '',
+		attempt INTEGER NOT NULL,
+		created TIMESTAMP NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_event_id ON webhook_deliveries(event_id);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_hook ON webhook_deliveries(hook);
+
+	CREATE TABLE IF NOT EXISTS bayes_stats (
+		user_id INTEGER PRIMARY KEY,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS bayes_tokens (
+		user_id INTEGER NOT NULL,
+		token VARCHAR(64) NOT NULL,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, token)
+	);
+
+	CREATE TABLE IF NOT EXISTS bayes_trained (
+		user_id INTEGER NOT NULL,
+		digest VARCHAR(64) NOT NULL,
+		spam BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, digest)
+	);
+
 	`
 
 	_, err := s.db.Exec(schema)
 	return err
 }
 
-// CreateUser cria um novo usuário
+// postgresMigrations atualizam bancos criados antes do suporte a domínios
+// virtuais, cotas, caixas com uso especial, assinaturas, CONDSTORE,
+// conversas e acompanhamento das entregas
+var postgresMigrations = []migration{
+	{1, "coluna de domínio dos usuários", func(tx *sql.Tx) error {
+		_, err := postgresAddColumns(tx, "users", "domain_id INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{2, "nome de usuário único por domínio", func(tx *sql.Tx) error {
+		if _, err := tx.Exec("ALTER TABLE users DROP CONSTRAINT IF EXISTS users_username_key"); err != nil {
+			return err
+		}
+		var exists bool
+		err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = 'users'::regclass AND conname = 'users_domain_id_username_key')",
+		).Scan(&exists)
+		if err != nil || exists {
+			return err
+		}
+		_, err = tx.Exec("ALTER TABLE users ADD CONSTRAINT users_domain_id_username_key UNIQUE (domain_id, username)")
+		return err
+	}},
+	{3, "colunas de cota dos usuários", func(tx *sql.Tx) error {
+		_, err := postgresAddColumns(tx, "users",
+			"quota_bytes BIGINT NOT NULL DEFAULT 0",
+			"quota_messages BIGINT NOT NULL DEFAULT 0",
+		)
+		return err
+	}},
+	{4, "colunas de uso especial das caixas", func(tx *sql.Tx) error {
+		_, err := postgresAddColumns(tx, "mailboxes",
+			"special_use VARCHAR(32) NOT NULL DEFAULT ''",
+			"noselect BOOLEAN NOT NULL DEFAULT FALSE",
+		)
+		return err
+	}},
+	{5, "caixas padrão e assinaturas de usuários existentes", postgresMigrateDefaultMailboxes},
+	{6, "colunas de UIDs e modseq das caixas e mensagens", func(tx *sql.Tx) error {
+		added, err := postgresAddColumns(tx, "mailboxes",
+			"uid_next BIGINT NOT NULL DEFAULT 1",
+			"highest_modseq BIGINT NOT NULL DEFAULT 1",
+		)
+		if err != nil {
+			return err
+		}
+		// Os UIDs antes eram calculados a partir das mensagens existentes
+		if added["uid_next"] {
+			if _, err := tx.Exec(`UPDATE mailboxes SET uid_next =
+				COALESCE((SELECT MAX(uid) FROM messages WHERE messages.mailbox_id = mailboxes.id), 0) + 1`); err != nil {
+				return err
+			}
+		}
+		_, err = postgresAddColumns(tx, "messages", "modseq BIGINT NOT NULL DEFAULT 1")
+		return err
+	}},
+	{7, "colunas de cabeçalhos de conversa das mensagens", func(tx *sql.Tx) error {
+		_, err := postgresAddColumns(tx, "messages",
+			"message_id TEXT NOT NULL DEFAULT ''",
+			"in_reply_to TEXT NOT NULL DEFAULT ''",
+			"refs TEXT NOT NULL DEFAULT ''",
+		)
+		return err
+	}},
+	{8, "coluna de conversa das mensagens", func(tx *sql.Tx) error {
+		_, err := postgresAddColumns(tx, "messages", "thread_id INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{9, "coluna de mensagens recentes das caixas", func(tx *sql.Tx) error {
+		added, err := postgresAddColumns(tx, "mailboxes", "recent_uid BIGINT NOT NULL DEFAULT 1")
+		if err != nil || !added["recent_uid"] {
+			return err
+		}
+		// As mensagens existentes já foram vistas pelos clientes
+		_, err = tx.Exec("UPDATE mailboxes SET recent_uid = uid_next")
+		return err
+	}},
+	{10, "id da mensagem nas remoções registradas", func(tx *sql.Tx) error {
+		_, err := postgresAddColumns(tx, "expunged_messages", "message_id INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{11, "colunas de acompanhamento das entregas na fila e nos envios JMAP", func(tx *sql.Tx) error {
+		added, err := postgresAddColumns(tx, "outbound_queue",
+			"queue_id VARCHAR(64) NOT NULL DEFAULT ''",
+			"dsn BYTEA",
+			"message_id TEXT NOT NULL DEFAULT ''",
+			"delayed TEXT NOT NULL DEFAULT ''",
+		)
+		if err != nil {
+			return err
+		}
+		if added["queue_id"] {
+			// Mensagens já enfileiradas recebem um identificador para o
+			// histórico de entregas
+			_, err = tx.Exec("UPDATE outbound_queue SET queue_id = UPPER(SUBSTR(MD5(RANDOM()::TEXT || id::TEXT), 1, 12))")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = postgresAddColumns(tx, "email_submissions", "queue_id TEXT NOT NULL DEFAULT ''")
+		return err
+	}},
+}
+
+// postgresMigrateDefaultMailboxes cria as caixas padrão e os atributos de uso
+// especial que faltam aos usuários criados antes deles e assina todas as
+// caixas existentes, para que clientes que só usam LSUB continuem a vê-las
+func postgresMigrateDefaultMailboxes(tx *sql.Tx) error {
+	for _, mailbox := range DefaultMailboxes {
+		if mailbox.SpecialUse != "" {
+			// A caixa com o nome padrão recebe o atributo, se o usuário não o usa em outra
+			if _, err := tx.Exec(
+				`UPDATE mailboxes SET special_use = $1 WHERE name = $2 AND special_use = ''
+				AND NOT EXISTS (SELECT 1 FROM mailboxes m WHERE m.user_id = mailboxes.user_id AND m.special_use = $3)`,
+				mailbox.SpecialUse, mailbox.Name, mailbox.SpecialUse,
+			); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO mailboxes (user_id, name, path, special_use)
+			SELECT u.id, $1, $2, $3 FROM users u WHERE NOT EXISTS (SELECT 1 FROM mailboxes m
+			WHERE m.user_id = u.id AND (m.name = $4 OR ($5 <> '' AND m.special_use = $6)))`,
+			mailbox.Name, mailbox.Name, mailbox.SpecialUse, mailbox.Name, mailbox.SpecialUse, mailbox.SpecialUse,
+		); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(
+		`INSERT INTO subscriptions (user_id, name) SELECT user_id, name FROM mailboxes WHERE NOT noselect
+		ON CONFLICT (user_id, name) DO NOTHING`,
+	)
+	return err
+}
+
+// migrate aplica as migrações pendentes
+func (s *PostgresStorage) migrate() error {
+	conn, err := s.db.Conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return runMigrations(conn, postgresMigrations, "INSERT INTO schema_version (version, applied) VALUES ($1, $2)")
+}
+
+// postgresAddColumns adiciona à tabela as colunas, informadas pela definição
+// completa, que ela ainda não possui, e retorna os nomes das adicionadas
+func postgresAddColumns(tx *sql.Tx, table string, columns ...string) (map[string]bool, error) {
+	added := make(map[string]bool)
+	for _, column := range columns {
+		name := strings.Fields(column)[0]
+		var exists bool
+		err := tx.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = $1 AND column_name = $2)",
+			table, name,
+		).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column); err != nil {
+			return nil, err
+		}
+		added[name] = true
+	}
+	return added, nil
+}
+
+// CreateUser cria um novo usuário. Usuários de um domínio virtual recebem o
+// endereço usuario@dominio como email.
 func (s *PostgresStorage) CreateUser(user *User) error {
+	if user.DomainID != 0 {
+		domain, err := s.GetDomainByID(user.DomainID)
+		if err != nil {
+			return err
+		}
+		user.Email = strings.ToLower(user.Username + "@" + domain.Name)
+	}
+
 	now := time.Now()
 	user.Created = now
 	user.Updated = now
 
 	var id int64
 	err := s.db.QueryRow(
-		"INSERT INTO users (username, password, name, email, created, updated) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
-		user.Username, user.Password, user.Name, user.Email, user.Created, user.Updated,
+		`INSERT INTO users (domain_id, username, password, name, email, quota_bytes, quota_messages, created, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		user.DomainID, user.Username, user.Password, user.Name, user.Email, user.QuotaBytes, user.QuotaMessages,
+		user.Created, user.Updated,
 	).Scan(&id)
 	if err != nil {
 		return fmt.Errorf("falha ao criar usuário: %w", err)
@@ -120,43 +522,57 @@ func (s *PostgresStorage) CreateUser(user *User) error {
 	user.ID = id
 
 	// Criar caixas padrão
-	for _, name := range []string{"INBOX", "Sent", "Drafts", "Trash"} {
-		mailbox := &Mailbox{
-			UserID: user.ID,
-			Name:   name,
-			Path:   name,
-		}
-		if err := s.CreateMailbox(mailbox); err != nil {
+	for _, mailbox := range DefaultMailboxes {
+		mailbox.UserID = user.ID
+		mailbox.Path = mailbox.Name
+		if err := s.CreateMailbox(&mailbox); err != nil {
 			return fmt.Errorf("falha ao criar caixa de correio padrão: %w", err)
 		}
+		if err := s.SubscribeMailbox(user.ID, mailbox.Name); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// GetUser obtém um usuário pelo nome de usuário
+// GetUser obtém um usuário pelo nome de usuário. Logins no formato
+// usuario@dominio são resolvidos dentro do domínio virtual correspondente.
 func (s *PostgresStorage) GetUser(username string) (*User, error) {
-	user := &User{}
-	err := s.db.QueryRow(
-		"SELECT id, username, password, name, email, created, updated FROM users WHERE username = $1",
+	if name, domain, ok := splitLogin(username); ok {
+		user, err := scanUser(s.db.QueryRow(
+			`SELECT u.id, u.domain_id, u.username, u.password, u.name, u.email, u.quota_bytes, u.quota_messages, u.created, u.updated
+			FROM users u JOIN domains d ON d.id = u.domain_id WHERE u.username = $1 AND d.name = $2`,
+			name, domain,
+		))
+		if err != ErrUserNotFound {
+			return user, err
+		}
+	}
+
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE username = $1 AND domain_id = 0",
 		username,
-	).Scan(&user.ID, &user.Username, &user.Password, &user.Name, &user.Email, &user.Created, &user.Updated)
+	))
+}
 
-	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
-	} else if err != nil {
-		return nil, fmt.Errorf("falha ao obter usuário: %w", err)
-	}
+// GetUserByID obtém um usuário pelo ID
+func (s *PostgresStorage) GetUserByID(userID int64) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1", userID))
+}
 
-	return user, nil
+// GetUserByEmail obtém um usuário pelo endereço de email
+func (s *PostgresStorage) GetUserByEmail(email string) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE LOWER(email) = LOWER($1)", email))
 }
 
 // UpdateUser atualiza um usuário existente
 func (s *PostgresStorage) UpdateUser(user *User) error {
 	user.Updated = time.Now()
 	_, err := s.db.Exec(
-		"UPDATE users SET password = $1, name = $2, email = $3, updated = $4 WHERE id = $5",
-		user.Password, user.Name, user.Email, user.Updated, user.ID,
+		`UPDATE users SET password = $1, name = $2, email = $3, quota_bytes = $4, quota_messages = $5, updated = $6
+		WHERE id = $7`,
+		user.Password, user.Name, user.Email, user.QuotaBytes, user.QuotaMessages, user.Updated, user.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("falha ao atualizar usuário: %w", err)
@@ -185,16 +601,106 @@ func (s *PostgresStorage) AuthenticateUser(username, password string) (*User, er
 		return nil, fmt.Errorf("senha inválida")
 	}
 
+	if user.DomainID != 0 {
+		domain, err := s.GetDomainByID(user.DomainID)
+		if err != nil {
+			return nil, err
+		}
+		if !domain.Enabled {
+			return nil, ErrDomainDisabled
+		}
+	}
+
 	return user, nil
 }
 
+// Métodos de implementação para Domain
+
+func (s *PostgresStorage) CreateDomain(domain *Domain) error {
+	domain.Name = strings.ToLower(domain.Name)
+	now := time.Now()
+	domain.Created = now
+	domain.Updated = now
+
+	var id int64
+	err := s.db.QueryRow(
+		`INSERT INTO domains
+		(name, enabled, catch_all, quota_bytes, quota_messages, dkim_selector, dkim_private_key, created, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		domain.Name, domain.Enabled, domain.CatchAll, domain.QuotaBytes, domain.QuotaMessages,
+		domain.DKIMSelector, domain.DKIMPrivateKey, domain.Created, domain.Updated,
+	).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("falha ao criar domínio: %w", err)
+	}
+	domain.ID = id
+
+	return nil
+}
+
+func (s *PostgresStorage) GetDomain(name string) (*Domain, error) {
+	return scanDomain(s.db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE name = $1", strings.ToLower(name)))
+}
+
+func (s *PostgresStorage) GetDomainByID(domainID int64) (*Domain, error) {
+	return scanDomain(s.db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE id = $1", domainID))
+}
+
+func (s *PostgresStorage) ListDomains() ([]*Domain, error) {
+	rows, err := s.db.Query("SELECT " + domainColumns + " FROM domains ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar domínios: %w", err)
+	}
+	defer rows.Close()
+
+	var domains []*Domain
+	for rows.Next() {
+		domain, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre domínios: %w", err)
+	}
+
+	return domains, nil
+}
+
+func (s *PostgresStorage) UpdateDomain(domain *Domain) error {
+	domain.Updated = time.Now()
+	_, err := s.db.Exec(
+		`UPDATE domains SET enabled = $1, catch_all = $2, quota_bytes = $3, quota_messages = $4,
+		dkim_selector = $5, dkim_private_key = $6, updated = $7 WHERE id = $8`,
+		domain.Enabled, domain.CatchAll, domain.QuotaBytes, domain.QuotaMessages,
+		domain.DKIMSelector, domain.DKIMPrivateKey, domain.Updated, domain.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar domínio: %w", err)
+	}
+	return nil
+}
+
+// DeleteDomain exclui um domínio e todos os seus usuários
+func (s *PostgresStorage) DeleteDomain(domainID int64) error {
+	if _, err := s.db.Exec("DELETE FROM users WHERE domain_id = $1", domainID); err != nil {
+		return fmt.Errorf("falha ao excluir usuários do domínio: %w", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM domains WHERE id = $1", domainID); err != nil {
+		return fmt.Errorf("falha ao excluir domínio: %w", err)
+	}
+	return nil
+}
+
 // Métodos de implementação para Mailbox
 
 func (s *PostgresStorage) CreateMailbox(mailbox *Mailbox) error {
 	var id int64
 	err := s.db.QueryRow(
-		"INSERT INTO mailboxes (user_id, name, path) VALUES ($1, $2, $3) RETURNING id",
-		mailbox.UserID, mailbox.Name, mailbox.Path,
+		"INSERT INTO mailboxes (user_id, name, path, special_use, noselect) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+		mailbox.UserID, mailbox.Name, mailbox.Path, mailbox.SpecialUse, mailbox.NoSelect,
 	).Scan(&id)
 	if err != nil {
 		return fmt.Errorf("falha ao criar caixa de correio: %w", err)
@@ -204,24 +710,22 @@ func (s *PostgresStorage) CreateMailbox(mailbox *Mailbox) error {
 }
 
 func (s *PostgresStorage) GetMailbox(userID int64, name string) (*Mailbox, error) {
-	mailbox := &Mailbox{}
-	err := s.db.QueryRow(
-		"SELECT id, user_id, name, path FROM mailboxes WHERE user_id = $1 AND name = $2",
+	return scanMailbox(s.db.QueryRow(
+		"SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = $1 AND name = $2",
 		userID, name,
-	).Scan(&mailbox.ID, &mailbox.UserID, &mailbox.Name, &mailbox.Path)
-
-	if err == sql.ErrNoRows {
-		return nil, ErrMailboxNotFound
-	} else if err != nil {
-		return nil, fmt.Errorf("falha ao obter caixa de correio: %w", err)
-	}
+	))
+}
 
-	return mailbox, nil
+func (s *PostgresStorage) GetMailboxByID(mailboxID int64) (*Mailbox, error) {
+	return scanMailbox(s.db.QueryRow(
+		"SELECT "+mailboxColumns+" FROM mailboxes WHERE id = $1",
+		mailboxID,
+	))
 }
 
 func (s *PostgresStorage) ListMailboxes(userID int64) ([]*Mailbox, error) {
 	rows, err := s.db.Query(
-		"SELECT id, user_id, name, path FROM mailboxes WHERE user_id = $1",
+		"SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = $1 ORDER BY name",
 		userID,
 	)
 	if err != nil {
@@ -231,9 +735,9 @@ func (s *PostgresStorage) ListMailboxes(userID int64) ([]*Mailbox, error) {
 
 	var mailboxes []*Mailbox
 	for rows.Next() {
-		mb := &Mailbox{}
-		if err := rows.Scan(&mb.ID, &mb.UserID, &mb.Name, &mb.Path); err != nil {
-			return nil, fmt.Errorf("falha ao ler dados da caixa de correio: %w", err)
+		mb, err := scanMailbox(rows)
+		if err != nil {
+			return nil, err
 		}
 		mailboxes = append(mailboxes, mb)
 	}
@@ -256,8 +760,8 @@ func (s *PostgresStorage) DeleteMailbox(mailboxID int64) error {
 // UpdateMailbox atualiza uma caixa de correio existente
 func (s *PostgresStorage) UpdateMailbox(mailbox *Mailbox) error {
 	_, err := s.db.Exec(
-		"UPDATE mailboxes SET name = $1, path = $2 WHERE id = $3",
-		mailbox.Name, mailbox.Path, mailbox.ID,
+		"UPDATE mailboxes SET name = $1, path = $2, special_use = $3, noselect = $4 WHERE id = $5",
+		mailbox.Name, mailbox.Path, mailbox.SpecialUse, mailbox.NoSelect, mailbox.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("falha ao atualizar caixa de correio: %w", err)
@@ -265,145 +769,1495 @@ func (s *PostgresStorage) UpdateMailbox(mailbox *Mailbox) error {
 	return nil
 }
 
-// Implementações de Message
-
-func (s *PostgresStorage) CreateMessage(message *Message) error {
-	message.Created = time.Now()
-	var id int64
-	err := s.db.QueryRow(
-		`INSERT INTO messages 
-		(mailbox_id, uid, from_addr, to_addr, cc, subject, date, body, raw_data, flags, size, seen, deleted, draft, created) 
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15) RETURNING id`,
-		message.MailboxID, message.UID, message.From, message.To, message.Cc, message.Subject, 
-		message.Date, message.Body, message.RawData, message.Flags, message.Size, 
-		message.Seen, message.Deleted, message.Draft, message.Created,
-	).Scan(&id)
+// RenameMailbox renomeia uma caixa de correio junto com suas subcaixas. A
+// INBOX não muda de nome: suas mensagens são movidas para a nova caixa.
+func (s *PostgresStorage) RenameMailbox(userID int64, oldName, newName string) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("falha ao criar mensagem: %w", err)
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
 	}
-	message.ID = id
-	return nil
-}
+	defer tx.Rollback()
 
-func (s *PostgresStorage) GetMessage(mailboxID int64, uid uint32) (*Message, error) {
-	message := &Message{}
-	err := s.db.QueryRow(
-		`SELECT id, mailbox_id, uid, from_addr, to_addr, cc, subject, date, body, raw_data, 
-		flags, size, seen, deleted, draft, created FROM messages 
-		WHERE mailbox_id = $1 AND uid = $2`,
-		mailboxID, uid,
-	).Scan(
-		&message.ID, &message.MailboxID, &message.UID, &message.From, &message.To, 
-		&message.Cc, &message.Subject, &message.Date, &message.Body, &message.RawData,
-		&message.Flags, &message.Size, &message.Seen, &message.Deleted, &message.Draft, &message.Created,
-	)
+	if oldName == "INBOX" {
+		inbox, err := s.GetMailbox(userID, oldName)
+		if err != nil {
+			return err
+		}
 
-	if err == sql.ErrNoRows {
-		return nil, ErrMessageNotFound
-	} else if err != nil {
-		return nil, fmt.Errorf("falha ao obter mensagem: %w", err)
-	}
+		// Para a INBOX as mensagens movidas contam como removidas, e a nova
+		// caixa herda os contadores para manter os UIDs
+		var modseq uint64
+		err = tx.QueryRow(
+			"UPDATE mailboxes SET highest_modseq = highest_modseq + 1 WHERE id = $1 RETURNING highest_modseq",
+			inbox.ID,
+		).Scan(&modseq)
+		if err != nil {
+			return fmt.Errorf("falha ao atualizar sequência de modificação: %w", err)
+		}
+		_, err = tx.Exec(
+			`INSERT INTO expunged_messages (mailbox_id, uid, message_id, modseq)
+			SELECT mailbox_id, uid, id, $1 FROM messages WHERE mailbox_id = $2
+			ON CONFLICT (mailbox_id, uid) DO UPDATE SET message_id = excluded.message_id, modseq = excluded.modseq`,
+			modseq, inbox.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("falha ao registrar remoção das mensagens: %w", err)
+		}
 
-	return message, nil
-}
+		var id int64
+		err = tx.QueryRow(
+			`INSERT INTO mailboxes (user_id, name, path, uid_next, highest_modseq, recent_uid)
+			VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+			userID, newName, newName, inbox.UIDNext, modseq, inbox.UIDNext,
+		).Scan(&id)
+		if err != nil {
+			return fmt.Errorf("falha ao criar caixa de correio: %w", err)
+		}
+		if _, err := tx.Exec("UPDATE messages SET mailbox_id = $1 WHERE mailbox_id = $2", id, inbox.ID); err != nil {
+			return fmt.Errorf("falha ao mover mensagens da INBOX: %w", err)
+		}
+		return tx.Commit()
+	}
 
-func (s *PostgresStorage) ListMessages(mailboxID int64) ([]*Message, error) {
-	rows, err := s.db.Query(
-		`SELECT id, mailbox_id, uid, from_addr, to_addr, cc, subject, date, body, raw_data, 
-		flags, size, seen, deleted, draft, created FROM messages 
-		WHERE mailbox_id = $1 ORDER BY uid`,
-		mailboxID,
+	// SUBSTR conta caracteres, e não bytes, nos dois bancos
+	length := utf8.RuneCountInString(oldName)
+	result, err := tx.Exec(
+		`UPDATE mailboxes SET name = $1 || SUBSTR(name, $2), path = $3 || SUBSTR(name, $4)
+		WHERE user_id = $5 AND (name = $6 OR SUBSTR(name, 1, $7) = $8)`,
+		newName, length+1, newName, length+1,
+		userID, oldName, length+1, oldName+MailboxDelimiter,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+		return fmt.Errorf("falha ao renomear caixa de correio: %w", err)
 	}
-	defer rows.Close()
-
-	var messages []*Message
-	for rows.Next() {
-		msg := &Message{}
-		if err := rows.Scan(
-			&msg.ID, &msg.MailboxID, &msg.UID, &msg.From, &msg.To, 
-			&msg.Cc, &msg.Subject, &msg.Date, &msg.Body, &msg.RawData,
-			&msg.Flags, &msg.Size, &msg.Seen, &msg.Deleted, &msg.Draft, &msg.Created,
-		); err != nil {
-			return nil, fmt.Errorf("falha ao ler dados da mensagem: %w", err)
-		}
-		messages = append(messages, msg)
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMailboxNotFound
 	}
 
-	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("erro ao iterar sobre mensagens: %w", err)
+	// As assinaturas acompanham as caixas renomeadas
+	_, err = tx.Exec(
+		`UPDATE subscriptions SET name = $1 || SUBSTR(name, $2)
+		WHERE user_id = $3 AND (name = $4 OR SUBSTR(name, 1, $5) = $6)`,
+		newName, length+1,
+		userID, oldName, length+1, oldName+MailboxDelimiter,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao renomear assinaturas: %w", err)
 	}
 
-	return messages, nil
+	return tx.Commit()
 }
 
-func (s *PostgresStorage) UpdateMessageFlags(messageID int64, flags string, seen, deleted, draft bool) error {
+// Métodos de implementação para assinaturas de caixas
+
+// SubscribeMailbox assina uma caixa de correio; assinar novamente não é erro
+func (s *PostgresStorage) SubscribeMailbox(userID int64, name string) error {
 	_, err := s.db.Exec(
-		"UPDATE messages SET flags = $1, seen = $2, deleted = $3, draft = $4 WHERE id = $5",
-		flags, seen, deleted, draft, messageID,
+		`INSERT INTO subscriptions (user_id, name) VALUES ($1, $2)
+		ON CONFLICT (user_id, name) DO NOTHING`,
+		userID, name,
 	)
 	if err != nil {
-		return fmt.Errorf("falha ao atualizar flags da mensagem: %w", err)
-	}
-	return nil
-}
-
-func (s *PostgresStorage) DeleteMessage(messageID int64) error {
-	_, err := s.db.Exec("DELETE FROM messages WHERE id = $1", messageID)
-	if err != nil {
-		return fmt.Errorf("falha ao excluir mensagem: %w", err)
+		return fmt.Errorf("falha ao assinar caixa de correio: %w", err)
 	}
 	return nil
 }
 
-// Implementações de Attachment
-
-func (s *PostgresStorage) CreateAttachment(attachment *Attachment) error {
-	attachment.Created = time.Now()
-	var id int64
-	err := s.db.QueryRow(
-		"INSERT INTO attachments (message_id, filename, mime_type, data, size, created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
-		attachment.MessageID, attachment.Filename, attachment.MimeType, attachment.Data, attachment.Size, attachment.Created,
-	).Scan(&id)
+// UnsubscribeMailbox cancela a assinatura de uma caixa de correio
+func (s *PostgresStorage) UnsubscribeMailbox(userID int64, name string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE user_id = $1 AND name = $2", userID, name)
 	if err != nil {
-		return fmt.Errorf("falha ao criar anexo: %w", err)
+		return fmt.Errorf("falha ao cancelar assinatura: %w", err)
 	}
-	attachment.ID = id
 	return nil
 }
 
-func (s *PostgresStorage) GetAttachments(messageID int64) ([]*Attachment, error) {
-	rows, err := s.db.Query(
-		"SELECT id, message_id, filename, mime_type, data, size, created FROM attachments WHERE message_id = $1",
-		messageID,
-	)
+// ListSubscriptions lista os nomes das caixas assinadas pelo usuário
+func (s *PostgresStorage) ListSubscriptions(userID int64) ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM subscriptions WHERE user_id = $1 ORDER BY name", userID)
 	if err != nil {
-		return nil, fmt.Errorf("falha ao obter anexos: %w", err)
+		return nil, fmt.Errorf("falha ao listar assinaturas: %w", err)
 	}
 	defer rows.Close()
 
-	var attachments []*Attachment
+	var names []string
 	for rows.Next() {
-		att := &Attachment{}
-		if err := rows.Scan(&att.ID, &att.MessageID, &att.Filename, &att.MimeType, &att.Data, &att.Size, &att.Created); err != nil {
-			return nil, fmt.Errorf("falha ao ler dados do anexo: %w", err)
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("falha ao ler assinatura: %w", err)
 		}
-		attachments = append(attachments, att)
+		names = append(names, name)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("erro ao iterar sobre anexos: %w", err)
+		return nil, fmt.Errorf("erro ao iterar sobre assinaturas: %w", err)
 	}
 
-	return attachments, nil
+	return names, nil
 }
 
-func (s *PostgresStorage) DeleteAttachment(attachmentID int64) error {
-	_, err := s.db.Exec("DELETE FROM attachments WHERE id = $1", attachmentID)
+// Métodos de implementação para controle de acesso às caixas
+
+// SetMailboxACL grava os direitos de um identificador sobre a caixa
+func (s *PostgresStorage) SetMailboxACL(acl *MailboxACL) error {
+	if acl.Rights == "" {
+		return s.DeleteMailboxACL(acl.MailboxID, acl.Identifier)
+	}
+	_, err := s.db.Exec(
+		`INSERT INTO mailbox_acl (mailbox_id, identifier, rights) VALUES ($1, $2, $3)
+		ON CONFLICT (mailbox_id, identifier) DO UPDATE SET rights = excluded.rights`,
+		acl.MailboxID, strings.ToLower(acl.Identifier), acl.Rights,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao gravar direitos da caixa: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteMailboxACL(mailboxID int64, identifier string) error {
+	_, err := s.db.Exec(
+		"DELETE FROM mailbox_acl WHERE mailbox_id = $1 AND identifier = $2",
+		mailboxID, strings.ToLower(identifier),
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao remover direitos da caixa: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListMailboxACL(mailboxID int64) ([]*MailboxACL, error) {
+	return s.listMailboxACL("SELECT mailbox_id, identifier, rights FROM mailbox_acl WHERE mailbox_id = $1 ORDER BY identifier", mailboxID)
+}
+
+// ListACLByIdentifier lista as caixas em que o identificador recebeu direitos
+func (s *PostgresStorage) ListACLByIdentifier(identifier string) ([]*MailboxACL, error) {
+	return s.listMailboxACL("SELECT mailbox_id, identifier, rights FROM mailbox_acl WHERE identifier = $1 ORDER BY mailbox_id", strings.ToLower(identifier))
+}
+
+func (s *PostgresStorage) listMailboxACL(query string, arg interface{}) ([]*MailboxACL, error) {
+	rows, err := s.db.Query(query, arg)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar direitos das caixas: %w", err)
+	}
+	defer rows.Close()
+
+	var acls []*MailboxACL
+	for rows.Next() {
+		acl := &MailboxACL{}
+		if err := rows.Scan(&acl.MailboxID, &acl.Identifier, &acl.Rights); err != nil {
+			return nil, fmt.Errorf("falha ao ler direitos da caixa: %w", err)
+		}
+		acls = append(acls, acl)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre direitos das caixas: %w", err)
+	}
+
+	return acls, nil
+}
+
+// Implementações de Message
+
+func (s *PostgresStorage) CreateMessage(message *Message) error {
+	return s.CreateMessages([]*Message{message})
+}
+
+// CreateMessages grava as mensagens em uma única transação: se alguma
+// falhar, nenhuma é gravada
+func (s *PostgresStorage) CreateMessages(messages []*Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, message := range messages {
+		if err := s.insertMessage(tx, message); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertMessage grava uma mensagem na transação, atribuindo UID, sequência
+// de modificação e conversa
+func (s *PostgresStorage) insertMessage(tx *sql.Tx, message *Message) error {
+	message.Created = time.Now()
+
+	// Os contadores da caixa garantem UIDs crescentes que nunca são reutilizados
+	var userID int64
+	var err error
+	if message.UID == 0 {
+		err = tx.QueryRow(
+			`UPDATE mailboxes SET uid_next = uid_next + 1, highest_modseq = highest_modseq + 1
+			WHERE id = $1 RETURNING user_id, uid_next - 1, highest_modseq`,
+			message.MailboxID,
+		).Scan(&userID, &message.UID, &message.ModSeq)
+	} else {
+		err = tx.QueryRow(
+			`UPDATE mailboxes SET uid_next = GREATEST(uid_next, $1), highest_modseq = highest_modseq + 1
+			WHERE id = $2 RETURNING user_id, highest_modseq`,
+			int64(message.UID)+1, message.MailboxID,
+		).Scan(&userID, &message.ModSeq)
+	}
+	if err == sql.ErrNoRows {
+		return ErrMailboxNotFound
+	} else if err != nil {
+		return fmt.Errorf("falha ao obter próximo UID: %w", err)
+	}
+
+	if err := s.assignThread(tx, userID, message); err != nil {
+		return err
+	}
+
+	var id int64
+	err = tx.QueryRow(
+		`INSERT INTO messages
+		(mailbox_id, uid, from_addr, to_addr, cc, subject, message_id, in_reply_to, refs,
+		thread_id, date, body, raw_data, flags, size, seen, deleted, draft, modseq, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20) RETURNING id`,
+		message.MailboxID, message.UID, message.From, message.To, message.Cc, message.Subject,
+		message.MessageID, message.InReplyTo, message.References,
+		message.ThreadID, message.Date, message.Body, message.RawData, message.Flags, message.Size,
+		message.Seen, message.Deleted, message.Draft, message.ModSeq, message.Created,
+	).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("falha ao criar mensagem: %w", err)
+	}
+	message.ID = id
+
+	return nil
+}
+
+func (s *PostgresStorage) GetMessage(mailboxID int64, uid uint32) (*Message, error) {
+	return scanMessage(s.db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE mailbox_id = $1 AND uid = $2",
+		mailboxID, uid,
+	))
+}
+
+func (s *PostgresStorage) GetMessageByID(messageID int64) (*Message, error) {
+	return scanMessage(s.db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE id = $1",
+		messageID,
+	))
+}
+
+func (s *PostgresStorage) ListMessages(mailboxID int64) ([]*Message, error) {
+	rows, err := s.db.Query(
+		"SELECT "+messageColumns+" FROM messages WHERE mailbox_id = $1 ORDER BY uid",
+		mailboxID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens: %w", err)
+	}
+
+	return messages, nil
+}
+
+// nextModSeq incrementa a sequência de modificação da caixa que contém a
+// mensagem e retorna o novo valor
+func (s *PostgresStorage) nextModSeq(tx *sql.Tx, messageID int64) (uint64, error) {
+	var modseq uint64
+	err := tx.QueryRow(
+		`UPDATE mailboxes SET highest_modseq = highest_modseq + 1
+		WHERE id = (SELECT mailbox_id FROM messages WHERE id = $1) RETURNING highest_modseq`,
+		messageID,
+	).Scan(&modseq)
+	if err == sql.ErrNoRows {
+		return 0, ErrMessageNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("falha ao atualizar sequência de modificação: %w", err)
+	}
+	return modseq, nil
+}
+
+func (s *PostgresStorage) UpdateMessageFlags(messageID int64, flags string, seen, deleted, draft bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	modseq, err := s.nextModSeq(tx, messageID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET flags = $1, seen = $2, deleted = $3, draft = $4, modseq = $5 WHERE id = $6",
+		flags, seen, deleted, draft, modseq, messageID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar flags da mensagem: %w", err)
+	}
+	return tx.Commit()
+}
+
+// DeleteMessage remove a mensagem, registrando seu UID no log de remoções
+func (s *PostgresStorage) DeleteMessage(messageID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	modseq, err := s.nextModSeq(tx, messageID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO expunged_messages (mailbox_id, uid, message_id, modseq)
+		SELECT mailbox_id, uid, id, $1 FROM messages WHERE id = $2
+		ON CONFLICT (mailbox_id, uid) DO UPDATE SET message_id = excluded.message_id, modseq = excluded.modseq`,
+		modseq, messageID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar remoção da mensagem: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM messages WHERE id = $1", messageID); err != nil {
+		return fmt.Errorf("falha ao excluir mensagem: %w", err)
+	}
+	return tx.Commit()
+}
+
+// MoveMessage move a mensagem para outra caixa, registrando a remoção do UID
+// na origem e atribuindo um novo UID e sequência de modificação no destino
+func (s *PostgresStorage) MoveMessage(messageID, mailboxID int64) error {
+	_, err := s.MoveMessages([]int64{messageID}, mailboxID)
+	return err
+}
+
+// MoveMessages move as mensagens para outra caixa em uma única transação e
+// retorna os UIDs atribuídos no destino, na mesma ordem
+func (s *PostgresStorage) MoveMessages(messageIDs []int64, mailboxID int64) ([]uint32, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	uids := make([]uint32, len(messageIDs))
+	for i, messageID := range messageIDs {
+		if uids[i], err = s.moveMessage(tx, messageID, mailboxID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("falha ao mover mensagens: %w", err)
+	}
+	return uids, nil
+}
+
+func (s *PostgresStorage) moveMessage(tx *sql.Tx, messageID, mailboxID int64) (uint32, error) {
+	modseq, err := s.nextModSeq(tx, messageID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO expunged_messages (mailbox_id, uid, message_id, modseq)
+		SELECT mailbox_id, uid, id, $1 FROM messages WHERE id = $2
+		ON CONFLICT (mailbox_id, uid) DO UPDATE SET message_id = excluded.message_id, modseq = excluded.modseq`,
+		modseq, messageID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("falha ao registrar remoção da mensagem: %w", err)
+	}
+
+	var uid uint32
+	err = tx.QueryRow(
+		`UPDATE mailboxes SET uid_next = uid_next + 1, highest_modseq = highest_modseq + 1
+		WHERE id = $1 RETURNING uid_next - 1, highest_modseq`,
+		mailboxID,
+	).Scan(&uid, &modseq)
+	if err == sql.ErrNoRows {
+		return 0, ErrMailboxNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("falha ao obter próximo UID: %w", err)
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET mailbox_id = $1, uid = $2, modseq = $3 WHERE id = $4",
+		mailboxID, uid, modseq, messageID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("falha ao mover mensagem: %w", err)
+	}
+	return uid, nil
+}
+
+func (s *PostgresStorage) ListExpunged(mailboxID int64, sinceModSeq uint64) ([]uint32, error) {
+	rows, err := s.db.Query(
+		"SELECT uid FROM expunged_messages WHERE mailbox_id = $1 AND modseq > $2 ORDER BY uid",
+		mailboxID, sinceModSeq,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens removidas: %w", err)
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, fmt.Errorf("falha ao ler mensagem removida: %w", err)
+		}
+		uids = append(uids, uid)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens removidas: %w", err)
+	}
+
+	return uids, nil
+}
+
+func (s *PostgresStorage) ListExpungedMessages(mailboxID int64, sinceModSeq uint64) ([]*ExpungedMessage, error) {
+	rows, err := s.db.Query(
+		"SELECT uid, message_id, modseq FROM expunged_messages WHERE mailbox_id = $1 AND modseq > $2 ORDER BY uid",
+		mailboxID, sinceModSeq,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens removidas: %w", err)
+	}
+	defer rows.Close()
+
+	var expunged []*ExpungedMessage
+	for rows.Next() {
+		e := &ExpungedMessage{}
+		if err := rows.Scan(&e.UID, &e.MessageID, &e.ModSeq); err != nil {
+			return nil, fmt.Errorf("falha ao ler mensagem removida: %w", err)
+		}
+		expunged = append(expunged, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens removidas: %w", err)
+	}
+
+	return expunged, nil
+}
+
+// Implementações de contadores de caixa
+
+// GetMailboxCounters calcula os contadores da caixa em uma única consulta
+func (s *PostgresStorage) GetMailboxCounters(mailboxID int64) (*MailboxCounters, error) {
+	counters := &MailboxCounters{}
+	var firstUnseen sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT COUNT(m.id),
+			COALESCE(SUM(CASE WHEN NOT m.seen THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN m.uid >= mb.recent_uid THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(m.size), 0),
+			MIN(CASE WHEN NOT m.seen THEN m.uid END),
+			mb.uid_next, mb.highest_modseq
+		FROM mailboxes mb LEFT JOIN messages m ON m.mailbox_id = mb.id
+		WHERE mb.id = $1 GROUP BY mb.id, mb.uid_next, mb.highest_modseq`,
+		mailboxID,
+	).Scan(&counters.Messages, &counters.Unseen, &counters.Recent, &counters.Size, &firstUnseen,
+		&counters.UIDNext, &counters.HighestModSeq)
+	if err == sql.ErrNoRows {
+		return nil, ErrMailboxNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao calcular contadores da caixa: %w", err)
+	}
+	counters.FirstUnseen = uint32(firstUnseen.Int64)
+	return counters, nil
+}
+
+func (s *PostgresStorage) ListMessageUIDs(mailboxID int64) ([]uint32, error) {
+	rows, err := s.db.Query("SELECT uid FROM messages WHERE mailbox_id = $1 ORDER BY uid", mailboxID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar UIDs: %w", err)
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, fmt.Errorf("falha ao ler UID: %w", err)
+		}
+		uids = append(uids, uid)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre UIDs: %w", err)
+	}
+
+	return uids, nil
+}
+
+// ClaimRecent avança o marcador de mensagens recentes da caixa. A
+// atualização só vale se o marcador não mudou desde a leitura, garantindo
+// que cada mensagem seja recente para uma única sessão.
+func (s *PostgresStorage) ClaimRecent(mailboxID int64, lastUID uint32) (uint32, error) {
+	for {
+		var first uint32
+		err := s.db.QueryRow("SELECT recent_uid FROM mailboxes WHERE id = $1", mailboxID).Scan(&first)
+		if err == sql.ErrNoRows {
+			return 0, ErrMailboxNotFound
+		} else if err != nil {
+			return 0, fmt.Errorf("falha ao obter mensagens recentes: %w", err)
+		}
+		if first > lastUID {
+			return 0, nil
+		}
+
+		result, err := s.db.Exec(
+			"UPDATE mailboxes SET recent_uid = $1 WHERE id = $2 AND recent_uid = $3",
+			int64(lastUID)+1, mailboxID, first,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("falha ao reivindicar mensagens recentes: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return first, nil
+		}
+	}
+}
+
+// Implementações de Thread
+
+// assignThread define a conversa da mensagem pelos identificadores de
+// References, In-Reply-To e Message-ID já vistos pelo usuário. Sem
+// correspondência, uma resposta entra na conversa mais recente de mesmo
+// assunto base. Conversas ligadas pela nova mensagem são unidas na mais antiga.
+func (s *PostgresStorage) assignThread(tx *sql.Tx, userID int64, message *Message) error {
+	refs := threadReferences(message)
+	subject, reply := threadSubject(message.Subject)
+
+	var threads []int64
+	for _, ref := range refs {
+		var threadID int64
+		err := tx.QueryRow(
+			"SELECT thread_id FROM thread_refs WHERE user_id = $1 AND message_id = $2",
+			userID, ref,
+		).Scan(&threadID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("falha ao buscar conversa: %w", err)
+		}
+		if message.ThreadID == 0 || threadID < message.ThreadID {
+			message.ThreadID = threadID
+		}
+		threads = append(threads, threadID)
+	}
+
+	if message.ThreadID == 0 && subject != "" && (reply || message.InReplyTo != "" || message.References != "") {
+		err := tx.QueryRow(
+			"SELECT id FROM threads WHERE user_id = $1 AND subject = $2 ORDER BY updated DESC LIMIT 1",
+			userID, subject,
+		).Scan(&message.ThreadID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("falha ao buscar conversa: %w", err)
+		}
+	}
+
+	if message.ThreadID == 0 {
+		err := tx.QueryRow(
+			"INSERT INTO threads (user_id, subject, created, updated) VALUES ($1, $2, $3, $4) RETURNING id",
+			userID, subject, message.Created, message.Created,
+		).Scan(&message.ThreadID)
+		if err != nil {
+			return fmt.Errorf("falha ao criar conversa: %w", err)
+		}
+	} else {
+		for _, threadID := range threads {
+			if threadID == message.ThreadID {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE messages SET thread_id = $1 WHERE thread_id = $2", message.ThreadID, threadID); err != nil {
+				return fmt.Errorf("falha ao unir conversas: %w", err)
+			}
+			if _, err := tx.Exec("UPDATE thread_refs SET thread_id = $1 WHERE thread_id = $2", message.ThreadID, threadID); err != nil {
+				return fmt.Errorf("falha ao unir conversas: %w", err)
+			}
+			if _, err := tx.Exec("DELETE FROM threads WHERE id = $1", threadID); err != nil {
+				return fmt.Errorf("falha ao unir conversas: %w", err)
+			}
+		}
+		if _, err := tx.Exec("UPDATE threads SET updated = $1 WHERE id = $2", message.Created, message.ThreadID); err != nil {
+			return fmt.Errorf("falha ao atualizar conversa: %w", err)
+		}
+	}
+
+	for _, ref := range refs {
+		_, err := tx.Exec(
+			"INSERT INTO thread_refs (user_id, message_id, thread_id) VALUES ($1, $2, $3) ON CONFLICT (user_id, message_id) DO NOTHING",
+			userID, ref, message.ThreadID,
+		)
+		if err != nil {
+			return fmt.Errorf("falha ao registrar conversa: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *PostgresStorage) ListThreads(userID int64) ([]*Thread, error) {
+	rows, err := s.db.Query(
+		`SELECT `+threadColumns+` FROM threads t JOIN messages m ON m.thread_id = t.id
+		WHERE t.user_id = $1 GROUP BY t.id, t.user_id, t.subject, t.created, t.updated ORDER BY t.updated DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar conversas: %w", err)
+	}
+	defer rows.Close()
+
+	var threads []*Thread
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre conversas: %w", err)
+	}
+
+	return threads, nil
+}
+
+func (s *PostgresStorage) GetThread(userID, threadID int64) ([]*Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		WHERE thread_id = $1 AND mailbox_id IN (SELECT id FROM mailboxes WHERE user_id = $2) ORDER BY date, id`,
+		threadID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao obter conversa: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens: %w", err)
+	}
+
+	if len(messages) == 0 {
+		return nil, ErrThreadNotFound
+	}
+	return messages, nil
+}
+
+// Implementações de Attachment
+
+func (s *PostgresStorage) CreateAttachment(attachment *Attachment) error {
+	attachment.Created = time.Now()
+	var id int64
+	err := s.db.QueryRow(
+		"INSERT INTO attachments (message_id, filename, mime_type, data, size, created) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+		attachment.MessageID, attachment.Filename, attachment.MimeType, attachment.Data, attachment.Size, attachment.Created,
+	).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("falha ao criar anexo: %w", err)
+	}
+	attachment.ID = id
+	return nil
+}
+
+func (s *PostgresStorage) GetAttachments(messageID int64) ([]*Attachment, error) {
+	rows, err := s.db.Query(
+		"SELECT id, message_id, filename, mime_type, data, size, created FROM attachments WHERE message_id = $1",
+		messageID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao obter anexos: %w", err)
+	}
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		att := &Attachment{}
+		if err := rows.Scan(&att.ID, &att.MessageID, &att.Filename, &att.MimeType, &att.Data, &att.Size, &att.Created); err != nil {
+			return nil, fmt.Errorf("falha ao ler dados do anexo: %w", err)
+		}
+		attachments = append(attachments, att)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre anexos: %w", err)
+	}
+
+	return attachments, nil
+}
+
+func (s *PostgresStorage) DeleteAttachment(attachmentID int64) error {
+	_, err := s.db.Exec("DELETE FROM attachments WHERE id = $1", attachmentID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir anexo: %w", err)
+	}
+	return nil
+}
+
+// Implementações de cota
+
+// GetUserUsage soma o tamanho e a quantidade das mensagens do usuário
+func (s *PostgresStorage) GetUserUsage(userID int64) (*Usage, error) {
+	usage := &Usage{}
+	err := s.db.QueryRow(
+		`SELECT COALESCE(SUM(m.size), 0), COUNT(m.id) FROM messages m
+		JOIN mailboxes mb ON mb.id = m.mailbox_id WHERE mb.user_id = $1`,
+		userID,
+	).Scan(&usage.Bytes, &usage.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao calcular uso do usuário: %w", err)
+	}
+	return usage, nil
+}
+
+// GetDomainUsage soma o tamanho e a quantidade das mensagens de todos os
+// usuários do domínio
+func (s *PostgresStorage) GetDomainUsage(domainID int64) (*Usage, error) {
+	usage := &Usage{}
+	err := s.db.QueryRow(
+		`SELECT COALESCE(SUM(m.size), 0), COUNT(m.id) FROM messages m
+		JOIN mailboxes mb ON mb.id = m.mailbox_id
+		JOIN users u ON u.id = mb.user_id WHERE u.domain_id = $1`,
+		domainID,
+	).Scan(&usage.Bytes, &usage.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao calcular uso do domínio: %w", err)
+	}
+	return usage, nil
+}
+
+// Implementações de Alias
+
+func (s *PostgresStorage) CreateAlias(alias *Alias) error {
+	alias.Created = time.Now()
+	var id int64
+	err := s.db.QueryRow(
+		"INSERT INTO aliases (address, user_id, targets, created) VALUES ($1, $2, $3, $4) RETURNING id",
+		strings.ToLower(alias.Address), nullInt64(alias.UserID), alias.Targets, alias.Created,
+	).Scan(&id)
+	if err != nil {
+		return fmt.Errorf("falha ao criar alias: %w", err)
+	}
+	alias.ID = id
+	return nil
+}
+
+func (s *PostgresStorage) GetAlias(address string) (*Alias, error) {
+	alias := &Alias{}
+	var userID sql.NullInt64
+	var targets sql.NullString
+	err := s.db.QueryRow(
+		"SELECT id, address, user_id, targets, created FROM aliases WHERE address = $1",
+		strings.ToLower(address),
+	).Scan(&alias.ID, &alias.Address, &userID, &targets, &alias.Created)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrAliasNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter alias: %w", err)
+	}
+	alias.UserID = userID.Int64
+	alias.Targets = targets.String
+
+	return alias, nil
+}
+
+func (s *PostgresStorage) ListAliases() ([]*Alias, error) {
+	rows, err := s.db.Query("SELECT id, address, user_id, targets, created FROM aliases ORDER BY address")
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar aliases: %w", err)
+	}
+	defer rows.Close()
+
+	var aliases []*Alias
+	for rows.Next() {
+		alias := &Alias{}
+		var userID sql.NullInt64
+		var targets sql.NullString
+		if err := rows.Scan(&alias.ID, &alias.Address, &userID, &targets, &alias.Created); err != nil {
+			return nil, fmt.Errorf("falha ao ler dados do alias: %w", err)
+		}
+		alias.UserID = userID.Int64
+		alias.Targets = targets.String
+		aliases = append(aliases, alias)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre aliases: %w", err)
+	}
+
+	return aliases, nil
+}
+
+func (s *PostgresStorage) DeleteAlias(aliasID int64) error {
+	_, err := s.db.Exec("DELETE FROM aliases WHERE id = $1", aliasID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir alias: %w", err)
+	}
+	return nil
+}
+
+// Implementações de Forwarding
+
+// SetForwarding cria ou substitui o encaminhamento de um usuário
+func (s *PostgresStorage) SetForwarding(forwarding *Forwarding) error {
+	forwarding.Updated = time.Now()
+	_, err := s.db.Exec(
+		`INSERT INTO forwardings (user_id, targets, keep_copy, enabled, updated) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE SET targets = excluded.targets, keep_copy = excluded.keep_copy,
+		enabled = excluded.enabled, updated = excluded.updated`,
+		forwarding.UserID, forwarding.Targets, forwarding.KeepCopy, forwarding.Enabled, forwarding.Updated,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao salvar encaminhamento: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetForwarding(userID int64) (*Forwarding, error) {
+	forwarding := &Forwarding{}
+	err := s.db.QueryRow(
+		"SELECT user_id, targets, keep_copy, enabled, updated FROM forwardings WHERE user_id = $1",
+		userID,
+	).Scan(&forwarding.UserID, &forwarding.Targets, &forwarding.KeepCopy, &forwarding.Enabled, &forwarding.Updated)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrForwardingNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter encaminhamento: %w", err)
+	}
+
+	return forwarding, nil
+}
+
+func (s *PostgresStorage) DeleteForwarding(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM forwardings WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir encaminhamento: %w", err)
+	}
+	return nil
+}
+
+// InitSetting grava a configuração se ela ainda não existir e retorna o
+// valor armazenado, que pode ter sido gravado antes por outro processo
+func (s *PostgresStorage) InitSetting(name, value string) (string, error) {
+	if _, err := s.db.Exec(
+		"INSERT INTO settings (name, value) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING",
+		name, value,
+	); err != nil {
+		return "", fmt.Errorf("falha ao gravar configuração %s: %w", name, err)
+	}
+	var stored string
+	if err := s.db.QueryRow("SELECT value FROM settings WHERE name = $1", name).Scan(&stored); err != nil {
+		return "", fmt.Errorf("falha ao obter configuração %s: %w", name, err)
+	}
+	return stored, nil
+}
+
+// Implementações da fila de entrega externa
+
+// EnqueueOutbound grava uma mensagem na fila de entrega externa
+func (s *PostgresStorage) EnqueueOutbound(msg *OutboundMessage) error {
+	if msg.Created.IsZero() {
+		msg.Created = time.Now()
+	}
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = msg.Created
+	}
+	var id int64
+	err := s.db.QueryRow(
+		`INSERT INTO outbound_queue (queue_id, sender, recipients, dsn, message_id, data, delayed, attempts, next_attempt, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		msg.QueueID, msg.Sender, joinAddressList(msg.Recipients), msg.DSN, msg.MessageID, msg.Data,
+		joinAddressList(msg.Delayed), msg.Attempts, msg.NextAttempt, msg.Created,
+	).Scan(&id)
 	if err != nil {
-		return fmt.Errorf("falha ao excluir anexo: %w", err)
+		return fmt.Errorf("falha ao enfileirar mensagem para entrega externa: %w", err)
+	}
+	msg.ID = id
+	return nil
+}
+
+func (s *PostgresStorage) PendingOutbound(now time.Time, limit int) ([]*OutboundMessage, error) {
+	rows, err := s.db.Query(
+		"SELECT "+outboundColumns+" FROM outbound_queue WHERE next_attempt <= $1 ORDER BY id LIMIT $2",
+		now, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar fila de entrega externa: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*OutboundMessage
+	for rows.Next() {
+		msg, err := scanOutbound(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre fila de entrega externa: %w", err)
+	}
+	return messages, nil
+}
+
+// UpdateOutbound grava o estado da mensagem após uma tentativa de entrega
+func (s *PostgresStorage) UpdateOutbound(msg *OutboundMessage) error {
+	_, err := s.db.Exec(
+		"UPDATE outbound_queue SET recipients = $1, delayed = $2, attempts = $3, next_attempt = $4 WHERE id = $5",
+		joinAddressList(msg.Recipients), joinAddressList(msg.Delayed), msg.Attempts, msg.NextAttempt, msg.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar mensagem na fila de entrega externa: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteOutbound(id int64) error {
+	_, err := s.db.Exec("DELETE FROM outbound_queue WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("falha ao remover mensagem da fila de entrega externa: %w", err)
+	}
+	return nil
+}
+
+// Implementações de Vacation
+
+// SetVacation cria ou substitui a resposta de ausência de um usuário
+func (s *PostgresStorage) SetVacation(vacation *Vacation) error {
+	vacation.Updated = time.Now()
+	_, err := s.db.Exec(
+		`INSERT INTO vacations (user_id, enabled, subject, body, start_date, end_date, addresses, days, updated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (user_id) DO UPDATE SET enabled = excluded.enabled, subject = excluded.subject,
+		body = excluded.body, start_date = excluded.start_date, end_date = excluded.end_date,
+		addresses = excluded.addresses, days = excluded.days, updated = excluded.updated`,
+		vacation.UserID, vacation.Enabled, vacation.Subject, vacation.Body, nullTime(vacation.Start),
+		nullTime(vacation.End), vacation.Addresses, vacation.Days, vacation.Updated,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao salvar resposta de ausência: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) GetVacation(userID int64) (*Vacation, error) {
+	return scanVacation(s.db.QueryRow("SELECT "+vacationColumns+" FROM vacations WHERE user_id = $1", userID))
+}
+
+func (s *PostgresStorage) DeleteVacation(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM vacations WHERE user_id = $1", userID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir resposta de ausência: %w", err)
+	}
+	return nil
+}
+
+// LastVacationReply retorna quando o remetente recebeu a última resposta com
+// o identificador informado, ou a data zero se nunca recebeu
+func (s *PostgresStorage) LastVacationReply(userID int64, sender, handle string) (time.Time, error) {
+	var sent time.Time
+	err := s.db.QueryRow(
+		"SELECT sent FROM vacation_replies WHERE user_id = $1 AND sender = $2 AND handle = $3",
+		userID, sender, handle,
+	).Scan(&sent)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("falha ao obter registro de resposta de ausência: %w", err)
+	}
+	return sent, nil
+}
+
+func (s *PostgresStorage) RecordVacationReply(userID int64, sender, handle string, sent time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO vacation_replies (user_id, sender, handle, sent) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, sender, handle) DO UPDATE SET sent = excluded.sent`,
+		userID, sender, handle, sent,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar resposta de ausência: %w", err)
+	}
+	return nil
+}
+
+// Implementações de SieveScript
+
+// PutSieveScript cria ou atualiza o conteúdo de um script, preservando seu estado de ativação
+func (s *PostgresStorage) PutSieveScript(script *SieveScript) error {
+	now := time.Now()
+	err := s.db.QueryRow(
+		`INSERT INTO sieve_scripts (user_id, name, content, active, created, updated) VALUES ($1, $2, $3, FALSE, $4, $5)
+		ON CONFLICT (user_id, name) DO UPDATE SET content = excluded.content, updated = excluded.updated
+		RETURNING id, active, created`,
+		script.UserID, script.Name, script.Content, now, now,
+	).Scan(&script.ID, &script.Active, &script.Created)
+	if err != nil {
+		return fmt.Errorf("falha ao salvar script sieve: %w", err)
+	}
+	script.Updated = now
+	return nil
+}
+
+func (s *PostgresStorage) GetSieveScript(userID int64, name string) (*SieveScript, error) {
+	return scanSieveScript(s.db.QueryRow(
+		"SELECT "+sieveScriptColumns+" FROM sieve_scripts WHERE user_id = $1 AND name = $2",
+		userID, name,
+	))
+}
+
+func (s *PostgresStorage) GetActiveSieveScript(userID int64) (*SieveScript, error) {
+	return scanSieveScript(s.db.QueryRow(
+		"SELECT "+sieveScriptColumns+" FROM sieve_scripts WHERE user_id = $1 AND active",
+		userID,
+	))
+}
+
+func (s *PostgresStorage) ListSieveScripts(userID int64) ([]*SieveScript, error) {
+	rows, err := s.db.Query(
+		"SELECT "+sieveScriptColumns+" FROM sieve_scripts WHERE user_id = $1 ORDER BY name",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar scripts sieve: %w", err)
+	}
+	defer rows.Close()
+
+	var scripts []*SieveScript
+	for rows.Next() {
+		script, err := scanSieveScript(rows)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre scripts sieve: %w", err)
+	}
+
+	return scripts, nil
+}
+
+// SetActiveSieveScript ativa o script informado e desativa os demais; um
+// nome vazio desativa todos os scripts do usuário
+func (s *PostgresStorage) SetActiveSieveScript(userID int64, name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE sieve_scripts SET active = FALSE WHERE user_id = $1", userID); err != nil {
+		return fmt.Errorf("falha ao desativar scripts sieve: %w", err)
+	}
+
+	if name != "" {
+		result, err := tx.Exec("UPDATE sieve_scripts SET active = TRUE WHERE user_id = $1 AND name = $2", userID, name)
+		if err != nil {
+			return fmt.Errorf("falha ao ativar script sieve: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrSieveScriptNotFound
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RenameSieveScript altera o nome de um script, mantendo conteúdo e ativação
+func (s *PostgresStorage) RenameSieveScript(userID int64, oldName, newName string) error {
+	if _, err := s.GetSieveScript(userID, newName); err == nil {
+		return ErrSieveScriptExists
+	} else if !errors.Is(err, ErrSieveScriptNotFound) {
+		return err
+	}
+
+	result, err := s.db.Exec(
+		"UPDATE sieve_scripts SET name = $1, updated = $2 WHERE user_id = $3 AND name = $4",
+		newName, time.Now(), userID, oldName,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao renomear script sieve: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSieveScriptNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteSieveScript(userID int64, name string) error {
+	result, err := s.db.Exec("DELETE FROM sieve_scripts WHERE user_id = $1 AND name = $2", userID, name)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir script sieve: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSieveScriptNotFound
+	}
+	return nil
+}
+
+// Implementações de EmailSubmission
+
+// CreateEmailSubmission registra um envio JMAP
+func (s *PostgresStorage) CreateEmailSubmission(submission *EmailSubmission) error {
+	if submission.SendAt.IsZero() {
+		submission.SendAt = time.Now()
+	}
+	err := s.db.QueryRow(
+		`INSERT INTO email_submissions (user_id, message_id, thread_id, mail_from, recipients, queue_id, send_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id`,
+		submission.UserID, submission.MessageID, submission.ThreadID, submission.MailFrom,
+		joinAddressList(submission.Recipients), submission.QueueID, submission.SendAt,
+	).Scan(&submission.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar envio: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListEmailSubmissions(userID int64) ([]*EmailSubmission, error) {
+	rows, err := s.db.Query(
+		"SELECT "+emailSubmissionColumns+" FROM email_submissions WHERE user_id = $1 ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar envios: %w", err)
+	}
+	defer rows.Close()
+
+	var submissions []*EmailSubmission
+	for rows.Next() {
+		submission, err := scanEmailSubmission(rows)
+		if err != nil {
+			return nil, err
+		}
+		submissions = append(submissions, submission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre envios: %w", err)
+	}
+	return submissions, nil
+}
+
+// Implementações do histórico de entregas
+
+// RecordDelivery acrescenta um registro ao histórico de entregas
+func (s *PostgresStorage) RecordDelivery(record *DeliveryRecord) error {
+	if record.Created.IsZero() {
+		record.Created = time.Now()
+	}
+	err := s.db.QueryRow(
+		`INSERT INTO deliveries (queue_id, message_id, sender, recipient, status, remote_host, detail, attempts, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		record.QueueID, record.MessageID, record.Sender, strings.ToLower(record.Recipient), record.Status,
+		record.RemoteHost, record.Detail, record.Attempts, record.Created,
+	).Scan(&record.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar entrega: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListDeliveries(query string, limit int) ([]*DeliveryRecord, error) {
+	var rows *sql.Rows
+	var err error
+	if query == "" {
+		rows, err = s.db.Query("SELECT "+deliveryColumns+" FROM deliveries ORDER BY id DESC LIMIT $1", limit)
+	} else {
+		args := append(deliveryQueryArgs(query), limit)
+		rows, err = s.db.Query(
+			"SELECT "+deliveryColumns+" FROM deliveries WHERE queue_id = $1 OR message_id IN ($2, $3) OR LOWER(sender) = $4 OR recipient = $5 ORDER BY id DESC LIMIT $6",
+			args...,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar entregas: %w", err)
+	}
+	defer rows.Close()
+
+	var records []*DeliveryRecord
+	for rows.Next() {
+		record, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre entregas: %w", err)
+	}
+
+	// A consulta parte dos registros mais recentes; o resultado segue a ordem
+	// em que as entregas ocorreram
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Implementações da fila de webhooks
+
+// EnqueueWebhook grava um evento na fila de webhooks
+func (s *PostgresStorage) EnqueueWebhook(event *WebhookEvent) error {
+	event.Created = time.Now()
+	if event.NextAttempt.IsZero() {
+		event.NextAttempt = event.Created
+	}
+	err := s.db.QueryRow(
+		`INSERT INTO webhook_outbox (event_id, hook, payload, attempts, next_attempt, created)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		event.EventID, event.Hook, event.Payload, event.Attempts, event.NextAttempt, event.Created,
+	).Scan(&event.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao enfileirar webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) PendingWebhooks(now time.Time, limit int) ([]*WebhookEvent, error) {
+	rows, err := s.db.Query(
+		"SELECT "+webhookEventColumns+" FROM webhook_outbox WHERE next_attempt <= $1 ORDER BY id LIMIT $2",
+		now, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar webhooks pendentes: %w", err)
+	}
+	defer rows.Close()
+
+	var events []*WebhookEvent
+	for rows.Next() {
+		event, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre webhooks pendentes: %w", err)
+	}
+	return events, nil
+}
+
+// RescheduleWebhook agenda uma nova tentativa do evento
+func (s *PostgresStorage) RescheduleWebhook(eventID int64, attempts int, next time.Time) error {
+	_, err := s.db.Exec("UPDATE webhook_outbox SET attempts = $1, next_attempt = $2 WHERE id = $3", attempts, next, eventID)
+	if err != nil {
+		return fmt.Errorf("falha ao reagendar webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) DeleteWebhook(eventID int64) error {
+	_, err := s.db.Exec("DELETE FROM webhook_outbox WHERE id = $1", eventID)
+	if err != nil {
+		return fmt.Errorf("falha ao remover webhook da fila: %w", err)
+	}
+	return nil
+}
+
+// RecordWebhookDelivery acrescenta uma tentativa ao histórico de webhooks
+func (s *PostgresStorage) RecordWebhookDelivery(delivery *WebhookDelivery) error {
+	if delivery.Created.IsZero() {
+		delivery.Created = time.Now()
+	}
+	err := s.db.QueryRow(
+		`INSERT INTO webhook_deliveries (event_id, hook, url, status, status_code, detail, attempt, created)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		delivery.EventID, delivery.Hook, delivery.URL, delivery.Status, delivery.StatusCode, delivery.Detail,
+		delivery.Attempt, delivery.Created,
+	).Scan(&delivery.ID)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar chamada de webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresStorage) ListWebhookDeliveries(query string, limit int) ([]*WebhookDelivery, error) {
+	var rows *sql.Rows
+	var err error
+	if query == "" {
+		rows, err = s.db.Query("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries ORDER BY id DESC LIMIT $1", limit)
+	} else {
+		rows, err = s.db.Query(
+			"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE hook = $1 OR event_id = $2 ORDER BY id DESC LIMIT $3",
+			query, query, limit,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar chamadas de webhook: %w", err)
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre chamadas de webhook: %w", err)
+	}
+
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	return deliveries, nil
+}
+
+// Implementações do classificador bayesiano
+
+// GetBayesStats retorna o número de mensagens treinadas no classificador
+func (s *PostgresStorage) GetBayesStats(userID int64) (*BayesStats, error) {
+	stats := &BayesStats{}
+	err := s.db.QueryRow("SELECT spam, ham FROM bayes_stats WHERE user_id = $1", userID).Scan(&stats.Spam, &stats.Ham)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("falha ao obter estatísticas do classificador: %w", err)
+	}
+	return stats, nil
+}
+
+// GetBayesTokens retorna as contagens dos tokens conhecidos pelo
+// classificador; tokens nunca vistos não aparecem no resultado
+func (s *PostgresStorage) GetBayesTokens(userID int64, tokens []string) (map[string]*BayesToken, error) {
+	result := make(map[string]*BayesToken)
+	for start := 0; start < len(tokens); start += bayesBatchSize {
+		end := start + bayesBatchSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		batch := tokens[start:end]
+		rows, err := s.db.Query(
+			"SELECT token, spam, ham FROM bayes_tokens WHERE user_id = $1 AND token = ANY($2)",
+			userID, pq.Array(batch),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao consultar tokens do classificador: %w", err)
+		}
+		for rows.Next() {
+			token := &BayesToken{}
+			if err := rows.Scan(&token.Token, &token.Spam, &token.Ham); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("falha ao ler token do classificador: %w", err)
+			}
+			result[token.Token] = token
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("erro ao iterar sobre tokens do classificador: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// TrainBayes treina o classificador com a mensagem
+func (s *PostgresStorage) TrainBayes(userID int64, digest string, tokens []string, spam bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previous bool
+	err = tx.QueryRow("SELECT spam FROM bayes_trained WHERE user_id = $1 AND digest = $2", userID, digest).Scan(&previous)
+	switch {
+	case err == nil && previous == spam:
+		return nil
+	case err == nil:
+		if err := s.countBayes(tx, userID, tokens, previous, -1); err != nil {
+			return err
+		}
+	case err != sql.ErrNoRows:
+		return fmt.Errorf("falha ao consultar treino do classificador: %w", err)
+	}
+
+	if err := s.countBayes(tx, userID, tokens, spam, 1); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO bayes_trained (user_id, digest, spam) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, digest) DO UPDATE SET spam = excluded.spam`,
+		userID, digest, spam,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar treino do classificador: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// countBayes soma delta às contagens da classe para a mensagem e seus tokens
+func (s *PostgresStorage) countBayes(tx *sql.Tx, userID int64, tokens []string, spam bool, delta int) error {
+	column := bayesColumn(spam)
+	_, err := tx.Exec("INSERT INTO bayes_stats (user_id, spam, ham) VALUES ($1, 0, 0) ON CONFLICT (user_id) DO NOTHING", userID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE bayes_stats SET "+column+" = GREATEST("+column+" + $1, 0) WHERE user_id = $2", delta, userID)
+	}
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar estatísticas do classificador: %w", err)
+	}
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO bayes_tokens (user_id, token, spam, ham) VALUES ($1, $2, 0, 0) ON CONFLICT (user_id, token) DO NOTHING`,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao preparar atualização de tokens: %w", err)
+	}
+	defer stmt.Close()
+	update, err := tx.Prepare("UPDATE bayes_tokens SET " + column + " = GREATEST(" + column + " + $1, 0) WHERE user_id = $2 AND token = $3")
+	if err != nil {
+		return fmt.Errorf("falha ao preparar atualização de tokens: %w", err)
+	}
+	defer update.Close()
+
+	for _, token := range tokens {
+		if delta > 0 {
+			if _, err := stmt.Exec(userID, token); err != nil {
+				return fmt.Errorf("falha ao atualizar token do classificador: %w", err)
+			}
+		}
+		if _, err := update.Exec(delta, userID, token); err != nil {
+			return fmt.Errorf("falha ao atualizar token do classificador: %w", err)
+		}
+	}
+
+	if delta < 0 {
+		_, err := tx.Exec("DELETE FROM bayes_tokens WHERE user_id = $1 AND spam = 0 AND ham = 0", userID)
+		if err != nil {
+			return fmt.Errorf("falha ao remover tokens do classificador: %w", err)
+		}
 	}
 	return nil
-} 
\ No newline at end of file
+}
@@ -1,11 +1,15 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/carloslauriano/simpleEmail/config"
 	_ "github.com/mattn/go-sqlite3"
@@ -32,7 +36,14 @@ func NewSQLiteStorage(cfg *config.DatabaseConfig) (Storage, error) {
 
 // Open abre a conexão com o banco de dados
 func (s *SQLiteStorage) Open() error {
-	db, err := sql.Open("sqlite3", s.path)
+	// O SQLite desliga as chaves estrangeiras por padrão, e o PRAGMA vale só
+	// para a conexão em que é executado; pelo DSN, o driver o aplica a cada
+	// nova conexão do pool, o que ativa as exclusões em cascata
+	dsn := s.path + "?_foreign_keys=on"
+	if strings.Contains(s.path, "?") {
+		dsn = s.path + "&_foreign_keys=on"
+	}
+	db, err := sql.Open("sqlite3", dsn)
 	if err != nil {
 		return fmt.Errorf("falha ao abrir banco de dados SQLite: %w", err)
 	}
@@ -42,6 +53,10 @@ func (s *SQLiteStorage) Open() error {
 		s.db.Close()
 		return fmt.Errorf("falha ao criar esquema SQLite: %w", err)
 	}
+	if err := s.migrate(); err != nil {
+		s.db.Close()
+		return fmt.Errorf("falha ao migrar esquema SQLite: %w", err)
+	}
 
 	return nil
 }
@@ -57,14 +72,36 @@ func (s *SQLiteStorage) Close() error {
 // createSchema cria o esquema do banco de dados
 func (s *SQLiteStorage) createSchema() error {
 	schema := `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		applied DATETIME NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS domains (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		catch_all TEXT,
+		quota_bytes INTEGER NOT NULL DEFAULT 0,
+		quota_messages INTEGER NOT NULL DEFAULT 0,
+		dkim_selector TEXT,
+		dkim_private_key TEXT,
+		created DATETIME NOT NULL,
+		updated DATETIME NOT NULL
+	);
+
 	CREATE TABLE IF NOT EXISTS users (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		username TEXT NOT NULL UNIQUE,
+		domain_id INTEGER NOT NULL DEFAULT 0,
+		username TEXT NOT NULL,
 		password TEXT NOT NULL,
 		name TEXT,
 		email TEXT NOT NULL UNIQUE,
+		quota_bytes INTEGER NOT NULL DEFAULT 0,
+		quota_messages INTEGER NOT NULL DEFAULT 0,
 		created DATETIME NOT NULL,
-		updated DATETIME NOT NULL
+		updated DATETIME NOT NULL,
+		UNIQUE(domain_id, username)
 	);
 
 	CREATE TABLE IF NOT EXISTS mailboxes (
@@ -72,10 +109,48 @@ func (s *SQLiteStorage) createSchema() error {
 		user_id INTEGER NOT NULL,
 		name TEXT NOT NULL,
 		path TEXT NOT NULL,
+		special_use TEXT NOT NULL DEFAULT '',
+		noselect BOOLEAN NOT NULL DEFAULT 0,
+		uid_next INTEGER NOT NULL DEFAULT 1,
+		highest_modseq INTEGER NOT NULL DEFAULT 1,
+		recent_uid INTEGER NOT NULL DEFAULT 1,
 		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
 		UNIQUE(user_id, name)
 	);
 
+	CREATE TABLE IF NOT EXISTS subscriptions (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		PRIMARY KEY (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS mailbox_acl (
+		mailbox_id INTEGER NOT NULL,
+		identifier TEXT NOT NULL,
+		rights TEXT NOT NULL,
+		PRIMARY KEY (mailbox_id, identifier),
+		FOREIGN KEY (mailbox_id) REFERENCES mailboxes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS threads (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		subject TEXT NOT NULL,
+		created DATETIME NOT NULL,
+		updated DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS thread_refs (
+		user_id INTEGER NOT NULL,
+		message_id TEXT NOT NULL,
+		thread_id INTEGER NOT NULL,
+		PRIMARY KEY (user_id, message_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (thread_id) REFERENCES threads(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS messages (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		mailbox_id INTEGER NOT NULL,
@@ -84,6 +159,10 @@ func (s *SQLiteStorage) createSchema() error {
 		to_addr TEXT NOT NULL,
 		cc TEXT,
 		subject TEXT,
+		message_id TEXT NOT NULL DEFAULT '',
+		in_reply_to TEXT NOT NULL DEFAULT '',
+		refs TEXT NOT NULL DEFAULT '',
+		thread_id INTEGER NOT NULL DEFAULT 0,
 		date DATETIME NOT NULL,
 		body TEXT,
 		raw_data BLOB,
@@ -92,11 +171,21 @@ func (s *SQLiteStorage) createSchema() error {
 		seen BOOLEAN NOT NULL DEFAULT 0,
 		deleted BOOLEAN NOT NULL DEFAULT 0,
 		draft BOOLEAN NOT NULL DEFAULT 0,
+		modseq INTEGER NOT NULL DEFAULT 1,
 		created DATETIME NOT NULL,
 		FOREIGN KEY (mailbox_id) REFERENCES mailboxes(id) ON DELETE CASCADE,
 		UNIQUE(mailbox_id, uid)
 	);
 
+	CREATE TABLE IF NOT EXISTS expunged_messages (
+		mailbox_id INTEGER NOT NULL,
+		uid INTEGER NOT NULL,
+		message_id INTEGER NOT NULL DEFAULT 0,
+		modseq INTEGER NOT NULL,
+		PRIMARY KEY (mailbox_id, uid),
+		FOREIGN KEY (mailbox_id) REFERENCES mailboxes(id) ON DELETE CASCADE
+	);
+
 	CREATE TABLE IF NOT EXISTS attachments (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		message_id INTEGER NOT NULL,
@@ -107,21 +196,400 @@ func (s *SQLiteStorage) createSchema() error {
 		created DATETIME NOT NULL,
 		FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE
 	);
+
+	CREATE TABLE IF NOT EXISTS aliases (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		address TEXT NOT NULL UNIQUE,
+		user_id INTEGER,
+		targets TEXT,
+		created DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS forwardings (
+		user_id INTEGER PRIMARY KEY,
+		targets TEXT NOT NULL,
+		keep_copy BOOLEAN NOT NULL DEFAULT 0,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		updated DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS settings (
+		name TEXT PRIMARY KEY,
+		value TEXT NOT NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS outbound_queue (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue_id TEXT NOT NULL,
+		sender TEXT NOT NULL DEFAULT '',
+		recipients TEXT NOT NULL,
+		dsn BLOB,
+		message_id TEXT NOT NULL DEFAULT '',
+		data BLOB NOT NULL,
+		delayed TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt DATETIME NOT NULL,
+		created DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS outbound_queue_next_attempt ON outbound_queue(next_attempt);
+
+	CREATE TABLE IF NOT EXISTS vacations (
+		user_id INTEGER PRIMARY KEY,
+		enabled BOOLEAN NOT NULL DEFAULT 1,
+		subject TEXT NOT NULL,
+		body TEXT NOT NULL,
+		start_date DATETIME,
+		end_date DATETIME,
+		addresses TEXT NOT NULL DEFAULT '',
+		days INTEGER NOT NULL DEFAULT 7,
+		updated DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS vacation_replies (
+		user_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		handle TEXT NOT NULL,
+		sent DATETIME NOT NULL,
+		PRIMARY KEY (user_id, sender, handle),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS sieve_scripts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		content TEXT NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT 0,
+		created DATETIME NOT NULL,
+		updated DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		UNIQUE(user_id, name)
+	);
+	CREATE TABLE IF NOT EXISTS email_submissions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		message_id INTEGER NOT NULL,
+		thread_id INTEGER NOT NULL DEFAULT 0,
+		mail_from TEXT NOT NULL,
+		recipients TEXT NOT NULL,
+		queue_id TEXT NOT NULL DEFAULT '',
+		send_at DATETIME NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS email_submissions_user_id ON email_submissions(user_id);
+
+	CREATE TABLE IF NOT EXISTS deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		queue_id TEXT NOT NULL,
+		message_id TEXT NOT NULL DEFAULT '',
+		sender TEXT NOT NULL DEFAULT '',
+		recipient TEXT NOT NULL,
+		status TEXT NOT NULL,
+		remote_host TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT '',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		created DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS deliveries_queue_id ON deliveries(queue_id);
+	CREATE INDEX IF NOT EXISTS deliveries_message_id ON deliveries(message_id);
+	CREATE INDEX IF NOT EXISTS deliveries_recipient ON deliveries(recipient);
+
+	CREATE TABLE IF NOT EXISTS webhook_outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		hook TEXT NOT NULL,
+		payload BLOB NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt DATETIME NOT NULL,
+		created DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_outbox_next_attempt ON webhook_outbox(next_attempt);
+
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		event_id TEXT NOT NULL,
+		hook TEXT NOT NULL,
+		url TEXT NOT NULL,
+		status TEXT NOT NULL,
+		status_code INTEGER NOT NULL DEFAULT 0,
+		detail TEXT NOT NULL DEFAULT '',
+		attempt INTEGER NOT NULL,
+		created DATETIME NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_event_id ON webhook_deliveries(event_id);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_hook ON webhook_deliveries(hook);
+
+	CREATE TABLE IF NOT EXISTS bayes_stats (
+		user_id INTEGER PRIMARY KEY,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0
+	);
+
+	CREATE TABLE IF NOT EXISTS bayes_tokens (
+		user_id INTEGER NOT NULL,
+		token TEXT NOT NULL,
+		spam INTEGER NOT NULL DEFAULT 0,
+		ham INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY (user_id, token)
+	);
+
+	CREATE TABLE IF NOT EXISTS bayes_trained (
+		user_id INTEGER NOT NULL,
+		digest TEXT NOT NULL,
+		spam BOOLEAN NOT NULL,
+		PRIMARY KEY (user_id, digest)
+	);
+
 	`
 
 	_, err := s.db.Exec(schema)
 	return err
 }
 
-// CreateUser cria um novo usuário
+// sqliteMigrations atualizam bancos criados antes do suporte a domínios
+// virtuais, cotas, caixas com uso especial, assinaturas, CONDSTORE,
+// conversas e acompanhamento das entregas
+var sqliteMigrations = []migration{
+	{1, "coluna de domínio dos usuários", func(tx *sql.Tx) error {
+		_, err := sqliteAddColumns(tx, "users", "domain_id INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{2, "nome de usuário único por domínio", sqliteMigrateUsersUnique},
+	{3, "colunas de cota dos usuários", func(tx *sql.Tx) error {
+		_, err := sqliteAddColumns(tx, "users",
+			"quota_bytes INTEGER NOT NULL DEFAULT 0",
+			"quota_messages INTEGER NOT NULL DEFAULT 0",
+		)
+		return err
+	}},
+	{4, "colunas de uso especial das caixas", func(tx *sql.Tx) error {
+		_, err := sqliteAddColumns(tx, "mailboxes",
+			"special_use TEXT NOT NULL DEFAULT ''",
+			"noselect BOOLEAN NOT NULL DEFAULT 0",
+		)
+		return err
+	}},
+	{5, "caixas padrão e assinaturas de usuários existentes", sqliteMigrateDefaultMailboxes},
+	{6, "colunas de UIDs e modseq das caixas e mensagens", func(tx *sql.Tx) error {
+		added, err := sqliteAddColumns(tx, "mailboxes",
+			"uid_next INTEGER NOT NULL DEFAULT 1",
+			"highest_modseq INTEGER NOT NULL DEFAULT 1",
+		)
+		if err != nil {
+			return err
+		}
+		// Os UIDs antes eram calculados a partir das mensagens existentes
+		if added["uid_next"] {
+			if _, err := tx.Exec(`UPDATE mailboxes SET uid_next =
+				COALESCE((SELECT MAX(uid) FROM messages WHERE messages.mailbox_id = mailboxes.id), 0) + 1`); err != nil {
+				return err
+			}
+		}
+		_, err = sqliteAddColumns(tx, "messages", "modseq INTEGER NOT NULL DEFAULT 1")
+		return err
+	}},
+	{7, "colunas de cabeçalhos de conversa das mensagens", func(tx *sql.Tx) error {
+		_, err := sqliteAddColumns(tx, "messages",
+			"message_id TEXT NOT NULL DEFAULT ''",
+			"in_reply_to TEXT NOT NULL DEFAULT ''",
+			"refs TEXT NOT NULL DEFAULT ''",
+		)
+		return err
+	}},
+	{8, "coluna de conversa das mensagens", func(tx *sql.Tx) error {
+		_, err := sqliteAddColumns(tx, "messages", "thread_id INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{9, "coluna de mensagens recentes das caixas", func(tx *sql.Tx) error {
+		added, err := sqliteAddColumns(tx, "mailboxes", "recent_uid INTEGER NOT NULL DEFAULT 1")
+		if err != nil || !added["recent_uid"] {
+			return err
+		}
+		// As mensagens existentes já foram vistas pelos clientes
+		_, err = tx.Exec("UPDATE mailboxes SET recent_uid = uid_next")
+		return err
+	}},
+	{10, "id da mensagem nas remoções registradas", func(tx *sql.Tx) error {
+		_, err := sqliteAddColumns(tx, "expunged_messages", "message_id INTEGER NOT NULL DEFAULT 0")
+		return err
+	}},
+	{11, "colunas de acompanhamento das entregas na fila e nos envios JMAP", func(tx *sql.Tx) error {
+		added, err := sqliteAddColumns(tx, "outbound_queue",
+			"queue_id TEXT NOT NULL DEFAULT ''",
+			"dsn BLOB",
+			"message_id TEXT NOT NULL DEFAULT ''",
+			"delayed TEXT NOT NULL DEFAULT ''",
+		)
+		if err != nil {
+			return err
+		}
+		if added["queue_id"] {
+			// Mensagens já enfileiradas recebem um identificador para o
+			// histórico de entregas
+			_, err = tx.Exec("UPDATE outbound_queue SET queue_id = UPPER(HEX(RANDOMBLOB(6)))")
+			if err != nil {
+				return err
+			}
+		}
+		_, err = sqliteAddColumns(tx, "email_submissions", "queue_id TEXT NOT NULL DEFAULT ''")
+		return err
+	}},
+}
+
+// sqliteMigrateDefaultMailboxes cria as caixas padrão e os atributos de uso
+// especial que faltam aos usuários criados antes deles e assina todas as
+// caixas existentes, para que clientes que só usam LSUB continuem a vê-las
+func sqliteMigrateDefaultMailboxes(tx *sql.Tx) error {
+	for _, mailbox := range DefaultMailboxes {
+		if mailbox.SpecialUse != "" {
+			// A caixa com o nome padrão recebe o atributo, se o usuário não o usa em outra
+			if _, err := tx.Exec(
+				`UPDATE mailboxes SET special_use = ? WHERE name = ? AND special_use = ''
+				AND NOT EXISTS (SELECT 1 FROM mailboxes m WHERE m.user_id = mailboxes.user_id AND m.special_use = ?)`,
+				mailbox.SpecialUse, mailbox.Name, mailbox.SpecialUse,
+			); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec(
+			`INSERT INTO mailboxes (user_id, name, path, special_use)
+			SELECT u.id, ?, ?, ? FROM users u WHERE NOT EXISTS (SELECT 1 FROM mailboxes m
+			WHERE m.user_id = u.id AND (m.name = ? OR (? <> '' AND m.special_use = ?)))`,
+			mailbox.Name, mailbox.Name, mailbox.SpecialUse, mailbox.Name, mailbox.SpecialUse, mailbox.SpecialUse,
+		); err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(
+		`INSERT INTO subscriptions (user_id, name) SELECT user_id, name FROM mailboxes WHERE NOT noselect
+		ON CONFLICT (user_id, name) DO NOTHING`,
+	)
+	return err
+}
+
+// migrate aplica as migrações pendentes. As chaves estrangeiras ficam
+// desligadas na conexão usada, pois recriar uma tabela apagaria em cascata
+// as linhas que a referenciam; o PRAGMA não tem efeito dentro de transações.
+func (s *SQLiteStorage) migrate() error {
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	return runMigrations(conn, sqliteMigrations, "INSERT INTO schema_version (version, applied) VALUES (?, ?)")
+}
+
+// sqliteAddColumns adiciona à tabela as colunas, informadas pela definição
+// completa, que ela ainda não possui, e retorna os nomes das adicionadas
+func sqliteAddColumns(tx *sql.Tx, table string, columns ...string) (map[string]bool, error) {
+	rows, err := tx.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		existing[name] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	added := make(map[string]bool)
+	for _, column := range columns {
+		name := strings.Fields(column)[0]
+		if existing[name] {
+			continue
+		}
+		if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column); err != nil {
+			return nil, err
+		}
+		added[name] = true
+	}
+	return added, nil
+}
+
+// sqliteMigrateUsersUnique troca UNIQUE(username) por UNIQUE(domain_id,
+// username). O SQLite não altera restrições, então a tabela é recriada.
+func sqliteMigrateUsersUnique(tx *sql.Tx) error {
+	var table string
+	if err := tx.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'users'").Scan(&table); err != nil {
+		return err
+	}
+	if strings.Contains(table, "UNIQUE(domain_id, username)") {
+		return nil
+	}
+
+	// A tabela é recriada com as colunas existentes nesta versão; colunas
+	// acrescentadas ao esquema depois ganham migrações próprias, aplicadas
+	// em seguida
+	const columns = "id, domain_id, username, password, name, email, created, updated"
+	statements := []string{
+		`CREATE TABLE users_new (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			domain_id INTEGER NOT NULL DEFAULT 0,
+			username TEXT NOT NULL,
+			password TEXT NOT NULL,
+			name TEXT,
+			email TEXT NOT NULL UNIQUE,
+			created DATETIME NOT NULL,
+			updated DATETIME NOT NULL,
+			UNIQUE(domain_id, username)
+		)`,
+		"INSERT INTO users_new (" + columns + ") SELECT " + columns + " FROM users",
+		"DROP TABLE users",
+		"ALTER TABLE users_new RENAME TO users",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateUser cria um novo usuário. Usuários de um domínio virtual recebem o
+// endereço usuario@dominio como email.
 func (s *SQLiteStorage) CreateUser(user *User) error {
+	if user.DomainID != 0 {
+		domain, err := s.GetDomainByID(user.DomainID)
+		if err != nil {
+			return err
+		}
+		user.Email = strings.ToLower(user.Username + "@" + domain.Name)
+	}
+
 	now := time.Now()
 	user.Created = now
 	user.Updated = now
 
 	result, err := s.db.Exec(
-		"INSERT INTO users (username, password, name, email, created, updated) VALUES (?, ?, ?, ?, ?, ?)",
-		user.Username, user.Password, user.Name, user.Email, user.Created, user.Updated,
+		`INSERT INTO users (domain_id, username, password, name, email, quota_bytes, quota_messages, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.DomainID, user.Username, user.Password, user.Name, user.Email, user.QuotaBytes, user.QuotaMessages,
+		user.Created, user.Updated,
 	)
 	if err != nil {
 		return fmt.Errorf("falha ao criar usuário: %w", err)
@@ -134,43 +602,57 @@ func (s *SQLiteStorage) CreateUser(user *User) error {
 	user.ID = id
 
 	// Criar caixas padrão
-	for _, name := range []string{"INBOX", "Sent", "Drafts", "Trash"} {
-		mailbox := &Mailbox{
-			UserID: user.ID,
-			Name:   name,
-			Path:   name,
-		}
-		if err := s.CreateMailbox(mailbox); err != nil {
+	for _, mailbox := range DefaultMailboxes {
+		mailbox.UserID = user.ID
+		mailbox.Path = mailbox.Name
+		if err := s.CreateMailbox(&mailbox); err != nil {
 			return fmt.Errorf("falha ao criar caixa de correio padrão: %w", err)
 		}
+		if err := s.SubscribeMailbox(user.ID, mailbox.Name); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
-// GetUser obtém um usuário pelo nome de usuário
+// GetUser obtém um usuário pelo nome de usuário. Logins no formato
+// usuario@dominio são resolvidos dentro do domínio virtual correspondente.
 func (s *SQLiteStorage) GetUser(username string) (*User, error) {
-	user := &User{}
-	err := s.db.QueryRow(
-		"SELECT id, username, password, name, email, created, updated FROM users WHERE username = ?",
+	if name, domain, ok := splitLogin(username); ok {
+		user, err := scanUser(s.db.QueryRow(
+			`SELECT u.id, u.domain_id, u.username, u.password, u.name, u.email, u.quota_bytes, u.quota_messages, u.created, u.updated
+			FROM users u JOIN domains d ON d.id = u.domain_id WHERE u.username = ? AND d.name = ?`,
+			name, domain,
+		))
+		if err != ErrUserNotFound {
+			return user, err
+		}
+	}
+
+	return scanUser(s.db.QueryRow(
+		"SELECT "+userColumns+" FROM users WHERE username = ? AND domain_id = 0",
 		username,
-	).Scan(&user.ID, &user.Username, &user.Password, &user.Name, &user.Email, &user.Created, &user.Updated)
+	))
+}
 
-	if err == sql.ErrNoRows {
-		return nil, ErrUserNotFound
-	} else if err != nil {
-		return nil, fmt.Errorf("falha ao obter usuário: %w", err)
-	}
+// GetUserByID obtém um usuário pelo ID
+func (s *SQLiteStorage) GetUserByID(userID int64) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", userID))
+}
 
-	return user, nil
+// GetUserByEmail obtém um usuário pelo endereço de email
+func (s *SQLiteStorage) GetUserByEmail(email string) (*User, error) {
+	return scanUser(s.db.QueryRow("SELECT "+userColumns+" FROM users WHERE LOWER(email) = LOWER(?)", email))
 }
 
 // UpdateUser atualiza um usuário existente
 func (s *SQLiteStorage) UpdateUser(user *User) error {
 	user.Updated = time.Now()
 	_, err := s.db.Exec(
-		"UPDATE users SET password = ?, name = ?, email = ?, updated = ? WHERE id = ?",
-		user.Password, user.Name, user.Email, user.Updated, user.ID,
+		`UPDATE users SET password = ?, name = ?, email = ?, quota_bytes = ?, quota_messages = ?, updated = ?
+		WHERE id = ?`,
+		user.Password, user.Name, user.Email, user.QuotaBytes, user.QuotaMessages, user.Updated, user.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("falha ao atualizar usuário: %w", err)
@@ -199,15 +681,109 @@ func (s *SQLiteStorage) AuthenticateUser(username, password string) (*User, erro
 		return nil, fmt.Errorf("senha inválida")
 	}
 
+	if user.DomainID != 0 {
+		domain, err := s.GetDomainByID(user.DomainID)
+		if err != nil {
+			return nil, err
+		}
+		if !domain.Enabled {
+			return nil, ErrDomainDisabled
+		}
+	}
+
 	return user, nil
 }
 
+// Métodos de implementação para Domain
+
+func (s *SQLiteStorage) CreateDomain(domain *Domain) error {
+	domain.Name = strings.ToLower(domain.Name)
+	now := time.Now()
+	domain.Created = now
+	domain.Updated = now
+
+	result, err := s.db.Exec(
+		`INSERT INTO domains
+		(name, enabled, catch_all, quota_bytes, quota_messages, dkim_selector, dkim_private_key, created, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		domain.Name, domain.Enabled, domain.CatchAll, domain.QuotaBytes, domain.QuotaMessages,
+		domain.DKIMSelector, domain.DKIMPrivateKey, domain.Created, domain.Updated,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao criar domínio: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID do domínio: %w", err)
+	}
+	domain.ID = id
+
+	return nil
+}
+
+func (s *SQLiteStorage) GetDomain(name string) (*Domain, error) {
+	return scanDomain(s.db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE name = ?", strings.ToLower(name)))
+}
+
+func (s *SQLiteStorage) GetDomainByID(domainID int64) (*Domain, error) {
+	return scanDomain(s.db.QueryRow("SELECT "+domainColumns+" FROM domains WHERE id = ?", domainID))
+}
+
+func (s *SQLiteStorage) ListDomains() ([]*Domain, error) {
+	rows, err := s.db.Query("SELECT " + domainColumns + " FROM domains ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar domínios: %w", err)
+	}
+	defer rows.Close()
+
+	var domains []*Domain
+	for rows.Next() {
+		domain, err := scanDomain(rows)
+		if err != nil {
+			return nil, err
+		}
+		domains = append(domains, domain)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre domínios: %w", err)
+	}
+
+	return domains, nil
+}
+
+func (s *SQLiteStorage) UpdateDomain(domain *Domain) error {
+	domain.Updated = time.Now()
+	_, err := s.db.Exec(
+		`UPDATE domains SET enabled = ?, catch_all = ?, quota_bytes = ?, quota_messages = ?,
+		dkim_selector = ?, dkim_private_key = ?, updated = ? WHERE id = ?`,
+		domain.Enabled, domain.CatchAll, domain.QuotaBytes, domain.QuotaMessages,
+		domain.DKIMSelector, domain.DKIMPrivateKey, domain.Updated, domain.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar domínio: %w", err)
+	}
+	return nil
+}
+
+// DeleteDomain exclui um domínio e todos os seus usuários
+func (s *SQLiteStorage) DeleteDomain(domainID int64) error {
+	if _, err := s.db.Exec("DELETE FROM users WHERE domain_id = ?", domainID); err != nil {
+		return fmt.Errorf("falha ao excluir usuários do domínio: %w", err)
+	}
+	if _, err := s.db.Exec("DELETE FROM domains WHERE id = ?", domainID); err != nil {
+		return fmt.Errorf("falha ao excluir domínio: %w", err)
+	}
+	return nil
+}
+
 // Métodos de implementação para Mailbox
 
 func (s *SQLiteStorage) CreateMailbox(mailbox *Mailbox) error {
 	result, err := s.db.Exec(
-		"INSERT INTO mailboxes (user_id, name, path) VALUES (?, ?, ?)",
-		mailbox.UserID, mailbox.Name, mailbox.Path,
+		"INSERT INTO mailboxes (user_id, name, path, special_use, noselect) VALUES (?, ?, ?, ?, ?)",
+		mailbox.UserID, mailbox.Name, mailbox.Path, mailbox.SpecialUse, mailbox.NoSelect,
 	)
 	if err != nil {
 		return fmt.Errorf("falha ao criar caixa de correio: %w", err)
@@ -223,24 +799,22 @@ func (s *SQLiteStorage) CreateMailbox(mailbox *Mailbox) error {
 }
 
 func (s *SQLiteStorage) GetMailbox(userID int64, name string) (*Mailbox, error) {
-	mailbox := &Mailbox{}
-	err := s.db.QueryRow(
-		"SELECT id, user_id, name, path FROM mailboxes WHERE user_id = ? AND name = ?",
+	return scanMailbox(s.db.QueryRow(
+		"SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = ? AND name = ?",
 		userID, name,
-	).Scan(&mailbox.ID, &mailbox.UserID, &mailbox.Name, &mailbox.Path)
-
-	if err == sql.ErrNoRows {
-		return nil, ErrMailboxNotFound
-	} else if err != nil {
-		return nil, fmt.Errorf("falha ao obter caixa de correio: %w", err)
-	}
+	))
+}
 
-	return mailbox, nil
+func (s *SQLiteStorage) GetMailboxByID(mailboxID int64) (*Mailbox, error) {
+	return scanMailbox(s.db.QueryRow(
+		"SELECT "+mailboxColumns+" FROM mailboxes WHERE id = ?",
+		mailboxID,
+	))
 }
 
 func (s *SQLiteStorage) ListMailboxes(userID int64) ([]*Mailbox, error) {
 	rows, err := s.db.Query(
-		"SELECT id, user_id, name, path FROM mailboxes WHERE user_id = ?",
+		"SELECT "+mailboxColumns+" FROM mailboxes WHERE user_id = ? ORDER BY name",
 		userID,
 	)
 	if err != nil {
@@ -250,9 +824,9 @@ func (s *SQLiteStorage) ListMailboxes(userID int64) ([]*Mailbox, error) {
 
 	var mailboxes []*Mailbox
 	for rows.Next() {
-		mb := &Mailbox{}
-		if err := rows.Scan(&mb.ID, &mb.UserID, &mb.Name, &mb.Path); err != nil {
-			return nil, fmt.Errorf("falha ao ler dados da caixa de correio: %w", err)
+		mb, err := scanMailbox(rows)
+		if err != nil {
+			return nil, err
 		}
 		mailboxes = append(mailboxes, mb)
 	}
@@ -275,8 +849,8 @@ func (s *SQLiteStorage) DeleteMailbox(mailboxID int64) error {
 // UpdateMailbox atualiza uma caixa de correio existente
 func (s *SQLiteStorage) UpdateMailbox(mailbox *Mailbox) error {
 	_, err := s.db.Exec(
-		"UPDATE mailboxes SET name = ?, path = ? WHERE id = ?",
-		mailbox.Name, mailbox.Path, mailbox.ID,
+		"UPDATE mailboxes SET name = ?, path = ?, special_use = ?, noselect = ? WHERE id = ?",
+		mailbox.Name, mailbox.Path, mailbox.SpecialUse, mailbox.NoSelect, mailbox.ID,
 	)
 	if err != nil {
 		return fmt.Errorf("falha ao atualizar caixa de correio: %w", err)
@@ -284,155 +858,1550 @@ func (s *SQLiteStorage) UpdateMailbox(mailbox *Mailbox) error {
 	return nil
 }
 
-// Implementações de Message
+// RenameMailbox renomeia uma caixa de correio junto com suas subcaixas. A
+// INBOX não muda de nome: suas mensagens são movidas para a nova caixa.
+func (s *SQLiteStorage) RenameMailbox(userID int64, oldName, newName string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
 
-func (s *SQLiteStorage) CreateMessage(message *Message) error {
-	message.Created = time.Now()
-	result, err := s.db.Exec(
-		`INSERT INTO messages 
-		(mailbox_id, uid, from_addr, to_addr, cc, subject, date, body, raw_data, flags, size, seen, deleted, draft, created) 
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		message.MailboxID, message.UID, message.From, message.To, message.Cc, message.Subject, 
-		message.Date, message.Body, message.RawData, message.Flags, message.Size, 
-		message.Seen, message.Deleted, message.Draft, message.Created,
+	if oldName == "INBOX" {
+		inbox, err := s.GetMailbox(userID, oldName)
+		if err != nil {
+			return err
+		}
+
+		// Para a INBOX as mensagens movidas contam como removidas, e a nova
+		// caixa herda os contadores para manter os UIDs
+		var modseq uint64
+		err = tx.QueryRow(
+			"UPDATE mailboxes SET highest_modseq = highest_modseq + 1 WHERE id = ? RETURNING highest_modseq",
+			inbox.ID,
+		).Scan(&modseq)
+		if err != nil {
+			return fmt.Errorf("falha ao atualizar sequência de modificação: %w", err)
+		}
+		_, err = tx.Exec(
+			`INSERT INTO expunged_messages (mailbox_id, uid, message_id, modseq)
+			SELECT mailbox_id, uid, id, ? FROM messages WHERE mailbox_id = ?
+			ON CONFLICT (mailbox_id, uid) DO UPDATE SET message_id = excluded.message_id, modseq = excluded.modseq`,
+			modseq, inbox.ID,
+		)
+		if err != nil {
+			return fmt.Errorf("falha ao registrar remoção das mensagens: %w", err)
+		}
+
+		result, err := tx.Exec(
+			"INSERT INTO mailboxes (user_id, name, path, uid_next, highest_modseq, recent_uid) VALUES (?, ?, ?, ?, ?, ?)",
+			userID, newName, newName, inbox.UIDNext, modseq, inbox.UIDNext,
+		)
+		if err != nil {
+			return fmt.Errorf("falha ao criar caixa de correio: %w", err)
+		}
+		id, err := result.LastInsertId()
+		if err != nil {
+			return fmt.Errorf("falha ao obter ID da caixa de correio: %w", err)
+		}
+		if _, err := tx.Exec("UPDATE messages SET mailbox_id = ? WHERE mailbox_id = ?", id, inbox.ID); err != nil {
+			return fmt.Errorf("falha ao mover mensagens da INBOX: %w", err)
+		}
+		return tx.Commit()
+	}
+
+	// SUBSTR conta caracteres, e não bytes, nos dois bancos
+	length := utf8.RuneCountInString(oldName)
+	result, err := tx.Exec(
+		`UPDATE mailboxes SET name = ? || SUBSTR(name, ?), path = ? || SUBSTR(name, ?)
+		WHERE user_id = ? AND (name = ? OR SUBSTR(name, 1, ?) = ?)`,
+		newName, length+1, newName, length+1,
+		userID, oldName, length+1, oldName+MailboxDelimiter,
 	)
 	if err != nil {
-		return fmt.Errorf("falha ao criar mensagem: %w", err)
+		return fmt.Errorf("falha ao renomear caixa de correio: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrMailboxNotFound
 	}
 
-	id, err := result.LastInsertId()
+	// As assinaturas acompanham as caixas renomeadas
+	_, err = tx.Exec(
+		`UPDATE subscriptions SET name = ? || SUBSTR(name, ?)
+		WHERE user_id = ? AND (name = ? OR SUBSTR(name, 1, ?) = ?)`,
+		newName, length+1,
+		userID, oldName, length+1, oldName+MailboxDelimiter,
+	)
 	if err != nil {
-		return fmt.Errorf("falha ao obter ID da mensagem: %w", err)
+		return fmt.Errorf("falha ao renomear assinaturas: %w", err)
 	}
-	message.ID = id
 
-	return nil
+	return tx.Commit()
 }
 
-func (s *SQLiteStorage) GetMessage(mailboxID int64, uid uint32) (*Message, error) {
-	message := &Message{}
-	err := s.db.QueryRow(
-		`SELECT id, mailbox_id, uid, from_addr, to_addr, cc, subject, date, body, raw_data, 
-		flags, size, seen, deleted, draft, created FROM messages 
-		WHERE mailbox_id = ? AND uid = ?`,
-		mailboxID, uid,
-	).Scan(
-		&message.ID, &message.MailboxID, &message.UID, &message.From, &message.To, 
-		&message.Cc, &message.Subject, &message.Date, &message.Body, &message.RawData,
-		&message.Flags, &message.Size, &message.Seen, &message.Deleted, &message.Draft, &message.Created,
-	)
+// Métodos de implementação para assinaturas de caixas
 
-	if err == sql.ErrNoRows {
-		return nil, ErrMessageNotFound
-	} else if err != nil {
-		return nil, fmt.Errorf("falha ao obter mensagem: %w", err)
+// SubscribeMailbox assina uma caixa de correio; assinar novamente não é erro
+func (s *SQLiteStorage) SubscribeMailbox(userID int64, name string) error {
+	_, err := s.db.Exec(
+		`INSERT INTO subscriptions (user_id, name) VALUES (?, ?)
+		ON CONFLICT (user_id, name) DO NOTHING`,
+		userID, name,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao assinar caixa de correio: %w", err)
 	}
+	return nil
+}
 
-	return message, nil
+// UnsubscribeMailbox cancela a assinatura de uma caixa de correio
+func (s *SQLiteStorage) UnsubscribeMailbox(userID int64, name string) error {
+	_, err := s.db.Exec("DELETE FROM subscriptions WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return fmt.Errorf("falha ao cancelar assinatura: %w", err)
+	}
+	return nil
 }
 
-func (s *SQLiteStorage) ListMessages(mailboxID int64) ([]*Message, error) {
-	rows, err := s.db.Query(
-		`SELECT id, mailbox_id, uid, from_addr, to_addr, cc, subject, date, body, raw_data, 
-		flags, size, seen, deleted, draft, created FROM messages 
-		WHERE mailbox_id = ? ORDER BY uid`,
-		mailboxID,
-	)
+// ListSubscriptions lista os nomes das caixas assinadas pelo usuário
+func (s *SQLiteStorage) ListSubscriptions(userID int64) ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM subscriptions WHERE user_id = ? ORDER BY name", userID)
 	if err != nil {
-		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+		return nil, fmt.Errorf("falha ao listar assinaturas: %w", err)
 	}
 	defer rows.Close()
 
-	var messages []*Message
+	var names []string
 	for rows.Next() {
-		msg := &Message{}
-		if err := rows.Scan(
-			&msg.ID, &msg.MailboxID, &msg.UID, &msg.From, &msg.To, 
-			&msg.Cc, &msg.Subject, &msg.Date, &msg.Body, &msg.RawData,
-			&msg.Flags, &msg.Size, &msg.Seen, &msg.Deleted, &msg.Draft, &msg.Created,
-		); err != nil {
-			return nil, fmt.Errorf("falha ao ler dados da mensagem: %w", err)
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("falha ao ler assinatura: %w", err)
 		}
-		messages = append(messages, msg)
+		names = append(names, name)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("erro ao iterar sobre mensagens: %w", err)
+		return nil, fmt.Errorf("erro ao iterar sobre assinaturas: %w", err)
 	}
 
-	return messages, nil
+	return names, nil
 }
 
-func (s *SQLiteStorage) UpdateMessageFlags(messageID int64, flags string, seen, deleted, draft bool) error {
+// Métodos de implementação para controle de acesso às caixas
+
+// SetMailboxACL grava os direitos de um identificador sobre a caixa
+func (s *SQLiteStorage) SetMailboxACL(acl *MailboxACL) error {
+	if acl.Rights == "" {
+		return s.DeleteMailboxACL(acl.MailboxID, acl.Identifier)
+	}
 	_, err := s.db.Exec(
-		"UPDATE messages SET flags = ?, seen = ?, deleted = ?, draft = ? WHERE id = ?",
-		flags, seen, deleted, draft, messageID,
+		`INSERT INTO mailbox_acl (mailbox_id, identifier, rights) VALUES (?, ?, ?)
+		ON CONFLICT (mailbox_id, identifier) DO UPDATE SET rights = excluded.rights`,
+		acl.MailboxID, strings.ToLower(acl.Identifier), acl.Rights,
 	)
 	if err != nil {
-		return fmt.Errorf("falha ao atualizar flags da mensagem: %w", err)
+		return fmt.Errorf("falha ao gravar direitos da caixa: %w", err)
 	}
 	return nil
 }
 
-func (s *SQLiteStorage) DeleteMessage(messageID int64) error {
-	_, err := s.db.Exec("DELETE FROM messages WHERE id = ?", messageID)
+func (s *SQLiteStorage) DeleteMailboxACL(mailboxID int64, identifier string) error {
+	_, err := s.db.Exec(
+		"DELETE FROM mailbox_acl WHERE mailbox_id = ? AND identifier = ?",
+		mailboxID, strings.ToLower(identifier),
+	)
 	if err != nil {
-		return fmt.Errorf("falha ao excluir mensagem: %w", err)
+		return fmt.Errorf("falha ao remover direitos da caixa: %w", err)
 	}
 	return nil
 }
 
+func (s *SQLiteStorage) ListMailboxACL(mailboxID int64) ([]*MailboxACL, error) {
+	return s.listMailboxACL("SELECT mailbox_id, identifier, rights FROM mailbox_acl WHERE mailbox_id = ? ORDER BY identifier", mailboxID)
+}
+
+// ListACLByIdentifier lista as caixas em que o identificador recebeu direitos
+func (s *SQLiteStorage) ListACLByIdentifier(identifier string) ([]*MailboxACL, error) {
+	return s.listMailboxACL("SELECT mailbox_id, identifier, rights FROM mailbox_acl WHERE identifier = ? ORDER BY mailbox_id", strings.ToLower(identifier))
+}
+
+func (s *SQLiteStorage) listMailboxACL(query string, arg interface{}) ([]*MailboxACL, error) {
+	rows, err := s.db.Query(query, arg)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar direitos das caixas: %w", err)
+	}
+	defer rows.Close()
+
+	var acls []*MailboxACL
+	for rows.Next() {
+		acl := &MailboxACL{}
+		if err := rows.Scan(&acl.MailboxID, &acl.Identifier, &acl.Rights); err != nil {
+			return nil, fmt.Errorf("falha ao ler direitos da caixa: %w", err)
+		}
+		acls = append(acls, acl)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre direitos das caixas: %w", err)
+	}
+
+	return acls, nil
+}
+
+// Implementações de Message
+
+func (s *SQLiteStorage) CreateMessage(message *Message) error {
+	return s.CreateMessages([]*Message{message})
+}
+
+// CreateMessages grava as mensagens em uma única transação: se alguma
+// falhar, nenhuma é gravada
+func (s *SQLiteStorage) CreateMessages(messages []*Message) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, message := range messages {
+		if err := s.insertMessage(tx, message); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// insertMessage grava uma mensagem na transação, atribuindo UID, sequência
+// de modificação e conversa
+func (s *SQLiteStorage) insertMessage(tx *sql.Tx, message *Message) error {
+	message.Created = time.Now()
+
+	// Os contadores da caixa garantem UIDs crescentes que nunca são reutilizados
+	var userID int64
+	var err error
+	if message.UID == 0 {
+		err = tx.QueryRow(
+			`UPDATE mailboxes SET uid_next = uid_next + 1, highest_modseq = highest_modseq + 1
+			WHERE id = ? RETURNING user_id, uid_next - 1, highest_modseq`,
+			message.MailboxID,
+		).Scan(&userID, &message.UID, &message.ModSeq)
+	} else {
+		err = tx.QueryRow(
+			`UPDATE mailboxes SET uid_next = MAX(uid_next, ?), highest_modseq = highest_modseq + 1
+			WHERE id = ? RETURNING user_id, highest_modseq`,
+			int64(message.UID)+1, message.MailboxID,
+		).Scan(&userID, &message.ModSeq)
+	}
+	if err == sql.ErrNoRows {
+		return ErrMailboxNotFound
+	} else if err != nil {
+		return fmt.Errorf("falha ao obter próximo UID: %w", err)
+	}
+
+	if err := s.assignThread(tx, userID, message); err != nil {
+		return err
+	}
+
+	result, err := tx.Exec(
+		`INSERT INTO messages
+		(mailbox_id, uid, from_addr, to_addr, cc, subject, message_id, in_reply_to, refs,
+		thread_id, date, body, raw_data, flags, size, seen, deleted, draft, modseq, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		message.MailboxID, message.UID, message.From, message.To, message.Cc, message.Subject,
+		message.MessageID, message.InReplyTo, message.References,
+		message.ThreadID, message.Date, message.Body, message.RawData, message.Flags, message.Size,
+		message.Seen, message.Deleted, message.Draft, message.ModSeq, message.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao criar mensagem: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID da mensagem: %w", err)
+	}
+	message.ID = id
+
+	return nil
+}
+
+func (s *SQLiteStorage) GetMessage(mailboxID int64, uid uint32) (*Message, error) {
+	return scanMessage(s.db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE mailbox_id = ? AND uid = ?",
+		mailboxID, uid,
+	))
+}
+
+func (s *SQLiteStorage) GetMessageByID(messageID int64) (*Message, error) {
+	return scanMessage(s.db.QueryRow(
+		"SELECT "+messageColumns+" FROM messages WHERE id = ?",
+		messageID,
+	))
+}
+
+func (s *SQLiteStorage) ListMessages(mailboxID int64) ([]*Message, error) {
+	rows, err := s.db.Query(
+		"SELECT "+messageColumns+" FROM messages WHERE mailbox_id = ? ORDER BY uid",
+		mailboxID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens: %w", err)
+	}
+
+	return messages, nil
+}
+
+// nextModSeq incrementa a sequência de modificação da caixa que contém a
+// mensagem e retorna o novo valor
+func (s *SQLiteStorage) nextModSeq(tx *sql.Tx, messageID int64) (uint64, error) {
+	var modseq uint64
+	err := tx.QueryRow(
+		`UPDATE mailboxes SET highest_modseq = highest_modseq + 1
+		WHERE id = (SELECT mailbox_id FROM messages WHERE id = ?) RETURNING highest_modseq`,
+		messageID,
+	).Scan(&modseq)
+	if err == sql.ErrNoRows {
+		return 0, ErrMessageNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("falha ao atualizar sequência de modificação: %w", err)
+	}
+	return modseq, nil
+}
+
+func (s *SQLiteStorage) UpdateMessageFlags(messageID int64, flags string, seen, deleted, draft bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	modseq, err := s.nextModSeq(tx, messageID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET flags = ?, seen = ?, deleted = ?, draft = ?, modseq = ? WHERE id = ?",
+		flags, seen, deleted, draft, modseq, messageID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar flags da mensagem: %w", err)
+	}
+	return tx.Commit()
+}
+
+// DeleteMessage remove a mensagem, registrando seu UID no log de remoções
+func (s *SQLiteStorage) DeleteMessage(messageID int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	modseq, err := s.nextModSeq(tx, messageID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO expunged_messages (mailbox_id, uid, message_id, modseq)
+		SELECT mailbox_id, uid, id, ? FROM messages WHERE id = ?
+		ON CONFLICT (mailbox_id, uid) DO UPDATE SET message_id = excluded.message_id, modseq = excluded.modseq`,
+		modseq, messageID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar remoção da mensagem: %w", err)
+	}
+
+	if _, err := tx.Exec("DELETE FROM messages WHERE id = ?", messageID); err != nil {
+		return fmt.Errorf("falha ao excluir mensagem: %w", err)
+	}
+	return tx.Commit()
+}
+
+// MoveMessage move a mensagem para outra caixa, registrando a remoção do UID
+// na origem e atribuindo um novo UID e sequência de modificação no destino
+func (s *SQLiteStorage) MoveMessage(messageID, mailboxID int64) error {
+	_, err := s.MoveMessages([]int64{messageID}, mailboxID)
+	return err
+}
+
+// MoveMessages move as mensagens para outra caixa em uma única transação e
+// retorna os UIDs atribuídos no destino, na mesma ordem
+func (s *SQLiteStorage) MoveMessages(messageIDs []int64, mailboxID int64) ([]uint32, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	uids := make([]uint32, len(messageIDs))
+	for i, messageID := range messageIDs {
+		if uids[i], err = s.moveMessage(tx, messageID, mailboxID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("falha ao mover mensagens: %w", err)
+	}
+	return uids, nil
+}
+
+func (s *SQLiteStorage) moveMessage(tx *sql.Tx, messageID, mailboxID int64) (uint32, error) {
+	modseq, err := s.nextModSeq(tx, messageID)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO expunged_messages (mailbox_id, uid, message_id, modseq)
+		SELECT mailbox_id, uid, id, ? FROM messages WHERE id = ?
+		ON CONFLICT (mailbox_id, uid) DO UPDATE SET message_id = excluded.message_id, modseq = excluded.modseq`,
+		modseq, messageID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("falha ao registrar remoção da mensagem: %w", err)
+	}
+
+	var uid uint32
+	err = tx.QueryRow(
+		`UPDATE mailboxes SET uid_next = uid_next + 1, highest_modseq = highest_modseq + 1
+		WHERE id = ? RETURNING uid_next - 1, highest_modseq`,
+		mailboxID,
+	).Scan(&uid, &modseq)
+	if err == sql.ErrNoRows {
+		return 0, ErrMailboxNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("falha ao obter próximo UID: %w", err)
+	}
+
+	_, err = tx.Exec(
+		"UPDATE messages SET mailbox_id = ?, uid = ?, modseq = ? WHERE id = ?",
+		mailboxID, uid, modseq, messageID,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("falha ao mover mensagem: %w", err)
+	}
+	return uid, nil
+}
+
+func (s *SQLiteStorage) ListExpunged(mailboxID int64, sinceModSeq uint64) ([]uint32, error) {
+	rows, err := s.db.Query(
+		"SELECT uid FROM expunged_messages WHERE mailbox_id = ? AND modseq > ? ORDER BY uid",
+		mailboxID, sinceModSeq,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens removidas: %w", err)
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, fmt.Errorf("falha ao ler mensagem removida: %w", err)
+		}
+		uids = append(uids, uid)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens removidas: %w", err)
+	}
+
+	return uids, nil
+}
+
+func (s *SQLiteStorage) ListExpungedMessages(mailboxID int64, sinceModSeq uint64) ([]*ExpungedMessage, error) {
+	rows, err := s.db.Query(
+		"SELECT uid, message_id, modseq FROM expunged_messages WHERE mailbox_id = ? AND modseq > ? ORDER BY uid",
+		mailboxID, sinceModSeq,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar mensagens removidas: %w", err)
+	}
+	defer rows.Close()
+
+	var expunged []*ExpungedMessage
+	for rows.Next() {
+		e := &ExpungedMessage{}
+		if err := rows.Scan(&e.UID, &e.MessageID, &e.ModSeq); err != nil {
+			return nil, fmt.Errorf("falha ao ler mensagem removida: %w", err)
+		}
+		expunged = append(expunged, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens removidas: %w", err)
+	}
+
+	return expunged, nil
+}
+
+// Implementações de contadores de caixa
+
+// GetMailboxCounters calcula os contadores da caixa em uma única consulta
+func (s *SQLiteStorage) GetMailboxCounters(mailboxID int64) (*MailboxCounters, error) {
+	counters := &MailboxCounters{}
+	var firstUnseen sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT COUNT(m.id),
+			COALESCE(SUM(CASE WHEN NOT m.seen THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(CASE WHEN m.uid >= mb.recent_uid THEN 1 ELSE 0 END), 0),
+			COALESCE(SUM(m.size), 0),
+			MIN(CASE WHEN NOT m.seen THEN m.uid END),
+			mb.uid_next, mb.highest_modseq
+		FROM mailboxes mb LEFT JOIN messages m ON m.mailbox_id = mb.id
+		WHERE mb.id = ? GROUP BY mb.id, mb.uid_next, mb.highest_modseq`,
+		mailboxID,
+	).Scan(&counters.Messages, &counters.Unseen, &counters.Recent, &counters.Size, &firstUnseen,
+		&counters.UIDNext, &counters.HighestModSeq)
+	if err == sql.ErrNoRows {
+		return nil, ErrMailboxNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao calcular contadores da caixa: %w", err)
+	}
+	counters.FirstUnseen = uint32(firstUnseen.Int64)
+	return counters, nil
+}
+
+func (s *SQLiteStorage) ListMessageUIDs(mailboxID int64) ([]uint32, error) {
+	rows, err := s.db.Query("SELECT uid FROM messages WHERE mailbox_id = ? ORDER BY uid", mailboxID)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar UIDs: %w", err)
+	}
+	defer rows.Close()
+
+	var uids []uint32
+	for rows.Next() {
+		var uid uint32
+		if err := rows.Scan(&uid); err != nil {
+			return nil, fmt.Errorf("falha ao ler UID: %w", err)
+		}
+		uids = append(uids, uid)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre UIDs: %w", err)
+	}
+
+	return uids, nil
+}
+
+// ClaimRecent avança o marcador de mensagens recentes da caixa. A
+// atualização só vale se o marcador não mudou desde a leitura, garantindo
+// que cada mensagem seja recente para uma única sessão.
+func (s *SQLiteStorage) ClaimRecent(mailboxID int64, lastUID uint32) (uint32, error) {
+	for {
+		var first uint32
+		err := s.db.QueryRow("SELECT recent_uid FROM mailboxes WHERE id = ?", mailboxID).Scan(&first)
+		if err == sql.ErrNoRows {
+			return 0, ErrMailboxNotFound
+		} else if err != nil {
+			return 0, fmt.Errorf("falha ao obter mensagens recentes: %w", err)
+		}
+		if first > lastUID {
+			return 0, nil
+		}
+
+		result, err := s.db.Exec(
+			"UPDATE mailboxes SET recent_uid = ? WHERE id = ? AND recent_uid = ?",
+			int64(lastUID)+1, mailboxID, first,
+		)
+		if err != nil {
+			return 0, fmt.Errorf("falha ao reivindicar mensagens recentes: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			return first, nil
+		}
+	}
+}
+
+// Implementações de Thread
+
+// assignThread define a conversa da mensagem pelos identificadores de
+// References, In-Reply-To e Message-ID já vistos pelo usuário. Sem
+// correspondência, uma resposta entra na conversa mais recente de mesmo
+// assunto base. Conversas ligadas pela nova mensagem são unidas na mais antiga.
+func (s *SQLiteStorage) assignThread(tx *sql.Tx, userID int64, message *Message) error {
+	refs := threadReferences(message)
+	subject, reply := threadSubject(message.Subject)
+
+	var threads []int64
+	for _, ref := range refs {
+		var threadID int64
+		err := tx.QueryRow(
+			"SELECT thread_id FROM thread_refs WHERE user_id = ? AND message_id = ?",
+			userID, ref,
+		).Scan(&threadID)
+		if err == sql.ErrNoRows {
+			continue
+		} else if err != nil {
+			return fmt.Errorf("falha ao buscar conversa: %w", err)
+		}
+		if message.ThreadID == 0 || threadID < message.ThreadID {
+			message.ThreadID = threadID
+		}
+		threads = append(threads, threadID)
+	}
+
+	if message.ThreadID == 0 && subject != "" && (reply || message.InReplyTo != "" || message.References != "") {
+		err := tx.QueryRow(
+			"SELECT id FROM threads WHERE user_id = ? AND subject = ? ORDER BY updated DESC LIMIT 1",
+			userID, subject,
+		).Scan(&message.ThreadID)
+		if err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("falha ao buscar conversa: %w", err)
+		}
+	}
+
+	if message.ThreadID == 0 {
+		result, err := tx.Exec(
+			"INSERT INTO threads (user_id, subject, created, updated) VALUES (?, ?, ?, ?)",
+			userID, subject, message.Created, message.Created,
+		)
+		if err != nil {
+			return fmt.Errorf("falha ao criar conversa: %w", err)
+		}
+		if message.ThreadID, err = result.LastInsertId(); err != nil {
+			return fmt.Errorf("falha ao obter ID da conversa: %w", err)
+		}
+	} else {
+		for _, threadID := range threads {
+			if threadID == message.ThreadID {
+				continue
+			}
+			if _, err := tx.Exec("UPDATE messages SET thread_id = ? WHERE thread_id = ?", message.ThreadID, threadID); err != nil {
+				return fmt.Errorf("falha ao unir conversas: %w", err)
+			}
+			if _, err := tx.Exec("UPDATE thread_refs SET thread_id = ? WHERE thread_id = ?", message.ThreadID, threadID); err != nil {
+				return fmt.Errorf("falha ao unir conversas: %w", err)
+			}
+			if _, err := tx.Exec("DELETE FROM threads WHERE id = ?", threadID); err != nil {
+				return fmt.Errorf("falha ao unir conversas: %w", err)
+			}
+		}
+		if _, err := tx.Exec("UPDATE threads SET updated = ? WHERE id = ?", message.Created, message.ThreadID); err != nil {
+			return fmt.Errorf("falha ao atualizar conversa: %w", err)
+		}
+	}
+
+	for _, ref := range refs {
+		_, err := tx.Exec(
+			"INSERT INTO thread_refs (user_id, message_id, thread_id) VALUES (?, ?, ?) ON CONFLICT (user_id, message_id) DO NOTHING",
+			userID, ref, message.ThreadID,
+		)
+		if err != nil {
+			return fmt.Errorf("falha ao registrar conversa: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStorage) ListThreads(userID int64) ([]*Thread, error) {
+	rows, err := s.db.Query(
+		`SELECT `+threadColumns+` FROM threads t JOIN messages m ON m.thread_id = t.id
+		WHERE t.user_id = ? GROUP BY t.id, t.user_id, t.subject, t.created, t.updated ORDER BY t.updated DESC`,
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar conversas: %w", err)
+	}
+	defer rows.Close()
+
+	var threads []*Thread
+	for rows.Next() {
+		thread, err := scanThread(rows)
+		if err != nil {
+			return nil, err
+		}
+		threads = append(threads, thread)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre conversas: %w", err)
+	}
+
+	return threads, nil
+}
+
+func (s *SQLiteStorage) GetThread(userID, threadID int64) ([]*Message, error) {
+	rows, err := s.db.Query(
+		`SELECT `+messageColumns+` FROM messages
+		WHERE thread_id = ? AND mailbox_id IN (SELECT id FROM mailboxes WHERE user_id = ?) ORDER BY date, id`,
+		threadID, userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao obter conversa: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*Message
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre mensagens: %w", err)
+	}
+
+	if len(messages) == 0 {
+		return nil, ErrThreadNotFound
+	}
+	return messages, nil
+}
+
 // Implementações de Attachment
 
-func (s *SQLiteStorage) CreateAttachment(attachment *Attachment) error {
-	attachment.Created = time.Now()
+func (s *SQLiteStorage) CreateAttachment(attachment *Attachment) error {
+	attachment.Created = time.Now()
+	result, err := s.db.Exec(
+		"INSERT INTO attachments (message_id, filename, mime_type, data, size, created) VALUES (?, ?, ?, ?, ?, ?)",
+		attachment.MessageID, attachment.Filename, attachment.MimeType, attachment.Data, attachment.Size, attachment.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao criar anexo: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID do anexo: %w", err)
+	}
+	attachment.ID = id
+
+	return nil
+}
+
+func (s *SQLiteStorage) GetAttachments(messageID int64) ([]*Attachment, error) {
+	rows, err := s.db.Query(
+		"SELECT id, message_id, filename, mime_type, data, size, created FROM attachments WHERE message_id = ?",
+		messageID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao obter anexos: %w", err)
+	}
+	defer rows.Close()
+
+	var attachments []*Attachment
+	for rows.Next() {
+		att := &Attachment{}
+		if err := rows.Scan(&att.ID, &att.MessageID, &att.Filename, &att.MimeType, &att.Data, &att.Size, &att.Created); err != nil {
+			return nil, fmt.Errorf("falha ao ler dados do anexo: %w", err)
+		}
+		attachments = append(attachments, att)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre anexos: %w", err)
+	}
+
+	return attachments, nil
+}
+
+func (s *SQLiteStorage) DeleteAttachment(attachmentID int64) error {
+	_, err := s.db.Exec("DELETE FROM attachments WHERE id = ?", attachmentID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir anexo: %w", err)
+	}
+	return nil
+}
+
+// Implementações de cota
+
+// GetUserUsage soma o tamanho e a quantidade das mensagens do usuário
+func (s *SQLiteStorage) GetUserUsage(userID int64) (*Usage, error) {
+	usage := &Usage{}
+	err := s.db.QueryRow(
+		`SELECT COALESCE(SUM(m.size), 0), COUNT(m.id) FROM messages m
+		JOIN mailboxes mb ON mb.id = m.mailbox_id WHERE mb.user_id = ?`,
+		userID,
+	).Scan(&usage.Bytes, &usage.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao calcular uso do usuário: %w", err)
+	}
+	return usage, nil
+}
+
+// GetDomainUsage soma o tamanho e a quantidade das mensagens de todos os
+// usuários do domínio
+func (s *SQLiteStorage) GetDomainUsage(domainID int64) (*Usage, error) {
+	usage := &Usage{}
+	err := s.db.QueryRow(
+		`SELECT COALESCE(SUM(m.size), 0), COUNT(m.id) FROM messages m
+		JOIN mailboxes mb ON mb.id = m.mailbox_id
+		JOIN users u ON u.id = mb.user_id WHERE u.domain_id = ?`,
+		domainID,
+	).Scan(&usage.Bytes, &usage.Messages)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao calcular uso do domínio: %w", err)
+	}
+	return usage, nil
+}
+
+// Implementações de Alias
+
+func (s *SQLiteStorage) CreateAlias(alias *Alias) error {
+	alias.Created = time.Now()
+	result, err := s.db.Exec(
+		"INSERT INTO aliases (address, user_id, targets, created) VALUES (?, ?, ?, ?)",
+		strings.ToLower(alias.Address), nullInt64(alias.UserID), alias.Targets, alias.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao criar alias: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID do alias: %w", err)
+	}
+	alias.ID = id
+
+	return nil
+}
+
+func (s *SQLiteStorage) GetAlias(address string) (*Alias, error) {
+	alias := &Alias{}
+	var userID sql.NullInt64
+	var targets sql.NullString
+	err := s.db.QueryRow(
+		"SELECT id, address, user_id, targets, created FROM aliases WHERE address = ?",
+		strings.ToLower(address),
+	).Scan(&alias.ID, &alias.Address, &userID, &targets, &alias.Created)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrAliasNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter alias: %w", err)
+	}
+	alias.UserID = userID.Int64
+	alias.Targets = targets.String
+
+	return alias, nil
+}
+
+func (s *SQLiteStorage) ListAliases() ([]*Alias, error) {
+	rows, err := s.db.Query("SELECT id, address, user_id, targets, created FROM aliases ORDER BY address")
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar aliases: %w", err)
+	}
+	defer rows.Close()
+
+	var aliases []*Alias
+	for rows.Next() {
+		alias := &Alias{}
+		var userID sql.NullInt64
+		var targets sql.NullString
+		if err := rows.Scan(&alias.ID, &alias.Address, &userID, &targets, &alias.Created); err != nil {
+			return nil, fmt.Errorf("falha ao ler dados do alias: %w", err)
+		}
+		alias.UserID = userID.Int64
+		alias.Targets = targets.String
+		aliases = append(aliases, alias)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre aliases: %w", err)
+	}
+
+	return aliases, nil
+}
+
+func (s *SQLiteStorage) DeleteAlias(aliasID int64) error {
+	_, err := s.db.Exec("DELETE FROM aliases WHERE id = ?", aliasID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir alias: %w", err)
+	}
+	return nil
+}
+
+// Implementações de Forwarding
+
+// SetForwarding cria ou substitui o encaminhamento de um usuário
+func (s *SQLiteStorage) SetForwarding(forwarding *Forwarding) error {
+	forwarding.Updated = time.Now()
+	_, err := s.db.Exec(
+		`INSERT INTO forwardings (user_id, targets, keep_copy, enabled, updated) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET targets = excluded.targets, keep_copy = excluded.keep_copy,
+		enabled = excluded.enabled, updated = excluded.updated`,
+		forwarding.UserID, forwarding.Targets, forwarding.KeepCopy, forwarding.Enabled, forwarding.Updated,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao salvar encaminhamento: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetForwarding(userID int64) (*Forwarding, error) {
+	forwarding := &Forwarding{}
+	err := s.db.QueryRow(
+		"SELECT user_id, targets, keep_copy, enabled, updated FROM forwardings WHERE user_id = ?",
+		userID,
+	).Scan(&forwarding.UserID, &forwarding.Targets, &forwarding.KeepCopy, &forwarding.Enabled, &forwarding.Updated)
+
+	if err == sql.ErrNoRows {
+		return nil, ErrForwardingNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter encaminhamento: %w", err)
+	}
+
+	return forwarding, nil
+}
+
+func (s *SQLiteStorage) DeleteForwarding(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM forwardings WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir encaminhamento: %w", err)
+	}
+	return nil
+}
+
+// InitSetting grava a configuração se ela ainda não existir e retorna o
+// valor armazenado, que pode ter sido gravado antes por outro processo
+func (s *SQLiteStorage) InitSetting(name, value string) (string, error) {
+	if _, err := s.db.Exec(
+		"INSERT INTO settings (name, value) VALUES (?, ?) ON CONFLICT (name) DO NOTHING",
+		name, value,
+	); err != nil {
+		return "", fmt.Errorf("falha ao gravar configuração %s: %w", name, err)
+	}
+	var stored string
+	if err := s.db.QueryRow("SELECT value FROM settings WHERE name = ?", name).Scan(&stored); err != nil {
+		return "", fmt.Errorf("falha ao obter configuração %s: %w", name, err)
+	}
+	return stored, nil
+}
+
+// Implementações da fila de entrega externa
+
+// EnqueueOutbound grava uma mensagem na fila de entrega externa
+func (s *SQLiteStorage) EnqueueOutbound(msg *OutboundMessage) error {
+	if msg.Created.IsZero() {
+		msg.Created = time.Now()
+	}
+	if msg.NextAttempt.IsZero() {
+		msg.NextAttempt = msg.Created
+	}
+	result, err := s.db.Exec(
+		`INSERT INTO outbound_queue (queue_id, sender, recipients, dsn, message_id, data, delayed, attempts, next_attempt, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		msg.QueueID, msg.Sender, joinAddressList(msg.Recipients), msg.DSN, msg.MessageID, msg.Data,
+		joinAddressList(msg.Delayed), msg.Attempts, msg.NextAttempt, msg.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao enfileirar mensagem para entrega externa: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID da mensagem na fila: %w", err)
+	}
+	msg.ID = id
+	return nil
+}
+
+func (s *SQLiteStorage) PendingOutbound(now time.Time, limit int) ([]*OutboundMessage, error) {
+	rows, err := s.db.Query(
+		"SELECT "+outboundColumns+" FROM outbound_queue WHERE next_attempt <= ? ORDER BY id LIMIT ?",
+		now, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar fila de entrega externa: %w", err)
+	}
+	defer rows.Close()
+
+	var messages []*OutboundMessage
+	for rows.Next() {
+		msg, err := scanOutbound(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre fila de entrega externa: %w", err)
+	}
+	return messages, nil
+}
+
+// UpdateOutbound grava o estado da mensagem após uma tentativa de entrega
+func (s *SQLiteStorage) UpdateOutbound(msg *OutboundMessage) error {
+	_, err := s.db.Exec(
+		"UPDATE outbound_queue SET recipients = ?, delayed = ?, attempts = ?, next_attempt = ? WHERE id = ?",
+		joinAddressList(msg.Recipients), joinAddressList(msg.Delayed), msg.Attempts, msg.NextAttempt, msg.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar mensagem na fila de entrega externa: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DeleteOutbound(id int64) error {
+	_, err := s.db.Exec("DELETE FROM outbound_queue WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("falha ao remover mensagem da fila de entrega externa: %w", err)
+	}
+	return nil
+}
+
+// Implementações de Vacation
+
+// SetVacation cria ou substitui a resposta de ausência de um usuário
+func (s *SQLiteStorage) SetVacation(vacation *Vacation) error {
+	vacation.Updated = time.Now()
+	_, err := s.db.Exec(
+		`INSERT INTO vacations (user_id, enabled, subject, body, start_date, end_date, addresses, days, updated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET enabled = excluded.enabled, subject = excluded.subject,
+		body = excluded.body, start_date = excluded.start_date, end_date = excluded.end_date,
+		addresses = excluded.addresses, days = excluded.days, updated = excluded.updated`,
+		vacation.UserID, vacation.Enabled, vacation.Subject, vacation.Body, nullTime(vacation.Start),
+		nullTime(vacation.End), vacation.Addresses, vacation.Days, vacation.Updated,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao salvar resposta de ausência: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) GetVacation(userID int64) (*Vacation, error) {
+	return scanVacation(s.db.QueryRow("SELECT "+vacationColumns+" FROM vacations WHERE user_id = ?", userID))
+}
+
+func (s *SQLiteStorage) DeleteVacation(userID int64) error {
+	_, err := s.db.Exec("DELETE FROM vacations WHERE user_id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir resposta de ausência: %w", err)
+	}
+	return nil
+}
+
+// LastVacationReply retorna quando o remetente recebeu a última resposta com
+// o identificador informado, ou a data zero se nunca recebeu
+func (s *SQLiteStorage) LastVacationReply(userID int64, sender, handle string) (time.Time, error) {
+	var sent time.Time
+	err := s.db.QueryRow(
+		"SELECT sent FROM vacation_replies WHERE user_id = ? AND sender = ? AND handle = ?",
+		userID, sender, handle,
+	).Scan(&sent)
+	if err == sql.ErrNoRows {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, fmt.Errorf("falha ao obter registro de resposta de ausência: %w", err)
+	}
+	return sent, nil
+}
+
+func (s *SQLiteStorage) RecordVacationReply(userID int64, sender, handle string, sent time.Time) error {
+	_, err := s.db.Exec(
+		`INSERT INTO vacation_replies (user_id, sender, handle, sent) VALUES (?, ?, ?, ?)
+		ON CONFLICT (user_id, sender, handle) DO UPDATE SET sent = excluded.sent`,
+		userID, sender, handle, sent,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar resposta de ausência: %w", err)
+	}
+	return nil
+}
+
+// Implementações de SieveScript
+
+// PutSieveScript cria ou atualiza o conteúdo de um script, preservando seu estado de ativação
+func (s *SQLiteStorage) PutSieveScript(script *SieveScript) error {
+	now := time.Now()
+	_, err := s.db.Exec(
+		`INSERT INTO sieve_scripts (user_id, name, content, active, created, updated) VALUES (?, ?, ?, 0, ?, ?)
+		ON CONFLICT (user_id, name) DO UPDATE SET content = excluded.content, updated = excluded.updated`,
+		script.UserID, script.Name, script.Content, now, now,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao salvar script sieve: %w", err)
+	}
+
+	saved, err := s.GetSieveScript(script.UserID, script.Name)
+	if err != nil {
+		return err
+	}
+	*script = *saved
+	return nil
+}
+
+func (s *SQLiteStorage) GetSieveScript(userID int64, name string) (*SieveScript, error) {
+	return scanSieveScript(s.db.QueryRow(
+		"SELECT "+sieveScriptColumns+" FROM sieve_scripts WHERE user_id = ? AND name = ?",
+		userID, name,
+	))
+}
+
+func (s *SQLiteStorage) GetActiveSieveScript(userID int64) (*SieveScript, error) {
+	return scanSieveScript(s.db.QueryRow(
+		"SELECT "+sieveScriptColumns+" FROM sieve_scripts WHERE user_id = ? AND active",
+		userID,
+	))
+}
+
+func (s *SQLiteStorage) ListSieveScripts(userID int64) ([]*SieveScript, error) {
+	rows, err := s.db.Query(
+		"SELECT "+sieveScriptColumns+" FROM sieve_scripts WHERE user_id = ? ORDER BY name",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar scripts sieve: %w", err)
+	}
+	defer rows.Close()
+
+	var scripts []*SieveScript
+	for rows.Next() {
+		script, err := scanSieveScript(rows)
+		if err != nil {
+			return nil, err
+		}
+		scripts = append(scripts, script)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre scripts sieve: %w", err)
+	}
+
+	return scripts, nil
+}
+
+// SetActiveSieveScript ativa o script informado e desativa os demais; um
+// nome vazio desativa todos os scripts do usuário
+func (s *SQLiteStorage) SetActiveSieveScript(userID int64, name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE sieve_scripts SET active = 0 WHERE user_id = ?", userID); err != nil {
+		return fmt.Errorf("falha ao desativar scripts sieve: %w", err)
+	}
+
+	if name != "" {
+		result, err := tx.Exec("UPDATE sieve_scripts SET active = 1 WHERE user_id = ? AND name = ?", userID, name)
+		if err != nil {
+			return fmt.Errorf("falha ao ativar script sieve: %w", err)
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return ErrSieveScriptNotFound
+		}
+	}
+
+	return tx.Commit()
+}
+
+// RenameSieveScript altera o nome de um script, mantendo conteúdo e ativação
+func (s *SQLiteStorage) RenameSieveScript(userID int64, oldName, newName string) error {
+	if _, err := s.GetSieveScript(userID, newName); err == nil {
+		return ErrSieveScriptExists
+	} else if !errors.Is(err, ErrSieveScriptNotFound) {
+		return err
+	}
+
 	result, err := s.db.Exec(
-		"INSERT INTO attachments (message_id, filename, mime_type, data, size, created) VALUES (?, ?, ?, ?, ?, ?)",
-		attachment.MessageID, attachment.Filename, attachment.MimeType, attachment.Data, attachment.Size, attachment.Created,
+		"UPDATE sieve_scripts SET name = ?, updated = ? WHERE user_id = ? AND name = ?",
+		newName, time.Now(), userID, oldName,
 	)
 	if err != nil {
-		return fmt.Errorf("falha ao criar anexo: %w", err)
+		return fmt.Errorf("falha ao renomear script sieve: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSieveScriptNotFound
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DeleteSieveScript(userID int64, name string) error {
+	result, err := s.db.Exec("DELETE FROM sieve_scripts WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		return fmt.Errorf("falha ao excluir script sieve: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrSieveScriptNotFound
+	}
+	return nil
+}
+
+// Implementações de EmailSubmission
+
+// CreateEmailSubmission registra um envio JMAP
+func (s *SQLiteStorage) CreateEmailSubmission(submission *EmailSubmission) error {
+	if submission.SendAt.IsZero() {
+		submission.SendAt = time.Now()
+	}
+	result, err := s.db.Exec(
+		`INSERT INTO email_submissions (user_id, message_id, thread_id, mail_from, recipients, queue_id, send_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		submission.UserID, submission.MessageID, submission.ThreadID, submission.MailFrom,
+		joinAddressList(submission.Recipients), submission.QueueID, submission.SendAt,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar envio: %w", err)
 	}
 
 	id, err := result.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("falha ao obter ID do anexo: %w", err)
+		return fmt.Errorf("falha ao obter ID do envio: %w", err)
+	}
+	submission.ID = id
+	return nil
+}
+
+func (s *SQLiteStorage) ListEmailSubmissions(userID int64) ([]*EmailSubmission, error) {
+	rows, err := s.db.Query(
+		"SELECT "+emailSubmissionColumns+" FROM email_submissions WHERE user_id = ? ORDER BY id",
+		userID,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar envios: %w", err)
+	}
+	defer rows.Close()
+
+	var submissions []*EmailSubmission
+	for rows.Next() {
+		submission, err := scanEmailSubmission(rows)
+		if err != nil {
+			return nil, err
+		}
+		submissions = append(submissions, submission)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre envios: %w", err)
+	}
+	return submissions, nil
+}
+
+// Implementações do histórico de entregas
+
+// RecordDelivery acrescenta um registro ao histórico de entregas
+func (s *SQLiteStorage) RecordDelivery(record *DeliveryRecord) error {
+	if record.Created.IsZero() {
+		record.Created = time.Now()
+	}
+	result, err := s.db.Exec(
+		`INSERT INTO deliveries (queue_id, message_id, sender, recipient, status, remote_host, detail, attempts, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		record.QueueID, record.MessageID, record.Sender, strings.ToLower(record.Recipient), record.Status,
+		record.RemoteHost, record.Detail, record.Attempts, record.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar entrega: %w", err)
 	}
-	attachment.ID = id
 
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID do registro de entrega: %w", err)
+	}
+	record.ID = id
 	return nil
 }
 
-func (s *SQLiteStorage) GetAttachments(messageID int64) ([]*Attachment, error) {
+func (s *SQLiteStorage) ListDeliveries(query string, limit int) ([]*DeliveryRecord, error) {
+	var rows *sql.Rows
+	var err error
+	if query == "" {
+		rows, err = s.db.Query("SELECT "+deliveryColumns+" FROM deliveries ORDER BY id DESC LIMIT ?", limit)
+	} else {
+		args := append(deliveryQueryArgs(query), limit)
+		rows, err = s.db.Query(
+			"SELECT "+deliveryColumns+" FROM deliveries WHERE queue_id = ? OR message_id IN (?, ?) OR LOWER(sender) = ? OR recipient = ? ORDER BY id DESC LIMIT ?",
+			args...,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar entregas: %w", err)
+	}
+	defer rows.Close()
+
+	var records []*DeliveryRecord
+	for rows.Next() {
+		record, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre entregas: %w", err)
+	}
+
+	// A consulta parte dos registros mais recentes; o resultado segue a ordem
+	// em que as entregas ocorreram
+	for i, j := 0, len(records)-1; i < j; i, j = i+1, j-1 {
+		records[i], records[j] = records[j], records[i]
+	}
+	return records, nil
+}
+
+// Implementações da fila de webhooks
+
+// EnqueueWebhook grava um evento na fila de webhooks
+func (s *SQLiteStorage) EnqueueWebhook(event *WebhookEvent) error {
+	event.Created = time.Now()
+	if event.NextAttempt.IsZero() {
+		event.NextAttempt = event.Created
+	}
+	result, err := s.db.Exec(
+		"INSERT INTO webhook_outbox (event_id, hook, payload, attempts, next_attempt, created) VALUES (?, ?, ?, ?, ?, ?)",
+		event.EventID, event.Hook, event.Payload, event.Attempts, event.NextAttempt, event.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao enfileirar webhook: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID do evento de webhook: %w", err)
+	}
+	event.ID = id
+	return nil
+}
+
+func (s *SQLiteStorage) PendingWebhooks(now time.Time, limit int) ([]*WebhookEvent, error) {
 	rows, err := s.db.Query(
-		"SELECT id, message_id, filename, mime_type, data, size, created FROM attachments WHERE message_id = ?",
-		messageID,
+		"SELECT "+webhookEventColumns+" FROM webhook_outbox WHERE next_attempt <= ? ORDER BY id LIMIT ?",
+		now, limit,
 	)
 	if err != nil {
-		return nil, fmt.Errorf("falha ao obter anexos: %w", err)
+		return nil, fmt.Errorf("falha ao listar webhooks pendentes: %w", err)
 	}
 	defer rows.Close()
 
-	var attachments []*Attachment
+	var events []*WebhookEvent
 	for rows.Next() {
-		att := &Attachment{}
-		if err := rows.Scan(&att.ID, &att.MessageID, &att.Filename, &att.MimeType, &att.Data, &att.Size, &att.Created); err != nil {
-			return nil, fmt.Errorf("falha ao ler dados do anexo: %w", err)
+		event, err := scanWebhookEvent(rows)
+		if err != nil {
+			return nil, err
 		}
-		attachments = append(attachments, att)
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("erro ao iterar sobre webhooks pendentes: %w", err)
+	}
+	return events, nil
+}
+
+// RescheduleWebhook agenda uma nova tentativa do evento
+func (s *SQLiteStorage) RescheduleWebhook(eventID int64, attempts int, next time.Time) error {
+	_, err := s.db.Exec("UPDATE webhook_outbox SET attempts = ?, next_attempt = ? WHERE id = ?", attempts, next, eventID)
+	if err != nil {
+		return fmt.Errorf("falha ao reagendar webhook: %w", err)
+	}
+	return nil
+}
+
+func (s *SQLiteStorage) DeleteWebhook(eventID int64) error {
+	_, err := s.db.Exec("DELETE FROM webhook_outbox WHERE id = ?", eventID)
+	if err != nil {
+		return fmt.Errorf("falha ao remover webhook da fila: %w", err)
+	}
+	return nil
+}
+
+// RecordWebhookDelivery acrescenta uma tentativa ao histórico de webhooks
+func (s *SQLiteStorage) RecordWebhookDelivery(delivery *WebhookDelivery) error {
+	if delivery.Created.IsZero() {
+		delivery.Created = time.Now()
+	}
+	result, err := s.db.Exec(
+		`INSERT INTO webhook_deliveries (event_id, hook, url, status, status_code, detail, attempt, created)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		delivery.EventID, delivery.Hook, delivery.URL, delivery.Status, delivery.StatusCode, delivery.Detail,
+		delivery.Attempt, delivery.Created,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar chamada de webhook: %w", err)
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("falha ao obter ID do registro de webhook: %w", err)
+	}
+	delivery.ID = id
+	return nil
+}
+
+func (s *SQLiteStorage) ListWebhookDeliveries(query string, limit int) ([]*WebhookDelivery, error) {
+	var rows *sql.Rows
+	var err error
+	if query == "" {
+		rows, err = s.db.Query("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries ORDER BY id DESC LIMIT ?", limit)
+	} else {
+		rows, err = s.db.Query(
+			"SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE hook = ? OR event_id = ? ORDER BY id DESC LIMIT ?",
+			query, query, limit,
+		)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("falha ao listar chamadas de webhook: %w", err)
 	}
+	defer rows.Close()
 
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("erro ao iterar sobre anexos: %w", err)
+		return nil, fmt.Errorf("erro ao iterar sobre chamadas de webhook: %w", err)
 	}
 
-	return attachments, nil
+	for i, j := 0, len(deliveries)-1; i < j; i, j = i+1, j-1 {
+		deliveries[i], deliveries[j] = deliveries[j], deliveries[i]
+	}
+	return deliveries, nil
 }
 
-func (s *SQLiteStorage) DeleteAttachment(attachmentID int64) error {
-	_, err := s.db.Exec("DELETE FROM attachments WHERE id = ?", attachmentID)
+// Implementações do classificador bayesiano
+
+// GetBayesStats retorna o número de mensagens treinadas no classificador
+func (s *SQLiteStorage) GetBayesStats(userID int64) (*BayesStats, error) {
+	stats := &BayesStats{}
+	err := s.db.QueryRow("SELECT spam, ham FROM bayes_stats WHERE user_id = ?", userID).Scan(&stats.Spam, &stats.Ham)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("falha ao obter estatísticas do classificador: %w", err)
+	}
+	return stats, nil
+}
+
+// GetBayesTokens retorna as contagens dos tokens conhecidos pelo
+// classificador; tokens nunca vistos não aparecem no resultado
+func (s *SQLiteStorage) GetBayesTokens(userID int64, tokens []string) (map[string]*BayesToken, error) {
+	result := make(map[string]*BayesToken)
+	for start := 0; start < len(tokens); start += bayesBatchSize {
+		end := start + bayesBatchSize
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		batch := tokens[start:end]
+		args := []interface{}{userID}
+		for _, token := range batch {
+			args = append(args, token)
+		}
+
+		rows, err := s.db.Query(
+			"SELECT token, spam, ham FROM bayes_tokens WHERE user_id = ? AND token IN ("+strings.TrimSuffix(strings.Repeat("?, ", len(batch)), ", ")+")",
+			args...,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("falha ao consultar tokens do classificador: %w", err)
+		}
+		for rows.Next() {
+			token := &BayesToken{}
+			if err := rows.Scan(&token.Token, &token.Spam, &token.Ham); err != nil {
+				rows.Close()
+				return nil, fmt.Errorf("falha ao ler token do classificador: %w", err)
+			}
+			result[token.Token] = token
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return nil, fmt.Errorf("erro ao iterar sobre tokens do classificador: %w", err)
+		}
+	}
+	return result, nil
+}
+
+// TrainBayes treina o classificador com a mensagem
+func (s *SQLiteStorage) TrainBayes(userID int64, digest string, tokens []string, spam bool) error {
+	tx, err := s.db.Begin()
 	if err != nil {
-		return fmt.Errorf("falha ao excluir anexo: %w", err)
+		return fmt.Errorf("falha ao iniciar transação: %w", err)
+	}
+	defer tx.Rollback()
+
+	var previous bool
+	err = tx.QueryRow("SELECT spam FROM bayes_trained WHERE user_id = ? AND digest = ?", userID, digest).Scan(&previous)
+	switch {
+	case err == nil && previous == spam:
+		return nil
+	case err == nil:
+		if err := s.countBayes(tx, userID, tokens, previous, -1); err != nil {
+			return err
+		}
+	case err != sql.ErrNoRows:
+		return fmt.Errorf("falha ao consultar treino do classificador: %w", err)
+	}
+
+	if err := s.countBayes(tx, userID, tokens, spam, 1); err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO bayes_trained (user_id, digest, spam) VALUES (?, ?, ?)
+		ON CONFLICT (user_id, digest) DO UPDATE SET spam = excluded.spam`,
+		userID, digest, spam,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao registrar treino do classificador: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// countBayes soma delta às contagens da classe para a mensagem e seus tokens
+func (s *SQLiteStorage) countBayes(tx *sql.Tx, userID int64, tokens []string, spam bool, delta int) error {
+	column := bayesColumn(spam)
+	_, err := tx.Exec("INSERT INTO bayes_stats (user_id, spam, ham) VALUES (?, 0, 0) ON CONFLICT (user_id) DO NOTHING", userID)
+	if err == nil {
+		_, err = tx.Exec("UPDATE bayes_stats SET "+column+" = MAX("+column+" + ?, 0) WHERE user_id = ?", delta, userID)
+	}
+	if err != nil {
+		return fmt.Errorf("falha ao atualizar estatísticas do classificador: %w", err)
+	}
+
+	stmt, err := tx.Prepare(
+		`INSERT INTO bayes_tokens (user_id, token, spam, ham) VALUES (?, ?, 0, 0) ON CONFLICT (user_id, token) DO NOTHING`,
+	)
+	if err != nil {
+		return fmt.Errorf("falha ao preparar atualização de tokens: %w", err)
+	}
+	defer stmt.Close()
+	update, err := tx.Prepare("UPDATE bayes_tokens SET " + column + " = MAX(" + column + " + ?, 0) WHERE user_id = ? AND token = ?")
+	if err != nil {
+		return fmt.Errorf("falha ao preparar atualização de tokens: %w", err)
+	}
+	defer update.Close()
+
+	for _, token := range tokens {
+		if delta > 0 {
+			if _, err := stmt.Exec(userID, token); err != nil {
+				return fmt.Errorf("falha ao atualizar token do classificador: %w", err)
+			}
+		}
+		if _, err := update.Exec(delta, userID, token); err != nil {
+			return fmt.Errorf("falha ao atualizar token do classificador: %w", err)
+		}
+	}
+
+	if delta < 0 {
+		_, err := tx.Exec("DELETE FROM bayes_tokens WHERE user_id = ? AND spam = 0 AND ham = 0", userID)
+		if err != nil {
+			return fmt.Errorf("falha ao remover tokens do classificador: %w", err)
+		}
 	}
 	return nil
-} 
\ No newline at end of file
+}
@@ -1,8 +1,12 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/carloslauriano/simpleEmail/config"
 )
@@ -16,6 +20,30 @@ var ErrMailboxNotFound = errors.New("caixa de correio não encontrada")
 // ErrMessageNotFound é retornado quando uma mensagem não é encontrada
 var ErrMessageNotFound = errors.New("mensagem não encontrada")
 
+// ErrThreadNotFound é retornado quando uma conversa não é encontrada
+var ErrThreadNotFound = errors.New("conversa não encontrada")
+
+// ErrAliasNotFound é retornado quando um alias não é encontrado
+var ErrAliasNotFound = errors.New("alias não encontrado")
+
+// ErrDomainNotFound é retornado quando um domínio não é encontrado
+var ErrDomainNotFound = errors.New("domínio não encontrado")
+
+// ErrForwardingNotFound é retornado quando o usuário não possui encaminhamento
+var ErrForwardingNotFound = errors.New("encaminhamento não encontrado")
+
+// ErrVacationNotFound é retornado quando o usuário não possui resposta de ausência
+var ErrVacationNotFound = errors.New("resposta de ausência não encontrada")
+
+// ErrSieveScriptNotFound é retornado quando um script Sieve não é encontrado
+var ErrSieveScriptNotFound = errors.New("script sieve não encontrado")
+
+// ErrSieveScriptExists é retornado ao renomear um script para um nome já usado
+var ErrSieveScriptExists = errors.New("script sieve já existe")
+
+// ErrDomainDisabled é retornado quando o domínio do usuário está desativado
+var ErrDomainDisabled = errors.New("domínio desativado")
+
 // Storage é a interface para operações de armazenamento
 type Storage interface {
 	// Métodos de inicialização
@@ -28,6 +56,16 @@ type Storage interface {
 	UpdateUser(user *User) error
 	DeleteUser(userID int64) error
 	AuthenticateUser(username, password string) (*User, error)
+	GetUserByEmail(email string) (*User, error)
+	GetUserByID(userID int64) (*User, error)
+
+	// Métodos de domínio
+	CreateDomain(domain *Domain) error
+	GetDomain(name string) (*Domain, error)
+	GetDomainByID(domainID int64) (*Domain, error)
+	ListDomains() ([]*Domain, error)
+	UpdateDomain(domain *Domain) error
+	DeleteDomain(domainID int64) error
 
 	// Métodos de caixa de correio
 	CreateMailbox(mailbox *Mailbox) error
@@ -35,18 +73,142 @@ type Storage interface {
 	ListMailboxes(userID int64) ([]*Mailbox, error)
 	DeleteMailbox(mailboxID int64) error
 	UpdateMailbox(mailbox *Mailbox) error
+	RenameMailbox(userID int64, oldName, newName string) error
+	GetMailboxByID(mailboxID int64) (*Mailbox, error)
+
+	// Métodos de controle de acesso às caixas (RFC 4314). Uma entrada com
+	// direitos vazios é removida.
+	SetMailboxACL(acl *MailboxACL) error
+	DeleteMailboxACL(mailboxID int64, identifier string) error
+	ListMailboxACL(mailboxID int64) ([]*MailboxACL, error)
+	ListACLByIdentifier(identifier string) ([]*MailboxACL, error)
+
+	// Métodos de assinatura de caixas. Assinaturas são guardadas por nome e
+	// podem referir-se a caixas inexistentes (RFC 3501, seção 6.3.6).
+	SubscribeMailbox(userID int64, name string) error
+	UnsubscribeMailbox(userID int64, name string) error
+	ListSubscriptions(userID int64) ([]string, error)
 
 	// Métodos de mensagem
 	CreateMessage(message *Message) error
+	// CreateMessages grava as mensagens atomicamente (MULTIAPPEND, RFC 3502)
+	CreateMessages(messages []*Message) error
 	GetMessage(mailboxID int64, uid uint32) (*Message, error)
+	GetMessageByID(messageID int64) (*Message, error)
 	ListMessages(mailboxID int64) ([]*Message, error)
 	UpdateMessageFlags(messageID int64, flags string, seen, deleted, draft bool) error
 	DeleteMessage(messageID int64) error
-	
+	// MoveMessage move a mensagem para outra caixa sem mudar seu ID: a origem
+	// registra a remoção do UID e o destino atribui um novo UID
+	MoveMessage(messageID, mailboxID int64) error
+	// MoveMessages move várias mensagens atomicamente e retorna os UIDs
+	// atribuídos no destino, na mesma ordem
+	MoveMessages(messageIDs []int64, mailboxID int64) ([]uint32, error)
+
+	// ListExpunged lista os UIDs removidos da caixa com sequência de
+	// modificação maior que sinceModSeq, para respostas VANISHED (RFC 7162)
+	ListExpunged(mailboxID int64, sinceModSeq uint64) ([]uint32, error)
+	// ListExpungedMessages lista as remoções com o ID da mensagem removida ou
+	// movida, para os métodos /changes do JMAP (RFC 8620, seção 5.2)
+	ListExpungedMessages(mailboxID int64, sinceModSeq uint64) ([]*ExpungedMessage, error)
+
+	// Métodos de contadores de caixa, que não leem o conteúdo das mensagens.
+	// ClaimRecent reivindica para a sessão as mensagens ainda não vistas por
+	// nenhuma outra, até lastUID, e retorna o primeiro UID reivindicado ou
+	// zero (RFC 3501, seção 2.3.2).
+	GetMailboxCounters(mailboxID int64) (*MailboxCounters, error)
+	ListMessageUIDs(mailboxID int64) ([]uint32, error)
+	ClaimRecent(mailboxID int64, lastUID uint32) (uint32, error)
+
+	// Métodos de conversa. Cada mensagem recebe uma conversa em CreateMessage;
+	// ListThreads ordena as conversas da mais recente para a mais antiga e
+	// GetThread retorna as mensagens da conversa em ordem de data.
+	ListThreads(userID int64) ([]*Thread, error)
+	GetThread(userID, threadID int64) ([]*Message, error)
+
+	// Métodos de cota
+	GetUserUsage(userID int64) (*Usage, error)
+	GetDomainUsage(domainID int64) (*Usage, error)
+
 	// Métodos de anexo
 	CreateAttachment(attachment *Attachment) error
 	GetAttachments(messageID int64) ([]*Attachment, error)
 	DeleteAttachment(attachmentID int64) error
+
+	// Métodos de alias
+	CreateAlias(alias *Alias) error
+	GetAlias(address string) (*Alias, error)
+	ListAliases() ([]*Alias, error)
+	DeleteAlias(aliasID int64) error
+
+	// Métodos de encaminhamento
+	SetForwarding(forwarding *Forwarding) error
+	GetForwarding(userID int64) (*Forwarding, error)
+	DeleteForwarding(userID int64) error
+
+	// Configurações geradas pelo próprio servidor, como o segredo SRS.
+	// InitSetting grava o valor apenas se a configuração ainda não existir e
+	// retorna o valor armazenado.
+	InitSetting(name, value string) (string, error)
+
+	// Métodos da fila persistente de entrega externa. PendingOutbound
+	// retorna, em ordem de chegada, as mensagens cuja próxima tentativa já
+	// venceu; UpdateOutbound grava os destinatários pendentes, as tentativas
+	// e o próximo agendamento.
+	EnqueueOutbound(msg *OutboundMessage) error
+	PendingOutbound(now time.Time, limit int) ([]*OutboundMessage, error)
+	UpdateOutbound(msg *OutboundMessage) error
+	DeleteOutbound(id int64) error
+
+	// Métodos de resposta de ausência. As respostas enviadas são registradas
+	// por remetente e identificador, para limitar a frequência (RFC 3834).
+	SetVacation(vacation *Vacation) error
+	GetVacation(userID int64) (*Vacation, error)
+	DeleteVacation(userID int64) error
+	LastVacationReply(userID int64, sender, handle string) (time.Time, error)
+	RecordVacationReply(userID int64, sender, handle string, sent time.Time) error
+
+	// Métodos de scripts Sieve
+	PutSieveScript(script *SieveScript) error
+	GetSieveScript(userID int64, name string) (*SieveScript, error)
+	GetActiveSieveScript(userID int64) (*SieveScript, error)
+	ListSieveScripts(userID int64) ([]*SieveScript, error)
+	SetActiveSieveScript(userID int64, name string) error
+	RenameSieveScript(userID int64, oldName, newName string) error
+	DeleteSieveScript(userID int64, name string) error
+	// Métodos de envios JMAP. ListEmailSubmissions retorna os envios do
+	// usuário em ordem de criação.
+	CreateEmailSubmission(submission *EmailSubmission) error
+	ListEmailSubmissions(userID int64) ([]*EmailSubmission, error)
+
+	// Métodos do histórico de entregas externas. ListDeliveries retorna, em
+	// ordem cronológica, os registros mais recentes (até limit) cujo
+	// identificador na fila, Message-ID (com ou sem <>), remetente ou
+	// destinatário corresponde a query; query vazia lista todos.
+	RecordDelivery(record *DeliveryRecord) error
+	ListDeliveries(query string, limit int) ([]*DeliveryRecord, error)
+
+	// Métodos da fila persistente de webhooks. PendingWebhooks retorna, em
+	// ordem de criação, os eventos cuja próxima tentativa já venceu; eventos
+	// entregues ou abandonados são removidos com DeleteWebhook.
+	EnqueueWebhook(event *WebhookEvent) error
+	PendingWebhooks(now time.Time, limit int) ([]*WebhookEvent, error)
+	RescheduleWebhook(eventID int64, attempts int, next time.Time) error
+	DeleteWebhook(eventID int64) error
+
+	// Métodos do histórico de webhooks. ListWebhookDeliveries retorna, em
+	// ordem cronológica, as tentativas mais recentes (até limit) do webhook
+	// ou evento informado em query; query vazia lista todas.
+	RecordWebhookDelivery(delivery *WebhookDelivery) error
+	ListWebhookDeliveries(query string, limit int) ([]*WebhookDelivery, error)
+
+	// Métodos do classificador bayesiano. userID zero identifica o
+	// classificador global. TrainBayes registra a mensagem identificada por
+	// digest como spam ou não spam: uma mensagem já treinada na mesma classe é
+	// ignorada, e na classe oposta tem o treino anterior desfeito.
+	GetBayesStats(userID int64) (*BayesStats, error)
+	GetBayesTokens(userID int64, tokens []string) (map[string]*BayesToken, error)
+	TrainBayes(userID int64, digest string, tokens []string, spam bool) error
 }
 
 // NewStorage cria uma nova instância de armazenamento com base na configuração
@@ -59,4 +221,356 @@ func NewStorage(cfg *config.Config) (Storage, error) {
 	default:
 		return nil, fmt.Errorf("tipo de banco de dados não suportado: %s", cfg.Database.Type)
 	}
-} 
\ No newline at end of file
+}
+
+// migration é uma alteração de esquema para bancos criados por versões
+// anteriores. Bancos novos já recebem o esquema completo, então cada
+// migração verifica se a alteração ainda é necessária.
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx) error
+}
+
+// runMigrations aplica, em ordem e cada uma em sua transação, as migrações
+// com versão maior que a última registrada em schema_version
+func runMigrations(conn *sql.Conn, migrations []migration, recordVersion string) error {
+	ctx := context.Background()
+	var current int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current); err != nil {
+		return fmt.Errorf("falha ao obter versão do esquema: %w", err)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("falha ao iniciar migração %d: %w", m.version, err)
+		}
+		if err := m.apply(tx); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("falha na migração %d (%s): %w", m.version, m.description, err)
+		}
+		if _, err := tx.Exec(recordVersion, m.version, time.Now()); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("falha ao registrar migração %d: %w", m.version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("falha ao concluir migração %d: %w", m.version, err)
+		}
+	}
+	return nil
+}
+
+// nullInt64 converte IDs opcionais (zero significa ausente) em NULL
+func nullInt64(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
+}
+
+// nullTime converte datas opcionais (zero significa ausente) em NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// rowScanner abstrai *sql.Row e *sql.Rows para as funções de leitura
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// userColumns lista as colunas lidas por scanUser
+const userColumns = "id, domain_id, username, password, name, email, quota_bytes, quota_messages, created, updated"
+
+// scanUser lê um usuário a partir das colunas em userColumns
+func scanUser(row rowScanner) (*User, error) {
+	user := &User{}
+	err := row.Scan(&user.ID, &user.DomainID, &user.Username, &user.Password, &user.Name, &user.Email,
+		&user.QuotaBytes, &user.QuotaMessages, &user.Created, &user.Updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrUserNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter usuário: %w", err)
+	}
+	return user, nil
+}
+
+// MailboxDelimiter separa os níveis da hierarquia de caixas de correio
+const MailboxDelimiter = "/"
+
+// DefaultMailboxes são as caixas criadas para cada novo usuário, com seus
+// atributos de uso especial
+var DefaultMailboxes = []Mailbox{
+	{Name: "INBOX"},
+	{Name: "Sent", SpecialUse: `\Sent`},
+	{Name: "Drafts", SpecialUse: `\Drafts`},
+	{Name: "Trash", SpecialUse: `\Trash`},
+	{Name: "Junk", SpecialUse: `\Junk`},
+	{Name: "Archive", SpecialUse: `\Archive`},
+}
+
+// mailboxColumns lista as colunas lidas por scanMailbox
+const mailboxColumns = "id, user_id, name, path, special_use, noselect, uid_next, highest_modseq"
+
+// scanMailbox lê uma caixa de correio a partir das colunas em mailboxColumns
+func scanMailbox(row rowScanner) (*Mailbox, error) {
+	mailbox := &Mailbox{}
+	err := row.Scan(&mailbox.ID, &mailbox.UserID, &mailbox.Name, &mailbox.Path, &mailbox.SpecialUse, &mailbox.NoSelect,
+		&mailbox.UIDNext, &mailbox.HighestModSeq)
+	if err == sql.ErrNoRows {
+		return nil, ErrMailboxNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter caixa de correio: %w", err)
+	}
+	return mailbox, nil
+}
+
+// messageColumns lista as colunas lidas por scanMessage
+const messageColumns = `id, mailbox_id, uid, from_addr, to_addr, cc, subject, message_id, in_reply_to, refs,
+	thread_id, date, body, raw_data, flags, size, seen, deleted, draft, modseq, created`
+
+// scanMessage lê uma mensagem a partir das colunas em messageColumns
+func scanMessage(row rowScanner) (*Message, error) {
+	msg := &Message{}
+	err := row.Scan(
+		&msg.ID, &msg.MailboxID, &msg.UID, &msg.From, &msg.To,
+		&msg.Cc, &msg.Subject, &msg.MessageID, &msg.InReplyTo, &msg.References,
+		&msg.ThreadID, &msg.Date, &msg.Body, &msg.RawData,
+		&msg.Flags, &msg.Size, &msg.Seen, &msg.Deleted, &msg.Draft, &msg.ModSeq, &msg.Created,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrMessageNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao ler dados da mensagem: %w", err)
+	}
+	return msg, nil
+}
+
+// threadColumns lista as colunas lidas por scanThread, com as mensagens da
+// conversa agregadas por GROUP BY
+const threadColumns = "t.id, t.user_id, t.subject, COUNT(m.id), t.created, t.updated"
+
+// scanThread lê uma conversa a partir das colunas em threadColumns
+func scanThread(row rowScanner) (*Thread, error) {
+	thread := &Thread{}
+	err := row.Scan(&thread.ID, &thread.UserID, &thread.Subject, &thread.Messages, &thread.Created, &thread.Updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrThreadNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter conversa: %w", err)
+	}
+	return thread, nil
+}
+
+// threadReferences retorna os identificadores que ligam a mensagem a uma
+// conversa: os de References e In-Reply-To, seguidos do próprio Message-ID
+func threadReferences(message *Message) []string {
+	var refs []string
+	seen := make(map[string]bool)
+	add := func(id string) {
+		if id != "" && !seen[id] {
+			seen[id] = true
+			refs = append(refs, id)
+		}
+	}
+	for _, id := range strings.Fields(message.References) {
+		add(id)
+	}
+	add(message.InReplyTo)
+	add(message.MessageID)
+	return refs
+}
+
+// threadSubject normaliza o assunto para agrupar conversas, removendo
+// prefixos de resposta e encaminhamento e marcadores como "[lista]".
+// reply informa se algum prefixo de resposta ou encaminhamento foi removido.
+func threadSubject(subject string) (base string, reply bool) {
+	base = strings.ToLower(strings.Join(strings.Fields(subject), " "))
+	for {
+		trimmed := base
+		if strings.HasPrefix(trimmed, "[") {
+			if i := strings.Index(trimmed, "]"); i > 0 {
+				trimmed = strings.TrimSpace(trimmed[i+1:])
+			}
+		}
+		for _, prefix := range []string{"re:", "fw:", "fwd:", "res:", "enc:"} {
+			if strings.HasPrefix(trimmed, prefix) {
+				trimmed = strings.TrimSpace(trimmed[len(prefix):])
+				reply = true
+			}
+		}
+		if trimmed == base {
+			return base, reply
+		}
+		base = trimmed
+	}
+}
+
+// domainColumns lista as colunas lidas por scanDomain
+const domainColumns = "id, name, enabled, catch_all, quota_bytes, quota_messages, dkim_selector, dkim_private_key, created, updated"
+
+// scanDomain lê um domínio a partir das colunas em domainColumns
+func scanDomain(row rowScanner) (*Domain, error) {
+	domain := &Domain{}
+	var catchAll, selector, key sql.NullString
+	err := row.Scan(&domain.ID, &domain.Name, &domain.Enabled, &catchAll, &domain.QuotaBytes, &domain.QuotaMessages,
+		&selector, &key, &domain.Created, &domain.Updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrDomainNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter domínio: %w", err)
+	}
+	domain.CatchAll = catchAll.String
+	domain.DKIMSelector = selector.String
+	domain.DKIMPrivateKey = key.String
+	return domain, nil
+}
+
+// outboundColumns lista as colunas lidas por scanOutbound
+const outboundColumns = "id, queue_id, sender, recipients, dsn, message_id, data, delayed, attempts, next_attempt, created"
+
+// scanOutbound lê uma mensagem da fila a partir das colunas em outboundColumns
+func scanOutbound(row rowScanner) (*OutboundMessage, error) {
+	msg := &OutboundMessage{}
+	var recipients, delayed string
+	err := row.Scan(&msg.ID, &msg.QueueID, &msg.Sender, &recipients, &msg.DSN, &msg.MessageID, &msg.Data,
+		&delayed, &msg.Attempts, &msg.NextAttempt, &msg.Created)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler mensagem da fila de entrega: %w", err)
+	}
+	msg.Recipients = splitAddressList(recipients)
+	msg.Delayed = splitAddressList(delayed)
+	return msg, nil
+}
+
+// joinAddressList e splitAddressList convertem listas de endereços para a
+// forma gravada na fila, um endereço por linha
+func joinAddressList(addresses []string) string {
+	return strings.Join(addresses, "\n")
+}
+
+func splitAddressList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, "\n")
+}
+
+// vacationColumns lista as colunas lidas por scanVacation
+const vacationColumns = "user_id, enabled, subject, body, start_date, end_date, addresses, days, updated"
+
+// scanVacation lê uma resposta de ausência a partir das colunas em vacationColumns
+func scanVacation(row rowScanner) (*Vacation, error) {
+	vacation := &Vacation{}
+	var start, end sql.NullTime
+	err := row.Scan(&vacation.UserID, &vacation.Enabled, &vacation.Subject, &vacation.Body, &start, &end,
+		&vacation.Addresses, &vacation.Days, &vacation.Updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrVacationNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter resposta de ausência: %w", err)
+	}
+	vacation.Start = start.Time
+	vacation.End = end.Time
+	return vacation, nil
+}
+
+// sieveScriptColumns lista as colunas lidas por scanSieveScript
+const sieveScriptColumns = "id, user_id, name, content, active, created, updated"
+
+// scanSieveScript lê um script a partir das colunas em sieveScriptColumns
+func scanSieveScript(row rowScanner) (*SieveScript, error) {
+	script := &SieveScript{}
+	err := row.Scan(&script.ID, &script.UserID, &script.Name, &script.Content, &script.Active, &script.Created, &script.Updated)
+	if err == sql.ErrNoRows {
+		return nil, ErrSieveScriptNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("falha ao obter script sieve: %w", err)
+	}
+	return script, nil
+}
+
+// emailSubmissionColumns lista as colunas lidas por scanEmailSubmission
+const emailSubmissionColumns = "id, user_id, message_id, thread_id, mail_from, recipients, queue_id, send_at"
+
+// scanEmailSubmission lê um envio a partir das colunas em emailSubmissionColumns
+func scanEmailSubmission(row rowScanner) (*EmailSubmission, error) {
+	submission := &EmailSubmission{}
+	var recipients string
+	err := row.Scan(&submission.ID, &submission.UserID, &submission.MessageID, &submission.ThreadID,
+		&submission.MailFrom, &recipients, &submission.QueueID, &submission.SendAt)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler envio: %w", err)
+	}
+	submission.Recipients = splitAddressList(recipients)
+	return submission, nil
+}
+
+// deliveryColumns lista as colunas lidas por scanDelivery
+const deliveryColumns = "id, queue_id, message_id, sender, recipient, status, remote_host, detail, attempts, created"
+
+// scanDelivery lê um registro de entrega a partir das colunas em deliveryColumns
+func scanDelivery(row rowScanner) (*DeliveryRecord, error) {
+	record := &DeliveryRecord{}
+	err := row.Scan(&record.ID, &record.QueueID, &record.MessageID, &record.Sender, &record.Recipient,
+		&record.Status, &record.RemoteHost, &record.Detail, &record.Attempts, &record.Created)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler registro de entrega: %w", err)
+	}
+	return record, nil
+}
+
+// deliveryQueryArgs retorna os argumentos da busca no histórico de entregas,
+// na ordem queue_id, message_id (duas formas), sender e recipient
+func deliveryQueryArgs(query string) []interface{} {
+	id := strings.Trim(query, "<>")
+	address := strings.ToLower(query)
+	return []interface{}{query, id, "<" + id + ">", address, address}
+}
+
+// webhookEventColumns lista as colunas lidas por scanWebhookEvent
+const webhookEventColumns = "id, event_id, hook, payload, attempts, next_attempt, created"
+
+// scanWebhookEvent lê um evento a partir das colunas em webhookEventColumns
+func scanWebhookEvent(row rowScanner) (*WebhookEvent, error) {
+	event := &WebhookEvent{}
+	err := row.Scan(&event.ID, &event.EventID, &event.Hook, &event.Payload, &event.Attempts, &event.NextAttempt, &event.Created)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler evento de webhook: %w", err)
+	}
+	return event, nil
+}
+
+// webhookDeliveryColumns lista as colunas lidas por scanWebhookDelivery
+const webhookDeliveryColumns = "id, event_id, hook, url, status, status_code, detail, attempt, created"
+
+// scanWebhookDelivery lê uma tentativa a partir das colunas em webhookDeliveryColumns
+func scanWebhookDelivery(row rowScanner) (*WebhookDelivery, error) {
+	delivery := &WebhookDelivery{}
+	err := row.Scan(&delivery.ID, &delivery.EventID, &delivery.Hook, &delivery.URL, &delivery.Status,
+		&delivery.StatusCode, &delivery.Detail, &delivery.Attempt, &delivery.Created)
+	if err != nil {
+		return nil, fmt.Errorf("falha ao ler registro de webhook: %w", err)
+	}
+	return delivery, nil
+}
+
+// bayesBatchSize limita os tokens consultados em cada SELECT ... IN
+const bayesBatchSize = 500
+
+// bayesColumn retorna a coluna de contagem da classe
+func bayesColumn(spam bool) string {
+	if spam {
+		return "spam"
+	}
+	return "ham"
+}
+
+// splitLogin separa um login no formato usuario@dominio
+func splitLogin(login string) (username, domain string, ok bool) {
+	i := strings.LastIndex(login, "@")
+	if i <= 0 || i == len(login)-1 {
+		return login, "", false
+	}
+	return login[:i], strings.ToLower(login[i+1:]), true
+}